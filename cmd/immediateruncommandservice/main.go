@@ -1,9 +1,14 @@
+//go:build !slim
+
 package main
 
 import (
 	"os"
 
 	"github.com/Azure/run-command-handler-linux/internal/immediateruncommand"
+	"github.com/Azure/run-command-handler-linux/pkg/logdedup"
+	"github.com/Azure/run-command-handler-linux/pkg/loglevel"
+	"github.com/Azure/run-command-handler-linux/pkg/logsanitizer"
 	"github.com/Azure/run-command-handler-linux/pkg/versionutil"
 	"github.com/go-kit/kit/log"
 )
@@ -21,8 +26,8 @@ func main() {
 	// After starting the program, vars from versionutil.go must be set in order to share those values across the program.
 	versionutil.Initialize(Version, GitCommit, BuildDate, GitState)
 
-	ctx := log.NewContext(log.NewSyncLogger(log.NewLogfmtLogger(
-		os.Stdout))).With("time", log.DefaultTimestamp).With("version", versionutil.VersionString())
+	dedup := logdedup.NewLogger(logsanitizer.NewLogger(log.NewSyncLogger(log.NewLogfmtLogger(os.Stdout))), logdedup.DefaultWindow)
+	ctx := log.NewContext(loglevel.NewLogger(dedup)).With("time", log.DefaultTimestamp).With("version", versionutil.VersionString())
 	ctx = ctx.With("operation", "runService")
-	immediateruncommand.StartImmediateRunCommand(ctx)
+	immediateruncommand.StartImmediateRunCommand(ctx, dedup.Flush)
 }
@@ -3,11 +3,14 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	commands "github.com/Azure/run-command-handler-linux/internal/cmds"
 	"github.com/Azure/run-command-handler-linux/internal/commandProcessor"
 	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/Azure/run-command-handler-linux/pkg/logsanitizer"
 	"github.com/Azure/run-command-handler-linux/pkg/versionutil"
+	"github.com/go-kit/kit/log"
 )
 
 // These fields are populated by govvv at compile-time.
@@ -23,6 +26,26 @@ func main() {
 	// After starting the program, vars from versionutil.go must be set in order to share those values across the program.
 	versionutil.Initialize(Version, GitCommit, BuildDate, GitState)
 
+	// Service subcommands are invoked by operators rather than the agent, so they are handled separately
+	if len(os.Args) >= 2 {
+		if os.Args[1] == commands.LogsCmdName {
+			runLogsCmd(os.Args)
+			return
+		}
+		switch os.Args[1] {
+		case commands.ExportStateCmdName, commands.ImportStateCmdName, commands.ResetStateCmdName:
+			runStateCmd(os.Args)
+			return
+		case commands.ProvisionCmdName:
+			runProvisionCmd(os.Args)
+			return
+		}
+		if serviceCmd, ok := commands.ServiceCmds[os.Args[1]]; ok {
+			runServiceCmd(serviceCmd, os.Args)
+			return
+		}
+	}
+
 	// parse command line arguments
 	cmd := parseCmd(os.Args)
 	err := commandProcessor.ProcessHandlerCommand(cmd)
@@ -54,11 +77,81 @@ func parseCmd(args []string) types.Cmd {
 	return cmd
 }
 
+// runServiceCmd parses the flags of the given service subcommand and invokes it. It exits with
+// code 2 on incorrect usage and code 1 if the subcommand fails.
+func runServiceCmd(serviceCmd commands.ServiceCmd, args []string) {
+	op := args[1]
+	opts, err := commands.ParseServiceCmdOptions(op, args[2:], os.Stdout)
+	if err != nil {
+		printUsage(args)
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	ctx := log.NewContext(logsanitizer.NewLogger(log.NewSyncLogger(log.NewLogfmtLogger(
+		os.Stdout)))).With("time", log.DefaultTimestamp).With("version", versionutil.VersionString())
+	ctx = ctx.With("operation", strings.ToLower(serviceCmd.Name))
+	if err := serviceCmd.Invoke(ctx, opts); err != nil {
+		ctx.Log("event", "failed to handle", "error", err)
+		os.Exit(1)
+	}
+}
+
+// runLogsCmd parses the flags of the logs subcommand and prints the output of the requested run command.
+// It exits with code 2 on incorrect usage and code 1 if the output cannot be printed.
+func runLogsCmd(args []string) {
+	opts, err := commands.ParseLogsCmdOptions(args[2:], os.Stdout)
+	if err != nil {
+		printUsage(args)
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	if err := commands.Logs(opts, os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// runStateCmd parses the flags of the given state subcommand and invokes it. It exits with code 2 on
+// incorrect usage and code 1 if the subcommand fails.
+func runStateCmd(args []string) {
+	op := args[1]
+	opts, err := commands.ParseStateCmdOptions(op, args[2:], os.Stdout)
+	if err != nil {
+		printUsage(args)
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	if err := commands.State(op, opts, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// runProvisionCmd parses the flags of the provision subcommand and executes the run command of the provisioning
+// settings. It exits with code 2 on incorrect usage and code 1 if the run command cannot be executed.
+func runProvisionCmd(args []string) {
+	opts, err := commands.ParseProvisionCmdOptions(args[2:], os.Stdout)
+	if err != nil {
+		printUsage(args)
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	if err := commands.Provision(opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
 // printUsage prints the help string and version of the program to stdout with a
 // trailing new line.
 func printUsage(args []string) {
 	cmds := commands.Cmds
 	printCommandsUsage(cmds)
+	printServiceCommandsUsage(commands.ServiceCmds)
 	fmt.Println(versionutil.DetailedVersionString())
 }
 
@@ -75,3 +168,21 @@ func printCommandsUsage(cmds map[string]types.Cmd) {
 	}
 	fmt.Println()
 }
+
+// printServiceCommandsUsage prints the format needed to launch the service subcommands.
+func printServiceCommandsUsage(cmds map[string]commands.ServiceCmd) {
+	fmt.Printf("       %s ", os.Args[0])
+	i, total := 1, len(cmds)
+	for k := range cmds {
+		fmt.Print(k)
+		if i < total {
+			fmt.Printf("|")
+		}
+		i++
+	}
+	fmt.Println(" [--dry-run] [--unit-path <dir>]")
+	fmt.Printf("       %s %s [--extension <name>] [--follow]\n", os.Args[0], commands.LogsCmdName)
+	fmt.Printf("       %s %s|%s --file <archive>\n", os.Args[0], commands.ExportStateCmdName, commands.ImportStateCmdName)
+	fmt.Printf("       %s %s [--dry-run] [--extension <name>]\n", os.Args[0], commands.ResetStateCmdName)
+	fmt.Printf("       %s %s [--settings <file>] [--status <file>] [--extension <name>]\n", os.Args[0], commands.ProvisionCmdName)
+}
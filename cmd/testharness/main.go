@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Azure/run-command-handler-linux/internal/testharness"
+	"github.com/go-kit/kit/log"
+)
+
+// Entry point of the test harness, driving the handler binary through its lifecycle against fake endpoints
+func main() {
+	var opts testharness.Options
+	flags := flag.NewFlagSet("test-harness", flag.ExitOnError)
+	flags.StringVar(&opts.HandlerPath, "handler", "", "path of the handler binary under test (required)")
+	flags.StringVar(&opts.ServicePath, "service", "", "path of the immediate run command service binary under test, built with the testharness tag, not run if empty")
+	flags.StringVar(&opts.WorkDir, "work-dir", "", "directory to create the environment of the handler in, a temporary one by default")
+	flags.BoolVar(&opts.Keep, "keep", false, "keep the environment of the handler once the run succeeds")
+	flags.BoolVar(&opts.Force, "force", false, "run even though the data directory of the handler exists, uninstall removes it")
+	flags.Parse(os.Args[1:])
+	if opts.HandlerPath == "" {
+		fmt.Fprintf(os.Stderr, "Usage: %s --handler <path> [--service <path>] [--work-dir <dir>] [--keep] [--force]\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	ctx := log.NewContext(log.NewSyncLogger(log.NewLogfmtLogger(os.Stdout))).With("time", log.DefaultTimestamp)
+	if err := testharness.Run(ctx, opts); err != nil {
+		ctx.Log("event", "failed", "error", err)
+		os.Exit(1)
+	}
+	ctx.Log("event", "passed")
+}
@@ -0,0 +1,208 @@
+// Package blobsync keeps a local directory in sync with the blobs of a storage container, so large and mostly
+// unchanged sets of files are not downloaded again every time.
+package blobsync
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/run-command-handler-linux/pkg/download"
+	"github.com/Azure/run-command-handler-linux/pkg/requestheaders"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// ManifestFileName keeps the version of every synced blob, so unchanged blobs are not downloaded again
+const ManifestFileName = ".manifest.json"
+
+// Blob is the version of the content of a blob
+type Blob struct {
+	ETag string `json:"etag"`
+	// MD5 of the content, if known. A blob uploaded again with the same content gets a new ETag but keeps its MD5.
+	MD5 string `json:"md5,omitempty"`
+}
+
+// unchanged reports whether the content of the blob is the same as the synced one
+func (b Blob) unchanged(synced Blob) bool {
+	return b.ETag == synced.ETag || (b.MD5 != "" && b.MD5 == synced.MD5)
+}
+
+// Container lists and downloads the blobs of a container
+type Container interface {
+	// List returns the version of every blob by name
+	List() (map[string]Blob, error)
+	Get(name string) (io.ReadCloser, error)
+}
+
+// Result counts the blobs of a sync by outcome
+type Result struct {
+	Downloaded int
+	Unchanged  int
+	Removed    int
+	Failed     int
+}
+
+// Sync downloads to dir the new and changed blobs of container and removes the files of the blobs no longer in the
+// container. Blobs whose name is rejected by validateName are skipped. A blob failing to download keeps its
+// previous version and is retried on the next sync. Files that were not synced from the container are left as is.
+func Sync(ctx *log.Context, container Container, dir string, validateName func(name string) error) (Result, error) {
+	var result Result
+	blobs, err := container.List()
+	if err != nil {
+		return result, errors.Wrap(err, "failed to list the blobs of the container")
+	}
+
+	synced := readManifest(dir)
+	for name, blob := range blobs {
+		if err := validateName(name); err != nil {
+			ctx.Log("warning", "skipping blob", "error", err)
+			delete(blobs, name)
+			continue
+		}
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if previous, ok := synced[name]; ok && blob.unchanged(previous) {
+			if _, err := os.Stat(path); err == nil {
+				synced[name] = blob
+				result.Unchanged++
+				continue
+			}
+		}
+
+		if err := downloadBlob(container, name, path); err != nil {
+			ctx.Log("warning", "failed to download blob", "blob", name, "error", err)
+			result.Failed++
+			continue
+		}
+		synced[name] = blob
+		result.Downloaded++
+	}
+
+	for name := range synced {
+		if _, ok := blobs[name]; !ok {
+			os.Remove(filepath.Join(dir, filepath.FromSlash(name)))
+			delete(synced, name)
+			result.Removed++
+		}
+	}
+
+	return result, writeManifest(dir, synced)
+}
+
+// ValidateName returns an error if name is not a relative path within the synced directory, e.g., "app.tar.gz"
+// or "linux/app.tar.gz". Hidden files and directories are reserved for the sync.
+func ValidateName(name string) error {
+	if name == "" || strings.Contains(name, "\\") || filepath.IsAbs(name) || filepath.Clean(name) != name {
+		return errors.Errorf("invalid blob name '%s'", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return errors.Errorf("invalid blob name '%s'", name)
+		}
+	}
+	return nil
+}
+
+// downloadBlob replaces the file at path with the content of the blob
+func downloadBlob(container Container, name string, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrap(err, "failed to create directory")
+	}
+
+	content, err := container.Get(name)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	// The file is replaced atomically since a run command may be reading it
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create file")
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write file")
+	}
+	return errors.Wrap(os.Rename(f.Name(), path), "failed to replace file")
+}
+
+// readManifest returns the version of every synced blob by name, or an empty manifest if it cannot be read
+func readManifest(dir string) map[string]Blob {
+	manifest := make(map[string]Blob)
+	b, err := os.ReadFile(filepath.Join(dir, ManifestFileName))
+	if err == nil {
+		if json.Unmarshal(b, &manifest) != nil {
+			// e.g., the manifest of a previous version only keeping the ETags. The blobs are downloaded again.
+			manifest = make(map[string]Blob)
+		}
+	}
+	return manifest
+}
+
+func writeManifest(dir string, manifest map[string]Blob) error {
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal sync manifest")
+	}
+	return errors.Wrap(os.WriteFile(filepath.Join(dir, ManifestFileName), b, 0600), "failed to write sync manifest")
+}
+
+// sasContainer is a storage container accessed with a SAS token, limited to the blobs under a prefix
+type sasContainer struct {
+	container *storage.Container
+	prefix    string
+}
+
+// NewSASContainer returns the container at uri, accessed with the SAS token of uri. When uri has a path within
+// the container (e.g., https://account.blob.core.windows.net/container/app/), only the blobs under that path are
+// synced and their names are relative to it.
+func NewSASContainer(uri string) (Container, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, errors.Errorf("invalid container URI %q", download.GetUriForLogging(uri))
+	}
+
+	container, err := storage.GetContainerReferenceFromSASURI(*u)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open storage container: %q", download.GetUriForLogging(uri))
+	}
+	requestheaders.ApplyToStorageClient(container.Client())
+
+	var prefix string
+	if parts := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2); len(parts) == 2 && parts[1] != "" {
+		prefix = strings.TrimSuffix(parts[1], "/") + "/"
+	}
+	return sasContainer{container: container, prefix: prefix}, nil
+}
+
+func (c sasContainer) List() (map[string]Blob, error) {
+	blobs := make(map[string]Blob)
+	params := storage.ListBlobsParameters{Prefix: c.prefix}
+	for {
+		response, err := c.container.ListBlobs(params)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range response.Blobs {
+			blobs[strings.TrimPrefix(b.Name, c.prefix)] = Blob{ETag: b.Properties.Etag, MD5: b.Properties.ContentMD5}
+		}
+		if response.NextMarker == "" {
+			return blobs, nil
+		}
+		params.Marker = response.NextMarker
+	}
+}
+
+func (c sasContainer) Get(name string) (io.ReadCloser, error) {
+	return c.container.GetBlobReference(c.prefix + name).Get(nil)
+}
@@ -0,0 +1,115 @@
+package blobsync
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeBlob struct {
+	content string
+	etag    string
+	md5     string
+}
+
+// fakeContainer serves blobs from memory and counts the downloads
+type fakeContainer struct {
+	blobs     map[string]fakeBlob
+	failing   map[string]bool
+	downloads int
+}
+
+func (c *fakeContainer) List() (map[string]Blob, error) {
+	blobs := make(map[string]Blob)
+	for name, b := range c.blobs {
+		blobs[name] = Blob{ETag: b.etag, MD5: b.md5}
+	}
+	return blobs, nil
+}
+
+func (c *fakeContainer) Get(name string) (io.ReadCloser, error) {
+	if c.failing[name] {
+		return nil, errors.New("download failed")
+	}
+	c.downloads++
+	return io.NopCloser(strings.NewReader(c.blobs[name].content)), nil
+}
+
+func Test_Sync(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	dir := t.TempDir()
+	container := &fakeContainer{blobs: map[string]fakeBlob{
+		"app.tar.gz":      {content: "v1", etag: "1", md5: "md5-v1"},
+		"conf/app.conf":   {content: "conf", etag: "1"},
+		"removed.txt":     {content: "removed", etag: "1"},
+		"../escape.txt":   {content: "escape", etag: "1"},
+		".manifest.json":  {content: "{}", etag: "1"},
+		"fails-later.txt": {content: "v1", etag: "1"},
+	}}
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "local.txt"), []byte("local"), 0600))
+
+	result, err := Sync(ctx, container, dir, ValidateName)
+	require.Nil(t, err)
+	require.Equal(t, Result{Downloaded: 4}, result)
+	requireFile(t, dir, "conf/app.conf", "conf")
+
+	// Uploaded again with the same content: new ETag, same MD5
+	container.downloads = 0
+	container.blobs["app.tar.gz"] = fakeBlob{content: "v1", etag: "2", md5: "md5-v1"}
+	container.blobs["conf/app.conf"] = fakeBlob{content: "conf v2", etag: "2"}
+	container.blobs["fails-later.txt"] = fakeBlob{content: "v2", etag: "2"}
+	container.failing = map[string]bool{"fails-later.txt": true}
+	delete(container.blobs, "removed.txt")
+
+	result, err = Sync(ctx, container, dir, ValidateName)
+	require.Nil(t, err)
+	require.Equal(t, Result{Downloaded: 1, Unchanged: 1, Removed: 1, Failed: 1}, result)
+	require.Equal(t, 1, container.downloads)
+	requireFile(t, dir, "conf/app.conf", "conf v2")
+	requireFile(t, dir, "fails-later.txt", "v1")
+	requireFile(t, dir, "local.txt", "local")
+	require.NoFileExists(t, filepath.Join(dir, "removed.txt"))
+
+	// The failed blob is retried, and a synced file deleted locally is downloaded again
+	container.failing = nil
+	require.Nil(t, os.Remove(filepath.Join(dir, "app.tar.gz")))
+	result, err = Sync(ctx, container, dir, ValidateName)
+	require.Nil(t, err)
+	require.Equal(t, Result{Downloaded: 2, Unchanged: 1}, result)
+	requireFile(t, dir, "fails-later.txt", "v2")
+	requireFile(t, dir, "app.tar.gz", "v1")
+}
+
+func Test_Sync_ignoresInvalidManifest(t *testing.T) {
+	dir := t.TempDir()
+	// The manifest of the script library used to only keep the ETags
+	require.Nil(t, os.WriteFile(filepath.Join(dir, ManifestFileName), []byte(`{"a.sh": "1"}`), 0600))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "a.sh"), []byte("old"), 0600))
+	container := &fakeContainer{blobs: map[string]fakeBlob{"a.sh": {content: "new", etag: "1"}}}
+
+	result, err := Sync(log.NewContext(log.NewNopLogger()), container, dir, ValidateName)
+	require.Nil(t, err)
+	require.Equal(t, Result{Downloaded: 1}, result)
+	requireFile(t, dir, "a.sh", "new")
+}
+
+func Test_ValidateName(t *testing.T) {
+	for _, name := range []string{"app.tar.gz", "linux/app.tar.gz"} {
+		require.Nil(t, ValidateName(name), name)
+	}
+	for _, name := range []string{"", "/etc/passwd", "../app", "a/../../b", ".hidden", "dir/.hidden", "a\\b", "dir/"} {
+		require.NotNil(t, ValidateName(name), name)
+	}
+}
+
+func requireFile(t *testing.T, dir string, name string, content string) {
+	b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	require.Nil(t, err, name)
+	require.Equal(t, content, string(b), name)
+}
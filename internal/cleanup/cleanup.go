@@ -2,21 +2,32 @@ package cleanup
 
 import (
 	"fmt"
-	"path/filepath"
 	"strconv"
 
 	"github.com/Azure/azure-extension-platform/pkg/utils"
-	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
 	"github.com/Azure/run-command-handler-linux/internal/types"
 	"github.com/Azure/run-command-handler-linux/pkg/linuxutils"
 	"github.com/go-kit/kit/log"
 )
 
+// ImmediateRunCommandCleanup deletes the scripts and settings of the extension, except the last executions kept by
+// its retention policy
 func ImmediateRunCommandCleanup(ctx *log.Context, metadata types.RCMetadata, h types.HandlerEnvironment, runAsUser string) {
+	if keep := keepLastExecutions(metadata.DownloadPath); keep > 0 {
+		deleteScriptsAndSettingsExceptLast(ctx, metadata, h, runAsUser, keep, true)
+		return
+	}
 	deleteAllScriptsAndSettings(ctx, metadata, h, runAsUser)
 }
 
+// RunCommandCleanup deletes the scripts of the extension and empties its settings, except the most recent ones or the
+// last executions kept by its retention policy
 func RunCommandCleanup(ctx *log.Context, metadata types.RCMetadata, h types.HandlerEnvironment, runAsUser string) {
+	if keep := keepLastExecutions(metadata.DownloadPath); keep > 1 {
+		deleteScriptsAndSettingsExceptLast(ctx, metadata, h, runAsUser, keep, false)
+		return
+	}
 	deleteScriptsAndSettingsExceptMostRecent(ctx, metadata, h, runAsUser)
 }
 
@@ -30,7 +41,7 @@ func deleteAllScriptsAndSettings(ctx *log.Context, metadata types.RCMetadata, h
 	}
 
 	if runAsUser != "" {
-		runAsDownloadParent := filepath.Join(fmt.Sprintf(constants.RunAsDir, runAsUser), metadata.DownloadDir)
+		runAsDownloadParent := datapaths.RunAsDownloadDir(runAsUser, metadata.DownloadDir)
 		ctx.Log("message", "removing all files from the download 'runas' directory "+runAsDownloadParent)
 		err = linuxutils.TryDeleteDirectories(ctx, runAsDownloadParent)
 		if err != nil {
@@ -51,7 +62,7 @@ func deleteScriptsAndSettingsExceptMostRecent(ctx *log.Context, metadata types.R
 	}
 
 	if runAsUser != "" {
-		runAsDownloadParent := filepath.Join(fmt.Sprintf(constants.RunAsDir, runAsUser), metadata.DownloadDir)
+		runAsDownloadParent := datapaths.RunAsDownloadDir(runAsUser, metadata.DownloadDir)
 		seqNumString := strconv.Itoa(metadata.SeqNum)
 		ctx.Log("message", "removing all files from the download 'runas' directory "+runAsDownloadParent)
 		err = utils.TryDeleteDirectoriesExcept(runAsDownloadParent, seqNumString)
@@ -60,3 +71,26 @@ func deleteScriptsAndSettingsExceptMostRecent(ctx *log.Context, metadata types.R
 		}
 	}
 }
+
+// deleteScriptsAndSettingsExceptLast deletes the execution directories of the extension except the keep most recent
+// ones. Its settings are deleted when deleteAllSettings is set, else they are emptied except the most recent one.
+func deleteScriptsAndSettingsExceptLast(ctx *log.Context, metadata types.RCMetadata, h types.HandlerEnvironment, runAsUser string, keep int, deleteAllSettings bool) {
+	runtimeSettingsRegexFormat := metadata.ExtName + ".\\d+.settings"
+	mostRecentRuntimeSettings := fmt.Sprintf("%s.%d.settings", metadata.ExtName, metadata.SeqNum)
+	if deleteAllSettings {
+		mostRecentRuntimeSettings = ""
+	}
+
+	ctx.Log("event", "clearing settings and script files except the last executions kept", "keep", keep)
+	deleteExecutionsExceptLast(ctx, metadata.DownloadPath, keep)
+	err := utils.TryClearRegexMatchingFilesExcept(h.HandlerEnvironment.ConfigFolder, runtimeSettingsRegexFormat, mostRecentRuntimeSettings, deleteAllSettings)
+	if err != nil {
+		ctx.Log("event", "could not clear settings files", "error", err)
+	}
+
+	if runAsUser != "" {
+		runAsDownloadParent := datapaths.RunAsDownloadDir(runAsUser, metadata.DownloadDir)
+		ctx.Log("message", "removing the files of the older executions from the download 'runas' directory "+runAsDownloadParent)
+		deleteExecutionsExceptLast(ctx, runAsDownloadParent, keep)
+	}
+}
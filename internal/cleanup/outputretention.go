@@ -0,0 +1,73 @@
+package cleanup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
+	"github.com/Azure/run-command-handler-linux/internal/outputfile"
+	"github.com/Azure/run-command-handler-linux/pkg/atomicfile"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// SetOutputRetention records that the stdout and stderr files of the execution in seqNumDir are deleted once
+// retention has elapsed from now. The files are deleted by DeleteExpiredOutput, which does not need the settings
+// of the execution.
+func SetOutputRetention(seqNumDir string, retention time.Duration, now time.Time) error {
+	expiry := now.Add(retention).UTC().Format(time.RFC3339)
+	if err := atomicfile.WriteFile(datapaths.OutputExpiryFilePath(seqNumDir), []byte(expiry), 0600); err != nil {
+		return errors.Wrap(err, "failed to save the retention of the output")
+	}
+	return nil
+}
+
+// DeleteExpiredOutput deletes the stdout and stderr files of the executions, of every download folder, whose output
+// retention has elapsed. An unreadable expiry is considered elapsed, since the output may be sensitive.
+func DeleteExpiredOutput(ctx *log.Context, dataDir string, now time.Time) {
+	for _, downloadFolder := range []string{constants.DownloadFolder, constants.ImmediateDownloadFolder, constants.ProvisioningDownloadFolder} {
+		// Every execution directory: <dataDir>/<downloadFolder>/<extension>/<seqNum>, or
+		// <dataDir>/<downloadFolder>/<seqNum> for the single-config extension
+		var expiryFiles []string
+		for _, pattern := range []string{filepath.Join(dataDir, downloadFolder, "*", "*"), filepath.Join(dataDir, downloadFolder, "*")} {
+			matches, err := filepath.Glob(datapaths.OutputExpiryFilePath(pattern))
+			if err != nil {
+				ctx.Log("warning", "failed to list the output retentions", "error", err)
+				continue
+			}
+			expiryFiles = append(expiryFiles, matches...)
+		}
+
+		for _, expiryFile := range expiryFiles {
+			b, err := os.ReadFile(expiryFile)
+			if err != nil && os.IsNotExist(err) {
+				continue
+			}
+			if expiry, parseErr := time.Parse(time.RFC3339, strings.TrimSpace(string(b))); err == nil && parseErr == nil && now.Before(expiry) {
+				continue
+			}
+
+			seqNumDir := filepath.Dir(expiryFile)
+			stdout, stderr := datapaths.OutputFilePaths(seqNumDir)
+			if deleteFiles(ctx, append(outputfile.Files(stdout), outputfile.Files(stderr)...)...) {
+				deleteFiles(ctx, expiryFile)
+				ctx.Log("event", "deleted expired output", "path", seqNumDir)
+			}
+		}
+	}
+}
+
+// deleteFiles deletes the given files, ignoring those already deleted. It returns whether all of them were deleted.
+func deleteFiles(ctx *log.Context, paths ...string) bool {
+	deleted := true
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			ctx.Log("warning", "failed to delete output file", "path", path, "error", err)
+			deleted = false
+		}
+	}
+	return deleted
+}
@@ -0,0 +1,58 @@
+package cleanup_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/cleanup"
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteExpiredOutput(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	dataDir := t.TempDir()
+	now := time.Now()
+
+	newExecution := func(downloadFolder string, extensionName string) string {
+		dir := datapaths.SeqNumDir(datapaths.DownloadPath(dataDir, downloadFolder, extensionName), 1)
+		require.Nil(t, os.MkdirAll(dir, 0700))
+		stdout, stderr := datapaths.OutputFilePaths(dir)
+		for _, path := range []string{stdout, stderr, datapaths.ScriptFilePath(dir)} {
+			require.Nil(t, os.WriteFile(path, []byte("output"), 0600))
+		}
+		return dir
+	}
+	expired := newExecution(constants.DownloadFolder, "")
+	expiredImmediate := newExecution(constants.ImmediateDownloadFolder, "rc1")
+	retained := newExecution(constants.DownloadFolder, "rc2")
+	noRetention := newExecution(constants.DownloadFolder, "rc3")
+
+	require.Nil(t, cleanup.SetOutputRetention(expired, 24*time.Hour, now.Add(-25*time.Hour)))
+	require.Nil(t, cleanup.SetOutputRetention(expiredImmediate, time.Hour, now.Add(-2*time.Hour)))
+	require.Nil(t, cleanup.SetOutputRetention(retained, 24*time.Hour, now))
+
+	cleanup.DeleteExpiredOutput(ctx, dataDir, now)
+	for _, dir := range []string{expired, expiredImmediate} {
+		stdout, stderr := datapaths.OutputFilePaths(dir)
+		require.NoFileExists(t, stdout)
+		require.NoFileExists(t, stderr)
+		require.NoFileExists(t, datapaths.OutputExpiryFilePath(dir))
+		require.FileExists(t, datapaths.ScriptFilePath(dir))
+	}
+	for _, dir := range []string{retained, noRetention} {
+		stdout, stderr := datapaths.OutputFilePaths(dir)
+		require.FileExists(t, stdout)
+		require.FileExists(t, stderr)
+	}
+
+	require.Nil(t, os.WriteFile(datapaths.OutputExpiryFilePath(retained), []byte("invalid"), 0600))
+	cleanup.DeleteExpiredOutput(ctx, dataDir, now)
+	stdout, _ := datapaths.OutputFilePaths(retained)
+	require.NoFileExists(t, stdout)
+	require.FileExists(t, filepath.Join(noRetention, "stdout"))
+}
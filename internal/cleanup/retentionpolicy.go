@@ -0,0 +1,228 @@
+package cleanup
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// execution is an execution directory of an extension
+type execution struct {
+	dir          string
+	seqNum       int
+	lastModified time.Time
+	size         int64
+}
+
+// SaveRetentionPolicy saves the retention policy of the executions of the extension in its download path, where the
+// cleanups and ApplyRetentionPolicies read it without the settings. A nil policy removes the saved one.
+func SaveRetentionPolicy(downloadPath string, policy *handlersettings.RetentionPolicy) error {
+	path := datapaths.RetentionPolicyFilePath(downloadPath)
+	if policy == nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to remove the retention policy")
+		}
+		return nil
+	}
+
+	b, err := json.Marshal(policy)
+	if err != nil {
+		return errors.Wrap(err, "failed to serialize the retention policy")
+	}
+	if err := os.MkdirAll(downloadPath, 0700); err != nil {
+		return errors.Wrap(err, "failed to create the download directory")
+	}
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		return errors.Wrap(err, "failed to save the retention policy")
+	}
+	return nil
+}
+
+// readRetentionPolicy returns the retention policy saved in the download path of the extension, nil if it has none.
+// An unreadable policy is ignored, the executions are then cleaned up as without a policy.
+func readRetentionPolicy(downloadPath string) *handlersettings.RetentionPolicy {
+	b, err := os.ReadFile(datapaths.RetentionPolicyFilePath(downloadPath))
+	if err != nil {
+		return nil
+	}
+	var policy handlersettings.RetentionPolicy
+	if err := json.Unmarshal(b, &policy); err != nil {
+		return nil
+	}
+	return &policy
+}
+
+// keepLastExecutions returns how many of the most recent executions of the extension its cleanup keeps, 0 when
+// its retention policy doesn't say
+func keepLastExecutions(downloadPath string) int {
+	if policy := readRetentionPolicy(downloadPath); policy != nil {
+		return policy.KeepLastExecutions
+	}
+	return 0
+}
+
+// ApplyRetentionPolicies deletes the executions, of every download folder, that the retention policies saved by
+// SaveRetentionPolicy no longer keep: those beyond the last ones kept, those older than the maximum age, and the
+// oldest ones of any extension while the data directory exceeds the smallest size cap. The most recent execution of
+// every extension is always kept, it may still be running.
+func ApplyRetentionPolicies(ctx *log.Context, dataDir string, now time.Time) {
+	var downloadPaths []string
+	for _, downloadFolder := range []string{constants.DownloadFolder, constants.ImmediateDownloadFolder, constants.ProvisioningDownloadFolder} {
+		paths, err := filepath.Glob(filepath.Join(dataDir, downloadFolder, "*"))
+		if err != nil {
+			ctx.Log("warning", "failed to list the extensions", "error", err)
+			continue
+		}
+		// The single-config extension keeps its executions in the download folder itself
+		downloadPaths = append(downloadPaths, filepath.Join(dataDir, downloadFolder))
+		downloadPaths = append(downloadPaths, paths...)
+	}
+
+	policies := make(map[string]*handlersettings.RetentionPolicy)
+	var maxSize int64
+	for _, downloadPath := range downloadPaths {
+		if policy := readRetentionPolicy(downloadPath); policy != nil {
+			policies[downloadPath] = policy
+			if limit := int64(policy.MaxDataDirSizeInMB) << 20; limit > 0 && (maxSize == 0 || limit < maxSize) {
+				maxSize = limit
+			}
+		}
+	}
+	if len(policies) == 0 {
+		return
+	}
+
+	// The executions the size cap can delete, of every extension
+	var candidates []execution
+	for _, downloadPath := range downloadPaths {
+		executions := listExecutions(downloadPath)
+		if len(executions) == 0 {
+			continue
+		}
+		if policy, ok := policies[downloadPath]; ok {
+			executions = applyRetentionPolicy(ctx, policy, executions, now)
+		}
+		candidates = append(candidates, executions[1:]...)
+	}
+	if maxSize == 0 {
+		return
+	}
+
+	size := directorySize(dataDir)
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].lastModified.Before(candidates[j].lastModified) })
+	for _, e := range candidates {
+		if size <= maxSize {
+			break
+		}
+		if deleteExecution(ctx, e, "the data directory exceeds its maximum size") {
+			size -= e.size
+		}
+	}
+	if size > maxSize {
+		ctx.Log("warning", "the data directory exceeds its maximum size once the old executions are deleted", "size", size, "maxSize", maxSize)
+	}
+}
+
+// applyRetentionPolicy deletes the executions, the most recent first, beyond the last ones kept by the policy or older
+// than its maximum age, except the most recent one. It returns the executions kept.
+func applyRetentionPolicy(ctx *log.Context, policy *handlersettings.RetentionPolicy, executions []execution, now time.Time) []execution {
+	maxAge := time.Duration(policy.MaxAgeInDays) * 24 * time.Hour
+	kept := []execution{executions[0]}
+	for i, e := range executions[1:] {
+		switch {
+		case policy.KeepLastExecutions > 0 && i+1 >= policy.KeepLastExecutions:
+			if !deleteExecution(ctx, e, "beyond the last executions kept") {
+				kept = append(kept, e)
+			}
+		case maxAge > 0 && now.Sub(e.lastModified) > maxAge:
+			if !deleteExecution(ctx, e, "older than the maximum age") {
+				kept = append(kept, e)
+			}
+		default:
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// listExecutions returns the execution directories in downloadPath, named by their sequence number, the most recent
+// first
+func listExecutions(downloadPath string) []execution {
+	entries, err := os.ReadDir(downloadPath)
+	if err != nil {
+		return nil
+	}
+	var executions []execution
+	for _, entry := range entries {
+		seqNum, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		e := execution{dir: filepath.Join(downloadPath, entry.Name()), seqNum: seqNum}
+		filepath.WalkDir(e.dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info, err := d.Info(); err == nil {
+				if info.ModTime().After(e.lastModified) {
+					e.lastModified = info.ModTime()
+				}
+				if info.Mode().IsRegular() {
+					e.size += info.Size()
+				}
+			}
+			return nil
+		})
+		executions = append(executions, e)
+	}
+	sort.Slice(executions, func(i, j int) bool { return executions[i].seqNum > executions[j].seqNum })
+	return executions
+}
+
+// deleteExecutionsExceptLast deletes the execution directories in parentDirectory except the keep most recent ones
+func deleteExecutionsExceptLast(ctx *log.Context, parentDirectory string, keep int) {
+	executions := listExecutions(parentDirectory)
+	if len(executions) <= keep {
+		return
+	}
+	for _, e := range executions[keep:] {
+		deleteExecution(ctx, e, "beyond the last executions kept")
+	}
+}
+
+// deleteExecution deletes the execution directory, returning whether it was deleted
+func deleteExecution(ctx *log.Context, e execution, reason string) bool {
+	if err := os.RemoveAll(e.dir); err != nil {
+		ctx.Log("warning", "failed to delete execution", "path", e.dir, "error", err)
+		return false
+	}
+	ctx.Log("event", "deleted execution "+reason, "path", e.dir)
+	return true
+}
+
+// directorySize returns the size of the regular files under dir
+func directorySize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
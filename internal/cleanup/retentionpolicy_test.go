@@ -0,0 +1,164 @@
+package cleanup_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/cleanup"
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// newExecutions creates the execution directories 1..count of the extension, each with an output of size bytes,
+// the older the lower their sequence number, and returns them
+func newExecutions(t *testing.T, downloadPath string, count int, size int, now time.Time) []string {
+	var dirs []string
+	for seqNum := 1; seqNum <= count; seqNum++ {
+		dir := datapaths.SeqNumDir(downloadPath, seqNum)
+		require.Nil(t, os.MkdirAll(dir, 0700))
+		stdout, _ := datapaths.OutputFilePaths(dir)
+		require.Nil(t, os.WriteFile(stdout, make([]byte, size), 0600))
+		modTime := now.Add(-time.Duration(count-seqNum) * 24 * time.Hour)
+		require.Nil(t, os.Chtimes(stdout, modTime, modTime))
+		require.Nil(t, os.Chtimes(dir, modTime, modTime))
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+func TestSaveRetentionPolicy(t *testing.T) {
+	downloadPath := filepath.Join(t.TempDir(), "rc1")
+	require.Nil(t, cleanup.SaveRetentionPolicy(downloadPath, &handlersettings.RetentionPolicy{KeepLastExecutions: 3}))
+	require.FileExists(t, datapaths.RetentionPolicyFilePath(downloadPath))
+
+	require.Nil(t, cleanup.SaveRetentionPolicy(downloadPath, nil))
+	require.NoFileExists(t, datapaths.RetentionPolicyFilePath(downloadPath))
+	require.Nil(t, cleanup.SaveRetentionPolicy(downloadPath, nil))
+}
+
+func TestRunCommandCleanup_KeepsLastExecutions(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	dataDir := t.TempDir()
+	downloadFolder, fakeEnv, scriptFilePathsForSeqs, runtimeSettingsForSeqs := createTempScriptsAndSettingsAndGetVariables(t, dataDir, "testExtension", 5)
+	metadata := types.NewRCMetadata("testExtension", 5, filepath.Base(downloadFolder), dataDir)
+	require.Nil(t, cleanup.SaveRetentionPolicy(metadata.DownloadPath, &handlersettings.RetentionPolicy{KeepLastExecutions: 3}))
+
+	cleanup.RunCommandCleanup(ctx, metadata, fakeEnv, "")
+	for i, script := range scriptFilePathsForSeqs {
+		if i < 2 {
+			require.NoFileExists(t, script)
+		} else {
+			require.FileExists(t, script)
+		}
+	}
+	for i, settings := range runtimeSettingsForSeqs {
+		content, err := os.ReadFile(settings)
+		require.Nil(t, err)
+		if i < len(runtimeSettingsForSeqs)-1 {
+			require.Empty(t, string(content))
+		} else {
+			require.Equal(t, "nonemptytext", string(content))
+		}
+	}
+	require.FileExists(t, datapaths.RetentionPolicyFilePath(metadata.DownloadPath))
+}
+
+func TestImmediateRunCommandCleanup_KeepsLastExecutions(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	dataDir := t.TempDir()
+	downloadFolder, fakeEnv, scriptFilePathsForSeqs, runtimeSettingsForSeqs := createTempScriptsAndSettingsAndGetVariables(t, dataDir, "testExtension", 5)
+	metadata := types.NewRCMetadata("testExtension", 5, filepath.Base(downloadFolder), dataDir)
+	require.Nil(t, cleanup.SaveRetentionPolicy(metadata.DownloadPath, &handlersettings.RetentionPolicy{KeepLastExecutions: 2}))
+
+	cleanup.ImmediateRunCommandCleanup(ctx, metadata, fakeEnv, "")
+	for i, script := range scriptFilePathsForSeqs {
+		if i < 3 {
+			require.NoFileExists(t, script)
+		} else {
+			require.FileExists(t, script)
+		}
+	}
+	for _, settings := range runtimeSettingsForSeqs {
+		require.NoFileExists(t, settings)
+	}
+}
+
+func TestApplyRetentionPolicies_KeepLastAndMaxAge(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	dataDir := t.TempDir()
+	now := time.Now()
+
+	keepLast := datapaths.DownloadPath(dataDir, constants.DownloadFolder, "rc1")
+	keepLastDirs := newExecutions(t, keepLast, 4, 10, now)
+	require.Nil(t, cleanup.SaveRetentionPolicy(keepLast, &handlersettings.RetentionPolicy{KeepLastExecutions: 2}))
+
+	maxAge := datapaths.DownloadPath(dataDir, constants.ImmediateDownloadFolder, "rc2")
+	maxAgeDirs := newExecutions(t, maxAge, 4, 10, now.Add(-10*24*time.Hour))
+	require.Nil(t, cleanup.SaveRetentionPolicy(maxAge, &handlersettings.RetentionPolicy{MaxAgeInDays: 11}))
+
+	noPolicyDirs := newExecutions(t, datapaths.DownloadPath(dataDir, constants.DownloadFolder, "rc3"), 3, 10, now)
+
+	// The single-config extension keeps its executions in the download folder
+	singleConfig := datapaths.DownloadPath(dataDir, constants.DownloadFolder, "")
+	singleConfigDirs := newExecutions(t, singleConfig, 2, 10, now)
+	require.Nil(t, cleanup.SaveRetentionPolicy(singleConfig, &handlersettings.RetentionPolicy{KeepLastExecutions: 1}))
+
+	cleanup.ApplyRetentionPolicies(ctx, dataDir, now)
+	require.NoDirExists(t, keepLastDirs[0])
+	require.NoDirExists(t, keepLastDirs[1])
+	require.DirExists(t, keepLastDirs[2])
+	require.DirExists(t, keepLastDirs[3])
+
+	// The most recent execution is kept however old it is
+	require.NoDirExists(t, maxAgeDirs[0])
+	require.NoDirExists(t, maxAgeDirs[1])
+	require.DirExists(t, maxAgeDirs[2])
+	require.DirExists(t, maxAgeDirs[3])
+
+	for _, dir := range noPolicyDirs {
+		require.DirExists(t, dir)
+	}
+	require.NoDirExists(t, singleConfigDirs[0])
+	require.DirExists(t, singleConfigDirs[1])
+}
+
+func TestApplyRetentionPolicies_MaxDataDirSize(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	dataDir := t.TempDir()
+	now := time.Now()
+	const mb = 1 << 20
+
+	// rc1 holds the oldest executions, rc2 the newest ones
+	rc1 := datapaths.DownloadPath(dataDir, constants.DownloadFolder, "rc1")
+	rc1Dirs := newExecutions(t, rc1, 3, mb, now.Add(-time.Hour))
+	rc2Dirs := newExecutions(t, datapaths.DownloadPath(dataDir, constants.DownloadFolder, "rc2"), 3, mb, now)
+	require.Nil(t, cleanup.SaveRetentionPolicy(rc1, &handlersettings.RetentionPolicy{MaxDataDirSizeInMB: 4}))
+
+	// The saved policy counts towards the size too, the data directory fits once three executions remain
+	cleanup.ApplyRetentionPolicies(ctx, dataDir, now)
+	remaining := 0
+	for _, dir := range append(rc1Dirs, rc2Dirs...) {
+		if _, err := os.Stat(dir); err == nil {
+			remaining++
+		}
+	}
+	require.Equal(t, 3, remaining)
+	// The oldest executions were deleted first
+	require.NoDirExists(t, rc1Dirs[0])
+	require.NoDirExists(t, rc1Dirs[1])
+	require.NoDirExists(t, rc2Dirs[0])
+	require.DirExists(t, rc2Dirs[1])
+
+	// The most recent execution of every extension is kept even though the data directory exceeds its size
+	require.Nil(t, cleanup.SaveRetentionPolicy(rc1, &handlersettings.RetentionPolicy{MaxDataDirSizeInMB: 1}))
+	cleanup.ApplyRetentionPolicies(ctx, dataDir, now)
+	require.DirExists(t, rc1Dirs[2])
+	require.DirExists(t, rc2Dirs[2])
+	require.NoDirExists(t, rc2Dirs[1])
+}
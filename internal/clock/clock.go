@@ -0,0 +1,157 @@
+// Package clock abstracts the time for the loops of the handler and the service (e.g., the partial status updates,
+// the retries and the polling), so their timing is tested deterministically with a fake clock.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and waits
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks at intervals, as time.Ticker does
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the clock of the system
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
+
+// Fake is a clock whose time only moves when advanced. The waits end once the time is advanced past them.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*waiter
+	added   chan struct{}
+}
+
+// waiter is a pending After, Sleep or tick of a ticker
+type waiter struct {
+	at       time.Time
+	c        chan time.Time
+	interval time.Duration
+	stopped  bool
+}
+
+// NewFake returns a fake clock set to now
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now, added: make(chan struct{}, 1)}
+}
+
+// Now returns the time of the clock
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Sleep blocks until the clock is advanced by d
+func (f *Fake) Sleep(d time.Duration) {
+	<-f.After(d)
+}
+
+// After returns a channel receiving the time once the clock is advanced by d
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.add(d, 0).c
+}
+
+// NewTicker returns a ticker ticking every time the clock is advanced by d. Like time.Ticker, it drops the ticks
+// which are not received.
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	return fakeTicker{f: f, w: f.add(d, d)}
+}
+
+func (f *Fake) add(d time.Duration, interval time.Duration) *waiter {
+	f.mu.Lock()
+	w := &waiter{at: f.now.Add(d), c: make(chan time.Time, 1), interval: interval}
+	f.waiters = append(f.waiters, w)
+	f.mu.Unlock()
+
+	select {
+	case f.added <- struct{}{}:
+	default:
+	}
+	return w
+}
+
+// Advance moves the clock by d, ending the waits due by then in order
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := f.now.Add(d)
+	for {
+		sort.SliceStable(f.waiters, func(i, j int) bool { return f.waiters[i].at.Before(f.waiters[j].at) })
+		if len(f.waiters) == 0 || f.waiters[0].at.After(end) {
+			break
+		}
+		w := f.waiters[0]
+		f.waiters = f.waiters[1:]
+		if w.stopped {
+			continue
+		}
+		f.now = w.at
+		select {
+		case w.c <- w.at:
+		default:
+		}
+		if w.interval > 0 {
+			w.at = w.at.Add(w.interval)
+			f.waiters = append(f.waiters, w)
+		}
+	}
+	f.now = end
+}
+
+// WaitForWaiters blocks until n waits (Sleep, After or tickers) are pending, so a test advances the clock once the
+// code under test waits
+func (f *Fake) WaitForWaiters(n int) {
+	for {
+		f.mu.Lock()
+		pending := 0
+		for _, w := range f.waiters {
+			if !w.stopped {
+				pending++
+			}
+		}
+		f.mu.Unlock()
+		if pending >= n {
+			return
+		}
+		<-f.added
+	}
+}
+
+type fakeTicker struct {
+	f *Fake
+	w *waiter
+}
+
+func (t fakeTicker) C() <-chan time.Time { return t.w.c }
+
+func (t fakeTicker) Stop() {
+	t.f.mu.Lock()
+	defer t.f.mu.Unlock()
+	t.w.stopped = true
+}
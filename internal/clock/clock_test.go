@@ -0,0 +1,52 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var start = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func Test_fakeAfter(t *testing.T) {
+	f := NewFake(start)
+	c := f.After(10 * time.Second)
+
+	f.Advance(9 * time.Second)
+	require.Len(t, c, 0)
+	f.Advance(time.Second)
+	require.Equal(t, start.Add(10*time.Second), <-c)
+	require.Equal(t, start.Add(10*time.Second), f.Now())
+}
+
+func Test_fakeSleep(t *testing.T) {
+	f := NewFake(start)
+	done := make(chan struct{})
+	go func() {
+		f.Sleep(time.Minute)
+		close(done)
+	}()
+
+	f.WaitForWaiters(1)
+	f.Advance(time.Minute)
+	<-done
+}
+
+func Test_fakeTicker(t *testing.T) {
+	f := NewFake(start)
+	ticker := f.NewTicker(30 * time.Second)
+
+	f.Advance(30 * time.Second)
+	require.Equal(t, start.Add(30*time.Second), <-ticker.C())
+
+	// The ticks not received are dropped
+	f.Advance(90 * time.Second)
+	require.Equal(t, start.Add(60*time.Second), <-ticker.C())
+	require.Len(t, ticker.C(), 0)
+
+	ticker.Stop()
+	f.Advance(time.Minute)
+	require.Len(t, ticker.C(), 0)
+	require.Equal(t, start.Add(3*time.Minute), f.Now())
+}
@@ -0,0 +1,469 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/appendblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/run-command-handler-linux/internal/clock"
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/requesthelper"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/Azure/run-command-handler-linux/pkg/download"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxAppendBlockSize is the largest block accepted by the Append Block operation
+	maxAppendBlockSize = 4 * 1024 * 1024
+
+	// maxAppendBlobRolls is the number of additional blobs created once a blob reaches its block limit
+	maxAppendBlobRolls = 10
+
+	// blobCallTimeout bounds every call to the storage service so a stalled connection can't hang the command
+	blobCallTimeout = 60 * time.Second
+
+	// blobOperationGracePeriod is the time given to upload the remaining output once the script timed out
+	blobOperationGracePeriod = 2 * time.Minute
+
+	// blobServerTimeout is the server-side timeout (in seconds) of the calls made with the legacy storage client
+	blobServerTimeout = uint(blobCallTimeout / time.Second)
+
+	// time to sleep between append retries is an exponential backoff formula:
+	//   t(n) = k * m^n
+	appendBlobRetryN = 3
+	appendBlobRetryK = time.Second * 2
+	appendBlobRetryM = 2
+
+	// time to wait before uploading again once the append retries are exhausted (e.g., a storage outage),
+	// doubled after every consecutive failure: t(n) = k * 2^(n-1), at most max
+	uploadBackoffK   = updateStatusInSeconds * time.Second
+	uploadBackoffMax = 10 * time.Minute
+
+	// SubStatus codes reported when the output can't be fully uploaded
+	subStatusCodeBlobUploadFailed   = "BlobUploadFailed"
+	subStatusCodeBlobUploadDegraded = "BlobUploadDegraded"
+	subStatusCodeBlobRolled         = "BlobRolled"
+)
+
+// errUploadBackingOff is returned while the uploads are paused after consecutive transient failures
+var errUploadBackingOff = errors.New("output upload is backing off after failures")
+
+// transientAppendError is returned once the retries of a transient failure are exhausted
+type transientAppendError struct {
+	error
+}
+
+// appendBlob is an append blob the output of a run command is uploaded to, or a block blob emulating one on the
+// storage accounts without append blobs
+type appendBlob interface {
+	// appendBlock appends data to the blob. The call fails if the blob length is not position.
+	appendBlock(ctx context.Context, data []byte, position int64) error
+
+	// length returns the current length of the blob
+	length(ctx context.Context) (int64, error)
+
+	// createNext creates (or replaces) the blob that continues this one once it is full
+	createNext(ctx context.Context, rollCount int) (appendBlob, error)
+
+	// uriForLogging returns the uri of the blob without secrets
+	uriForLogging() string
+}
+
+// blobSASRenewal returns the provider of the SAS tokens of the output and error blobs issued by the 'blobSasRenewal'
+// endpoint, nil if there is none. The tokens are requested within the blob operations of opCtx.
+func blobSASRenewal(opCtx context.Context, cfg *handlersettings.HandlerSettings) download.SASProvider {
+	r := cfg.ProtectedSettings.BlobSASRenewal
+	if r == nil {
+		return nil
+	}
+	var clientId, objectId string
+	if r.ManagedIdentity != nil {
+		clientId, objectId = r.ManagedIdentity.ClientId, r.ManagedIdentity.ObjectId
+	}
+	return download.NewSASRenewalEndpoint(opCtx, r.URI, download.GetSASRenewalMsiProvider(r.Resource, clientId, objectId))
+}
+
+// outputBlob uploads an output stream to an append blob. It rolls to a new blob when the current one
+// reaches its block limit and stops uploading after an unrecoverable failure (e.g., a lease or a
+// concurrent writer) so the failure can be reported instead of silently dropping the output. Transient
+// failures outlasting the retries pause the uploads for an increasing time instead.
+type outputBlob struct {
+	blob         appendBlob
+	blobPosition int64
+	rolledBlobs  []string
+	failure      error
+	sleep        requesthelper.SleepFunc
+	now          func() time.Time
+
+	// Transient failures, in total and since the last successful upload, and when to upload again
+	failureCount            int
+	consecutiveFailureCount int
+	lastError               error
+	retryAfter              time.Time
+}
+
+func newOutputBlob(blob appendBlob) *outputBlob {
+	if blob == nil {
+		return nil
+	}
+	return &outputBlob{blob: blob, sleep: clock.Real.Sleep, now: clock.Real.Now}
+}
+
+// newBlobOperationContext returns the context bounding all the blob operations of a command. When the command
+// has a timeout, the blob operations get the same timeout plus a grace period to upload the remaining output.
+func newBlobOperationContext(timeoutInSeconds int) (context.Context, context.CancelFunc) {
+	if timeoutInSeconds > 0 {
+		return context.WithTimeout(context.Background(), time.Duration(timeoutInSeconds)*time.Second+blobOperationGracePeriod)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// callWithTimeout runs a call to the storage service bounded by blobCallTimeout and the given context.
+// The legacy storage client does not accept a context: when the context is done first the call is
+// abandoned and left to the server-side timeout.
+func callWithTimeout(ctx context.Context, call func(ctx context.Context) error) error {
+	callCtx, cancel := context.WithTimeout(ctx, blobCallTimeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- call(callCtx) }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-callCtx.Done():
+		return errors.Wrap(callCtx.Err(), "blob operation did not complete in time")
+	}
+}
+
+// checkAvailable returns the error that stops or pauses the uploads, if any. The final upload is attempted
+// even if the uploads are paused.
+func (o *outputBlob) checkAvailable(final bool) error {
+	if o.failure != nil {
+		return o.failure
+	}
+	if final {
+		o.retryAfter = time.Time{}
+	}
+	if o.now().Before(o.retryAfter) {
+		return errUploadBackingOff
+	}
+	return nil
+}
+
+// write appends data to the blob in blocks no larger than the service limit
+func (o *outputBlob) write(opCtx context.Context, ctx *log.Context, data []byte) error {
+	if err := o.checkAvailable(false); err != nil {
+		return err
+	}
+
+	for written := false; len(data) > 0; written = true {
+		n := len(data)
+		if n > maxAppendBlockSize {
+			n = maxAppendBlockSize
+		}
+
+		if err := o.writeBlock(opCtx, ctx, data[:n]); err != nil {
+			// The data is uploaded again later, which would duplicate the blocks already appended
+			var transientErr *transientAppendError
+			if errors.As(err, &transientErr) && !written {
+				o.backOff(ctx, err)
+				return err
+			}
+
+			ctx.Log("warning", "stopped uploading output", "blob", o.blob.uriForLogging(), "error", err)
+			o.failure = err
+			return err
+		}
+		data = data[n:]
+	}
+
+	if o.consecutiveFailureCount > 0 {
+		ctx.Log("message", "output upload recovered", "blob", o.blob.uriForLogging(), "failures", o.consecutiveFailureCount)
+		o.consecutiveFailureCount = 0
+	}
+	return nil
+}
+
+// backOff pauses the uploads after a transient failure. The error is only logged for the first failure, the
+// status of the command reports the last one.
+func (o *outputBlob) backOff(ctx *log.Context, err error) {
+	o.failureCount++
+	o.consecutiveFailureCount++
+	o.lastError = err
+
+	delay := uploadBackoffMax
+	if o.consecutiveFailureCount <= 10 {
+		if d := uploadBackoffK * time.Duration(1<<(o.consecutiveFailureCount-1)); d < uploadBackoffMax {
+			delay = d
+		}
+	}
+	o.retryAfter = o.now().Add(delay)
+
+	if o.consecutiveFailureCount == 1 {
+		ctx.Log("warning", "failed to upload output, backing off", "blob", o.blob.uriForLogging(), "retryIn", delay, "error", err)
+	} else {
+		ctx.Log("message", "output upload still failing, backing off", "blob", o.blob.uriForLogging(), "failures", o.consecutiveFailureCount, "retryIn", delay)
+	}
+}
+
+// writeBlock appends a single block. Every attempt is conditioned on the expected append position so
+// retrying never duplicates output.
+func (o *outputBlob) writeBlock(opCtx context.Context, ctx *log.Context, block []byte) error {
+	var lastErr error
+	transient := false
+	for n := 0; n < appendBlobRetryN; n++ {
+		if opCtx.Err() != nil {
+			return errors.Wrapf(opCtx.Err(), "stopped appending to blob '%s'", o.blob.uriForLogging())
+		}
+
+		err := o.blob.appendBlock(opCtx, block, o.blobPosition)
+		if err == nil {
+			o.blobPosition += int64(len(block))
+			return nil
+		}
+		lastErr = err
+		transient = false
+
+		switch classifyAppendBlobError(err) {
+		case appendBlobErrorBlobFull:
+			if err := o.roll(opCtx, ctx); err != nil {
+				return err
+			}
+			continue
+		case appendBlobErrorPositionConflict:
+			// The block may have been committed by a previous attempt whose response was lost
+			length, lengthErr := o.blob.length(opCtx)
+			if lengthErr == nil && length == o.blobPosition+int64(len(block)) {
+				ctx.Log("message", "append block already committed by a previous attempt", "blob", o.blob.uriForLogging())
+				o.blobPosition = length
+				return nil
+			}
+			return errors.Wrapf(err, "append blob '%s' was modified by another writer", o.blob.uriForLogging())
+		case appendBlobErrorLeaseConflict:
+			return errors.Wrapf(err, "append blob '%s' is leased or locked by another writer", o.blob.uriForLogging())
+		case appendBlobErrorTransient:
+			transient = true
+			// Already reported while backing off
+			if o.consecutiveFailureCount == 0 {
+				ctx.Log("warning", fmt.Sprintf("transient error appending to blob on attempt %v", n+1), "error", err)
+			}
+			if n < appendBlobRetryN-1 {
+				o.sleep(appendBlobRetryK * time.Duration(int(math.Pow(float64(appendBlobRetryM), float64(n)))))
+			}
+			continue
+		default:
+			return errors.Wrapf(err, "failed to append to blob '%s'", o.blob.uriForLogging())
+		}
+	}
+
+	err := errors.Wrapf(lastErr, "failed to append to blob '%s' after %d attempts", o.blob.uriForLogging(), appendBlobRetryN)
+	if transient {
+		return &transientAppendError{err}
+	}
+	return err
+}
+
+// roll continues the output in a new blob once the current one can't accept more blocks
+func (o *outputBlob) roll(opCtx context.Context, ctx *log.Context) error {
+	if len(o.rolledBlobs) >= maxAppendBlobRolls {
+		return errors.Errorf("append blob '%s' is full and the limit of %d additional blobs was reached", o.blob.uriForLogging(), maxAppendBlobRolls)
+	}
+
+	next, err := o.blob.createNext(opCtx, len(o.rolledBlobs)+1)
+	if err != nil {
+		return errors.Wrapf(err, "append blob '%s' is full and the next blob could not be created", o.blob.uriForLogging())
+	}
+
+	ctx.Log("message", "append blob is full, continuing output in a new blob", "blob", o.blob.uriForLogging(), "next", next.uriForLogging())
+	o.blob = next
+	o.blobPosition = 0
+	o.rolledBlobs = append(o.rolledBlobs, next.uriForLogging())
+	return nil
+}
+
+// subStatuses describes the conditions met while uploading the output, if any
+func (o *outputBlob) subStatuses(name string) []types.InstanceViewSubStatus {
+	if o == nil {
+		return nil
+	}
+
+	var result []types.InstanceViewSubStatus
+	if len(o.rolledBlobs) > 0 {
+		result = append(result, types.InstanceViewSubStatus{
+			Name:    name,
+			Code:    subStatusCodeBlobRolled,
+			Level:   types.SubStatusLevelInfo,
+			Message: fmt.Sprintf("The blob reached its size limit. The output continues in: %v", o.rolledBlobs),
+		})
+	}
+	if o.failureCount > 0 {
+		message := fmt.Sprintf("The output upload failed %d times and was retried later. Last error: %v", o.failureCount, o.lastError)
+		if o.consecutiveFailureCount > 0 {
+			message = fmt.Sprintf("The output upload failed %d times and the output may not be fully uploaded. Last error: %v", o.failureCount, o.lastError)
+		}
+		result = append(result, types.InstanceViewSubStatus{
+			Name:    name,
+			Code:    subStatusCodeBlobUploadDegraded,
+			Level:   types.SubStatusLevelWarning,
+			Message: message,
+		})
+	}
+	if o.failure != nil {
+		result = append(result, types.InstanceViewSubStatus{
+			Name:    name,
+			Code:    subStatusCodeBlobUploadFailed,
+			Level:   types.SubStatusLevelWarning,
+			Message: "The output was not fully uploaded: " + o.failure.Error(),
+		})
+	}
+	return result
+}
+
+type appendBlobErrorKind int
+
+const (
+	appendBlobErrorOther appendBlobErrorKind = iota
+	appendBlobErrorTransient
+	appendBlobErrorBlobFull
+	appendBlobErrorPositionConflict
+	appendBlobErrorLeaseConflict
+)
+
+// classifyAppendBlobError maps the storage error returned by either client to the action to take
+func classifyAppendBlobError(err error) appendBlobErrorKind {
+	statusCode, code := getStorageErrorDetails(err)
+	switch bloberror.Code(code) {
+	case bloberror.BlockCountExceedsLimit, bloberror.MaxBlobSizeConditionNotMet:
+		return appendBlobErrorBlobFull
+	case bloberror.AppendPositionConditionNotMet:
+		return appendBlobErrorPositionConflict
+	case bloberror.LeaseIDMissing, bloberror.LeaseIDMismatchWithBlobOperation, bloberror.LeaseAlreadyPresent, bloberror.LeaseLost, bloberror.ConditionNotMet:
+		return appendBlobErrorLeaseConflict
+	}
+
+	switch {
+	case statusCode == http.StatusPreconditionFailed || statusCode == http.StatusConflict:
+		return appendBlobErrorLeaseConflict
+	case statusCode != 0 && requesthelper.IsTransientHTTPStatusCode(statusCode):
+		return appendBlobErrorTransient
+	case statusCode == 0 && err != nil:
+		// No response from the service (e.g., connection reset)
+		return appendBlobErrorTransient
+	}
+	return appendBlobErrorOther
+}
+
+func getStorageErrorDetails(err error) (statusCode int, code string) {
+	var storageErr storage.AzureStorageServiceError
+	if errors.As(err, &storageErr) {
+		return storageErr.StatusCode, storageErr.Code
+	}
+
+	var responseErr *azcore.ResponseError
+	if errors.As(err, &responseErr) {
+		return responseErr.StatusCode, responseErr.ErrorCode
+	}
+	return 0, ""
+}
+
+// rolledBlobName returns the name of the blob that continues the given one. E.g., output.txt.1
+func rolledBlobName(name string, rollCount int) string {
+	return fmt.Sprintf("%s.%d", name, rollCount)
+}
+
+// sasAppendBlob is an append blob accessed with a SAS token
+type sasAppendBlob struct {
+	ref *storage.Blob
+}
+
+func (b *sasAppendBlob) appendBlock(ctx context.Context, data []byte, position int64) error {
+	appendPosition := uint(position)
+	return callWithTimeout(ctx, func(context.Context) error {
+		return b.ref.AppendBlock(data, &storage.AppendBlockOptions{Timeout: blobServerTimeout, AppendPosition: &appendPosition})
+	})
+}
+
+func (b *sasAppendBlob) length(ctx context.Context) (int64, error) {
+	// The properties are read into a copy so an abandoned call can't race with the next one
+	ref := *b.ref
+	if err := callWithTimeout(ctx, func(context.Context) error {
+		return ref.GetProperties(&storage.GetBlobPropertiesOptions{Timeout: blobServerTimeout})
+	}); err != nil {
+		return 0, err
+	}
+	return ref.Properties.ContentLength, nil
+}
+
+func (b *sasAppendBlob) createNext(ctx context.Context, rollCount int) (appendBlob, error) {
+	next := b.ref.Container.GetBlobReference(rolledBlobName(b.ref.Name, rollCount))
+	if err := callWithTimeout(ctx, func(context.Context) error {
+		return next.PutAppendBlob(&storage.PutBlobOptions{Timeout: blobServerTimeout})
+	}); err != nil {
+		return nil, err
+	}
+	return &sasAppendBlob{ref: next}, nil
+}
+
+func (b *sasAppendBlob) uriForLogging() string {
+	return download.GetUriForLogging(b.ref.GetURL())
+}
+
+// clientAppendBlob is an append blob accessed with a managed identity
+type clientAppendBlob struct {
+	client          *appendblob.Client
+	managedIdentity *handlersettings.RunCommandManagedIdentity
+}
+
+func (b *clientAppendBlob) appendBlock(ctx context.Context, data []byte, position int64) error {
+	return callWithTimeout(ctx, func(callCtx context.Context) error {
+		_, err := b.client.AppendBlock(callCtx, streaming.NopCloser(bytes.NewReader(data)), &appendblob.AppendBlockOptions{
+			AppendPositionAccessConditions: &appendblob.AppendPositionAccessConditions{AppendPosition: &position},
+		})
+		return err
+	})
+}
+
+func (b *clientAppendBlob) length(ctx context.Context) (int64, error) {
+	var contentLength *int64
+	if err := callWithTimeout(ctx, func(callCtx context.Context) error {
+		properties, err := b.client.GetProperties(callCtx, nil)
+		contentLength = properties.ContentLength
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	if contentLength == nil {
+		return 0, errors.New("blob properties do not contain the content length")
+	}
+	return *contentLength, nil
+}
+
+func (b *clientAppendBlob) createNext(ctx context.Context, rollCount int) (appendBlob, error) {
+	blobURL, err := url.Parse(b.client.URL())
+	if err != nil {
+		return nil, err
+	}
+	blobURL.Path = rolledBlobName(blobURL.Path, rollCount)
+
+	client, err := createOrReplaceAppendBlobUsingManagedIdentity(ctx, blobURL.String(), b.managedIdentity)
+	if err != nil {
+		return nil, err
+	}
+	return &clientAppendBlob{client: client, managedIdentity: b.managedIdentity}, nil
+}
+
+func (b *clientAppendBlob) uriForLogging() string {
+	return download.GetUriForLogging(b.client.URL())
+}
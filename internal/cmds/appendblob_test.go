@@ -0,0 +1,250 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAppendBlob keeps the appended data in memory and returns the queued errors before appending
+type fakeAppendBlob struct {
+	name     string
+	data     []byte
+	errs     []error
+	next     *fakeAppendBlob
+	attempts int
+}
+
+func (b *fakeAppendBlob) appendBlock(ctx context.Context, data []byte, position int64) error {
+	b.attempts++
+	if len(b.errs) > 0 {
+		err := b.errs[0]
+		b.errs = b.errs[1:]
+		return err
+	}
+	if position != int64(len(b.data)) {
+		return storage.AzureStorageServiceError{StatusCode: http.StatusPreconditionFailed, Code: "AppendPositionConditionNotMet"}
+	}
+	b.data = append(b.data, data...)
+	return nil
+}
+
+func (b *fakeAppendBlob) length(ctx context.Context) (int64, error) {
+	return int64(len(b.data)), nil
+}
+
+func (b *fakeAppendBlob) createNext(ctx context.Context, rollCount int) (appendBlob, error) {
+	b.next = &fakeAppendBlob{name: rolledBlobName(b.name, rollCount)}
+	return b.next, nil
+}
+
+func (b *fakeAppendBlob) uriForLogging() string {
+	return b.name
+}
+
+func newFakeOutputBlob(blob *fakeAppendBlob) *outputBlob {
+	return &outputBlob{blob: blob, sleep: func(time.Duration) {}, now: time.Now}
+}
+
+func Test_outputBlob_writeSplitsIntoBlocks(t *testing.T) {
+	blob := &fakeAppendBlob{name: "output.txt"}
+	o := newFakeOutputBlob(blob)
+
+	data := make([]byte, maxAppendBlockSize+10)
+	require.Nil(t, o.write(context.Background(), log.NewContext(log.NewNopLogger()), data))
+	require.Equal(t, 2, blob.attempts)
+	require.Equal(t, len(data), len(blob.data))
+	require.Empty(t, o.subStatuses("outputBlobUri"))
+}
+
+func Test_outputBlob_retriesTransientErrors(t *testing.T) {
+	blob := &fakeAppendBlob{name: "output.txt", errs: []error{
+		storage.AzureStorageServiceError{StatusCode: http.StatusServiceUnavailable, Code: "ServerBusy"},
+	}}
+	o := newFakeOutputBlob(blob)
+
+	require.Nil(t, o.write(context.Background(), log.NewContext(log.NewNopLogger()), []byte("hello")))
+	require.Equal(t, "hello", string(blob.data))
+	require.Equal(t, 2, blob.attempts)
+}
+
+func Test_outputBlob_rollsWhenBlobIsFull(t *testing.T) {
+	blob := &fakeAppendBlob{name: "output.txt", errs: []error{
+		storage.AzureStorageServiceError{StatusCode: http.StatusConflict, Code: "BlockCountExceedsLimit"},
+	}}
+	o := newFakeOutputBlob(blob)
+
+	require.Nil(t, o.write(context.Background(), log.NewContext(log.NewNopLogger()), []byte("hello")))
+	require.Empty(t, blob.data)
+	require.NotNil(t, blob.next)
+	require.Equal(t, "hello", string(blob.next.data))
+
+	subStatuses := o.subStatuses("outputBlobUri")
+	require.Len(t, subStatuses, 1)
+	require.Equal(t, subStatusCodeBlobRolled, subStatuses[0].Code)
+	require.Equal(t, types.SubStatusLevelInfo, subStatuses[0].Level)
+	require.Contains(t, subStatuses[0].Message, "output.txt.1")
+}
+
+func Test_outputBlob_positionConflictAfterCommittedAttempt(t *testing.T) {
+	blob := &fakeAppendBlob{name: "output.txt", data: []byte("hello")}
+	o := newFakeOutputBlob(blob)
+
+	// The previous attempt was committed but the client did not get the response
+	require.Nil(t, o.write(context.Background(), log.NewContext(log.NewNopLogger()), []byte("hello")))
+	require.Equal(t, "hello", string(blob.data))
+	require.Empty(t, o.subStatuses("outputBlobUri"))
+}
+
+func Test_outputBlob_leaseConflictStopsUploading(t *testing.T) {
+	blob := &fakeAppendBlob{name: "output.txt", errs: []error{
+		storage.AzureStorageServiceError{StatusCode: http.StatusPreconditionFailed, Code: "LeaseIdMissing"},
+	}}
+	o := newFakeOutputBlob(blob)
+	ctx := log.NewContext(log.NewNopLogger())
+
+	require.NotNil(t, o.write(context.Background(), ctx, []byte("hello")))
+	require.NotNil(t, o.write(context.Background(), ctx, []byte("world")))
+	require.Equal(t, 1, blob.attempts)
+	require.Empty(t, blob.data)
+
+	subStatuses := o.subStatuses("outputBlobUri")
+	require.Len(t, subStatuses, 1)
+	require.Equal(t, "outputBlobUri", subStatuses[0].Name)
+	require.Equal(t, subStatusCodeBlobUploadFailed, subStatuses[0].Code)
+	require.Equal(t, types.SubStatusLevelWarning, subStatuses[0].Level)
+	require.Contains(t, subStatuses[0].Message, "leased")
+}
+
+func Test_outputBlob_backsOffAfterTransientErrors(t *testing.T) {
+	var errs []error
+	for i := 0; i < 2*appendBlobRetryN; i++ {
+		errs = append(errs, storage.AzureStorageServiceError{StatusCode: http.StatusServiceUnavailable, Code: "ServerBusy"})
+	}
+	blob := &fakeAppendBlob{name: "output.txt", errs: errs}
+	o := newFakeOutputBlob(blob)
+	now := time.Now()
+	o.now = func() time.Time { return now }
+	ctx := log.NewContext(log.NewNopLogger())
+
+	require.NotNil(t, o.write(context.Background(), ctx, []byte("hello")))
+	require.Equal(t, appendBlobRetryN, blob.attempts)
+	require.Nil(t, o.failure)
+
+	// Not attempted until the backoff elapses
+	require.Equal(t, errUploadBackingOff, o.write(context.Background(), ctx, []byte("hello")))
+	require.Equal(t, appendBlobRetryN, blob.attempts)
+
+	now = now.Add(uploadBackoffK)
+	require.NotNil(t, o.write(context.Background(), ctx, []byte("hello")))
+	require.Equal(t, 2*appendBlobRetryN, blob.attempts)
+
+	// The backoff doubles
+	now = now.Add(uploadBackoffK)
+	require.Equal(t, errUploadBackingOff, o.checkAvailable(false))
+	subStatuses := o.subStatuses("outputBlobUri")
+	require.Len(t, subStatuses, 1)
+	require.Equal(t, subStatusCodeBlobUploadDegraded, subStatuses[0].Code)
+	require.Equal(t, types.SubStatusLevelWarning, subStatuses[0].Level)
+	require.Contains(t, subStatuses[0].Message, "failed 2 times")
+	require.Contains(t, subStatuses[0].Message, "ServerBusy")
+
+	// The final upload is attempted regardless
+	require.Nil(t, o.checkAvailable(true))
+	require.Nil(t, o.write(context.Background(), ctx, []byte("hello")))
+	require.Equal(t, "hello", string(blob.data))
+	subStatuses = o.subStatuses("outputBlobUri")
+	require.Len(t, subStatuses, 1)
+	require.Contains(t, subStatuses[0].Message, "retried later")
+}
+
+func Test_appendToBlob_noBlob(t *testing.T) {
+	position, err := appendToBlob(context.Background(), "/non/existing/file", nil, 10, true, log.NewContext(log.NewNopLogger()))
+	require.Nil(t, err)
+	require.Equal(t, int64(10), position)
+}
+
+func Test_outputBlob_stopsWhenOperationIsCancelled(t *testing.T) {
+	blob := &fakeAppendBlob{name: "output.txt"}
+	o := newFakeOutputBlob(blob)
+
+	opCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := o.write(opCtx, log.NewContext(log.NewNopLogger()), []byte("hello"))
+	require.True(t, errors.Is(err, context.Canceled))
+	require.Equal(t, 0, blob.attempts)
+	require.Len(t, o.subStatuses("outputBlobUri"), 1)
+}
+
+func Test_callWithTimeout(t *testing.T) {
+	require.Nil(t, callWithTimeout(context.Background(), func(context.Context) error { return nil }))
+
+	// A call that ignores the context is abandoned once the context is done
+	opCtx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	release := make(chan bool)
+	defer close(release)
+	err := callWithTimeout(opCtx, func(context.Context) error {
+		<-release
+		return nil
+	})
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func Test_appendToBlob_holdsBackIncompleteCharacter(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "stdout")
+	blob := &fakeAppendBlob{name: "output.txt"}
+	o := newFakeOutputBlob(blob)
+	ctx := log.NewContext(log.NewNopLogger())
+
+	// "✓" is e2 9c 93 and the script has only written its first two bytes
+	require.Nil(t, os.WriteFile(path, []byte{'o', 'k', ' ', 0xe2, 0x9c}, 0600))
+	position, err := appendToBlob(context.Background(), path, o, 0, false, ctx)
+	require.Nil(t, err)
+	require.Equal(t, int64(3), position)
+	require.Equal(t, "ok ", string(blob.data))
+
+	require.Nil(t, os.WriteFile(path, []byte{'o', 'k', ' ', 0xe2, 0x9c, 0x93, 0xe9}, 0600))
+	position, err = appendToBlob(context.Background(), path, o, position, true, ctx)
+	require.Nil(t, err)
+	require.Equal(t, int64(7), position)
+	require.Equal(t, "ok ✓é", string(blob.data))
+}
+
+func Test_appendToBlob_uploadsInChunks(t *testing.T) {
+	defer func(size int) { outputChunkSize = size }(outputChunkSize)
+	outputChunkSize = 4
+
+	path := filepath.Join(t.TempDir(), "stdout")
+	blob := &fakeAppendBlob{name: "output.txt"}
+	o := newFakeOutputBlob(blob)
+	ctx := log.NewContext(log.NewNopLogger())
+
+	// "✓" (e2 9c 93) is cut by the end of the first chunk
+	require.Nil(t, os.WriteFile(path, []byte("ok ✓ done"), 0600))
+	position, err := appendToBlob(context.Background(), path, o, 0, false, ctx)
+	require.Nil(t, err)
+	require.Equal(t, int64(len("ok ✓ done")), position)
+	require.Equal(t, "ok ✓ done", string(blob.data))
+	require.Greater(t, blob.attempts, 2)
+
+	// A character cut by the end of the file is uploaded once complete, or when final
+	require.Nil(t, os.WriteFile(path, []byte{'o', 'k', ' ', 0xe2, 0x9c, 0x93, 0x20, 0x64, 0x6f, 0x6e, 0x65, 0xe2, 0x9c}, 0600))
+	position, err = appendToBlob(context.Background(), path, o, position, false, ctx)
+	require.Nil(t, err)
+	require.Equal(t, int64(11), position)
+	position, err = appendToBlob(context.Background(), path, o, position, true, ctx)
+	require.Nil(t, err)
+	require.Equal(t, int64(13), position)
+}
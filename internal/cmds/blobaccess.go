@@ -0,0 +1,33 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/identitydiagnosis"
+	"github.com/Azure/run-command-handler-linux/pkg/download"
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	// Roles the managed identities need on the container of a blob to read the script and artifacts, and to write
+	// the output
+	roleBlobReader      = "Storage Blob Data Reader"
+	roleBlobContributor = "Storage Blob Data Contributor"
+
+	blobAccessDocumentation = "For more info, refer https://aka.ms/RunCommandManagedLinux"
+)
+
+// diagnoseIdentity diagnoses the managed identity of the VM, replaced in tests
+var diagnoseIdentity = identitydiagnosis.Diagnose
+
+// blobAccessGuidance explains a failure to access blobURI. Azure storage blobs are accessed with a managed identity
+// when there is no SAS token or it failed, so the managed identity is diagnosed to tell which of its usual causes
+// applies.
+func blobAccessGuidance(ctx *log.Context, blobURI string, mi *handlersettings.RunCommandManagedIdentity, role string) string {
+	if !download.IsAzureStorageBlobUri(blobURI) {
+		return "Make sure the URI is public, or use an Azure storage blob SAS URI or a storage blob accessible by a managed identity. " + blobAccessDocumentation
+	}
+	diagnosis := diagnoseIdentity(ctx, mi, download.GetResourceNameFromBlobUri(blobURI))
+	return fmt.Sprintf("If a SAS token is used, make sure it is valid and not expired. %s %s", diagnosis.String(role), blobAccessDocumentation)
+}
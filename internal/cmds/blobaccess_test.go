@@ -0,0 +1,34 @@
+package commands
+
+import (
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/identitydiagnosis"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_blobAccessGuidance(t *testing.T) {
+	defer func(d func(*log.Context, *handlersettings.RunCommandManagedIdentity, string) identitydiagnosis.Diagnosis) {
+		diagnoseIdentity = d
+	}(diagnoseIdentity)
+	var diagnosed *handlersettings.RunCommandManagedIdentity
+	diagnoseIdentity = func(ctx *log.Context, mi *handlersettings.RunCommandManagedIdentity, resource string) identitydiagnosis.Diagnosis {
+		require.Equal(t, "https://storage.azure.com/", resource)
+		diagnosed = mi
+		return identitydiagnosis.Diagnosis{Findings: []string{"system-assigned identity available (object id oid-1)"}, TokenAcquired: true}
+	}
+	ctx := log.NewContext(log.NewNopLogger())
+
+	// The identities are not diagnosed for the URIs which are not storage blobs
+	require.Equal(t, "Make sure the URI is public, or use an Azure storage blob SAS URI or a storage blob accessible by a managed identity. For more info, refer https://aka.ms/RunCommandManagedLinux",
+		blobAccessGuidance(ctx, "https://example.com/script.sh", nil, roleBlobReader))
+	require.Nil(t, diagnosed)
+
+	mi := &handlersettings.RunCommandManagedIdentity{ClientId: "client-1"}
+	require.Equal(t, "If a SAS token is used, make sure it is valid and not expired. Managed identity diagnosis: system-assigned identity available (object id oid-1). "+
+		"The identity got a token for the storage account, make sure it has the 'Storage Blob Data Contributor' role assignment on the container of the blob. For more info, refer https://aka.ms/RunCommandManagedLinux",
+		blobAccessGuidance(ctx, "https://account.blob.core.windows.net/output/stdout.txt", mi, roleBlobContributor))
+	require.Equal(t, mi, diagnosed)
+}
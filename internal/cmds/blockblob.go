@@ -0,0 +1,164 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/pkg/download"
+	"github.com/pkg/errors"
+)
+
+// Error codes of the storage accounts rejecting append blobs, e.g., with a hierarchical namespace (ADLS Gen2) or
+// premium block blob accounts
+var appendBlobUnsupportedCodes = map[string]bool{
+	"FeatureNotYetSupportedForHierarchicalNamespaceAccounts": true,
+	"BlobTypeNotSupported": true,
+	"FeatureNotSupported":  true,
+}
+
+// appendBlobsUnsupported returns whether creating an append blob failed because the storage account doesn't
+// support them
+func appendBlobsUnsupported(err error) bool {
+	_, code := getStorageErrorDetails(err)
+	return appendBlobUnsupportedCodes[code]
+}
+
+// blockList is the list of blocks committed to a block blob emulating an append blob. Every append stages a new
+// block and commits the list with it, so the output is readable as it is uploaded. Appending again the same block
+// reuses its id, which makes retrying an append whose response was lost harmless.
+type blockList struct {
+	ids    []string
+	length int64
+}
+
+// next returns the id of the block appended at position. The ids have the same length, as required by the service.
+func (l *blockList) next(uri string, position int64) (string, error) {
+	if position != l.length {
+		return "", errors.Errorf("block blob '%s' has %d bytes, can't append at %d", uri, l.length, position)
+	}
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%010d", len(l.ids)))), nil
+}
+
+// committed records the block committed with the given id
+func (l *blockList) committed(id string, size int) {
+	l.ids = append(l.ids, id)
+	l.length += int64(size)
+}
+
+// sasBlockBlob is a block blob accessed with a SAS token
+type sasBlockBlob struct {
+	ref    *storage.Blob
+	blocks blockList
+}
+
+func (b *sasBlockBlob) appendBlock(ctx context.Context, data []byte, position int64) error {
+	id, err := b.blocks.next(b.uriForLogging(), position)
+	if err != nil {
+		return err
+	}
+	blocks := make([]storage.Block, 0, len(b.blocks.ids)+1)
+	for _, committed := range append(append([]string(nil), b.blocks.ids...), id) {
+		blocks = append(blocks, storage.Block{ID: committed, Status: storage.BlockStatusLatest})
+	}
+	if err := callWithTimeout(ctx, func(context.Context) error {
+		if err := b.ref.PutBlock(id, data, &storage.PutBlockOptions{Timeout: blobServerTimeout}); err != nil {
+			return err
+		}
+		return b.ref.PutBlockList(blocks, &storage.PutBlockListOptions{Timeout: blobServerTimeout})
+	}); err != nil {
+		return err
+	}
+	b.blocks.committed(id, len(data))
+	return nil
+}
+
+func (b *sasBlockBlob) length(ctx context.Context) (int64, error) {
+	// The properties are read into a copy so an abandoned call can't race with the next one
+	ref := *b.ref
+	if err := callWithTimeout(ctx, func(context.Context) error {
+		return ref.GetProperties(&storage.GetBlobPropertiesOptions{Timeout: blobServerTimeout})
+	}); err != nil {
+		return 0, err
+	}
+	return ref.Properties.ContentLength, nil
+}
+
+func (b *sasBlockBlob) createNext(ctx context.Context, rollCount int) (appendBlob, error) {
+	next := b.ref.Container.GetBlobReference(rolledBlobName(b.ref.Name, rollCount))
+	if err := callWithTimeout(ctx, func(context.Context) error {
+		return next.CreateBlockBlob(&storage.PutBlobOptions{Timeout: blobServerTimeout})
+	}); err != nil {
+		return nil, err
+	}
+	return &sasBlockBlob{ref: next}, nil
+}
+
+func (b *sasBlockBlob) uriForLogging() string {
+	return download.GetUriForLogging(b.ref.GetURL())
+}
+
+// clientBlockBlob is a block blob accessed with a managed identity
+type clientBlockBlob struct {
+	client          *blockblob.Client
+	managedIdentity *handlersettings.RunCommandManagedIdentity
+	blocks          blockList
+}
+
+func (b *clientBlockBlob) appendBlock(ctx context.Context, data []byte, position int64) error {
+	id, err := b.blocks.next(b.uriForLogging(), position)
+	if err != nil {
+		return err
+	}
+	ids := append(append([]string(nil), b.blocks.ids...), id)
+	if err := callWithTimeout(ctx, func(callCtx context.Context) error {
+		if _, err := b.client.StageBlock(callCtx, id, streaming.NopCloser(bytes.NewReader(data)), nil); err != nil {
+			return err
+		}
+		_, err := b.client.CommitBlockList(callCtx, ids, nil)
+		return err
+	}); err != nil {
+		return err
+	}
+	b.blocks.committed(id, len(data))
+	return nil
+}
+
+func (b *clientBlockBlob) length(ctx context.Context) (int64, error) {
+	var contentLength *int64
+	if err := callWithTimeout(ctx, func(callCtx context.Context) error {
+		properties, err := b.client.GetProperties(callCtx, nil)
+		contentLength = properties.ContentLength
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	if contentLength == nil {
+		return 0, errors.New("blob properties do not contain the content length")
+	}
+	return *contentLength, nil
+}
+
+func (b *clientBlockBlob) createNext(ctx context.Context, rollCount int) (appendBlob, error) {
+	blobURL, err := url.Parse(b.client.URL())
+	if err != nil {
+		return nil, err
+	}
+	blobURL.Path = rolledBlobName(blobURL.Path, rollCount)
+
+	client, err := createOrReplaceBlockBlobUsingManagedIdentity(ctx, blobURL.String(), b.managedIdentity)
+	if err != nil {
+		return nil, err
+	}
+	return &clientBlockBlob{client: client, managedIdentity: b.managedIdentity}, nil
+}
+
+func (b *clientBlockBlob) uriForLogging() string {
+	return download.GetUriForLogging(b.client.URL())
+}
@@ -0,0 +1,89 @@
+package commands
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_appendBlobsUnsupported(t *testing.T) {
+	require.True(t, appendBlobsUnsupported(errors.Wrap(storage.AzureStorageServiceError{
+		StatusCode: http.StatusConflict, Code: "FeatureNotYetSupportedForHierarchicalNamespaceAccounts"}, "failed")))
+	require.False(t, appendBlobsUnsupported(storage.AzureStorageServiceError{StatusCode: http.StatusForbidden, Code: "AuthorizationFailure"}))
+	require.False(t, appendBlobsUnsupported(errors.New("connection reset")))
+}
+
+func Test_blockList(t *testing.T) {
+	var l blockList
+	id, err := l.next("blob", 0)
+	require.Nil(t, err)
+	require.Equal(t, base64.StdEncoding.EncodeToString([]byte("0000000000")), id)
+
+	// Retrying the same append reuses the id
+	again, err := l.next("blob", 0)
+	require.Nil(t, err)
+	require.Equal(t, id, again)
+
+	l.committed(id, 5)
+	next, err := l.next("blob", 5)
+	require.Nil(t, err)
+	require.Equal(t, base64.StdEncoding.EncodeToString([]byte("0000000001")), next)
+	require.Equal(t, len(id), len(next))
+
+	_, err = l.next("blob", 3)
+	require.EqualError(t, err, "block blob 'blob' has 5 bytes, can't append at 3")
+}
+
+// blockBlobServer is a storage service keeping the staged blocks of a block blob and its committed content
+type blockBlobServer struct {
+	mu      sync.Mutex
+	staged  map[string]string
+	content string
+}
+
+func (s *blockBlobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	switch r.URL.Query().Get("comp") {
+	case "block":
+		s.staged[r.URL.Query().Get("blockid")] = string(body)
+	case "blocklist":
+		var content strings.Builder
+		for _, element := range strings.Split(string(body), "<Latest>")[1:] {
+			content.WriteString(s.staged[strings.Split(element, "</Latest>")[0]])
+		}
+		s.content = content.String()
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func Test_clientBlockBlob_appendsBlocks(t *testing.T) {
+	server := &blockBlobServer{staged: map[string]string{}}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	client, err := blockblob.NewClientWithNoCredential(httpServer.URL+"/container/output.txt", nil)
+	require.Nil(t, err)
+	blob := &clientBlockBlob{client: client}
+	o := &outputBlob{blob: blob, sleep: func(time.Duration) {}, now: time.Now}
+	ctx := log.NewContext(log.NewNopLogger())
+
+	require.Nil(t, o.write(context.Background(), ctx, []byte("hello ")))
+	require.Nil(t, o.write(context.Background(), ctx, []byte("world")))
+	require.Equal(t, "hello world", server.content)
+	require.Equal(t, int64(11), o.blobPosition)
+	require.Len(t, blob.blocks.ids, 2)
+}
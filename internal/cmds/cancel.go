@@ -0,0 +1,54 @@
+package commands
+
+import (
+	"os"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
+	"github.com/Azure/run-command-handler-linux/internal/exec"
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/pid"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// cancelGracePeriod is how long the script has to exit once sent SIGTERM before it is killed
+const cancelGracePeriod = 10 * time.Second
+
+// errScriptCanceled is the error of an execution whose script was canceled
+var errScriptCanceled = errors.New("the script was canceled")
+
+// cancelPre fails when no script of the run command is executing, before any status is reported, so the status of
+// a completed execution is left as is
+func cancelPre(ctx *log.Context, h types.HandlerEnvironment, metadata types.RCMetadata, c types.Cmd) error {
+	if !pid.IsExtensionStillRunning(metadata.PidFilePath) {
+		return errors.New("no script of the run command is executing, there is nothing to cancel")
+	}
+	return nil
+}
+
+// cancel terminates the script executing for the run command and reports the execution as canceled. The enable
+// operation executing the script reports it as canceled too once the script exits.
+func cancel(ctx *log.Context, h types.HandlerEnvironment, report *types.RunCommandInstanceView, metadata types.RCMetadata, c types.Cmd) (string, string, error, int) {
+	dir := datapaths.SeqNumDir(metadata.DownloadPath, metadata.SeqNum)
+	if err := os.WriteFile(datapaths.CancelMarkerFilePath(dir), nil, 0600); err != nil {
+		return "", "", errors.Wrap(err, "failed to record the cancellation"), constants.ExitCode_CommandExecutionFailed
+	}
+
+	if !pid.TerminateExtensionScripts(ctx, metadata.PidFilePath, cancelGracePeriod) {
+		ctx.Log("message", "the script completed before it was canceled")
+	}
+
+	stdoutF, stderrF := exec.LogPaths(dir)
+	stdoutTail, stderrTail := getOutput(ctx, stdoutF, stderrF, handlersettings.DefaultMaxStatusOutputBytes)
+	ctx.Log("event", "canceled")
+	return stdoutTail, stderrTail, errScriptCanceled, constants.ExitCode_ScriptCanceled
+}
+
+// isCanceled returns whether the execution was canceled by the cancel operation
+func isCanceled(dir string) bool {
+	_, err := os.Stat(datapaths.CancelMarkerFilePath(dir))
+	return err == nil
+}
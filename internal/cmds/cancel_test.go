@@ -0,0 +1,37 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_cancelPre_nothingToCancel(t *testing.T) {
+	metadata := types.NewRCMetadata("RC0001", 1, constants.DownloadFolder, t.TempDir())
+	metadata.PidFilePath = filepath.Join(t.TempDir(), "RC0001.pidstart")
+	err := cancelPre(log.NewContext(log.NewNopLogger()), types.HandlerEnvironment{}, metadata, CmdCancel)
+	require.EqualError(t, err, "no script of the run command is executing, there is nothing to cancel")
+}
+
+func Test_cancel(t *testing.T) {
+	dataDir := t.TempDir()
+	metadata := types.NewRCMetadata("RC0001", 1, constants.DownloadFolder, dataDir)
+	metadata.PidFilePath = filepath.Join(dataDir, "RC0001.pidstart")
+	dir := datapaths.SeqNumDir(metadata.DownloadPath, metadata.SeqNum)
+	require.Nil(t, os.MkdirAll(dir, 0700))
+	stdoutF, _ := datapaths.OutputFilePaths(dir)
+	require.Nil(t, os.WriteFile(stdoutF, []byte("started\n"), 0600))
+	require.False(t, isCanceled(dir))
+
+	stdout, _, err, exitCode := cancel(log.NewContext(log.NewNopLogger()), types.HandlerEnvironment{}, &types.RunCommandInstanceView{}, metadata, CmdCancel)
+	require.Equal(t, errScriptCanceled, err)
+	require.Equal(t, constants.ExitCode_ScriptCanceled, exitCode)
+	require.Equal(t, "started\n", stdout)
+	require.True(t, isCanceled(dir), "the enable operation reports the execution as canceled")
+}
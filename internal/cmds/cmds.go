@@ -10,24 +10,44 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/appendblob"
-	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
 	"github.com/Azure/run-command-handler-linux/internal/cleanup"
+	"github.com/Azure/run-command-handler-linux/internal/clock"
 	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
+	"github.com/Azure/run-command-handler-linux/internal/dependencies"
 	"github.com/Azure/run-command-handler-linux/internal/exec"
+	"github.com/Azure/run-command-handler-linux/internal/featureflags"
 	"github.com/Azure/run-command-handler-linux/internal/files"
 	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
 	"github.com/Azure/run-command-handler-linux/internal/immediatecmds"
 	"github.com/Azure/run-command-handler-linux/internal/instanceview"
+	"github.com/Azure/run-command-handler-linux/internal/multistep"
+	"github.com/Azure/run-command-handler-linux/internal/netready"
+	"github.com/Azure/run-command-handler-linux/internal/outputfile"
 	"github.com/Azure/run-command-handler-linux/internal/pid"
+	"github.com/Azure/run-command-handler-linux/internal/proctree"
+	"github.com/Azure/run-command-handler-linux/internal/readiness"
+	"github.com/Azure/run-command-handler-linux/internal/scriptlibrary"
+	"github.com/Azure/run-command-handler-linux/internal/scriptpolicy"
+	"github.com/Azure/run-command-handler-linux/internal/scriptprogress"
+	"github.com/Azure/run-command-handler-linux/internal/scripttemplate"
 	"github.com/Azure/run-command-handler-linux/internal/status"
 	"github.com/Azure/run-command-handler-linux/internal/telemetry"
 	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/Azure/run-command-handler-linux/pkg/atomicfile"
 	"github.com/Azure/run-command-handler-linux/pkg/download"
+	"github.com/Azure/run-command-handler-linux/pkg/encodingutil"
+	"github.com/Azure/run-command-handler-linux/pkg/requestheaders"
 	seqnum "github.com/Azure/run-command-handler-linux/pkg/seqnumutil"
 	"github.com/Azure/run-command-handler-linux/pkg/versionutil"
 	"github.com/go-kit/kit/log"
@@ -35,26 +55,43 @@ import (
 )
 
 const (
-	maxScriptSize         = 256 * 1024
-	updateStatusInSeconds = 30
+	maxScriptSize            = 256 * 1024
+	updateStatusInSeconds    = 30
+	maxUpdateStatusInSeconds = 300
 )
 
+// statusClock times the partial status updates of the running scripts
+var statusClock clock.Clock = clock.Real
+
+// outputChunkSize bounds the memory used to upload the output files to the append blobs. A chunk at most doubles
+// in size once made valid UTF-8, so it is uploaded as a single block and either fully uploaded or not at all.
+var outputChunkSize = maxAppendBlockSize / 2
+
 const (
 	fullName                = "Microsoft.Compute.CPlat.Core.RunCommandLinux"
-	maxTailLen              = 4 * 1024 // length of max stdout/stderr to be transmitted in .status file
 	maxTelemetryTailLen int = 1800
+
+	// SubStatus codes reported when the exit code of the script is mapped by exitCodeMappings
+	subStatusCodeScriptSucceededWithWarning = "ScriptSucceededWithWarning"
+	subStatusCodeScriptSkipped              = "ScriptSkipped"
 )
 
 var (
 	cmdDefaultReportStatusFunc = status.ReportStatusToLocalFile
 	cmdDefaultCleanupFunc      = cleanup.RunCommandCleanup
-	telemetryResult            = telemetry.SendTelemetry(telemetry.NewTelemetryEventSender(), fullName, versionutil.Version)
+	telemetryResult            = telemetry.SendTelemetry(fullName, versionutil.Version)
+
+	// errorLinePattern matches the stderr lines kept in the status when the output is truncated, as they usually
+	// explain the failure better than the last lines
+	errorLinePattern = regexp.MustCompile(`(?i)\b(error|fatal|fail(ed|ure)?|exception|traceback|panic|denied|not found|no such file)\b`)
 
 	CmdInstall   = types.CmdInstallTemplate.InitializeFunctions(types.CmdFunctions{Invoke: install, Pre: nil, ReportStatus: cmdDefaultReportStatusFunc, Cleanup: cmdDefaultCleanupFunc})
 	CmdEnable    = types.CmdEnableTemplate.InitializeFunctions(types.CmdFunctions{Invoke: enable, Pre: enablePre, ReportStatus: cmdDefaultReportStatusFunc, Cleanup: cmdDefaultCleanupFunc})
 	CmdDisable   = types.CmdDisableTemplate.InitializeFunctions(types.CmdFunctions{Invoke: disable, Pre: nil, ReportStatus: cmdDefaultReportStatusFunc, Cleanup: cmdDefaultCleanupFunc})
 	CmdUpdate    = types.CmdUpdateTemplate.InitializeFunctions(types.CmdFunctions{Invoke: update, Pre: nil, ReportStatus: cmdDefaultReportStatusFunc, Cleanup: cmdDefaultCleanupFunc})
 	CmdUninstall = types.CmdUninstallTemplate.InitializeFunctions(types.CmdFunctions{Invoke: uninstall, Pre: nil, ReportStatus: cmdDefaultReportStatusFunc, Cleanup: cmdDefaultCleanupFunc})
+	CmdCancel    = types.CmdCancelTemplate.InitializeFunctions(types.CmdFunctions{Invoke: cancel, Pre: cancelPre, ReportStatus: cmdDefaultReportStatusFunc, Cleanup: cmdDefaultCleanupFunc})
+	CmdValidate  = types.CmdValidateTemplate.InitializeFunctions(types.CmdFunctions{Invoke: validate, Pre: nil, ReportStatus: cmdDefaultReportStatusFunc, Cleanup: nil})
 
 	Cmds = map[string]types.Cmd{
 		"install":   CmdInstall,
@@ -62,12 +99,21 @@ var (
 		"disable":   CmdDisable,
 		"update":    CmdUpdate,
 		"uninstall": CmdUninstall,
+		"cancel":    CmdCancel,
+		"validate":  CmdValidate,
 	}
 )
 
 func update(ctx *log.Context, h types.HandlerEnvironment, report *types.RunCommandInstanceView, metadata types.RCMetadata, c types.Cmd) (string, string, error, int) {
+	migrated, err := migrateStateFromPreviousVersion(ctx, h)
+	if err != nil {
+		rollbackMigratedState(ctx, migrated)
+		return "", "", errors.Wrap(err, "failed to migrate state from the previous version"), constants.ExitCode_MigrateStateFailed
+	}
+
 	exitCode, err := immediatecmds.Update(ctx, h, metadata.ExtName, metadata.SeqNum)
 	if err != nil {
+		rollbackMigratedState(ctx, migrated)
 		return "", "", err, exitCode
 	}
 
@@ -119,7 +165,33 @@ func uninstall(ctx *log.Context, h types.HandlerEnvironment, report *types.RunCo
 	return "", "", nil, constants.ExitCode_Okay
 }
 
-func enablePre(ctx *log.Context, h types.HandlerEnvironment, metadata types.RCMetadata, c types.Cmd) error {
+func enablePre(ctx *log.Context, h types.HandlerEnvironment, metadata types.RCMetadata, c types.Cmd) (err error) {
+	// exit if another invocation of the handler (e.g., a retry of the agent) is executing this sequence number. The
+	// lock is held until enable returns.
+	if err := lockExecution(metadata); err != nil {
+		ctx.Log("event", "exit", "message", err.Error())
+		return err
+	}
+	defer func() {
+		if err != nil {
+			releaseExecution(metadata)
+		}
+	}()
+
+	// an execution resumed after a reboot requested by its script processes its sequence number again
+	if multistep.Resuming(metadata.ExtName, metadata.SeqNum) {
+		ctx.Log("event", "resuming the execution after a reboot")
+		return nil
+	}
+
+	// the sequence numbers of the extension are checked and saved one invocation at a time, so a smaller one is
+	// never saved over a greater one
+	unlock, err := lockExtensionState(metadata)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	// exit if this sequence number (a snapshot of the configuration) is already
 	// processed. if not, save this sequence number before proceeding.
 	if shouldExit, err := checkAndSaveSeqNum(ctx, metadata.SeqNum, metadata.MostRecentSequence); err != nil {
@@ -134,6 +206,18 @@ func enablePre(ctx *log.Context, h types.HandlerEnvironment, metadata types.RCMe
 }
 
 func enable(ctx *log.Context, h types.HandlerEnvironment, report *types.RunCommandInstanceView, metadata types.RCMetadata, c types.Cmd) (string, string, error, int) {
+	defer releaseExecution(metadata)
+	logPath := handlerLogPath(metadata)
+	logStart := logFileSize(logPath)
+
+	stdout, stderr, err, exitCode := enableScript(ctx, h, report, metadata, c)
+	if _, rebootPending := multistep.IsRebootPending(err); err != nil && !rebootPending {
+		uploadHandlerLogsOnFailure(ctx, h, report, metadata, logPath, logStart, err, exitCode)
+	}
+	return stdout, stderr, err, exitCode
+}
+
+func enableScript(ctx *log.Context, h types.HandlerEnvironment, report *types.RunCommandInstanceView, metadata types.RCMetadata, c types.Cmd) (string, string, error, int) {
 	// parse the extension handler settings (not available prior to 'enable')
 	cfg, err1 := handlersettings.GetHandlerSettings(h.HandlerEnvironment.ConfigFolder, metadata.ExtName, metadata.SeqNum, ctx)
 	if err1 != nil {
@@ -144,59 +228,149 @@ func enable(ctx *log.Context, h types.HandlerEnvironment, report *types.RunComma
 	if err != nil {
 		return "", "", err, exitCode
 	}
+	if interval := cfg.StatusUpdateInterval(); interval > 0 {
+		metadata.StatusUpdateInterval = interval
+	}
+
+	// The configuration is recorded with the output before anything can fail, the agent deletes its settings file
+	dir := datapaths.SeqNumDir(metadata.DownloadPath, metadata.SeqNum)
+	recordConfig(ctx, dir, metadata, &cfg, time.Now())
+	if err := cleanup.SaveRetentionPolicy(metadata.DownloadPath, cfg.PublicSettings.RetentionPolicy); err != nil {
+		ctx.Log("warning", "the previous retention policy applies", "error", err)
+	}
+
+	// The script and artifacts are downloaded once the network is ready
+	if w := cfg.PublicSettings.WaitForNetwork; w != nil {
+		requirements := netready.Requirements{HostNames: w.HostNames, Endpoints: w.Endpoints}
+		if err := netready.Wait(ctx, requirements, w.NetworkWaitTimeout()); err != nil {
+			return "", "", err, constants.ExitCode_NetworkNotReady
+		}
+	}
+
+	// Fail fast when the downloads can't fit rather than midway through them
+	if err := files.CheckDiskSpace(ctx, dir, &cfg); err != nil {
+		if files.IsInsufficientDiskSpace(err) {
+			return "", "", errors.Wrap(err, "Not enough free disk space for the script and the artifacts, nothing was downloaded. Free up disk space or lower 'minFreeDiskSpaceMB'"),
+				constants.ExitCode_InsufficientDiskSpace
+		}
+		return "", "", errors.Wrap(err, "Artifact downloads failed"), constants.ExitCode_DownloadArtifactFailed
+	}
 
-	dir := filepath.Join(metadata.DownloadPath, fmt.Sprintf("%d", metadata.SeqNum))
-	scriptFilePath, err := downloadScript(ctx, dir, &cfg)
+	scriptFilePath, scriptHash, err := downloadScript(ctx, dir, &cfg)
+	if err != nil && cfg.LibraryScript() != "" {
+		return "", "", errors.Wrap(err, "Failed to prepare the script of the script library"), constants.ExitCode_LibraryScriptNotFound
+	}
+	if files.IsChecksumMismatch(err) {
+		return "", "", errors.Wrap(err, "The downloaded script does not match 'source.scriptChecksum' and was not executed"), constants.ExitCode_ChecksumMismatch
+	}
+	if err != nil && cfg.GitRepository() != nil {
+		return "", "", errors.Wrap(err, "Failed to download the git repository of the script. Make sure the repository, the ref and the entrypoint exist, and its credentials can read the repository."),
+			constants.ExitCode_GitRepositoryCloneFailed
+	}
+	if err != nil && cfg.OCIArtifact() != nil {
+		return "", "", errors.Wrap(err, "Failed to pull the container registry artifact of the script. Make sure the artifact and its entrypoint exist, and the managed identity has the 'AcrPull' role on the registry."),
+			constants.ExitCode_OCIArtifactPullFailed
+	}
+	if err != nil && cfg.ScriptLocalPath() != "" {
+		return "", "", errors.Wrap(err, "Failed to prepare the local script. Make sure 'source.localPath' points to a script present on the VM and readable by root."),
+			constants.ExitCode_LocalScriptCopyFailed
+	}
 	if err != nil {
 		return "",
 			"",
-			errors.Wrap(err, fmt.Sprintf("File downloads failed. Use either a public script URI that points to .sh file, Azure storage blob SAS URI or storage blob accessible by a managed identity and retry. If managed identity is used, make sure it has been given access to container of storage blob '%s' with 'Storage Blob Data Reader' role assignment. In case of user-assigned identity, make sure you add it under VM's identity. For more info, refer https://aka.ms/RunCommandManagedLinux", download.GetUriForLogging(cfg.ScriptURI()))),
+			errors.Wrap(err, fmt.Sprintf("Failed to download the script '%s'. %s", download.GetUriForLogging(cfg.ScriptURI()),
+				blobAccessGuidance(ctx, cfg.ScriptURI(), cfg.SourceManagedIdentity, roleBlobReader))),
 			constants.ExitCode_ScriptBlobDownloadFailed
 	}
 
 	err = downloadArtifacts(ctx, dir, &cfg)
+	if files.IsChecksumMismatch(err) {
+		return "", "", errors.Wrap(err, "A downloaded artifact does not match its 'checksum', the script was not executed"), constants.ExitCode_ChecksumMismatch
+	}
 	if err != nil {
 		return "", "",
-			errors.Wrap(err, "Artifact downloads failed. Use either a public artifact URI that points to .sh file, Azure storage blob SAS URI, or storage blob accessible by a managed identity and retry."),
+			errors.Wrap(err, "Artifact downloads failed"),
 			constants.ExitCode_DownloadArtifactFailed
 	}
 
-	blobCreateOrReplaceError := "Error creating AppendBlob '%s' using SAS token or Managed identity. Please use a valid blob SAS URI with [read, append, create, write] permissions OR managed identity. If managed identity is used, make sure Azure blob and identity exist, and identity has been given access to storage blob's container with 'Storage Blob Data Contributor' role assignment. In case of user-assigned identity, make sure you add it under VM's identity and provide outputBlobUri / errorBlobUri and corresponding clientId in outputBlobManagedIdentity / errorBlobManagedIdentity parameter(s). In case of system-assigned identity, do not use outputBlobManagedIdentity / errorBlobManagedIdentity parameter(s). For more info, refer https://aka.ms/RunCommandManagedLinux"
+	if len(cfg.PublicSettings.Requires) > 0 {
+		if err := dependencies.Ensure(ctx, cfg.PublicSettings.Requires, cfg.PublicSettings.InstallRequirements, exec.LookPathFunc(&cfg)); err != nil {
+			return "", "", err, constants.ExitCode_MissingRequirements
+		}
+	}
+
+	// A script that can reboot the VM executes in steps, the execution resumes at the step following a reboot
+	resumable := rebootsSupported(metadata, &cfg)
+	var progress multistep.Progress
+	if resumable {
+		if progress, err = startStep(ctx, dir, metadata, report); err != nil {
+			return "", "", errors.Wrap(err, "failed to prepare the step of the script"), constants.ExitCode_CommandExecutionFailed
+		}
+	}
+
+	// Record the pid before waiting for an execution slot, so a newer enable of the extension can kill this one while it is queued.
+	// We need to kill previous extension process if exists before starting a new one, unless the customer opted out.
+	if cfg.ShouldKillPreviousRunningProcess() {
+		pid.KillPreviousExtension(ctx, metadata.PidFilePath)
+	} else {
+		ctx.Log("message", "killPreviousRunningProcess is false - previous execution is left running if active")
+	}
+
+	// Store the active process id and start time in case its a long running process that needs to be killed later
+	// If process exited successfully the pid file is deleted
+	pid.SaveCurrentPidAndStartTime(metadata.PidFilePath)
+	defer pid.DeleteCurrentPidAndStartTimeIfOwned(metadata.PidFilePath)
+
+	// Wait before creating the blobs so the time spent in the queue does not count against the blob deadlines
+	slot := waitForExecutionSlot(ctx, h, metadata, c, report)
+	defer slot.Release()
+	if isCanceled(dir) {
+		ctx.Log("event", "the script was canceled before it started")
+		return "", "", errScriptCanceled, constants.ExitCode_ScriptCanceled
+	}
+
+	blobCreateOrReplaceError := "Error creating AppendBlob '%s' using SAS token or Managed identity. The SAS token needs the [read, append, create, write] permissions. %s"
+
+	// Blob operations must not outlive the command: they are bound by its timeout and cancelled when it returns
+	blobCtx, cancelBlobOperations := newBlobOperationContext(cfg.PublicSettings.TimeoutInSeconds)
+	defer cancelBlobOperations()
+	blobCtx = download.WithProxy(blobCtx, cfg.ProxyURL())
+	renewal := blobSASRenewal(blobCtx, &cfg)
 
-	var outputBlobSASRef *storage.Blob
-	var outputBlobAppendClient *appendblob.Client
-	var outputBlobAppendCreateOrReplaceError error
+	var stdoutBlob *outputBlob
 	outputFilePosition := int64(0)
 
 	// Create or Replace outputBlobURI if provided. Fail the command if create or replace fails.
 	if cfg.OutputBlobURI != "" {
-		outputBlobSASRef, outputBlobAppendClient, outputBlobAppendCreateOrReplaceError = createOrReplaceAppendBlob(cfg.OutputBlobURI,
-			cfg.ProtectedSettings.OutputBlobSASToken, cfg.ProtectedSettings.OutputBlobManagedIdentity, ctx)
+		outputAppendBlob, outputBlobAppendCreateOrReplaceError := createOrReplaceAppendBlob(blobCtx, cfg.OutputBlobURI,
+			cfg.ProtectedSettings.OutputBlobSASToken, renewal, cfg.ProtectedSettings.OutputBlobManagedIdentity, ctx)
 
 		if outputBlobAppendCreateOrReplaceError != nil {
 			return "",
 				"",
-				errors.Wrap(outputBlobAppendCreateOrReplaceError, fmt.Sprintf(blobCreateOrReplaceError, cfg.OutputBlobURI)),
+				errors.Wrap(outputBlobAppendCreateOrReplaceError, fmt.Sprintf(blobCreateOrReplaceError, download.GetUriForLogging(cfg.OutputBlobURI),
+					blobAccessGuidance(ctx, cfg.OutputBlobURI, cfg.ProtectedSettings.OutputBlobManagedIdentity, roleBlobContributor))),
 				constants.ExitCode_BlobCreateOrReplaceFailed
 		}
+		stdoutBlob = newOutputBlob(outputAppendBlob)
 	}
 
-	var errorBlobSASRef *storage.Blob
-	var errorBlobAppendClient *appendblob.Client
-	var errorBlobAppendCreateOrReplaceError error
+	var stderrBlob *outputBlob
 	errorFilePosition := int64(0)
 
 	// Create or Replace errorBlobURI if provided. Fail the command if create or replace fails.
 	if cfg.ErrorBlobURI != "" {
-		errorBlobSASRef, errorBlobAppendClient, errorBlobAppendCreateOrReplaceError = createOrReplaceAppendBlob(cfg.ErrorBlobURI,
-			cfg.ProtectedSettings.ErrorBlobSASToken, cfg.ProtectedSettings.ErrorBlobManagedIdentity, ctx)
+		errorAppendBlob, errorBlobAppendCreateOrReplaceError := createOrReplaceAppendBlob(blobCtx, cfg.ErrorBlobURI,
+			cfg.ProtectedSettings.ErrorBlobSASToken, renewal, cfg.ProtectedSettings.ErrorBlobManagedIdentity, ctx)
 
 		if errorBlobAppendCreateOrReplaceError != nil {
 			return "",
 				"",
-				errors.Wrap(errorBlobAppendCreateOrReplaceError, fmt.Sprintf(blobCreateOrReplaceError, cfg.ErrorBlobURI)),
+				errors.Wrap(errorBlobAppendCreateOrReplaceError, fmt.Sprintf(blobCreateOrReplaceError, download.GetUriForLogging(cfg.ErrorBlobURI),
+					blobAccessGuidance(ctx, cfg.ErrorBlobURI, cfg.ProtectedSettings.ErrorBlobManagedIdentity, roleBlobContributor))),
 				constants.ExitCode_BlobCreateOrReplaceFailed
 		}
+		stderrBlob = newOutputBlob(errorAppendBlob)
 	}
 
 	// AsyncExecution requested by customer means the extension should report successful extension deployment to complete the provisioning state
@@ -209,35 +383,48 @@ func enable(ctx *log.Context, h types.HandlerEnvironment, report *types.RunComma
 	}
 
 	stdoutF, stderrF := exec.LogPaths(dir)
-
-	// Implement ticker to update extension status periodically
-	ticker := time.NewTicker(updateStatusInSeconds * time.Second)
-	done := make(chan bool)
-	go func() {
-		for {
-			select {
-			case <-done:
-				return
-			case <-ticker.C:
-				ctx.Log("event", "report partial status")
-				stdoutTail, stderrTail := getOutput(ctx, stdoutF, stderrF)
-				report.Output = stdoutTail
-				report.Error = stderrTail
-				instanceview.ReportInstanceView(ctx, h, metadata, statusToReport, c, report)
-				outputFilePosition, err = appendToBlob(stdoutF, outputBlobSASRef, outputBlobAppendClient, outputFilePosition, ctx)
-				errorFilePosition, err = appendToBlob(stderrF, errorBlobSASRef, errorBlobAppendClient, errorFilePosition, ctx)
-			}
-		}
-	}()
+	logShipper := newOutputShipper(blobCtx, ctx, &cfg, metadata)
+	progressReader := scriptprogress.NewReader(exec.ProgressReportFilePath(&cfg, dir))
+	output := newOutputReader(stdoutF, stderrF, cfg.MaxStatusOutputLength())
+
+	// Update the extension status periodically
+	stopStatusUpdates := startStatusUpdates(statusClock, getStatusUpdateInterval(ctx, metadata), func() {
+		ctx.Log("event", "report partial status")
+		stdoutTail, stderrTail := output.read(ctx)
+		report.Output = stdoutTail
+		report.Error = stderrTail
+		report.ProcessTree = snapshotProcessTree(ctx, dir)
+		// Failing uploads are reported while the script runs, the final report gets them once it completes
+		partialReport := *report
+		percentComplete, progressSubStatuses := readScriptProgress(ctx, progressReader)
+		partialReport.PercentComplete = percentComplete
+		partialReport.SubStatuses = append(append(append(append([]types.InstanceViewSubStatus(nil), report.SubStatuses...),
+			progressSubStatuses...), stdoutBlob.subStatuses("outputBlobUri")...), stderrBlob.subStatuses("errorBlobUri")...)
+		partialReport.SubStatuses = append(partialReport.SubStatuses, logShipper.subStatuses()...)
+		instanceview.ReportInstanceView(ctx, h, metadata, statusToReport, c, &partialReport)
+		outputFilePosition, err = appendToBlob(blobCtx, stdoutF, stdoutBlob, outputFilePosition, false, ctx)
+		errorFilePosition, err = appendToBlob(blobCtx, stderrF, stderrBlob, errorFilePosition, false, ctx)
+		logShipper.ship(ctx, stdoutF, stderrF)
+	})
 
 	// execute the command, save its error
-	runErr, exitCode := runCmd(ctx, dir, scriptFilePath, &cfg, metadata)
+	runErr, exitCode := runCmd(ctx, dir, scriptFilePath, scriptHash, &cfg, report)
+
+	stopStatusUpdates()
 
-	ticker.Stop()
-	done <- true
+	// The process tree is only reported while the script runs, the last snapshot stays in the execution directory
+	report.ProcessTree = ""
 
 	// collect the logs if available
-	stdoutTail, stderrTail := getOutput(ctx, stdoutF, stderrF)
+	stdoutTail, stderrTail := output.read(ctx)
+	if cfg.ExecutesScript() {
+		reportMetrics(ctx, stdoutF, &cfg, report)
+	}
+	if isCanceled(dir) {
+		runErr, exitCode = errScriptCanceled, constants.ExitCode_ScriptCanceled
+	} else if resumable {
+		runErr, exitCode = completeStep(ctx, dir, metadata, &cfg, progress, stdoutTail, runErr, exitCode)
+	}
 
 	isSuccess := runErr == nil
 	telemetryResult("Output", "-- stdout/stderr omitted from telemetry pipeline --", isSuccess, 0)
@@ -249,55 +436,205 @@ func enable(ctx *log.Context, h types.HandlerEnvironment, report *types.RunComma
 	}
 
 	// Report the output streams to blobs
-	outputFilePosition, err = appendToBlob(stdoutF, outputBlobSASRef, outputBlobAppendClient, outputFilePosition, ctx)
-	errorFilePosition, err = appendToBlob(stderrF, errorBlobSASRef, errorBlobAppendClient, errorFilePosition, ctx)
+	outputFilePosition, err = appendToBlob(blobCtx, stdoutF, stdoutBlob, outputFilePosition, true, ctx)
+	errorFilePosition, err = appendToBlob(blobCtx, stderrF, stderrBlob, errorFilePosition, true, ctx)
+	logShipper.finish(ctx, stdoutF, stderrF)
+	if cfg.PublicSettings.DeleteOutputAfterUpload {
+		deleteUploadedOutput(ctx, stdoutF, stdoutBlob, outputFilePosition)
+		deleteUploadedOutput(ctx, stderrF, stderrBlob, errorFilePosition)
+	}
+	if cfg.PublicSettings.OutputRetentionInDays > 0 {
+		if err := cleanup.SetOutputRetention(dir, time.Duration(cfg.PublicSettings.OutputRetentionInDays)*24*time.Hour, time.Now()); err != nil {
+			ctx.Log("warning", "the output will be kept on the VM", "error", err)
+		}
+	}
+	// The last progress reported by the script stays in the final report
+	percentComplete, progressSubStatuses := readScriptProgress(ctx, progressReader)
+	report.PercentComplete = percentComplete
+	report.SubStatuses = append(report.SubStatuses, progressSubStatuses...)
+	report.SubStatuses = append(report.SubStatuses, stdoutBlob.subStatuses("outputBlobUri")...)
+	report.SubStatuses = append(report.SubStatuses, stderrBlob.subStatuses("errorBlobUri")...)
+	report.SubStatuses = append(report.SubStatuses, logShipper.subStatuses()...)
+
+	if isSuccess && cfg.ExecutesScript() {
+		recordReadiness(ctx, metadata, report, exitCode, time.Now())
+	}
 
 	c.Functions.Cleanup(ctx, metadata, h, cfg.PublicSettings.RunAsUser)
+	cleanup.ApplyRetentionPolicies(ctx, constants.DataDir, time.Now())
 	return stdoutTail, stderrTail, runErr, exitCode
 }
 
-// appendToBlob saves a file (from seeking position to the end of the file) to AppendBlob. Returns the new position (end of the file)
-func appendToBlob(sourceFilePath string, appendBlobRef *storage.Blob, appendBlobClient *appendblob.Client, outputFilePosition int64, ctx *log.Context) (int64, error) {
-	var err error
-	var newOutput []byte
-	if appendBlobRef != nil || appendBlobClient != nil {
-		// Save to blob
-		newOutput, err = files.GetFileFromPosition(sourceFilePath, outputFilePosition)
-		if err == nil {
-			newOutputSize := len(newOutput)
-			if newOutputSize > 0 {
-				if appendBlobRef != nil {
-					err = appendBlobRef.AppendBlock(newOutput, nil)
-				} else if appendBlobClient != nil {
-					ctx.Log("message", fmt.Sprintf("inside appendBlobClient. Output is '%s'", newOutput))
-					_, err = appendBlobClient.AppendBlock(context.Background(), streaming.NopCloser(bytes.NewReader(newOutput)), nil)
-				}
-
-				if err == nil {
-					outputFilePosition += int64(newOutputSize)
-				} else {
-					ctx.Log("message", "AppendToBlob failed", "error", err)
-				}
-			}
-		} else {
-			ctx.Log("message", "AppendToBlob - GetFileFromPosition failed.", "error", err)
+// recordReadiness publishes the successful run of the extension to the extensions and agents depending on it
+func recordReadiness(ctx *log.Context, metadata types.RCMetadata, report *types.RunCommandInstanceView, exitCode int, now time.Time) {
+	if err := readiness.Record(constants.ReadinessDir, readiness.Marker{
+		ExtensionName:  metadata.ExtName,
+		SeqNum:         metadata.SeqNum,
+		CompletedAt:    now.UTC().Format(time.RFC3339),
+		ExitCode:       exitCode,
+		ScriptHash:     report.ScriptHash,
+		HandlerVersion: versionutil.VersionString(),
+	}); err != nil {
+		ctx.Log("warning", "the successful run is not published to the dependent extensions", "error", err)
+		return
+	}
+	ctx.Log("event", "published the successful run", "path", datapaths.ReadinessMarkerFilePath(constants.ReadinessDir, metadata.ExtName))
+}
+
+// appendToBlob saves a file (from seeking position to the end of the file) to AppendBlob as valid UTF-8, decompressed if
+// it is compressed in segments. Returns the new position.
+// Unless final is set, an incomplete character at the end of the file is left to be uploaded with the next call.
+// The file is uploaded in chunks of outputChunkSize, since a script may write hundreds of MB between two calls.
+func appendToBlob(opCtx context.Context, sourceFilePath string, blob *outputBlob, outputFilePosition int64, final bool, ctx *log.Context) (int64, error) {
+	if blob == nil {
+		return outputFilePosition, nil
+	}
+	// The output is left in the file while the uploads are stopped or paused
+	if err := blob.checkAvailable(final); err != nil {
+		return outputFilePosition, err
+	}
+
+	f, err := outputfile.Open(sourceFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return outputFilePosition, nil
+		}
+		ctx.Log("message", "AppendToBlob - failed to open output file.", "error", err)
+		return outputFilePosition, errors.Wrap(err, "error opening file")
+	}
+	defer f.Close()
+
+	// Only the output written so far is uploaded, the output written meanwhile is left to the next call
+	size, err := f.Size()
+	if err != nil {
+		return outputFilePosition, errors.Wrap(err, "error retrieving file info")
+	}
+
+	buffer := make([]byte, outputChunkSize)
+	for outputFilePosition < size {
+		n := int64(len(buffer))
+		if size-outputFilePosition < n {
+			n = size - outputFilePosition
 		}
+		chunk := buffer[:n]
+		if _, err := f.ReadAt(chunk, outputFilePosition); err != nil {
+			ctx.Log("message", "AppendToBlob - failed to read output file.", "error", err)
+			return outputFilePosition, errors.Wrapf(err, "error reading from file: %s", sourceFilePath)
+		}
+
+		// A character cut by the end of the chunk is uploaded with the next one
+		if !final || outputFilePosition+n < size {
+			chunk = chunk[:encodingutil.CompleteRunesLength(chunk)]
+		}
+		if len(chunk) == 0 {
+			break
+		}
+
+		// The failures are logged by the blob, once rather than on every status update
+		if err = blob.write(opCtx, ctx, encodingutil.ToValidUTF8(chunk)); err != nil {
+			return outputFilePosition, err
+		}
+		outputFilePosition += int64(len(chunk))
+	}
+
+	return outputFilePosition, nil
+}
+
+// deleteUploadedOutput deletes an output file and its segments once it is fully uploaded to its blob, i.e., up to the given position
+func deleteUploadedOutput(ctx *log.Context, path string, blob *outputBlob, position int64) {
+	if blob == nil {
+		return
+	}
+	f, err := outputfile.Open(path)
+	if err != nil {
+		return
+	}
+	size, err := f.Size()
+	f.Close()
+	if err != nil {
+		return
+	}
+	if size != position {
+		ctx.Log("warning", "output not fully uploaded, keeping it on the VM", "path", path)
+		return
 	}
+	if err := outputfile.Remove(path); err != nil {
+		ctx.Log("warning", "failed to delete uploaded output", "path", path, "error", err)
+		return
+	}
+	ctx.Log("message", "deleted uploaded output", "path", path)
+}
 
-	return outputFilePosition, err
+// getOutput returns the output of the script reported in the status, at most max bytes of each stream. A longer
+// stream is cut in the middle, keeping its beginning and its end around a truncation marker.
+func getOutput(ctx *log.Context, stdoutFileName string, stderrFileName string, max int64) (string, string) {
+	return newOutputReader(stdoutFileName, stderrFileName, max).read(ctx)
 }
 
-func getOutput(ctx *log.Context, stdoutFileName string, stderrFileName string) (string, string) {
+// outputReader reads the output of the script like getOutput on every status update. The stderr lines matching
+// errorLinePattern are kept between the updates, so only the lines written since the previous one are scanned.
+type outputReader struct {
+	stdoutFileName string
+	stderrFileName string
+	max            int64
+	errorLines     *files.MatchingTail
+}
+
+func newOutputReader(stdoutFileName string, stderrFileName string, max int64) *outputReader {
+	return &outputReader{
+		stdoutFileName: stdoutFileName,
+		stderrFileName: stderrFileName,
+		max:            max,
+		errorLines:     files.NewMatchingTail(stderrFileName, max, errorLinePattern),
+	}
+}
+
+func (o *outputReader) read(ctx *log.Context) (string, string) {
 	// collect the logs if available
-	stdoutTail, err := files.TailFile(stdoutFileName, maxTailLen)
+	stdoutTail, err := files.HeadAndTailFile(o.stdoutFileName, o.max)
 	if err != nil {
 		ctx.Log("message", "error tailing stdout logs", "error", err)
 	}
-	stderrTail, err := files.TailFile(stderrFileName, maxTailLen)
+	var stderrTail []byte
+	if featureflags.Enabled(ctx, featureflags.StderrErrorLines) {
+		stderrTail, err = o.errorLines.Read()
+	} else {
+		stderrTail, err = files.HeadAndTailFile(o.stderrFileName, o.max)
+	}
 	if err != nil {
 		ctx.Log("message", "error tailing stderr logs", "error", err)
 	}
-	return string(stdoutTail), string(stderrTail)
+	return normalizeOutputTail(stdoutTail, o.max), normalizeOutputTail(stderrTail, o.max)
+}
+
+// normalizeOutputTail makes the tail of an output file valid UTF-8 so the status file stays valid JSON
+func normalizeOutputTail(tail []byte, max int64) string {
+	if int64(len(tail)) == max {
+		// The file was cut, possibly in the middle of a character
+		tail = encodingutil.TrimLeadingPartialRune(tail)
+	}
+	return string(encodingutil.ToValidUTF8(tail))
+}
+
+// snapshotProcessTree returns a summary of the process tree of the script executing in dir, which is also
+// saved in the execution directory. Returns an empty summary if the script is not running.
+func snapshotProcessTree(ctx *log.Context, dir string) string {
+	scriptPid, ok := exec.RunningScriptPid(dir)
+	if !ok {
+		return ""
+	}
+
+	processes, err := proctree.Snapshot(scriptPid)
+	if err != nil {
+		ctx.Log("message", "failed to snapshot the process tree of the script", "error", err)
+		return ""
+	}
+
+	summary := proctree.Summarize(processes)
+	if err := atomicfile.WriteFile(datapaths.ProcessTreeFilePath(dir), []byte(summary+"\n"), 0600); err != nil {
+		ctx.Log("message", "failed to save the process tree of the script", "error", err)
+	}
+	return summary
 }
 
 // checkAndSaveSeqNum checks if the given seqNum is already processed
@@ -316,6 +653,9 @@ func checkAndSaveSeqNum(ctx log.Logger, seq int, mrseqPath string) (shouldExit b
 		return true, nil
 	}
 
+	if err := os.MkdirAll(filepath.Dir(mrseqPath), 0755); err != nil {
+		return false, errors.Wrap(err, "failed to create sequence number directory")
+	}
 	if err := seqnum.SaveSeqNum(mrseqPath, seq); err != nil {
 		return false, errors.Wrap(err, "failed to save sequence number")
 	}
@@ -324,34 +664,92 @@ func checkAndSaveSeqNum(ctx log.Logger, seq int, mrseqPath string) (shouldExit b
 }
 
 // downloadScript downloads the script file specified in cfg into dir (creates if does
-// not exist) and takes storage credentials specified in cfg into account.
-func downloadScript(ctx *log.Context, dir string, cfg *handlersettings.HandlerSettings) (string, error) {
+// not exist) and takes storage credentials specified in cfg into account. It returns the path of the script, and its
+// SHA-256 as downloaded, before the post-processing changes it.
+func downloadScript(ctx *log.Context, dir string, cfg *handlersettings.HandlerSettings) (string, string, error) {
 	// - prepare the output directory for files and the command output
 	// - create the directory if missing
 	ctx.Log("event", "creating output directory", "path", dir)
 	if err := os.MkdirAll(dir, 0700); err != nil {
-		return "", errors.Wrap(err, "failed to prepare output directory")
+		return "", "", errors.Wrap(err, "failed to prepare output directory")
 	}
 	ctx.Log("event", "created output directory")
 
 	dos2unix := 1
+	if cfg.PublicSettings.SkipDos2Unix {
+		dos2unix = 0
+	}
 
 	// - download scriptURI
-	scriptFilePath := ""
+	scriptFilePath, scriptHash := "", ""
 	scriptURI := cfg.ScriptURI()
 	ctx.Log("scriptUri", scriptURI)
 	if scriptURI != "" {
 		telemetryResult("scenario", fmt.Sprintf("source.scriptUri;dos2unix=%d", dos2unix), true, 0*time.Millisecond)
 		ctx.Log("event", "download start")
-		file, err := files.DownloadAndProcessScript(ctx, scriptURI, dir, cfg)
+		file, hash, err := files.DownloadAndProcessScript(ctx, scriptURI, dir, cfg)
 		if err != nil {
 			ctx.Log("event", "download failed", "error", err)
-			return "", errors.Wrapf(err, "failed to download file %s. ", scriptURI)
+			return "", "", errors.Wrapf(err, "failed to download file %s. ", scriptURI)
 		}
-		scriptFilePath = file
+		scriptFilePath, scriptHash = file, hash
 		ctx.Log("event", "download complete", "output", dir)
 	}
-	return scriptFilePath, nil
+
+	// - or use the script pre-staged on the machine, without any download
+	if localPath := cfg.ScriptLocalPath(); localPath != "" {
+		ctx.Log("event", "copying local script", "localPath", localPath)
+		file, hash, err := files.CopyAndProcessLocalScript(localPath, dir, files.ScriptPostProcessOptions(cfg))
+		if err != nil {
+			ctx.Log("event", "copying local script failed", "error", err)
+			return "", "", err
+		}
+		scriptFilePath, scriptHash = file, hash
+		ctx.Log("event", "copied local script", "output", dir)
+	}
+
+	// - or use the script of the script library synced on the machine
+	if name := cfg.LibraryScript(); name != "" {
+		ctx.Log("event", "copying script library script", "libraryScript", name)
+		localPath, err := scriptlibrary.Resolve(name)
+		if err != nil {
+			return "", "", err
+		}
+		file, hash, err := files.CopyAndProcessLocalScript(localPath, dir, files.ScriptPostProcessOptions(cfg))
+		if err != nil {
+			ctx.Log("event", "copying script library script failed", "error", err)
+			return "", "", err
+		}
+		scriptFilePath, scriptHash = file, hash
+		ctx.Log("event", "copied script library script", "output", dir)
+	}
+
+	// - or download the git repository, whose entrypoint executes in place next to the other files of the repository
+	if repo := cfg.GitRepository(); repo != nil {
+		telemetryResult("scenario", fmt.Sprintf("source.gitRepository;dos2unix=%d", dos2unix), true, 0*time.Millisecond)
+		ctx.Log("event", "downloading git repository", "url", download.GetUriForLogging(repo.URL), "ref", repo.Ref)
+		file, hash, err := files.CloneAndProcessGitRepository(ctx, datapaths.GitRepositoryDir(dir), cfg)
+		if err != nil {
+			ctx.Log("event", "downloading git repository failed", "error", err)
+			return "", "", err
+		}
+		scriptFilePath, scriptHash = file, hash
+		ctx.Log("event", "downloaded git repository", "entrypoint", file)
+	}
+
+	// - or pull the container registry artifact, whose entrypoint executes in place next to the other files of the artifact
+	if artifact := cfg.OCIArtifact(); artifact != nil {
+		telemetryResult("scenario", fmt.Sprintf("source.ociArtifact;dos2unix=%d", dos2unix), true, 0*time.Millisecond)
+		ctx.Log("event", "pulling artifact", "reference", artifact.Reference)
+		file, hash, err := files.PullAndProcessOCIArtifact(ctx, datapaths.OCIArtifactDir(dir), cfg)
+		if err != nil {
+			ctx.Log("event", "pulling artifact failed", "error", err)
+			return "", "", err
+		}
+		scriptFilePath, scriptHash = file, hash
+		ctx.Log("event", "pulled artifact", "entrypoint", file)
+	}
+	return scriptFilePath, scriptHash, nil
 }
 
 func downloadArtifacts(ctx *log.Context, dir string, cfg *handlersettings.HandlerSettings) error {
@@ -366,11 +764,16 @@ func downloadArtifacts(ctx *log.Context, dir string, cfg *handlersettings.Handle
 
 	ctx.Log("event", "Downloading artifacts")
 	for i := 0; i < len(artifacts); i++ {
-		// Download the artifact
-		filePath, err := files.DownloadAndProcessArtifact(ctx, dir, &artifacts[i])
+		// Download the artifact with its own credentials
+		ctx.Log("event", "downloading artifact", "id", artifacts[i].ArtifactId)
+		filePath, err := files.DownloadAndProcessArtifact(ctx, dir, &artifacts[i], cfg.ProxyURL(), cfg.PublicSettings.MaxDownloadBandwidthKbps)
 		if err != nil {
 			ctx.Log("events", "Failed to download artifact", err, "artifact", artifacts[i].ArtifactUri)
-			return errors.Wrapf(err, "failed to download artifact %s", artifacts[i].ArtifactUri)
+			if files.IsChecksumMismatch(err) {
+				return errors.Wrapf(err, "failed to download artifact %s", artifacts[i].ArtifactUri)
+			}
+			return errors.Wrapf(err, "failed to download artifact %s. %s", artifacts[i].ArtifactUri,
+				blobAccessGuidance(ctx, artifacts[i].ArtifactUri, artifacts[i].ArtifactManagedIdentity, roleBlobReader))
 		}
 
 		ctx.Log("event", "Downloaded artifact complete", "file", filePath)
@@ -379,8 +782,10 @@ func downloadArtifacts(ctx *log.Context, dir string, cfg *handlersettings.Handle
 	return nil
 }
 
-// runCmd runs the command (extracted from cfg) in the given dir (assumed to exist).
-func runCmd(ctx *log.Context, dir string, scriptFilePath string, cfg *handlersettings.HandlerSettings, metadata types.RCMetadata) (err error, exitCode int) {
+// runCmd runs the command (extracted from cfg) in the given dir (assumed to exist). scriptHash is the hash of the
+// downloaded script before its post-processing, the embedded script is hashed once saved. The hash of the script is
+// reported whether or not the scripts are restricted by an allow-list.
+func runCmd(ctx *log.Context, dir string, scriptFilePath string, scriptHash string, cfg *handlersettings.HandlerSettings, report *types.RunCommandInstanceView) (err error, exitCode int) {
 	ctx.Log("event", "executing command", "output", dir)
 	var scenario string
 
@@ -388,30 +793,73 @@ func runCmd(ctx *log.Context, dir string, scriptFilePath string, cfg *handlerset
 	if cfg.Script() != "" {
 		scenario = "embedded-script"
 		// Save the script to a file
-		scriptFilePath = filepath.Join(dir, "script.sh")
+		scriptFilePath = datapaths.ScriptFilePath(dir)
 		err := files.SaveScriptFile(scriptFilePath, cfg.Script())
 		if err != nil {
 			ctx.Log("event", "failed to save script to file", "error", err, "file", scriptFilePath)
 			return errors.Wrap(err, "failed to save script to file"), constants.ExitCode_SaveScriptFailed
 		}
+		if scriptHash, err = scriptpolicy.Hash(scriptFilePath); err != nil {
+			ctx.Log("warning", "failed to hash the script", "error", err)
+		}
 	} else if cfg.ScriptURI() != "" {
 		// If scriptUri is specified then cmd should start it
 		scenario = "public-scriptUri"
+	} else if cfg.ScriptLocalPath() != "" {
+		scenario = "local-path"
+	} else if cfg.LibraryScript() != "" {
+		scenario = "library-script"
+	} else if cfg.GitRepository() != nil {
+		scenario = "git-repository"
+	} else if cfg.OCIArtifact() != nil {
+		scenario = "oci-artifact"
 	}
 
 	ctx.Log("event", "prepare command", "scriptFile", scriptFilePath)
 
-	// We need to kill previous extension process if exists before starting a new one.
-	pid.KillPreviousExtension(ctx, metadata.PidFilePath)
+	if scriptHash != "" {
+		report.ScriptHash = scriptHash
+		ctx.Log("event", "script hash", "sha256", scriptHash)
+		telemetryResult("scriptHash", "sha256="+scriptHash, true, 0)
+	}
+	if err := scriptpolicy.Check(constants.ScriptAllowListPath, scriptHash); err != nil {
+		ctx.Log("event", "script not allowed", "error", err)
+		return errors.Wrap(err, "the script is not allowed to execute on this VM"), constants.ExitCode_ScriptNotAllowed
+	}
 
-	// Store the active process id and start time in case its a long running process that needs to be killed later
-	// If process exited successfully the pid file is deleted
-	pid.SaveCurrentPidAndStartTime(metadata.PidFilePath)
-	defer pid.DeleteCurrentPidAndStartTime(metadata.PidFilePath)
+	// The template is rendered once allowed, like the parameters passed in the environment, the values don't
+	// change the hash of the script
+	if cfg.PublicSettings.DryRenderTemplate {
+		return dryRenderScriptTemplate(ctx, scriptFilePath, dir, cfg)
+	}
+	if cfg.PublicSettings.RenderTemplate {
+		rendered, err := scripttemplate.RenderFile(scriptFilePath, scripttemplate.NewParameters(cfg), cfg.PublicSettings.TemplateEncoding)
+		if err != nil {
+			ctx.Log("event", "failed to render the script template", "error", err)
+			return errors.Wrap(err, "failed to render the script template"), constants.ExitCode_RenderScriptTemplateFailed
+		}
+		ctx.Log("event", "rendered the script template", "parameters", strings.Join(rendered, ","))
+	}
+
+	if err := resolveKeyVaultReferences(ctx, cfg); err != nil {
+		ctx.Log("event", "failed to resolve the Key Vault references", "error", err)
+		return errors.Wrap(err, "Failed to read the secrets of 'keyVaultReferences', the script was not executed. The managed identity of the VM, or 'keyVaultManagedIdentity', needs the permission to get the secrets"), constants.ExitCode_KeyVaultResolutionFailed
+	}
+
+	if cfg.PublicSettings.WhatIf {
+		return whatIf(ctx, scriptFilePath, dir, cfg, report)
+	}
 
 	begin := time.Now()
 	err, exitCode = exec.ExecCmdInDir(ctx, scriptFilePath, dir, cfg)
 	elapsed := time.Since(begin)
+	if err != nil {
+		if state, ok := cfg.MappedExitCodeState(exitCode); ok {
+			ctx.Log("event", "exit code of the script is mapped", "exitCode", exitCode, "state", state)
+			report.SubStatuses = append(report.SubStatuses, mappedExitCodeSubStatus(exitCode, state))
+			err = nil
+		}
+	}
 	isSuccess := err == nil
 
 	telemetryResult("scenario", scenario, isSuccess, elapsed)
@@ -421,9 +869,57 @@ func runCmd(ctx *log.Context, dir string, scriptFilePath string, cfg *handlerset
 		return errors.Wrap(err, "failed to execute command"), exitCode
 	}
 	ctx.Log("event", "executed command", "output", dir)
+	// A mapped exit code is still reported, so the executions mapped to the same state can be told apart
+	return nil, exitCode
+}
+
+// dryRenderScriptTemplate renders the script without executing it and saves the rendered script, which never
+// contains the values of the protected parameters, as the output of the script. The issues found analyzing the script are saved
+// as its error output.
+func dryRenderScriptTemplate(ctx *log.Context, scriptFilePath string, dir string, cfg *handlersettings.HandlerSettings) (error, int) {
+	findings, err := files.AnalyzeScript(scriptFilePath, files.ScriptPostProcessOptions(cfg))
+	if err != nil {
+		return errors.Wrap(err, "failed to analyze the script"), constants.ExitCode_RenderScriptTemplateFailed
+	}
+	for _, finding := range findings {
+		ctx.Log("warning", "script analysis", "finding", finding)
+	}
+
+	template, err := os.ReadFile(scriptFilePath)
+	if err != nil {
+		return errors.Wrap(err, "failed to read the script template"), constants.ExitCode_RenderScriptTemplateFailed
+	}
+	rendered, parameters := scripttemplate.Render(string(template), scripttemplate.NewParameters(cfg), cfg.PublicSettings.TemplateEncoding)
+	ctx.Log("event", "dry rendered the script template", "parameters", strings.Join(parameters, ","))
+
+	stdoutF, stderrF := exec.LogPaths(dir)
+	if err := os.WriteFile(stdoutF, []byte(rendered), 0600); err != nil {
+		return errors.Wrap(err, "failed to save the rendered script"), constants.ExitCode_OpenStdOutFileFailed
+	}
+	var report []byte
+	for _, finding := range findings {
+		report = append(report, finding+"\n"...)
+	}
+	if err := os.WriteFile(stderrF, report, 0600); err != nil {
+		return errors.Wrap(err, "failed to save the rendered script"), constants.ExitCode_OpenStdErrFileFailed
+	}
 	return nil, constants.ExitCode_Okay
 }
 
+// mappedExitCodeSubStatus describes the state the exit code of the script is mapped to
+func mappedExitCodeSubStatus(exitCode int, state string) types.InstanceViewSubStatus {
+	subStatus := types.InstanceViewSubStatus{
+		Name:    "exitCode",
+		Code:    subStatusCodeScriptSucceededWithWarning,
+		Level:   types.SubStatusLevelWarning,
+		Message: fmt.Sprintf("The script exited with code %d, which is mapped to %s", exitCode, state),
+	}
+	if state == handlersettings.ExitCodeStateSkipped {
+		subStatus.Code, subStatus.Level = subStatusCodeScriptSkipped, types.SubStatusLevelInfo
+	}
+	return subStatus
+}
+
 // base64 decode and optionally GZip decompress a script
 func decodeScript(script string) (string, string, error) {
 	// scripts must be base64 encoded
@@ -450,11 +946,10 @@ func decodeScript(script string) (string, string, error) {
 	return buf.String(), fmt.Sprintf("%d;%d;gzip=1", len(script), n), nil
 }
 
-func createOrReplaceAppendBlobUsingManagedIdentity(blobUri string, managedIdentity *handlersettings.RunCommandManagedIdentity) (*appendblob.Client, error) {
+// newManagedIdentityCredential returns the credential of the user-assigned identity with the given clientId, or of
+// the system-assigned identity if no clientId is provided
+func newManagedIdentityCredential(managedIdentity *handlersettings.RunCommandManagedIdentity) (*azidentity.ManagedIdentityCredential, error) {
 	var ID string = ""
-	var miCred *azidentity.ManagedIdentityCredential = nil
-	var miCredError error = nil
-
 	if managedIdentity != nil {
 		if managedIdentity.ClientId != "" {
 			ID = managedIdentity.ClientId
@@ -463,66 +958,128 @@ func createOrReplaceAppendBlobUsingManagedIdentity(blobUri string, managedIdenti
 		}
 	}
 
-	if ID != "" { // Use user-assigned identity if clientId is provided
-		miCredentialOptions := azidentity.ManagedIdentityCredentialOptions{ID: azidentity.ClientID(ID)}
-		miCred, miCredError = azidentity.NewManagedIdentityCredential(&miCredentialOptions)
-	} else { // Use system-assigned identity if clientId not provided
-		miCred, miCredError = azidentity.NewManagedIdentityCredential(nil)
-	}
-
-	var appendBlobClient *appendblob.Client
-	var appendBlobNewClientError error
-	if miCredError == nil {
-		appendBlobClient, appendBlobNewClientError = appendblob.NewClient(blobUri, miCred, nil)
-		if appendBlobNewClientError != nil {
-			return nil, errors.Wrap(appendBlobNewClientError, fmt.Sprintf("Error Creating client to Append Blob '%s'. Make sure you are using Append blob. Other types of blob such as PageBlob, BlockBlob are not supported types.", download.GetUriForLogging(blobUri)))
-		} else {
-			// Create or Replace Append blob. If AppendBlob already exists, blob gets cleared.
-			_, createAppendBlobError := appendBlobClient.Create(context.Background(), nil)
-			if createAppendBlobError != nil {
-				return nil, errors.Wrap(createAppendBlobError, fmt.Sprintf("Error creating or replacing the Append blob '%s'. Make sure you are using Append blob. Other types of blob such as PageBlob, BlockBlob are not supported types.", download.GetUriForLogging(blobUri)))
-			}
-		}
-	} else {
+	// The tokens are requested from IMDS, which the transport never reaches through a proxy
+	miCredentialOptions := azidentity.ManagedIdentityCredentialOptions{ClientOptions: azcore.ClientOptions{Transport: download.NewAzureTransport()}}
+	if ID != "" { // Use user-assigned identity if clientId is provided, else system-assigned identity
+		miCredentialOptions.ID = azidentity.ClientID(ID)
+	}
+	miCred, miCredError := azidentity.NewManagedIdentityCredential(&miCredentialOptions)
+	if miCredError != nil {
 		return nil, errors.Wrap(miCredError, "Error while retrieving managed identity credential")
 	}
+	return miCred, nil
+}
+
+func createOrReplaceAppendBlobUsingManagedIdentity(opCtx context.Context, blobUri string, managedIdentity *handlersettings.RunCommandManagedIdentity) (*appendblob.Client, error) {
+	miCred, err := newManagedIdentityCredential(managedIdentity)
+	if err != nil {
+		return nil, err
+	}
+
+	appendBlobClient, appendBlobNewClientError := appendblob.NewClient(blobUri, miCred, &appendblob.ClientOptions{
+		ClientOptions: azcore.ClientOptions{PerCallPolicies: []policy.Policy{requestheaders.NewPolicy()}, Transport: download.NewAzureTransport()},
+	})
+	if appendBlobNewClientError != nil {
+		return nil, errors.Wrap(appendBlobNewClientError, fmt.Sprintf("Error Creating client to Append Blob '%s'. Make sure you are using Append blob. Other types of blob such as PageBlob, BlockBlob are not supported types.", download.GetUriForLogging(blobUri)))
+	}
 
+	// Create or Replace Append blob. If AppendBlob already exists, blob gets cleared.
+	createAppendBlobError := callWithTimeout(opCtx, func(callCtx context.Context) error {
+		_, err := appendBlobClient.Create(callCtx, nil)
+		return err
+	})
+	if createAppendBlobError != nil {
+		return nil, errors.Wrap(createAppendBlobError, fmt.Sprintf("Error creating or replacing the Append blob '%s'. Make sure you are using Append blob. Other types of blob such as PageBlob, BlockBlob are not supported types.", download.GetUriForLogging(blobUri)))
+	}
 	return appendBlobClient, nil
 }
 
-func createOrReplaceAppendBlob(blobUri string, sasToken string, managedIdentity *handlersettings.RunCommandManagedIdentity, ctx *log.Context) (*storage.Blob, *appendblob.Client, error) {
-	var blobSASRef *storage.Blob
-	var blobSASTokenError error
-	var blobAppendClient *appendblob.Client
-	var blobAppendClientError error
+func createOrReplaceBlockBlobUsingManagedIdentity(opCtx context.Context, blobUri string, managedIdentity *handlersettings.RunCommandManagedIdentity) (*blockblob.Client, error) {
+	miCred, err := newManagedIdentityCredential(managedIdentity)
+	if err != nil {
+		return nil, err
+	}
 
-	// Validate blob can be created or replaced.
-	if blobUri != "" {
-		if sasToken != "" {
-			blobSASRef, blobSASTokenError = download.CreateOrReplaceAppendBlob(blobUri, sasToken)
+	blockBlobClient, err := blockblob.NewClient(blobUri, miCred, &blockblob.ClientOptions{
+		ClientOptions: azcore.ClientOptions{PerCallPolicies: []policy.Policy{requestheaders.NewPolicy()}, Transport: download.NewAzureTransport()},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Error Creating client to Block Blob '%s'.", download.GetUriForLogging(blobUri)))
+	}
 
-			if blobSASTokenError != nil {
-				ctx.Log("message", fmt.Sprintf("Error creating blob '%s' using SAS token. Retrying with system-assigned managed identity if available..", download.GetUriForLogging(blobUri)), "error", blobSASTokenError)
-			}
-		}
+	// Create or Replace Block blob with an empty one
+	if err := callWithTimeout(opCtx, func(callCtx context.Context) error {
+		_, err := blockBlobClient.Upload(callCtx, streaming.NopCloser(bytes.NewReader(nil)), nil)
+		return err
+	}); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Error creating or replacing the Block blob '%s'.", download.GetUriForLogging(blobUri)))
+	}
+	return blockBlobClient, nil
+}
 
-		// Try to create or replace output blob using managed identity.
-		if sasToken == "" || blobSASTokenError != nil {
+// createOrReplaceAppendBlob creates (or replaces) the blob the output is appended to, with the SAS token or else
+// the managed identity. The storage accounts without append blobs (e.g., with a hierarchical namespace) get a
+// block blob instead, the output being appended to it as blocks.
+//
+// The legacy storage client of the SAS token can't be cancelled, so an attempt with the SAS token timing out is
+// awaited before falling back to the managed identity: completing later, it would replace the blob the output is
+// appended to with the managed identity.
+func createOrReplaceAppendBlob(opCtx context.Context, blobUri string, sasToken string, renewal download.SASProvider, managedIdentity *handlersettings.RunCommandManagedIdentity, ctx *log.Context) (appendBlob, error) {
+	if blobUri == "" {
+		return nil, nil
+	}
 
-			blobAppendClient, blobAppendClientError = createOrReplaceAppendBlobUsingManagedIdentity(blobUri, managedIdentity)
+	var blobSASTokenError error
+	// Validate blob can be created or replaced.
+	if sasToken != "" || renewal != nil {
+		var blob appendBlob
+		var sasErr error
+		sasDone := make(chan struct{})
+		blobSASTokenError = callWithTimeout(opCtx, func(context.Context) error {
+			defer close(sasDone)
+			blobSASRef, err := download.CreateOrReplaceAppendBlob(blobUri, sasToken, download.ProxyFromContext(opCtx), renewal)
+			if err == nil {
+				blob = &sasAppendBlob{ref: blobSASRef}
+			} else if appendBlobsUnsupported(err) {
+				ctx.Log("message", fmt.Sprintf("The storage account of blob '%s' does not support append blobs, using a block blob", download.GetUriForLogging(blobUri)), "error", err)
+				blobSASRef, err = download.CreateOrReplaceBlockBlob(blobUri, sasToken, download.ProxyFromContext(opCtx), renewal)
+				blob = &sasBlockBlob{ref: blobSASRef}
+			}
+			sasErr = err
+			return err
+		})
+		if blobSASTokenError == nil {
+			return blob, nil
 		}
+		select {
+		case <-sasDone:
+		case <-opCtx.Done():
+			return nil, errors.Wrap(blobSASTokenError, "Creating or Replacing append blob failed.")
+		}
+		// The attempt completed after its timeout
+		if sasErr == nil {
+			return blob, nil
+		}
+		ctx.Log("message", fmt.Sprintf("Error creating blob '%s' using SAS token. Retrying with system-assigned managed identity if available..", download.GetUriForLogging(blobUri)), "error", blobSASTokenError)
+	}
 
-		if (sasToken == "" && blobAppendClientError != nil) ||
-			(blobSASTokenError != nil && blobAppendClientError != nil) {
-
-			var er error
-			if blobSASTokenError != nil {
-				er = blobSASTokenError
-			} else {
-				er = blobAppendClientError
-			}
-			return nil, nil, errors.Wrap(er, "Creating or Replacing append blob failed.")
+	// Try to create or replace output blob using managed identity.
+	blobAppendClient, blobAppendClientError := createOrReplaceAppendBlobUsingManagedIdentity(opCtx, blobUri, managedIdentity)
+	if blobAppendClientError == nil {
+		return &clientAppendBlob{client: blobAppendClient, managedIdentity: managedIdentity}, nil
+	}
+	if appendBlobsUnsupported(blobAppendClientError) {
+		ctx.Log("message", fmt.Sprintf("The storage account of blob '%s' does not support append blobs, using a block blob", download.GetUriForLogging(blobUri)), "error", blobAppendClientError)
+		blockBlobClient, err := createOrReplaceBlockBlobUsingManagedIdentity(opCtx, blobUri, managedIdentity)
+		if err == nil {
+			return &clientBlockBlob{client: blockBlobClient, managedIdentity: managedIdentity}, nil
 		}
+		blobAppendClientError = err
+	}
+
+	er := blobAppendClientError
+	if blobSASTokenError != nil {
+		er = blobSASTokenError
 	}
-	return blobSASRef, blobAppendClient, nil
+	return nil, errors.Wrap(er, "Creating or Replacing append blob failed.")
 }
@@ -10,6 +10,7 @@ import (
 	"testing"
 
 	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/exec"
 	"github.com/Azure/run-command-handler-linux/internal/files"
 	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
 	"github.com/Azure/run-command-handler-linux/internal/types"
@@ -20,7 +21,7 @@ import (
 
 func Test_commandsExist(t *testing.T) {
 	// we expect these subcommands to be handled
-	expect := []string{"install", "enable", "disable", "uninstall", "update"}
+	expect := []string{"install", "enable", "disable", "uninstall", "update", "cancel"}
 	for _, c := range expect {
 		_, ok := Cmds[c]
 		if !ok {
@@ -40,6 +41,7 @@ func Test_commands_shouldReportStatus(t *testing.T) {
 	require.True(t, Cmds["enable"].ShouldReportStatus, "enable should report status")
 	require.True(t, Cmds["disable"].ShouldReportStatus, "disable should report status")
 	require.True(t, Cmds["update"].ShouldReportStatus, "update should report status")
+	require.True(t, Cmds["cancel"].ShouldReportStatus, "cancel should report status")
 }
 
 func Test_checkAndSaveSeqNum_fails(t *testing.T) {
@@ -89,12 +91,14 @@ func Test_runCmd_success(t *testing.T) {
 	require.Nil(t, err)
 	defer os.RemoveAll(dir)
 
-	metadata := types.NewRCMetadata("extName", 0, constants.DownloadFolder, constants.DataDir)
-	err, exitCode := runCmd(log.NewContext(log.NewNopLogger()), dir, "", &handlersettings.HandlerSettings{
+	report := &types.RunCommandInstanceView{}
+	err, exitCode := runCmd(log.NewContext(log.NewNopLogger()), dir, "", "", &handlersettings.HandlerSettings{
 		PublicSettings: handlersettings.PublicSettings{Source: &handlersettings.ScriptSource{Script: script}},
-	}, metadata)
+	}, report)
 	require.Nil(t, err, "command should run successfully")
 	require.Equal(t, constants.ExitCode_Okay, exitCode)
+	// sha256sum of the embedded script
+	require.Equal(t, "0e87632cd46bd4907c516317eb6d81fe0f921a23c7643018f21292894b470681", report.ScriptHash)
 
 	// check stdout stderr files
 	_, err = os.Stat(filepath.Join(dir, "stdout"))
@@ -115,15 +119,77 @@ func Test_runCmd_fail(t *testing.T) {
 	require.Nil(t, err)
 	defer os.RemoveAll(dir)
 
-	metadata := types.NewRCMetadata("extName", 0, constants.DownloadFolder, constants.DataDir)
-	err, exitCode := runCmd(log.NewContext(log.NewNopLogger()), dir, "", &handlersettings.HandlerSettings{
+	err, exitCode := runCmd(log.NewContext(log.NewNopLogger()), dir, "", "", &handlersettings.HandlerSettings{
 		PublicSettings: handlersettings.PublicSettings{Source: &handlersettings.ScriptSource{Script: "non-existing-cmd"}},
-	}, metadata)
+	}, &types.RunCommandInstanceView{})
 	require.NotNil(t, err, "command terminated with exit status")
 	require.Contains(t, err.Error(), "failed to execute command")
 	require.NotEqual(t, constants.ExitCode_Okay, exitCode)
 }
 
+func Test_runCmd_mappedExitCode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := &handlersettings.HandlerSettings{
+		PublicSettings: handlersettings.PublicSettings{
+			Source:           &handlersettings.ScriptSource{Script: "exit 2"},
+			ExitCodeMappings: []handlersettings.ExitCodeMapping{{ExitCodes: []int{2}, State: handlersettings.ExitCodeStateSkipped}},
+		},
+	}
+	report := &types.RunCommandInstanceView{}
+	err, exitCode := runCmd(log.NewContext(log.NewNopLogger()), dir, "", "", cfg, report)
+	require.Nil(t, err)
+	require.Equal(t, 2, exitCode)
+	require.Len(t, report.SubStatuses, 1)
+	require.Equal(t, subStatusCodeScriptSkipped, report.SubStatuses[0].Code)
+
+	// Exit codes that are not mapped still fail the execution
+	cfg.PublicSettings.Source.Script = "exit 3"
+	err, exitCode = runCmd(log.NewContext(log.NewNopLogger()), dir, "", "", cfg, &types.RunCommandInstanceView{})
+	require.NotNil(t, err)
+	require.Equal(t, 3, exitCode)
+}
+
+func Test_runCmd_renderTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := &handlersettings.HandlerSettings{
+		PublicSettings: handlersettings.PublicSettings{
+			Source:         &handlersettings.ScriptSource{Script: "echo ${greeting} '$${greeting}' ${name} \"${name}\""},
+			Parameters:     []handlersettings.ParameterDefinition{{Name: "greeting", Value: "hello"}},
+			RenderTemplate: true,
+		},
+		ProtectedSettings: handlersettings.ProtectedSettings{
+			ProtectedParameters: []handlersettings.ParameterDefinition{{Name: "name", Value: "secret"}},
+		},
+	}
+	err, exitCode := runCmd(log.NewContext(log.NewNopLogger()), dir, "", "", cfg, &types.RunCommandInstanceView{})
+	require.Nil(t, err)
+	require.Equal(t, constants.ExitCode_Okay, exitCode)
+	stdoutF, _ := exec.LogPaths(dir)
+	b, err := ioutil.ReadFile(stdoutF)
+	require.Nil(t, err)
+	require.Equal(t, "hello ${greeting} secret secret\n", string(b))
+
+	// A dry render reports the rendered script, which reads the protected values from its environment, without
+	// executing it
+	cfg.PublicSettings.DryRenderTemplate = true
+	err, exitCode = runCmd(log.NewContext(log.NewNopLogger()), dir, "", "", cfg, &types.RunCommandInstanceView{})
+	require.Nil(t, err)
+	require.Equal(t, constants.ExitCode_Okay, exitCode)
+	b, err = ioutil.ReadFile(stdoutF)
+	require.Nil(t, err)
+	require.Equal(t, `echo 'hello' '${greeting}' "${name}" "${name}"`, string(b))
+	_, stderrF := exec.LogPaths(dir)
+	b, err = ioutil.ReadFile(stderrF)
+	require.Nil(t, err)
+	require.Equal(t, "shebang: none, the script runs with /bin/bash\n", string(b))
+}
+
 func Test_downloadScriptUri(t *testing.T) {
 	dir, err := ioutil.TempDir("", "")
 	require.Nil(t, err)
@@ -132,7 +198,7 @@ func Test_downloadScriptUri(t *testing.T) {
 	srv := httptest.NewServer(httpbin.GetMux())
 	defer srv.Close()
 
-	downloadedFilePath, err := downloadScript(log.NewContext(log.NewNopLogger()),
+	downloadedFilePath, _, err := downloadScript(log.NewContext(log.NewNopLogger()),
 		dir,
 		&handlersettings.HandlerSettings{
 			PublicSettings: handlersettings.PublicSettings{
@@ -319,7 +385,7 @@ func Test_downloadScriptUri_BySASFailsSucceedsByManagedIdentity(t *testing.T) {
 	srv := httptest.NewServer(http.HandlerFunc(handler))
 	defer srv.Close()
 
-	_, err = downloadScript(log.NewContext(log.NewNopLogger()),
+	_, _, err = downloadScript(log.NewContext(log.NewNopLogger()),
 		dir,
 		&handlersettings.HandlerSettings{
 			PublicSettings: handlersettings.PublicSettings{
@@ -346,10 +412,9 @@ func Test_TreatFailureAsDeploymentFailureIsTrue_Fails(t *testing.T) {
 	require.Nil(t, err)
 	defer os.RemoveAll(dir)
 
-	metadata := types.NewRCMetadata("extName", 0, constants.DownloadFolder, constants.DataDir)
-	err, exitCode := runCmd(log.NewContext(log.NewNopLogger()), dir, "", &handlersettings.HandlerSettings{
+	err, exitCode := runCmd(log.NewContext(log.NewNopLogger()), dir, "", "", &handlersettings.HandlerSettings{
 		PublicSettings: handlersettings.PublicSettings{Source: &handlersettings.ScriptSource{Script: script}, TreatFailureAsDeploymentFailure: true},
-	}, metadata)
+	}, &types.RunCommandInstanceView{})
 	require.NotNil(t, err)
 	require.Contains(t, err.Error(), "failed to execute command: command terminated with exit status=127")
 	require.NotEqual(t, constants.ExitCode_Okay, exitCode)
@@ -365,10 +430,23 @@ func Test_TreatFailureAsDeploymentFailureIsTrue_SimpleScriptSucceeds(t *testing.
 	require.Nil(t, err)
 	defer os.RemoveAll(dir)
 
-	metadata := types.NewRCMetadata("extName", 0, constants.DownloadFolder, constants.DataDir)
-	err, exitCode := runCmd(log.NewContext(log.NewNopLogger()), dir, "", &handlersettings.HandlerSettings{
+	err, exitCode := runCmd(log.NewContext(log.NewNopLogger()), dir, "", "", &handlersettings.HandlerSettings{
 		PublicSettings: handlersettings.PublicSettings{Source: &handlersettings.ScriptSource{Script: script}, TreatFailureAsDeploymentFailure: false},
-	}, metadata)
+	}, &types.RunCommandInstanceView{})
 	require.Nil(t, err)
 	require.Equal(t, constants.ExitCode_Okay, exitCode)
 }
+
+func Test_getOutput_truncatesTheMiddle(t *testing.T) {
+	dir := t.TempDir()
+	stdoutF, stderrF := exec.LogPaths(dir)
+	line := strings.Repeat("a", 500) + strings.Repeat("b", 5000) + strings.Repeat("c", 500)
+	require.Nil(t, os.WriteFile(stdoutF, []byte(line), 0600))
+	require.Nil(t, os.WriteFile(stderrF, []byte("error\n"), 0600))
+
+	stdout, stderr := getOutput(log.NewContext(log.NewNopLogger()), stdoutF, stderrF, 1024)
+	require.Len(t, stdout, 1024)
+	require.True(t, strings.HasPrefix(stdout, strings.Repeat("a", 256)+"\n[output truncated]\n"), stdout)
+	require.True(t, strings.HasSuffix(stdout, strings.Repeat("c", 500)), stdout)
+	require.Equal(t, "error\n", stderr)
+}
@@ -0,0 +1,66 @@
+package commands
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/Azure/run-command-handler-linux/pkg/versionutil"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// configRecord is the configuration a sequence number was requested with, kept with its output so it can be
+// troubleshot after the agent deletes its settings file
+type configRecord struct {
+	ExtensionName  string                          `json:"extensionName"`
+	SeqNum         int                             `json:"seqNum"`
+	HandlerVersion string                          `json:"handlerVersion"`
+	RecordedAt     string                          `json:"recordedAt"`
+	Config         handlersettings.EffectiveConfig `json:"config"`
+}
+
+// recordConfig writes the record of the configuration into the execution directory. The record is written once
+// and read-only: an execution resumed or processed again keeps the record of the first one.
+func recordConfig(ctx *log.Context, dir string, metadata types.RCMetadata, cfg *handlersettings.HandlerSettings, now time.Time) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		ctx.Log("warning", "the configuration of the sequence number is not recorded", "error", err)
+		return
+	}
+	path := datapaths.ConfigRecordFilePath(dir)
+	if err := writeConfigRecord(path, configRecord{
+		ExtensionName:  metadata.ExtName,
+		SeqNum:         metadata.SeqNum,
+		HandlerVersion: versionutil.VersionString(),
+		RecordedAt:     now.UTC().Format(time.RFC3339),
+		Config:         cfg.EffectiveConfig(),
+	}); err != nil {
+		if os.IsExist(errors.Cause(err)) {
+			ctx.Log("message", "the configuration of the sequence number is already recorded", "path", path)
+			return
+		}
+		ctx.Log("warning", "the configuration of the sequence number is not recorded", "error", err)
+		return
+	}
+	ctx.Log("event", "recorded the configuration of the sequence number", "path", path)
+}
+
+func writeConfigRecord(path string, record configRecord) error {
+	b, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal the configuration record")
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0400)
+	if err != nil {
+		return errors.Wrap(err, "failed to create the configuration record")
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(path)
+		return errors.Wrap(err, "failed to write the configuration record")
+	}
+	return errors.Wrap(f.Close(), "failed to close the configuration record")
+}
@@ -0,0 +1,50 @@
+package commands
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_recordConfig(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	dir := filepath.Join(t.TempDir(), "3")
+	metadata := types.NewRCMetadata("RC0001", 3, constants.DownloadFolder, constants.DataDir)
+	cfg := handlersettings.HandlerSettings{
+		PublicSettings:    handlersettings.PublicSettings{Source: &handlersettings.ScriptSource{Script: "date"}},
+		ProtectedSettings: handlersettings.ProtectedSettings{RunAsPassword: "password"},
+	}
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	recordConfig(ctx, dir, metadata, &cfg, now)
+	path := datapaths.ConfigRecordFilePath(dir)
+	fi, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0400), fi.Mode().Perm())
+
+	var record configRecord
+	b, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Nil(t, json.Unmarshal(b, &record))
+	require.Equal(t, "RC0001", record.ExtensionName)
+	require.Equal(t, 3, record.SeqNum)
+	require.Equal(t, "2026-01-02T03:04:05Z", record.RecordedAt)
+	require.Equal(t, "date", record.Config.PublicSettings.Source.Script)
+	require.NotContains(t, string(b), "\"password\"")
+
+	// The record of the first execution of the sequence number is kept
+	cfg.PublicSettings.Source.Script = "uptime"
+	recordConfig(ctx, dir, metadata, &cfg, now.Add(time.Hour))
+	b2, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, b, b2)
+}
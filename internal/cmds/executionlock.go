@@ -0,0 +1,85 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/pkg/errors"
+)
+
+// errExecutionInProgress is returned when another invocation of the handler, e.g., a retry of the agent, is already
+// executing the same sequence number of the extension
+var errExecutionInProgress = errors.New("the script configuration is being executed by another invocation of the handler, will not run again")
+
+// executionLocks are the execution locks held by the process, by path, from enablePre until enable returns. The
+// service executes several extensions at the same time in the same process.
+var executionLocks sync.Map
+
+// lockExecution locks the execution of the sequence number of the extension, so two invocations of the handler
+// never run the same script or append its output to the blobs twice. It fails with errExecutionInProgress if
+// another invocation holds the lock, which is released by releaseExecution or when the process exits.
+func lockExecution(metadata types.RCMetadata) error {
+	path := datapaths.ExecutionLockFilePath(datapaths.SeqNumDir(metadata.DownloadPath, metadata.SeqNum))
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrap(err, "failed to create the execution directory")
+	}
+	f, err := lockFile(path, false)
+	if err != nil {
+		return errors.Wrap(err, "failed to lock the execution")
+	}
+	if f == nil {
+		return errExecutionInProgress
+	}
+	executionLocks.Store(path, f)
+	return nil
+}
+
+// releaseExecution releases the execution lock taken by lockExecution, if any
+func releaseExecution(metadata types.RCMetadata) {
+	path := datapaths.ExecutionLockFilePath(datapaths.SeqNumDir(metadata.DownloadPath, metadata.SeqNum))
+	if f, ok := executionLocks.LoadAndDelete(path); ok {
+		f.(*os.File).Close()
+	}
+}
+
+// lockExtensionState blocks until no other invocation of the handler updates the state files of the extension, e.g.,
+// its most recent sequence number. The returned function releases the lock.
+func lockExtensionState(metadata types.RCMetadata) (func(), error) {
+	if dir := filepath.Dir(metadata.LockFilePath); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, errors.Wrap(err, "failed to create the state directory")
+		}
+	}
+	f, err := lockFile(metadata.LockFilePath, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to lock the state of the extension")
+	}
+	return func() { f.Close() }, nil
+}
+
+// lockFile locks the file at path with flock, creating it if missing. It waits for the lock if wait is set, and
+// otherwise returns a nil file if the lock is held elsewhere. Closing the file releases the lock. Locks are held by
+// open files, so two locks of the same file conflict within a process too.
+func lockFile(path string, wait bool) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK && !wait {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,54 @@
+package commands
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_enablePreLocksTheExecution(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	dataDir := t.TempDir()
+	metadata := types.NewRCMetadata("RC0001", 2, constants.ImmediateDownloadFolder, dataDir)
+	c := types.CmdEnableTemplate
+
+	require.Nil(t, enablePre(ctx, types.HandlerEnvironment{}, metadata, c))
+
+	// A retry of the same sequence number while it executes neither runs the script nor cleans it up
+	require.Equal(t, errExecutionInProgress, enablePre(ctx, types.HandlerEnvironment{}, metadata, c))
+
+	// Another sequence number of the extension is not locked
+	next := types.NewRCMetadata("RC0001", 3, constants.ImmediateDownloadFolder, dataDir)
+	require.Nil(t, lockExecution(next))
+	releaseExecution(next)
+
+	releaseExecution(metadata)
+	require.Nil(t, lockExecution(metadata))
+	releaseExecution(metadata)
+}
+
+func Test_lockExtensionState(t *testing.T) {
+	metadata := types.NewRCMetadata("RC0001", 2, constants.ImmediateDownloadFolder, t.TempDir())
+	unlock, err := lockExtensionState(metadata)
+	require.Nil(t, err)
+
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := lockExtensionState(metadata)
+		require.Nil(t, err)
+		unlock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		require.Fail(t, "the state of the extension was locked twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+}
@@ -0,0 +1,67 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/executionqueue"
+	"github.com/Azure/run-command-handler-linux/internal/instanceview"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+)
+
+// minDefaultConcurrentExecutions keeps small VMs able to run more than one script at a time by default
+const minDefaultConcurrentExecutions = 2
+
+var newExecutionQueue = func(ctx *log.Context) *executionqueue.Queue {
+	return executionqueue.New(constants.ExecutionQueueDir, getMaxConcurrentExecutions(ctx))
+}
+
+// waitForExecutionSlot blocks until the script can execute within the machine concurrency limit, reporting
+// its position in the queue while it waits. If the queue is not available, the script executes without a slot.
+func waitForExecutionSlot(ctx *log.Context, h types.HandlerEnvironment, metadata types.RCMetadata, c types.Cmd, report *types.RunCommandInstanceView) *executionqueue.Slot {
+	queued := false
+	slot, err := newExecutionQueue(ctx).Wait(context.Background(), func(position int) {
+		queued = true
+		ctx.Log("event", "waiting for an execution slot", "position", position)
+		report.ExecutionState = types.Pending
+		report.ExecutionMessage = fmt.Sprintf("Waiting for an execution slot. Position in queue: %d", position)
+		report.QueuePosition = position
+		instanceview.ReportInstanceView(ctx, h, metadata, types.StatusTransitioning, c, report)
+	})
+	if err != nil {
+		ctx.Log("warning", "execution queue is not available. Executing without waiting for a slot", "error", err)
+	}
+
+	if queued {
+		ctx.Log("event", "got an execution slot")
+		report.ExecutionState = types.Running
+		report.ExecutionMessage = "Execution in progress"
+		report.QueuePosition = 0
+		instanceview.ReportInstanceView(ctx, h, metadata, types.StatusTransitioning, c, report)
+	}
+	return slot
+}
+
+// getMaxConcurrentExecutions reads the number of scripts that can execute at the same time on the machine.
+// Defaults to the number of CPUs.
+func getMaxConcurrentExecutions(ctx *log.Context) int {
+	max := runtime.NumCPU()
+	if max < minDefaultConcurrentExecutions {
+		max = minDefaultConcurrentExecutions
+	}
+
+	if value := os.Getenv(constants.MaxConcurrentExecutionsEnvName); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			ctx.Log("warning", fmt.Sprintf("invalid value %q for %v. Using default of %v", value, constants.MaxConcurrentExecutionsEnvName, max))
+		} else {
+			max = parsed
+		}
+	}
+	return max
+}
@@ -0,0 +1,70 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/executionqueue"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_getMaxConcurrentExecutions(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	defer os.Unsetenv(constants.MaxConcurrentExecutionsEnvName)
+
+	os.Unsetenv(constants.MaxConcurrentExecutionsEnvName)
+	defaultMax := getMaxConcurrentExecutions(ctx)
+	require.GreaterOrEqual(t, defaultMax, minDefaultConcurrentExecutions)
+
+	os.Setenv(constants.MaxConcurrentExecutionsEnvName, "7")
+	require.Equal(t, 7, getMaxConcurrentExecutions(ctx))
+
+	os.Setenv(constants.MaxConcurrentExecutionsEnvName, "0")
+	require.Equal(t, defaultMax, getMaxConcurrentExecutions(ctx))
+
+	os.Setenv(constants.MaxConcurrentExecutionsEnvName, "abc")
+	require.Equal(t, defaultMax, getMaxConcurrentExecutions(ctx))
+}
+
+func Test_waitForExecutionSlot_reportsQueuePosition(t *testing.T) {
+	dir := t.TempDir()
+	defer func(f func(*log.Context) *executionqueue.Queue) { newExecutionQueue = f }(newExecutionQueue)
+	newExecutionQueue = func(*log.Context) *executionqueue.Queue { return executionqueue.New(dir, 1) }
+
+	running, err := executionqueue.New(dir, 1).Wait(context.Background(), nil)
+	require.Nil(t, err)
+
+	reported := make(chan types.RunCommandInstanceView, 2)
+	c := types.CmdEnableTemplate.InitializeFunctions(types.CmdFunctions{
+		ReportStatus: func(ctx *log.Context, hEnv types.HandlerEnvironment, metadata types.RCMetadata, statusType types.StatusType, c types.Cmd, msg string) error {
+			var iv types.RunCommandInstanceView
+			require.Nil(t, json.Unmarshal([]byte(msg), &iv))
+			reported <- iv
+			return nil
+		},
+	})
+
+	report := types.RunCommandInstanceView{ExecutionState: types.Running}
+	done := make(chan bool)
+	go func() {
+		slot := waitForExecutionSlot(log.NewContext(log.NewNopLogger()), types.HandlerEnvironment{}, types.RCMetadata{}, c, &report)
+		slot.Release()
+		close(done)
+	}()
+
+	queued := <-reported
+	require.Equal(t, types.Pending, queued.ExecutionState)
+	require.Equal(t, 1, queued.QueuePosition)
+	require.Contains(t, queued.ExecutionMessage, "Position in queue: 1")
+
+	running.Release()
+	started := <-reported
+	require.Equal(t, types.Running, started.ExecutionState)
+	require.Equal(t, 0, started.QueuePosition)
+	<-done
+}
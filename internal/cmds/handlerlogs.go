@@ -0,0 +1,217 @@
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/instancemetadata"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/Azure/run-command-handler-linux/pkg/download"
+	"github.com/Azure/run-command-handler-linux/pkg/logsanitizer"
+	"github.com/Azure/run-command-handler-linux/pkg/versionutil"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// handlerLogsBlobSuffix names the blob the handler logs are uploaded to, next to the error blob
+	handlerLogsBlobSuffix = ".handlerlogs"
+
+	// maxHandlerLogsLen bounds the handler logs uploaded, the last ones are kept
+	maxHandlerLogsLen = 1024 * 1024
+
+	// handlerLogsTruncationMarker replaces the handler logs left out of the upload
+	handlerLogsTruncationMarker = "[...]\n"
+
+	// SubStatus codes reported when the handler logs are uploaded on failure
+	subStatusCodeHandlerLogsUploaded     = "HandlerLogsUploaded"
+	subStatusCodeHandlerLogsUploadFailed = "HandlerLogsUploadFailed"
+)
+
+// handlerLogPath returns the log file the handler writes to for the operation, the log of the service for the
+// immediate run commands
+func handlerLogPath(metadata types.RCMetadata) string {
+	if strings.HasPrefix(metadata.DownloadDir, constants.ImmediateDownloadFolder) {
+		return constants.ImmediateRCOutputDirectory
+	}
+	return constants.HandlerLogPath
+}
+
+// logFileSize returns the size of the log file, where the logs of the operation start, 0 if there is none yet
+func logFileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// uploadHandlerLogsOnFailure uploads the handler logs written since logStart and a summary of the failed operation
+// next to the error blob, when the settings opted in. The outcome is reported as a substatus of errorBlobUri.
+func uploadHandlerLogsOnFailure(ctx *log.Context, h types.HandlerEnvironment, report *types.RunCommandInstanceView, metadata types.RCMetadata, logPath string, logStart int64, opErr error, exitCode int) {
+	cfg, err := handlersettings.GetHandlerSettings(h.HandlerEnvironment.ConfigFolder, metadata.ExtName, metadata.SeqNum, ctx)
+	if err != nil || !cfg.PublicSettings.UploadHandlerLogsOnFailure || cfg.ErrorBlobURI == "" {
+		return
+	}
+
+	blobURI, err := handlerLogsBlobURI(cfg.ErrorBlobURI)
+	if err == nil {
+		blobCtx, cancel := context.WithTimeout(context.Background(), blobOperationGracePeriod)
+		defer cancel()
+		content := handlerLogsContent(metadata, logPath, logStart, opErr, exitCode, time.Now())
+		err = uploadHandlerLogs(download.WithProxy(blobCtx, cfg.ProxyURL()), ctx, blobURI, cfg.ProtectedSettings.ErrorBlobSASToken, cfg.ProtectedSettings.ErrorBlobManagedIdentity, content)
+	}
+	if err != nil {
+		ctx.Log("warning", "failed to upload the handler logs", "error", err)
+		report.SubStatuses = append(report.SubStatuses, types.InstanceViewSubStatus{
+			Name:    "errorBlobUri",
+			Code:    subStatusCodeHandlerLogsUploadFailed,
+			Level:   types.SubStatusLevelWarning,
+			Message: "The handler logs of the failed operation were not uploaded: " + logsanitizer.Sanitize(err.Error()),
+		})
+		return
+	}
+
+	ctx.Log("message", "uploaded the handler logs", "blob", download.GetUriForLogging(blobURI))
+	report.SubStatuses = append(report.SubStatuses, types.InstanceViewSubStatus{
+		Name:    "errorBlobUri",
+		Code:    subStatusCodeHandlerLogsUploaded,
+		Level:   types.SubStatusLevelInfo,
+		Message: "The handler logs of the failed operation were uploaded to " + download.GetUriForLogging(blobURI),
+	})
+}
+
+// handlerLogsBlobURI returns the uri of the blob the handler logs are uploaded to, next to the error blob. E.g.,
+// error.txt.handlerlogs. The query of the uri (e.g., a SAS token of the container) is kept.
+func handlerLogsBlobURI(errorBlobURI string) (string, error) {
+	u, err := url.Parse(errorBlobURI)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid errorBlobUri")
+	}
+	u.Path += handlerLogsBlobSuffix
+	return u.String(), nil
+}
+
+func uploadHandlerLogs(opCtx context.Context, ctx *log.Context, blobURI string, sasToken string, managedIdentity *handlersettings.RunCommandManagedIdentity, content []byte) error {
+	appendBlob, err := createOrReplaceAppendBlob(opCtx, blobURI, sasToken, nil, managedIdentity, ctx)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create blob '%s'", download.GetUriForLogging(blobURI))
+	}
+	blob := newOutputBlob(appendBlob)
+	if blob == nil {
+		return errors.Errorf("failed to create blob '%s'", download.GetUriForLogging(blobURI))
+	}
+	return blob.write(opCtx, ctx, content)
+}
+
+// handlerLogsContent returns a summary of the failed operation followed by the handler logs written since logStart
+func handlerLogsContent(metadata types.RCMetadata, logPath string, logStart int64, opErr error, exitCode int, now time.Time) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "extensionName: %s\n", metadata.ExtName)
+	fmt.Fprintf(&b, "sequenceNumber: %d\n", metadata.SeqNum)
+	fmt.Fprintf(&b, "handlerVersion: %s\n", versionutil.VersionString())
+	if m, ok := instancemetadata.Cached(); ok {
+		fields := m.Fields()
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(&b, "%s: %s\n", name, fields[name])
+		}
+	}
+	fmt.Fprintf(&b, "failedAt: %s\n", now.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "exitCode: %d\n", exitCode)
+	fmt.Fprintf(&b, "error: %s\n", logsanitizer.Sanitize(opErr.Error()))
+	fmt.Fprintf(&b, "\n--- %s ---\n", logPath)
+
+	// The log may be shared with the other operations executing concurrently, e.g. the immediate run commands
+	logs, err := readLogSlice(logPath, logStart, maxHandlerLogsLen, operationLogFilter(metadata))
+	if err != nil {
+		fmt.Fprintf(&b, "the handler logs could not be read: %v\n", err)
+	} else {
+		b.Write(logs)
+	}
+	return []byte(b.String())
+}
+
+// operationLogFilter returns whether a line of the logs was written by the operation of metadata, as the lines are
+// written with the name of the extension and the sequence number
+func operationLogFilter(metadata types.RCMetadata) func(line []byte) bool {
+	fields := [][]byte{logfmtField("extensionName", metadata.ExtName), logfmtField("seq", metadata.SeqNum)}
+	return func(line []byte) bool {
+		line = append(append([]byte(" "), bytes.TrimRight(line, "\r\n")...), ' ')
+		for _, field := range fields {
+			if !bytes.Contains(line, field) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// logfmtField returns the field as the logger writes it within a line, e.g. " seq=3 "
+func logfmtField(key string, value interface{}) []byte {
+	var b bytes.Buffer
+	log.NewLogfmtLogger(&b).Log(key, value)
+	return append(append([]byte(" "), bytes.TrimRight(b.Bytes(), "\n")...), ' ')
+}
+
+// readLogSlice returns the lines kept by keep written from start to the end of the file, the last ones within max
+// bytes. The whole file is read if it is smaller than start, e.g., once rotated.
+func readLogSlice(path string, start int64, max int, keep func(line []byte) bool) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if start > size {
+		start = 0
+	}
+
+	var b []byte
+	truncated := false
+	r := bufio.NewReader(io.NewSectionReader(f, start, size-start))
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 && keep(line) {
+			b = append(b, line...)
+			// The first lines are dropped as the kept ones exceed max
+			for len(b) > max {
+				truncated = true
+				i := bytes.IndexByte(b, '\n')
+				if i < 0 {
+					i = len(b) - 1
+				}
+				b = b[i+1:]
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if truncated {
+		b = append([]byte(handlerLogsTruncationMarker), b...)
+	}
+	return b, nil
+}
@@ -0,0 +1,109 @@
+package commands
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_handlerLogPath(t *testing.T) {
+	require.Equal(t, constants.HandlerLogPath, handlerLogPath(types.NewRCMetadata("RC0001", 1, constants.DownloadFolder, constants.DataDir)))
+	require.Equal(t, constants.ImmediateRCOutputDirectory,
+		handlerLogPath(types.NewRCMetadata("RC0001", 1, constants.ImmediateDownloadFolder, constants.DataDir)))
+
+	// The shim redirects the output of the handler to its log file
+	shim, err := os.ReadFile("../../misc/run-command-shim")
+	require.Nil(t, err)
+	require.Contains(t, string(shim), `LOG_DIR="`+filepath.Dir(constants.HandlerLogPath)+`"`)
+	require.Contains(t, string(shim), "LOG_FILE="+filepath.Base(constants.HandlerLogPath)+"\n")
+}
+
+func Test_handlerLogsBlobURI(t *testing.T) {
+	uri, err := handlerLogsBlobURI("https://account.blob.core.windows.net/container/error.txt?sv=2020&sig=secret")
+	require.Nil(t, err)
+	require.Equal(t, "https://account.blob.core.windows.net/container/error.txt.handlerlogs?sv=2020&sig=secret", uri)
+
+	_, err = handlerLogsBlobURI("://invalid")
+	require.ErrorContains(t, err, "invalid errorBlobUri")
+}
+
+func Test_readLogSlice(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handler.log")
+	require.Nil(t, os.WriteFile(path, []byte("before\n"), 0644))
+	start := logFileSize(path)
+	require.Nil(t, os.WriteFile(path, []byte("before\nfirst\nsecond\n"), 0644))
+
+	all := func([]byte) bool { return true }
+	b, err := readLogSlice(path, start, 100, all)
+	require.Nil(t, err)
+	require.Equal(t, "first\nsecond\n", string(b))
+
+	// Only the last complete lines are kept
+	b, err = readLogSlice(path, start, 9, all)
+	require.Nil(t, err)
+	require.Equal(t, handlerLogsTruncationMarker+"second\n", string(b))
+
+	// The log was rotated since the operation started
+	b, err = readLogSlice(path, 1000, 100, all)
+	require.Nil(t, err)
+	require.Equal(t, "before\nfirst\nsecond\n", string(b))
+
+	// The lines left out don't count toward max
+	b, err = readLogSlice(path, 0, 13, func(line []byte) bool { return !strings.HasPrefix(string(line), "second") })
+	require.Nil(t, err)
+	require.Equal(t, "before\nfirst\n", string(b))
+
+	_, err = readLogSlice(filepath.Join(t.TempDir(), "missing.log"), 0, 100, all)
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, int64(0), logFileSize(filepath.Join(t.TempDir(), "missing.log")))
+}
+
+func Test_operationLogFilter(t *testing.T) {
+	keep := operationLogFilter(types.NewRCMetadata("RC0001", 3, constants.ImmediateDownloadFolder, constants.DataDir))
+	require.True(t, keep([]byte("time=2024-01-02T03:04:05Z extensionName=RC0001 seq=3 event=start\n")))
+	require.True(t, keep([]byte("extensionName=RC0001 event=\"download failed\" seq=3")))
+	require.False(t, keep([]byte("time=2024-01-02T03:04:05Z extensionName=RC0002 seq=3 event=start\n")), "another extension")
+	require.False(t, keep([]byte("time=2024-01-02T03:04:05Z extensionName=RC0001 seq=31 event=start\n")), "another sequence number")
+	require.False(t, keep([]byte("time=2024-01-02T03:04:05Z extensionName=RC00012 seq=3 event=start\n")), "another extension")
+	require.False(t, keep([]byte("time=2024-01-02T03:04:05Z operation=runService event=poll\n")), "the service")
+
+	// The values are matched as the logger writes them
+	keep = operationLogFilter(types.NewRCMetadata("Run Command", 3, constants.ImmediateDownloadFolder, constants.DataDir))
+	require.True(t, keep([]byte(`extensionName="Run Command" seq=3`)))
+}
+
+func Test_handlerLogsContent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handler.log")
+	require.Nil(t, os.WriteFile(path, []byte("extensionName=RC0001 seq=3 event=start\nextensionName=RC0002 seq=1 event=start\n"), 0644))
+	metadata := types.NewRCMetadata("RC0001", 3, constants.DownloadFolder, constants.DataDir)
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	content := string(handlerLogsContent(metadata, path, 0, errors.New("download failed: https://account.blob.core.windows.net/c/s.sh?sig=secret"), -100, now))
+	require.True(t, strings.HasPrefix(content, "extensionName: RC0001\nsequenceNumber: 3\n"))
+	require.Contains(t, content, "failedAt: 2024-01-02T03:04:05Z\nexitCode: -100\n")
+	require.Contains(t, content, "error: download failed: https://account.blob.core.windows.net/c/s.sh\n")
+	require.NotContains(t, content, "secret")
+	require.True(t, strings.HasSuffix(content, "--- "+path+" ---\nextensionName=RC0001 seq=3 event=start\n"))
+
+	content = string(handlerLogsContent(metadata, filepath.Join(t.TempDir(), "missing.log"), 0, errors.New("failed"), -1, now))
+	require.Contains(t, content, "the handler logs could not be read")
+}
+
+func Test_uploadHandlerLogsOnFailure_notOptedIn(t *testing.T) {
+	var h types.HandlerEnvironment
+	h.HandlerEnvironment.ConfigFolder = t.TempDir()
+	report := types.RunCommandInstanceView{}
+	metadata := types.NewRCMetadata("RC0001", 1, constants.DownloadFolder, constants.DataDir)
+
+	// Without settings, nothing is uploaded nor reported
+	uploadHandlerLogsOnFailure(log.NewContext(log.NewNopLogger()), h, &report, metadata, "", 0, errors.New("failed"), -1)
+	require.Empty(t, report.SubStatuses)
+}
@@ -0,0 +1,76 @@
+package commands
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/pkg/download"
+	"github.com/Azure/run-command-handler-linux/pkg/keyvault"
+	"github.com/Azure/run-command-handler-linux/pkg/logsanitizer"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// keyVaultTimeout bounds the resolution of all the Key Vault references of a run command, retries included
+const keyVaultTimeout = 2 * time.Minute
+
+var (
+	// keyVaultClients are the Key Vault clients by managed identity. A client caches the secrets it reads, so
+	// they are only shared by the run commands reading them with the same identity.
+	keyVaultClients     = make(map[handlersettings.RunCommandManagedIdentity]*keyvault.Client)
+	keyVaultClientsLock sync.Mutex
+)
+
+// resolveKeyVaultReferences reads the secrets of the keyVaultReferences into cfg.KeyVaultSecrets, which the script
+// gets as environment variables. The secrets are masked in the logs.
+func resolveKeyVaultReferences(ctx *log.Context, cfg *handlersettings.HandlerSettings) error {
+	references := cfg.ProtectedSettings.KeyVaultReferences
+	if len(references) == 0 {
+		return nil
+	}
+	client, err := getKeyVaultClient(cfg.ProtectedSettings.KeyVaultManagedIdentity)
+	if err != nil {
+		return err
+	}
+
+	opCtx, cancel := context.WithTimeout(download.WithProxy(context.Background(), cfg.ProxyURL()), keyVaultTimeout)
+	defer cancel()
+	secrets := make(map[string]string, len(references))
+	for name, reference := range references {
+		value, err := client.Resolve(opCtx, reference)
+		if err != nil {
+			return errors.Wrapf(err, "failed to resolve the Key Vault reference of '%s'", name)
+		}
+		logsanitizer.RegisterSecrets(value)
+		secrets[name] = value
+	}
+	cfg.ProtectedSettings.KeyVaultSecrets = secrets
+	ctx.Log("event", "resolved the Key Vault references", "count", len(secrets))
+	return nil
+}
+
+func getKeyVaultClient(managedIdentity *handlersettings.RunCommandManagedIdentity) (*keyvault.Client, error) {
+	var key handlersettings.RunCommandManagedIdentity
+	if managedIdentity != nil {
+		key = *managedIdentity
+	}
+	keyVaultClientsLock.Lock()
+	defer keyVaultClientsLock.Unlock()
+	if client, ok := keyVaultClients[key]; ok {
+		return client, nil
+	}
+
+	credential, err := newManagedIdentityCredential(managedIdentity)
+	if err != nil {
+		return nil, err
+	}
+	client := keyvault.NewClient(func(ctx context.Context, scope string) (string, error) {
+		token, err := credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{scope}})
+		return token.Token, err
+	}, download.NewTransport())
+	keyVaultClients[key] = client
+	return client, nil
+}
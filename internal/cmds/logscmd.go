@@ -0,0 +1,121 @@
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
+	"github.com/Azure/run-command-handler-linux/internal/outputfile"
+	"github.com/Azure/run-command-handler-linux/internal/outputstream"
+	"github.com/pkg/errors"
+)
+
+// LogsCmdName is the operator facing subcommand printing the output of the scripts of an extension
+const LogsCmdName = "logs"
+
+// LogsOptions changes what the logs subcommand prints
+type LogsOptions struct {
+	// ExtensionName is the run command to print the output of. Empty for the single-config extension.
+	ExtensionName string
+
+	// Follow keeps printing the output of the scripts executed by the service as it is written
+	Follow bool
+}
+
+// ParseLogsCmdOptions parses the flags accepted by the logs subcommand
+func ParseLogsCmdOptions(args []string, output io.Writer) (LogsOptions, error) {
+	var opts LogsOptions
+	flags := flag.NewFlagSet(LogsCmdName, flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.StringVar(&opts.ExtensionName, "extension", "", "name of the run command")
+	flags.BoolVar(&opts.Follow, "follow", false, "stream the output of the scripts executed by the service as it is written")
+
+	if err := flags.Parse(args); err != nil {
+		return opts, errors.Wrapf(err, "failed to parse arguments for %s", LogsCmdName)
+	}
+
+	if flags.NArg() > 0 {
+		return opts, fmt.Errorf("unexpected arguments for %s: %v", LogsCmdName, flags.Args())
+	}
+
+	return opts, nil
+}
+
+// Logs prints the output of the most recent execution of the extension. If opts.Follow is set, it then
+// streams the output of the scripts executed by the service until the service closes the connection.
+func Logs(opts LogsOptions, stdout io.Writer, stderr io.Writer) error {
+	dir, found := latestExecutionDir(constants.DataDir, opts.ExtensionName)
+	if found {
+		stdoutPath, stderrPath := datapaths.OutputFilePaths(dir)
+		if err := copyFile(stdoutPath, stdout); err != nil {
+			return err
+		}
+		if err := copyFile(stderrPath, stderr); err != nil {
+			return err
+		}
+	}
+
+	if opts.Follow {
+		return outputstream.Follow(constants.ServiceSocketPath, opts.ExtensionName, stdout, stderr)
+	}
+
+	if !found {
+		return fmt.Errorf("no execution found for run command '%s'", opts.ExtensionName)
+	}
+	return nil
+}
+
+// latestExecutionDir returns the execution directory of the extension with the most recent output,
+// across the standard and immediate run command download folders
+func latestExecutionDir(dataDir string, extensionName string) (string, bool) {
+	var latest string
+	var latestTime time.Time
+	for _, folder := range []string{constants.DownloadFolder, constants.ImmediateDownloadFolder, constants.ProvisioningDownloadFolder} {
+		downloadPath := datapaths.DownloadPath(dataDir, folder, extensionName)
+		entries, err := os.ReadDir(downloadPath)
+		if err != nil {
+			continue
+		}
+
+		for _, e := range entries {
+			seqNum, err := strconv.Atoi(e.Name())
+			if err != nil || !e.IsDir() {
+				continue
+			}
+
+			dir := datapaths.SeqNumDir(downloadPath, seqNum)
+			stdoutPath, _ := datapaths.OutputFilePaths(dir)
+			info, err := os.Stat(stdoutPath)
+			if err != nil {
+				continue
+			}
+			if latest == "" || info.ModTime().After(latestTime) {
+				latest, latestTime = dir, info.ModTime()
+			}
+		}
+	}
+	return latest, latest != ""
+}
+
+func copyFile(path string, w io.Writer) error {
+	f, err := outputfile.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "failed to open %s", path)
+	}
+	defer f.Close()
+
+	size, err := f.Size()
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", path)
+	}
+	_, err = io.Copy(w, io.NewSectionReader(f, 0, size))
+	return errors.Wrapf(err, "failed to read %s", path)
+}
@@ -0,0 +1,47 @@
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseLogsCmdOptions(t *testing.T) {
+	opts, err := ParseLogsCmdOptions([]string{}, ioutil.Discard)
+	require.Nil(t, err)
+	require.Empty(t, opts.ExtensionName)
+	require.False(t, opts.Follow)
+
+	opts, err = ParseLogsCmdOptions([]string{"--extension", "rc1", "--follow"}, ioutil.Discard)
+	require.Nil(t, err)
+	require.Equal(t, "rc1", opts.ExtensionName)
+	require.True(t, opts.Follow)
+
+	_, err = ParseLogsCmdOptions([]string{"extra"}, ioutil.Discard)
+	require.ErrorContains(t, err, "unexpected arguments")
+}
+
+func Test_latestExecutionDir(t *testing.T) {
+	dataDir := t.TempDir()
+	_, found := latestExecutionDir(dataDir, "rc1")
+	require.False(t, found)
+
+	older := datapaths.SeqNumDir(datapaths.DownloadPath(dataDir, constants.DownloadFolder, "rc1"), 5)
+	newer := datapaths.SeqNumDir(datapaths.DownloadPath(dataDir, constants.ImmediateDownloadFolder, "rc1"), 1)
+	for _, dir := range []string{older, newer} {
+		require.Nil(t, os.MkdirAll(dir, 0700))
+		require.Nil(t, os.WriteFile(filepath.Join(dir, "stdout"), []byte("output"), 0600))
+	}
+	past := time.Now().Add(-time.Hour)
+	require.Nil(t, os.Chtimes(filepath.Join(older, "stdout"), past, past))
+
+	dir, found := latestExecutionDir(dataDir, "rc1")
+	require.True(t, found)
+	require.Equal(t, newer, dir)
+}
@@ -0,0 +1,216 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/outputfile"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/Azure/run-command-handler-linux/pkg/logshipper"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// logAnalyticsScope is the scope of the tokens of the Logs Ingestion API
+	logAnalyticsScope = "https://monitor.azure.com//.default"
+
+	// maxShippedChunkSize bounds the output read from a file every time it is shipped, the rest is shipped next time
+	maxShippedChunkSize = 4 * 1024 * 1024
+
+	// maxShippedLineLength truncates the lines of output longer than what a column of the workspace is meant for
+	maxShippedLineLength = 32 * 1024
+
+	// shipQueueLength bounds the chunks of output read but not shipped yet. The output is read again once the queue
+	// has room, so a slow workspace delays the shipment without delaying the status updates.
+	shipQueueLength = 4
+
+	subStatusCodeLogAnalyticsFailed = "LogAnalyticsShipmentFailed"
+
+	// Streams of the records shipped to the workspace
+	streamStdout = "stdout"
+	streamStderr = "stderr"
+)
+
+// outputShipper ships the lines of output of the script to the Log Analytics workspace of logAnalytics, from the
+// position each output file was read up to. The lines are shipped in the background, in the order they are read.
+type outputShipper struct {
+	shipper  *logshipper.Shipper
+	record   logshipper.Record
+	now      func() time.Time
+	failure  error
+	position map[string]int64
+
+	// queue passes the lines read to the goroutine shipping them, which closes done once the queue is closed and
+	// the lines are shipped
+	queue chan []logshipper.Record
+	done  chan struct{}
+
+	// The lines dropped by the shipper so far and the last error dropping them
+	mutex     sync.Mutex
+	dropped   int
+	lastError error
+}
+
+// newOutputShipper returns the shipper of the output, or nil if the output is not shipped to a workspace. A
+// shipper which can't be created reports the failure without failing the execution. The lines are shipped until
+// opCtx is done.
+func newOutputShipper(opCtx context.Context, ctx *log.Context, cfg *handlersettings.HandlerSettings, metadata types.RCMetadata) *outputShipper {
+	destination := cfg.PublicSettings.LogAnalytics
+	if destination == nil {
+		return nil
+	}
+	computer, _ := os.Hostname()
+	s := &outputShipper{
+		record:   logshipper.Record{Computer: computer, ExtensionName: metadata.ExtName, SeqNum: metadata.SeqNum},
+		now:      time.Now,
+		position: map[string]int64{},
+	}
+
+	sender, err := newLogAnalyticsSender(*destination, cfg.ProtectedSettings)
+	if err != nil {
+		ctx.Log("warning", "the output is not shipped to the Log Analytics workspace", "error", err)
+		s.failure = err
+		return s
+	}
+	s.start(opCtx, logshipper.NewShipper(sender))
+	return s
+}
+
+// newLogAnalyticsSender returns the sender to the workspace, authenticated with a managed identity
+func newLogAnalyticsSender(destination handlersettings.LogAnalyticsDestination, protected handlersettings.ProtectedSettings) (logshipper.Sender, error) {
+	credential, err := newManagedIdentityCredential(protected.LogAnalyticsManagedIdentity)
+	if err != nil {
+		return nil, err
+	}
+	return logshipper.NewIngestionSender(destination.DataCollectionEndpoint, destination.DataCollectionRuleID, destination.StreamName,
+		func(ctx context.Context) (string, error) {
+			token, err := credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{logAnalyticsScope}})
+			return token.Token, err
+		}), nil
+}
+
+// start ships the lines queued with shipper in the background until the queue is closed
+func (s *outputShipper) start(opCtx context.Context, shipper *logshipper.Shipper) {
+	s.shipper = shipper
+	s.queue = make(chan []logshipper.Record, shipQueueLength)
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		for records := range s.queue {
+			for _, record := range records {
+				shipper.Add(opCtx, record)
+			}
+			shipper.Flush(opCtx)
+			s.mutex.Lock()
+			s.dropped, s.lastError = shipper.Dropped, shipper.LastError
+			s.mutex.Unlock()
+		}
+	}()
+}
+
+// ship queues the lines of output written since the last call, as long as the queue has room. An incomplete line at
+// the end of a file is left to be shipped with the next call.
+func (s *outputShipper) ship(ctx *log.Context, stdoutF, stderrF string) {
+	if s == nil || s.shipper == nil {
+		return
+	}
+	s.queueFile(ctx, stdoutF, streamStdout, false)
+	s.queueFile(ctx, stderrF, streamStderr, false)
+}
+
+// finish queues the rest of the output and waits for the lines to be shipped, until the operation is done
+func (s *outputShipper) finish(ctx *log.Context, stdoutF, stderrF string) {
+	if s == nil || s.shipper == nil {
+		return
+	}
+	for s.queueFile(ctx, stdoutF, streamStdout, true) {
+	}
+	for s.queueFile(ctx, stderrF, streamStderr, true) {
+	}
+	close(s.queue)
+	<-s.done
+}
+
+// queueFile queues the lines of the output file from the position it was read up to. Unless final is set, the lines
+// are not queued if the queue is full, they are read again next time. Returns whether lines were queued.
+func (s *outputShipper) queueFile(ctx *log.Context, path string, stream string, final bool) bool {
+	if !final && len(s.queue) == cap(s.queue) {
+		return false
+	}
+	chunk, err := readFrom(path, s.position[path], maxShippedChunkSize)
+	if err != nil {
+		if !os.IsNotExist(errors.Cause(err)) {
+			ctx.Log("warning", "failed to read the output to ship", "path", path, "error", err)
+		}
+		return false
+	}
+
+	// Complete lines only, unless the chunk is a single line longer than a chunk
+	end := bytes.LastIndexByte(chunk, '\n') + 1
+	if final || (end == 0 && len(chunk) == maxShippedChunkSize) {
+		end = len(chunk)
+	}
+	if end == 0 {
+		return false
+	}
+	s.position[path] += int64(end)
+
+	timeGenerated := s.now().UTC().Format(time.RFC3339Nano)
+	var records []logshipper.Record
+	for _, line := range bytes.Split(bytes.TrimSuffix(chunk[:end], []byte("\n")), []byte("\n")) {
+		if len(line) > maxShippedLineLength {
+			line = line[:maxShippedLineLength]
+		}
+		record := s.record
+		record.TimeGenerated = timeGenerated
+		record.Stream = stream
+		record.Line = string(bytes.ToValidUTF8(line, []byte("�")))
+		records = append(records, record)
+	}
+	// Only this goroutine sends to the queue, which has room unless final is set
+	s.queue <- records
+	return true
+}
+
+// readFrom reads at most max bytes of the output file from position
+func readFrom(path string, position int64, max int64) ([]byte, error) {
+	f, err := outputfile.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.NewSectionReader(f, position, max))
+}
+
+// subStatuses describes the failures to ship the output, if any
+func (s *outputShipper) subStatuses() []types.InstanceViewSubStatus {
+	if s == nil {
+		return nil
+	}
+	s.mutex.Lock()
+	dropped, lastError := s.dropped, s.lastError
+	s.mutex.Unlock()
+	var message string
+	switch {
+	case s.failure != nil:
+		message = fmt.Sprintf("The output is not shipped to the Log Analytics workspace: %v", s.failure)
+	case dropped > 0:
+		message = fmt.Sprintf("%d lines of output were not shipped to the Log Analytics workspace. Last error: %v", dropped, lastError)
+	default:
+		return nil
+	}
+	return []types.InstanceViewSubStatus{{
+		Name:    "logAnalytics",
+		Code:    subStatusCodeLogAnalyticsFailed,
+		Level:   types.SubStatusLevelWarning,
+		Message: message,
+	}}
+}
@@ -0,0 +1,143 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/Azure/run-command-handler-linux/pkg/logshipper"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingSender struct {
+	mutex   sync.Mutex
+	records []logshipper.Record
+	err     error
+	blocked chan struct{}
+}
+
+func (r *recordingSender) Send(ctx context.Context, body []byte) error {
+	if r.blocked != nil {
+		<-r.blocked
+	}
+	if r.err != nil {
+		return r.err
+	}
+	var batch []logshipper.Record
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.records = append(r.records, batch...)
+	return nil
+}
+
+func (r *recordingSender) lines() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var result []string
+	for _, record := range r.records {
+		result = append(result, record.Stream+":"+record.Line)
+	}
+	return result
+}
+
+func newTestOutputShipper(opCtx context.Context, sender logshipper.Sender) *outputShipper {
+	s := &outputShipper{
+		record:   logshipper.Record{Computer: "vm", ExtensionName: "ext", SeqNum: 3},
+		now:      func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) },
+		position: map[string]int64{},
+	}
+	s.start(opCtx, logshipper.NewShipper(sender))
+	return s
+}
+
+func Test_outputShipperShipsCompleteLines(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	dir := t.TempDir()
+	stdoutF, stderrF := filepath.Join(dir, "stdout"), filepath.Join(dir, "stderr")
+	require.Nil(t, os.WriteFile(stdoutF, []byte("one\ntwo\nthr"), 0600))
+
+	sender := &recordingSender{}
+	s := newTestOutputShipper(context.Background(), sender)
+	s.ship(ctx, stdoutF, stderrF)
+	require.Eventually(t, func() bool { return len(sender.lines()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"stdout:one", "stdout:two"}, sender.lines())
+	require.Equal(t, logshipper.Record{TimeGenerated: "2024-01-02T03:04:05Z", Computer: "vm", ExtensionName: "ext", SeqNum: 3, Stream: "stdout", Line: "one"}, sender.records[0])
+
+	f, err := os.OpenFile(stdoutF, os.O_APPEND|os.O_WRONLY, 0600)
+	require.Nil(t, err)
+	_, err = f.WriteString("ee\nfour")
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+	require.Nil(t, os.WriteFile(stderrF, []byte("oops\n"), 0600))
+
+	s.finish(ctx, stdoutF, stderrF)
+	require.Equal(t, []string{"stdout:one", "stdout:two", "stdout:three", "stdout:four", "stderr:oops"}, sender.lines())
+	require.Nil(t, s.subStatuses())
+}
+
+func Test_outputShipperDoesNotWaitForTheWorkspace(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	dir := t.TempDir()
+	stdoutF, stderrF := filepath.Join(dir, "stdout"), filepath.Join(dir, "stderr")
+	f, err := os.Create(stdoutF)
+	require.Nil(t, err)
+	defer f.Close()
+
+	// The workspace doesn't respond, the lines are read as long as the queue has room
+	sender := &recordingSender{blocked: make(chan struct{})}
+	s := newTestOutputShipper(context.Background(), sender)
+	for i := 0; i < shipQueueLength+3; i++ {
+		_, err := f.WriteString("line\n")
+		require.Nil(t, err)
+		s.ship(ctx, stdoutF, stderrF)
+	}
+	require.Less(t, s.position[stdoutF], int64((shipQueueLength+3)*len("line\n")), "the lines not queued are read again")
+
+	close(sender.blocked)
+	s.finish(ctx, stdoutF, stderrF)
+	require.Len(t, sender.lines(), shipQueueLength+3)
+}
+
+func Test_outputShipperReportsDroppedLines(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	dir := t.TempDir()
+	stdoutF := filepath.Join(dir, "stdout")
+	require.Nil(t, os.WriteFile(stdoutF, []byte("one\ntwo\n"), 0600))
+
+	// The blob operations of the command are done, the batch is not retried
+	opCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s := newTestOutputShipper(opCtx, &recordingSender{err: errors.New("unauthorized")})
+	s.finish(ctx, stdoutF, filepath.Join(dir, "stderr"))
+
+	subStatuses := s.subStatuses()
+	require.Len(t, subStatuses, 1)
+	require.Equal(t, "logAnalytics", subStatuses[0].Name)
+	require.Equal(t, types.SubStatusLevelWarning, subStatuses[0].Level)
+	require.Equal(t, "2 lines of output were not shipped to the Log Analytics workspace. Last error: unauthorized", subStatuses[0].Message)
+}
+
+func Test_newOutputShipper(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	cfg := handlersettings.HandlerSettings{}
+	require.Nil(t, newOutputShipper(context.Background(), ctx, &cfg, types.RCMetadata{}))
+
+	cfg.PublicSettings.LogAnalytics = &handlersettings.LogAnalyticsDestination{DataCollectionEndpoint: "https://dce.ingest.monitor.azure.com", DataCollectionRuleID: "dcr-1", StreamName: "Custom-RunCommand"}
+	cfg.ProtectedSettings.LogAnalyticsManagedIdentity = &handlersettings.RunCommandManagedIdentity{ObjectId: "object"}
+	s := newOutputShipper(context.Background(), ctx, &cfg, types.RCMetadata{ExtName: "ext", SeqNum: 1})
+	require.NotNil(t, s)
+	require.Len(t, s.subStatuses(), 1, "a shipper which can't be created is reported")
+	s.ship(ctx, "stdout", "stderr")
+	s.finish(ctx, "stdout", "stderr")
+}
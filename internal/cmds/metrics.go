@@ -0,0 +1,37 @@
+package commands
+
+import (
+	"github.com/Azure/run-command-handler-linux/internal/files"
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/outputmetrics"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+)
+
+// maxMetricsOutputLen is the length of the end of stdout the metrics are extracted from
+const maxMetricsOutputLen = 1024 * 1024
+
+// reportMetrics extracts the metrics of metricExtractors from stdout into the report and sends them as telemetry
+func reportMetrics(ctx *log.Context, stdoutF string, cfg *handlersettings.HandlerSettings, report *types.RunCommandInstanceView) {
+	extractors, err := cfg.OutputMetricExtractors()
+	if err != nil || len(extractors) == 0 {
+		return
+	}
+	output, err := files.TailFile(stdoutF, maxMetricsOutputLen)
+	if err != nil {
+		ctx.Log("warning", "failed to read the output to extract the metrics", "error", err)
+		return
+	}
+
+	metrics := outputmetrics.Extract(extractors, output)
+	if len(metrics) == 0 {
+		ctx.Log("message", "no metric found in the output")
+		return
+	}
+	report.Metrics = map[string]string{}
+	for _, metric := range metrics {
+		report.Metrics[metric.Name] = metric.Value
+		telemetryResult("metric", metric.Name+"="+metric.Value, true, 0)
+	}
+	ctx.Log("event", "extracted the metrics of the output", "metrics", len(metrics), "extractors", len(extractors))
+}
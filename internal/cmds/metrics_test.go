@@ -0,0 +1,32 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_reportMetrics(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	stdoutF := filepath.Join(t.TempDir(), "stdout")
+	require.Nil(t, os.WriteFile(stdoutF, []byte("patched=42\n{\"reboot\": false}\n"), 0600))
+
+	cfg := handlersettings.HandlerSettings{PublicSettings: handlersettings.PublicSettings{MetricExtractors: []handlersettings.MetricExtractor{
+		{Name: "patched_packages", Regex: `patched=(\d+)`},
+		{Name: "reboot", JSONPath: "$.reboot"},
+		{Name: "missing", Regex: "missing"},
+	}}}
+	report := types.RunCommandInstanceView{}
+	reportMetrics(ctx, stdoutF, &cfg, &report)
+	require.Equal(t, map[string]string{"patched_packages": "42", "reboot": "false"}, report.Metrics)
+
+	// Without metrics, the report has none
+	report = types.RunCommandInstanceView{}
+	reportMetrics(ctx, filepath.Join(t.TempDir(), "none"), &cfg, &report)
+	require.Nil(t, report.Metrics)
+}
@@ -0,0 +1,48 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/Azure/run-command-handler-linux/internal/scriptprogress"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	subStatusCodeScriptProgress = "ScriptProgress"
+
+	// progressSubStatusName names the substatus of the overall progress of the script
+	progressSubStatusName = "progress"
+)
+
+// readScriptProgress reads the progress the script reported so far, returning its percent complete (nil if not
+// reported) and its messages as substatuses
+func readScriptProgress(ctx *log.Context, reader *scriptprogress.Reader) (*int, []types.InstanceViewSubStatus) {
+	progress, err := reader.Read()
+	if err != nil {
+		ctx.Log("warning", "failed to read the progress of the script", "error", err)
+	}
+
+	var subStatuses []types.InstanceViewSubStatus
+	if progress.PercentComplete != nil || progress.Message != "" {
+		message := progress.Message
+		if progress.PercentComplete != nil {
+			message = fmt.Sprintf("%d%% complete. %s", *progress.PercentComplete, progress.Message)
+		}
+		subStatuses = append(subStatuses, types.InstanceViewSubStatus{
+			Name:    progressSubStatusName,
+			Code:    subStatusCodeScriptProgress,
+			Level:   types.SubStatusLevelInfo,
+			Message: message,
+		})
+	}
+	for _, s := range progress.SubStatuses {
+		subStatuses = append(subStatuses, types.InstanceViewSubStatus{
+			Name:    s.Name,
+			Code:    subStatusCodeScriptProgress,
+			Level:   s.Level,
+			Message: s.Message,
+		})
+	}
+	return progress.PercentComplete, subStatuses
+}
@@ -0,0 +1,32 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/scriptprogress"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_readScriptProgress(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	path := filepath.Join(t.TempDir(), "progress.jsonl")
+	reader := scriptprogress.NewReader(path)
+
+	percent, subStatuses := readScriptProgress(ctx, reader)
+	require.Nil(t, percent)
+	require.Empty(t, subStatuses)
+
+	require.Nil(t, os.WriteFile(path, []byte(`{"percentComplete": 40, "message": "Installing packages"}
+{"name": "database", "message": "Schema migrated"}
+`), 0600))
+	percent, subStatuses = readScriptProgress(ctx, reader)
+	require.Equal(t, 40, *percent)
+	require.Equal(t, []types.InstanceViewSubStatus{
+		{Name: "progress", Code: "ScriptProgress", Level: types.SubStatusLevelInfo, Message: "40% complete. Installing packages"},
+		{Name: "database", Code: "ScriptProgress", Level: types.SubStatusLevelInfo, Message: "Schema migrated"},
+	}, subStatuses)
+}
@@ -0,0 +1,98 @@
+package commands
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Azure/run-command-handler-linux/internal/commandProcessor"
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/status"
+	"github.com/pkg/errors"
+)
+
+// ProvisionCmdName is the subcommand executing a run command at provisioning time (e.g., from cloud-init at first
+// boot), before the agent issues goal states
+const ProvisionCmdName = "provision"
+
+// defaultProvisioningExtensionName is the name of the run command executed at provisioning time if neither the
+// settings nor the flags name it
+const defaultProvisioningExtensionName = "provisioning"
+
+// ProvisionOptions changes what the provision subcommand executes and where it reports the status
+type ProvisionOptions struct {
+	// SettingsFile has the format of the settings files of the agent, with a single runtime settings
+	SettingsFile string
+
+	// StatusFile receives the status of the execution, in the format of the status files of the agent
+	StatusFile string
+
+	// ExtensionName overrides the name of the run command in the settings
+	ExtensionName string
+}
+
+// ParseProvisionCmdOptions parses the flags accepted by the provision subcommand
+func ParseProvisionCmdOptions(args []string, output io.Writer) (ProvisionOptions, error) {
+	var opts ProvisionOptions
+	flags := flag.NewFlagSet(ProvisionCmdName, flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.StringVar(&opts.SettingsFile, "settings", constants.ProvisioningSettingsPath, "settings file of the run command to execute")
+	flags.StringVar(&opts.StatusFile, "status", constants.ProvisioningStatusPath, "file to report the status of the run command to")
+	flags.StringVar(&opts.ExtensionName, "extension", "", "name of the run command, instead of the name in the settings")
+
+	if err := flags.Parse(args); err != nil {
+		return opts, errors.Wrapf(err, "failed to parse arguments for %s", ProvisionCmdName)
+	}
+
+	if flags.NArg() > 0 {
+		return opts, fmt.Errorf("unexpected arguments for %s: %v", ProvisionCmdName, flags.Args())
+	}
+
+	return opts, nil
+}
+
+// Provision executes the run command of the settings file with the full enable pipeline (downloads, policies,
+// blobs, sequence numbers), reporting its status to the status file. A sequence number already executed is not
+// executed again, so provisioning can be retried safely.
+func Provision(opts ProvisionOptions) error {
+	hs, extensionName, seqNum, err := readProvisioningSettings(opts.SettingsFile)
+	if err != nil {
+		return err
+	}
+	if opts.ExtensionName != "" {
+		extensionName = opts.ExtensionName
+	}
+
+	cmd := CmdEnable
+	cmd.Functions.ReportStatus = status.ReportStatusToFile(opts.StatusFile)
+	return commandProcessor.ProcessProvisioningCommand(cmd, hs, extensionName, seqNum)
+}
+
+// readProvisioningSettings reads the settings file and returns it with the name and sequence number of the run
+// command, which default to "provisioning" and 0
+func readProvisioningSettings(path string) (handlersettings.HandlerSettingsFile, string, int, error) {
+	var hs handlersettings.HandlerSettingsFile
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return hs, "", 0, errors.Wrap(err, "failed to read provisioning settings")
+	}
+	if err := json.Unmarshal(b, &hs); err != nil {
+		return hs, "", 0, errors.Wrapf(err, "invalid provisioning settings %s", path)
+	}
+	if len(hs.RuntimeSettings) != 1 {
+		return hs, "", 0, errors.Errorf("invalid provisioning settings %s: expected 1 runtimeSettings, got %d", path, len(hs.RuntimeSettings))
+	}
+
+	settings := hs.RuntimeSettings[0].HandlerSettings
+	extensionName, seqNum := defaultProvisioningExtensionName, 0
+	if settings.ExtensionName != nil && *settings.ExtensionName != "" {
+		extensionName = *settings.ExtensionName
+	}
+	if settings.SeqNo != nil {
+		seqNum = *settings.SeqNo
+	}
+	return hs, extensionName, seqNum, nil
+}
@@ -0,0 +1,45 @@
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseProvisionCmdOptions(t *testing.T) {
+	opts, err := ParseProvisionCmdOptions([]string{}, ioutil.Discard)
+	require.Nil(t, err)
+	require.Equal(t, constants.ProvisioningSettingsPath, opts.SettingsFile)
+	require.Equal(t, constants.ProvisioningStatusPath, opts.StatusFile)
+
+	opts, err = ParseProvisionCmdOptions([]string{"--settings", "rc.settings", "--status", "rc.status", "--extension", "setup"}, ioutil.Discard)
+	require.Nil(t, err)
+	require.Equal(t, ProvisionOptions{SettingsFile: "rc.settings", StatusFile: "rc.status", ExtensionName: "setup"}, opts)
+
+	_, err = ParseProvisionCmdOptions([]string{"extra"}, ioutil.Discard)
+	require.ErrorContains(t, err, "unexpected arguments")
+}
+
+func Test_readProvisioningSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "provisioning.settings")
+	require.Nil(t, os.WriteFile(path, []byte(`{"runtimeSettings": [{"handlerSettings": {"publicSettings": {"source": {"script": "echo hello"}}}}]}`), 0600))
+	hs, extensionName, seqNum, err := readProvisioningSettings(path)
+	require.Nil(t, err)
+	require.Equal(t, "provisioning", extensionName)
+	require.Equal(t, 0, seqNum)
+	require.Equal(t, map[string]interface{}{"script": "echo hello"}, hs.RuntimeSettings[0].HandlerSettings.PublicSettings["source"])
+
+	require.Nil(t, os.WriteFile(path, []byte(`{"runtimeSettings": [{"handlerSettings": {"extensionName": "setup", "seqNo": 2, "publicSettings": {}}}]}`), 0600))
+	_, extensionName, seqNum, err = readProvisioningSettings(path)
+	require.Nil(t, err)
+	require.Equal(t, "setup", extensionName)
+	require.Equal(t, 2, seqNum)
+
+	require.Nil(t, os.WriteFile(path, []byte(`{"runtimeSettings": []}`), 0600))
+	_, _, _, err = readProvisioningSettings(path)
+	require.ErrorContains(t, err, "expected 1 runtimeSettings")
+}
@@ -0,0 +1,46 @@
+//go:build !slim
+
+package commands
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/Azure/run-command-handler-linux/internal/service"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// ServiceCmd is an operator facing subcommand to manage the managed run command service directly.
+// Unlike Cmds, these do not require the HandlerEnvironment and never report status.
+type ServiceCmd struct {
+	Name   string
+	Invoke func(ctx *log.Context, opts service.Options) error
+}
+
+var (
+	ServiceCmds = map[string]ServiceCmd{
+		"install-service":   {Name: "InstallService", Invoke: service.RegisterWithOptions},
+		"uninstall-service": {Name: "UninstallService", Invoke: service.DeRegisterWithOptions},
+	}
+)
+
+// ParseServiceCmdOptions parses the flags accepted by the service subcommands
+func ParseServiceCmdOptions(op string, args []string, output io.Writer) (service.Options, error) {
+	var opts service.Options
+	flags := flag.NewFlagSet(op, flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "print the actions without applying them")
+	flags.StringVar(&opts.UnitPath, "unit-path", "", "directory where the systemd unit configuration file is written")
+
+	if err := flags.Parse(args); err != nil {
+		return opts, errors.Wrapf(err, "failed to parse arguments for %s", op)
+	}
+
+	if flags.NArg() > 0 {
+		return opts, fmt.Errorf("unexpected arguments for %s: %v", op, flags.Args())
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,29 @@
+//go:build slim
+
+package commands
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/go-kit/kit/log"
+)
+
+// serviceOptions is empty since the slim handler is built without the run command service
+type serviceOptions struct{}
+
+// ServiceCmd is an operator facing subcommand to manage the managed run command service directly.
+// The slim handler has none.
+type ServiceCmd struct {
+	Name   string
+	Invoke func(ctx *log.Context, opts serviceOptions) error
+}
+
+var (
+	ServiceCmds = map[string]ServiceCmd{}
+)
+
+// ParseServiceCmdOptions always fails since the slim handler has no service subcommands
+func ParseServiceCmdOptions(op string, args []string, output io.Writer) (serviceOptions, error) {
+	return serviceOptions{}, fmt.Errorf("%s is not supported by this build of the handler", op)
+}
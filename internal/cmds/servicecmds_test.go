@@ -0,0 +1,35 @@
+//go:build !slim
+
+package commands
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_serviceCommandsExist(t *testing.T) {
+	for _, c := range []string{"install-service", "uninstall-service"} {
+		_, ok := ServiceCmds[c]
+		require.True(t, ok, "cmd '%s' is not handled", c)
+	}
+}
+
+func Test_ParseServiceCmdOptions(t *testing.T) {
+	opts, err := ParseServiceCmdOptions("install-service", []string{}, ioutil.Discard)
+	require.Nil(t, err)
+	require.False(t, opts.DryRun)
+	require.Empty(t, opts.UnitPath)
+
+	opts, err = ParseServiceCmdOptions("install-service", []string{"--dry-run", "--unit-path", "/tmp/units"}, ioutil.Discard)
+	require.Nil(t, err)
+	require.True(t, opts.DryRun)
+	require.Equal(t, "/tmp/units", opts.UnitPath)
+
+	_, err = ParseServiceCmdOptions("uninstall-service", []string{"--unknown"}, ioutil.Discard)
+	require.NotNil(t, err)
+
+	_, err = ParseServiceCmdOptions("uninstall-service", []string{"extra"}, ioutil.Discard)
+	require.ErrorContains(t, err, "unexpected arguments")
+}
@@ -0,0 +1,363 @@
+package commands
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/pid"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/Azure/run-command-handler-linux/pkg/versionutil"
+	"github.com/pkg/errors"
+)
+
+// Operator facing subcommands managing the state of the handler, e.g., before capturing an image of a configured VM
+const (
+	ExportStateCmdName = "export-state"
+	ImportStateCmdName = "import-state"
+	ResetStateCmdName  = "reset-state"
+)
+
+// maxStateFileSize bounds the files read from a state archive
+const maxStateFileSize = 16 * 1024 * 1024
+
+// StateOptions changes what the state subcommands do
+type StateOptions struct {
+	// File is the archive written by export-state and read by import-state
+	File string
+
+	// DryRun prints what reset-state would remove without removing it
+	DryRun bool
+
+	// ExtensionName restricts reset-state to the most recent sequence numbers of the extension, so the goal
+	// state already processed is executed again. Only used if SingleExtension is true, since the name of the
+	// single-config extension is empty.
+	ExtensionName   string
+	SingleExtension bool
+}
+
+// stateLocation is a directory holding state files of the handler
+type stateLocation struct {
+	// name prefixes the files of the location in the archive
+	name    string
+	dir     string
+	subdirs []string
+
+	// exported reports whether the file at the given path relative to dir is part of the exported state
+	exported func(relPath string) bool
+
+	// transient reports whether the file at the given path relative to dir is state that is removed by
+	// reset-state without being exported, e.g., the pid of a running execution
+	transient func(relPath string) bool
+}
+
+// ParseStateCmdOptions parses the flags accepted by the given state subcommand
+func ParseStateCmdOptions(op string, args []string, output io.Writer) (StateOptions, error) {
+	var opts StateOptions
+	flags := flag.NewFlagSet(op, flag.ContinueOnError)
+	flags.SetOutput(output)
+	switch op {
+	case ExportStateCmdName:
+		flags.StringVar(&opts.File, "file", "", "archive to write the state of the handler to")
+	case ImportStateCmdName:
+		flags.StringVar(&opts.File, "file", "", "archive written by "+ExportStateCmdName+" to restore the state of the handler from")
+	case ResetStateCmdName:
+		flags.BoolVar(&opts.DryRun, "dry-run", false, "print the files that would be removed without removing them")
+		flags.StringVar(&opts.ExtensionName, "extension", "", "only clear the most recent sequence numbers of the extension with this name (empty for single-config)")
+	default:
+		return opts, fmt.Errorf("unknown state command %s", op)
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return opts, errors.Wrapf(err, "failed to parse arguments for %s", op)
+	}
+
+	if flags.NArg() > 0 {
+		return opts, fmt.Errorf("unexpected arguments for %s: %v", op, flags.Args())
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "extension" {
+			opts.SingleExtension = true
+		}
+	})
+	if op != ResetStateCmdName && opts.File == "" {
+		return opts, fmt.Errorf("--file is required for %s", op)
+	}
+
+	return opts, nil
+}
+
+// State runs the given state subcommand, printing what it does to stdout
+func State(op string, opts StateOptions, stdout io.Writer) error {
+	hEnv, err := handlersettings.GetHandlerEnvWithFallback(constants.RunCommandHandlerName, versionutil.Version)
+	if err != nil {
+		return errors.Wrap(err, "could not get handler environment")
+	}
+	locations := getStateLocations(hEnv, constants.DataDir)
+
+	switch op {
+	case ExportStateCmdName:
+		f, err := os.OpenFile(opts.File, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return errors.Wrap(err, "failed to create state archive")
+		}
+		if err := exportState(locations, f, stdout); err != nil {
+			f.Close()
+			return err
+		}
+		return errors.Wrap(f.Close(), "failed to write state archive")
+	case ImportStateCmdName:
+		f, err := os.Open(opts.File)
+		if err != nil {
+			return errors.Wrap(err, "failed to open state archive")
+		}
+		defer f.Close()
+		return importState(locations, f, stdout)
+	case ResetStateCmdName:
+		if opts.SingleExtension {
+			return resetSequenceNumbers(locations[0].dir, constants.DataDir, opts.ExtensionName, opts.DryRun, stdout)
+		}
+		return resetState(locations, constants.DataDir, opts.DryRun, stdout)
+	}
+	return fmt.Errorf("unknown state command %s", op)
+}
+
+// getStateLocations returns where the handler keeps its state: the most recent sequence numbers of the standard
+// run commands (in the handler directory, their working directory) and of the immediate and provisioning ones, the
+// journal of the immediate goal states already executed, and the settings cached in the config folder
+func getStateLocations(hEnv types.HandlerEnvironment, dataDir string) []stateLocation {
+	isStateFile := func(relPath string) bool {
+		return !strings.Contains(relPath, "/") && strings.HasSuffix(relPath, ".mrseq")
+	}
+	isPidFile := func(relPath string) bool {
+		return !strings.Contains(relPath, "/") && strings.HasSuffix(relPath, ".pidstart")
+	}
+	dataSubdirs := []string{filepath.Clean(constants.ImmediateDownloadFolder), filepath.Clean(constants.ProvisioningDownloadFolder)}
+	inDataSubdir := func(relPath string, match func(string) bool) bool {
+		dir, file := path.Split(relPath)
+		for _, subdir := range dataSubdirs {
+			if path.Clean(dir) == subdir && match(file) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return []stateLocation{
+		{
+			name:      "handler",
+			dir:       filepath.Dir(hEnv.HandlerEnvironment.ConfigFolder),
+			exported:  isStateFile,
+			transient: isPidFile,
+		},
+		{
+			name: "config",
+			dir:  hEnv.HandlerEnvironment.ConfigFolder,
+			exported: func(relPath string) bool {
+				return !strings.Contains(relPath, "/") && strings.HasSuffix(relPath, constants.ConfigFileExtension)
+			},
+			transient: func(string) bool { return false },
+		},
+		{
+			name:    "data",
+			dir:     dataDir,
+			subdirs: dataSubdirs,
+			exported: func(relPath string) bool {
+				return relPath == constants.GoalStateJournalFileName || inDataSubdir(relPath, isStateFile)
+			},
+			transient: func(relPath string) bool {
+				return inDataSubdir(relPath, isPidFile)
+			},
+		},
+	}
+}
+
+// listStateFiles returns the paths relative to the location of the files matching the given filter. State
+// files are either at the top of the location or in its subdirectories listed in subdirs.
+func (l stateLocation) listStateFiles(match func(relPath string) bool) ([]string, error) {
+	var files []string
+	for _, subdir := range append([]string{""}, l.subdirs...) {
+		entries, err := os.ReadDir(filepath.Join(l.dir, subdir))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, errors.Wrapf(err, "failed to list the state files in %s", l.dir)
+		}
+		for _, e := range entries {
+			relPath := path.Join(subdir, e.Name())
+			if e.Type().IsRegular() && match(relPath) {
+				files = append(files, relPath)
+			}
+		}
+	}
+	return files, nil
+}
+
+// exportState writes the state files to w as a gzipped tar archive
+func exportState(locations []stateLocation, w io.Writer, stdout io.Writer) error {
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	for _, l := range locations {
+		files, err := l.listStateFiles(l.exported)
+		if err != nil {
+			return err
+		}
+		for _, relPath := range files {
+			content, err := os.ReadFile(filepath.Join(l.dir, relPath))
+			if err != nil {
+				return errors.Wrapf(err, "failed to read state file %s", relPath)
+			}
+			header := &tar.Header{Name: l.name + "/" + relPath, Mode: 0600, Size: int64(len(content)), Typeflag: tar.TypeReg}
+			if err := archive.WriteHeader(header); err != nil {
+				return errors.Wrap(err, "failed to write state archive")
+			}
+			if _, err := archive.Write(content); err != nil {
+				return errors.Wrap(err, "failed to write state archive")
+			}
+			fmt.Fprintf(stdout, "exported %s\n", filepath.Join(l.dir, relPath))
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return errors.Wrap(err, "failed to write state archive")
+	}
+	return errors.Wrap(gz.Close(), "failed to write state archive")
+}
+
+// importState restores the state files of an archive written by exportState. Files which are not state
+// files of a known location are rejected, so an archive cannot write anywhere else.
+func importState(locations []stateLocation, r io.Reader, stdout io.Writer) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return errors.Wrap(err, "invalid state archive")
+	}
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "invalid state archive")
+		}
+
+		path, err := resolveStateFile(locations, header.Name)
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg || header.Size > maxStateFileSize {
+			return errors.Errorf("invalid state file %s in state archive", header.Name)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return errors.Wrapf(err, "failed to create directory for state file %s", path)
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create state file %s", path)
+		}
+		_, err = io.Copy(f, io.LimitReader(archive, maxStateFileSize))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to write state file %s", path)
+		}
+		fmt.Fprintf(stdout, "imported %s\n", path)
+	}
+}
+
+// resolveStateFile returns the path where the file with the given name in a state archive is restored
+func resolveStateFile(locations []stateLocation, name string) (string, error) {
+	locationName, relPath, found := strings.Cut(name, "/")
+	if found && relPath == path.Clean(relPath) && !strings.HasPrefix(relPath, "../") {
+		for _, l := range locations {
+			if l.name == locationName && l.exported(relPath) {
+				return filepath.Join(l.dir, filepath.FromSlash(relPath)), nil
+			}
+		}
+	}
+	return "", errors.Errorf("unexpected file %s in state archive", name)
+}
+
+// resetState removes the state files, the executions (scripts, artifacts and output), the provisioning settings, the
+// execution queue and the readiness markers, so a VM created from an image captured afterwards starts like a new one:
+// it neither replays the sequence numbers already executed nor skips them, nor reports them as succeeded
+func resetState(locations []stateLocation, dataDir string, dryRun bool, stdout io.Writer) error {
+	var paths []string
+	for _, l := range locations {
+		files, err := l.listStateFiles(func(relPath string) bool { return l.exported(relPath) || l.transient(relPath) })
+		if err != nil {
+			return err
+		}
+		for _, relPath := range files {
+			paths = append(paths, filepath.Join(l.dir, relPath))
+		}
+	}
+	for _, dir := range []string{constants.DownloadFolder, constants.ImmediateDownloadFolder, constants.ProvisioningDownloadFolder, filepath.Base(constants.ProvisioningConfigDir), filepath.Base(constants.ExecutionQueueDir), filepath.Base(constants.ReadinessDir)} {
+		if _, err := os.Stat(filepath.Join(dataDir, dir)); err == nil {
+			paths = append(paths, filepath.Join(dataDir, dir))
+		}
+	}
+
+	for _, path := range paths {
+		if dryRun {
+			fmt.Fprintf(stdout, "would remove %s\n", path)
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return errors.Wrapf(err, "failed to remove %s", path)
+		}
+		fmt.Fprintf(stdout, "removed %s\n", path)
+	}
+	return nil
+}
+
+// resetSequenceNumbers removes the most recent sequence numbers of the standard and the immediate run command of
+// the extension, so the goal state the handler considers already processed is executed again. It fails if the
+// extension is executing, since the execution would save its sequence number again when it completes.
+func resetSequenceNumbers(handlerDir string, dataDir string, extensionName string, dryRun bool, stdout io.Writer) error {
+	var paths []string
+	for _, downloadFolder := range []string{constants.DownloadFolder, constants.ImmediateDownloadFolder, constants.ProvisioningDownloadFolder} {
+		// The standard run command keeps its state files in the handler directory, its working directory
+		pidFilePath := datapaths.PidFilePath(dataDir, downloadFolder, extensionName)
+		mrseqPath := datapaths.MostRecentSequencePath(dataDir, downloadFolder, extensionName)
+		if !filepath.IsAbs(mrseqPath) {
+			pidFilePath = filepath.Join(handlerDir, pidFilePath)
+			mrseqPath = filepath.Join(handlerDir, mrseqPath)
+		}
+
+		if pid.IsExtensionStillRunning(pidFilePath) {
+			return errors.Errorf("extension '%s' is executing. Retry once the execution completes", extensionName)
+		}
+		if _, err := os.Stat(mrseqPath); err == nil {
+			paths = append(paths, mrseqPath)
+		}
+	}
+
+	if len(paths) == 0 {
+		fmt.Fprintf(stdout, "no sequence number to clear for extension '%s'\n", extensionName)
+		return nil
+	}
+	for _, path := range paths {
+		if dryRun {
+			fmt.Fprintf(stdout, "would remove %s\n", path)
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return errors.Wrapf(err, "failed to remove %s", path)
+		}
+		fmt.Fprintf(stdout, "removed %s\n", path)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package commands
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/pid"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseStateCmdOptions(t *testing.T) {
+	opts, err := ParseStateCmdOptions(ExportStateCmdName, []string{"--file", "state.tar.gz"}, ioutil.Discard)
+	require.Nil(t, err)
+	require.Equal(t, "state.tar.gz", opts.File)
+
+	_, err = ParseStateCmdOptions(ImportStateCmdName, []string{}, ioutil.Discard)
+	require.ErrorContains(t, err, "--file is required")
+
+	opts, err = ParseStateCmdOptions(ResetStateCmdName, []string{"--dry-run"}, ioutil.Discard)
+	require.Nil(t, err)
+	require.True(t, opts.DryRun)
+
+	require.False(t, opts.SingleExtension)
+
+	opts, err = ParseStateCmdOptions(ResetStateCmdName, []string{"--extension", ""}, ioutil.Discard)
+	require.Nil(t, err)
+	require.True(t, opts.SingleExtension)
+	require.Empty(t, opts.ExtensionName)
+
+	_, err = ParseStateCmdOptions(ResetStateCmdName, []string{"--file", "state.tar.gz"}, ioutil.Discard)
+	require.NotNil(t, err)
+
+	_, err = ParseStateCmdOptions(ResetStateCmdName, []string{"extra"}, ioutil.Discard)
+	require.ErrorContains(t, err, "unexpected arguments")
+}
+
+// newTestStateLocations returns the state locations of a handler under a temporary directory, along with the
+// data directory
+func newTestStateLocations(t *testing.T) ([]stateLocation, string) {
+	root := t.TempDir()
+	var hEnv types.HandlerEnvironment
+	hEnv.HandlerEnvironment.ConfigFolder = filepath.Join(root, "handler", "config")
+	dataDir := filepath.Join(root, "data")
+	for _, dir := range []string{hEnv.HandlerEnvironment.ConfigFolder, filepath.Join(dataDir, constants.ImmediateDownloadFolder)} {
+		require.Nil(t, os.MkdirAll(dir, 0700))
+	}
+	return getStateLocations(hEnv, dataDir), dataDir
+}
+
+func writeTestFiles(t *testing.T, files map[string]string) {
+	for path, content := range files {
+		require.Nil(t, os.MkdirAll(filepath.Dir(path), 0700))
+		require.Nil(t, os.WriteFile(path, []byte(content), 0600))
+	}
+}
+
+func Test_exportImportState(t *testing.T) {
+	locations, dataDir := newTestStateLocations(t)
+	handlerDir, configDir := locations[0].dir, locations[1].dir
+	// The exported files by location index
+	state := []map[string]string{
+		{"rc1.mrseq": "3"},
+		{"rc1.0.settings": "{}"},
+		{constants.GoalStateJournalFileName: "journal", constants.ImmediateDownloadFolder + "rc2.mrseq": "7", constants.ProvisioningDownloadFolder + "provisioning.mrseq": "0"},
+	}
+	for i, files := range state {
+		for relPath, content := range files {
+			writeTestFiles(t, map[string]string{filepath.Join(locations[i].dir, relPath): content})
+		}
+	}
+	// Not part of the exported state
+	writeTestFiles(t, map[string]string{
+		filepath.Join(handlerDir, "rc1.pidstart"):                                 "123",
+		filepath.Join(handlerDir, "bin", "run-command-handler"):                   "binary",
+		filepath.Join(configDir, "HandlerState"):                                  "NotInstalled",
+		filepath.Join(dataDir, constants.DownloadFolder, "rc1", "0", "script.sh"): "echo",
+	})
+
+	var archive bytes.Buffer
+	require.Nil(t, exportState(locations, &archive, ioutil.Discard))
+
+	imported, _ := newTestStateLocations(t)
+	var output bytes.Buffer
+	require.Nil(t, importState(imported, &archive, &output))
+	require.Equal(t, 5, bytes.Count(output.Bytes(), []byte("imported ")))
+	for i, files := range state {
+		for relPath, content := range files {
+			b, err := os.ReadFile(filepath.Join(imported[i].dir, relPath))
+			require.Nil(t, err, "%s was not imported", relPath)
+			require.Equal(t, content, string(b))
+		}
+	}
+	require.NoFileExists(t, filepath.Join(imported[0].dir, "rc1.pidstart"))
+	require.NoFileExists(t, filepath.Join(imported[1].dir, "HandlerState"))
+}
+
+func Test_importState_rejectsUnexpectedFiles(t *testing.T) {
+	for _, name := range []string{"config/foo.txt", "data/../handler.mrseq", "handler/bin/run.mrseq", "unknown/rc1.mrseq", "rc1.mrseq"} {
+		var archive bytes.Buffer
+		gz := gzip.NewWriter(&archive)
+		w := tar.NewWriter(gz)
+		require.Nil(t, w.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: 1, Typeflag: tar.TypeReg}))
+		_, err := w.Write([]byte("1"))
+		require.Nil(t, err)
+		require.Nil(t, w.Close())
+		require.Nil(t, gz.Close())
+
+		locations, _ := newTestStateLocations(t)
+		err = importState(locations, &archive, ioutil.Discard)
+		require.ErrorContains(t, err, "unexpected file", name)
+	}
+}
+
+func Test_resetState(t *testing.T) {
+	locations, dataDir := newTestStateLocations(t)
+	handlerDir, configDir := locations[0].dir, locations[1].dir
+	removed := []string{
+		filepath.Join(handlerDir, "rc1.mrseq"),
+		filepath.Join(handlerDir, "rc1.pidstart"),
+		filepath.Join(configDir, "rc1.0.settings"),
+		filepath.Join(dataDir, constants.GoalStateJournalFileName),
+		filepath.Join(dataDir, constants.DownloadFolder, "rc1", "0", "script.sh"),
+		filepath.Join(dataDir, constants.ImmediateDownloadFolder, "rc2.mrseq"),
+		filepath.Join(dataDir, "executionqueue", "rc3.json"),
+		filepath.Join(dataDir, constants.ProvisioningDownloadFolder, "provisioning.mrseq"),
+		filepath.Join(dataDir, "provisioning", "provisioning.0.settings"),
+		filepath.Join(dataDir, "ready", "rc1.json"),
+	}
+	kept := []string{
+		filepath.Join(handlerDir, "bin", "run-command-handler"),
+		filepath.Join(configDir, "HandlerState"),
+	}
+	files := make(map[string]string)
+	for _, path := range append(removed, kept...) {
+		files[path] = "content"
+	}
+	writeTestFiles(t, files)
+
+	var output bytes.Buffer
+	require.Nil(t, resetState(locations, dataDir, true, &output))
+	require.Contains(t, output.String(), "would remove "+filepath.Join(handlerDir, "rc1.mrseq"))
+	for path := range files {
+		require.FileExists(t, path)
+	}
+
+	require.Nil(t, resetState(locations, dataDir, false, ioutil.Discard))
+	for _, path := range removed {
+		require.NoFileExists(t, path)
+	}
+	for _, path := range kept {
+		require.FileExists(t, path)
+	}
+}
+
+func Test_resetSequenceNumbers(t *testing.T) {
+	locations, dataDir := newTestStateLocations(t)
+	handlerDir := locations[0].dir
+	removed := []string{
+		filepath.Join(handlerDir, "rc1.mrseq"),
+		filepath.Join(dataDir, constants.ImmediateDownloadFolder, "rc1.mrseq"),
+	}
+	kept := []string{
+		filepath.Join(handlerDir, "rc2.mrseq"),
+		filepath.Join(dataDir, constants.ImmediateDownloadFolder, "rc2.mrseq"),
+		filepath.Join(dataDir, constants.DownloadFolder, "rc1", "0", "stdout"),
+	}
+	files := make(map[string]string)
+	for _, path := range append(removed, kept...) {
+		files[path] = "1"
+	}
+	writeTestFiles(t, files)
+
+	var output bytes.Buffer
+	require.Nil(t, resetSequenceNumbers(handlerDir, dataDir, "rc1", true, &output))
+	require.Contains(t, output.String(), "would remove "+removed[0])
+	require.FileExists(t, removed[0])
+
+	require.Nil(t, resetSequenceNumbers(handlerDir, dataDir, "rc1", false, ioutil.Discard))
+	for _, path := range removed {
+		require.NoFileExists(t, path)
+	}
+	for _, path := range kept {
+		require.FileExists(t, path)
+	}
+
+	output.Reset()
+	require.Nil(t, resetSequenceNumbers(handlerDir, dataDir, "rc1", false, &output))
+	require.Contains(t, output.String(), "no sequence number to clear")
+}
+
+func Test_resetSequenceNumbers_failsWhileExecuting(t *testing.T) {
+	locations, dataDir := newTestStateLocations(t)
+	handlerDir := locations[0].dir
+	mrseqPath := filepath.Join(handlerDir, "rc1.mrseq")
+	writeTestFiles(t, map[string]string{mrseqPath: "1"})
+	require.Nil(t, pid.SaveCurrentPidAndStartTime(filepath.Join(handlerDir, "rc1.pidstart")))
+
+	err := resetSequenceNumbers(handlerDir, dataDir, "rc1", false, ioutil.Discard)
+	require.ErrorContains(t, err, "is executing")
+	require.FileExists(t, mrseqPath)
+}
@@ -0,0 +1,52 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/clock"
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+)
+
+// startStatusUpdates calls update every interval of clk until the returned function is called. Stopping waits for
+// an update in progress to complete, so the final status is reported after the partial ones.
+func startStatusUpdates(clk clock.Clock, interval time.Duration, update func()) (stop func()) {
+	ticker := clk.NewTicker(interval)
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C():
+				update()
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		done <- true
+	}
+}
+
+// getStatusUpdateInterval returns how often the status of a running script is reported: the interval of the metadata
+// (set by the settings), else the one of the environment, else the default
+func getStatusUpdateInterval(ctx *log.Context, metadata types.RCMetadata) time.Duration {
+	if metadata.StatusUpdateInterval > 0 {
+		return metadata.StatusUpdateInterval
+	}
+	interval := updateStatusInSeconds
+	if value := os.Getenv(constants.StatusUpdateIntervalEnvName); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxUpdateStatusInSeconds {
+			ctx.Log("warning", fmt.Sprintf("invalid value %q for %v. Using default of %v", value, constants.StatusUpdateIntervalEnvName, updateStatusInSeconds))
+		} else {
+			interval = parsed
+		}
+	}
+	return time.Duration(interval) * time.Second
+}
@@ -0,0 +1,53 @@
+package commands
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/clock"
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_startStatusUpdates(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	updates := make(chan struct{}, 10)
+	stop := startStatusUpdates(clk, 30*time.Second, func() { updates <- struct{}{} })
+
+	clk.Advance(29 * time.Second)
+	requireNoUpdate(t, updates)
+	clk.Advance(time.Second)
+	<-updates
+	clk.Advance(30 * time.Second)
+	<-updates
+
+	stop()
+	clk.Advance(time.Minute)
+	requireNoUpdate(t, updates)
+}
+
+func requireNoUpdate(t *testing.T, updates <-chan struct{}) {
+	select {
+	case <-updates:
+		t.Fatal("unexpected status update")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func Test_getStatusUpdateInterval(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	var metadata types.RCMetadata
+	require.Equal(t, 30*time.Second, getStatusUpdateInterval(ctx, metadata))
+
+	t.Setenv(constants.StatusUpdateIntervalEnvName, "5")
+	require.Equal(t, 5*time.Second, getStatusUpdateInterval(ctx, metadata))
+
+	t.Setenv(constants.StatusUpdateIntervalEnvName, "3600")
+	require.Equal(t, 30*time.Second, getStatusUpdateInterval(ctx, metadata))
+
+	// The interval of the settings, passed with the metadata, takes precedence
+	metadata.StatusUpdateInterval = 100 * time.Millisecond
+	require.Equal(t, 100*time.Millisecond, getStatusUpdateInterval(ctx, metadata))
+}
@@ -0,0 +1,75 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/multistep"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const subStatusCodeStepCompleted = "StepCompleted"
+
+// rebootsSupported returns whether a script can reboot the VM, the immediate run command service resumes its
+// execution once the VM boots while the agent does not execute a sequence number twice
+func rebootsSupported(metadata types.RCMetadata, cfg *handlersettings.HandlerSettings) bool {
+	return cfg.PublicSettings.AllowReboot && strings.HasPrefix(metadata.DownloadDir, constants.ImmediateDownloadFolder)
+}
+
+// startStep loads the progress of an execution whose script can reboot the VM, reports its completed steps and
+// records the step the script executes
+func startStep(ctx *log.Context, dir string, metadata types.RCMetadata, report *types.RunCommandInstanceView) (multistep.Progress, error) {
+	progress, err := multistep.Load(metadata.ExtName, metadata.SeqNum, time.Now())
+	if err != nil {
+		return progress, err
+	}
+	if len(progress.Steps) > 0 {
+		ctx.Log("event", "resuming the execution after a reboot", "step", progress.Step())
+		report.StartTime = progress.StartedAt.Format(time.RFC3339)
+		for _, step := range progress.Steps {
+			report.SubStatuses = append(report.SubStatuses, stepSubStatus(step))
+		}
+	}
+	return progress, multistep.PrepareStep(dir, progress.Step())
+}
+
+// completeStep records the step as completed when the script requested a reboot, so the execution resumes once the
+// VM boots. The progress is removed once the last step completes or the script requests too many reboots.
+func completeStep(ctx *log.Context, dir string, metadata types.RCMetadata, cfg *handlersettings.HandlerSettings, progress multistep.Progress, stdout string, runErr error, exitCode int) (error, int) {
+	if !multistep.RebootRequested(dir, exitCode) {
+		if err := multistep.Remove(metadata.ExtName, metadata.SeqNum); err != nil {
+			ctx.Log("warning", "the progress of the completed execution is left behind", "error", err)
+		}
+		return runErr, exitCode
+	}
+
+	if len(progress.Steps) >= cfg.RebootLimit() {
+		if err := multistep.Remove(metadata.ExtName, metadata.SeqNum); err != nil {
+			ctx.Log("warning", "the progress of the failed execution is left behind", "error", err)
+		}
+		return errors.Errorf("step %d of the script requested a reboot, more than the %d reboots allowed by 'maxReboots'", progress.Step(), cfg.RebootLimit()),
+			constants.ExitCode_RebootLimitExceeded
+	}
+
+	step := progress.Step()
+	progress.Complete(exitCode, stdout, time.Now())
+	if err := multistep.Save(metadata.ExtName, metadata.SeqNum, progress); err != nil {
+		return errors.Wrap(err, "the script requested a reboot but its progress could not be saved"), exitCode
+	}
+	ctx.Log("event", "the script requested a reboot", "step", step, "exitCode", exitCode)
+	return multistep.RebootPendingError{Step: step}, exitCode
+}
+
+func stepSubStatus(step multistep.StepResult) types.InstanceViewSubStatus {
+	return types.InstanceViewSubStatus{
+		Name:    fmt.Sprintf("step%d", step.Step),
+		Code:    subStatusCodeStepCompleted,
+		Level:   types.SubStatusLevelInfo,
+		Message: fmt.Sprintf("Step %d exited with code %d and requested a reboot at %s. Output: %s", step.Step, step.ExitCode, step.CompletedAt.Format(time.RFC3339), step.Output),
+	}
+}
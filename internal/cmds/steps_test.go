@@ -0,0 +1,92 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/multistep"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryProgressStore keeps the progress of the executions in memory, as the journal of the service does
+type memoryProgressStore map[string]*multistep.Progress
+
+func (s memoryProgressStore) LoadProgress(extensionName string, seqNum int) (*multistep.Progress, error) {
+	return s[fmt.Sprintf("%s.%d", extensionName, seqNum)], nil
+}
+
+func (s memoryProgressStore) SaveProgress(extensionName string, seqNum int, p *multistep.Progress) error {
+	s[fmt.Sprintf("%s.%d", extensionName, seqNum)] = p
+	return nil
+}
+
+func Test_rebootsSupported(t *testing.T) {
+	cfg := handlersettings.HandlerSettings{PublicSettings: handlersettings.PublicSettings{AllowReboot: true}}
+	require.True(t, rebootsSupported(types.NewRCMetadata("RC0001", 1, constants.ImmediateDownloadFolder, constants.DataDir), &cfg))
+	require.False(t, rebootsSupported(types.NewRCMetadata("RC0001", 1, constants.DownloadFolder, constants.DataDir), &cfg),
+		"the agent does not resume an execution after a reboot")
+
+	cfg.PublicSettings.AllowReboot = false
+	require.False(t, rebootsSupported(types.NewRCMetadata("RC0001", 1, constants.ImmediateDownloadFolder, constants.DataDir), &cfg))
+}
+
+func Test_executionResumedAfterReboots(t *testing.T) {
+	multistep.UseStore(memoryProgressStore{})
+	defer multistep.UseStore(nil)
+	ctx := log.NewContext(log.NewNopLogger())
+	dataDir := t.TempDir()
+	metadata := types.NewRCMetadata("RC0001", 1, constants.ImmediateDownloadFolder, dataDir)
+	dir := t.TempDir()
+	cfg := handlersettings.HandlerSettings{PublicSettings: handlersettings.PublicSettings{AllowReboot: true, MaxReboots: 1}}
+
+	// The first step requests a reboot
+	var report types.RunCommandInstanceView
+	progress, err := startStep(ctx, dir, metadata, &report)
+	require.Nil(t, err)
+	require.Equal(t, 1, progress.Step())
+	err, exitCode := completeStep(ctx, dir, metadata, &cfg, progress, "step 1 done", errors.New("exit status 194"), constants.ScriptRebootExitCode)
+	pending, ok := multistep.IsRebootPending(err)
+	require.True(t, ok)
+	require.Equal(t, 1, pending.Step)
+	require.Equal(t, constants.ScriptRebootExitCode, exitCode)
+	require.True(t, multistep.Resuming(metadata.ExtName, 1))
+
+	// The second step completes, the first one is reported along with it
+	report = types.RunCommandInstanceView{}
+	progress, err = startStep(ctx, dir, metadata, &report)
+	require.Nil(t, err)
+	require.Equal(t, 2, progress.Step())
+	require.NotEmpty(t, report.StartTime)
+	require.Len(t, report.SubStatuses, 1)
+	require.Equal(t, "step1", report.SubStatuses[0].Name)
+	require.Contains(t, report.SubStatuses[0].Message, "step 1 done")
+
+	err, exitCode = completeStep(ctx, dir, metadata, &cfg, progress, "step 2 done", nil, 0)
+	require.Nil(t, err)
+	require.Equal(t, 0, exitCode)
+	require.False(t, multistep.Resuming(metadata.ExtName, 1), "the progress is removed once the execution completes")
+}
+
+func Test_executionFailsOnTooManyReboots(t *testing.T) {
+	multistep.UseStore(memoryProgressStore{})
+	defer multistep.UseStore(nil)
+	ctx := log.NewContext(log.NewNopLogger())
+	metadata := types.NewRCMetadata("RC0001", 1, constants.ImmediateDownloadFolder, t.TempDir())
+	dir := t.TempDir()
+	cfg := handlersettings.HandlerSettings{PublicSettings: handlersettings.PublicSettings{AllowReboot: true, MaxReboots: 1}}
+
+	progress, err := startStep(ctx, dir, metadata, &types.RunCommandInstanceView{})
+	require.Nil(t, err)
+	progress.Complete(constants.ScriptRebootExitCode, "", progress.StartedAt)
+	require.Nil(t, multistep.Save(metadata.ExtName, metadata.SeqNum, progress))
+
+	err, exitCode := completeStep(ctx, dir, metadata, &cfg, progress, "", errors.New("exit status 194"), constants.ScriptRebootExitCode)
+	require.EqualError(t, err, "step 2 of the script requested a reboot, more than the 1 reboots allowed by 'maxReboots'")
+	require.Equal(t, constants.ExitCode_RebootLimitExceeded, exitCode)
+	require.False(t, multistep.Resuming(metadata.ExtName, 1))
+}
@@ -0,0 +1,102 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// migrateStateFromPreviousVersion copies the state of the version being updated from, which lives in its own
+// handler directory, to the handler directory of this version. Without the most recent sequence numbers, the
+// new version would execute again the run commands already executed by the previous one. It returns the paths of
+// the files migrated, even on failure, so they can be rolled back.
+func migrateStateFromPreviousVersion(ctx *log.Context, h types.HandlerEnvironment) ([]string, error) {
+	previousVersion := os.Getenv(constants.UpdatingFromVersionEnvName)
+	if previousVersion == "" {
+		ctx.Log("message", "version being updated from is unknown, skipping state migration", "env", constants.UpdatingFromVersionEnvName)
+		return nil, nil
+	}
+
+	previousHandlerDir, err := getPreviousHandlerDir(filepath.Dir(h.HandlerEnvironment.ConfigFolder), previousVersion)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(previousHandlerDir); err != nil {
+		ctx.Log("warning", "handler directory of the previous version not found, skipping state migration", "path", previousHandlerDir)
+		return nil, nil
+	}
+
+	var previous types.HandlerEnvironment
+	previous.HandlerEnvironment.ConfigFolder = filepath.Join(previousHandlerDir, filepath.Base(h.HandlerEnvironment.ConfigFolder))
+	ctx.Log("event", "migrating state", "from", previousHandlerDir)
+	return migrateState(ctx, getStateLocations(previous, constants.DataDir), getStateLocations(h, constants.DataDir))
+}
+
+// getPreviousHandlerDir returns the handler directory of the given version, a sibling of the handler directory
+// of this version named after the handler and its version, e.g., Microsoft.CPlat.Core.RunCommandHandlerLinux-1.3.2
+func getPreviousHandlerDir(handlerDir string, previousVersion string) (string, error) {
+	handlerDirName := filepath.Base(handlerDir)
+	i := strings.LastIndex(handlerDirName, "-")
+	if i < 1 || strings.ContainsAny(previousVersion, "/\\") || previousVersion == "." || previousVersion == ".." {
+		return "", errors.Errorf("cannot locate the handler directory of version %q from %s", previousVersion, handlerDir)
+	}
+	return filepath.Join(filepath.Dir(handlerDir), handlerDirName[:i+1]+previousVersion), nil
+}
+
+// migrateState copies the exported state files of the previous locations to the locations with the same name and
+// returns the paths of the copies. Files already in the new locations are more recent, so they are kept.
+func migrateState(ctx *log.Context, previousLocations []stateLocation, locations []stateLocation) (migrated []string, _ error) {
+	for i, previous := range previousLocations {
+		l := locations[i]
+		if filepath.Clean(previous.dir) == filepath.Clean(l.dir) {
+			// e.g., the data directory, which is shared by all versions
+			continue
+		}
+
+		files, err := previous.listStateFiles(previous.exported)
+		if err != nil {
+			return migrated, err
+		}
+		for _, relPath := range files {
+			target := filepath.Join(l.dir, relPath)
+			if _, err := os.Stat(target); err == nil {
+				ctx.Log("message", "keeping state file of the new version", "path", target)
+				continue
+			}
+
+			content, err := os.ReadFile(filepath.Join(previous.dir, relPath))
+			if err != nil {
+				return migrated, errors.Wrapf(err, "failed to read state file %s", relPath)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return migrated, errors.Wrapf(err, "failed to create directory for state file %s", target)
+			}
+			// Recorded before writing, so a partially written file is rolled back too
+			migrated = append(migrated, target)
+			if err := os.WriteFile(target, content, 0600); err != nil {
+				return migrated, errors.Wrapf(err, "failed to write state file %s", target)
+			}
+			ctx.Log("event", "migrated state file", "path", target)
+		}
+	}
+	return migrated, nil
+}
+
+// rollbackMigratedState removes the files copied by migrateState. The state of the previous version is left
+// untouched by the migration, so removing the copies is enough to restore it, and a later update migrates it again
+// instead of keeping incomplete copies.
+func rollbackMigratedState(ctx *log.Context, migrated []string) {
+	for _, path := range migrated {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			ctx.Log("warning", "failed to roll back migrated state file", "path", path, "error", err)
+		}
+	}
+	if len(migrated) > 0 {
+		ctx.Log("event", "rolled back migrated state", "files", len(migrated))
+	}
+}
@@ -0,0 +1,76 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_getPreviousHandlerDir(t *testing.T) {
+	dir, err := getPreviousHandlerDir("/var/lib/waagent/Microsoft.CPlat.Core.RunCommandHandlerLinux-1.3.5", "1.3.2")
+	require.Nil(t, err)
+	require.Equal(t, "/var/lib/waagent/Microsoft.CPlat.Core.RunCommandHandlerLinux-1.3.2", dir)
+
+	for _, version := range []string{"../1.3.2", ".."} {
+		_, err = getPreviousHandlerDir("/var/lib/waagent/Microsoft.CPlat.Core.RunCommandHandlerLinux-1.3.5", version)
+		require.ErrorContains(t, err, "cannot locate the handler directory")
+	}
+
+	_, err = getPreviousHandlerDir("/var/lib/waagent/handler", "1.3.2")
+	require.ErrorContains(t, err, "cannot locate the handler directory")
+}
+
+func Test_migrateState(t *testing.T) {
+	root := t.TempDir()
+	dataDir := filepath.Join(root, "data")
+	newHandlerEnv := func(version string) types.HandlerEnvironment {
+		var h types.HandlerEnvironment
+		h.HandlerEnvironment.ConfigFolder = filepath.Join(root, "Microsoft.CPlat.Core.RunCommandHandlerLinux-"+version, "config")
+		return h
+	}
+	previous, current := getStateLocations(newHandlerEnv("1.3.2"), dataDir), getStateLocations(newHandlerEnv("1.3.5"), dataDir)
+	writeTestFiles(t, map[string]string{
+		filepath.Join(previous[0].dir, "rc1.mrseq"):           "3",
+		filepath.Join(previous[0].dir, "rc2.mrseq"):           "4",
+		filepath.Join(previous[0].dir, "rc1.pidstart"):        "123",
+		filepath.Join(previous[1].dir, "rc1.3.settings"):      "{}",
+		filepath.Join(current[0].dir, "rc2.mrseq"):            "5",
+		filepath.Join(dataDir, "immediateGoalStates.journal"): "journal",
+	})
+
+	migrated, err := migrateState(log.NewContext(log.NewNopLogger()), previous, current)
+	require.Nil(t, err)
+	require.ElementsMatch(t, []string{filepath.Join(current[0].dir, "rc1.mrseq"), filepath.Join(current[1].dir, "rc1.3.settings")}, migrated)
+
+	for path, content := range map[string]string{
+		filepath.Join(current[0].dir, "rc1.mrseq"):      "3",
+		filepath.Join(current[0].dir, "rc2.mrseq"):      "5",
+		filepath.Join(current[1].dir, "rc1.3.settings"): "{}",
+	} {
+		b, err := os.ReadFile(path)
+		require.Nil(t, err)
+		require.Equal(t, content, string(b))
+	}
+	require.NoFileExists(t, filepath.Join(current[0].dir, "rc1.pidstart"))
+
+	rollbackMigratedState(log.NewContext(log.NewNopLogger()), migrated)
+	for _, path := range migrated {
+		require.NoFileExists(t, path)
+	}
+	require.FileExists(t, filepath.Join(current[0].dir, "rc2.mrseq"))
+	require.FileExists(t, filepath.Join(previous[0].dir, "rc1.mrseq"))
+}
+
+func Test_migrateStateFromPreviousVersion_unknownVersion(t *testing.T) {
+	t.Setenv(constants.UpdatingFromVersionEnvName, "")
+	var h types.HandlerEnvironment
+	h.HandlerEnvironment.ConfigFolder = filepath.Join(t.TempDir(), "Microsoft.CPlat.Core.RunCommandHandlerLinux-1.3.5", "config")
+	migrated, err := migrateStateFromPreviousVersion(log.NewContext(log.NewNopLogger()), h)
+	require.Nil(t, err)
+	require.Empty(t, migrated)
+}
@@ -0,0 +1,112 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/files"
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/Azure/run-command-handler-linux/pkg/download"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// finding is the outcome of a check of the validate operation on a setting
+type finding struct {
+	setting string
+	issue   bool
+	message string
+}
+
+func (f finding) String() string {
+	level := "ok"
+	if f.issue {
+		level = "issue"
+	}
+	return fmt.Sprintf("%s: %s: %s", level, f.setting, f.message)
+}
+
+// validate checks the settings of the run command without executing anything, for the pipelines pre-flighting a
+// configuration: the settings are parsed and validated, the script and the artifacts are requested with HEAD only,
+// and the credentials the output blobs are written with are checked. The findings are reported as the output, and
+// the operation fails if any of them is an issue.
+func validate(ctx *log.Context, h types.HandlerEnvironment, report *types.RunCommandInstanceView, metadata types.RCMetadata, c types.Cmd) (string, string, error, int) {
+	cfg, err := handlersettings.GetHandlerSettings(h.HandlerEnvironment.ConfigFolder, metadata.ExtName, metadata.SeqNum, ctx)
+	if err != nil {
+		return "", "", errors.Wrap(err, "the settings are invalid"), constants.ExitCode_GetHandlerSettingsFailed
+	}
+
+	findings := validateSettings(ctx, &cfg, time.Now())
+	lines := make([]string, len(findings))
+	issues := 0
+	for i, f := range findings {
+		lines[i] = f.String()
+		if f.issue {
+			issues++
+		}
+	}
+	ctx.Log("event", "validated", "issues", issues)
+	output := strings.Join(lines, "\n") + "\n"
+	if issues > 0 {
+		return output, "", errors.Errorf("%d issues were found in the settings, see the output", issues), constants.ExitCode_ValidationFailed
+	}
+	return output, "", nil, constants.ExitCode_Okay
+}
+
+// validateSettings checks what the settings download and upload, as of now
+func validateSettings(ctx *log.Context, cfg *handlersettings.HandlerSettings, now time.Time) []finding {
+	findings := []finding{{setting: "settings", message: "the settings are valid"}}
+
+	if uri := cfg.ScriptURI(); uri != "" {
+		findings = append(findings, checkDownload(ctx, "source.scriptUri", uri, cfg.ScriptSAS(), cfg.SourceManagedIdentity, cfg))
+	}
+
+	artifacts, err := cfg.ReadArtifacts()
+	if err != nil {
+		findings = append(findings, finding{setting: "artifacts", issue: true, message: err.Error()})
+	}
+	for i := range artifacts {
+		setting := fmt.Sprintf("artifacts[%d]", artifacts[i].ArtifactId)
+		if artifacts[i].Mode == handlersettings.ArtifactModeSync {
+			findings = append(findings, finding{setting: setting, message: "synced from a container, not checked"})
+			continue
+		}
+		findings = append(findings, checkDownload(ctx, setting, artifacts[i].ArtifactUri, artifacts[i].ArtifactSasToken, artifacts[i].ArtifactManagedIdentity, cfg))
+	}
+
+	if cfg.OutputBlobURI != "" {
+		findings = append(findings, checkOutputBlob(ctx, "outputBlobUri", cfg.OutputBlobURI, cfg.ProtectedSettings.OutputBlobSASToken, cfg.ProtectedSettings.OutputBlobManagedIdentity, cfg, now))
+	}
+	if cfg.ErrorBlobURI != "" {
+		findings = append(findings, checkOutputBlob(ctx, "errorBlobUri", cfg.ErrorBlobURI, cfg.ProtectedSettings.ErrorBlobSASToken, cfg.ProtectedSettings.ErrorBlobManagedIdentity, cfg, now))
+	}
+	return findings
+}
+
+// checkDownload requests the file at uri with HEAD, with the credentials it is downloaded with
+func checkDownload(ctx *log.Context, setting, uri, sas string, mi *handlersettings.RunCommandManagedIdentity, cfg *handlersettings.HandlerSettings) finding {
+	if err := files.CheckReachable(ctx, uri, sas, mi, cfg.ProxyURL()); err != nil {
+		return finding{setting: setting, issue: true, message: fmt.Sprintf("%s is not reachable: %v. %s",
+			download.GetUriForLogging(uri), err, blobAccessGuidance(ctx, uri, mi, roleBlobReader))}
+	}
+	return finding{setting: setting, message: download.GetUriForLogging(uri) + " is reachable"}
+}
+
+// checkOutputBlob checks the credentials the blob at uri is written with: the expiry of its SAS token, or else the
+// managed identity getting a token for its storage account. The blob itself is not written.
+func checkOutputBlob(ctx *log.Context, setting, uri, sas string, mi *handlersettings.RunCommandManagedIdentity, cfg *handlersettings.HandlerSettings, now time.Time) finding {
+	if sas != "" {
+		if expiry, ok := download.SASExpiry(sas); ok && expiry.Before(now) && cfg.ProtectedSettings.BlobSASRenewal == nil {
+			return finding{setting: setting, issue: true, message: fmt.Sprintf("the SAS token of %s expired at %s", download.GetUriForLogging(uri), expiry.UTC().Format(time.RFC3339))}
+		}
+		return finding{setting: setting, message: download.GetUriForLogging(uri) + " is written with its SAS token"}
+	}
+	if !download.IsAzureStorageBlobUri(uri) {
+		return finding{setting: setting, issue: true, message: download.GetUriForLogging(uri) + " is not an Azure storage blob and has no SAS token"}
+	}
+	diagnosis := diagnoseIdentity(ctx, mi, download.GetResourceNameFromBlobUri(uri))
+	return finding{setting: setting, issue: !diagnosis.TokenAcquired, message: diagnosis.String(roleBlobContributor)}
+}
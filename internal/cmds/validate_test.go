@@ -0,0 +1,73 @@
+package commands
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/identitydiagnosis"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_validateSettings(t *testing.T) {
+	defer func(d func(*log.Context, *handlersettings.RunCommandManagedIdentity, string) identitydiagnosis.Diagnosis) {
+		diagnoseIdentity = d
+	}(diagnoseIdentity)
+	tokenAcquired := true
+	diagnoseIdentity = func(ctx *log.Context, mi *handlersettings.RunCommandManagedIdentity, resource string) identitydiagnosis.Diagnosis {
+		return identitydiagnosis.Diagnosis{Findings: []string{"system-assigned identity available (object id oid-1)"}, TokenAcquired: tokenAcquired}
+	}
+
+	var methods []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		if r.URL.Path != "/script.sh" && r.URL.Path != "/artifact.tar" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	ctx := log.NewContext(log.NewNopLogger())
+	now := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	cfg := handlersettings.HandlerSettings{
+		PublicSettings: handlersettings.PublicSettings{
+			Source: &handlersettings.ScriptSource{ScriptURI: srv.URL + "/script.sh"},
+			Artifacts: []handlersettings.PublicArtifactSource{
+				{ArtifactId: 1, ArtifactUri: srv.URL + "/artifact.tar"},
+				{ArtifactId: 2, ArtifactUri: srv.URL + "/missing.tar"},
+				{ArtifactId: 3, ArtifactUri: srv.URL + "/container/prefix", Mode: handlersettings.ArtifactModeSync},
+			},
+			OutputBlobURI: "https://account.blob.core.windows.net/output/stdout.txt",
+			ErrorBlobURI:  "https://account.blob.core.windows.net/output/stderr.txt",
+		},
+		ProtectedSettings: handlersettings.ProtectedSettings{
+			Artifacts:         []handlersettings.ProtectedArtifactSource{{ArtifactId: 1}, {ArtifactId: 2}, {ArtifactId: 3}},
+			ErrorBlobSASToken: "?sv=2020-08-04&se=2026-02-01T00:00:00Z&sig=abc",
+		},
+	}
+
+	findings := validateSettings(ctx, &cfg, now)
+	require.Len(t, findings, 7)
+	require.Equal(t, finding{setting: "settings", message: "the settings are valid"}, findings[0])
+	require.Equal(t, finding{setting: "source.scriptUri", message: srv.URL + "/script.sh is reachable"}, findings[1])
+	require.Equal(t, finding{setting: "artifacts[1]", message: srv.URL + "/artifact.tar is reachable"}, findings[2])
+	require.True(t, findings[3].issue)
+	require.Contains(t, findings[3].String(), "issue: artifacts[2]: "+srv.URL+"/missing.tar is not reachable")
+	require.Equal(t, finding{setting: "artifacts[3]", message: "synced from a container, not checked"}, findings[4])
+	require.False(t, findings[5].issue)
+	require.Contains(t, findings[5].message, "'Storage Blob Data Contributor' role assignment")
+	require.Equal(t, "issue: errorBlobUri: the SAS token of https://account.blob.core.windows.net/output/stderr.txt expired at 2026-02-01T00:00:00Z", findings[6].String())
+	for _, method := range methods {
+		require.Equal(t, http.MethodHead, method, "nothing is downloaded")
+	}
+
+	// The SAS token is renewed during the execution, and an identity without a token can't write the output
+	cfg.ProtectedSettings.BlobSASRenewal = &handlersettings.SASRenewal{URI: "https://renewal.contoso.com/token", Resource: "api://renewal"}
+	tokenAcquired = false
+	findings = validateSettings(ctx, &cfg, now)
+	require.True(t, findings[5].issue)
+	require.False(t, findings[6].issue)
+}
@@ -0,0 +1,75 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/exec"
+	"github.com/Azure/run-command-handler-linux/internal/files"
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/Azure/run-command-handler-linux/pkg/preprocess"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const subStatusCodeWhatIf = "WhatIf"
+
+// whatIf reports what would run instead of executing the script: the script, its hash, interpreter, user and
+// timeout, saved as the output of the script and reported as a substatus
+func whatIf(ctx *log.Context, scriptFilePath string, dir string, cfg *handlersettings.HandlerSettings, report *types.RunCommandInstanceView) (error, int) {
+	details := whatIfDetails(ctx, scriptFilePath, cfg, report.ScriptHash)
+	ctx.Log("event", "whatIf, the script is not executed", "details", strings.Join(details, ", "))
+
+	stdoutF, stderrF := exec.LogPaths(dir)
+	if err := os.WriteFile(stdoutF, []byte(strings.Join(details, "\n")+"\n"), 0600); err != nil {
+		return errors.Wrap(err, "failed to save what the script would run"), constants.ExitCode_OpenStdOutFileFailed
+	}
+	if err := os.WriteFile(stderrF, nil, 0600); err != nil {
+		return errors.Wrap(err, "failed to save what the script would run"), constants.ExitCode_OpenStdErrFileFailed
+	}
+
+	report.SubStatuses = append(report.SubStatuses, types.InstanceViewSubStatus{
+		Name:    "whatIf",
+		Code:    subStatusCodeWhatIf,
+		Level:   types.SubStatusLevelInfo,
+		Message: "The script was not executed (whatIf). It would run with " + strings.Join(details[1:], ", "),
+	})
+	return nil, constants.ExitCode_Okay
+}
+
+// whatIfDetails describes the script that would run, as "name: value" lines
+func whatIfDetails(ctx *log.Context, scriptFilePath string, cfg *handlersettings.HandlerSettings, scriptHash string) []string {
+	interpreter := files.DefaultInterpreter
+	if configured := cfg.CommandInterpreter(); configured != "" {
+		interpreter = configured + " (commandInterpreter)"
+	} else if b, err := os.ReadFile(scriptFilePath); err != nil {
+		ctx.Log("warning", "failed to read the interpreter of the script", "error", err)
+		interpreter = "unknown"
+	} else if shebang, ok := preprocess.Shebang(b); ok {
+		interpreter = shebang
+	}
+
+	user := "root"
+	if runAs := cfg.PublicSettings.RunAsUser; runAs != "" {
+		user = runAs
+		if cfg.PublicSettings.RunAsElevated {
+			user = fmt.Sprintf("root on behalf of %s", runAs)
+		}
+	}
+
+	timeout := "none"
+	if cfg.PublicSettings.TimeoutInSeconds > 0 {
+		timeout = fmt.Sprintf("%d seconds", cfg.PublicSettings.TimeoutInSeconds)
+	}
+
+	return []string{
+		"script: " + scriptFilePath,
+		"sha256: " + scriptHash,
+		"interpreter: " + interpreter,
+		"user: " + user,
+		"timeout: " + timeout,
+	}
+}
@@ -0,0 +1,68 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/exec"
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_whatIf(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	dir := t.TempDir()
+	scriptFilePath := filepath.Join(dir, "script.sh")
+	require.Nil(t, os.WriteFile(scriptFilePath, []byte("#!/usr/bin/env python3\nprint('hello')\n"), 0700))
+
+	cfg := &handlersettings.HandlerSettings{PublicSettings: handlersettings.PublicSettings{
+		RunAsUser: "azureuser", RunAsElevated: true, TimeoutInSeconds: 120,
+	}}
+	report := &types.RunCommandInstanceView{ScriptHash: "abc123"}
+	err, exitCode := whatIf(ctx, scriptFilePath, dir, cfg, report)
+	require.Nil(t, err)
+	require.Equal(t, constants.ExitCode_Okay, exitCode)
+
+	stdoutF, stderrF := exec.LogPaths(dir)
+	stdout, err := os.ReadFile(stdoutF)
+	require.Nil(t, err)
+	require.Equal(t, "script: "+scriptFilePath+"\n"+
+		"sha256: abc123\n"+
+		"interpreter: /usr/bin/env python3\n"+
+		"user: root on behalf of azureuser\n"+
+		"timeout: 120 seconds\n", string(stdout))
+	require.FileExists(t, stderrF)
+
+	require.Len(t, report.SubStatuses, 1)
+	require.Equal(t, subStatusCodeWhatIf, report.SubStatuses[0].Code)
+	require.Equal(t, "The script was not executed (whatIf). It would run with sha256: abc123, "+
+		"interpreter: /usr/bin/env python3, user: root on behalf of azureuser, timeout: 120 seconds", report.SubStatuses[0].Message)
+}
+
+func Test_whatIfDetails_defaults(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	scriptFilePath := filepath.Join(t.TempDir(), "script.sh")
+	require.Nil(t, os.WriteFile(scriptFilePath, []byte("date\n"), 0700))
+
+	details := whatIfDetails(ctx, scriptFilePath, &handlersettings.HandlerSettings{}, "")
+	require.Contains(t, details, "interpreter: /bin/bash")
+	require.Contains(t, details, "user: root")
+	require.Contains(t, details, "timeout: none")
+
+	details = whatIfDetails(ctx, filepath.Join(t.TempDir(), "missing.sh"), &handlersettings.HandlerSettings{}, "")
+	require.Contains(t, details, "interpreter: unknown")
+}
+
+func Test_whatIfDetails_commandInterpreter(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	scriptFilePath := filepath.Join(t.TempDir(), "script.sh")
+	require.Nil(t, os.WriteFile(scriptFilePath, []byte("#!/bin/sh\nprint('hello')\n"), 0700))
+
+	cfg := &handlersettings.HandlerSettings{PublicSettings: handlersettings.PublicSettings{CommandInterpreter: "python3"}}
+	details := whatIfDetails(ctx, scriptFilePath, cfg, "")
+	require.Contains(t, details, "interpreter: /usr/bin/env python3 (commandInterpreter)")
+}
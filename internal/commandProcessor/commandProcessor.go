@@ -9,10 +9,22 @@ import (
 	"time"
 
 	"github.com/Azure/azure-extension-platform/pkg/logging"
+	"github.com/Azure/run-command-handler-linux/internal/cleanup"
 	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/featureflags"
 	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/instancemetadata"
 	"github.com/Azure/run-command-handler-linux/internal/instanceview"
+	"github.com/Azure/run-command-handler-linux/internal/monitorevents"
+	"github.com/Azure/run-command-handler-linux/internal/multistep"
+	"github.com/Azure/run-command-handler-linux/internal/telemetry"
 	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/Azure/run-command-handler-linux/internal/versioncheck"
+	"github.com/Azure/run-command-handler-linux/internal/writablestate"
+	"github.com/Azure/run-command-handler-linux/pkg/atomicfile"
+	"github.com/Azure/run-command-handler-linux/pkg/logdedup"
+	"github.com/Azure/run-command-handler-linux/pkg/logsanitizer"
+	"github.com/Azure/run-command-handler-linux/pkg/requestheaders"
 	"github.com/Azure/run-command-handler-linux/pkg/seqnumutil"
 	"github.com/Azure/run-command-handler-linux/pkg/versionutil"
 	"github.com/go-kit/kit/log"
@@ -20,11 +32,12 @@ import (
 )
 
 func ProcessImmediateHandlerCommand(cmd types.Cmd, hs handlersettings.HandlerSettingsFile, extensionName string, seqNum int) error {
-	ctx := initializeLogger(cmd)
+	ctx, flushLogs := initializeLogger(cmd)
+	defer flushLogs()
 	ctx = ctx.With("extensionName", extensionName)
 	ctx.Log("event", "start")
 
-	hEnv, err := getHandlerEnv(ctx)
+	hEnv, err := getImmediateHandlerEnv(ctx)
 	if err != nil {
 		return errors.Wrap(err, "could not get handler environment")
 	}
@@ -43,16 +56,87 @@ func ProcessImmediateHandlerCommand(cmd types.Cmd, hs handlersettings.HandlerSet
 	return ProcessHandlerCommandWithDetails(ctx, cmd, hEnv, extensionName, seqNum, constants.ImmediateDownloadFolder)
 }
 
+// ReportImmediateExpired reports the immediate run command as expired without executing it, as it did not start
+// before its expiration time
+func ReportImmediateExpired(cmd types.Cmd, extensionName string, seqNum int, expiry time.Time) error {
+	ctx, flushLogs := initializeLogger(cmd)
+	defer flushLogs()
+	ctx = ctx.With("extensionName", extensionName)
+	hEnv, err := getImmediateHandlerEnv(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not get handler environment")
+	}
+
+	ctx.Log("event", "expired", "seqNum", seqNum, "expirationTime", expiry.UTC().Format(time.RFC3339))
+	now := time.Now().UTC().Format(time.RFC3339)
+	instView := types.RunCommandInstanceView{
+		ExecutionState:   types.Expired,
+		ExecutionMessage: fmt.Sprintf("Execution expired: the command did not start before its expiration time %s", expiry.UTC().Format(time.RFC3339)),
+		ExitCode:         constants.ExitCode_GoalStateExpired,
+		StartTime:        now,
+		EndTime:          now,
+	}
+	metadata := types.NewRCMetadata(extensionName, seqNum, constants.ImmediateDownloadFolder, constants.DataDir)
+	return instanceview.ReportInstanceView(ctx, hEnv, metadata, types.StatusSuccess, cmd, &instView)
+}
+
+// ProcessProvisioningCommand executes the given settings with cmd at provisioning time, before the agent runs. The
+// settings are kept in the provisioning config folder, so they neither need nor alter the handler environment of the
+// agent.
+func ProcessProvisioningCommand(cmd types.Cmd, hs handlersettings.HandlerSettingsFile, extensionName string, seqNum int) error {
+	ctx, flushLogs := initializeLogger(cmd)
+	defer flushLogs()
+	ctx = ctx.With("extensionName", extensionName)
+	defer flushTelemetry(ctx)
+	ctx.Log("event", "start provisioning")
+	if err := writablestate.Resolve(ctx); err != nil {
+		return errors.Wrap(err, "precondition failed")
+	}
+
+	var hEnv types.HandlerEnvironment
+	hEnv.Name = constants.RunCommandHandlerName
+	hEnv.HandlerEnvironment.ConfigFolder = constants.ProvisioningConfigDir
+	hEnv.HandlerEnvironment.StatusFolder = constants.ProvisioningConfigDir
+	if err := os.MkdirAll(hEnv.HandlerEnvironment.ConfigFolder, 0700); err != nil {
+		return errors.Wrap(err, "failed to create provisioning config folder")
+	}
+
+	err := executePreSteps(ctx, cmd, hEnv, extensionName, seqNum, constants.ProvisioningDownloadFolder)
+	if err != nil {
+		return errors.Wrap(err, "failed on pre steps")
+	}
+
+	err = storeConfigSettingsFileForLocalExecution(ctx, hs, hEnv, extensionName, seqNum)
+	if err != nil {
+		return errors.Wrap(err, "failed when trying to store handler settings locally")
+	}
+
+	return ProcessHandlerCommandWithDetails(ctx, cmd, hEnv, extensionName, seqNum, constants.ProvisioningDownloadFolder)
+}
+
 func ProcessHandlerCommand(cmd types.Cmd) error {
-	ctx := initializeLogger(cmd)
+	ctx, flushLogs := initializeLogger(cmd)
+	defer flushLogs()
+	ctx = ctx.With("operationId", requestheaders.InitializeFromEnvironment(ctx))
+	defer flushTelemetry(ctx)
 	ctx.Log("event", "start")
+	versioncheck.Report(ctx, versionutil.Version, telemetry.SendTelemetry(constants.RunCommandHandlerName, versionutil.Version))
+	cmd = applyStatusReportingOptIn(ctx, cmd)
+	stateErr := writablestate.Resolve(ctx)
+	if stateErr == nil {
+		cleanup.DeleteExpiredOutput(ctx, constants.DataDir, time.Now())
+	}
 
-	hEnv, extensionName, seqNum, err := getRequiredInitialVariables(ctx)
+	hEnv, extensionName, seqNum, err := getRequiredInitialVariables(ctx, cmd)
 	if err != nil {
 		return errors.Wrap(err, "could not get initial required variables")
 	}
 	ctx = ctx.With("extensionName", extensionName)
 
+	if stateErr != nil {
+		return reportPreconditionFailure(ctx, cmd, hEnv, extensionName, seqNum, stateErr)
+	}
+
 	err = executePreSteps(ctx, cmd, hEnv, extensionName, seqNum, constants.DownloadFolder)
 	if err != nil {
 		return errors.Wrap(err, "failed on pre steps")
@@ -63,6 +147,7 @@ func ProcessHandlerCommand(cmd types.Cmd) error {
 
 func ProcessHandlerCommandWithDetails(ctx *log.Context, cmd types.Cmd, hEnv types.HandlerEnvironment, extensionName string, seqNum int, downloadFolder string) error {
 	ctx.Log("message", fmt.Sprintf("processing command for extensionName: %v and seqNum: %v", extensionName, seqNum))
+	instancemetadata.Report(ctx)
 	instView := types.RunCommandInstanceView{
 		ExecutionState:   types.Running,
 		ExecutionMessage: "Execution in progress",
@@ -75,16 +160,35 @@ func ProcessHandlerCommandWithDetails(ctx *log.Context, cmd types.Cmd, hEnv type
 
 	metadata := types.NewRCMetadata(extensionName, seqNum, downloadFolder, constants.DataDir)
 	instanceview.ReportInstanceView(ctx, hEnv, metadata, types.StatusTransitioning, cmd, &instView)
+	completeOperationEvents := startOperationEvents(ctx, cmd, extensionName, seqNum)
 
 	// execute the subcommand
-	stdout, stderr, cmdInvokeError, exitCode := cmd.Functions.Invoke(ctx, hEnv, &instView, metadata, cmd)
+	deadline := operationDeadline(ctx, cmd, hEnv, extensionName, seqNum)
+	stdout, stderr, cmdInvokeError, exitCode := invokeWithDeadline(ctx, cmd, hEnv, &instView, metadata, deadline)
 
 	instView.Output = stdout
 	instView.Error = stderr
+	if pending, ok := multistep.IsRebootPending(cmdInvokeError); ok {
+		// The execution is still in progress, the service resumes it once the VM boots
+		ctx.Log("event", "reboot pending", "step", pending.Step)
+		instView.ExecutionMessage = "Execution in progress: " + pending.Error()
+		instView.ExitCode = exitCode
+		instanceview.ReportInstanceView(ctx, hEnv, metadata, types.StatusTransitioning, cmd, &instView)
+		completeOperationEvents(monitorevents.OutcomeRebootPending, exitCode, pending.Error())
+		return cmdInvokeError
+	}
 	if cmdInvokeError != nil {
 		ctx.Log("event", "failed to handle", "error", cmdInvokeError)
 		instView.ExecutionMessage = "Execution failed: " + cmdInvokeError.Error()
 		instView.ExecutionState = types.Failed
+		if _, ok := cmdInvokeError.(operationTimedOutError); ok || exitCode == constants.ExitCode_ScriptTimedOut {
+			instView.ExecutionMessage = "Execution timed out: " + cmdInvokeError.Error()
+			instView.ExecutionState = types.TimedOut
+		}
+		if exitCode == constants.ExitCode_ScriptCanceled {
+			instView.ExecutionMessage = "Execution canceled: " + cmdInvokeError.Error()
+			instView.ExecutionState = types.Canceled
+		}
 		instView.EndTime = time.Now().UTC().Format(time.RFC3339)
 		instView.ExitCode = exitCode
 		statusToReport := types.StatusSuccess
@@ -96,25 +200,56 @@ func ProcessHandlerCommandWithDetails(ctx *log.Context, cmd types.Cmd, hEnv type
 		}
 
 		instanceview.ReportInstanceView(ctx, hEnv, metadata, statusToReport, cmd, &instView)
+		completeOperationEvents(string(instView.ExecutionState), exitCode, cmdInvokeError.Error())
 		return errors.Wrapf(err, "command execution failed")
 	} else { // No error. Succeeded
 		instView.ExecutionMessage = "Execution completed"
 		instView.ExecutionState = types.Succeeded
 		instView.EndTime = time.Now().UTC().Format(time.RFC3339)
-		instView.ExitCode = constants.ExitCode_Okay
+		// Non-zero when the exit code of the script is mapped to a succeeded state
+		instView.ExitCode = exitCode
 	}
 
 	instanceview.ReportInstanceView(ctx, hEnv, metadata, types.StatusSuccess, cmd, &instView)
+	completeOperationEvents(string(instView.ExecutionState), exitCode, "")
 	ctx.Log("event", "end")
 
 	return nil
 }
 
-func getRequiredInitialVariables(ctx *log.Context) (types.HandlerEnvironment, string, int, error) {
+// startOperationEvents emits the started event of the operation to the syslog for the Azure Monitor Agent, when
+// enabled by the feature flag. The returned function emits its completed event.
+func startOperationEvents(ctx *log.Context, cmd types.Cmd, extensionName string, seqNum int) func(outcome string, exitCode int, message string) {
+	if !featureflags.Enabled(ctx, featureflags.MonitorEvents) {
+		return func(string, int, string) {}
+	}
+	operation := monitorevents.Start(ctx, requestheaders.OperationID(), cmd.Name, extensionName, seqNum)
+	return func(outcome string, exitCode int, message string) {
+		operation.Complete(ctx, outcome, exitCode, message)
+	}
+}
+
+// reportPreconditionFailure reports the command as failed without executing it, when the handler can't run on the VM
+func reportPreconditionFailure(ctx *log.Context, cmd types.Cmd, hEnv types.HandlerEnvironment, extensionName string, seqNum int, err error) error {
+	ctx.Log("event", "precondition failed", "error", err)
+	now := time.Now().UTC().Format(time.RFC3339)
+	instView := types.RunCommandInstanceView{
+		ExecutionState:   types.Failed,
+		ExecutionMessage: "Execution failed: " + err.Error(),
+		ExitCode:         constants.ExitCode_NoWritableStateDir,
+		StartTime:        now,
+		EndTime:          now,
+	}
+	metadata := types.NewRCMetadata(extensionName, seqNum, constants.DownloadFolder, constants.DataDir)
+	instanceview.ReportInstanceView(ctx, hEnv, metadata, types.StatusError, cmd, &instView)
+	return errors.Wrap(err, "precondition failed")
+}
+
+func getRequiredInitialVariables(ctx *log.Context, cmd types.Cmd) (types.HandlerEnvironment, string, int, error) {
 	var seqNum int
 	var extensionName string
 	ctx.Log("message", "getting required initial variables")
-	hEnv, err := getHandlerEnv(ctx)
+	hEnv, err := getHandlerEnv(ctx, cmd)
 	if err != nil {
 		return hEnv, extensionName, seqNum, errors.Wrap(err, "failed to parse handlerEnv")
 	}
@@ -133,7 +268,7 @@ func executePreSteps(ctx *log.Context, cmd types.Cmd, hEnv types.HandlerEnvironm
 	if cmd.Functions.Pre != nil {
 		ctx.Log("event", "pre-check")
 		metadata := types.NewRCMetadata(extensionName, seqNum, downloadFolder, constants.DataDir)
-		if err := cmd.Functions.Pre(ctx, hEnv, metadata, cmd); err != nil {
+		if err := executePreWithRecovery(ctx, cmd, hEnv, metadata); err != nil {
 			ctx.Log("event", "pre-check failed", "error", err)
 			return errors.Wrapf(err, "pre-check step failed")
 		}
@@ -142,19 +277,67 @@ func executePreSteps(ctx *log.Context, cmd types.Cmd, hEnv types.HandlerEnvironm
 	return nil
 }
 
-func initializeLogger(cmd types.Cmd) *log.Context {
+// applyStatusReportingOptIn enables status reporting for the given command when the machine opted in to
+// receive status for all the operations, not only the ones reporting status by design.
+func applyStatusReportingOptIn(ctx *log.Context, cmd types.Cmd) types.Cmd {
+	if cmd.ShouldReportStatus {
+		return cmd
+	}
+
+	optIn, err := strconv.ParseBool(os.Getenv(constants.ReportStatusForAllOperationsEnvName))
+	if err == nil && optIn {
+		ctx.Log("message", fmt.Sprintf("%v is set. Status will be reported for this operation", constants.ReportStatusForAllOperationsEnvName))
+		cmd.ShouldReportStatus = true
+	}
+
+	return cmd
+}
+
+// initializeLogger returns the logger of the operation, and a function writing the summaries of the duplicate
+// warnings and errors it suppressed, to call once the operation completes
+func initializeLogger(cmd types.Cmd) (*log.Context, func()) {
 	logging.New(nil)
-	ctx := log.NewContext(log.NewSyncLogger(log.NewLogfmtLogger(
-		os.Stdout))).With("time", log.DefaultTimestamp).With("version", versionutil.VersionString())
+	dedup := logdedup.NewLogger(logsanitizer.NewLogger(log.NewSyncLogger(log.NewLogfmtLogger(os.Stdout))), logdedup.DefaultWindow)
+	ctx := log.NewContext(dedup).With("time", log.DefaultTimestamp).With("version", versionutil.VersionString())
 	ctx = ctx.With("operation", strings.ToLower(cmd.Name))
-	return ctx
+	return ctx, dedup.Flush
 }
 
-func getHandlerEnv(ctx *log.Context) (types.HandlerEnvironment, error) {
+// flushTelemetry writes the telemetry events still queued, as the handler exits once the operation completes
+func flushTelemetry(ctx *log.Context) {
+	if err := telemetry.Flush(telemetry.FlushTimeout); err != nil {
+		ctx.Log("warning", "some telemetry events may be lost", "error", err)
+	}
+}
+
+func getHandlerEnv(ctx *log.Context, cmd types.Cmd) (types.HandlerEnvironment, error) {
 	// parse extension handler environment
 	hEnv, err := handlersettings.GetHandlerEnv()
 	if err != nil {
 		ctx.Log("message", "failed to parse handlerEnv", "error", err)
+		return hEnv, toleratedHandlerEnvError(ctx, cmd, err)
+	}
+	return hEnv, nil
+}
+
+// toleratedHandlerEnvError returns nil if the operation proceeds despite err, as disabling or uninstalling the
+// extension must not be blocked by the problems of its folders
+func toleratedHandlerEnvError(ctx *log.Context, cmd types.Cmd, err error) error {
+	var invalid *handlersettings.HandlerEnvError
+	if cmd.Name != types.CmdDisableTemplate.Name && cmd.Name != types.CmdUninstallTemplate.Name || !errors.As(err, &invalid) || invalid.Path == "" {
+		return err
+	}
+	ctx.Log("warning", fmt.Sprintf("the folders of the handler environment are invalid, the %s operation proceeds anyway", strings.ToLower(cmd.Name)), "error", err)
+	return nil
+}
+
+// getImmediateHandlerEnv returns the handler environment for immediate run commands. The service may run
+// standalone without HandlerEnvironment.json, in which case the agent's default layout is assumed for the
+// name and version of the handler.
+func getImmediateHandlerEnv(ctx *log.Context) (types.HandlerEnvironment, error) {
+	hEnv, err := handlersettings.GetHandlerEnvWithFallback(constants.RunCommandHandlerName, versionutil.Version)
+	if err != nil {
+		ctx.Log("message", "failed to get handlerEnv", "error", err)
 		return hEnv, err
 	}
 	return hEnv, nil
@@ -205,7 +388,7 @@ func storeConfigSettingsFileForLocalExecution(ctx *log.Context, hs handlersettin
 		return errors.Wrap(err, "could not marshal handler settings file")
 	}
 
-	err = os.WriteFile(configFilePath, content, 0644)
+	err = atomicfile.WriteFile(configFilePath, content, 0644)
 	if err != nil {
 		return errors.Wrap(err, "could not store handler settings file locally to run the command")
 	}
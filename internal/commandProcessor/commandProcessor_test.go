@@ -36,7 +36,7 @@ func Test_InitializeLogger(t *testing.T) {
 
 func Test_ExecutePreStepsNilPreFunction(t *testing.T) {
 	cmd := types.CmdEnableTemplate.InitializeFunctions(types.CmdFunctions{Invoke: nil, Pre: nil, ReportStatus: status.ReportStatusToLocalFile, Cleanup: cleanup.RunCommandCleanup})
-	ctx := initializeLogger(cmd)
+	ctx, _ := initializeLogger(cmd)
 	extName, seqNum := "testExtension", 5
 	fakeEnv := types.HandlerEnvironment{}
 
@@ -46,7 +46,7 @@ func Test_ExecutePreStepsNilPreFunction(t *testing.T) {
 
 func Test_ExecutePreSteps(t *testing.T) {
 	cmd := types.CmdEnableTemplate.InitializeFunctions(types.CmdFunctions{Invoke: nil, Pre: enablePreSuccess, ReportStatus: status.ReportStatusToLocalFile, Cleanup: cleanup.RunCommandCleanup})
-	ctx := initializeLogger(cmd)
+	ctx, _ := initializeLogger(cmd)
 	extName, seqNum := "testExtension", 5
 	fakeEnv := types.HandlerEnvironment{}
 
@@ -56,7 +56,7 @@ func Test_ExecutePreSteps(t *testing.T) {
 
 func Test_ExecutePreStepsAndFailed(t *testing.T) {
 	cmd := types.CmdEnableTemplate.InitializeFunctions(types.CmdFunctions{Invoke: nil, Pre: enablePreThrowError, ReportStatus: status.ReportStatusToLocalFile, Cleanup: cleanup.RunCommandCleanup})
-	ctx := initializeLogger(cmd)
+	ctx, _ := initializeLogger(cmd)
 	extName, seqNum := "testExtension", 5
 	fakeEnv := types.HandlerEnvironment{}
 
@@ -190,3 +190,33 @@ func Test_GetSeqNumFromFailedToFind(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, 0, actualSeqNum)
 }
+
+func Test_ApplyStatusReportingOptIn(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	defer os.Unsetenv(constants.ReportStatusForAllOperationsEnvName)
+
+	os.Unsetenv(constants.ReportStatusForAllOperationsEnvName)
+	require.False(t, applyStatusReportingOptIn(ctx, types.CmdInstallTemplate).ShouldReportStatus)
+
+	os.Setenv(constants.ReportStatusForAllOperationsEnvName, "notabool")
+	require.False(t, applyStatusReportingOptIn(ctx, types.CmdUninstallTemplate).ShouldReportStatus)
+
+	os.Setenv(constants.ReportStatusForAllOperationsEnvName, "true")
+	require.True(t, applyStatusReportingOptIn(ctx, types.CmdInstallTemplate).ShouldReportStatus)
+	require.True(t, applyStatusReportingOptIn(ctx, types.CmdUninstallTemplate).ShouldReportStatus)
+	require.True(t, applyStatusReportingOptIn(ctx, types.CmdEnableTemplate).ShouldReportStatus)
+
+	// Templates are not modified
+	require.False(t, types.CmdInstallTemplate.ShouldReportStatus)
+}
+
+func Test_ToleratedHandlerEnvError(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	invalidFolders := &handlersettings.HandlerEnvError{Path: "/var/lib/waagent/ext/HandlerEnvironment.json", Problems: []string{"statusFolder is not writable"}}
+	notFound := &handlersettings.HandlerEnvError{Searched: []handlersettings.SearchedPath{{Path: "/var/lib/waagent/ext/HandlerEnvironment.json", Result: "not found"}}}
+
+	require.Nil(t, toleratedHandlerEnvError(ctx, types.CmdUninstallTemplate, invalidFolders))
+	require.Nil(t, toleratedHandlerEnvError(ctx, types.CmdDisableTemplate, fmt.Errorf("wrapped: %w", invalidFolders)))
+	require.Equal(t, invalidFolders, toleratedHandlerEnvError(ctx, types.CmdEnableTemplate, invalidFolders))
+	require.Equal(t, notFound, toleratedHandlerEnvError(ctx, types.CmdUninstallTemplate, notFound), "the handler environment is still required")
+}
@@ -0,0 +1,95 @@
+package commandProcessor
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
+	"github.com/Azure/run-command-handler-linux/internal/exec"
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+)
+
+// operationDeadlineGracePeriod is added to the timeout of the script to download it, wait for an execution slot
+// and upload its output
+const operationDeadlineGracePeriod = 30 * time.Minute
+
+// abandonTimeout bounds how long a timed out invocation is waited for once its script is killed, e.g., while it
+// uploads the output of the script
+var abandonTimeout = 30 * time.Second
+
+// operationTimedOutError is returned when the command does not complete before its deadline
+type operationTimedOutError struct {
+	name     string
+	deadline time.Duration
+}
+
+func (e operationTimedOutError) Error() string {
+	return fmt.Sprintf("the %s operation did not complete within %v", e.name, e.deadline)
+}
+
+// operationDeadline returns the time the command has to complete: its default deadline or, for Enable, the timeout
+// of the script plus a grace period when longer. Zero means the command has no deadline.
+func operationDeadline(ctx *log.Context, cmd types.Cmd, hEnv types.HandlerEnvironment, extensionName string, seqNum int) time.Duration {
+	deadline := cmd.Deadline
+	if cmd.Name != types.CmdEnableTemplate.Name {
+		return deadline
+	}
+
+	cfg, err := handlersettings.GetHandlerSettings(hEnv.HandlerEnvironment.ConfigFolder, extensionName, seqNum, ctx)
+	if err != nil || cfg.PublicSettings.TimeoutInSeconds <= 0 {
+		return deadline
+	}
+	if scriptDeadline := time.Duration(cfg.PublicSettings.TimeoutInSeconds)*time.Second + operationDeadlineGracePeriod; scriptDeadline > deadline {
+		deadline = scriptDeadline
+	}
+	return deadline
+}
+
+// invokeWithDeadline calls the invoke function of the command bounded by the given deadline, so a stuck dependency
+// can't hang the whole operation. When the deadline is exceeded, the script of the command and its processes are
+// killed and the invocation is waited for up to abandonTimeout: its changes to the instance view are discarded. The
+// files of an invocation still running after that are left as they are, as it may still write them and it holds
+// the execution lock until it returns.
+func invokeWithDeadline(ctx *log.Context, cmd types.Cmd, hEnv types.HandlerEnvironment, instView *types.RunCommandInstanceView, metadata types.RCMetadata, deadline time.Duration) (string, string, error, int) {
+	if deadline <= 0 {
+		return invokeWithRecovery(ctx, cmd, hEnv, instView, metadata)
+	}
+
+	type result struct {
+		stdout, stderr string
+		err            error
+		exitCode       int
+		report         types.RunCommandInstanceView
+	}
+	done := make(chan result, 1)
+	go func() {
+		r := result{report: *instView}
+		r.stdout, r.stderr, r.err, r.exitCode = invokeWithRecovery(ctx, cmd, hEnv, &r.report, metadata)
+		done <- r
+	}()
+
+	deadlineCtx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+
+	select {
+	case r := <-done:
+		*instView = r.report
+		return r.stdout, r.stderr, r.err, r.exitCode
+	case <-deadlineCtx.Done():
+		ctx.Log("event", "operation deadline exceeded", "operation", cmd.Name, "deadline", deadline)
+		exec.KillRunningScript(ctx, datapaths.SeqNumDir(metadata.DownloadPath, metadata.SeqNum))
+		select {
+		case <-done:
+			if cmd.Functions.Cleanup != nil {
+				cmd.Functions.Cleanup(ctx, metadata, hEnv, "")
+			}
+		case <-time.After(abandonTimeout):
+			ctx.Log("warning", "the timed out operation is abandoned, its files are left behind", "operation", cmd.Name)
+		}
+		return "", "", operationTimedOutError{name: cmd.Name, deadline: deadline}, constants.ExitCode_OperationTimedOut
+	}
+}
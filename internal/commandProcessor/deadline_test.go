@@ -0,0 +1,106 @@
+package commandProcessor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/status"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func invokeHangs(ctx *log.Context, h types.HandlerEnvironment, report *types.RunCommandInstanceView, metadata types.RCMetadata, c types.Cmd) (string, string, error, int) {
+	report.ExecutionMessage = "changed by an abandoned invocation"
+	select {}
+}
+
+func invokeSucceeds(ctx *log.Context, h types.HandlerEnvironment, report *types.RunCommandInstanceView, metadata types.RCMetadata, c types.Cmd) (string, string, error, int) {
+	report.ScriptHash = "hash"
+	return "output", "", nil, constants.ExitCode_Okay
+}
+
+func invokeSlow(ctx *log.Context, h types.HandlerEnvironment, report *types.RunCommandInstanceView, metadata types.RCMetadata, c types.Cmd) (string, string, error, int) {
+	time.Sleep(50 * time.Millisecond)
+	report.ExecutionMessage = "changed by a timed out invocation"
+	return "", "", nil, constants.ExitCode_Okay
+}
+
+func Test_invokeWithDeadline(t *testing.T) {
+	defer func(timeout time.Duration) { abandonTimeout = timeout }(abandonTimeout)
+	abandonTimeout = 100 * time.Millisecond
+	ctx := log.NewContext(log.NewNopLogger())
+	metadata := types.NewRCMetadata("testExtension", 1, constants.DownloadFolder, t.TempDir())
+
+	cmd := types.CmdDisableTemplate.InitializeFunctions(types.CmdFunctions{Invoke: invokeSucceeds})
+	var instView types.RunCommandInstanceView
+	stdout, _, err, exitCode := invokeWithDeadline(ctx, cmd, types.HandlerEnvironment{}, &instView, metadata, time.Minute)
+	require.Nil(t, err)
+	require.Equal(t, "output", stdout)
+	require.Equal(t, constants.ExitCode_Okay, exitCode)
+	require.Equal(t, "hash", instView.ScriptHash)
+
+	cleanedUp := false
+	cleanup := func(ctx *log.Context, metadata types.RCMetadata, h types.HandlerEnvironment, runAsUser string) {
+		cleanedUp = true
+	}
+
+	// The invocation returning once timed out is cleaned up
+	cmd = types.CmdDisableTemplate.InitializeFunctions(types.CmdFunctions{Invoke: invokeSlow, Cleanup: cleanup})
+	instView = types.RunCommandInstanceView{}
+	_, _, err, exitCode = invokeWithDeadline(ctx, cmd, types.HandlerEnvironment{}, &instView, metadata, 10*time.Millisecond)
+	require.ErrorContains(t, err, "the Disable operation did not complete within 10ms")
+	require.Equal(t, constants.ExitCode_OperationTimedOut, exitCode)
+	require.Empty(t, instView.ExecutionMessage)
+	require.True(t, cleanedUp)
+
+	// The files of an abandoned invocation are left as they are
+	cleanedUp = false
+	cmd = types.CmdDisableTemplate.InitializeFunctions(types.CmdFunctions{Invoke: invokeHangs, Cleanup: cleanup})
+	instView = types.RunCommandInstanceView{}
+	_, _, err, exitCode = invokeWithDeadline(ctx, cmd, types.HandlerEnvironment{}, &instView, metadata, 10*time.Millisecond)
+	require.ErrorContains(t, err, "the Disable operation did not complete within 10ms")
+	require.Equal(t, constants.ExitCode_OperationTimedOut, exitCode)
+	require.Empty(t, instView.ExecutionMessage)
+	require.False(t, cleanedUp)
+}
+
+func Test_operationDeadline(t *testing.T) {
+	defer func(dir string) { constants.SettingsSnapshotDir = dir }(constants.SettingsSnapshotDir)
+	constants.SettingsSnapshotDir = t.TempDir()
+	ctx := log.NewContext(log.NewNopLogger())
+	configFolder := t.TempDir()
+	var hEnv types.HandlerEnvironment
+	hEnv.HandlerEnvironment.ConfigFolder = configFolder
+
+	require.Equal(t, 5*time.Minute, operationDeadline(ctx, types.CmdInstallTemplate, hEnv, "testExtension", 0))
+	require.Equal(t, time.Duration(0), operationDeadline(ctx, types.CmdRunServiceTemplate, hEnv, "testExtension", 0))
+
+	// Enable has no deadline unless the script has a timeout
+	require.Equal(t, time.Duration(0), operationDeadline(ctx, types.CmdEnableTemplate, hEnv, "testExtension", 0))
+
+	settings := `{"runtimeSettings": [{"handlerSettings": {"publicSettings": {"source": {"script": "date"}, "timeoutInSeconds": 3600}}}]}`
+	require.Nil(t, os.WriteFile(filepath.Join(configFolder, "testExtension.1.settings"), []byte(settings), 0600))
+	require.Equal(t, time.Hour+operationDeadlineGracePeriod, operationDeadline(ctx, types.CmdEnableTemplate, hEnv, "testExtension", 1))
+}
+
+func Test_ProcessHandlerCommandReportsTimedOutStatus(t *testing.T) {
+	defer func(timeout time.Duration) { abandonTimeout = timeout }(abandonTimeout)
+	abandonTimeout = 10 * time.Millisecond
+	tmpDir := t.TempDir()
+	cmd := types.CmdEnableTemplate.InitializeFunctions(types.CmdFunctions{Invoke: invokeHangs, ReportStatus: status.ReportStatusToLocalFile})
+	cmd.Deadline = 10 * time.Millisecond
+	fakeEnv := types.HandlerEnvironment{}
+	fakeEnv.HandlerEnvironment.StatusFolder = tmpDir
+	fakeEnv.HandlerEnvironment.ConfigFolder = tmpDir
+
+	ProcessHandlerCommandWithDetails(log.NewContext(log.NewNopLogger()), cmd, fakeEnv, "testExtension", 3, constants.DownloadFolder)
+
+	b, err := os.ReadFile(filepath.Join(tmpDir, "testExtension.3.status"))
+	require.Nil(t, err)
+	require.Contains(t, string(b), types.TimedOut)
+	require.Contains(t, string(b), "the Enable operation did not complete within 10ms")
+}
@@ -0,0 +1,60 @@
+package commandProcessor
+
+import (
+	"fmt"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// Message reported in the status when the handler panics. Details are only written to the log.
+const panicStatusMessage = "the handler encountered an internal error. See the handler logs for more details"
+
+// Function arguments in a stack trace are raw memory values that could point to secrets, so they are stripped
+var stackTraceArgumentsRegex = regexp.MustCompile(`\(((0x[0-9a-f]+|\.\.\.|\{[^)]*\})(, )?)+\)`)
+
+// invokeWithRecovery calls the invoke function of the command and converts any panic into a failed result
+// so the handler always reaches the point where the status is written.
+func invokeWithRecovery(ctx *log.Context, cmd types.Cmd, hEnv types.HandlerEnvironment, instView *types.RunCommandInstanceView, metadata types.RCMetadata) (stdout string, stderr string, err error, exitCode int) {
+	defer func() {
+		if r := recover(); r != nil {
+			logPanic(ctx, r)
+			stdout, stderr = "", ""
+			err = errors.New(panicStatusMessage)
+			exitCode = constants.ExitCode_HandlerPanicked
+		}
+	}()
+
+	return cmd.Functions.Invoke(ctx, hEnv, instView, metadata, cmd)
+}
+
+// executePreWithRecovery calls the pre function of the command and converts any panic into an error
+func executePreWithRecovery(ctx *log.Context, cmd types.Cmd, hEnv types.HandlerEnvironment, metadata types.RCMetadata) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logPanic(ctx, r)
+			err = errors.New(panicStatusMessage)
+		}
+	}()
+
+	return cmd.Functions.Pre(ctx, hEnv, metadata, cmd)
+}
+
+func logPanic(ctx *log.Context, r interface{}) {
+	// Only runtime errors are logged verbatim. Any other panic value may carry user data.
+	reason := fmt.Sprintf("panic of type %T", r)
+	if runtimeErr, ok := r.(runtime.Error); ok {
+		reason = runtimeErr.Error()
+	}
+	ctx.Log("event", "recovered from panic", "reason", reason, "stack", sanitizeStackTrace(debug.Stack()))
+}
+
+// sanitizeStackTrace removes function argument values from the given stack trace
+func sanitizeStackTrace(stack []byte) string {
+	return stackTraceArgumentsRegex.ReplaceAllString(string(stack), "(...)")
+}
@@ -0,0 +1,66 @@
+package commandProcessor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/cleanup"
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/status"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func invokePanics(ctx *log.Context, h types.HandlerEnvironment, report *types.RunCommandInstanceView, metadata types.RCMetadata, c types.Cmd) (string, string, error, int) {
+	var settings map[string]string
+	settings["secret"] = "value" // assignment to nil map panics
+	return "", "", nil, constants.ExitCode_Okay
+}
+
+func prePanics(ctx *log.Context, h types.HandlerEnvironment, metadata types.RCMetadata, c types.Cmd) error {
+	panic("password=secret")
+}
+
+func Test_InvokeWithRecoveryConvertsPanicIntoFailure(t *testing.T) {
+	cmd := types.CmdEnableTemplate.InitializeFunctions(types.CmdFunctions{Invoke: invokePanics, Pre: nil, ReportStatus: status.ReportStatusToLocalFile, Cleanup: cleanup.RunCommandCleanup})
+	ctx := log.NewContext(log.NewNopLogger())
+	metadata := types.NewRCMetadata("testExtension", 1, constants.DownloadFolder, constants.DataDir)
+
+	_, _, err, exitCode := invokeWithRecovery(ctx, cmd, types.HandlerEnvironment{}, &types.RunCommandInstanceView{}, metadata)
+	require.ErrorContains(t, err, panicStatusMessage)
+	require.Equal(t, constants.ExitCode_HandlerPanicked, exitCode)
+}
+
+func Test_ExecutePreStepsRecoversFromPanic(t *testing.T) {
+	cmd := types.CmdEnableTemplate.InitializeFunctions(types.CmdFunctions{Invoke: nil, Pre: prePanics, ReportStatus: status.ReportStatusToLocalFile, Cleanup: cleanup.RunCommandCleanup})
+	ctx := log.NewContext(log.NewNopLogger())
+
+	err := executePreSteps(ctx, cmd, types.HandlerEnvironment{}, "testExtension", 1, constants.DownloadFolder)
+	require.ErrorContains(t, err, panicStatusMessage)
+	require.NotContains(t, err.Error(), "secret")
+}
+
+func Test_ProcessHandlerCommandReportsFailedStatusOnPanic(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	cmd := types.CmdEnableTemplate.InitializeFunctions(types.CmdFunctions{Invoke: invokePanics, Pre: nil, ReportStatus: status.ReportStatusToLocalFile, Cleanup: cleanup.RunCommandCleanup})
+	fakeEnv := types.HandlerEnvironment{}
+	fakeEnv.HandlerEnvironment.StatusFolder = tmpDir
+	fakeEnv.HandlerEnvironment.ConfigFolder = tmpDir
+
+	ProcessHandlerCommandWithDetails(log.NewContext(log.NewNopLogger()), cmd, fakeEnv, "testExtension", 3, constants.DownloadFolder)
+
+	b, err := os.ReadFile(filepath.Join(tmpDir, "testExtension.3.status"))
+	require.Nil(t, err)
+	require.Contains(t, string(b), types.Failed)
+	require.Contains(t, string(b), panicStatusMessage)
+}
+
+func Test_SanitizeStackTrace(t *testing.T) {
+	stack := "main.enable(0xc000012345, 0x1a, {0xc0000a0000, 0x5, 0x8})\n\t/src/main.go:10 +0x1d"
+	require.Equal(t, "main.enable(...)\n\t/src/main.go:10 +0x1d", sanitizeStackTrace([]byte(stack)))
+}
@@ -1,9 +1,54 @@
 package constants
 
+// DefaultDataDir is where we store the downloaded files, logs and state for
+// the extension handler, unless it is not writable (see SetDataDir)
+const DefaultDataDir = "/var/lib/waagent/run-command-handler"
+
+var (
+	// DataDir is the data directory in use, the default one unless the state is routed elsewhere
+	DataDir = DefaultDataDir
+
+	// Directory of the queue of scripts waiting for an execution slot, shared by all run command extensions
+	ExecutionQueueDir = DataDir + "/executionqueue"
+
+	// Unix socket of the immediate run command service streaming the output of the scripts it executes
+	ServiceSocketPath = DataDir + "/service.sock"
+
+	// Directory of the markers of the last successful run of every extension, read by dependent extensions and agents
+	ReadinessDir = DataDir + "/ready"
+
+	// Unix socket of the immediate run command service serving the readiness markers over HTTP
+	ReadinessSocketPath = DataDir + "/readiness.sock"
+
+	// Unix socket of the immediate run command service on which other extensions and the agent submit run commands
+	TriggerSocketPath = DataDir + "/trigger.sock"
+
+	// Directory of the script library synced by the immediate run command service, which scripts can reference by name
+	ScriptLibraryDir = DataDir + "/scriptlibrary"
+
+	// Config folder holding the settings of the run command executed at provisioning time. Like the config folders
+	// of the agent, it is two levels below the agent directory holding the certificates of the protected settings.
+	ProvisioningConfigDir = DataDir + "/provisioning"
+
+	// Directory of the snapshots of the last settings of every extension, without the protected settings, to log
+	// what changed between the invocations of the handler
+	SettingsSnapshotDir = DataDir + "/settings"
+)
+
+// SetDataDir routes the data directory and the paths within it to dir, e.g., when the root filesystem is read-only
+func SetDataDir(dir string) {
+	DataDir = dir
+	ExecutionQueueDir = DataDir + "/executionqueue"
+	ServiceSocketPath = DataDir + "/service.sock"
+	ReadinessDir = DataDir + "/ready"
+	ReadinessSocketPath = DataDir + "/readiness.sock"
+	TriggerSocketPath = DataDir + "/trigger.sock"
+	ScriptLibraryDir = DataDir + "/scriptlibrary"
+	ProvisioningConfigDir = DataDir + "/provisioning"
+	SettingsSnapshotDir = DataDir + "/settings"
+}
+
 const (
-	// dataDir is where we store the downloaded files, logs and state for
-	// the extension handler
-	DataDir = "/var/lib/waagent/run-command-handler"
 
 	// Directory used for copying the Run Command script file to be able to RunAs a different user.
 	// It needs to copied because of permission restrictions. RunAsUser does not have permission to execute under /var/lib/waagent and its subdirectories.
@@ -18,9 +63,133 @@ const (
 
 	ConfigFileExtension = ".settings"
 
+	// UpdatingFromVersionEnvName environment variable is set by VMAgent to the version being updated from when
+	// invoking the update command of the new version
+	UpdatingFromVersionEnvName = "AZURE_GUEST_AGENT_UPDATING_FROM_VERSION"
+
+	// ReportStatusForAllOperationsEnvName environment variable can be set to "true" to write status files for
+	// the operations that do not report status by default (e.g., install and uninstall)
+	ReportStatusForAllOperationsEnvName = "RunCommandReportStatusForAllOperations"
+
+	// ReservedHighPrioritySlotsEnvName environment variable can be set in the service unit to change the number of
+	// execution slots reserved for high priority immediate run commands
+	ReservedHighPrioritySlotsEnvName = "RunCommandReservedHighPrioritySlots"
+
+	// MaxConcurrentExecutionsEnvName environment variable can be set to change the number of scripts that can
+	// execute at the same time on the machine across all run command extensions
+	MaxConcurrentExecutionsEnvName = "RunCommandMaxConcurrentExecutions"
+
+	// Journal of the immediate goal states already executed, within the data directory
+	GoalStateJournalFileName = "immediateGoalStates.journal"
+
+	// ETag of the last VMSettings whose immediate goal states were all processed, within the data directory
+	VMSettingsETagFileName = "vmSettings.etag"
+
+	// File listing the SHA-256 of the only scripts allowed to execute, managed by the administrator of the VM. Every
+	// script is allowed if it does not exist.
+	ScriptAllowListPath = "/etc/azure/run-command-handler/allowed-scripts"
+
+	// File listing the directories the state of the handler can be routed to, one per line by preference, managed by
+	// the administrator of the VM. It is only used when the default data directory is not writable (e.g., the root
+	// filesystem is read-only or immutable).
+	WritableStateDirsPath = "/etc/azure/run-command-handler/writable-state-dirs"
+
+	// File overriding the feature flags of the handler, managed by the administrator of the VM
+	FeatureFlagsPath = "/etc/azure/run-command-handler/feature-flags.json"
+
+	// File defining the execution profiles the settings reference by name, managed by the administrator of the VM
+	ExecutionProfilesPath = "/etc/azure/run-command-handler/execution-profiles.json"
+
+	// File configuring the immediate run command service with the variables of its environment (e.g.,
+	// RunCommandReservedHighPrioritySlots=2), reloaded on SIGHUP without restarting the service
+	ServiceConfigPath = "/etc/azure/run-command-handler/service.conf"
+
+	// ServiceMaxParallelismEnvName environment variable can be set to change how many immediate run commands the
+	// service executes at the same time, each with its own download directory, pid file and status. The scripts
+	// still wait for a slot within RunCommandMaxConcurrentExecutions.
+	ServiceMaxParallelismEnvName = "RunCommandServiceMaxParallelism"
+
+	// ServicePollingIntervalEnvName environment variable can be set to change how often the immediate run command
+	// service polls for new goal states
+	ServicePollingIntervalEnvName = "RunCommandServicePollingIntervalInSeconds"
+
+	// ServicePollingJitterEnvName environment variable can be set to wait up to as many more seconds, at random,
+	// between two polls, so the services of a dense host don't poll at the same time
+	ServicePollingJitterEnvName = "RunCommandServicePollingJitterInSeconds"
+
+	// ServicePollingMaxBackoffEnvName environment variable can be set to change how long, at most, the immediate run
+	// command service waits between two polls once they keep failing, the wait doubling from the polling interval
+	// with every consecutive failure
+	ServicePollingMaxBackoffEnvName = "RunCommandServicePollingMaxBackoffInSeconds"
+
+	// ServicePollingBurstLimitEnvName environment variable can be set to change the most polls for new goal states
+	// in a minute, e.g., when the configuration is reloaded repeatedly
+	ServicePollingBurstLimitEnvName = "RunCommandServicePollingBurstLimit"
+
+	// StatusUpdateIntervalEnvName environment variable can be set to change how often the status of a running script
+	// is reported
+	StatusUpdateIntervalEnvName = "RunCommandStatusUpdateIntervalInSeconds"
+
+	// ServiceLogLevelEnvName environment variable can be set to info, warning or error to only log the records of
+	// the immediate run command service at least as severe
+	ServiceLogLevelEnvName = "RunCommandServiceLogLevel"
+
+	// ScriptLibraryContainerURIEnvName environment variable can be set in the service unit to sync the script library
+	// from a storage container, given as a container URI with a SAS token allowing to list and read the blobs
+	ScriptLibraryContainerURIEnvName = "RunCommandScriptLibraryContainerUri"
+
+	// ScriptLibraryGitRepoEnvName environment variable can be set in the service unit to sync the script library
+	// from the default branch of a git repository instead of a storage container
+	ScriptLibraryGitRepoEnvName = "RunCommandScriptLibraryGitRepo"
+
+	// ScriptLibrarySyncIntervalEnvName environment variable can be set to change how often the script library is synced
+	ScriptLibrarySyncIntervalEnvName = "RunCommandScriptLibrarySyncIntervalInSeconds"
+
+	// StatusEndpointEnvName environment variable can be set to upload the immediate status to an endpoint other than
+	// the wire server fallback address (e.g., https://<host>:<port> where the node offers HTTPS)
+	StatusEndpointEnvName = "RunCommandStatusEndpoint"
+
+	// VMSettingsEndpointEnvName environment variable sets the fake HGAP the VMSettings are requested from by the
+	// service built for the test harness, with the testharness build tag. The production builds ignore it.
+	VMSettingsEndpointEnvName = "RunCommandVMSettingsEndpoint"
+
+	// StatusEndpointHeadersEnvName environment variable can be set to add headers to the status requests, as
+	// "Name1=value1;Name2=value2" (e.g., the authentication headers required by the endpoint)
+	StatusEndpointHeadersEnvName = "RunCommandStatusEndpointHeaders"
+
+	// StatusEndpointCACertFileEnvName environment variable can be set to a PEM file with the certificates to trust
+	// for an HTTPS status endpoint, in addition to the system ones
+	StatusEndpointCACertFileEnvName = "RunCommandStatusEndpointCACertFile"
+
+	// StatusEndpointInsecureSkipVerifyEnvName environment variable can be set to "true" to skip the validation of
+	// the certificate of an HTTPS status endpoint. Only meant for testing.
+	StatusEndpointInsecureSkipVerifyEnvName = "RunCommandStatusEndpointInsecureSkipVerify"
+
+	// RequestHeadersEnvName environment variable can be set to add headers to every outbound request (downloads,
+	// blob operations and status uploads), as "Name1=value1;Name2=value2" (e.g., tracing headers)
+	RequestHeadersEnvName = "RunCommandRequestHeaders"
+
+	// ScriptRebootExitCode is the exit code of a script requesting a reboot, when allowed by allowReboot. The
+	// script can also create the file named by ScriptRebootMarkerEnvName.
+	ScriptRebootExitCode = 194
+
+	// ScriptStepEnvName environment variable tells a script allowed to reboot which step it executes, from 1
+	ScriptStepEnvName = "RUN_COMMAND_STEP"
+
+	// ScriptRebootMarkerEnvName environment variable is the path of the file a script allowed to reboot creates to
+	// request a reboot once it exits
+	ScriptRebootMarkerEnvName = "RUN_COMMAND_REBOOT_MARKER"
+
+	// ScriptProgressFileEnvName environment variable is the path of the file a script appends JSON lines to, to
+	// report its progress in the instance view while it runs
+	ScriptProgressFileEnvName = "RUN_COMMAND_PROGRESS_FILE"
+
 	// General failed exit code when extension provisioning fails due to service errors.
 	FailedExitCodeGeneral = -1
 
+	// The log file the handler writes to, LOG_DIR/LOG_FILE of the shim (misc/run-command-shim)
+	HandlerLogPath = "/var/log/azure/run-command-handler/handler.log"
+
 	// The output directory for logs of immediate run command
 	ImmediateRCOutputDirectory = "/var/log/azure/run-command-handler/ImmediateRunCommandService.log"
 
@@ -29,4 +198,16 @@ const (
 
 	// Download folder to use for immediate run command
 	ImmediateDownloadFolder = "immediateDownload/"
+
+	// Download folder to use for the run command executed at provisioning time, before the agent runs
+	ProvisioningDownloadFolder = "provisioningDownload/"
+
+	// Settings file of the run command executed at provisioning time, dropped by cloud-init at first boot
+	ProvisioningSettingsPath = "/etc/azure/run-command-handler/provisioning.settings"
+
+	// Status file of the run command executed at provisioning time
+	ProvisioningStatusPath = "/var/log/azure/run-command-handler/provisioning.status"
+
+	// Name of the handler as it appears in the VMSettings goal states
+	RunCommandHandlerName = "Microsoft.CPlat.Core.RunCommandHandlerLinux"
 )
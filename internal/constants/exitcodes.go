@@ -8,6 +8,26 @@ const (
 	ExitCode_ScriptBlobDownloadFailed  = -100
 	ExitCode_BlobCreateOrReplaceFailed = -101
 	ExitCode_RunAsLookupUserFailed     = -102
+	ExitCode_RunAsLookupGroupFailed    = -103
+	ExitCode_LocalScriptCopyFailed     = -104
+	ExitCode_LibraryScriptNotFound     = -105
+	ExitCode_ScriptNotAllowed          = -106
+	ExitCode_CapabilitiesNotSupported  = -107
+	ExitCode_NoWritableStateDir        = -108
+	ExitCode_MissingRequirements       = -109
+	ExitCode_NetworkNotReady           = -110
+	ExitCode_ScriptTimedOut            = -111
+	ExitCode_RebootLimitExceeded       = -112
+	ExitCode_ScriptCanceled            = -113
+	ExitCode_GoalStateExpired          = -114
+	ExitCode_ChecksumMismatch          = -115
+	ExitCode_RunAsElevationNotAllowed  = -116
+	ExitCode_KeyVaultResolutionFailed  = -117
+	ExitCode_GitRepositoryCloneFailed  = -118
+	ExitCode_OCIArtifactPullFailed     = -119
+	ExitCode_InsufficientDiskSpace     = -120
+	ExitCode_InterpreterNotFound       = -121
+	ExitCode_ValidationFailed          = -122
 
 	// Service Errors (-200s):
 	ExitCode_CreateDataDirectoryFailed                    = -200
@@ -30,6 +50,11 @@ const (
 	ExitCode_InstallServiceFailed                         = -217
 	ExitCode_UninstallInstalledServiceFailed              = -218
 	ExitCode_DisableInstalledServiceFailed                = -219
+	ExitCode_MigrateStateFailed                           = -220
+	ExitCode_UpdateRollbackFailed                         = -221
+	ExitCode_OperationTimedOut                            = -222
+	ExitCode_RenderScriptTemplateFailed                   = -223
 
 	// Unknown errors (-300s):
+	ExitCode_HandlerPanicked = -300
 )
@@ -0,0 +1,206 @@
+// Package datapaths builds the location of every file the handler keeps on disk for a run command.
+// All the paths are namespaced by extension name (and sequence number when the artifact belongs to a
+// single execution) so multiple run commands configured on the same VM never share files.
+package datapaths
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+)
+
+const (
+	// defaultExtensionFileName names the files of the single-config extension (empty extension name) outside of its
+	// download directory. Escaped extension names never start with '.', so it cannot clash with a multi-config extension.
+	defaultExtensionFileName = ".default"
+
+	mostRecentSequenceFileExtension = ".mrseq"
+	pidFileExtension                = ".pidstart"
+	lockFileExtension               = ".lock"
+
+	scriptFileName = "script.sh"
+	stdoutFileName = "stdout"
+	stderrFileName = "stderr"
+
+	processTreeFileName    = "processtree"
+	outputExpiryFileName   = "output.expiry"
+	tempDirName            = "tmp"
+	stepFileName           = "step"
+	rebootMarkerFileName   = "reboot-requested"
+	configRecordFileName   = "effective-config.json"
+	cancelMarkerFileName   = "canceled"
+	progressReportFileName = "progress.jsonl"
+	gitRepositoryDirName   = "repository"
+	ociArtifactDirName     = "bundle"
+	executionLockFileName  = "execution.lock"
+
+	readinessMarkerFileExtension  = ".json"
+	settingsSnapshotFileExtension = ".json"
+
+	// retentionPolicyFileName lives in the download path of the extension, beside its execution directories
+	retentionPolicyFileName = "retention-policy.json"
+)
+
+// EscapeExtensionName returns a representation of the extension name that is safe to use as a single
+// path element. Path separators and leading dots are percent-encoded so a name can neither escape its
+// directory nor alias another extension. Common names (letters, digits, '-', '_', '.') are unchanged.
+func EscapeExtensionName(extensionName string) string {
+	escaped := strings.ReplaceAll(extensionName, "%", "%25")
+	escaped = strings.ReplaceAll(escaped, "/", "%2F")
+	if strings.HasPrefix(escaped, ".") {
+		escaped = "%2E" + escaped[1:]
+	}
+	return escaped
+}
+
+// DownloadDir returns the directory, relative to the data directory, where the files of the given
+// extension are stored. E.g., download/RC0001. The single-config extension keeps the layout it always had on disk,
+// its executions directly in the download folder.
+func DownloadDir(downloadFolder string, extensionName string) string {
+	return filepath.Join(downloadFolder, EscapeExtensionName(extensionName))
+}
+
+// DownloadPath returns the full path where the files of the given extension are stored.
+// E.g., /var/lib/waagent/run-command-handler/download/RC0001
+func DownloadPath(dataDir string, downloadFolder string, extensionName string) string {
+	return filepath.Join(dataDir, DownloadDir(downloadFolder, extensionName))
+}
+
+// SeqNumDir returns the directory holding the script, artifacts and output of a single execution
+// under the extension download path. E.g., /var/lib/waagent/run-command-handler/download/RC0001/3
+func SeqNumDir(downloadPath string, seqNum int) string {
+	return filepath.Join(downloadPath, strconv.Itoa(seqNum))
+}
+
+// RetentionPolicyFilePath returns the path of the file holding the retention policy of the executions of the
+// extension, applied without its settings
+func RetentionPolicyFilePath(downloadPath string) string {
+	return filepath.Join(downloadPath, retentionPolicyFileName)
+}
+
+// ScriptFilePath returns the path where an embedded script is saved within the execution directory
+func ScriptFilePath(seqNumDir string) string {
+	return filepath.Join(seqNumDir, scriptFileName)
+}
+
+// OutputFilePaths returns the paths of the stdout and stderr files within the execution directory
+func OutputFilePaths(seqNumDir string) (stdout string, stderr string) {
+	return filepath.Join(seqNumDir, stdoutFileName), filepath.Join(seqNumDir, stderrFileName)
+}
+
+// ProcessTreeFilePath returns the path of the last snapshot of the process tree of the script within the execution directory
+func ProcessTreeFilePath(seqNumDir string) string {
+	return filepath.Join(seqNumDir, processTreeFileName)
+}
+
+// OutputExpiryFilePath returns the path of the file holding when the stdout and stderr files of the execution are
+// deleted, if they have a retention
+func OutputExpiryFilePath(seqNumDir string) string {
+	return filepath.Join(seqNumDir, outputExpiryFileName)
+}
+
+// TempDirPath returns the temporary directory (TMPDIR) of the script within the execution directory
+func TempDirPath(seqNumDir string) string {
+	return filepath.Join(seqNumDir, tempDirName)
+}
+
+// StepFilePath returns the path of the file holding the step a script allowed to reboot executes, within the
+// execution directory
+func StepFilePath(seqNumDir string) string {
+	return filepath.Join(seqNumDir, stepFileName)
+}
+
+// RebootMarkerFilePath returns the path of the file a script creates to request a reboot within the execution directory
+func RebootMarkerFilePath(seqNumDir string) string {
+	return filepath.Join(seqNumDir, rebootMarkerFileName)
+}
+
+// ProgressReportFilePath returns the path of the file the script reports its progress to, within the execution
+// directory (or the RunAs directory of the script)
+func ProgressReportFilePath(seqNumDir string) string {
+	return filepath.Join(seqNumDir, progressReportFileName)
+}
+
+// GitRepositoryDir returns the directory the git repository of the script is downloaded to, within the execution
+// directory
+func GitRepositoryDir(seqNumDir string) string {
+	return filepath.Join(seqNumDir, gitRepositoryDirName)
+}
+
+// OCIArtifactDir returns the directory the container registry artifact of the script is extracted to, within the
+// execution directory
+func OCIArtifactDir(seqNumDir string) string {
+	return filepath.Join(seqNumDir, ociArtifactDirName)
+}
+
+// ConfigRecordFilePath returns the path of the record of the configuration the execution was requested with, within
+// the execution directory
+func ConfigRecordFilePath(seqNumDir string) string {
+	return filepath.Join(seqNumDir, configRecordFileName)
+}
+
+// CancelMarkerFilePath returns the path of the file recording that the execution was canceled, within the execution
+// directory
+func CancelMarkerFilePath(seqNumDir string) string {
+	return filepath.Join(seqNumDir, cancelMarkerFileName)
+}
+
+// ExecutionLockFilePath returns the path of the file locked while the execution runs, within the execution directory
+func ExecutionLockFilePath(seqNumDir string) string {
+	return filepath.Join(seqNumDir, executionLockFileName)
+}
+
+// ReadinessMarkerFilePath returns the path of the marker of the last successful run of the extension, within the
+// readiness directory. E.g., /var/lib/waagent/run-command-handler/ready/RC0001.json
+func ReadinessMarkerFilePath(readinessDir string, extensionName string) string {
+	name := EscapeExtensionName(extensionName)
+	if name == "" {
+		name = defaultExtensionFileName
+	}
+	return filepath.Join(readinessDir, name+readinessMarkerFileExtension)
+}
+
+// SettingsSnapshotFilePath returns the path of the snapshot of the last settings of the extension, within the
+// snapshot directory. E.g., /var/lib/waagent/run-command-handler/settings/RC0001.json
+func SettingsSnapshotFilePath(snapshotDir string, extensionName string) string {
+	name := EscapeExtensionName(extensionName)
+	if name == "" {
+		name = defaultExtensionFileName
+	}
+	return filepath.Join(snapshotDir, name+settingsSnapshotFileExtension)
+}
+
+// MostRecentSequencePath returns the path of the file tracking the last sequence number processed by the extension
+func MostRecentSequencePath(dataDir string, downloadFolder string, extensionName string) string {
+	return stateFilePath(dataDir, downloadFolder, extensionName, mostRecentSequenceFileExtension)
+}
+
+// PidFilePath returns the path of the file tracking the process currently executing the extension
+func PidFilePath(dataDir string, downloadFolder string, extensionName string) string {
+	return stateFilePath(dataDir, downloadFolder, extensionName, pidFileExtension)
+}
+
+// LockFilePath returns the path of the file locked by the invocations of the handler updating the state files of
+// the extension (e.g., its most recent sequence number)
+func LockFilePath(dataDir string, downloadFolder string, extensionName string) string {
+	return stateFilePath(dataDir, downloadFolder, extensionName, lockFileExtension)
+}
+
+// RunAsDownloadDir returns the directory where the files of the extension are copied to run them as the given user
+func RunAsDownloadDir(runAsUser string, downloadDir string) string {
+	return filepath.Join(fmt.Sprintf(constants.RunAsDir, runAsUser), downloadDir)
+}
+
+// stateFilePath returns the path of a per-extension state file. The standard run command keeps its state files
+// in the working directory, which is preserved by the agent across updates. Any other flow (e.g., immediate run
+// command) keeps them next to its download directories so they never clash with the standard ones.
+func stateFilePath(dataDir string, downloadFolder string, extensionName string, fileExtension string) string {
+	fileName := EscapeExtensionName(extensionName) + fileExtension
+	if filepath.Clean(downloadFolder) == filepath.Clean(constants.DownloadFolder) {
+		return fileName
+	}
+	return filepath.Join(dataDir, downloadFolder, fileName)
+}
@@ -0,0 +1,72 @@
+package datapaths
+
+import (
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_escapeExtensionName(t *testing.T) {
+	require.Equal(t, "RC0001", EscapeExtensionName("RC0001"))
+	require.Equal(t, "my-run_command.v2", EscapeExtensionName("my-run_command.v2"))
+	require.Equal(t, "a%2Fb", EscapeExtensionName("a/b"))
+	require.Equal(t, "%2E.", EscapeExtensionName(".."))
+	require.Equal(t, "%2Edefault", EscapeExtensionName(".default"))
+	require.Equal(t, "a%252Fb", EscapeExtensionName("a%2Fb"))
+}
+
+func Test_downloadPath(t *testing.T) {
+	dataDir := "/var/lib/waagent/run-command-handler"
+	require.Equal(t, "download/RC0001", DownloadDir(constants.DownloadFolder, "RC0001"))
+	require.Equal(t, "/var/lib/waagent/run-command-handler/download/RC0001", DownloadPath(dataDir, constants.DownloadFolder, "RC0001"))
+	require.Equal(t, "/var/lib/waagent/run-command-handler/immediateDownload/RC0001", DownloadPath(dataDir, constants.ImmediateDownloadFolder, "RC0001"))
+
+	// The single-config extension keeps its executions in the download folder, e.g., download/0
+	require.Equal(t, "/var/lib/waagent/run-command-handler/download", DownloadPath(dataDir, constants.DownloadFolder, ""))
+	require.Equal(t, "/var/lib/waagent/run-command-handler/download/0", SeqNumDir(DownloadPath(dataDir, constants.DownloadFolder, ""), 0))
+
+	// Extension names cannot escape the download folder
+	require.Equal(t, "/var/lib/waagent/run-command-handler/download/%2E.", DownloadPath(dataDir, constants.DownloadFolder, ".."))
+}
+
+func Test_executionPaths(t *testing.T) {
+	dir := SeqNumDir("/var/lib/waagent/run-command-handler/download/RC0001", 3)
+	require.Equal(t, "/var/lib/waagent/run-command-handler/download/RC0001/3", dir)
+	require.Equal(t, "/var/lib/waagent/run-command-handler/download/RC0001/3/script.sh", ScriptFilePath(dir))
+
+	stdout, stderr := OutputFilePaths(dir)
+	require.Equal(t, "/var/lib/waagent/run-command-handler/download/RC0001/3/stdout", stdout)
+	require.Equal(t, "/var/lib/waagent/run-command-handler/download/RC0001/3/stderr", stderr)
+	require.Equal(t, "/var/lib/waagent/run-command-handler/download/RC0001/3/processtree", ProcessTreeFilePath(dir))
+	require.Equal(t, "/var/lib/waagent/run-command-handler/download/RC0001/3/tmp", TempDirPath(dir))
+	require.Equal(t, "/var/lib/waagent/run-command-handler/download/RC0001/3/output.expiry", OutputExpiryFilePath(dir))
+	require.Equal(t, "/var/lib/waagent/run-command-handler/download/RC0001/3/execution.lock", ExecutionLockFilePath(dir))
+
+	require.Equal(t, "/home/user1/waagent/run-command-handler-runas/download/RC0001", RunAsDownloadDir("user1", DownloadDir(constants.DownloadFolder, "RC0001")))
+}
+
+func Test_stateFilePaths(t *testing.T) {
+	dataDir := "/var/lib/waagent/run-command-handler"
+
+	// The standard run command keeps its state files in the working directory
+	require.Equal(t, "RC0001.mrseq", MostRecentSequencePath(dataDir, constants.DownloadFolder, "RC0001"))
+	require.Equal(t, "RC0001.pidstart", PidFilePath(dataDir, constants.DownloadFolder, "RC0001"))
+	require.Equal(t, "RC0001.lock", LockFilePath(dataDir, constants.DownloadFolder, "RC0001"))
+	require.Equal(t, ".mrseq", MostRecentSequencePath(dataDir, constants.DownloadFolder, ""))
+
+	// The immediate run command does not share them with a standard run command of the same name
+	require.Equal(t, "/var/lib/waagent/run-command-handler/immediateDownload/RC0001.mrseq", MostRecentSequencePath(dataDir, constants.ImmediateDownloadFolder, "RC0001"))
+	require.Equal(t, "/var/lib/waagent/run-command-handler/immediateDownload/RC0001.pidstart", PidFilePath(dataDir, constants.ImmediateDownloadFolder, "RC0001"))
+}
+
+func Test_readinessMarkerFilePath(t *testing.T) {
+	require.Equal(t, "/ready/RC0001.json", ReadinessMarkerFilePath("/ready", "RC0001"))
+	require.Equal(t, "/ready/.default.json", ReadinessMarkerFilePath("/ready", ""))
+	require.Equal(t, "/ready/%2E.%2Fetc.json", ReadinessMarkerFilePath("/ready", "../etc"))
+}
+
+func Test_settingsSnapshotFilePath(t *testing.T) {
+	require.Equal(t, "/settings/RC0001.json", SettingsSnapshotFilePath("/settings", "RC0001"))
+	require.Equal(t, "/settings/.default.json", SettingsSnapshotFilePath("/settings", ""))
+}
@@ -0,0 +1,64 @@
+// Package dependencies checks that the commands a script requires are present on the VM before executing it, and
+// installs the missing ones with the package manager of the VM when asked to.
+package dependencies
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// installTimeout bounds the installation of the missing commands
+const installTimeout = 10 * time.Minute
+
+// lookPath finds a command in the PATH of the handler, which installs the packages
+var lookPath = exec.LookPath
+
+// Missing returns the required commands lookPath doesn't find, in the order they are required
+func Missing(required []string, lookPath func(name string) (string, error)) []string {
+	var missing []string
+	for _, name := range required {
+		if _, err := lookPath(name); err != nil {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// Ensure returns an error naming the required commands lookPath doesn't find in the PATH the script executes with
+// (e.g., the PATH of its RunAs user). When install is set, the missing commands are first installed with the package
+// manager of the VM, as packages of the same name.
+func Ensure(ctx *log.Context, required []string, install bool, lookPath func(name string) (string, error)) error {
+	return ensure(ctx, required, install, lookPath, DetectPackageManager)
+}
+
+func ensure(ctx *log.Context, required []string, install bool, lookPath func(name string) (string, error), detect func() (PackageManager, error)) error {
+	missing := Missing(required, lookPath)
+	if len(missing) == 0 {
+		return nil
+	}
+	if !install {
+		return fmt.Errorf("the script requires commands missing from the VM: %s. Install them or set 'installRequirements' to true", strings.Join(missing, ", "))
+	}
+
+	pm, err := detect()
+	if err != nil {
+		return errors.Wrapf(err, "the script requires commands missing from the VM: %s", strings.Join(missing, ", "))
+	}
+	ctx.Log("event", "installing the missing requirements", "packageManager", pm.Name(), "packages", strings.Join(missing, ","))
+	installCtx, cancel := context.WithTimeout(context.Background(), installTimeout)
+	defer cancel()
+	if err := pm.Install(installCtx, missing); err != nil {
+		return errors.Wrapf(err, "failed to install the commands missing from the VM with %s: %s", pm.Name(), strings.Join(missing, ", "))
+	}
+
+	if missing := Missing(missing, lookPath); len(missing) > 0 {
+		return fmt.Errorf("the script requires commands still missing from the VM once their packages were installed with %s: %s", pm.Name(), strings.Join(missing, ", "))
+	}
+	return nil
+}
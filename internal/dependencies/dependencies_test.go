@@ -0,0 +1,71 @@
+package dependencies
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePackageManager makes the installed packages present
+type fakePackageManager struct {
+	present   map[string]bool
+	installed []string
+	err       error
+}
+
+func (m *fakePackageManager) Name() string { return "fake" }
+
+func (m *fakePackageManager) Install(ctx context.Context, packages []string) error {
+	m.installed = append(m.installed, packages...)
+	if m.err != nil {
+		return m.err
+	}
+	for _, name := range packages {
+		if name != "noop" {
+			m.present[name] = true
+		}
+	}
+	return nil
+}
+
+func fakeLookPath(present map[string]bool) func(string) (string, error) {
+	return func(name string) (string, error) {
+		if present[name] {
+			return "/usr/bin/" + name, nil
+		}
+		return "", exec.ErrNotFound
+	}
+}
+
+func Test_ensure(t *testing.T) {
+	defer func() { lookPath = exec.LookPath }()
+	ctx := log.NewContext(log.NewNopLogger())
+	present := map[string]bool{"curl": true}
+	lookPath = fakeLookPath(present)
+	pm := &fakePackageManager{present: present}
+	detect := func() (PackageManager, error) { return pm, nil }
+
+	require.Nil(t, ensure(ctx, []string{"curl"}, false, lookPath, detect))
+	require.Equal(t, []string{"jq", "yq"}, Missing([]string{"jq", "curl", "yq"}, lookPath))
+
+	err := ensure(ctx, []string{"jq", "curl", "yq"}, false, lookPath, detect)
+	require.EqualError(t, err, "the script requires commands missing from the VM: jq, yq. Install them or set 'installRequirements' to true")
+	require.Empty(t, pm.installed)
+
+	// Only the missing commands are installed
+	require.Nil(t, ensure(ctx, []string{"jq", "curl"}, true, lookPath, detect))
+	require.Equal(t, []string{"jq"}, pm.installed)
+
+	err = ensure(ctx, []string{"noop"}, true, lookPath, detect)
+	require.EqualError(t, err, "the script requires commands still missing from the VM once their packages were installed with fake: noop")
+
+	pm.err = errors.New("no such package")
+	require.ErrorContains(t, ensure(ctx, []string{"yq"}, true, lookPath, detect), "failed to install the commands missing from the VM with fake: yq: no such package")
+
+	err = ensure(ctx, []string{"yq"}, true, lookPath, func() (PackageManager, error) { return nil, errors.New("no supported package manager") })
+	require.EqualError(t, err, "the script requires commands missing from the VM: yq: no supported package manager")
+}
@@ -0,0 +1,78 @@
+package dependencies
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxInstallOutputLen bounds the output of a failed installation reported in its error
+const maxInstallOutputLen = 1024
+
+// PackageManager installs packages on the VM
+type PackageManager interface {
+	// Name returns the name of the package manager, e.g., apt-get
+	Name() string
+
+	// Install installs the given packages, without prompting
+	Install(ctx context.Context, packages []string) error
+}
+
+// commandPackageManager is a package manager invoked as a command
+type commandPackageManager struct {
+	name string
+	// refreshArgs refresh the package index before installing, if set
+	refreshArgs []string
+	installArgs []string
+	env         []string
+}
+
+// packageManagers are the supported package managers, by preference when several are present
+var packageManagers = []PackageManager{
+	commandPackageManager{name: "apt-get", refreshArgs: []string{"update", "-q"}, installArgs: []string{"install", "-y", "-q"}, env: []string{"DEBIAN_FRONTEND=noninteractive"}},
+	commandPackageManager{name: "tdnf", installArgs: []string{"install", "-y", "-q"}},
+	commandPackageManager{name: "dnf", installArgs: []string{"install", "-y", "-q"}},
+	commandPackageManager{name: "yum", installArgs: []string{"install", "-y", "-q"}},
+	commandPackageManager{name: "zypper", installArgs: []string{"--non-interactive", "--quiet", "install"}},
+}
+
+// DetectPackageManager returns the first supported package manager present on the VM
+func DetectPackageManager() (PackageManager, error) {
+	names := make([]string, 0, len(packageManagers))
+	for _, pm := range packageManagers {
+		if _, err := lookPath(pm.Name()); err == nil {
+			return pm, nil
+		}
+		names = append(names, pm.Name())
+	}
+	return nil, errors.Errorf("no supported package manager found on the VM (%s)", strings.Join(names, ", "))
+}
+
+func (m commandPackageManager) Name() string {
+	return m.name
+}
+
+func (m commandPackageManager) Install(ctx context.Context, packages []string) error {
+	if len(m.refreshArgs) > 0 {
+		if err := m.run(ctx, m.refreshArgs); err != nil {
+			return err
+		}
+	}
+	return m.run(ctx, append(append([]string(nil), m.installArgs...), packages...))
+}
+
+func (m commandPackageManager) run(ctx context.Context, args []string) error {
+	cmd := exec.CommandContext(ctx, m.name, args...)
+	cmd.Env = append(os.Environ(), m.env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if len(out) > maxInstallOutputLen {
+			out = out[len(out)-maxInstallOutputLen:]
+		}
+		return errors.Wrapf(err, "%s %s failed: %s", m.name, strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package dependencies
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_DetectPackageManager(t *testing.T) {
+	defer func() { lookPath = exec.LookPath }()
+
+	lookPath = fakeLookPath(map[string]bool{"dnf": true, "yum": true})
+	pm, err := DetectPackageManager()
+	require.Nil(t, err)
+	require.Equal(t, "dnf", pm.Name())
+
+	lookPath = fakeLookPath(nil)
+	_, err = DetectPackageManager()
+	require.EqualError(t, err, "no supported package manager found on the VM (apt-get, tdnf, dnf, yum, zypper)")
+}
+
+func Test_commandPackageManager(t *testing.T) {
+	pm := commandPackageManager{name: "sh", refreshArgs: []string{"-c", "test \"$FRONTEND\" = none"}, installArgs: []string{"-c", "echo \"cannot install $1\"; exit 3", "sh"}, env: []string{"FRONTEND=none"}}
+	require.EqualError(t, pm.Install(context.Background(), []string{"jq"}), "sh -c echo \"cannot install $1\"; exit 3 sh jq failed: cannot install jq: exit status 3")
+
+	pm.env = nil
+	require.ErrorContains(t, pm.Install(context.Background(), []string{"jq"}), "sh -c test \"$FRONTEND\" = none failed")
+}
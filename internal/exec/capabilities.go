@@ -0,0 +1,41 @@
+package exec
+
+import (
+	"os"
+	"strings"
+
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/pkg/errors"
+)
+
+// setprivPath runs the script with only the capabilities of the settings. It is part of util-linux.
+var setprivPath = "/usr/bin/setpriv"
+
+// shellCommand returns the command running cmd with bash, within the resource limits of the settings. When the
+// settings restrict the capabilities of the script, bash runs through setpriv with the other capabilities dropped
+// from its bounding set, so neither the script nor its children can regain them, and the granted ones are ambient so
+// they survive the execution of the programs of the script. setpriv also sets the no_new_privs flag of the scripts
+// sandboxed by their execution profile.
+func shellCommand(cfg *handlersettings.HandlerSettings, cmd string) (string, []string, error) {
+	cmd = resourceLimitsCommand(cfg, cmd)
+	capabilities, restricted := cfg.ScriptCapabilities()
+	if !restricted && !cfg.PublicSettings.NoNewPrivileges {
+		return "/bin/bash", []string{"-c", cmd}, nil
+	}
+	if _, err := os.Stat(setprivPath); err != nil {
+		return "", nil, errors.Wrapf(err, "'capabilities' and the sandbox of the execution profile require %s (util-linux) on the VM", setprivPath)
+	}
+
+	var args []string
+	if restricted {
+		set := "-all"
+		if len(capabilities) > 0 {
+			set += ",+" + strings.Join(capabilities, ",+")
+		}
+		args = append(args, "--inh-caps="+set, "--ambient-caps="+set, "--bounding-set="+set)
+	}
+	if cfg.PublicSettings.NoNewPrivileges {
+		args = append(args, "--no-new-privs")
+	}
+	return setprivPath, append(args, "--", "/bin/bash", "-c", cmd), nil
+}
@@ -1,40 +1,60 @@
 package exec
 
 import (
-	"context"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
 	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/multistep"
+	"github.com/Azure/run-command-handler-linux/internal/outputfile"
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 )
 
+// runningScripts maps the working directory of the scripts executing to their pid
+var runningScripts sync.Map
+
 // Exec runs the given cmd in /bin/sh, saves its stdout/stderr streams to
 // the specified files. It waits until the execution terminates.
 //
 // On error, an exit code may be returned if it is an exit code error.
 // Given stdout and stderr will be closed upon returning.
 func Exec(ctx *log.Context, cmd, workdir string, stdout, stderr io.WriteCloser, cfg *handlersettings.HandlerSettings) (int, error) {
+	return execWithTempDir(ctx, cmd, "", workdir, "", "", stdout, stderr, cfg)
+}
+
+// execWithTempDir is Exec giving the script a dedicated TMPDIR at tempDir (next to the RunAs script when running
+// as another user), which is removed once the script exits, and a file to report its progress to at progressFile.
+// The script is launched with interpreter, see scriptInterpreter. No TMPDIR or progress file is set if tempDir or
+// progressFile is empty, and the script is executed itself if interpreter is empty.
+func execWithTempDir(ctx *log.Context, cmd, interpreter, workdir, tempDir, progressFile string, stdout, stderr io.WriteCloser, cfg *handlersettings.HandlerSettings) (int, error) {
 	defer stdout.Close()
 	defer stderr.Close()
 
 	scriptPath := cmd
 
-	commandArgs, err := SetEnvironmentVariables(cfg)
-	// Add command args if any. Unnamed arguments go in 'commandArgs'. Named arguments are set as environment variables so the'd be available within the script.
-	cmd = cmd + commandArgs
+	// The unnamed parameters are the arguments of the script, the named ones are set as its environment variables
+	commandArgs := scriptArguments(cfg)
+	cmd = interpreterCommand(interpreter, cmd) + commandArgs
+	for _, name := range skippedParameterNames(cfg) {
+		ctx.Log("warning", fmt.Sprintf("the parameter '%s' is skipped, its name can't be an environment variable", name))
+	}
 
 	exitCode := constants.ExitCode_Okay
+	var groups runAsGroups
 
 	if cfg.PublicSettings.RunAsUser != "" {
 		ctx.Log("message", "RunAsUser is "+cfg.PublicSettings.RunAsUser)
@@ -49,7 +69,7 @@ func Exec(ctx *log.Context, cmd, workdir string, stdout, stderr io.WriteCloser,
 		// Gets suffix "download/<runcommandName>/0/script.sh"
 		downloadPathSuffix := scriptPath[len(constants.DataDir):]
 		// formats into something like "/home/<RunAsUserName>/waagent/run-command-handler-runas/download/<runcommandName>/0/script.sh", This filepath doesn't exist yet.
-		runAsScriptFilePath := filepath.Join(fmt.Sprintf(constants.RunAsDir, cfg.PublicSettings.RunAsUser), downloadPathSuffix)
+		runAsScriptFilePath := datapaths.RunAsDownloadDir(cfg.PublicSettings.RunAsUser, downloadPathSuffix)
 		runAsScriptDirectoryPath := filepath.Dir(runAsScriptFilePath) // Get directory of runAsScript that doesn't exist yet
 
 		// Create runAsScriptDirectoryPath and its intermediate directories if they do not exist
@@ -108,34 +128,112 @@ func Exec(ctx *log.Context, cmd, workdir string, stdout, stderr io.WriteCloser,
 			return constants.ExitCode_RunAsScriptFileChangePermissionsFailed, errors.Wrapf(runAsScriptChmodError, errMessage)
 		}
 
+		if tempDir != "" {
+			tempDir = datapaths.TempDirPath(runAsScriptDirectoryPath)
+			if err := createTempDir(tempDir, lookedUpUserUid); err != nil {
+				ctx.Log("warning", "the script will use the default temporary directory", "error", err)
+				tempDir = ""
+			}
+		}
+		if progressFile != "" {
+			if err := createProgressReportFile(progressFile, lookedUpUserUid); err != nil {
+				ctx.Log("warning", "the script can't report its progress", "error", err)
+				progressFile = ""
+			}
+		}
+
+		var lookupGroupError error
+		groups, lookupGroupError = resolveRunAsGroups(lookedUpUser, cfg)
+		if lookupGroupError != nil {
+			errMessage := fmt.Sprintf("Failed to lookup the RunAs groups of user '%s'. Make sure the groups in runAsGroup and runAsSupplementaryGroups exist on the VM. Refer: https://aka.ms/RunCommandManagedLinux", cfg.PublicSettings.RunAsUser)
+			ctx.Log("message", errMessage, "error", lookupGroupError)
+			return constants.ExitCode_RunAsLookupGroupFailed, errors.Wrapf(lookupGroupError, errMessage)
+		}
+
+		// sudo resets the environment, so the temporary directory, the step and the progress file are set by env for
+		// the RunAs user
+		runAsEnv := ""
+		for _, variable := range append(append(tempDirEnvironment(cfg, tempDir), stepEnvironment(cfg, workdir)...), progressEnvironment(progressFile)...) {
+			runAsEnv += " " + variable
+		}
+		if runAsEnv != "" {
+			runAsEnv = "env" + runAsEnv + " "
+		}
+		// The command sudo runs, with the interpreter and the arguments of the script
+		runAsCommand := runAsEnv + runAsResourceLimitsCommand(cfg, interpreterCommand(interpreter, runAsScriptFilePath)+commandArgs)
+
+		if cfg.PublicSettings.RunAsElevated {
+			if err := checkElevation(cfg.PublicSettings.RunAsUser, runAsCommand); err != nil {
+				errMessage := fmt.Sprintf("RunAs user '%s' is not allowed to run the script elevated. 'runAsElevated' requires the user to be allowed to run commands as root with sudo. Refer: https://aka.ms/RunCommandManagedLinux", cfg.PublicSettings.RunAsUser)
+				ctx.Log("message", errMessage, "error", err)
+				return constants.ExitCode_RunAsElevationNotAllowed, errors.Wrapf(err, errMessage)
+			}
+		}
+
 		// echo pipes the RunAsPassword to sudo -S for RunAsUser instead of prompting the password interactively from user and blocking.
-		// echo <cfg.protectedSettings.RunAsPassword> | sudo -S -u <cfg.publicSettings.RunAsUser> <command>
-		cmd = fmt.Sprintf("echo %s | sudo -S -u %s %s", cfg.ProtectedSettings.RunAsPassword, cfg.PublicSettings.RunAsUser, runAsScriptFilePath+commandArgs)
+		// echo <cfg.protectedSettings.RunAsPassword> | sudo -S [-i] -H -u <cfg.publicSettings.RunAsUser or root> [-g '#<gid>'] [-P] [env TMPDIR=<dir>] <command>
+		cmd = fmt.Sprintf("echo %s | sudo -S%s%s %s", cfg.ProtectedSettings.RunAsPassword, runAsSudoOptions(cfg), groups.sudoArgs(), runAsCommand)
 		ctx.Log("message", "RunAs cmd is "+cmd)
+	} else {
+		if tempDir != "" {
+			if err := createTempDir(tempDir, -1); err != nil {
+				ctx.Log("warning", "the script will use the default temporary directory", "error", err)
+				tempDir = ""
+			}
+		}
+		if progressFile != "" {
+			if err := createProgressReportFile(progressFile, -1); err != nil {
+				ctx.Log("warning", "the script can't report its progress", "error", err)
+				progressFile = ""
+			}
+		}
+	}
+	if tempDir != "" {
+		defer removeTempDir(ctx, tempDir)
 	}
 
-	var command *exec.Cmd
-	if cfg.PublicSettings.TimeoutInSeconds > 0 {
-		commandContext, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.PublicSettings.TimeoutInSeconds)*time.Second)
-		defer cancel()
-		command = exec.CommandContext(commandContext, "/bin/bash", "-c", cmd)
-		ctx.Log("message", "Execute with TimeoutInSeconds="+strconv.Itoa(cfg.PublicSettings.TimeoutInSeconds))
-	} else {
-		command = exec.Command("/bin/bash", "-c", cmd)
+	shell, shellArgs, err := shellCommand(cfg, cmd)
+	if err != nil {
+		ctx.Log("message", "failed to restrict the capabilities or the privileges of the script", "error", err)
+		return constants.ExitCode_CapabilitiesNotSupported, err
 	}
 
+	command := exec.Command(shell, shellArgs...)
 	command.Dir = workdir
-	command.Stdout = stdout
-	command.Stderr = stderr
-	err = command.Run()
+	command.SysProcAttr = scriptSysProcAttr(groups)
+	command.Env = append(append(append(append(append(os.Environ(), localeEnvironment(cfg)...), settingsEnvironment(cfg)...), tempDirEnvironment(cfg, tempDir)...), stepEnvironment(cfg, workdir)...), progressEnvironment(progressFile)...)
+	waitForOutput := streamOutput(ctx, command, workdir, stdout, stderr)
+	err = command.Start()
+	var timedOut int32
+	if err == nil {
+		runningScripts.Store(workdir, command.Process.Pid)
+		var timer *time.Timer
+		if cfg.PublicSettings.TimeoutInSeconds > 0 {
+			ctx.Log("message", "Execute with TimeoutInSeconds="+strconv.Itoa(cfg.PublicSettings.TimeoutInSeconds))
+			pid := command.Process.Pid
+			timer = time.AfterFunc(time.Duration(cfg.PublicSettings.TimeoutInSeconds)*time.Second, func() {
+				atomic.StoreInt32(&timedOut, 1)
+				killProcessGroup(ctx, pid)
+			})
+		}
+		err = command.Wait()
+		if timer != nil {
+			timer.Stop()
+		}
+		runningScripts.Delete(workdir)
+	}
+	if outputErr := waitForOutput(); err == nil {
+		err = outputErr
+	}
+	if atomic.LoadInt32(&timedOut) == 1 {
+		ctx.Log("message", "Timeout: the script and its processes were killed")
+		return constants.ExitCode_ScriptTimedOut, fmt.Errorf("the script did not complete within %d seconds and was killed", cfg.PublicSettings.TimeoutInSeconds)
+	}
 	if err != nil {
 		exitErr, ok := err.(*exec.ExitError)
 		if ok {
 			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
 				exitCode = status.ExitStatus()
-				if status.Signaled() { // Timed out
-					ctx.Log("message", "Timeout:"+err.Error())
-				}
 				return exitCode, fmt.Errorf("command terminated with exit status=%d", exitCode)
 			}
 		}
@@ -144,30 +242,170 @@ func Exec(ctx *log.Context, cmd, workdir string, stdout, stderr io.WriteCloser,
 	return exitCode, errors.Wrapf(err, "failed to execute command")
 }
 
-func SetEnvironmentVariables(cfg *handlersettings.HandlerSettings) (string, error) {
-	var err error
-	commandArgs := ""
-	parameters := []handlersettings.ParameterDefinition{}
-	if cfg.PublicSettings.Parameters != nil && len(cfg.PublicSettings.Parameters) > 0 {
-		parameters = cfg.PublicSettings.Parameters
+// scriptSysProcAttr returns the attributes of the script process, which leads its own process group so the script
+// and all the processes it started can be killed together
+func scriptSysProcAttr(groups runAsGroups) *syscall.SysProcAttr {
+	attr := groups.sysProcAttr()
+	if attr == nil {
+		attr = &syscall.SysProcAttr{}
 	}
-	if cfg.ProtectedSettings.ProtectedParameters != nil && len(cfg.ProtectedSettings.ProtectedParameters) > 0 {
-		parameters = append(parameters, cfg.ProtectedSettings.ProtectedParameters...)
+	attr.Setpgid = true
+	return attr
+}
+
+// killProcessGroup kills the process group led by the script with the given pid
+func killProcessGroup(ctx *log.Context, pid int) {
+	if err := syscall.Kill(-pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		ctx.Log("warning", "failed to kill the processes of the script", "pid", pid, "error", err)
 	}
+}
 
-	for i := 0; i < len(parameters); i++ {
-		name := parameters[i].Name
-		value := parameters[i].Value
-		if value != "" {
-			if name != "" { // Named parameters are set as environmental setting
-				err = os.Setenv(name, value)
-			} else { // Unnamed parameters go to command args
-				commandArgs += " " + value
-			}
+// KillRunningScript kills the script executing in workdir along with the processes it started. It returns false if
+// no script is executing there.
+func KillRunningScript(ctx *log.Context, workdir string) bool {
+	pid, ok := RunningScriptPid(workdir)
+	if !ok {
+		return false
+	}
+	ctx.Log("event", "killing the script", "pid", pid)
+	killProcessGroup(ctx, pid)
+	return true
+}
+
+// RunningScriptPid returns the pid of the script executing in workdir, if any
+func RunningScriptPid(workdir string) (int, bool) {
+	pid, ok := runningScripts.Load(workdir)
+	if !ok {
+		return 0, false
+	}
+	return pid.(int), true
+}
+
+// localeEnvironment returns the locale variables of the script. Named parameters setting them take precedence.
+func localeEnvironment(cfg *handlersettings.HandlerSettings) []string {
+	var env []string
+	for _, name := range []string{"LANG", "LC_ALL"} {
+		if !isNamedParameter(cfg, name) {
+			env = append(env, name+"="+cfg.ScriptLocale())
 		}
 	}
+	return env
+}
 
-	return commandArgs, err // Return command args and the last error if any
+// settingsEnvironment returns the environment variables of the settings, including the resolved Key Vault
+// references, which take precedence over the locale
+func settingsEnvironment(cfg *handlersettings.HandlerSettings) []string {
+	variables := settingsVariables(cfg)
+	var env []string
+	for _, name := range settingsEnvironmentNames(cfg) {
+		env = append(env, name+"="+variables[name])
+	}
+	return env
+}
+
+// settingsEnvironmentNames returns the names of the environment variables of the settings, in order
+func settingsEnvironmentNames(cfg *handlersettings.HandlerSettings) []string {
+	var names []string
+	for name := range settingsVariables(cfg) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// settingsVariables returns the environment variables of the settings by name: the named parameters, overridden by
+// the environment variables and the resolved Key Vault references
+func settingsVariables(cfg *handlersettings.HandlerSettings) map[string]string {
+	variables := namedParameters(cfg)
+	for _, m := range []map[string]string{cfg.PublicSettings.EnvironmentVariables, cfg.ProtectedSettings.ProtectedEnvironmentVariables, cfg.KeyVaultSecrets} {
+		for name, value := range m {
+			variables[name] = value
+		}
+	}
+	return variables
+}
+
+// tempDirEnvironment returns the TMPDIR variable of the script, if it has a temporary directory. A named parameter
+// setting TMPDIR takes precedence.
+func tempDirEnvironment(cfg *handlersettings.HandlerSettings, tempDir string) []string {
+	if tempDir == "" || isNamedParameter(cfg, "TMPDIR") {
+		return nil
+	}
+	return []string{"TMPDIR=" + tempDir}
+}
+
+// stepEnvironment returns the variables telling a script allowed to reboot the step it executes and where to request
+// a reboot
+func stepEnvironment(cfg *handlersettings.HandlerSettings, workdir string) []string {
+	if !cfg.PublicSettings.AllowReboot {
+		return nil
+	}
+	return multistep.Environment(workdir)
+}
+
+// progressEnvironment returns the variable naming the file the script reports its progress to, if it was created
+func progressEnvironment(progressFile string) []string {
+	if progressFile == "" {
+		return nil
+	}
+	return []string{constants.ScriptProgressFileEnvName + "=" + progressFile}
+}
+
+// ProgressReportFilePath returns the path of the file the script executed in workdir reports its progress to, next
+// to the RunAs script when running as another user, who can't access the execution directory
+func ProgressReportFilePath(cfg *handlersettings.HandlerSettings, workdir string) string {
+	if cfg.PublicSettings.RunAsUser != "" && strings.HasPrefix(workdir, constants.DataDir) {
+		return datapaths.ProgressReportFilePath(datapaths.RunAsDownloadDir(cfg.PublicSettings.RunAsUser, workdir[len(constants.DataDir):]))
+	}
+	return datapaths.ProgressReportFilePath(workdir)
+}
+
+// createProgressReportFile creates the empty progress file of the script, writable by the given user only (the
+// current one if negative). The progress of a previous execution of the same sequence number is discarded.
+func createProgressReportFile(path string, uid int) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to clear the progress file")
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to create the progress file")
+	}
+	f.Close()
+	if uid >= 0 {
+		if err := os.Chown(path, uid, -1); err != nil {
+			return errors.Wrap(err, "failed to change owner of the progress file")
+		}
+	}
+	return nil
+}
+
+// isNamedParameter reports whether a named parameter sets the environment variable with the given name
+func isNamedParameter(cfg *handlersettings.HandlerSettings, name string) bool {
+	_, ok := namedParameters(cfg)[name]
+	return ok
+}
+
+// createTempDir creates an empty temporary directory only accessible by the given user (the current one if negative)
+func createTempDir(path string, uid int) error {
+	// A previous execution of the same sequence number may have left files behind
+	if err := os.RemoveAll(path); err != nil {
+		return errors.Wrap(err, "failed to clear temporary directory")
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return errors.Wrap(err, "failed to create temporary directory")
+	}
+	if uid >= 0 {
+		if err := os.Chown(path, uid, -1); err != nil {
+			return errors.Wrap(err, "failed to change owner of temporary directory")
+		}
+	}
+	return nil
+}
+
+func removeTempDir(ctx *log.Context, path string) {
+	if err := os.RemoveAll(path); err != nil {
+		ctx.Log("warning", "failed to remove the temporary directory of the script", "path", path, "error", err)
+	}
 }
 
 // ExecCmdInDir executes the given command in given directory and saves output
@@ -180,21 +418,34 @@ func ExecCmdInDir(ctx *log.Context, scriptFilePath, workdir string, cfg *handler
 
 	stdoutFileName, stderrFileName := LogPaths(workdir)
 
-	outF, err := os.OpenFile(stdoutFileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	outF, err := outputfile.Create(ctx, stdoutFileName, cfg.OutputSegmentSize())
 	if err != nil {
 		return errors.Wrapf(err, "failed to open stdout file"), constants.ExitCode_OpenStdOutFileFailed
 	}
-	errF, err := os.OpenFile(stderrFileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	errF, err := outputfile.Create(ctx, stderrFileName, cfg.OutputSegmentSize())
 	if err != nil {
+		outF.Close()
 		return errors.Wrapf(err, "failed to open stderr file"), constants.ExitCode_OpenStdErrFileFailed
 	}
 
-	exitCode, err := Exec(ctx, scriptFilePath, workdir, outF, errF, cfg)
+	interpreter, err := scriptInterpreter(cfg, scriptFilePath)
+	if err != nil {
+		ctx.Log("message", "failed to determine the interpreter of the script", "error", err)
+		fmt.Fprintln(errF, err)
+		outF.Close()
+		errF.Close()
+		return err, constants.ExitCode_InterpreterNotFound
+	}
+	if interpreter != "" {
+		ctx.Log("message", "launching the script with its interpreter", "interpreter", interpreter)
+	}
+
+	exitCode, err := execWithTempDir(ctx, scriptFilePath, interpreter, workdir, datapaths.TempDirPath(workdir), ProgressReportFilePath(cfg, workdir), outF, errF, cfg)
 	return err, exitCode
 }
 
 // LogPaths returns stdout and stderr file paths for the specified output
 // directory. It does not create the files.
 func LogPaths(dir string) (stdout string, stderr string) {
-	return filepath.Join(dir, "stdout"), filepath.Join(dir, "stderr")
+	return datapaths.OutputFilePaths(dir)
 }
@@ -5,11 +5,16 @@ import (
 	"errors"
 	"io/ioutil"
 	"os"
+	osexec "os/exec"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
 	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/outputstream"
 	"github.com/go-kit/kit/log"
 	"github.com/stretchr/testify/require"
 )
@@ -26,6 +31,32 @@ func TestExec_success(t *testing.T) {
 	require.EqualValues(t, 0, ec)
 }
 
+func TestExec_setsDefaultLocale(t *testing.T) {
+	o := new(mockFile)
+	_, err := Exec(testContext, "/bin/echo $LANG $LC_ALL", "/", o, new(mockFile), &testHandlerSettings)
+	require.Nil(t, err)
+	require.Equal(t, "C.UTF-8 C.UTF-8\n", o.b.String())
+}
+
+func TestExec_namedParameterOverridesLocale(t *testing.T) {
+	cfg := handlersettings.HandlerSettings{PublicSettings: handlersettings.PublicSettings{
+		Locale:     "en_US.UTF-8",
+		Parameters: []handlersettings.ParameterDefinition{{Name: "LC_ALL", Value: "POSIX"}},
+	}}
+	require.Equal(t, []string{"LANG=en_US.UTF-8"}, localeEnvironment(&cfg))
+}
+
+func TestExec_setsSettingsEnvironment(t *testing.T) {
+	cfg := handlersettings.HandlerSettings{
+		PublicSettings:    handlersettings.PublicSettings{EnvironmentVariables: map[string]string{"APP_ENV": "prod", "LANG": "POSIX"}},
+		ProtectedSettings: handlersettings.ProtectedSettings{ProtectedEnvironmentVariables: map[string]string{"API_KEY": "secret value"}},
+	}
+	o := new(mockFile)
+	_, err := Exec(testContext, "/bin/echo \"$APP_ENV $API_KEY $LANG\"", "/", o, new(mockFile), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, "prod secret value POSIX\n", o.b.String())
+}
+
 func TestExec_success_redirectsStdStreams_closesFds(t *testing.T) {
 	o, e := new(mockFile), new(mockFile)
 	require.False(t, o.closed, "stdout open")
@@ -48,11 +79,14 @@ func TestExec_failure_exitError(t *testing.T) {
 
 func TestExec_failure_timeout(t *testing.T) {
 	testHandlerSettings.PublicSettings.TimeoutInSeconds = 1
-	ec, err := Exec(testContext, "sleep 20", "/", new(mockFile), new(mockFile), &testHandlerSettings)
+	// The background process holding the output open is killed along with the script
+	begin := time.Now()
+	ec, err := Exec(testContext, "sleep 20 & sleep 20", "/", new(mockFile), new(mockFile), &testHandlerSettings)
 	testHandlerSettings.PublicSettings.TimeoutInSeconds = 0
 	require.NotNil(t, err)
-	require.EqualError(t, err, "command terminated with exit status=-1") // error is customized
-	require.EqualValues(t, -1, ec)
+	require.EqualError(t, err, "the script did not complete within 1 seconds and was killed")
+	require.EqualValues(t, constants.ExitCode_ScriptTimedOut, ec)
+	require.Less(t, time.Since(begin), 10*time.Second)
 }
 
 // func TestExec_runasuser(t *testing.T) {
@@ -70,26 +104,40 @@ func TestExec_failure_timeout(t *testing.T) {
 // 	require.Equal(t, "runcommand\n", string(o.b.Bytes()))
 // }
 
-func TestExec_SetEnvironmentVariables(t *testing.T) {
+func TestExec_parameters(t *testing.T) {
 	cfg := handlersettings.HandlerSettings{
 		PublicSettings: handlersettings.PublicSettings{
 			Parameters: []handlersettings.ParameterDefinition{
 				{Name: "Variable1", Value: "value1"},
 				{Name: "", Value: "arg1"},
+				{Name: "", Value: "it's $(not) expanded"},
 			},
 		},
 		ProtectedSettings: handlersettings.ProtectedSettings{
 			ProtectedParameters: []handlersettings.ParameterDefinition{
-				{Name: "Variable2", Value: "value2"},
+				{Name: "Variable2", Value: "value2; reboot"},
 				{Name: "", Value: "arg2"},
+				{Name: "Empty", Value: ""},
+				{Name: "APP-ENV", Value: "prod"},
+				{Name: "A=B", Value: "skipped"},
 			},
 		},
 	}
-	commandArgs, err := SetEnvironmentVariables(&cfg)
+	require.Equal(t, ` 'arg1' 'it'\''s $(not) expanded' 'arg2'`, scriptArguments(&cfg))
+	require.Equal(t, map[string]string{"Variable1": "value1", "Variable2": "value2; reboot", "APP-ENV": "prod"}, namedParameters(&cfg))
+	require.Equal(t, []string{"A=B"}, skippedParameterNames(&cfg))
+	require.Equal(t, []string{"APP-ENV=prod", "Variable1=value1", "Variable2=value2; reboot"}, settingsEnvironment(&cfg))
+	// The parameters are not leaked to the environment of the handler
+	require.Equal(t, "", os.Getenv("Variable1"))
+
+	dir := t.TempDir()
+	scriptPath := filepath.Join(dir, "script.sh")
+	require.Nil(t, os.WriteFile(scriptPath, []byte("#!/bin/bash\nprintf '%s|' \"$Variable2\" \"$(printenv APP-ENV)\" \"$@\"\n"), 0700))
+	err, _ := ExecCmdInDir(testContext, scriptPath, dir, &cfg)
+	require.Nil(t, err)
+	b, err := os.ReadFile(filepath.Join(dir, "stdout"))
 	require.Nil(t, err)
-	require.Equal(t, commandArgs, " arg1 arg2")
-	require.Equal(t, "value1", os.Getenv("Variable1"))
-	require.Equal(t, "value2", os.Getenv("Variable2"))
+	require.Equal(t, "value2; reboot|prod|arg1|it's $(not) expanded|arg2|", string(b))
 }
 
 func TestExec_failure_genericError(t *testing.T) {
@@ -140,6 +188,110 @@ func TestExecCmdInDir(t *testing.T) {
 	require.EqualValues(t, 0, len(b), "stderr file must be empty")
 }
 
+func TestExecCmdInDir_setsTempDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	err, _ = ExecCmdInDir(testContext, "/bin/echo $TMPDIR && touch $TMPDIR/file && ls -ld $TMPDIR | cut -c1-10", dir, &testHandlerSettings)
+	require.Nil(t, err)
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(dir, "tmp")+"\ndrwx------\n", string(b))
+	require.False(t, fileExists(t, filepath.Join(dir, "tmp")), "temporary directory should be removed")
+}
+
+func TestExecCmdInDir_setsProgressFile(t *testing.T) {
+	dir := t.TempDir()
+	progressFile := filepath.Join(dir, "progress.jsonl")
+	require.Nil(t, os.WriteFile(progressFile, []byte("{\"message\": \"previous execution\"}\n"), 0600))
+
+	err, _ := ExecCmdInDir(testContext, "/bin/echo $RUN_COMMAND_PROGRESS_FILE && /bin/echo '{\"percentComplete\": 50}' >> $RUN_COMMAND_PROGRESS_FILE", dir, &testHandlerSettings)
+	require.Nil(t, err)
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, progressFile+"\n", string(b))
+	// The progress of the previous execution is discarded
+	b, err = ioutil.ReadFile(progressFile)
+	require.Nil(t, err)
+	require.Equal(t, "{\"percentComplete\": 50}\n", string(b))
+}
+
+func TestProgressReportFilePath(t *testing.T) {
+	workdir := filepath.Join(constants.DataDir, "download", "RC0001", "3")
+	require.Equal(t, workdir+"/progress.jsonl", ProgressReportFilePath(&testHandlerSettings, workdir))
+
+	cfg := handlersettings.HandlerSettings{PublicSettings: handlersettings.PublicSettings{RunAsUser: "alice"}}
+	require.Equal(t, datapaths.RunAsDownloadDir("alice", "/download/RC0001/3")+"/progress.jsonl", ProgressReportFilePath(&cfg, workdir))
+}
+
+func TestExec_namedParameterOverridesTempDir(t *testing.T) {
+	require.Equal(t, []string{"TMPDIR=/seq/tmp"}, tempDirEnvironment(&testHandlerSettings, "/seq/tmp"))
+	require.Nil(t, tempDirEnvironment(&testHandlerSettings, ""))
+
+	cfg := handlersettings.HandlerSettings{PublicSettings: handlersettings.PublicSettings{
+		Parameters: []handlersettings.ParameterDefinition{{Name: "TMPDIR", Value: "/data/tmp"}},
+	}}
+	require.Nil(t, tempDirEnvironment(&cfg, "/seq/tmp"))
+}
+
+func TestExecCmdInDir_commandInterpreter(t *testing.T) {
+	dir := t.TempDir()
+	// The script is neither executable nor a shell script
+	scriptPath := filepath.Join(dir, "script.txt")
+	require.Nil(t, os.WriteFile(scriptPath, []byte("print text\n"), 0600))
+
+	cfg := handlersettings.HandlerSettings{PublicSettings: handlersettings.PublicSettings{CommandInterpreter: "/bin/cat"}}
+	err, exitCode := ExecCmdInDir(testContext, scriptPath, dir, &cfg)
+	require.Nil(t, err)
+	require.Equal(t, constants.ExitCode_Okay, exitCode)
+	b, err := os.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, "print text\n", string(b))
+}
+
+func TestExecCmdInDir_shebang(t *testing.T) {
+	dir := t.TempDir()
+	// The shebang launches the script even though it is not executable
+	scriptPath := filepath.Join(dir, "script.sh")
+	require.Nil(t, os.WriteFile(scriptPath, []byte("#!/bin/sh -e\r\necho $0\n"), 0600))
+	err, exitCode := ExecCmdInDir(testContext, scriptPath, dir, &testHandlerSettings)
+	require.Nil(t, err)
+	require.Equal(t, constants.ExitCode_Okay, exitCode)
+	b, err := os.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, scriptPath+"\n", string(b))
+
+	require.Nil(t, os.WriteFile(scriptPath, []byte("#!/usr/bin/env no-such-interpreter\nprint('hello')\n"), 0700))
+	err, exitCode = ExecCmdInDir(testContext, scriptPath, dir, &testHandlerSettings)
+	require.NotNil(t, err)
+	require.Equal(t, constants.ExitCode_InterpreterNotFound, exitCode)
+	b, err = os.ReadFile(filepath.Join(dir, "stderr"))
+	require.Nil(t, err)
+	require.Contains(t, string(b), "no-such-interpreter")
+}
+
+func TestExecCmdInDir_shebangIsNotExpanded(t *testing.T) {
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "expanded")
+	scriptPath := filepath.Join(dir, "script.sh")
+	require.Nil(t, os.WriteFile(scriptPath, []byte("#!/bin/echo  $(touch "+marker+"); touch "+marker+" `id`  \necho script\n"), 0600))
+
+	// The rest of the line is the single argument of the interpreter, as the kernel passes it
+	require.Equal(t, `'/bin/echo' '$(touch `+marker+`); touch `+marker+" `id`' '"+scriptPath+"'",
+		interpreterCommand(readShebang(scriptPath), scriptPath))
+
+	err, exitCode := ExecCmdInDir(testContext, scriptPath, dir, &testHandlerSettings)
+	require.Nil(t, err)
+	require.Equal(t, constants.ExitCode_Okay, exitCode)
+	b, err := os.ReadFile(filepath.Join(dir, "stdout"))
+	require.Nil(t, err)
+	require.Equal(t, "$(touch "+marker+"); touch "+marker+" `id` "+scriptPath+"\n", string(b))
+	require.NoFileExists(t, marker)
+}
+
 func TestExecCmdInDir_cantOpenError(t *testing.T) {
 	err, exitCode := ExecCmdInDir(testContext, "/bin/echo 'Hello world'", "/non-existing-dir", &testHandlerSettings)
 	require.Contains(t, err.Error(), "failed to open stdout file")
@@ -204,3 +356,149 @@ func fileExists(t *testing.T, path string) bool {
 	t.Fatalf("failed to check if %s exists: %v", path, err)
 	return false
 }
+
+func TestExec_streamsOutput(t *testing.T) {
+	broker := outputstream.NewBroker()
+	EnableOutputStreaming(broker)
+	defer EnableOutputStreaming(nil)
+
+	lines, unsubscribe := broker.Subscribe(func(outputstream.Line) bool { return true })
+	defer unsubscribe()
+
+	o, e := new(mockFile), new(mockFile)
+	ec, err := Exec(testContext, "/bin/echo 'line 1'; /bin/echo 'line 2' >&2", "/tmp", o, e, &testHandlerSettings)
+	require.Nil(t, err)
+	require.EqualValues(t, 0, ec)
+	require.Equal(t, "line 1\n", string(o.b.Bytes()))
+	require.Equal(t, "line 2\n", string(e.b.Bytes()))
+	require.True(t, o.closed, "stdout closed")
+
+	streamed := map[string]string{}
+	for i := 0; i < 2; i++ {
+		l := <-lines
+		require.Equal(t, "/tmp", l.Dir)
+		streamed[l.Stream] = l.Text
+	}
+	require.Equal(t, map[string]string{outputstream.Stdout: "line 1", outputstream.Stderr: "line 2"}, streamed)
+}
+
+func TestExec_lineProcessors(t *testing.T) {
+	var mu sync.Mutex
+	var processed []string
+	newProcessor := func(name string) LineProcessor {
+		return LineProcessorFunc(func(l outputstream.Line) {
+			mu.Lock()
+			defer mu.Unlock()
+			processed = append(processed, name+":"+l.Stream+":"+l.Text)
+		})
+	}
+	unregisterFirst := RegisterLineProcessor(newProcessor("first"))
+	unregisterSecond := RegisterLineProcessor(newProcessor("second"))
+	defer unregisterSecond()
+
+	ec, err := Exec(testContext, "/bin/echo 'line 1'; /bin/echo 'line 2'", "/tmp", new(mockFile), new(mockFile), &testHandlerSettings)
+	require.Nil(t, err)
+	require.EqualValues(t, 0, ec)
+	require.Equal(t, []string{"first:stdout:line 1", "second:stdout:line 1", "first:stdout:line 2", "second:stdout:line 2"}, processed)
+
+	unregisterFirst()
+	processed = nil
+	_, err = Exec(testContext, "/bin/echo 'line 3' >&2", "/tmp", new(mockFile), new(mockFile), &testHandlerSettings)
+	require.Nil(t, err)
+	require.Equal(t, []string{"second:stderr:line 3"}, processed)
+}
+
+func TestExec_recordsRunningScriptPid(t *testing.T) {
+	dir := t.TempDir()
+	_, running := RunningScriptPid(dir)
+	require.False(t, running)
+
+	done := make(chan bool)
+	go func() {
+		Exec(testContext, "sleep 1", dir, new(mockFile), new(mockFile), &testHandlerSettings)
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool {
+		pid, running := RunningScriptPid(dir)
+		return running && pid > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	<-done
+	_, running = RunningScriptPid(dir)
+	require.False(t, running)
+}
+
+func TestExec_killRunningScript(t *testing.T) {
+	dir := t.TempDir()
+	require.False(t, KillRunningScript(testContext, dir), "no script is executing")
+
+	done := make(chan bool)
+	go func() {
+		Exec(testContext, "sleep 60 & sleep 60", dir, new(mockFile), new(mockFile), &testHandlerSettings)
+		close(done)
+	}()
+	require.Eventually(t, func() bool {
+		_, running := RunningScriptPid(dir)
+		return running
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.True(t, KillRunningScript(testContext, dir))
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		require.Fail(t, "the script and its background process were not killed")
+	}
+}
+
+func TestExec_restrictsCapabilities(t *testing.T) {
+	if _, err := os.Stat(setprivPath); err != nil || os.Geteuid() != 0 {
+		t.Skip("requires setpriv and root")
+	}
+	cfg := handlersettings.HandlerSettings{PublicSettings: handlersettings.PublicSettings{Capabilities: []string{"CAP_NET_ADMIN"}}}
+	o := new(mockFile)
+	_, err := Exec(testContext, "grep -E '^Cap(Eff|Bnd|Amb)' /proc/self/status", "/", o, new(mockFile), &cfg)
+	require.Nil(t, err)
+	// CAP_NET_ADMIN is capability 12
+	require.Equal(t, "CapEff:\t0000000000001000\nCapBnd:\t0000000000001000\nCapAmb:\t0000000000001000\n", o.b.String())
+}
+
+func TestExec_capabilitiesRequireSetpriv(t *testing.T) {
+	defer func(path string) { setprivPath = path }(setprivPath)
+	setprivPath = filepath.Join(t.TempDir(), "setpriv")
+
+	cfg := handlersettings.HandlerSettings{PublicSettings: handlersettings.PublicSettings{Capabilities: []string{}}}
+	ec, err := Exec(testContext, "date", "/", new(mockFile), new(mockFile), &cfg)
+	require.ErrorContains(t, err, "'capabilities' and the sandbox of the execution profile require")
+	require.Equal(t, constants.ExitCode_CapabilitiesNotSupported, ec)
+}
+
+func TestExec_resourceLimits(t *testing.T) {
+	cfg := handlersettings.HandlerSettings{PublicSettings: handlersettings.PublicSettings{
+		ResourceLimits: &handlersettings.ResourceLimits{MaxOpenFiles: 64, MaxFileSizeInMB: 10},
+	}}
+	o := new(mockFile)
+	_, err := Exec(testContext, "ulimit -H -n && ulimit -S -n && ulimit -f", "/", o, new(mockFile), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, "64\n64\n10240\n", o.b.String())
+
+	// The script of the RunAs user is bounded once sudo switched to the user
+	cfg.PublicSettings.RunAsUser = "azureuser"
+	require.Equal(t, "sudo -u azureuser script", resourceLimitsCommand(&cfg, "sudo -u azureuser script"))
+	command := runAsResourceLimitsCommand(&cfg, `/bin/echo 'it'\''s' limited`)
+	require.Equal(t, `/bin/bash -c 'ulimit -n 64 && ulimit -f 10240 && exec "$@"' bash /bin/echo 'it'\''s' limited`, command)
+	out, err := osexec.Command("/bin/bash", "-c", command).Output()
+	require.Nil(t, err)
+	require.Equal(t, "it's limited\n", string(out))
+}
+
+func TestExec_noNewPrivileges(t *testing.T) {
+	if _, err := os.Stat(setprivPath); err != nil {
+		t.Skip("requires setpriv")
+	}
+	cfg := handlersettings.HandlerSettings{PublicSettings: handlersettings.PublicSettings{NoNewPrivileges: true}}
+	o := new(mockFile)
+	_, err := Exec(testContext, "grep '^NoNewPrivs' /proc/self/status", "/", o, new(mockFile), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, "NoNewPrivs:\t1\n", o.b.String())
+}
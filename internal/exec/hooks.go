@@ -0,0 +1,75 @@
+package exec
+
+import (
+	"sync"
+
+	"github.com/Azure/run-command-handler-linux/internal/outputstream"
+)
+
+// LineProcessor observes the output of the scripts line by line as it is produced, e.g., to redact it, parse
+// progress, extract metrics or stream it, so the output features compose instead of each reading the output
+// files again. Lines are processed on the goroutine copying the output, so ProcessLine must not block.
+type LineProcessor interface {
+	ProcessLine(l outputstream.Line)
+}
+
+// LineProcessorFunc is a function used as a LineProcessor
+type LineProcessorFunc func(l outputstream.Line)
+
+// ProcessLine calls f(l)
+func (f LineProcessorFunc) ProcessLine(l outputstream.Line) {
+	f(l)
+}
+
+// lineProcessorRegistration is a registered processor, a pointer so the same processor can be registered twice
+type lineProcessorRegistration struct {
+	processor LineProcessor
+}
+
+var (
+	lineProcessorsLock sync.Mutex
+	lineProcessors     []*lineProcessorRegistration
+)
+
+// RegisterLineProcessor makes p observe the output of the scripts executed by this process from their next
+// execution on. Processors observe the lines in the order they were registered. It returns a function to
+// unregister p.
+func RegisterLineProcessor(p LineProcessor) (unregister func()) {
+	r := &lineProcessorRegistration{processor: p}
+	lineProcessorsLock.Lock()
+	lineProcessors = append(lineProcessors, r)
+	lineProcessorsLock.Unlock()
+
+	return func() {
+		lineProcessorsLock.Lock()
+		defer lineProcessorsLock.Unlock()
+		for i, registered := range lineProcessors {
+			if registered == r {
+				lineProcessors = append(lineProcessors[:i:i], lineProcessors[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// lineDispatcher passes the lines of an execution to the processors registered when it started
+type lineDispatcher []LineProcessor
+
+// getLineDispatcher returns the processors currently registered, nil if there are none
+func getLineDispatcher() lineDispatcher {
+	lineProcessorsLock.Lock()
+	defer lineProcessorsLock.Unlock()
+
+	var d lineDispatcher
+	for _, r := range lineProcessors {
+		d = append(d, r.processor)
+	}
+	return d
+}
+
+// Publish passes l to every processor
+func (d lineDispatcher) Publish(l outputstream.Line) {
+	for _, p := range d {
+		p.ProcessLine(l)
+	}
+}
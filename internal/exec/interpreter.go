@@ -0,0 +1,62 @@
+package exec
+
+import (
+	"io"
+	"os"
+
+	"github.com/Azure/run-command-handler-linux/internal/files"
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/pkg/preprocess"
+	"github.com/pkg/errors"
+)
+
+// maxShebangLength bounds how much of the script is read to find its shebang, longer lines are truncated by the
+// kernel anyway
+const maxShebangLength = 4096
+
+// scriptInterpreter returns the interpreter line launching the script at scriptPath, e.g. "/usr/bin/env python3":
+// the commandInterpreter of the settings, or else the shebang of the script. Launching the script with it reports a
+// missing interpreter before the script runs and doesn't depend on the executable bit of a downloaded script. It is
+// empty for a script without a shebang, or which can't be read, that bash runs as before.
+func scriptInterpreter(cfg *handlersettings.HandlerSettings, scriptPath string) (string, error) {
+	interpreter := cfg.CommandInterpreter()
+	if interpreter == "" {
+		if interpreter = readShebang(scriptPath); interpreter == "" {
+			return "", nil
+		}
+	}
+	if err := files.CheckInterpreter(interpreter); err != nil {
+		return "", errors.Wrap(err, "the script can't be launched")
+	}
+	return interpreter, nil
+}
+
+// readShebang returns the interpreter line of the shebang of the script at scriptPath, empty if it has none
+func readShebang(scriptPath string) string {
+	f, err := os.Open(scriptPath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	b, err := io.ReadAll(io.LimitReader(f, maxShebangLength))
+	if err != nil {
+		return ""
+	}
+	interpreter, _ := preprocess.Shebang(b)
+	return interpreter
+}
+
+// interpreterCommand returns the command launching the script at scriptPath with interpreter, the script itself if
+// interpreter is empty. The interpreter and its argument are split as the kernel does and quoted, so nothing in the
+// shebang is expanded by bash.
+func interpreterCommand(interpreter, scriptPath string) string {
+	if interpreter == "" {
+		return scriptPath
+	}
+	path, arg := files.SplitInterpreter(interpreter)
+	command := ShellQuote(path)
+	if arg != "" {
+		command += " " + ShellQuote(arg)
+	}
+	return command + " " + ShellQuote(scriptPath)
+}
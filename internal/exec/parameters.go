@@ -0,0 +1,67 @@
+package exec
+
+import (
+	"strings"
+
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+)
+
+// parameters returns the parameters of the settings with a value, the public ones first
+func parameters(cfg *handlersettings.HandlerSettings) []handlersettings.ParameterDefinition {
+	var parameters []handlersettings.ParameterDefinition
+	for _, p := range append(append([]handlersettings.ParameterDefinition{}, cfg.PublicSettings.Parameters...), cfg.ProtectedSettings.ProtectedParameters...) {
+		if p.Value != "" {
+			parameters = append(parameters, p)
+		}
+	}
+	return parameters
+}
+
+// scriptArguments returns the unnamed parameters of the settings as the arguments appended to the command of the
+// script, each preceded by a space. Every value is quoted for bash, so it is passed as a single argument as is,
+// whatever spaces, quotes or expansions it contains.
+func scriptArguments(cfg *handlersettings.HandlerSettings) string {
+	var args string
+	for _, p := range parameters(cfg) {
+		if p.Name == "" {
+			args += " " + ShellQuote(p.Value)
+		}
+	}
+	return args
+}
+
+// namedParameters returns the named parameters of the settings, set as environment variables of the script. They
+// are passed in the environment of the script rather than in its command, and so never go through bash. A name
+// which is not a shell identifier (e.g., APP-ENV) is not a variable of bash, but bash passes it in the environment
+// of the programs it executes. The parameters whose names can't be environment variables are skipped.
+func namedParameters(cfg *handlersettings.HandlerSettings) map[string]string {
+	variables := make(map[string]string)
+	for _, p := range parameters(cfg) {
+		if p.Name != "" && isEnvironmentName(p.Name) {
+			variables[p.Name] = p.Value
+		}
+	}
+	return variables
+}
+
+// skippedParameterNames returns the names of the named parameters skipped by namedParameters
+func skippedParameterNames(cfg *handlersettings.HandlerSettings) []string {
+	var names []string
+	for _, p := range parameters(cfg) {
+		if p.Name != "" && !isEnvironmentName(p.Name) {
+			names = append(names, p.Name)
+		}
+	}
+	return names
+}
+
+// isEnvironmentName reports whether name can be the name of an environment variable
+func isEnvironmentName(name string) bool {
+	return !strings.ContainsAny(name, "=\x00")
+}
+
+// ShellQuote quotes s as a single word for bash: within single quotes nothing is expanded, and a single quote is
+// written as a quoted backslash-escaped one
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
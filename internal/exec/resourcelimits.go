@@ -0,0 +1,48 @@
+package exec
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+)
+
+// resourceLimits returns the ulimit builtins of bash bounding the resources of the script, joined by &&, if any.
+// ulimit sets both the soft and hard limits, so the processes of the script can't raise them unless they have
+// CAP_SYS_RESOURCE. The memory is not bounded: the limit of ulimit is on the virtual memory, which runtimes
+// reserving large address spaces (e.g., the JVM or Go) exceed whatever memory they use.
+func resourceLimits(cfg *handlersettings.HandlerSettings) string {
+	l := cfg.PublicSettings.ResourceLimits
+	if l == nil {
+		return ""
+	}
+	var limits []string
+	if l.MaxOpenFiles > 0 {
+		limits = append(limits, fmt.Sprintf("ulimit -n %d", l.MaxOpenFiles))
+	}
+	if l.MaxFileSizeInMB > 0 {
+		limits = append(limits, fmt.Sprintf("ulimit -f %d", l.MaxFileSizeInMB*1024))
+	}
+	return strings.Join(limits, " && ")
+}
+
+// resourceLimitsCommand returns cmd preceded by the resource limits of the script, if any. The script of the RunAs
+// user is bounded within the command sudo runs instead, see runAsResourceLimitsCommand.
+func resourceLimitsCommand(cfg *handlersettings.HandlerSettings, cmd string) string {
+	limits := resourceLimits(cfg)
+	if limits == "" || cfg.PublicSettings.RunAsUser != "" {
+		return cmd
+	}
+	return limits + " && " + cmd
+}
+
+// runAsResourceLimitsCommand returns the command sudo runs for the RunAs user, cmd, bounded by the resource limits
+// of the script, if any. sudo and the PAM session it opens (e.g., pam_limits) set the resource limits of the user,
+// so the limits are set by a bash executing cmd once sudo switched to the user.
+func runAsResourceLimitsCommand(cfg *handlersettings.HandlerSettings, cmd string) string {
+	limits := resourceLimits(cfg)
+	if limits == "" {
+		return cmd
+	}
+	return "/bin/bash -c '" + limits + ` && exec "$@"' bash ` + cmd
+}
@@ -0,0 +1,70 @@
+package exec
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/pkg/errors"
+)
+
+// runAsSudoOptions returns the sudo options switching to the RunAs user. HOME is set to the home directory of the
+// user and, with runAsLoginShell, the script runs in its login shell, which loads its profile and starts in its home
+// directory as sudo -i does. An elevated script runs as root on behalf of the user. The environment variables of the
+// settings are preserved by name, so their values are not part of the command.
+func runAsSudoOptions(cfg *handlersettings.HandlerSettings) string {
+	target := cfg.PublicSettings.RunAsUser
+	if cfg.PublicSettings.RunAsElevated {
+		target = "root"
+	}
+	options := " -H -u " + target
+	if cfg.PublicSettings.RunAsLoginShell {
+		options = " -i" + options
+	}
+	if names := settingsEnvironmentNames(cfg); len(names) > 0 {
+		options += " --preserve-env=" + strings.Join(names, ",")
+	}
+	return options
+}
+
+// checkElevation returns an error unless sudo allows username to run command as root, which an elevated script
+// requires. command is the command line sudo runs, read by the shell like the command line of the script so sudo
+// checks the same command and arguments.
+func checkElevation(username string, command string) error {
+	out, err := exec.Command("/bin/sh", "-c", "sudo -n -l -U "+ShellQuote(username)+" -u root "+command).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	message := fmt.Sprintf("sudo does not allow user '%s' to run the script as root", username)
+	if out := strings.TrimSpace(string(out)); out != "" {
+		message += " (" + out + ")"
+	}
+	return errors.Wrap(err, message)
+}
+
+// LookPathFunc returns how to find the commands required by the script in the PATH it executes with: the PATH of the
+// handler, or with runAsUser, the PATH sudo gives the RunAs user. That is the PATH of its login shell with
+// runAsLoginShell, else the secure_path of sudo if set.
+func LookPathFunc(cfg *handlersettings.HandlerSettings) func(name string) (string, error) {
+	if cfg.PublicSettings.RunAsUser == "" {
+		return exec.LookPath
+	}
+	target := cfg.PublicSettings.RunAsUser
+	if cfg.PublicSettings.RunAsElevated {
+		target = "root"
+	}
+	options := []string{"-n", "-H", "-u", target}
+	if cfg.PublicSettings.RunAsLoginShell {
+		options = append([]string{"-i"}, options...)
+	}
+	return func(name string) (string, error) {
+		// The handler runs as root, sudo doesn't prompt for the password of the user
+		out, err := exec.Command("sudo", append(options, "sh", "-c", `command -v "$0"`, name)...).Output()
+		path := strings.TrimSpace(string(out))
+		if err != nil || path == "" {
+			return "", errors.Wrapf(exec.ErrNotFound, "'%s' is not in the PATH of user '%s'", name, target)
+		}
+		return path, nil
+	}
+}
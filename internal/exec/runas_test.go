@@ -0,0 +1,106 @@
+package exec
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_runAsSudoOptions(t *testing.T) {
+	cfg := handlersettings.HandlerSettings{PublicSettings: handlersettings.PublicSettings{RunAsUser: "user1"}}
+	require.Equal(t, " -H -u user1", runAsSudoOptions(&cfg))
+
+	cfg.PublicSettings.RunAsLoginShell = true
+	require.Equal(t, " -i -H -u user1", runAsSudoOptions(&cfg))
+
+	cfg.PublicSettings.RunAsElevated = true
+	require.Equal(t, " -i -H -u root", runAsSudoOptions(&cfg))
+
+	cfg.PublicSettings.EnvironmentVariables = map[string]string{"B": "public"}
+	cfg.ProtectedSettings.ProtectedEnvironmentVariables = map[string]string{"A": "secret"}
+	require.Equal(t, " -i -H -u root --preserve-env=A,B", runAsSudoOptions(&cfg))
+}
+
+// installSudo installs a sudo in the PATH executing script once it recorded its arguments, one invocation per line,
+// to the file returned
+func installSudo(t *testing.T, script string) string {
+	dir := t.TempDir()
+	args := filepath.Join(dir, "args")
+	script = "#!/bin/sh\nprintf '%s\\n' \"$*\" >> " + args + "\n" + script
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "sudo"), []byte(script), 0700))
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+	return args
+}
+
+// fakeSudo installs a sudo executing the command it is passed after its options, as the RunAs user whose PATH is path
+func fakeSudo(t *testing.T, path string) string {
+	return installSudo(t, "while [ \"$1\" != sh ]; do shift; done\nPATH="+path+" exec \"$@\"\n")
+}
+
+func Test_checkElevation(t *testing.T) {
+	// The sudoers of the VM allow user1 to run the script as root with the argument 'a b' only, sudo -l prints the
+	// command allowed
+	args := installSudo(t, `shift 6
+if [ "$#" = 3 ] && [ "$1" = /bin/bash ] && [ "$2" = /home/user1/script.sh ] && [ "$3" = "a b" ]; then
+	echo /bin/bash
+	exit 0
+fi
+echo "Sorry, user user1 is not allowed to execute '$*' as root."
+exit 1
+`)
+
+	require.Nil(t, checkElevation("user1", "/bin/bash '/home/user1/script.sh' 'a b'"))
+
+	err := checkElevation("user1", "/bin/bash '/home/user1/script.sh' 'a' 'b'")
+	require.EqualError(t, err, "sudo does not allow user 'user1' to run the script as root (Sorry, user user1 is not allowed to execute '/bin/bash /home/user1/script.sh a b' as root.): exit status 1")
+	err = checkElevation("user1", "env TMPDIR=/tmp/x /bin/bash '/home/user1/script.sh' 'a b'")
+	require.NotNil(t, err, "sudo runs env, which is not allowed")
+
+	b, err := os.ReadFile(args)
+	require.Nil(t, err)
+	require.Equal(t, []string{
+		"-n -l -U user1 -u root /bin/bash /home/user1/script.sh a b",
+		"-n -l -U user1 -u root /bin/bash /home/user1/script.sh a b",
+		"-n -l -U user1 -u root env TMPDIR=/tmp/x /bin/bash /home/user1/script.sh a b",
+	}, strings.Split(strings.TrimSpace(string(b)), "\n"))
+}
+
+func Test_LookPathFunc(t *testing.T) {
+	userBin := t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(userBin, "usertool"), []byte("#!/bin/sh\n"), 0755))
+	args := fakeSudo(t, userBin+":/usr/bin:/bin")
+
+	// Without RunAs, the commands are found in the PATH of the handler
+	cfg := handlersettings.HandlerSettings{}
+	_, err := LookPathFunc(&cfg)("usertool")
+	require.NotNil(t, err)
+	path, err := LookPathFunc(&cfg)("sh")
+	require.Nil(t, err)
+	require.NotEmpty(t, path)
+	require.NoFileExists(t, args)
+
+	// With RunAs, they are found in the PATH of the user
+	cfg.PublicSettings.RunAsUser = "user1"
+	path, err = LookPathFunc(&cfg)("usertool")
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(userBin, "usertool"), path)
+	_, err = LookPathFunc(&cfg)("missing-tool")
+	require.EqualError(t, err, "'missing-tool' is not in the PATH of user 'user1': executable file not found in $PATH")
+
+	cfg.PublicSettings.RunAsLoginShell = true
+	cfg.PublicSettings.RunAsElevated = true
+	_, err = LookPathFunc(&cfg)("usertool")
+	require.Nil(t, err)
+
+	b, err := os.ReadFile(args)
+	require.Nil(t, err)
+	require.Equal(t, []string{
+		`-n -H -u user1 sh -c command -v "$0" usertool`,
+		`-n -H -u user1 sh -c command -v "$0" missing-tool`,
+		`-i -n -H -u root sh -c command -v "$0" usertool`,
+	}, strings.Split(strings.TrimSpace(string(b)), "\n"))
+}
@@ -0,0 +1,109 @@
+package exec
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/pkg/errors"
+)
+
+// runAsGroups describes the groups a RunAs script runs with
+type runAsGroups struct {
+	// primaryGid is the primary group of the script. Empty to keep the primary group of the RunAs user.
+	primaryGid string
+
+	// groupIds is the complete group vector of the script. Nil to keep the groups of the RunAs user.
+	groupIds []uint32
+}
+
+// resolveRunAsGroups looks up the groups requested in the settings for the given RunAs user. Supplementary
+// groups are added to the groups the user is already a member of.
+func resolveRunAsGroups(runAsUser *user.User, cfg *handlersettings.HandlerSettings) (runAsGroups, error) {
+	var groups runAsGroups
+	if cfg.PublicSettings.RunAsGroup != "" {
+		g, err := lookupGroup(cfg.PublicSettings.RunAsGroup)
+		if err != nil {
+			return groups, err
+		}
+		groups.primaryGid = g.Gid
+	}
+
+	if len(cfg.PublicSettings.RunAsSupplementaryGroups) == 0 {
+		return groups, nil
+	}
+
+	userGroupIds, err := runAsUser.GroupIds()
+	if err != nil {
+		return groups, errors.Wrapf(err, "failed to get the groups of user '%s'", runAsUser.Username)
+	}
+
+	seen := make(map[uint32]bool)
+	for _, gid := range userGroupIds {
+		if err := groups.addGroupId(gid, seen); err != nil {
+			return groups, err
+		}
+	}
+	for _, name := range cfg.PublicSettings.RunAsSupplementaryGroups {
+		g, err := lookupGroup(name)
+		if err != nil {
+			return groups, err
+		}
+		if err := groups.addGroupId(g.Gid, seen); err != nil {
+			return groups, err
+		}
+	}
+	return groups, nil
+}
+
+func (g *runAsGroups) addGroupId(gid string, seen map[uint32]bool) error {
+	id, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return errors.Wrapf(err, "invalid group id '%s'", gid)
+	}
+	if !seen[uint32(id)] {
+		seen[uint32(id)] = true
+		g.groupIds = append(g.groupIds, uint32(id))
+	}
+	return nil
+}
+
+// sudoArgs returns the sudo arguments applying the groups. The group vector of sudo is preserved (-P)
+// when supplementary groups are requested, see sysProcAttr.
+func (g runAsGroups) sudoArgs() string {
+	args := ""
+	if g.primaryGid != "" {
+		args += fmt.Sprintf(" -g '#%s'", g.primaryGid)
+	}
+	if g.groupIds != nil {
+		args += " -P"
+	}
+	return args
+}
+
+// sysProcAttr returns the attributes giving the sudo invocation the group vector of the script, if any
+func (g runAsGroups) sysProcAttr() *syscall.SysProcAttr {
+	if g.groupIds == nil {
+		return nil
+	}
+	return &syscall.SysProcAttr{Credential: &syscall.Credential{
+		Uid:    uint32(os.Getuid()),
+		Gid:    uint32(os.Getgid()),
+		Groups: g.groupIds,
+	}}
+}
+
+// lookupGroup finds a group by name or, if numeric, by id
+func lookupGroup(nameOrId string) (*user.Group, error) {
+	if _, err := strconv.ParseUint(nameOrId, 10, 32); err == nil {
+		if g, err := user.LookupGroupId(nameOrId); err == nil {
+			return g, nil
+		}
+	}
+
+	g, err := user.LookupGroup(nameOrId)
+	return g, errors.Wrapf(err, "failed to lookup group '%s'", nameOrId)
+}
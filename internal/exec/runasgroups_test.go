@@ -0,0 +1,59 @@
+package exec
+
+import (
+	"os/user"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_resolveRunAsGroups_none(t *testing.T) {
+	u, err := user.Current()
+	require.Nil(t, err)
+
+	groups, err := resolveRunAsGroups(u, &testHandlerSettings)
+	require.Nil(t, err)
+	require.Equal(t, "", groups.sudoArgs())
+	require.Nil(t, groups.sysProcAttr())
+}
+
+func Test_resolveRunAsGroups_primaryAndSupplementary(t *testing.T) {
+	u, err := user.Current()
+	require.Nil(t, err)
+	root, err := user.LookupGroupId("0")
+	require.Nil(t, err)
+
+	cfg := handlersettings.HandlerSettings{PublicSettings: handlersettings.PublicSettings{
+		RunAsUser:                u.Username,
+		RunAsGroup:               root.Name,
+		RunAsSupplementaryGroups: []string{"0", root.Name},
+	}}
+	groups, err := resolveRunAsGroups(u, &cfg)
+	require.Nil(t, err)
+	require.Equal(t, " -g '#0' -P", groups.sudoArgs())
+
+	attr := groups.sysProcAttr()
+	require.NotNil(t, attr)
+	require.Contains(t, attr.Credential.Groups, uint32(0))
+
+	// Groups are not duplicated
+	seen := make(map[uint32]bool)
+	for _, gid := range attr.Credential.Groups {
+		require.False(t, seen[gid])
+		seen[gid] = true
+	}
+}
+
+func Test_resolveRunAsGroups_unknownGroup(t *testing.T) {
+	u, err := user.Current()
+	require.Nil(t, err)
+
+	cfg := handlersettings.HandlerSettings{PublicSettings: handlersettings.PublicSettings{
+		RunAsUser:  u.Username,
+		RunAsGroup: "non-existing-group-name",
+	}}
+	_, err = resolveRunAsGroups(u, &cfg)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "non-existing-group-name")
+}
@@ -0,0 +1,116 @@
+package exec
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/featureflags"
+	"github.com/Azure/run-command-handler-linux/internal/outputstream"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// streamDrainTimeout bounds how long the output of a script is copied after it exits. Background processes
+// started by the script may keep the output open.
+const streamDrainTimeout = 5 * time.Second
+
+// unregisterOutputBroker stops publishing to the broker passed to EnableOutputStreaming, nil if there is none
+var unregisterOutputBroker func()
+
+// EnableOutputStreaming publishes the output of the scripts executed by this process to broker. A nil broker
+// disables streaming.
+func EnableOutputStreaming(broker *outputstream.Broker) {
+	if unregisterOutputBroker != nil {
+		unregisterOutputBroker()
+		unregisterOutputBroker = nil
+	}
+	if broker != nil {
+		unregisterOutputBroker = RegisterLineProcessor(LineProcessorFunc(broker.Publish))
+	}
+}
+
+// streamOutput makes command write its output to stdout and stderr through pipes passing every line to the
+// registered line processors. It returns a function to call once the command exited, which waits for the output
+// to be copied and returns the error copying it, as exec.Cmd.Wait does. Output is written directly if it goes to files and either no processor is registered or streaming
+// is disabled by its feature flag, or if the pipes fail to be set up.
+func streamOutput(ctx *log.Context, command *exec.Cmd, workdir string, stdout, stderr io.Writer) func() error {
+	dispatcher := getLineDispatcher()
+	if !featureflags.Enabled(ctx, featureflags.OutputStreaming) {
+		dispatcher = nil
+	}
+	// The output written through a writer which is not a file (e.g., compressed) is copied from pipes anyway, and
+	// exec.Cmd would wait for the background processes of the script to close them
+	_, stdoutIsFile := stdout.(*os.File)
+	_, stderrIsFile := stderr.(*os.File)
+	if dispatcher == nil && stdoutIsFile && stderrIsFile {
+		command.Stdout = stdout
+		command.Stderr = stderr
+		return func() error { return nil }
+	}
+
+	stdoutPipe, stdoutDone, err := newStreamPipe(dispatcher, workdir, outputstream.Stdout, stdout)
+	if err != nil {
+		ctx.Log("warning", "failed to stream the output of the script", "error", err)
+		command.Stdout = stdout
+		command.Stderr = stderr
+		return func() error { return nil }
+	}
+	stderrPipe, stderrDone, err := newStreamPipe(dispatcher, workdir, outputstream.Stderr, stderr)
+	if err != nil {
+		ctx.Log("warning", "failed to stream the output of the script", "error", err)
+		stdoutPipe.Close()
+		<-stdoutDone
+		command.Stdout = stdout
+		command.Stderr = stderr
+		return func() error { return nil }
+	}
+
+	// The pipes are files, so the command does not wait for the copies to finish
+	command.Stdout = stdoutPipe
+	command.Stderr = stderrPipe
+	return func() error {
+		stdoutPipe.Close()
+		stderrPipe.Close()
+
+		var copyErr error
+		timeout := time.After(streamDrainTimeout)
+		for _, done := range []<-chan error{stdoutDone, stderrDone} {
+			select {
+			case err := <-done:
+				if copyErr == nil {
+					copyErr = err
+				}
+			case <-timeout:
+				ctx.Log("warning", "the output of the script is still open after it exited, it will not be fully saved")
+				return copyErr
+			}
+		}
+		return copyErr
+	}
+}
+
+// newStreamPipe returns the write end of a pipe copied to dst and, line by line, to dispatcher unless it is nil, and
+// a channel receiving the error of the copy once it is done
+func newStreamPipe(dispatcher lineDispatcher, workdir string, stream string, dst io.Writer) (*os.File, <-chan error, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to create %s pipe", stream)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer r.Close()
+		if dispatcher == nil {
+			_, err := io.Copy(dst, r)
+			done <- err
+			return
+		}
+		lines := outputstream.NewLineWriter(dispatcher, workdir, stream)
+		_, err := io.Copy(io.MultiWriter(dst, lines), r)
+		lines.Close()
+		done <- err
+	}()
+	return w, done, nil
+}
@@ -0,0 +1,199 @@
+// Package executionqueue limits the number of scripts executing at the same time on the machine.
+//
+// Execution slots and queue tickets are files locked with flock in a directory shared by every run
+// command process (standard and immediate), so the limit applies across extensions and the kernel
+// releases the slot and the ticket of a process that dies.
+package executionqueue
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/pkg/counterutil"
+	"github.com/pkg/errors"
+)
+
+const (
+	ticketPrefix = "ticket-"
+	slotPrefix   = "slot-"
+
+	defaultPollInterval = time.Second
+)
+
+var ticketCount counterutil.AtomicCount
+
+// Queue hands out a limited number of execution slots in FIFO order
+type Queue struct {
+	dir          string
+	limit        int
+	pollInterval time.Duration
+}
+
+// ticket is the place of a caller in the queue, locked until removed
+type ticket struct {
+	f    *os.File
+	name string
+	path string
+}
+
+// Slot is an execution slot held until released
+type Slot struct {
+	f *os.File
+}
+
+// New returns a queue keeping its state in dir and allowing at most limit concurrent executions
+func New(dir string, limit int) *Queue {
+	if limit < 1 {
+		limit = 1
+	}
+	return &Queue{dir: dir, limit: limit, pollInterval: defaultPollInterval}
+}
+
+// Wait enqueues the caller and blocks until it gets an execution slot or ctx is done. While waiting,
+// onPosition is called with the 1-based position of the caller in the queue every time it changes.
+func (q *Queue) Wait(ctx context.Context, onPosition func(position int)) (*Slot, error) {
+	if err := os.MkdirAll(q.dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create execution queue directory")
+	}
+
+	t, err := q.enqueue()
+	if err != nil {
+		return nil, err
+	}
+	defer t.remove()
+
+	lastPosition := 0
+	for {
+		position, err := q.position(t.name)
+		if err != nil {
+			return nil, err
+		}
+
+		// Only the head of the queue takes a slot, so scripts start in the order they arrived
+		if position == 1 {
+			if slot, err := q.tryAcquireSlot(); err != nil {
+				return nil, err
+			} else if slot != nil {
+				return slot, nil
+			}
+		}
+
+		if position != lastPosition {
+			lastPosition = position
+			if onPosition != nil {
+				onPosition(position)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(q.pollInterval):
+		}
+	}
+}
+
+// Release gives the slot back to the queue. It is safe to call on a nil slot.
+func (s *Slot) Release() {
+	if s == nil || s.f == nil {
+		return
+	}
+	syscall.Flock(int(s.f.Fd()), syscall.LOCK_UN)
+	s.f.Close()
+	s.f = nil
+}
+
+func (t *ticket) remove() {
+	os.Remove(t.path)
+	t.f.Close()
+}
+
+// enqueue creates a ticket locked for the lifetime of the caller. The ticket is locked before it is
+// renamed into the queue so other processes never see it unlocked and take it for a stale one.
+func (q *Queue) enqueue() (*ticket, error) {
+	f, err := os.CreateTemp(q.dir, "tmp-")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create queue ticket")
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, errors.Wrap(err, "failed to lock queue ticket")
+	}
+
+	// Names sort in arrival order
+	name := filepath.Join(q.dir, fmt.Sprintf("%s%020d-%d-%d", ticketPrefix, time.Now().UnixNano(), os.Getpid(), ticketCount.Increment()))
+	if err := os.Rename(f.Name(), name); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, errors.Wrap(err, "failed to enqueue ticket")
+	}
+
+	return &ticket{f: f, name: filepath.Base(name), path: name}, nil
+}
+
+// position returns the 1-based position of ticket in the queue, removing the tickets left by dead processes
+func (q *Queue) position(ticket string) (int, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read execution queue")
+	}
+
+	ahead := 0
+	for _, e := range entries { // sorted by name
+		name := e.Name()
+		if !strings.HasPrefix(name, ticketPrefix) {
+			continue
+		}
+		if name == ticket {
+			return ahead + 1, nil
+		}
+		if isStale(filepath.Join(q.dir, name)) {
+			os.Remove(filepath.Join(q.dir, name))
+			continue
+		}
+		ahead++
+	}
+	return 0, errors.Errorf("ticket %s is no longer in the execution queue", ticket)
+}
+
+// tryAcquireSlot locks the first free slot, if any
+func (q *Queue) tryAcquireSlot() (*Slot, error) {
+	for i := 0; i < q.limit; i++ {
+		f, err := os.OpenFile(filepath.Join(q.dir, fmt.Sprintf("%s%d", slotPrefix, i)), os.O_CREATE|os.O_RDWR, 0600)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open execution slot")
+		}
+
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return &Slot{f: f}, nil
+		}
+		f.Close()
+		if err != syscall.EWOULDBLOCK {
+			return nil, errors.Wrap(err, "failed to lock execution slot")
+		}
+	}
+	return nil, nil
+}
+
+// isStale reports whether the ticket at path is no longer locked by the process that created it
+func isStale(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		return false
+	}
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return true
+}
@@ -0,0 +1,90 @@
+package executionqueue
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestQueue(t *testing.T, limit int) *Queue {
+	q := New(t.TempDir(), limit)
+	q.pollInterval = 10 * time.Millisecond
+	return q
+}
+
+func Test_waitLimitsConcurrentExecutions(t *testing.T) {
+	q := newTestQueue(t, 2)
+
+	first, err := q.Wait(context.Background(), nil)
+	require.Nil(t, err)
+	second, err := q.Wait(context.Background(), nil)
+	require.Nil(t, err)
+
+	waitCtx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	var positions []int
+	_, err = q.Wait(waitCtx, func(position int) { positions = append(positions, position) })
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Equal(t, []int{1}, positions)
+
+	first.Release()
+	third, err := q.Wait(context.Background(), nil)
+	require.Nil(t, err)
+
+	second.Release()
+	third.Release()
+}
+
+func Test_waitIsFifo(t *testing.T) {
+	q := newTestQueue(t, 1)
+	running, err := q.Wait(context.Background(), nil)
+	require.Nil(t, err)
+
+	order := make(chan int, 2)
+	for i := 1; i <= 2; i++ {
+		queued := make(chan bool)
+		go func(i int) {
+			slot, err := q.Wait(context.Background(), func(position int) {
+				if position == i {
+					close(queued)
+				}
+			})
+			require.Nil(t, err)
+			order <- i
+			slot.Release()
+		}(i)
+		<-queued
+	}
+
+	running.Release()
+	require.Equal(t, 1, <-order)
+	require.Equal(t, 2, <-order)
+}
+
+func Test_waitRemovesStaleTickets(t *testing.T) {
+	q := newTestQueue(t, 1)
+
+	// A ticket left by a process that died is not locked anymore
+	require.Nil(t, os.WriteFile(filepath.Join(q.dir, ticketPrefix+"00000000000000000001-1-1"), nil, 0600))
+
+	slot, err := q.Wait(context.Background(), func(position int) {
+		require.Fail(t, "should not wait behind a stale ticket")
+	})
+	require.Nil(t, err)
+	slot.Release()
+
+	entries, err := os.ReadDir(q.dir)
+	require.Nil(t, err)
+	for _, e := range entries {
+		require.NotContains(t, e.Name(), ticketPrefix)
+	}
+}
+
+func Test_releaseNilSlot(t *testing.T) {
+	var slot *Slot
+	slot.Release()
+}
@@ -0,0 +1,114 @@
+// Package featureflags gates the risky behaviors of the handler, so they can be rolled out and rolled back per fleet
+// without a new release. Every flag has a default compiled in, which the goal state can override for a fleet and the
+// administrator of the machine can override with a local file.
+package featureflags
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/trustedfile"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// Flag names a gated behavior, as found in the goal state and the local file
+type Flag string
+
+const (
+	// OutputStreaming passes the output lines of the scripts to the registered streaming sinks (e.g., logs --follow)
+	OutputStreaming Flag = "outputStreaming"
+	// ArtifactSync allows the artifacts to be synced from a storage container with mode "sync"
+	ArtifactSync Flag = "artifactSync"
+	// StderrErrorLines keeps the error lines of a truncated stderr in the status rather than only its last bytes
+	StderrErrorLines Flag = "stderrErrorLines"
+	// InstanceMetadata queries the metadata of the VM from IMDS to report it in the telemetry and execution summaries
+	InstanceMetadata Flag = "instanceMetadata"
+	// MonitorEvents emits the started and completed events of the operations to the syslog for the Azure Monitor Agent
+	MonitorEvents Flag = "monitorEvents"
+)
+
+// defaults are the values of the flags unless overridden
+var defaults = map[Flag]bool{
+	OutputStreaming:  true,
+	ArtifactSync:     true,
+	StderrErrorLines: true,
+	InstanceMetadata: false,
+	MonitorEvents:    true,
+}
+
+var (
+	// configPath is the local file overriding the flags, e.g., {"outputStreaming": false}
+	configPath = constants.FeatureFlagsPath
+
+	mu                 sync.RWMutex
+	goalStateOverrides map[Flag]bool
+)
+
+// Enabled returns whether the behavior gated by flag is enabled: the value of the local file if set, else the value
+// of the goal state if set, else the default. An invalid local file is ignored. The local file is read on every call
+// so changing it applies without restarting the handler.
+func Enabled(ctx *log.Context, flag Flag) bool {
+	overrides, err := loadConfig(configPath)
+	if err != nil {
+		ctx.Log("warning", "ignoring the feature flags of "+configPath, "error", err)
+	}
+	if enabled, ok := overrides[flag]; ok {
+		return enabled
+	}
+
+	mu.RLock()
+	enabled, ok := goalStateOverrides[flag]
+	mu.RUnlock()
+	if ok {
+		return enabled
+	}
+	return defaults[flag]
+}
+
+// SetGoalStateOverrides replaces the values of the flags set by the goal state. Unknown flags are ignored, e.g., the
+// flags of a newer version of the handler.
+func SetGoalStateOverrides(ctx *log.Context, flags map[string]bool) {
+	overrides := make(map[Flag]bool)
+	for name, enabled := range flags {
+		if _, ok := defaults[Flag(name)]; !ok {
+			ctx.Log("message", "ignoring unknown feature flag of the goal state", "flag", name)
+			continue
+		}
+		overrides[Flag(name)] = enabled
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	goalStateOverrides = overrides
+}
+
+// loadConfig returns the values of the flags set by the local file, none if there is no file
+func loadConfig(path string) (map[Flag]bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open feature flags")
+	}
+	defer f.Close()
+
+	if err := trustedfile.Check(f, "feature flags"); err != nil {
+		return nil, err
+	}
+
+	var flags map[string]bool
+	if err := json.NewDecoder(f).Decode(&flags); err != nil {
+		return nil, errors.Wrap(err, "failed to parse feature flags")
+	}
+	overrides := make(map[Flag]bool)
+	for name, enabled := range flags {
+		if _, ok := defaults[Flag(name)]; ok {
+			overrides[Flag(name)] = enabled
+		}
+	}
+	return overrides, nil
+}
@@ -0,0 +1,61 @@
+package featureflags
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// withConfigPath makes the flags read the local file at path for the duration of the test
+func withConfigPath(t *testing.T, path string) {
+	previous := configPath
+	configPath = path
+	t.Cleanup(func() {
+		configPath = previous
+		goalStateOverrides = nil
+	})
+}
+
+func Test_Enabled(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	path := filepath.Join(t.TempDir(), "feature-flags.json")
+	withConfigPath(t, path)
+
+	// Defaults
+	require.True(t, Enabled(ctx, OutputStreaming))
+	require.False(t, Enabled(ctx, Flag("unknown")))
+
+	// The goal state overrides the defaults
+	SetGoalStateOverrides(ctx, map[string]bool{string(OutputStreaming): false, string(ArtifactSync): false, "unknown": true})
+	require.False(t, Enabled(ctx, OutputStreaming))
+	require.False(t, Enabled(ctx, ArtifactSync))
+	require.False(t, Enabled(ctx, Flag("unknown")))
+
+	// The local file overrides the goal state
+	require.Nil(t, os.WriteFile(path, []byte(`{"outputStreaming": true}`), 0644))
+	require.True(t, Enabled(ctx, OutputStreaming))
+	require.False(t, Enabled(ctx, ArtifactSync))
+
+	// The flags the goal state no longer sets go back to their defaults
+	SetGoalStateOverrides(ctx, nil)
+	require.True(t, Enabled(ctx, ArtifactSync))
+}
+
+func Test_Enabled_ignoresInvalidConfig(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	path := filepath.Join(t.TempDir(), "feature-flags.json")
+	withConfigPath(t, path)
+
+	require.Nil(t, os.WriteFile(path, []byte(`{"outputStreaming": false`), 0644))
+	require.True(t, Enabled(ctx, OutputStreaming))
+
+	// Writable by others
+	require.Nil(t, os.WriteFile(path, []byte(`{"outputStreaming": false}`), 0644))
+	require.Nil(t, os.Chmod(path, 0666))
+	require.True(t, Enabled(ctx, OutputStreaming))
+	_, err := loadConfig(path)
+	require.ErrorContains(t, err, "only writable by its owner")
+}
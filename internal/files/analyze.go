@@ -0,0 +1,93 @@
+package files
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/run-command-handler-linux/pkg/preprocess"
+	"github.com/pkg/errors"
+)
+
+// AnalyzeScript reports the issues of the script at path, as post-processed with opts, that commonly make a script
+// working locally fail in run command: its encoding, its line endings, its shebang and its executable bit. Each
+// finding is a line describing one issue, and no finding means none of them was found.
+func AnalyzeScript(path string, opts PostProcessOptions) ([]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to stat the script")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the script")
+	}
+
+	var findings []string
+	switch encoding := preprocess.DetectEncoding(b); encoding {
+	case preprocess.EncodingUTF8:
+	case preprocess.EncodingNotUTF8:
+		findings = append(findings, "encoding: the script is not valid UTF-8 text")
+	case preprocess.EncodingUTF16LE, preprocess.EncodingUTF16BE:
+		findings = append(findings, fmt.Sprintf("encoding: the script is %s, which bash cannot read, save it as UTF-8%s", encoding, settingNote(opts.SkipBOMRemoval, "skipBomRemoval")))
+	default:
+		findings = append(findings, fmt.Sprintf("encoding: the script is %s, the BOM is read as part of the first command%s", encoding, settingNote(opts.SkipBOMRemoval, "skipBomRemoval")))
+	}
+
+	if n := preprocess.CountDOSLineEndings(b); n > 0 {
+		findings = append(findings, fmt.Sprintf("line endings: %d lines end with CRLF, the carriage returns are read as part of the commands%s", n, settingNote(opts.SkipDos2Unix, "skipDos2Unix")))
+	}
+
+	if interpreter, ok := preprocess.Shebang(b); !ok {
+		findings = append(findings, fmt.Sprintf("shebang: none, the script runs with %s", DefaultInterpreter))
+	} else if err := CheckInterpreter(interpreter); err != nil {
+		findings = append(findings, "shebang: "+err.Error())
+	}
+
+	if fi.Mode().Perm()&0100 == 0 {
+		findings = append(findings, "executable bit: the script is not executable by its owner")
+	}
+	return findings, nil
+}
+
+// settingNote names the setting keeping an issue from being fixed by the post-processing, if set
+func settingNote(set bool, setting string) string {
+	if !set {
+		return ""
+	}
+	return fmt.Sprintf(" (%s is set)", setting)
+}
+
+// CheckInterpreter returns an error if the interpreter line of a shebang, e.g., "/usr/bin/env python3", does not
+// run on this VM
+func CheckInterpreter(interpreter string) error {
+	path, arg := SplitInterpreter(interpreter)
+	if path == "" {
+		return errors.New("no interpreter")
+	}
+	if !filepath.IsAbs(path) {
+		return errors.Errorf("the interpreter %q is not an absolute path", path)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return errors.Errorf("the interpreter %q does not exist on this VM", path)
+	}
+	// env looks the command up in the PATH
+	if filepath.Base(path) == "env" && arg != "" && !strings.HasPrefix(arg, "-") {
+		if _, err := exec.LookPath(arg); err != nil {
+			return errors.Errorf("the command %q is not found in the PATH of this VM", arg)
+		}
+	}
+	return nil
+}
+
+// SplitInterpreter splits the interpreter line of a shebang the way the kernel does: the path of the interpreter
+// ends at the first blank, and the rest of the line is passed as its single argument, spaces included
+func SplitInterpreter(interpreter string) (path, arg string) {
+	interpreter = strings.Trim(interpreter, " \t")
+	i := strings.IndexAny(interpreter, " \t")
+	if i < 0 {
+		return interpreter, ""
+	}
+	return interpreter[:i], strings.Trim(interpreter[i:], " \t")
+}
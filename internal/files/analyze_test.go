@@ -0,0 +1,43 @@
+package files
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_analyzeScript(t *testing.T) {
+	dir := t.TempDir()
+	writeScript := func(content string, mode os.FileMode) string {
+		path := filepath.Join(dir, "script.sh")
+		os.Remove(path)
+		require.Nil(t, os.WriteFile(path, []byte(content), mode))
+		return path
+	}
+
+	findings, err := AnalyzeScript(writeScript("#!/bin/sh\necho hi\n", 0500), PostProcessOptions{})
+	require.Nil(t, err)
+	require.Empty(t, findings)
+
+	findings, err = AnalyzeScript(writeScript("\xef\xbb\xbfecho hi\r\necho bye\r\n", 0400), PostProcessOptions{SkipBOMRemoval: true, SkipDos2Unix: true})
+	require.Nil(t, err)
+	require.Equal(t, []string{
+		"encoding: the script is UTF-8 with BOM, the BOM is read as part of the first command (skipBomRemoval is set)",
+		"line endings: 2 lines end with CRLF, the carriage returns are read as part of the commands (skipDos2Unix is set)",
+		"shebang: none, the script runs with /bin/bash",
+		"executable bit: the script is not executable by its owner",
+	}, findings)
+
+	findings, err = AnalyzeScript(writeScript("#!/usr/bin/python-missing\n", 0500), PostProcessOptions{})
+	require.Nil(t, err)
+	require.Equal(t, []string{`shebang: the interpreter "/usr/bin/python-missing" does not exist on this VM`}, findings)
+
+	findings, err = AnalyzeScript(writeScript("#!/usr/bin/env command-missing\n", 0500), PostProcessOptions{})
+	require.Nil(t, err)
+	require.Equal(t, []string{`shebang: the command "command-missing" is not found in the PATH of this VM`}, findings)
+
+	_, err = AnalyzeScript(filepath.Join(dir, "missing.sh"), PostProcessOptions{})
+	require.ErrorContains(t, err, "failed to stat the script")
+}
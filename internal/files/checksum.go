@@ -0,0 +1,47 @@
+package files
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Azure/run-command-handler-linux/internal/scriptpolicy"
+	"github.com/pkg/errors"
+)
+
+// ChecksumMismatchError reports a downloaded file whose SHA-256 differs from the expected checksum, e.g., because
+// the blob was replaced or tampered with since the checksum was computed
+type ChecksumMismatchError struct {
+	FileName string
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("the SHA-256 of '%s' is %s instead of the expected %s", e.FileName, e.Actual, e.Expected)
+}
+
+// IsChecksumMismatch returns whether err was caused by a downloaded file not matching its checksum
+func IsChecksumMismatch(err error) bool {
+	var mismatch *ChecksumMismatchError
+	return errors.As(err, &mismatch)
+}
+
+// verifyChecksum returns a ChecksumMismatchError, and removes the file so it is never used, unless its SHA-256 is
+// expected. The expected checksum is hex encoded and may be prefixed with sha256:. Every file is valid without one.
+func verifyChecksum(path string, fileName string, expected string) error {
+	if expected == "" {
+		return nil
+	}
+	expected = strings.ToLower(strings.TrimPrefix(expected, "sha256:"))
+
+	actual, err := scriptpolicy.Hash(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to compute the checksum of '%s'", fileName)
+	}
+	if actual != expected {
+		os.Remove(path)
+		return &ChecksumMismatchError{FileName: fileName, Expected: expected, Actual: actual}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package files
+
+import (
+	"fmt"
+	"net/url"
+	"syscall"
+
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/pkg/download"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// statfs reads the statistics of a file system, replaced by the tests
+var statfs = syscall.Statfs
+
+// InsufficientDiskSpaceError reports a file system without the space the downloads and the minimum free space need
+type InsufficientDiskSpaceError struct {
+	Path     string
+	Required uint64
+	Free     uint64
+}
+
+func (e *InsufficientDiskSpaceError) Error() string {
+	return fmt.Sprintf("the file system of '%s' has %d MB free, %d MB are required", e.Path, e.Free>>20, e.Required>>20)
+}
+
+// IsInsufficientDiskSpace returns whether err was caused by a file system without enough free space
+func IsInsufficientDiskSpace(err error) bool {
+	var insufficient *InsufficientDiskSpaceError
+	return errors.As(err, &insufficient)
+}
+
+// FreeSpace returns the space available to the handler on the file system of path, in bytes
+func FreeSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := statfs(path, &stat); err != nil {
+		return 0, errors.Wrapf(err, "failed to read the free space of '%s'", path)
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// CheckDiskSpace returns an InsufficientDiskSpaceError unless the file system of dir has room for the declared sizes
+// of the script and the artifacts cfg downloads, and 'minFreeDiskSpaceMB' on top of them. The downloads whose size
+// is unknown (e.g., the git repositories, the container registry artifacts or the servers not declaring it) and the
+// synced artifacts don't count. The check is skipped, without requesting the sizes of the downloads, unless
+// 'minFreeDiskSpaceMB' is set, and when the free space can't be read.
+func CheckDiskSpace(ctx *log.Context, dir string, cfg *handlersettings.HandlerSettings) error {
+	if cfg.PublicSettings.MinFreeDiskSpaceMB == 0 {
+		return nil
+	}
+	required := uint64(cfg.PublicSettings.MinFreeDiskSpaceMB) << 20
+	if uri := cfg.ScriptURI(); uri != "" {
+		required += declaredSize(ctx, uri, cfg.ScriptSAS(), cfg.SourceManagedIdentity, cfg.ProxyURL())
+	}
+	artifacts, err := cfg.ReadArtifacts()
+	if err != nil {
+		return err
+	}
+	for i := range artifacts {
+		if artifacts[i].Mode != handlersettings.ArtifactModeSync {
+			required += declaredSize(ctx, artifacts[i].ArtifactUri, artifacts[i].ArtifactSasToken, artifacts[i].ArtifactManagedIdentity, cfg.ProxyURL())
+		}
+	}
+	free, err := FreeSpace(dir)
+	if err != nil {
+		ctx.Log("warning", "the free disk space is not checked", "error", err)
+		return nil
+	}
+	ctx.Log("event", "checked the free disk space", "path", dir, "freeBytes", free, "requiredBytes", required)
+	if free < required {
+		return &InsufficientDiskSpaceError{Path: dir, Required: required, Free: free}
+	}
+	return nil
+}
+
+// declaredSize returns the size the server declares for the file at fileURL, requested with the credentials it is
+// downloaded with, or 0 if it is unknown
+func declaredSize(ctx *log.Context, fileURL, sas string, managedIdentity *handlersettings.RunCommandManagedIdentity, proxy *url.URL) uint64 {
+	downloaders, err := fileDownloaders(fileURL, sas, managedIdentity, proxy)
+	if err != nil {
+		return 0
+	}
+	size, err := download.ContentLength(ctx, downloaders)
+	if err != nil || size < 0 {
+		ctx.Log("event", "the size of the download is unknown", "uri", download.GetUriForLogging(fileURL))
+		return 0
+	}
+	return uint64(size)
+}
+
+// CheckReachable returns an error unless the file at fileURL can be requested with the credentials it is downloaded
+// with. Only a HEAD request is made, the file is not downloaded.
+func CheckReachable(ctx *log.Context, fileURL, sas string, managedIdentity *handlersettings.RunCommandManagedIdentity, proxy *url.URL) error {
+	downloaders, err := fileDownloaders(fileURL, sas, managedIdentity, proxy)
+	if err != nil {
+		return err
+	}
+	_, err = download.ContentLength(ctx, downloaders)
+	return err
+}
+
+// fileDownloaders returns the downloaders of the file at fileURL, in the order it is downloaded with: the SAS token
+// first, if any, then the managed identity and the public URI
+func fileDownloaders(fileURL, sas string, managedIdentity *handlersettings.RunCommandManagedIdentity, proxy *url.URL) ([]download.Downloader, error) {
+	downloaders, err := getDownloaders(fileURL, managedIdentity, download.ProdMsiDownloader{})
+	if err != nil {
+		return nil, err
+	}
+	if sas != "" {
+		downloaders = append([]download.Downloader{download.NewURLDownload(fileURL + sas)}, downloaders...)
+	}
+	for i := range downloaders {
+		downloaders[i] = download.ThroughProxy(downloaders[i], proxy)
+	}
+	return downloaders, nil
+}
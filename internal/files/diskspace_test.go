@@ -0,0 +1,105 @@
+package files
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// withFreeSpace makes the file systems report free bytes of free space until the test ends
+func withFreeSpace(t *testing.T, free uint64) {
+	statfs = func(path string, stat *syscall.Statfs_t) error {
+		stat.Bsize = 4096
+		stat.Bavail = free / 4096
+		return nil
+	}
+	t.Cleanup(func() { statfs = syscall.Statfs })
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/script.sh":
+			w.Header().Set("Content-Length", "4194304") // 4 MB
+		case "/artifact.tar":
+			w.Header().Set("Content-Length", "8388608") // 8 MB
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	ctx := log.NewContext(log.NewNopLogger())
+	cfg := handlersettings.HandlerSettings{
+		PublicSettings: handlersettings.PublicSettings{
+			Source:    &handlersettings.ScriptSource{ScriptURI: srv.URL + "/script.sh"},
+			Artifacts: []handlersettings.PublicArtifactSource{{ArtifactId: 1, ArtifactUri: srv.URL + "/artifact.tar"}},
+		},
+		ProtectedSettings: handlersettings.ProtectedSettings{
+			Artifacts: []handlersettings.ProtectedArtifactSource{{ArtifactId: 1}},
+		},
+	}
+
+	// the check is skipped unless a minimum free space is set
+	withFreeSpace(t, 0)
+	require.Nil(t, CheckDiskSpace(ctx, t.TempDir(), &cfg))
+	require.Zero(t, requests, "the sizes of the downloads are not requested")
+
+	cfg.PublicSettings.MinFreeDiskSpaceMB = 1
+	withFreeSpace(t, 13<<20)
+	require.Nil(t, CheckDiskSpace(ctx, t.TempDir(), &cfg))
+
+	withFreeSpace(t, 12<<20)
+	err := CheckDiskSpace(ctx, t.TempDir(), &cfg)
+	require.True(t, IsInsufficientDiskSpace(errors.Wrap(err, "wrapped")), "%v", err)
+	require.Contains(t, err.Error(), "12 MB free, 13 MB are required")
+
+	// the downloads of unknown size don't count
+	cfg.PublicSettings.Artifacts[0].ArtifactUri = srv.URL + "/missing.tar"
+	require.Nil(t, CheckDiskSpace(ctx, t.TempDir(), &cfg))
+}
+
+func TestCheckDiskSpace_skippedWithoutFreeSpace(t *testing.T) {
+	statfs = func(path string, stat *syscall.Statfs_t) error { return syscall.EIO }
+	defer func() { statfs = syscall.Statfs }()
+
+	cfg := handlersettings.HandlerSettings{PublicSettings: handlersettings.PublicSettings{Source: &handlersettings.ScriptSource{Script: "date"}, MinFreeDiskSpaceMB: 1 << 20}}
+	require.Nil(t, CheckDiskSpace(log.NewContext(log.NewNopLogger()), t.TempDir(), &cfg))
+}
+
+func TestFreeSpace(t *testing.T) {
+	free, err := FreeSpace(t.TempDir())
+	require.Nil(t, err)
+	require.NotZero(t, free)
+
+	_, err = FreeSpace("/nonexistent/path")
+	require.NotNil(t, err)
+}
+
+func TestCheckReachable(t *testing.T) {
+	var methods []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		if r.URL.Path != "/script.sh" || r.URL.Query().Get("sig") != "valid" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+	ctx := log.NewContext(log.NewNopLogger())
+
+	require.Nil(t, CheckReachable(ctx, srv.URL+"/script.sh", "?sig=valid", nil, nil))
+	err := CheckReachable(ctx, srv.URL+"/script.sh", "?sig=expired", nil, nil)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "403")
+	require.NotNil(t, CheckReachable(ctx, srv.URL+"/missing.sh", "?sig=valid", nil, nil))
+	for _, method := range methods {
+		require.Equal(t, http.MethodHead, method)
+	}
+}
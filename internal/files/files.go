@@ -9,7 +9,10 @@ import (
 
 	"os"
 
+	"github.com/Azure/run-command-handler-linux/internal/blobsync"
+	"github.com/Azure/run-command-handler-linux/internal/featureflags"
 	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/scriptpolicy"
 	"github.com/Azure/run-command-handler-linux/pkg/download"
 	"github.com/Azure/run-command-handler-linux/pkg/preprocess"
 	"github.com/Azure/run-command-handler-linux/pkg/urlutil"
@@ -19,36 +22,97 @@ import (
 
 var UseMockSASDownloadFailure bool = false
 
-func DownloadAndProcessArtifact(ctx *log.Context, downloadDir string, artifact *handlersettings.UnifiedArtifact) (string, error) {
+// DefaultInterpreter runs the scripts without a shebang, as they are executed by bash
+const DefaultInterpreter = "/bin/bash"
+
+// PostProcessOptions selects the in-place changes PostProcessFile makes to a script. The zero value
+// removes the BOM and converts DOS-line endings, without inserting a shebang.
+type PostProcessOptions struct {
+	SkipDos2Unix   bool
+	SkipBOMRemoval bool
+	InsertShebang  bool
+}
+
+// ScriptPostProcessOptions returns the post-processing of the script selected by cfg
+func ScriptPostProcessOptions(cfg *handlersettings.HandlerSettings) PostProcessOptions {
+	return PostProcessOptions{
+		SkipDos2Unix:   cfg.PublicSettings.SkipDos2Unix,
+		SkipBOMRemoval: cfg.PublicSettings.SkipBOMRemoval,
+		InsertShebang:  cfg.PublicSettings.InsertShebang,
+	}
+}
+
+// newArtifactContainer opens the container of an artifact in sync mode
+var newArtifactContainer = blobsync.NewSASContainer
+
+// DownloadAndProcessArtifact downloads the artifact through proxy, unless it is nil, at most at maxKbps kilobits per
+// second, unless it is zero, or syncs it in sync mode
+func DownloadAndProcessArtifact(ctx *log.Context, downloadDir string, artifact *handlersettings.UnifiedArtifact, proxy *url.URL, maxKbps int) (string, error) {
+	if artifact.Mode == handlersettings.ArtifactModeSync {
+		if !featureflags.Enabled(ctx, featureflags.ArtifactSync) {
+			return "", errors.Errorf("artifact %d can't be synced, the sync mode is disabled on this VM", artifact.ArtifactId)
+		}
+		return syncArtifact(ctx, artifact)
+	}
+
 	fileName := artifact.FileName
 	if fileName == "" {
 		fileName = fmt.Sprintf("%s%d", "Artifact", artifact.ArtifactId)
 	}
-	targetFilePath, err := downloadAndProcessURL(ctx, artifact.ArtifactUri, downloadDir, fileName, artifact.ArtifactSasToken, artifact.ArtifactManagedIdentity)
+	targetFilePath, _, err := downloadAndProcessURL(ctx, artifact.ArtifactUri, downloadDir, fileName, artifact.ArtifactSasToken, artifact.ArtifactManagedIdentity, artifact.Checksum, proxy, maxKbps, PostProcessOptions{})
 
 	return targetFilePath, err
 }
 
-func DownloadAndProcessScript(ctx *log.Context, url, downloadDir string, cfg *handlersettings.HandlerSettings) (string, error) {
-	fileName, err := UrlToFileName(url)
+// syncArtifact syncs the blobs of the artifact container into its target directory and returns the directory. The
+// directory is kept across sequence numbers, so only the new and changed blobs are downloaded. Unlike downloaded
+// artifacts, the synced files are not post-processed.
+func syncArtifact(ctx *log.Context, artifact *handlersettings.UnifiedArtifact) (string, error) {
+	// The legacy storage client used to list the blobs only supports SAS tokens
+	if artifact.ArtifactSasToken == "" {
+		return "", errors.Errorf("artifact %d: a SAS token is required to sync a container", artifact.ArtifactId)
+	}
+	container, err := newArtifactContainer(artifact.ArtifactUri + artifact.ArtifactSasToken)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(artifact.TargetDirectory, 0700); err != nil {
+		return "", errors.Wrapf(err, "failed to create target directory '%s'", artifact.TargetDirectory)
+	}
+
+	result, err := blobsync.Sync(ctx, container, artifact.TargetDirectory, blobsync.ValidateName)
 	if err != nil {
 		return "", err
 	}
+	ctx.Log("event", "synced artifact", "id", artifact.ArtifactId, "downloaded", result.Downloaded, "unchanged", result.Unchanged, "removed", result.Removed)
+	if result.Failed > 0 {
+		return "", errors.Errorf("failed to download %d blobs of artifact %d", result.Failed, artifact.ArtifactId)
+	}
+	return artifact.TargetDirectory, nil
+}
+
+// DownloadAndProcessScript downloads the script at url to downloadDir and post-processes it. It returns the path of
+// the script, and the SHA-256 of the script as downloaded, before the post-processing changes it.
+func DownloadAndProcessScript(ctx *log.Context, url, downloadDir string, cfg *handlersettings.HandlerSettings) (string, string, error) {
+	fileName, err := UrlToFileName(url)
+	if err != nil {
+		return "", "", err
+	}
 
 	scriptSAS := cfg.ScriptSAS()
 	sourceManagedIdentity := cfg.SourceManagedIdentity
-	targetFilePath, err := downloadAndProcessURL(ctx, url, downloadDir, fileName, scriptSAS, sourceManagedIdentity)
-
-	return targetFilePath, err
+	return downloadAndProcessURL(ctx, url, downloadDir, fileName, scriptSAS, sourceManagedIdentity, cfg.ScriptChecksum(), cfg.ProxyURL(), cfg.PublicSettings.MaxDownloadBandwidthKbps, ScriptPostProcessOptions(cfg))
 }
 
 // downloadAndProcessURL downloads using the specified downloader and saves it to the
 // specified existing directory, which must be the path to the saved file. Then
-// it post-processes file based on heuristics.
-func downloadAndProcessURL(ctx *log.Context, url, downloadDir string, fileName string, scriptSAS string, sourceManagedIdentity *handlersettings.RunCommandManagedIdentity) (string, error) {
+// it verifies the checksum of the file, if any, and post-processes it based on
+// heuristics. The requests go through proxy unless it is nil, and the download reads at most maxKbps kilobits per
+// second unless it is zero. It returns the path of the file and its SHA-256 before the post-processing.
+func downloadAndProcessURL(ctx *log.Context, url, downloadDir string, fileName string, scriptSAS string, sourceManagedIdentity *handlersettings.RunCommandManagedIdentity, checksum string, proxy *url.URL, maxKbps int, opts PostProcessOptions) (string, string, error) {
 	var err error
 	if !urlutil.IsValidUrl(url) {
-		return "", fmt.Errorf(url + " is not a valid url") // url does not contain SAS to se can log it
+		return "", "", fmt.Errorf(url + " is not a valid url") // url does not contain SAS to se can log it
 	}
 
 	targetFilePath := filepath.Join(downloadDir, fileName)
@@ -56,10 +120,11 @@ func downloadAndProcessURL(ctx *log.Context, url, downloadDir string, fileName s
 	var scriptSASDownloadErr error = nil
 	var downloadedFilePath string = ""
 	if scriptSAS != "" {
+		ctx.Log("event", "downloading file", "credentials", "sasToken")
 		if UseMockSASDownloadFailure {
 			scriptSASDownloadErr = errors.New("Downloading script using SAS token failed.")
 		} else {
-			downloadedFilePath, scriptSASDownloadErr = download.GetSASBlob(url, scriptSAS, downloadDir)
+			downloadedFilePath, scriptSASDownloadErr = download.GetSASBlob(url, scriptSAS, downloadDir, proxy, maxKbps)
 		}
 		// Download was successful using SAS. So use downloadedFilePath
 		if scriptSASDownloadErr == nil && downloadedFilePath != "" {
@@ -69,53 +134,191 @@ func downloadAndProcessURL(ctx *log.Context, url, downloadDir string, fileName s
 
 	//If there was an error downloading using SAS URI or SAS was not provided, download using managedIdentity or publicly.
 	if scriptSASDownloadErr != nil || scriptSAS == "" {
-		downloaders, getDownloadersError := getDownloaders(url, sourceManagedIdentity, download.ProdMsiDownloader{})
+		downloaders, credentials, getDownloadersError := getCredentialDownloaders(url, sourceManagedIdentity, download.ProdMsiDownloader{})
 		if getDownloadersError == nil {
+			ctx.Log("event", "downloading file", "credentials", strings.Join(credentials, ","))
+			for i := range downloaders {
+				downloaders[i] = download.Throttled(download.ThroughProxy(downloaders[i], proxy), maxKbps)
+			}
 			const mode = 0500 // we assume users download scripts to execute
 			_, err = download.SaveTo(ctx, downloaders, targetFilePath, mode)
 		} else {
-			return "", getDownloadersError
+			return "", "", getDownloadersError
 		}
 	}
 
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+
+	// The checksum is of the file as published, before the post-processing changes it
+	if err := verifyChecksum(targetFilePath, fileName, checksum); err != nil {
+		return "", "", err
+	}
+
+	hash, err := hashAndPostProcessFile(targetFilePath, opts)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "failed to post-process '%s'", fileName)
+	}
+
+	return targetFilePath, hash, nil
+}
+
+// CopyAndProcessLocalScript copies a script already present on the machine to the specified existing directory
+// and post-processes the copy like a downloaded script. Executing a copy keeps a record of what was executed
+// and leaves the pre-staged script untouched. It returns the path of the copy, and the SHA-256 of the script before
+// the post-processing.
+func CopyAndProcessLocalScript(localPath, targetDir string, opts PostProcessOptions) (string, string, error) {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "local script '%s' is not accessible", localPath)
+	}
+	if !info.Mode().IsRegular() {
+		return "", "", errors.Errorf("local script '%s' is not a regular file", localPath)
+	}
+
+	content, err := ioutil.ReadFile(localPath)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "failed to read local script '%s'", localPath)
+	}
+
+	targetFilePath := filepath.Join(targetDir, filepath.Base(localPath))
+	const mode = 0500 // scripts should have execute permissions
+	if err := ioutil.WriteFile(targetFilePath, content, mode); err != nil {
+		return "", "", errors.Wrapf(err, "failed to copy local script to '%s'", targetFilePath)
+	}
+
+	hash, err := hashAndPostProcessFile(targetFilePath, opts)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "failed to post-process '%s'", filepath.Base(localPath))
+	}
+	return targetFilePath, hash, nil
+}
+
+// CloneAndProcessGitRepository downloads the git repository of the script to repoDir, replacing any previous
+// download, and post-processes its entrypoint in place, so the script executes next to the other files of the
+// repository. It returns the path of the entrypoint, and its SHA-256 before the post-processing.
+func CloneAndProcessGitRepository(ctx *log.Context, repoDir string, cfg *handlersettings.HandlerSettings) (string, string, error) {
+	source := cfg.GitRepository()
+	repo := download.GitRepository{
+		URL:   source.URL,
+		Ref:   source.Ref,
+		PAT:   cfg.ProtectedSettings.SourceGitToken,
+		Proxy: cfg.ProxyURL(),
+	}
+	if source.UseManagedIdentity {
+		var clientId, objectId string
+		if mi := cfg.SourceManagedIdentity; mi != nil {
+			clientId, objectId = mi.ClientId, mi.ObjectId
+		}
+		repo.MsiProvider = download.GetAzureDevOpsMsiProvider(clientId, objectId)
+	}
+
+	if err := os.RemoveAll(repoDir); err != nil {
+		return "", "", errors.Wrap(err, "failed to remove the previous download of the git repository")
+	}
+	if err := repo.Clone(ctx, repoDir); err != nil {
+		return "", "", err
+	}
+
+	return processEntrypoint(repoDir, source.Entrypoint, cfg)
+}
+
+// PullAndProcessOCIArtifact downloads the container registry artifact of the script to artifactDir, replacing any
+// previous download, and post-processes its entrypoint in place, so the script executes next to the other files of
+// the artifact. It returns the path of the entrypoint, and its SHA-256 before the post-processing.
+func PullAndProcessOCIArtifact(ctx *log.Context, artifactDir string, cfg *handlersettings.HandlerSettings) (string, string, error) {
+	source := cfg.OCIArtifact()
+	reference, err := download.ParseOCIReference(source.Reference)
+	if err != nil {
+		return "", "", err
+	}
+	var clientId, objectId string
+	if mi := cfg.SourceManagedIdentity; mi != nil {
+		clientId, objectId = mi.ClientId, mi.ObjectId
+	}
+	artifact := download.NewOCIDownload(reference, download.GetContainerRegistryMsiProvider(clientId, objectId), cfg.ProxyURL())
+
+	if err := os.RemoveAll(artifactDir); err != nil {
+		return "", "", errors.Wrap(err, "failed to remove the previous download of the artifact")
+	}
+	if err := download.PullOCIArtifact(ctx, artifact, artifactDir, cfg.PublicSettings.MaxDownloadBandwidthKbps); err != nil {
+		return "", "", err
 	}
+	ctx.Log("event", "pulled artifact", "digest", artifact.Layer().Digest)
+	return processEntrypoint(artifactDir, source.Entrypoint, cfg)
+}
 
-	err = PostProcessFile(targetFilePath)
+// processEntrypoint makes the entrypoint of the bundle of scripts in dir executable and post-processes it in place.
+// It returns the path of the entrypoint, and its SHA-256 before the post-processing. The entrypoint may be a link,
+// which must not lead out of the bundle.
+func processEntrypoint(dir, name string, cfg *handlersettings.HandlerSettings) (string, string, error) {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to resolve the directory of the scripts")
+	}
+	entrypoint, err := filepath.EvalSymlinks(filepath.Join(dir, name))
+	if err != nil {
+		return "", "", errors.Wrapf(err, "entrypoint '%s' is not in the scripts", name)
+	}
+	if !strings.HasPrefix(entrypoint, root+string(filepath.Separator)) {
+		return "", "", errors.Errorf("entrypoint '%s' leads out of the scripts", name)
+	}
+	info, err := os.Stat(entrypoint)
 	if err != nil {
-		return "", errors.Wrapf(err, "failed to post-process '%s'", fileName)
+		return "", "", errors.Wrapf(err, "entrypoint '%s' is not accessible", name)
+	}
+	if !info.Mode().IsRegular() {
+		return "", "", errors.Errorf("entrypoint '%s' is not a regular file", name)
 	}
 
-	return targetFilePath, nil
+	const mode = 0700 // scripts should have execute permissions
+	if err := os.Chmod(entrypoint, mode); err != nil {
+		return "", "", errors.Wrapf(err, "failed to make entrypoint '%s' executable", name)
+	}
+	hash, err := hashAndPostProcessFile(entrypoint, ScriptPostProcessOptions(cfg))
+	if err != nil {
+		return "", "", errors.Wrapf(err, "failed to post-process '%s'", name)
+	}
+	return entrypoint, hash, nil
 }
 
 // getDownloaders returns one or two downloaders (two if it is an Azure storage blob):
 // 1. Downloader for script using public URI.
 // 2. Downloader for script using managed identity.
 func getDownloaders(fileURL string, managedIdentity *handlersettings.RunCommandManagedIdentity, msiDownloader download.MsiDownloader) ([]download.Downloader, error) {
+	downloaders, _, err := getCredentialDownloaders(fileURL, managedIdentity, msiDownloader)
+	return downloaders, err
+}
 
+// getCredentialDownloaders returns the downloaders of getDownloaders and, for each of them, the credentials it
+// downloads with (e.g., systemManagedIdentity or anonymous)
+func getCredentialDownloaders(fileURL string, managedIdentity *handlersettings.RunCommandManagedIdentity, msiDownloader download.MsiDownloader) ([]download.Downloader, []string, error) {
 	if fileURL == "" {
-		return nil, fmt.Errorf("fileURL is empty")
+		return nil, nil, fmt.Errorf("fileURL is empty")
 	}
 
 	if download.IsAzureStorageBlobUri(fileURL) {
 		// if managed identity was specified in the configuration, try to use it to download the files
 		var msiProvider download.MsiProvider
+		var identity string
 
 		switch {
 		case managedIdentity == nil || (managedIdentity.ClientId == "" && managedIdentity.ObjectId == ""):
 			// get msi Provider for blob url implicitly (uses system managed identity)
 			msiProvider = msiDownloader.GetMsiProvider(fileURL)
+			identity = "systemManagedIdentity"
 
 		case managedIdentity.ClientId != "" && managedIdentity.ObjectId == "":
 			// uses user-managed identity
 			msiProvider = msiDownloader.GetMsiProviderByClientId(fileURL, managedIdentity.ClientId)
+			identity = "managedIdentity(clientId=" + managedIdentity.ClientId + ")"
 		case managedIdentity.ClientId == "" && managedIdentity.ObjectId != "":
 			// uses user-managed identity
 			msiProvider = msiDownloader.GetMsiProviderByObjectId(fileURL, managedIdentity.ObjectId)
+			identity = "managedIdentity(objectId=" + managedIdentity.ObjectId + ")"
 		default:
-			return nil, fmt.Errorf("use either ClientId or ObjectId for managed identity. Not both")
+			return nil, nil, fmt.Errorf("use either ClientId or ObjectId for managed identity. Not both")
 		}
 
 		_, msiError := msiProvider()
@@ -124,16 +327,16 @@ func getDownloaders(fileURL string, managedIdentity *handlersettings.RunCommandM
 				//Try downloading with MSI token first, if that fails attempt public download
 				download.NewBlobWithMsiDownload(fileURL, msiProvider),
 				download.NewURLDownload(fileURL), // Try downloading the Azure storage blob as public URI
-			}, nil
+			}, []string{identity, "anonymous"}, nil
 		} else {
 			return []download.Downloader{
 				// Try downloading the Azure storage blob as public URI
 				download.NewURLDownload(fileURL),
-			}, nil
+			}, []string{"anonymous"}, nil
 		}
 	} else {
 		// Public URI - do not use MSI downloader if the uri is not azure storage blob
-		return []download.Downloader{download.NewURLDownload(fileURL)}, nil
+		return []download.Downloader{download.NewURLDownload(fileURL)}, []string{"anonymous"}, nil
 	}
 }
 
@@ -156,10 +359,25 @@ func UrlToFileName(fileURL string) (string, error) {
 	return "", fmt.Errorf("cannot extract file name from URL: %q", fileURL)
 }
 
+// hashAndPostProcessFile post-processes the file at path and returns its SHA-256 before the post-processing, the
+// hash of the script as published which the allow-list of the scripts lists
+func hashAndPostProcessFile(path string, opts PostProcessOptions) (string, error) {
+	hash, err := scriptpolicy.Hash(path)
+	if err != nil {
+		return "", err
+	}
+	return hash, PostProcessFile(path, opts)
+}
+
 // postProcessFile determines if path is a script file based on heuristics
 // and makes in-place changes to the file with some post-processing such as BOM
-// and DOS-line endings fixes to make the script POSIX-friendly.
-func PostProcessFile(path string) error {
+// and DOS-line endings fixes to make the script POSIX-friendly. Each change
+// can be turned off with opts, as they corrupt some payloads (e.g., scripts
+// embedding binary here-docs).
+func PostProcessFile(path string, opts PostProcessOptions) error {
+	if opts.SkipBOMRemoval && opts.SkipDos2Unix && !opts.InsertShebang {
+		return nil
+	}
 	ok, err := preprocess.IsTextFile(path)
 	if err != nil {
 		return errors.Wrapf(err, "error determining if script is a text file")
@@ -172,8 +390,15 @@ func PostProcessFile(path string) error {
 	if err != nil {
 		return errors.Wrapf(err, "error reading file")
 	}
-	b = preprocess.RemoveBOM(b)
-	b = preprocess.Dos2Unix(b)
+	if !opts.SkipBOMRemoval {
+		b = preprocess.RemoveBOM(b)
+	}
+	if !opts.SkipDos2Unix {
+		b = preprocess.Dos2Unix(b)
+	}
+	if opts.InsertShebang {
+		b = preprocess.AddShebang(b, DefaultInterpreter)
+	}
 
 	err = ioutil.WriteFile(path, b, 0)
 	return errors.Wrap(os.Rename(path, path), "error writing file")
@@ -1,17 +1,25 @@
 package files
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/Azure/run-command-handler-linux/internal/blobsync"
 	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
 	"github.com/Azure/run-command-handler-linux/pkg/download"
 	"github.com/ahmetalpbalkan/go-httpbin"
 	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -136,7 +144,7 @@ func Test_urlToFileName(t *testing.T) {
 }
 
 func Test_postProcessFile_fail(t *testing.T) {
-	require.NotNil(t, PostProcessFile("/non/existing/path"))
+	require.NotNil(t, PostProcessFile("/non/existing/path", PostProcessOptions{}))
 }
 
 func Test_postProcessFile(t *testing.T) {
@@ -147,13 +155,39 @@ func Test_postProcessFile(t *testing.T) {
 	require.Nil(t, err)
 	f.Close()
 
-	require.Nil(t, PostProcessFile(f.Name()))
+	require.Nil(t, PostProcessFile(f.Name(), PostProcessOptions{}))
 
 	b, err := ioutil.ReadFile(f.Name())
 	require.Nil(t, err)
 	require.Equal(t, []byte("#!/bin/sh\necho 'Hello, world!'\n"), b)
 }
 
+func Test_postProcessFile_options(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	const script = "\xef\xbb\xbfecho 'Hello, world!'\r\n"
+	cases := []struct {
+		opts PostProcessOptions
+		out  string
+	}{
+		{PostProcessOptions{}, "echo 'Hello, world!'\n"},
+		{PostProcessOptions{SkipDos2Unix: true}, "echo 'Hello, world!'\r\n"},
+		{PostProcessOptions{SkipBOMRemoval: true}, "\xef\xbb\xbfecho 'Hello, world!'\n"},
+		{PostProcessOptions{SkipDos2Unix: true, SkipBOMRemoval: true}, script},
+		{PostProcessOptions{InsertShebang: true}, "#!/bin/bash\necho 'Hello, world!'\n"},
+	}
+	for _, c := range cases {
+		fp := filepath.Join(tmpDir, "script.sh")
+		require.Nil(t, ioutil.WriteFile(fp, []byte(script), 0600))
+		require.Nil(t, PostProcessFile(fp, c.opts))
+		b, err := ioutil.ReadFile(fp)
+		require.Nil(t, err)
+		require.Equal(t, c.out, string(b), "opts=%+v", c.opts)
+	}
+}
+
 func Test_downloadAndProcessScript(t *testing.T) {
 	srv := httptest.NewServer(httpbin.GetMux())
 	defer srv.Close()
@@ -163,7 +197,7 @@ func Test_downloadAndProcessScript(t *testing.T) {
 	defer os.RemoveAll(tmpDir)
 
 	cfg := handlersettings.HandlerSettings{PublicSettings: handlersettings.PublicSettings{}, ProtectedSettings: handlersettings.ProtectedSettings{}}
-	downloadedFilePath, err := DownloadAndProcessScript(log.NewContext(log.NewNopLogger()), srv.URL+"/bytes/256", tmpDir, &cfg)
+	downloadedFilePath, _, err := DownloadAndProcessScript(log.NewContext(log.NewNopLogger()), srv.URL+"/bytes/256", tmpDir, &cfg)
 	require.Nil(t, err)
 
 	fp := filepath.Join(tmpDir, "256")
@@ -188,7 +222,7 @@ func Test_downloadAndProcessArtifact(t *testing.T) {
 		ArtifactUri: srv.URL + "/bytes/256",
 		FileName:    "iggy.txt",
 	}
-	downloadedFilePath, err := DownloadAndProcessArtifact(log.NewContext(log.NewNopLogger()), tmpDir, &artifact)
+	downloadedFilePath, err := DownloadAndProcessArtifact(log.NewContext(log.NewNopLogger()), tmpDir, &artifact, nil, 0)
 	require.Nil(t, err)
 
 	fp := filepath.Join(tmpDir, "iggy.txt")
@@ -203,7 +237,7 @@ func Test_downloadAndProcessArtifact(t *testing.T) {
 		ArtifactId:  3,
 		ArtifactUri: srv.URL + "/bytes/256",
 	}
-	downloadedFilePath, err = DownloadAndProcessArtifact(log.NewContext(log.NewNopLogger()), tmpDir, &artifact)
+	downloadedFilePath, err = DownloadAndProcessArtifact(log.NewContext(log.NewNopLogger()), tmpDir, &artifact, nil, 0)
 	require.Nil(t, err)
 
 	fp = filepath.Join(tmpDir, "Artifact3")
@@ -214,6 +248,82 @@ func Test_downloadAndProcessArtifact(t *testing.T) {
 	require.Equal(t, os.FileMode(0500).String(), fi.Mode().String())
 }
 
+// fakeArtifactContainer serves blobs from memory, the ETag is the content
+type fakeArtifactContainer map[string]string
+
+func (c fakeArtifactContainer) List() (map[string]blobsync.Blob, error) {
+	blobs := make(map[string]blobsync.Blob)
+	for name, content := range c {
+		blobs[name] = blobsync.Blob{ETag: content}
+	}
+	return blobs, nil
+}
+
+func (c fakeArtifactContainer) Get(name string) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader(c[name])), nil
+}
+
+func Test_downloadAndProcessArtifact_syncMode(t *testing.T) {
+	var openedURI string
+	container := fakeArtifactContainer{"app/app.sh": "echo\r\n"}
+	newArtifactContainer = func(uri string) (blobsync.Container, error) {
+		openedURI = uri
+		return container, nil
+	}
+	defer func() { newArtifactContainer = blobsync.NewSASContainer }()
+
+	targetDir := filepath.Join(t.TempDir(), "app")
+	artifact := handlersettings.UnifiedArtifact{
+		ArtifactId:       1,
+		ArtifactUri:      "https://account.blob.core.windows.net/container/prefix",
+		ArtifactSasToken: "?sv=2018-03-28&sig=secret",
+		Mode:             handlersettings.ArtifactModeSync,
+		TargetDirectory:  targetDir,
+	}
+	path, err := DownloadAndProcessArtifact(log.NewContext(log.NewNopLogger()), t.TempDir(), &artifact, nil, 0)
+	require.Nil(t, err)
+	require.Equal(t, targetDir, path)
+	require.Equal(t, "https://account.blob.core.windows.net/container/prefix?sv=2018-03-28&sig=secret", openedURI)
+
+	// The synced files are not post-processed
+	b, err := ioutil.ReadFile(filepath.Join(targetDir, "app", "app.sh"))
+	require.Nil(t, err)
+	require.Equal(t, "echo\r\n", string(b))
+
+	artifact.ArtifactSasToken = ""
+	_, err = DownloadAndProcessArtifact(log.NewContext(log.NewNopLogger()), t.TempDir(), &artifact, nil, 0)
+	require.ErrorContains(t, err, "a SAS token is required")
+}
+
+func Test_getCredentialDownloaders(t *testing.T) {
+	const blobURI = "https://a.blob.core.windows.net/c/app.tar.gz"
+	defer func() { download.MockReturnErrorForMockMsiDownloader = false }()
+	msiDownloader := download.MockMsiDownloader{}
+
+	d, credentials, err := getCredentialDownloaders("https://contoso.com/app.tar.gz", nil, msiDownloader)
+	require.Nil(t, err)
+	require.Len(t, d, 1)
+	require.Equal(t, []string{"anonymous"}, credentials)
+
+	download.MockReturnErrorForMockMsiDownloader = false
+	d, credentials, err = getCredentialDownloaders(blobURI, nil, msiDownloader)
+	require.Nil(t, err)
+	require.Len(t, d, 2)
+	require.Equal(t, []string{"systemManagedIdentity", "anonymous"}, credentials)
+
+	d, credentials, err = getCredentialDownloaders(blobURI, &handlersettings.RunCommandManagedIdentity{ClientId: "31b403aa-c364-4240-a7ff-d85fb6cd7232"}, msiDownloader)
+	require.Nil(t, err)
+	require.Len(t, d, 2)
+	require.Equal(t, []string{"managedIdentity(clientId=31b403aa-c364-4240-a7ff-d85fb6cd7232)", "anonymous"}, credentials)
+
+	// The managed identity is not tried when it has no token
+	download.MockReturnErrorForMockMsiDownloader = true
+	d, credentials, err = getCredentialDownloaders(blobURI, &handlersettings.RunCommandManagedIdentity{ObjectId: "7d1e2b3c"}, msiDownloader)
+	require.Nil(t, err)
+	require.Len(t, d, 1)
+	require.Equal(t, []string{"anonymous"}, credentials)
+}
+
 func Test_saveScriptFile(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "")
 	require.Nil(t, err)
@@ -227,3 +337,138 @@ func Test_saveScriptFile(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, content, string(result))
 }
+
+func Test_copyAndProcessLocalScript(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(srcDir)
+	tmpDir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	localPath := filepath.Join(srcDir, "prestaged.sh")
+	require.Nil(t, ioutil.WriteFile(localPath, []byte("#!/bin/sh\r\necho 'Hello, world!'\r\n"), 0644))
+
+	copiedFilePath, hash, err := CopyAndProcessLocalScript(localPath, tmpDir, PostProcessOptions{})
+	require.Nil(t, err)
+	sum := sha256.Sum256([]byte("#!/bin/sh\r\necho 'Hello, world!'\r\n"))
+	require.Equal(t, hex.EncodeToString(sum[:]), hash, "the hash is of the script before the post-processing")
+
+	fp := filepath.Join(tmpDir, "prestaged.sh")
+	require.Equal(t, fp, copiedFilePath)
+	fi, err := os.Stat(fp)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0500).String(), fi.Mode().String())
+	b, err := ioutil.ReadFile(fp)
+	require.Nil(t, err)
+	require.Equal(t, "#!/bin/sh\necho 'Hello, world!'\n", string(b))
+
+	// The pre-staged script is left untouched
+	b, err = ioutil.ReadFile(localPath)
+	require.Nil(t, err)
+	require.Equal(t, "#!/bin/sh\r\necho 'Hello, world!'\r\n", string(b))
+}
+
+func Test_copyAndProcessLocalScript_fail(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	_, _, err = CopyAndProcessLocalScript("/non/existing/path", tmpDir, PostProcessOptions{})
+	require.Contains(t, err.Error(), "local script '/non/existing/path' is not accessible")
+
+	_, _, err = CopyAndProcessLocalScript(tmpDir, tmpDir, PostProcessOptions{})
+	require.Contains(t, err.Error(), "is not a regular file")
+}
+
+func Test_downloadAndProcessScript_checksum(t *testing.T) {
+	// The checksum is of the published script, with its DOS-line endings
+	const script = "echo hello\r\n"
+	sum := sha256.Sum256([]byte(script))
+	checksum := hex.EncodeToString(sum[:])
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(script))
+	}))
+	defer srv.Close()
+
+	cfg := handlersettings.HandlerSettings{PublicSettings: handlersettings.PublicSettings{
+		Source: &handlersettings.ScriptSource{ScriptURI: srv.URL + "/script.sh", ScriptChecksum: "sha256:" + strings.ToUpper(checksum)}}}
+	tmpDir := t.TempDir()
+	path, hash, err := DownloadAndProcessScript(log.NewContext(log.NewNopLogger()), srv.URL+"/script.sh", tmpDir, &cfg)
+	require.Nil(t, err)
+	require.Equal(t, checksum, hash, "the hash is of the script as downloaded, like the checksum")
+	b, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, "echo hello\n", string(b))
+
+	// A script which doesn't match is removed
+	cfg.PublicSettings.Source.ScriptChecksum = strings.Repeat("0", 64)
+	tmpDir = t.TempDir()
+	_, _, err = DownloadAndProcessScript(log.NewContext(log.NewNopLogger()), srv.URL+"/script.sh", tmpDir, &cfg)
+	require.True(t, IsChecksumMismatch(errors.Wrap(err, "failed to download")))
+	require.EqualError(t, err, fmt.Sprintf("the SHA-256 of 'script.sh' is %s instead of the expected %s", checksum, strings.Repeat("0", 64)))
+	_, err = os.Stat(filepath.Join(tmpDir, "script.sh"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func Test_downloadAndProcessArtifact_checksum(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("payload"))
+	}))
+	defer srv.Close()
+
+	sum := sha256.Sum256([]byte("payload"))
+	artifact := handlersettings.UnifiedArtifact{ArtifactId: 1, ArtifactUri: srv.URL + "/app.bin", Checksum: hex.EncodeToString(sum[:])}
+	_, err := DownloadAndProcessArtifact(log.NewContext(log.NewNopLogger()), t.TempDir(), &artifact, nil, 0)
+	require.Nil(t, err)
+
+	artifact.Checksum = strings.Repeat("f", 64)
+	_, err = DownloadAndProcessArtifact(log.NewContext(log.NewNopLogger()), t.TempDir(), &artifact, nil, 0)
+	require.True(t, IsChecksumMismatch(err))
+	require.False(t, IsChecksumMismatch(errors.New("connection reset")))
+}
+
+func Test_cloneAndProcessGitRepository(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	repoDir := t.TempDir()
+	require.Nil(t, os.MkdirAll(filepath.Join(repoDir, "deploy"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(repoDir, "deploy", "run.sh"), []byte("#!/bin/sh\r\necho 'Hello, world!'\r\n"), 0644))
+	require.Nil(t, os.Symlink("/etc/passwd", filepath.Join(repoDir, "passwd")))
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "scripts"},
+	} {
+		out, err := exec.Command("git", append([]string{"-C", repoDir}, args...)...).CombinedOutput()
+		require.Nil(t, err, string(out))
+	}
+
+	cfg := func(entrypoint string) *handlersettings.HandlerSettings {
+		return &handlersettings.HandlerSettings{PublicSettings: handlersettings.PublicSettings{Source: &handlersettings.ScriptSource{
+			GitRepository: &handlersettings.GitRepositorySource{URL: "file://" + repoDir, Entrypoint: entrypoint},
+		}}}
+	}
+	dir := filepath.Join(t.TempDir(), "repository")
+	entrypoint, _, err := CloneAndProcessGitRepository(ctx, dir, cfg("deploy/run.sh"))
+	require.Nil(t, err)
+	resolvedDir, err := filepath.EvalSymlinks(dir)
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(resolvedDir, "deploy", "run.sh"), entrypoint)
+	fi, err := os.Stat(entrypoint)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0700).String(), fi.Mode().String())
+	b, err := ioutil.ReadFile(entrypoint)
+	require.Nil(t, err)
+	require.Equal(t, "#!/bin/sh\necho 'Hello, world!'\n", string(b))
+
+	// The repository is downloaded again, replacing the previous download
+	_, _, err = CloneAndProcessGitRepository(ctx, dir, cfg("deploy/run.sh"))
+	require.Nil(t, err)
+
+	_, _, err = CloneAndProcessGitRepository(ctx, dir, cfg("passwd"))
+	require.Contains(t, err.Error(), "leads out of the scripts")
+	_, _, err = CloneAndProcessGitRepository(ctx, dir, cfg("deploy"))
+	require.Contains(t, err.Error(), "is not a regular file")
+	_, _, err = CloneAndProcessGitRepository(ctx, dir, cfg("missing.sh"))
+	require.Contains(t, err.Error(), "is not in the scripts")
+}
@@ -1,17 +1,23 @@
 package files
 
 import (
+	"bufio"
+	"bytes"
 	"io"
 	"os"
+	"regexp"
 
+	"github.com/Azure/run-command-handler-linux/internal/outputfile"
+	"github.com/Azure/run-command-handler-linux/pkg/encodingutil"
 	"github.com/pkg/errors"
 )
 
 // TailFile returns the last max bytes (or the entire file if the file size is
-// smaller than max) from the file at path. If the file does not exist, it
-// returns a nil slice and no error.
+// smaller than max) from the output file at path, decompressed if it is
+// compressed in segments. If the file does not exist, it returns a nil slice
+// and no error.
 func TailFile(path string, max int64) ([]byte, error) {
-	f, err := os.Open(path)
+	f, err := outputfile.Open(path)
 	if err != nil && os.IsNotExist(err) {
 		return nil, nil
 	} else if err != nil {
@@ -19,23 +25,202 @@ func TailFile(path string, max int64) ([]byte, error) {
 	}
 	defer f.Close()
 
-	fi, err := f.Stat()
+	size, err := f.Size()
 	if err != nil {
 		return nil, errors.Wrap(err, "error retrieving file info")
 	}
-	size := fi.Size()
 
 	n := max
 	if size < n {
 		n = size
 	}
-	_, err = f.Seek(-n, io.SeekEnd)
+
+	// The file may grow meanwhile, only the n bytes found are read
+	b := make([]byte, n)
+	read, err := f.ReadAt(b, size-n)
+	if err == io.EOF {
+		// The file was truncated meanwhile
+		err = nil
+	}
+	return b[:read], errors.Wrap(err, "error reading from file")
+}
+
+// truncationMarker replaces the part of an output file cut by HeadAndTailFile and TailFileWithMatches
+const truncationMarker = "[output truncated]\n"
+
+// HeadAndTailFile returns the output file at path like TailFile when it is at most max bytes. A larger file is cut
+// in the middle: a quarter of max is kept for its first bytes and the rest for its last ones, separated by a
+// truncation marker on its own line, so the beginning of a long output (e.g., a single huge line) isn't lost. The
+// cuts never split a UTF-8 character.
+func HeadAndTailFile(path string, max int64) ([]byte, error) {
+	f, err := outputfile.Open(path)
+	if err != nil && os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "error opening file")
+	}
+	defer f.Close()
+
+	size, err := f.Size()
+	if err != nil {
+		return nil, errors.Wrap(err, "error retrieving file info")
+	}
+	marker := "\n" + truncationMarker
+	headLen := max / 4
+	tailLen := max - headLen - int64(len(marker))
+	if size <= max || headLen <= 0 || tailLen <= 0 {
+		return TailFile(path, max)
+	}
+
+	head := make([]byte, headLen)
+	read, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "error reading from file")
+	}
+	head = head[:read]
+	tail := make([]byte, tailLen)
+	read, err = f.ReadAt(tail, size-tailLen)
+	if err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "error reading from file")
+	}
+	tail = encodingutil.TrimLeadingPartialRune(tail[:read])
+
+	b := append(head[:encodingutil.CompleteRunesLength(head)], marker...)
+	return append(b, tail...), nil
+}
+
+// TailFileWithMatches returns the last max bytes of the file at path like TailFile, except that when the file is
+// larger than max, the lines before the tail that match pattern (e.g., the error lines of a long output) are kept in
+// place of the oldest lines of the tail, so they survive the truncation. At least half of max is kept for the last
+// lines, which start at the beginning of a line.
+func TailFileWithMatches(path string, max int64, pattern *regexp.Regexp) ([]byte, error) {
+	return NewMatchingTail(path, max, pattern).Read()
+}
+
+// MatchingTail reads the tail of a growing file like TailFileWithMatches, e.g., the stderr of a script on every
+// status update. The matched lines and how far the file was scanned are kept between reads, so each read only scans
+// the lines written since the previous one.
+type MatchingTail struct {
+	path    string
+	max     int64
+	pattern *regexp.Regexp
+
+	// scanned is the offset up to which the file was scanned, the start of a line unless skipping
+	scanned int64
+
+	// skipping is set while scanning a line longer than the buffer, which is not matched
+	skipping bool
+
+	matches    []lineMatch
+	matchesLen int64
+}
+
+// lineMatch is a line matching the pattern of a MatchingTail and its offset in the file
+type lineMatch struct {
+	offset int64
+	line   []byte
+}
+
+// NewMatchingTail returns the tail of the file at path, of at most max bytes, keeping the lines matching pattern
+func NewMatchingTail(path string, max int64, pattern *regexp.Regexp) *MatchingTail {
+	return &MatchingTail{path: path, max: max, pattern: pattern}
+}
+
+// Read returns the tail of the file as it is now, see TailFileWithMatches
+func (t *MatchingTail) Read() ([]byte, error) {
+	f, err := outputfile.Open(t.path)
+	if err != nil && os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "error opening file")
+	}
+	defer f.Close()
+
+	size, err := f.Size()
 	if err != nil {
-		return nil, errors.Wrapf(err, "error seeking file: offset=%d whence=%v", n, io.SeekEnd)
+		return nil, errors.Wrap(err, "error retrieving file info")
 	}
+	budget := t.max/2 - int64(len(truncationMarker))
+	if size <= t.max || budget <= 0 {
+		return TailFile(t.path, t.max)
+	}
+
+	if size < t.scanned {
+		// The file was truncated meanwhile, it is scanned again
+		*t = MatchingTail{path: t.path, max: t.max, pattern: t.pattern}
+	}
+	if err := t.scan(f, size-t.max/2, budget); err != nil {
+		return nil, err
+	}
+
+	// The last lines fill the rest, the matches within them are not repeated
+	tailLen := t.max - t.matchesLen - int64(len(truncationMarker))
+	tail := make([]byte, tailLen+1)
+	read, err := f.ReadAt(tail, size-tailLen-1)
+	if err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "error reading from file")
+	}
+	tail = tail[:read]
+	i := bytes.IndexByte(tail, '\n')
+	if i < 0 {
+		return TailFile(t.path, t.max)
+	}
+	tail = tail[i+1:]
+	tailOffset := size - tailLen - 1 + int64(i) + 1
 
-	b, err := io.ReadAll(io.LimitReader(f, max))
-	return b, errors.Wrap(err, "error reading from file")
+	var b []byte
+	for _, m := range t.matches {
+		if m.offset < tailOffset {
+			b = append(b, m.line...)
+		}
+	}
+	if len(b) == 0 {
+		return TailFile(t.path, t.max)
+	}
+	b = append(b, truncationMarker...)
+	return append(b, tail...), nil
+}
+
+// scan matches the complete lines written between the scanned offset and limit, keeping the last matches fitting in
+// budget. The last line is scanned once it is complete.
+func (t *MatchingTail) scan(f io.ReaderAt, limit, budget int64) error {
+	if limit <= t.scanned {
+		return nil
+	}
+	r := bufio.NewReader(io.NewSectionReader(f, t.scanned, limit-t.scanned))
+	for {
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull || (err == io.EOF && t.skipping) {
+			// Lines longer than the buffer are not matched
+			t.scanned += int64(len(line))
+			t.skipping = true
+			if err == io.EOF {
+				return nil
+			}
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "error reading from file")
+		}
+
+		offset := t.scanned
+		t.scanned += int64(len(line))
+		if t.skipping {
+			t.skipping = false
+			continue
+		}
+		if int64(len(line)) < budget && t.pattern.Match(line) {
+			t.matches = append(t.matches, lineMatch{offset: offset, line: append([]byte(nil), line...)})
+			t.matchesLen += int64(len(line))
+			// The last matches are kept
+			for t.matchesLen > budget {
+				t.matchesLen -= int64(len(t.matches[0].line))
+				t.matches = t.matches[1:]
+			}
+		}
+	}
 }
 
 func GetFileFromPosition(path string, position int64) ([]byte, error) {
@@ -3,7 +3,10 @@ package files
 import (
 	"bytes"
 	"os"
+	"regexp"
+	"strings"
 	"testing"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/require"
 )
@@ -52,6 +55,116 @@ func Test_tailFile(t *testing.T) {
 	require.EqualValues(t, in, b)
 }
 
+func Test_tailFileWithMatches(t *testing.T) {
+	tf := tempFile(t)
+	defer os.RemoveAll(tf)
+	pattern := regexp.MustCompile(`error`)
+
+	var in bytes.Buffer
+	in.WriteString("error: first\n")
+	for i := 0; i < 20; i++ {
+		in.WriteString("line\n")
+	}
+	in.WriteString("error: second\n")
+	for i := 0; i < 20; i++ {
+		in.WriteString("last\n")
+	}
+	require.Nil(t, os.WriteFile(tf, in.Bytes(), 0666))
+
+	// max>=size
+	b, err := TailFileWithMatches(tf, int64(in.Len()), pattern)
+	require.Nil(t, err)
+	require.Equal(t, in.Bytes(), b)
+
+	// The matched lines are kept in place of the oldest lines of the tail
+	b, err = TailFileWithMatches(tf, 106, pattern)
+	require.Nil(t, err)
+	require.Equal(t, "error: first\nerror: second\n"+truncationMarker+strings.Repeat("last\n", 12), string(b))
+
+	// Only the last matches fitting in half of max are kept
+	b, err = TailFileWithMatches(tf, 70, pattern)
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(string(b), "error: second\n"+truncationMarker), string(b))
+
+	// Without matches, the tail is returned
+	b, err = TailFileWithMatches(tf, 50, regexp.MustCompile(`missing`))
+	require.Nil(t, err)
+	require.Equal(t, in.Bytes()[in.Len()-50:], b)
+
+	b, err = TailFileWithMatches("/non/existing/path", 50, pattern)
+	require.Nil(t, err)
+	require.Len(t, b, 0)
+}
+
+func Test_matchingTail(t *testing.T) {
+	tf := tempFile(t)
+	defer os.RemoveAll(tf)
+	f, err := os.OpenFile(tf, os.O_WRONLY|os.O_APPEND, 0)
+	require.Nil(t, err)
+	defer f.Close()
+	tail := NewMatchingTail(tf, 106, regexp.MustCompile(`error`))
+
+	f.WriteString("error: first\n" + strings.Repeat("line\n", 20))
+	b, err := tail.Read()
+	require.Nil(t, err)
+	require.Equal(t, "error: first\n"+truncationMarker+strings.Repeat("line\n", 14), string(b))
+	scanned := tail.scanned
+	require.Equal(t, int64(len("error: first\n")+9*5), scanned, "the complete lines before the tail are scanned")
+
+	// Only the lines written since are scanned, the last one once it is complete
+	f.WriteString("error: second\n" + strings.Repeat("last\n", 20) + "error: incompl")
+	b, err = tail.Read()
+	require.Nil(t, err)
+	require.Equal(t, "error: first\nerror: second\n"+truncationMarker+strings.Repeat("last\n", 9)+"error: incompl", string(b))
+	require.Greater(t, tail.scanned, scanned)
+	require.Len(t, tail.matches, 2)
+	f.WriteString("ete\n" + strings.Repeat("last\n", 20))
+	_, err = tail.Read()
+	require.Nil(t, err)
+	require.Len(t, tail.matches, 2, "the first match no longer fits")
+	require.Equal(t, "error: incomplete\n", string(tail.matches[1].line))
+
+	// A truncated file is scanned again
+	require.Nil(t, os.Truncate(tf, 0))
+	f.WriteString(strings.Repeat("line\n", 30))
+	b, err = tail.Read()
+	require.Nil(t, err)
+	require.Equal(t, strings.Repeat("line\n", 30)[150-106:], string(b))
+	require.Empty(t, tail.matches)
+}
+
+func Test_headAndTailFile(t *testing.T) {
+	tf := tempFile(t)
+	defer os.RemoveAll(tf)
+
+	// A single huge line
+	line := strings.Repeat("a", 100) + strings.Repeat("b", 1000) + strings.Repeat("c", 100) + "\n"
+	require.Nil(t, os.WriteFile(tf, []byte(line), 0666))
+
+	// max>=size
+	b, err := HeadAndTailFile(tf, int64(len(line)))
+	require.Nil(t, err)
+	require.Equal(t, line, string(b))
+
+	// The middle is cut, a quarter of max is kept for the head
+	b, err = HeadAndTailFile(tf, 400)
+	require.Nil(t, err)
+	require.Len(t, b, 400)
+	require.Equal(t, strings.Repeat("a", 100)+"\n"+truncationMarker, string(b[:100+1+len(truncationMarker)]))
+	require.True(t, strings.HasSuffix(string(b), strings.Repeat("c", 100)+"\n"), string(b))
+
+	// The cuts don't split a character
+	require.Nil(t, os.WriteFile(tf, []byte(strings.Repeat("é", 500)), 0666))
+	b, err = HeadAndTailFile(tf, 201)
+	require.Nil(t, err)
+	require.True(t, utf8.Valid(b), string(b))
+	require.Equal(t, strings.Repeat("é", 25)+"\n"+truncationMarker, string(b[:50+1+len(truncationMarker)]))
+
+	b, err = HeadAndTailFile("/non/existing/path", 50)
+	require.Nil(t, err)
+	require.Len(t, b, 0)
+}
+
 func Test_getFileFromPosition(t *testing.T) {
 	tf := tempFile(t)
 	defer os.RemoveAll(tf)
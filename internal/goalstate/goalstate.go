@@ -1,3 +1,5 @@
+//go:build !slim
+
 package goalstate
 
 import (
@@ -9,6 +11,7 @@ import (
 	commands "github.com/Azure/run-command-handler-linux/internal/cmds"
 	"github.com/Azure/run-command-handler-linux/internal/commandProcessor"
 	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/multistep"
 	"github.com/Azure/run-command-handler-linux/internal/settings"
 	"github.com/Azure/run-command-handler-linux/internal/status"
 	"github.com/go-kit/kit/log"
@@ -25,8 +28,8 @@ func HandleImmediateGoalState(ctx *log.Context, setting settings.SettingsCommon)
 	err := make(chan error)
 	go startAsync(ctx, setting, done, err)
 	select {
-	case <-err:
-		return errors.Wrapf(<-err, "error when trying to execute goal state")
+	case e := <-err:
+		return errors.Wrapf(e, "error when trying to execute goal state")
 	case <-done:
 		ctx.Log("message", "goal state successfully finished")
 		return nil
@@ -35,6 +38,16 @@ func HandleImmediateGoalState(ctx *log.Context, setting settings.SettingsCommon)
 	}
 }
 
+// ReportExpiredGoalState reports the goal state as expired without executing it
+func ReportExpiredGoalState(ctx *log.Context, setting settings.SettingsCommon, expiry time.Time) error {
+	cmd, ok := commands.Cmds[enableCommand]
+	if !ok {
+		return errors.New("missing enable command")
+	}
+	cmd.Functions.ReportStatus = status.ReportStatusToBlob
+	return errors.Wrap(commandProcessor.ReportImmediateExpired(cmd, *setting.ExtensionName, *setting.SeqNo, expiry), "failed to report the expired goal state")
+}
+
 func startAsync(ctx *log.Context, setting settings.SettingsCommon, done chan bool, err chan error) {
 	cmd, ok := commands.Cmds[enableCommand]
 	if !ok {
@@ -50,7 +63,13 @@ func startAsync(ctx *log.Context, setting settings.SettingsCommon, done chan boo
 	var runtimeSettings []handlersettings.RunTimeSettingsFile
 	hs.RuntimeSettings = append(runtimeSettings, handlersettings.RunTimeSettingsFile{HandlerSettings: setting})
 	ctx.Log("message", "executing immediate goal state")
-	commandProcessor.ProcessImmediateHandlerCommand(cmd, hs, *setting.ExtensionName, *setting.SeqNo)
+	if processErr := commandProcessor.ProcessImmediateHandlerCommand(cmd, hs, *setting.ExtensionName, *setting.SeqNo); processErr != nil {
+		// The service reboots the VM and resumes the execution once it boots
+		if _, ok := multistep.IsRebootPending(processErr); ok {
+			err <- processErr
+			return
+		}
+	}
 
 	// TODO: Remove (only for simulating long duration processes)
 	rand.Seed(time.Now().UnixNano())
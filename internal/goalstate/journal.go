@@ -0,0 +1,200 @@
+package goalstate
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/multistep"
+	"github.com/Azure/run-command-handler-linux/internal/settings"
+	"github.com/Azure/run-command-handler-linux/pkg/atomicfile"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Maximum number of goal states remembered by the journal. Oldest entries are evicted first.
+	maxJournalEntries = 1000
+)
+
+// JournalEntry records an immediate goal state that was already launched
+type JournalEntry struct {
+	ExtensionName string    `json:"extensionName"`
+	SeqNo         int       `json:"seqNo"`
+	Hash          string    `json:"hash"`
+	LaunchedAt    time.Time `json:"launchedAt"`
+
+	// ResumeStep is the step the execution resumes at once the VM reboots, as requested by its script. The goal
+	// state is kept until then to execute it again.
+	ResumeStep int                      `json:"resumeStep,omitempty"`
+	Settings   *settings.SettingsCommon `json:"settings,omitempty"`
+
+	// Progress is the steps of the execution completed so far, each of them requested a reboot
+	Progress *multistep.Progress `json:"progress,omitempty"`
+}
+
+// Journal is a durable record of the immediate goal states already executed. It is used to skip
+// goal states re-delivered by HGAP (e.g., after a reconnect) so they do not run twice.
+type Journal struct {
+	path    string
+	mutex   sync.Mutex
+	entries map[string]JournalEntry
+}
+
+// GetJournalPath returns the path of the journal file under the given data directory
+func GetJournalPath(dataDir string) string {
+	return filepath.Join(dataDir, constants.GoalStateJournalFileName)
+}
+
+// LoadJournal reads the journal at path. A missing file results in an empty journal.
+func LoadJournal(path string) (*Journal, error) {
+	j := &Journal{path: path, entries: make(map[string]JournalEntry)}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return j, nil
+		}
+		return j, errors.Wrap(err, "journal: failed to read")
+	}
+
+	var entries []JournalEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return j, errors.Wrap(err, "journal: failed to parse")
+	}
+
+	for _, e := range entries {
+		j.entries[journalKey(e.ExtensionName, e.SeqNo)] = e
+	}
+	return j, nil
+}
+
+// Contains returns true if the goal state was already launched. A goal state whose settings changed since it was
+// launched with the same extension name and sequence number is not a duplicate, it is launched again.
+func (j *Journal) Contains(setting settings.SettingsCommon) bool {
+	hash, err := settingsHash(setting)
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	e, ok := j.entries[journalKey(*setting.ExtensionName, *setting.SeqNo)]
+	// A goal state that can't be hashed is not recorded with its hash either
+	return ok && (err != nil || e.Hash == hash)
+}
+
+// Add records the goal state as launched and persists the journal
+func (j *Journal) Add(setting settings.SettingsCommon) error {
+	hash, err := settingsHash(setting)
+	if err != nil {
+		return err
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.entries[journalKey(*setting.ExtensionName, *setting.SeqNo)] = JournalEntry{
+		ExtensionName: *setting.ExtensionName,
+		SeqNo:         *setting.SeqNo,
+		Hash:          hash,
+		LaunchedAt:    time.Now().UTC(),
+	}
+	return j.save()
+}
+
+// MarkRebootPending records that the goal state resumes at the given step once the VM reboots
+func (j *Journal) MarkRebootPending(setting settings.SettingsCommon, step int) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	key := journalKey(*setting.ExtensionName, *setting.SeqNo)
+	e, ok := j.entries[key]
+	if !ok {
+		return errors.Errorf("journal: goal state %s was not launched", key)
+	}
+	e.ResumeStep = step
+	e.Settings = &setting
+	j.entries[key] = e
+	return j.save()
+}
+
+// LoadProgress returns the steps completed by the execution of the goal state, nil if none is recorded
+func (j *Journal) LoadProgress(extensionName string, seqNo int) (*multistep.Progress, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.entries[journalKey(extensionName, seqNo)].Progress, nil
+}
+
+// SaveProgress records the steps completed by the execution of the goal state, a nil progress clears them
+func (j *Journal) SaveProgress(extensionName string, seqNo int, p *multistep.Progress) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	key := journalKey(extensionName, seqNo)
+	e, ok := j.entries[key]
+	if !ok {
+		if p == nil {
+			return nil
+		}
+		return errors.Errorf("journal: goal state %s was not launched", key)
+	}
+	e.Progress = p
+	j.entries[key] = e
+	return j.save()
+}
+
+// TakeRebootPending returns the goal states to resume after a reboot and clears them from the journal, so a step
+// interrupted by an unexpected reboot is not executed again
+func (j *Journal) TakeRebootPending() ([]JournalEntry, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	var pending []JournalEntry
+	for key, e := range j.entries {
+		if e.Settings == nil {
+			continue
+		}
+		pending = append(pending, e)
+		e.ResumeStep = 0
+		e.Settings = nil
+		j.entries[key] = e
+	}
+	if len(pending) == 0 {
+		return nil, nil
+	}
+	sort.Slice(pending, func(a, b int) bool { return pending[a].LaunchedAt.Before(pending[b].LaunchedAt) })
+	return pending, j.save()
+}
+
+// save writes the journal to a temporary file and moves it to its final destination for atomicity.
+// Callers must hold the mutex.
+func (j *Journal) save() error {
+	entries := make([]JournalEntry, 0, len(j.entries))
+	for _, e := range j.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].LaunchedAt.After(entries[b].LaunchedAt) })
+
+	if len(entries) > maxJournalEntries {
+		for _, e := range entries[maxJournalEntries:] {
+			delete(j.entries, journalKey(e.ExtensionName, e.SeqNo))
+		}
+		entries = entries[:maxJournalEntries]
+	}
+
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return errors.Wrap(err, "journal: failed to marshal")
+	}
+
+	return errors.Wrap(atomicfile.WriteFile(j.path, b, 0600), "journal")
+}
+
+func journalKey(extensionName string, seqNo int) string {
+	return fmt.Sprintf("%s.%d", extensionName, seqNo)
+}
+
+func settingsHash(setting settings.SettingsCommon) (string, error) {
+	b, err := json.Marshal(setting)
+	if err != nil {
+		return "", errors.Wrap(err, "journal: failed to marshal goal state")
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b)), nil
+}
@@ -0,0 +1,128 @@
+package goalstate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/multistep"
+	"github.com/Azure/run-command-handler-linux/internal/settings"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSetting(extensionName string, seqNo int) settings.SettingsCommon {
+	return settings.SettingsCommon{ExtensionName: &extensionName, SeqNo: &seqNo}
+}
+
+func Test_JournalPersistsLaunchedGoalStates(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	path := GetJournalPath(tmpDir)
+	journal, err := LoadJournal(path)
+	require.Nil(t, err)
+	require.False(t, journal.Contains(newTestSetting("rc1", 1)))
+
+	require.Nil(t, journal.Add(newTestSetting("rc1", 1)))
+	require.True(t, journal.Contains(newTestSetting("rc1", 1)))
+	require.False(t, journal.Contains(newTestSetting("rc1", 2)))
+
+	reloaded, err := LoadJournal(path)
+	require.Nil(t, err)
+	require.True(t, reloaded.Contains(newTestSetting("rc1", 1)))
+}
+
+func Test_JournalComparesTheSettings(t *testing.T) {
+	journal, err := LoadJournal(GetJournalPath(t.TempDir()))
+	require.Nil(t, err)
+	launched := newTestSetting("rc1", 1)
+	launched.PublicSettings = map[string]interface{}{"source": map[string]interface{}{"script": "date"}}
+	require.Nil(t, journal.Add(launched))
+	require.True(t, journal.Contains(launched))
+
+	changed := newTestSetting("rc1", 1)
+	changed.PublicSettings = map[string]interface{}{"source": map[string]interface{}{"script": "uptime"}}
+	require.False(t, journal.Contains(changed), "the goal state changed with the same extension name and sequence number")
+	require.Nil(t, journal.Add(changed))
+	require.True(t, journal.Contains(changed))
+	require.False(t, journal.Contains(launched))
+}
+
+func Test_JournalFailsOnCorruptedFile(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "corrupted.journal")
+	require.Nil(t, os.WriteFile(path, []byte("not json"), 0600))
+
+	journal, err := LoadJournal(path)
+	require.ErrorContains(t, err, "journal: failed to parse")
+	require.NotNil(t, journal)
+	require.False(t, journal.Contains(newTestSetting("rc1", 1)))
+}
+
+func Test_JournalResumesGoalStatesAfterReboot(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	path := GetJournalPath(tmpDir)
+	journal, err := LoadJournal(path)
+	require.Nil(t, err)
+	require.Error(t, journal.MarkRebootPending(newTestSetting("rc1", 1), 2), "a goal state not launched can't resume")
+
+	require.Nil(t, journal.Add(newTestSetting("rc1", 1)))
+	require.Nil(t, journal.Add(newTestSetting("rc2", 1)))
+	require.Nil(t, journal.MarkRebootPending(newTestSetting("rc1", 1), 2))
+
+	reloaded, err := LoadJournal(path)
+	require.Nil(t, err)
+	pending, err := reloaded.TakeRebootPending()
+	require.Nil(t, err)
+	require.Len(t, pending, 1)
+	require.Equal(t, "rc1", *pending[0].Settings.ExtensionName)
+	require.Equal(t, 2, pending[0].ResumeStep)
+	require.True(t, reloaded.Contains(newTestSetting("rc1", 1)), "the goal state is not executed again when re-delivered")
+
+	reloaded, err = LoadJournal(path)
+	require.Nil(t, err)
+	pending, err = reloaded.TakeRebootPending()
+	require.Nil(t, err)
+	require.Empty(t, pending, "a goal state is resumed once")
+}
+
+func Test_JournalPersistsProgress(t *testing.T) {
+	path := GetJournalPath(t.TempDir())
+	journal, err := LoadJournal(path)
+	require.Nil(t, err)
+	require.Error(t, journal.SaveProgress("rc1", 1, &multistep.Progress{}), "a goal state not launched has no progress")
+	require.Nil(t, journal.SaveProgress("rc1", 1, nil))
+
+	require.Nil(t, journal.Add(newTestSetting("rc1", 1)))
+	p, err := journal.LoadProgress("rc1", 1)
+	require.Nil(t, err)
+	require.Nil(t, p)
+
+	progress := multistep.Progress{StartedAt: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)}
+	progress.Complete(194, "step 1 done", progress.StartedAt.Add(time.Minute))
+	require.Nil(t, journal.SaveProgress("rc1", 1, &progress))
+
+	reloaded, err := LoadJournal(path)
+	require.Nil(t, err)
+	p, err = reloaded.LoadProgress("rc1", 1)
+	require.Nil(t, err)
+	require.Equal(t, &progress, p)
+	p, err = reloaded.LoadProgress("rc1", 2)
+	require.Nil(t, err)
+	require.Nil(t, p, "the progress of another sequence number is not returned")
+
+	require.Nil(t, reloaded.SaveProgress("rc1", 1, nil))
+	reloaded, err = LoadJournal(path)
+	require.Nil(t, err)
+	p, err = reloaded.LoadProgress("rc1", 1)
+	require.Nil(t, err)
+	require.Nil(t, p)
+}
@@ -0,0 +1,201 @@
+package handlersettings
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
+	"github.com/Azure/run-command-handler-linux/pkg/atomicfile"
+	"github.com/Azure/run-command-handler-linux/pkg/encodingutil"
+	"github.com/go-kit/kit/log"
+)
+
+// maxLoggedSettingLen bounds the length of the values logged for a changed public setting, e.g., an inline script
+const maxLoggedSettingLen = 256
+
+// cachedSettings are the settings parsed and validated from a config file, along with the hash of the file and
+// their snapshot
+type cachedSettings struct {
+	hash     string
+	settings HandlerSettings
+	snapshot settingsSnapshot
+}
+
+// settingsSnapshot is what is saved on disk of the last settings of an extension, so the changes are logged between
+// the invocations of the handler, each a process of its own. The protected settings are only kept as a hash.
+type settingsSnapshot struct {
+	ConfigPath            string            `json:"configPath"`
+	Hash                  string            `json:"hash"`
+	PublicSettings        map[string]string `json:"publicSettings"`
+	ProtectedSettingsHash string            `json:"protectedSettingsHash"`
+}
+
+var (
+	settingsCacheMu sync.Mutex
+	// settingsCache keeps the last settings of every config file, by path (i.e., per extension and sequence number)
+	settingsCache = make(map[string]cachedSettings)
+)
+
+// getCachedSettings returns the settings of the config file at configPath, which are only parsed, decrypted and
+// validated again when the file changed. Every caller gets a copy of its own. The changes since the last settings of
+// the extension are logged.
+func getCachedSettings(ctx *log.Context, configPath string, extensionName string) (HandlerSettings, error) {
+	hash, err := hashConfigFile(configPath)
+	if err != nil {
+		// The parsing reports the error
+		return ParseAndValidateSettings(ctx, configPath)
+	}
+
+	settingsCacheMu.Lock()
+	previous, found := settingsCache[configPath]
+	settingsCacheMu.Unlock()
+	if found && previous.hash == hash {
+		ctx.Log("event", "using cached configuration of "+configPath)
+		return copySettings(previous.settings), nil
+	}
+
+	// Invalid settings are not cached, they are parsed again to report the error
+	cfg, err := ParseAndValidateSettings(ctx, configPath)
+	if err != nil {
+		return cfg, err
+	}
+
+	snapshot := newSettingsSnapshot(configPath, hash, cfg)
+	snapshotPath := datapaths.SettingsSnapshotFilePath(constants.SettingsSnapshotDir, extensionName)
+	last, ok := loadSettingsSnapshot(snapshotPath)
+	if !ok && found {
+		last, ok = previous.snapshot, true
+	}
+	if ok && last.ConfigPath == configPath && last.Hash != hash {
+		logSettingsChanges(ctx, configPath, last, snapshot)
+	}
+	if err := saveSettingsSnapshot(snapshotPath, snapshot); err != nil {
+		ctx.Log("warning", "the changes of the settings will not be logged by the next invocation", "error", err)
+	}
+
+	settingsCacheMu.Lock()
+	settingsCache[configPath] = cachedSettings{hash: hash, settings: copySettings(cfg), snapshot: snapshot}
+	settingsCacheMu.Unlock()
+	return cfg, nil
+}
+
+// copySettings returns a deep copy of cfg, which shares no slice, map or pointer with it
+func copySettings(cfg HandlerSettings) HandlerSettings {
+	var c HandlerSettings
+	if b, err := json.Marshal(cfg.PublicSettings); err == nil {
+		json.Unmarshal(b, &c.PublicSettings)
+	}
+	if b, err := json.Marshal(cfg.ProtectedSettings); err == nil {
+		json.Unmarshal(b, &c.ProtectedSettings)
+	}
+
+	// The settings only kept in memory
+	if cfg.PublicSettings.ResourceLimits != nil {
+		limits := *cfg.PublicSettings.ResourceLimits
+		c.PublicSettings.ResourceLimits = &limits
+	}
+	if cfg.ProtectedSettings.KeyVaultSecrets != nil {
+		c.ProtectedSettings.KeyVaultSecrets = make(map[string]string, len(cfg.ProtectedSettings.KeyVaultSecrets))
+		for name, value := range cfg.ProtectedSettings.KeyVaultSecrets {
+			c.ProtectedSettings.KeyVaultSecrets[name] = value
+		}
+	}
+	return c
+}
+
+func newSettingsSnapshot(configPath string, hash string, cfg HandlerSettings) settingsSnapshot {
+	protected, _ := json.Marshal(cfg.ProtectedSettings)
+	protectedHash := sha256.Sum256(protected)
+	return settingsSnapshot{
+		ConfigPath:            configPath,
+		Hash:                  hash,
+		PublicSettings:        settingValues(cfg.PublicSettings),
+		ProtectedSettingsHash: hex.EncodeToString(protectedHash[:]),
+	}
+}
+
+// loadSettingsSnapshot reads the snapshot at path, if any
+func loadSettingsSnapshot(path string) (settingsSnapshot, bool) {
+	var snapshot settingsSnapshot
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return snapshot, false
+	}
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return snapshot, false
+	}
+	return snapshot, true
+}
+
+func saveSettingsSnapshot(path string, snapshot settingsSnapshot) error {
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, b, 0600)
+}
+
+func hashConfigFile(configPath string) (string, error) {
+	b, err := os.ReadFile(configPath)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// logSettingsChanges logs the public settings that changed between the attempts with their old and new values, and
+// whether the protected settings changed, without their values
+func logSettingsChanges(ctx *log.Context, configPath string, previous, current settingsSnapshot) {
+	oldValues, newValues := previous.PublicSettings, current.PublicSettings
+	var changed []string
+	for name := range oldValues {
+		if _, ok := newValues[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	for name, value := range newValues {
+		if oldValues[name] != value {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+
+	protectedChanged := previous.ProtectedSettingsHash != current.ProtectedSettingsHash
+	ctx.Log("event", "configuration changed since the last attempt", "path", configPath, "publicSettings", strings.Join(changed, ","), "protectedSettingsChanged", protectedChanged)
+	for _, name := range changed {
+		ctx.Log("message", "public setting changed", "setting", name, "old", truncateSetting(oldValues[name]), "new", truncateSetting(newValues[name]))
+	}
+}
+
+// settingValues returns the JSON value of every public setting that is set, by name
+func settingValues(public PublicSettings) map[string]string {
+	values := make(map[string]string)
+	b, err := json.Marshal(public)
+	if err != nil {
+		return values
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return values
+	}
+	for name, raw := range fields {
+		values[name] = string(raw)
+	}
+	return values
+}
+
+// truncateSetting bounds the length of a logged setting value
+func truncateSetting(value string) string {
+	return encodingutil.Truncate(value, maxLoggedSettingLen)
+}
@@ -0,0 +1,112 @@
+package handlersettings
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestConfig(t *testing.T, configFolder string, publicSettings string) {
+	settings := `{"runtimeSettings": [{"handlerSettings": {"publicSettings": ` + publicSettings + `}}]}`
+	require.Nil(t, os.WriteFile(GetConfigFilePath(configFolder, 1, "testExtension"), []byte(settings), 0600))
+}
+
+func Test_GetHandlerSettings_cache(t *testing.T) {
+	defer func(dir string) { constants.SettingsSnapshotDir = dir }(constants.SettingsSnapshotDir)
+	constants.SettingsSnapshotDir = t.TempDir()
+	configFolder := t.TempDir()
+	var logs bytes.Buffer
+	ctx := log.NewContext(log.NewLogfmtLogger(&logs))
+
+	writeTestConfig(t, configFolder, `{"source": {"script": "date"}, "timeoutInSeconds": 10}`)
+	cfg, err := GetHandlerSettings(configFolder, "testExtension", 1, ctx)
+	require.Nil(t, err)
+	require.Equal(t, 10, cfg.PublicSettings.TimeoutInSeconds)
+	require.NotContains(t, logs.String(), "using cached configuration")
+
+	// Unchanged settings are not parsed again
+	logs.Reset()
+	cfg, err = GetHandlerSettings(configFolder, "testExtension", 1, ctx)
+	require.Nil(t, err)
+	require.Equal(t, 10, cfg.PublicSettings.TimeoutInSeconds)
+	require.Contains(t, logs.String(), "using cached configuration")
+	require.NotContains(t, logs.String(), "parsing configuration json")
+
+	// Changed settings are parsed again and the changes are logged
+	logs.Reset()
+	writeTestConfig(t, configFolder, `{"source": {"script": "date"}, "timeoutInSeconds": 20}`)
+	cfg, err = GetHandlerSettings(configFolder, "testExtension", 1, ctx)
+	require.Nil(t, err)
+	require.Equal(t, 20, cfg.PublicSettings.TimeoutInSeconds)
+	require.Contains(t, logs.String(), "publicSettings=timeoutInSeconds protectedSettingsChanged=false")
+	require.Contains(t, logs.String(), "setting=timeoutInSeconds old=10 new=20")
+
+	// The changes are logged by the next invocation of the handler, a new process, from the snapshot on disk
+	settingsCacheMu.Lock()
+	settingsCache = make(map[string]cachedSettings)
+	settingsCacheMu.Unlock()
+	logs.Reset()
+	writeTestConfig(t, configFolder, `{"source": {"script": "uptime"}, "timeoutInSeconds": 20}`)
+	_, err = GetHandlerSettings(configFolder, "testExtension", 1, ctx)
+	require.Nil(t, err)
+	require.Contains(t, logs.String(), "publicSettings=source protectedSettingsChanged=false")
+	b, err := os.ReadFile(datapaths.SettingsSnapshotFilePath(constants.SettingsSnapshotDir, "testExtension"))
+	require.Nil(t, err)
+	require.Contains(t, string(b), "uptime")
+
+	// Every caller gets a copy of its own
+	cfg, err = GetHandlerSettings(configFolder, "testExtension", 1, ctx)
+	require.Nil(t, err)
+	cfg.PublicSettings.Source.Script = "modified"
+	cfg, err = GetHandlerSettings(configFolder, "testExtension", 1, ctx)
+	require.Nil(t, err)
+	require.Equal(t, "uptime", cfg.PublicSettings.Source.Script)
+
+	// Invalid settings are not cached
+	writeTestConfig(t, configFolder, `{"timeoutInSeconds": 20}`)
+	_, err = GetHandlerSettings(configFolder, "testExtension", 1, ctx)
+	require.ErrorContains(t, err, "invalid configuration")
+	_, err = GetHandlerSettings(configFolder, "testExtension", 1, ctx)
+	require.ErrorContains(t, err, "invalid configuration")
+
+	_, err = GetHandlerSettings(configFolder, "testExtension", 2, ctx)
+	require.NotNil(t, err)
+}
+
+func Test_truncateSetting(t *testing.T) {
+	values := settingValues(PublicSettings{Source: &ScriptSource{Script: string(bytes.Repeat([]byte("a"), 2*maxLoggedSettingLen))}})
+	require.Len(t, truncateSetting(values["source"]), maxLoggedSettingLen+len("..."))
+	require.Equal(t, "10", truncateSetting("10"))
+}
+
+func Test_copySettings(t *testing.T) {
+	cfg := HandlerSettings{
+		PublicSettings: PublicSettings{
+			Source:         &ScriptSource{Script: "date"},
+			Parameters:     []ParameterDefinition{{Name: "a", Value: "1"}},
+			ResourceLimits: &ResourceLimits{MaxOpenFiles: 512},
+		},
+		ProtectedSettings: ProtectedSettings{
+			ProtectedParameters: []ParameterDefinition{{Name: "b", Value: "2"}},
+			KeyVaultSecrets:     map[string]string{"c": "3"},
+		},
+	}
+	c := copySettings(cfg)
+	require.Equal(t, cfg, c)
+
+	c.PublicSettings.Source.Script = "uptime"
+	c.PublicSettings.Parameters[0].Value = "changed"
+	c.PublicSettings.ResourceLimits.MaxOpenFiles = 1
+	c.ProtectedSettings.ProtectedParameters[0].Value = "changed"
+	c.ProtectedSettings.KeyVaultSecrets["c"] = "changed"
+	require.Equal(t, "date", cfg.PublicSettings.Source.Script)
+	require.Equal(t, "1", cfg.PublicSettings.Parameters[0].Value)
+	require.Equal(t, 512, cfg.PublicSettings.ResourceLimits.MaxOpenFiles)
+	require.Equal(t, "2", cfg.ProtectedSettings.ProtectedParameters[0].Value)
+	require.Equal(t, "3", cfg.ProtectedSettings.KeyVaultSecrets["c"])
+}
@@ -0,0 +1,86 @@
+package handlersettings
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/url"
+)
+
+// hashedSecretPrefix prefixes the hash replacing a secret in the effective configuration
+const hashedSecretPrefix = "sha256:"
+
+// EffectiveConfig is the configuration a sequence number executed with, safe to keep on the VM. The secrets are
+// replaced with their hash, so two configurations can be compared without revealing them.
+type EffectiveConfig struct {
+	PublicSettings    PublicSettings    `json:"publicSettings"`
+	ProtectedSettings ProtectedSettings `json:"protectedSettings"`
+}
+
+// EffectiveConfig returns the settings with their protected values and the queries of their urls, which may carry
+// a SAS token, hashed
+func (s HandlerSettings) EffectiveConfig() EffectiveConfig {
+	public := s.PublicSettings
+	if public.Source != nil {
+		source := *public.Source
+		source.ScriptURI = hashURLQuery(source.ScriptURI)
+		public.Source = &source
+	}
+	public.OutputBlobURI = hashURLQuery(public.OutputBlobURI)
+	public.ErrorBlobURI = hashURLQuery(public.ErrorBlobURI)
+	public.Artifacts = make([]PublicArtifactSource, len(s.PublicSettings.Artifacts))
+	for i, artifact := range s.PublicSettings.Artifacts {
+		artifact.ArtifactUri = hashURLQuery(artifact.ArtifactUri)
+		public.Artifacts[i] = artifact
+	}
+
+	protected := s.ProtectedSettings
+	protected.RunAsPassword = hashSecret(protected.RunAsPassword)
+	protected.SourceSASToken = hashSecret(protected.SourceSASToken)
+	protected.SourceGitToken = hashSecret(protected.SourceGitToken)
+	protected.OutputBlobSASToken = hashSecret(protected.OutputBlobSASToken)
+	protected.ErrorBlobSASToken = hashSecret(protected.ErrorBlobSASToken)
+	protected.ProtectedParameters = make([]ParameterDefinition, len(s.ProtectedSettings.ProtectedParameters))
+	for i, parameter := range s.ProtectedSettings.ProtectedParameters {
+		parameter.Value = hashSecret(parameter.Value)
+		protected.ProtectedParameters[i] = parameter
+	}
+	if s.ProtectedSettings.ProtectedEnvironmentVariables != nil {
+		protected.ProtectedEnvironmentVariables = make(map[string]string, len(s.ProtectedSettings.ProtectedEnvironmentVariables))
+		for name, value := range s.ProtectedSettings.ProtectedEnvironmentVariables {
+			protected.ProtectedEnvironmentVariables[name] = hashSecret(value)
+		}
+	}
+	if renewal := s.ProtectedSettings.BlobSASRenewal; renewal != nil {
+		hashed := *renewal
+		hashed.URI = hashURLQuery(renewal.URI)
+		protected.BlobSASRenewal = &hashed
+	}
+	protected.Artifacts = make([]ProtectedArtifactSource, len(s.ProtectedSettings.Artifacts))
+	for i, artifact := range s.ProtectedSettings.Artifacts {
+		artifact.ArtifactSasToken = hashSecret(artifact.ArtifactSasToken)
+		protected.Artifacts[i] = artifact
+	}
+
+	return EffectiveConfig{PublicSettings: public, ProtectedSettings: protected}
+}
+
+// hashSecret returns the hash of a non-empty secret
+func hashSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s%x", hashedSecretPrefix, sha256.Sum256([]byte(secret)))
+}
+
+// hashURLQuery returns the url with its query hashed, or the whole url if it can't be parsed
+func hashURLQuery(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return hashSecret(rawURL)
+	}
+	if u.RawQuery == "" {
+		return rawURL
+	}
+	u.RawQuery = hashSecret(u.RawQuery)
+	return u.String()
+}
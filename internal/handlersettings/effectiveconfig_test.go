@@ -0,0 +1,51 @@
+package handlersettings
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_effectiveConfigHashesSecrets(t *testing.T) {
+	s := HandlerSettings{
+		PublicSettings: PublicSettings{
+			Source:        &ScriptSource{ScriptURI: "https://account.blob.core.windows.net/scripts/script.sh?sv=2020&sig=secret"},
+			OutputBlobURI: "https://account.blob.core.windows.net/output/stdout",
+			Parameters:    []ParameterDefinition{{Name: "NAME", Value: "value"}},
+			Artifacts:     []PublicArtifactSource{{ArtifactId: 1, ArtifactUri: "https://account.blob.core.windows.net/a/b?sig=secret"}},
+		},
+		ProtectedSettings: ProtectedSettings{
+			RunAsPassword:                 "password",
+			ProtectedParameters:           []ParameterDefinition{{Name: "TOKEN", Value: "token"}},
+			ProtectedEnvironmentVariables: map[string]string{"API_KEY": "apikey"},
+			Artifacts:                     []ProtectedArtifactSource{{ArtifactId: 1, ArtifactSasToken: "sas"}},
+			BlobSASRenewal:                &SASRenewal{URI: "https://renew.contoso.com/api/sas?code=functionkey", Resource: "api://renew"},
+		},
+	}
+
+	config := s.EffectiveConfig()
+	require.Equal(t, "https://account.blob.core.windows.net/scripts/script.sh?sha256:"+hashSecret("sv=2020&sig=secret")[len(hashedSecretPrefix):], config.PublicSettings.Source.ScriptURI)
+	require.Equal(t, "https://account.blob.core.windows.net/output/stdout", config.PublicSettings.OutputBlobURI)
+	require.Equal(t, "value", config.PublicSettings.Parameters[0].Value)
+	require.Equal(t, hashSecret("password"), config.ProtectedSettings.RunAsPassword)
+	require.Equal(t, "", config.ProtectedSettings.SourceSASToken)
+	require.Equal(t, "TOKEN", config.ProtectedSettings.ProtectedParameters[0].Name)
+	require.Equal(t, hashSecret("token"), config.ProtectedSettings.ProtectedParameters[0].Value)
+	require.Equal(t, hashSecret("sas"), config.ProtectedSettings.Artifacts[0].ArtifactSasToken)
+	require.Equal(t, hashSecret("apikey"), config.ProtectedSettings.ProtectedEnvironmentVariables["API_KEY"])
+	require.Equal(t, "apikey", s.ProtectedSettings.ProtectedEnvironmentVariables["API_KEY"])
+	require.Equal(t, "https://renew.contoso.com/api/sas?"+hashSecret("code=functionkey"), config.ProtectedSettings.BlobSASRenewal.URI)
+
+	b, err := json.Marshal(config)
+	require.Nil(t, err)
+	for _, secret := range []string{"sig=secret", "password\"", "\"token\"", "\"sas\"", "apikey", "functionkey"} {
+		require.NotContains(t, string(b), secret)
+	}
+
+	// The settings themselves are unchanged
+	require.Equal(t, "password", s.ProtectedSettings.RunAsPassword)
+	require.Contains(t, s.PublicSettings.Source.ScriptURI, "sig=secret")
+	require.Contains(t, s.PublicSettings.Artifacts[0].ArtifactUri, "sig=secret")
+	require.Contains(t, s.ProtectedSettings.BlobSASRenewal.URI, "code=functionkey")
+}
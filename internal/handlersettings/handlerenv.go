@@ -2,10 +2,12 @@ package handlersettings
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	"github.com/Azure/run-command-handler-linux/internal/types"
 )
@@ -14,32 +16,197 @@ import (
 // Azure Linux Guest Agent.
 const HandlerEnvFileName = "HandlerEnvironment.json"
 
+const (
+	// waAgentDir is where the Azure Linux Guest Agent places the extension handlers
+	waAgentDir = "/var/lib/waagent"
+
+	// extensionLogDir is where the Azure Linux Guest Agent places the logs of the extension handlers
+	extensionLogDir = "/var/log/azure"
+)
+
+// ErrHandlerEnvNotFound is returned when HandlerEnvironment.json does not exist in any of the expected paths
+var ErrHandlerEnvNotFound = errors.New("Cannot find HandlerEnvironment")
+
 // GetHandlerEnv locates the HandlerEnvironment.json file by assuming it lives
-// next to or one level above the extension handler (read: this) executable,
-// reads, parses and returns it.
+// next to or above the extension handler (read: this) executable, as invoked
+// or with its symbolic links resolved, reads, parses and validates it. The error
+// is a *HandlerEnvError listing the paths searched if it can't be located.
 func GetHandlerEnv() (he types.HandlerEnvironment, _ error) {
-	dir, err := scriptDir()
+	paths, err := handlerEnvPaths()
 	if err != nil {
 		return he, fmt.Errorf("vmextension: cannot find base directory of the running process: %v", err)
 	}
-	paths := []string{
-		filepath.Join(dir, HandlerEnvFileName),       // this level (i.e. executable is in [EXT_NAME]/.)
-		filepath.Join(dir, "..", HandlerEnvFileName), // one up (i.e. executable is in [EXT_NAME]/bin/.)
+	return findHandlerEnv(paths)
+}
+
+// handlerEnvPaths returns the paths HandlerEnvironment.json may be at, in order
+func handlerEnvPaths() ([]string, error) {
+	dir, err := scriptDir()
+	if err != nil {
+		return nil, err
+	}
+	dirs := []string{dir}
+	if executable, err := os.Executable(); err == nil {
+		if resolved, err := filepath.EvalSymlinks(executable); err == nil {
+			dirs = append(dirs, filepath.Dir(resolved))
+		}
+	}
+
+	var paths []string
+	seen := make(map[string]bool)
+	for _, d := range dirs {
+		for _, p := range []string{
+			filepath.Join(d, HandlerEnvFileName),             // this level (i.e. executable is in [EXT_NAME]/.)
+			filepath.Join(d, "..", HandlerEnvFileName),       // one up (i.e. executable is in [EXT_NAME]/bin/.)
+			filepath.Join(d, "..", "..", HandlerEnvFileName), // two up (i.e. executable is in [EXT_NAME]/bin/[ARCH]/.)
+		} {
+			if !seen[p] {
+				seen[p] = true
+				paths = append(paths, p)
+			}
+		}
+	}
+	return paths, nil
+}
+
+// SearchedPath is a path searched for HandlerEnvironment.json, and what was found there
+type SearchedPath struct {
+	Path   string
+	Result string
+}
+
+// HandlerEnvError describes why the HandlerEnvironment can't be used: either the paths searched for it, or the
+// problems of the file found at Path
+type HandlerEnvError struct {
+	Searched []SearchedPath
+	Path     string
+	Problems []string
+}
+
+func (e *HandlerEnvError) Error() string {
+	if e.Path != "" {
+		return fmt.Sprintf("vmextension: invalid HandlerEnvironment at '%s': %s", e.Path, strings.Join(e.Problems, "; "))
+	}
+	searched := make([]string, len(e.Searched))
+	for i, p := range e.Searched {
+		searched[i] = fmt.Sprintf("%s (%s)", p.Path, p.Result)
+	}
+	if errors.Is(e, ErrHandlerEnvNotFound) {
+		return fmt.Sprintf("vmextension: %v at paths: %s", ErrHandlerEnvNotFound, strings.Join(searched, ", "))
+	}
+	return fmt.Sprintf("vmextension: cannot read HandlerEnvironment at paths: %s", strings.Join(searched, ", "))
+}
+
+// Unwrap returns ErrHandlerEnvNotFound if none of the paths searched exists
+func (e *HandlerEnvError) Unwrap() error {
+	if e.Path != "" {
+		return nil
+	}
+	for _, p := range e.Searched {
+		if p.Result != searchResultNotFound {
+			return nil
+		}
 	}
-	var b []byte
+	return ErrHandlerEnvNotFound
+}
+
+const searchResultNotFound = "not found"
+
+// findHandlerEnv reads, parses and validates the first of paths which exists
+func findHandlerEnv(paths []string) (he types.HandlerEnvironment, _ error) {
+	diagnostic := &HandlerEnvError{}
 	for _, p := range paths {
-		o, err := os.ReadFile(p)
-		if err != nil && !os.IsNotExist(err) {
-			return he, fmt.Errorf("vmextension: error examining HandlerEnvironment at '%s': %v", p, err)
-		} else if err == nil {
-			b = o
-			break
+		b, err := os.ReadFile(p)
+		if err == nil {
+			if he, err = ParseHandlerEnv(b); err != nil {
+				return he, err
+			}
+			if problems := checkHandlerEnvFolders(he); len(problems) > 0 {
+				return he, &HandlerEnvError{Searched: diagnostic.Searched, Path: p, Problems: problems}
+			}
+			return he, nil
+		}
+		result := searchResultNotFound
+		if !os.IsNotExist(err) {
+			result = err.Error()
 		}
+		diagnostic.Searched = append(diagnostic.Searched, SearchedPath{Path: p, Result: result})
 	}
-	if b == nil {
-		return he, fmt.Errorf("vmextension: Cannot find HandlerEnvironment at paths: %s", strings.Join(paths, ", "))
+	return he, diagnostic
+}
+
+// checkHandlerEnvFolders returns the problems of the folders of the HandlerEnvironment: the config folder must exist,
+// the status and log folders must also be writable. The status and log folders are created if they are missing.
+func checkHandlerEnvFolders(he types.HandlerEnvironment) []string {
+	var problems []string
+	for _, folder := range []struct {
+		name     string
+		path     string
+		writable bool
+	}{
+		{"configFolder", he.HandlerEnvironment.ConfigFolder, false},
+		{"statusFolder", he.HandlerEnvironment.StatusFolder, true},
+		{"logFolder", he.HandlerEnvironment.LogFolder, true},
+	} {
+		fi, err := os.Stat(folder.path)
+		if os.IsNotExist(err) && folder.writable {
+			if err = os.MkdirAll(folder.path, 0700); err == nil {
+				fi, err = os.Stat(folder.path)
+			}
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s '%s' is not accessible: %v", folder.name, folder.path, err))
+		} else if !fi.IsDir() {
+			problems = append(problems, fmt.Sprintf("%s '%s' is not a directory", folder.name, folder.path))
+		} else if folder.writable && syscall.Access(folder.path, accessWritable) != nil {
+			problems = append(problems, fmt.Sprintf("%s '%s' is not writable (%s) by uid %d", folder.name, folder.path, describeOwnership(fi), os.Geteuid()))
+		}
 	}
-	return ParseHandlerEnv(b)
+	return problems
+}
+
+// accessWritable is W_OK of access(2)
+const accessWritable = 0x2
+
+// describeOwnership returns the mode and the owner of a file, e.g. drwx------ 0:0
+func describeOwnership(fi os.FileInfo) string {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return fmt.Sprintf("%v %d:%d", fi.Mode(), st.Uid, st.Gid)
+	}
+	return fi.Mode().String()
+}
+
+// GetHandlerEnvWithFallback returns the HandlerEnvironment from HandlerEnvironment.json. When the file does
+// not exist (e.g., the service runs standalone), the environment is built from the default layout of the
+// agent (waAgentDir and extensionLogDir) for the given handler name and version, creating the config and
+// status folders if needed. Neither the wire server nor HGAP serve the folders of the handler, so an agent
+// configured with other directories requires HandlerEnvironment.json.
+func GetHandlerEnvWithFallback(handlerName string, version string) (types.HandlerEnvironment, error) {
+	he, err := GetHandlerEnv()
+	if err == nil || !errors.Is(err, ErrHandlerEnvNotFound) {
+		return he, err
+	}
+
+	he = NewDefaultHandlerEnv(handlerName, version)
+	for _, dir := range []string{he.HandlerEnvironment.ConfigFolder, he.HandlerEnvironment.StatusFolder} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return he, fmt.Errorf("vmextension: failed to create default HandlerEnvironment folder '%s': %v", dir, err)
+		}
+	}
+	return he, nil
+}
+
+// NewDefaultHandlerEnv builds the HandlerEnvironment the Azure Linux Guest Agent would present
+// to the given handler name and version.
+func NewDefaultHandlerEnv(handlerName string, version string) (he types.HandlerEnvironment) {
+	handlerDir := filepath.Join(waAgentDir, fmt.Sprintf("%s-%s", handlerName, version))
+	he.Version = 1.0
+	he.Name = handlerName
+	he.HandlerEnvironment.HeartbeatFile = filepath.Join(handlerDir, "heartbeat.log")
+	he.HandlerEnvironment.StatusFolder = filepath.Join(handlerDir, "status")
+	he.HandlerEnvironment.ConfigFolder = filepath.Join(handlerDir, "config")
+	he.HandlerEnvironment.LogFolder = filepath.Join(extensionLogDir, handlerName)
+	return he
 }
 
 // scriptDir returns the absolute path of the running process.
@@ -52,7 +219,8 @@ func scriptDir() (string, error) {
 }
 
 // ParseHandlerEnv parses the
-// /var/lib/waagent/[extension]/HandlerEnvironment.json format.
+// /var/lib/waagent/[extension]/HandlerEnvironment.json format, which must have
+// absolute config, status and log folders.
 func ParseHandlerEnv(b []byte) (he types.HandlerEnvironment, _ error) {
 	var hf []types.HandlerEnvironment
 
@@ -62,5 +230,15 @@ func ParseHandlerEnv(b []byte) (he types.HandlerEnvironment, _ error) {
 	if len(hf) != 1 {
 		return he, fmt.Errorf("vmextension: expected 1 config in parsed HandlerEnvironment, found: %v", len(hf))
 	}
-	return hf[0], nil
+	he = hf[0]
+	for _, folder := range []struct{ name, path string }{
+		{"configFolder", he.HandlerEnvironment.ConfigFolder},
+		{"statusFolder", he.HandlerEnvironment.StatusFolder},
+		{"logFolder", he.HandlerEnvironment.LogFolder},
+	} {
+		if !filepath.IsAbs(folder.path) {
+			return he, fmt.Errorf("vmextension: HandlerEnvironment must have an absolute 'handlerEnvironment.%s', found: '%s'", folder.name, folder.path)
+		}
+	}
+	return he, nil
 }
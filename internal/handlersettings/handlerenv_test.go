@@ -0,0 +1,119 @@
+package handlersettings
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_newDefaultHandlerEnv(t *testing.T) {
+	he := NewDefaultHandlerEnv("Microsoft.CPlat.Core.RunCommandHandlerLinux", "1.3.3")
+
+	require.Equal(t, "Microsoft.CPlat.Core.RunCommandHandlerLinux", he.Name)
+	require.Equal(t, "/var/lib/waagent/Microsoft.CPlat.Core.RunCommandHandlerLinux-1.3.3/config", he.HandlerEnvironment.ConfigFolder)
+	require.Equal(t, "/var/lib/waagent/Microsoft.CPlat.Core.RunCommandHandlerLinux-1.3.3/status", he.HandlerEnvironment.StatusFolder)
+	require.Equal(t, "/var/lib/waagent/Microsoft.CPlat.Core.RunCommandHandlerLinux-1.3.3/heartbeat.log", he.HandlerEnvironment.HeartbeatFile)
+	require.Equal(t, "/var/log/azure/Microsoft.CPlat.Core.RunCommandHandlerLinux", he.HandlerEnvironment.LogFolder)
+}
+
+func Test_getHandlerEnvNotFound(t *testing.T) {
+	// The test binary's directory does not contain HandlerEnvironment.json
+	_, err := GetHandlerEnv()
+	require.ErrorIs(t, err, ErrHandlerEnvNotFound)
+	require.Contains(t, err.Error(), "Cannot find HandlerEnvironment at paths")
+}
+
+func writeHandlerEnv(t *testing.T, dir string, he types.HandlerEnvironment) string {
+	b, err := json.Marshal([]types.HandlerEnvironment{he})
+	require.Nil(t, err)
+	path := filepath.Join(dir, HandlerEnvFileName)
+	require.Nil(t, os.WriteFile(path, b, 0600))
+	return path
+}
+
+func testHandlerEnv(dir string) types.HandlerEnvironment {
+	var he types.HandlerEnvironment
+	he.Version = 1.0
+	he.Name = "Microsoft.CPlat.Core.RunCommandHandlerLinux"
+	he.HandlerEnvironment.ConfigFolder = filepath.Join(dir, "config")
+	he.HandlerEnvironment.StatusFolder = filepath.Join(dir, "status")
+	he.HandlerEnvironment.LogFolder = filepath.Join(dir, "log")
+	he.HandlerEnvironment.HeartbeatFile = filepath.Join(dir, "heartbeat.log")
+	return he
+}
+
+func Test_findHandlerEnv(t *testing.T) {
+	dir := t.TempDir()
+	he := testHandlerEnv(dir)
+	for _, d := range []string{he.HandlerEnvironment.ConfigFolder, he.HandlerEnvironment.StatusFolder, he.HandlerEnvironment.LogFolder} {
+		require.Nil(t, os.Mkdir(d, 0700))
+	}
+	path := writeHandlerEnv(t, dir, he)
+
+	// The first path which exists is used
+	found, err := findHandlerEnv([]string{filepath.Join(dir, "bin", HandlerEnvFileName), path})
+	require.Nil(t, err)
+	require.Equal(t, he, found)
+}
+
+func Test_findHandlerEnvNotFound(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{filepath.Join(dir, "a", HandlerEnvFileName), filepath.Join(dir, "b", HandlerEnvFileName)}
+
+	_, err := findHandlerEnv(paths)
+	require.ErrorIs(t, err, ErrHandlerEnvNotFound)
+	var diagnostic *HandlerEnvError
+	require.True(t, errors.As(err, &diagnostic))
+	require.Equal(t, []SearchedPath{{paths[0], "not found"}, {paths[1], "not found"}}, diagnostic.Searched)
+	require.Equal(t, fmt.Sprintf("vmextension: Cannot find HandlerEnvironment at paths: %s (not found), %s (not found)", paths[0], paths[1]), err.Error())
+}
+
+func Test_findHandlerEnvUnreadable(t *testing.T) {
+	dir := t.TempDir()
+	// A directory can't be read as the file
+	path := filepath.Join(dir, HandlerEnvFileName)
+	require.Nil(t, os.Mkdir(path, 0700))
+
+	_, err := findHandlerEnv([]string{path})
+	require.NotErrorIs(t, err, ErrHandlerEnvNotFound)
+	require.Contains(t, err.Error(), "cannot read HandlerEnvironment at paths: "+path+" (")
+}
+
+func Test_findHandlerEnvInvalidFolders(t *testing.T) {
+	dir := t.TempDir()
+	he := testHandlerEnv(dir)
+	require.Nil(t, os.Mkdir(he.HandlerEnvironment.ConfigFolder, 0700))
+	require.Nil(t, os.WriteFile(he.HandlerEnvironment.StatusFolder, nil, 0600))
+	path := writeHandlerEnv(t, dir, he)
+
+	_, err := findHandlerEnv([]string{path})
+	require.NotErrorIs(t, err, ErrHandlerEnvNotFound)
+	var diagnostic *HandlerEnvError
+	require.True(t, errors.As(err, &diagnostic))
+	require.Equal(t, path, diagnostic.Path)
+	require.Equal(t, []string{fmt.Sprintf("statusFolder '%s' is not a directory", he.HandlerEnvironment.StatusFolder)}, diagnostic.Problems)
+	require.DirExists(t, he.HandlerEnvironment.LogFolder, "the missing log folder is created")
+
+	require.Nil(t, os.Remove(he.HandlerEnvironment.ConfigFolder))
+	_, err = findHandlerEnv([]string{path})
+	require.True(t, errors.As(err, &diagnostic))
+	require.Contains(t, diagnostic.Problems[0], fmt.Sprintf("configFolder '%s' is not accessible", he.HandlerEnvironment.ConfigFolder))
+	require.NoDirExists(t, he.HandlerEnvironment.ConfigFolder, "the config folder is written by the agent")
+}
+
+func Test_parseHandlerEnvRelativeFolder(t *testing.T) {
+	he := testHandlerEnv("/var/lib/waagent/ext")
+	he.HandlerEnvironment.StatusFolder = "status"
+	b, err := json.Marshal([]types.HandlerEnvironment{he})
+	require.Nil(t, err)
+
+	_, err = ParseHandlerEnv(b)
+	require.EqualError(t, err, "vmextension: HandlerEnvironment must have an absolute 'handlerEnvironment.statusFolder', found: 'status'")
+}
@@ -1,12 +1,52 @@
 package handlersettings
 
 import (
+	"github.com/Azure/run-command-handler-linux/pkg/logsanitizer"
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 )
 
 var (
-	errSourceNotSpecified = errors.New("Either 'source.script' or 'source.scriptUri' has to be specified")
+	errSourceNotSpecified          = errors.New("Exactly one of 'source.script', 'source.scriptUri', 'source.localPath', 'source.libraryScript', 'source.gitRepository' or 'source.ociArtifact' has to be specified")
+	errLocalPathNotAbsolute        = errors.New("'source.localPath' must be an absolute path")
+	errChecksumWithoutScriptURI    = errors.New("'source.scriptChecksum' requires 'source.scriptUri', only downloaded scripts are verified")
+	errInvalidScriptChecksum       = errors.New("'source.scriptChecksum' must be a hex encoded SHA-256, optionally prefixed with sha256:")
+	errInvalidArtifactChecksum     = errors.New("'artifacts.checksum' must be a hex encoded SHA-256, optionally prefixed with sha256:")
+	errChecksumWithSync            = errors.New("'artifacts.checksum' can't be combined with 'artifacts.mode' sync, a synced container has no single checksum")
+	errInvalidGitRepositoryURL     = errors.New("'source.gitRepository.url' must be an https URL without credentials, the token goes in the protected 'sourceGitToken'")
+	errInvalidGitEntrypoint        = errors.New("'source.gitRepository.entrypoint' must be the path of a script relative to the root of the repository")
+	errInvalidOCIEntrypoint        = errors.New("'source.ociArtifact.entrypoint' must be the path of a script relative to the root of the artifact")
+	errOCIArtifactWithRunAs        = errors.New("'source.ociArtifact' can't be combined with 'runAsUser', only the entrypoint of the artifact would be copied for the user")
+	errInvalidGitRef               = errors.New("'source.gitRepository.ref' must be a branch, tag or commit")
+	errGitTokenWithManagedIdentity = errors.New("'sourceGitToken' can't be combined with 'source.gitRepository.useManagedIdentity', the repository is downloaded with either one")
+	errGitTokenWithoutRepository   = errors.New("'sourceGitToken' requires 'source.gitRepository'")
+	errGitRepositoryWithRunAs      = errors.New("'source.gitRepository' can't be combined with 'runAsUser', only the entrypoint of the repository would be copied for the user")
+	errRunAsGroupWithoutUser       = errors.New("'runAsGroup' and 'runAsSupplementaryGroups' require 'runAsUser' to be specified")
+	errRunAsOptionsWithoutUser     = errors.New("'runAsLoginShell' and 'runAsElevated' require 'runAsUser' to be specified")
+	errRunAsElevatedWithGroups     = errors.New("'runAsElevated' can't be combined with 'runAsGroup' or 'runAsSupplementaryGroups', an elevated script runs as root")
+	errInvalidLocale               = errors.New("'locale' must be a locale name such as C.UTF-8 or en_US.UTF-8")
+	errInvalidRetention            = errors.New("'outputRetentionInDays' must not be negative")
+	errInvalidExitCodeMap          = errors.New("'exitCodeMappings' must map exit codes between 1 and 255 to either SucceededWithWarning or Skipped")
+	errInvalidArtifactMode         = errors.New("'artifacts.mode' must be either download or sync")
+	errSyncTargetNotAbsolute       = errors.New("'artifacts.targetDirectory' must be an absolute path when 'artifacts.mode' is sync")
+	errCapabilitiesWithRunAs       = errors.New("'capabilities' can't be combined with 'runAsUser', the capabilities apply to root")
+	errHandlerLogsWithoutErrorBlob = errors.New("'uploadHandlerLogsOnFailure' requires 'errorBlobUri', the logs are uploaded next to the error blob")
+	errInvalidOutputSegmentSize    = errors.New("'outputCompression.segmentSizeInMB' must be between 0 and 1024")
+	errInvalidProxy                = errors.New("'proxy' must be an http or https URL without credentials, such as http://proxy.contoso.com:3128")
+	errInvalidSASRenewal           = errors.New("'blobSasRenewal' requires an https 'uri' and the 'resource' its managed identity tokens are issued for")
+	errInvalidMaxDownloadBandwidth = errors.New("'maxDownloadBandwidthKbps' must not be negative")
+	errInvalidMinFreeDiskSpace     = errors.New("'minFreeDiskSpaceMB' must not be negative")
+	errInvalidRetentionPolicy      = errors.New("'retentionPolicy' must keep between 0 and 100 executions, and its 'maxAgeInDays' and 'maxDataDirSizeInMB' must not be negative")
+	errInvalidNetworkWaitTimeout   = errors.New("'waitForNetwork.timeoutInSeconds' must be between 0 and 3600")
+	errInvalidMaxReboots           = errors.New("'maxReboots' must be between 0 and 10")
+	errMaxRebootsWithoutReboot     = errors.New("'maxReboots' requires 'allowReboot' to be true")
+	errInvalidStatusUpdateInterval = errors.New("'statusUpdateIntervalSeconds' must be between 5 and 300")
+	errInvalidMaxStatusOutput      = errors.New("'maxStatusOutputBytes' must be between 256 and 32768")
+	errInvalidCommandInterpreter   = errors.New("'commandInterpreter' must be bash, sh, python3, pwsh or the absolute path of an interpreter")
+	errInvalidTemplateEncoding     = errors.New("'templateEncoding' must be either shell or none")
+	errWhatIfWithDryRender         = errors.New("'whatIf' can't be combined with 'dryRenderTemplate', neither executes the script")
+	errTooManyMetricExtractors     = errors.New("'metricExtractors' can't have more than 20 metrics")
+	errInvalidLogAnalytics         = errors.New("'logAnalytics' requires 'dataCollectionEndpoint', 'dataCollectionRuleId' and 'streamName'")
 )
 
 // parseAndValidateSettings reads configuration from configFolder, decrypts it,
@@ -23,8 +63,13 @@ func ParseAndValidateSettings(ctx *log.Context, configFilePath string) (h Handle
 	if err := UnmarshalHandlerSettings(pubJSON, protJSON, &h.PublicSettings, &h.ProtectedSettings); err != nil {
 		return h, errors.Wrap(err, "json parsing error")
 	}
+	logsanitizer.RegisterSecrets(h.ProtectedSettings.secrets()...)
 	ctx.Log("event", "parsed configuration json")
 
+	if err := h.applyExecutionProfile(ctx, executionProfilesPath); err != nil {
+		return h, errors.Wrap(err, "invalid configuration")
+	}
+
 	ctx.Log("event", "validating configuration logically")
 	if err := h.validate(); err != nil {
 		return h, errors.Wrap(err, "invalid configuration")
@@ -0,0 +1,194 @@
+package handlersettings
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/trustedfile"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// defaultExecutionProfile is the profile of the settings referencing none, if defined
+const defaultExecutionProfile = "default"
+
+const (
+	// SandboxLevelNone runs the scripts without a sandbox beyond the other restrictions of the profile
+	SandboxLevelNone = "none"
+
+	// SandboxLevelNoNewPrivileges runs the scripts with the no_new_privs flag set: neither they nor their children
+	// gain privileges by executing setuid programs (e.g., sudo) or programs with file capabilities
+	SandboxLevelNoNewPrivileges = "noNewPrivileges"
+)
+
+// executionProfilesPath is the local file defining the execution profiles
+var executionProfilesPath = constants.ExecutionProfilesPath
+
+// ExecutionProfile is a policy defined by the administrator of the machine that the settings reference by name,
+// so the commands of a fleet share it without repeating it
+type ExecutionProfile struct {
+	// Selectable lets the settings reference the profile by name. The default profile applies to the settings
+	// referencing none, and the settings can't escape it by referencing a profile not meant for them.
+	Selectable bool `json:"selectable"`
+
+	// ResourceLimits bound the resources of every process of the script
+	ResourceLimits *ResourceLimits `json:"resourceLimits"`
+
+	// SandboxLevel is the sandbox the scripts run in, SandboxLevelNone if not set
+	SandboxLevel string `json:"sandboxLevel"`
+
+	// MaxTimeoutInSeconds is the timeout of the scripts without one or with a longer one
+	MaxTimeoutInSeconds int `json:"maxTimeoutInSeconds"`
+
+	// Capabilities are the only capabilities of root the scripts running as root may run with, the scripts whose
+	// settings don't restrict their capabilities run with all of them
+	Capabilities []string `json:"capabilities"`
+
+	// AllowedUsers are the only users the scripts may run as, "root" for the scripts without RunAs or elevated
+	AllowedUsers []string `json:"allowedUsers"`
+
+	// LogAnalytics is the destination of the output of the scripts whose settings don't specify one
+	LogAnalytics *LogAnalyticsDestination `json:"logAnalytics"`
+
+	// DenyOutputBlobs rejects the settings uploading the output to outputBlobUri or errorBlobUri
+	DenyOutputBlobs bool `json:"denyOutputBlobs"`
+}
+
+// ResourceLimits bound the resources of every process of the script, as both their soft and hard limits. Zero is
+// no limit.
+type ResourceLimits struct {
+	MaxOpenFiles    int `json:"maxOpenFiles"`
+	MaxFileSizeInMB int `json:"maxFileSizeInMB"`
+}
+
+// applyExecutionProfile applies the execution profile the settings reference, or the default one if they reference
+// none, to the settings. The settings violating its policy are rejected.
+func (s *HandlerSettings) applyExecutionProfile(ctx *log.Context, path string) error {
+	name := s.PublicSettings.ExecutionProfile
+	profiles, err := loadExecutionProfiles(path)
+	if err != nil {
+		return err
+	}
+	profile, ok := profiles[name]
+	if name == "" {
+		profile, ok = profiles[defaultExecutionProfile]
+		if !ok {
+			return nil
+		}
+		name = defaultExecutionProfile
+	} else if !ok {
+		return errors.Errorf("'executionProfile' %s is not defined on this machine", name)
+	} else if !profile.Selectable && name != defaultExecutionProfile {
+		return errors.Errorf("'executionProfile' %s can't be selected by the settings", name)
+	}
+	ctx.Log("event", "applying execution profile", "profile", name)
+
+	user := "root"
+	if s.PublicSettings.RunAsUser != "" && !s.PublicSettings.RunAsElevated {
+		user = s.PublicSettings.RunAsUser
+	}
+	if len(profile.AllowedUsers) > 0 && !containsString(profile.AllowedUsers, user) {
+		return errors.Errorf("execution profile %s doesn't allow the script to run as %s", name, user)
+	}
+
+	if profile.Capabilities != nil && user == "root" {
+		if s.PublicSettings.RunAsElevated {
+			return errors.Errorf("execution profile %s restricts the capabilities of root, 'runAsElevated' is not allowed", name)
+		}
+		if s.PublicSettings.Capabilities == nil {
+			s.PublicSettings.Capabilities = append([]string{}, profile.Capabilities...)
+		}
+		allowed, _ := HandlerSettings{PublicSettings: PublicSettings{Capabilities: profile.Capabilities}}.ScriptCapabilities()
+		requested, _ := s.ScriptCapabilities()
+		for _, capability := range requested {
+			if !containsString(allowed, capability) {
+				return errors.Errorf("execution profile %s doesn't allow the capability %s", name, capability)
+			}
+		}
+	}
+
+	if profile.SandboxLevel == SandboxLevelNoNewPrivileges {
+		if s.PublicSettings.RunAsUser != "" {
+			return errors.Errorf("execution profile %s runs the scripts without new privileges, 'runAsUser' is not allowed", name)
+		}
+		s.PublicSettings.NoNewPrivileges = true
+	}
+
+	if profile.DenyOutputBlobs && (s.PublicSettings.OutputBlobURI != "" || s.PublicSettings.ErrorBlobURI != "") {
+		return errors.Errorf("execution profile %s doesn't allow 'outputBlobUri' and 'errorBlobUri'", name)
+	}
+	if s.PublicSettings.LogAnalytics == nil && profile.LogAnalytics != nil {
+		destination := *profile.LogAnalytics
+		s.PublicSettings.LogAnalytics = &destination
+	}
+
+	if max := profile.MaxTimeoutInSeconds; max > 0 && (s.PublicSettings.TimeoutInSeconds == 0 || s.PublicSettings.TimeoutInSeconds > max) {
+		ctx.Log("message", "the execution profile bounds the timeout of the script", "timeoutInSeconds", max)
+		s.PublicSettings.TimeoutInSeconds = max
+	}
+	if profile.ResourceLimits != nil {
+		limits := *profile.ResourceLimits
+		s.PublicSettings.ResourceLimits = &limits
+	}
+	return nil
+}
+
+// loadExecutionProfiles returns the execution profiles by name, none if there is no file. Unlike the feature flags,
+// an invalid file fails the settings rather than being ignored, as it is a policy.
+func loadExecutionProfiles(path string) (map[string]ExecutionProfile, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open the execution profiles")
+	}
+	defer f.Close()
+
+	if err := trustedfile.Check(f, "the execution profiles"); err != nil {
+		return nil, err
+	}
+
+	var profiles map[string]ExecutionProfile
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&profiles); err != nil {
+		return nil, errors.Wrap(err, "failed to parse the execution profiles")
+	}
+	for name, profile := range profiles {
+		if err := profile.validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid execution profile %s", name)
+		}
+	}
+	return profiles, nil
+}
+
+// validate makes logical validation on the profile
+func (p ExecutionProfile) validate() error {
+	if p.MaxTimeoutInSeconds < 0 {
+		return errors.New("'maxTimeoutInSeconds' must not be negative")
+	}
+	if l := p.ResourceLimits; l != nil && (l.MaxOpenFiles < 0 || l.MaxFileSizeInMB < 0) {
+		return errors.New("'resourceLimits' must not be negative")
+	}
+	if p.SandboxLevel != "" && p.SandboxLevel != SandboxLevelNone && p.SandboxLevel != SandboxLevelNoNewPrivileges {
+		return errors.Errorf("'sandboxLevel' must be either %s or %s", SandboxLevelNone, SandboxLevelNoNewPrivileges)
+	}
+	for _, name := range p.Capabilities {
+		if !linuxCapabilities[strings.TrimPrefix(strings.ToLower(name), "cap_")] {
+			return errors.Errorf("'capabilities' has an unknown capability '%s'", name)
+		}
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
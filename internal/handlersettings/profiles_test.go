@@ -0,0 +1,110 @@
+package handlersettings
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+const testExecutionProfiles = `{
+	"default": {"maxTimeoutInSeconds": 600},
+	"restricted": {
+		"selectable": true,
+		"resourceLimits": {"maxOpenFiles": 64},
+		"capabilities": ["CAP_NET_ADMIN", "cap_net_raw"],
+		"allowedUsers": ["root", "azureuser"],
+		"logAnalytics": {"dataCollectionEndpoint": "https://dce.ingest.monitor.azure.com", "dataCollectionRuleId": "dcr-1", "streamName": "Custom-RunCommand"},
+		"denyOutputBlobs": true
+	},
+	"sandboxed": {"selectable": true, "sandboxLevel": "noNewPrivileges"},
+	"lax": {"maxTimeoutInSeconds": 86400}
+}`
+
+func writeExecutionProfiles(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "execution-profiles.json")
+	require.Nil(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func Test_applyExecutionProfile(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	path := writeExecutionProfiles(t, testExecutionProfiles)
+
+	// The default profile applies to the settings referencing none
+	s := HandlerSettings{PublicSettings: PublicSettings{TimeoutInSeconds: 3600}}
+	require.Nil(t, s.applyExecutionProfile(ctx, path))
+	require.Equal(t, 600, s.PublicSettings.TimeoutInSeconds)
+	require.Nil(t, s.PublicSettings.ResourceLimits)
+
+	s = HandlerSettings{PublicSettings: PublicSettings{ExecutionProfile: "restricted", TimeoutInSeconds: 60}}
+	require.Nil(t, s.applyExecutionProfile(ctx, path))
+	require.Equal(t, 60, s.PublicSettings.TimeoutInSeconds)
+	require.Equal(t, &ResourceLimits{MaxOpenFiles: 64}, s.PublicSettings.ResourceLimits)
+	require.False(t, s.PublicSettings.NoNewPrivileges)
+	require.Equal(t, []string{"CAP_NET_ADMIN", "cap_net_raw"}, s.PublicSettings.Capabilities)
+	require.Equal(t, "dcr-1", s.PublicSettings.LogAnalytics.DataCollectionRuleID)
+
+	// The settings may grant fewer capabilities
+	s = HandlerSettings{PublicSettings: PublicSettings{ExecutionProfile: "restricted", Capabilities: []string{"net_raw"}}}
+	require.Nil(t, s.applyExecutionProfile(ctx, path))
+	require.Equal(t, []string{"net_raw"}, s.PublicSettings.Capabilities)
+
+	// The capabilities only apply to root
+	s = HandlerSettings{PublicSettings: PublicSettings{ExecutionProfile: "restricted", RunAsUser: "azureuser"}}
+	require.Nil(t, s.applyExecutionProfile(ctx, path))
+	require.Nil(t, s.PublicSettings.Capabilities)
+
+	s = HandlerSettings{PublicSettings: PublicSettings{ExecutionProfile: "sandboxed"}}
+	require.Nil(t, s.applyExecutionProfile(ctx, path))
+	require.True(t, s.PublicSettings.NoNewPrivileges)
+
+	// The default profile can be referenced by name
+	s = HandlerSettings{PublicSettings: PublicSettings{ExecutionProfile: "default", TimeoutInSeconds: 3600}}
+	require.Nil(t, s.applyExecutionProfile(ctx, path))
+	require.Equal(t, 600, s.PublicSettings.TimeoutInSeconds)
+
+	// Without a profile file, nothing applies
+	s = HandlerSettings{PublicSettings: PublicSettings{TimeoutInSeconds: 3600}}
+	require.Nil(t, s.applyExecutionProfile(ctx, filepath.Join(t.TempDir(), "missing.json")))
+	require.Equal(t, 3600, s.PublicSettings.TimeoutInSeconds)
+}
+
+func Test_applyExecutionProfile_rejects(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	path := writeExecutionProfiles(t, testExecutionProfiles)
+
+	for settings, expected := range map[*PublicSettings]string{
+		{ExecutionProfile: "missing"}:                                                            "'executionProfile' missing is not defined on this machine",
+		{ExecutionProfile: "lax"}:                                                                "'executionProfile' lax can't be selected by the settings",
+		{ExecutionProfile: "sandboxed", RunAsUser: "azureuser"}:                                  "execution profile sandboxed runs the scripts without new privileges, 'runAsUser' is not allowed",
+		{ExecutionProfile: "restricted", RunAsUser: "bob"}:                                       "execution profile restricted doesn't allow the script to run as bob",
+		{ExecutionProfile: "restricted", RunAsUser: "azureuser", RunAsElevated: true}:            "execution profile restricted restricts the capabilities of root, 'runAsElevated' is not allowed",
+		{ExecutionProfile: "restricted", Capabilities: []string{"CAP_SYS_ADMIN"}}:                "execution profile restricted doesn't allow the capability sys_admin",
+		{ExecutionProfile: "restricted", OutputBlobURI: "https://a.blob.core.windows.net/c/out"}: "execution profile restricted doesn't allow 'outputBlobUri' and 'errorBlobUri'",
+	} {
+		s := HandlerSettings{PublicSettings: *settings}
+		require.EqualError(t, s.applyExecutionProfile(ctx, path), expected)
+	}
+}
+
+func Test_loadExecutionProfiles_invalid(t *testing.T) {
+	for content, expected := range map[string]string{
+		`{"p": {"maxTimeout": 600}}`:                      "failed to parse the execution profiles",
+		`{"p": {"maxTimeoutInSeconds": -1}}`:              "invalid execution profile p: 'maxTimeoutInSeconds' must not be negative",
+		`{"p": {"resourceLimits": {"maxOpenFiles": -1}}}`: "invalid execution profile p: 'resourceLimits' must not be negative",
+		`{"p": {"capabilities": ["CAP_UNKNOWN"]}}`:        "invalid execution profile p: 'capabilities' has an unknown capability 'CAP_UNKNOWN'",
+		`{"p": {"sandboxLevel": "strict"}}`:               "invalid execution profile p: 'sandboxLevel' must be either none or noNewPrivileges",
+		`{"p": {"resourceLimits": {"maxMemoryInMB": 1}}}`: "failed to parse the execution profiles",
+	} {
+		_, err := loadExecutionProfiles(writeExecutionProfiles(t, content))
+		require.ErrorContains(t, err, expected)
+	}
+
+	path := writeExecutionProfiles(t, `{}`)
+	require.Nil(t, os.Chmod(path, 0666))
+	_, err := loadExecutionProfiles(path)
+	require.EqualError(t, err, "the execution profiles must be a regular file only writable by its owner")
+}
@@ -1,11 +1,114 @@
 package handlersettings
 
 import (
+	"net"
+	"net/url"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 
+	"github.com/Azure/run-command-handler-linux/internal/outputmetrics"
+	"github.com/Azure/run-command-handler-linux/internal/scriptlibrary"
+	"github.com/Azure/run-command-handler-linux/pkg/download"
+	"github.com/Azure/run-command-handler-linux/pkg/keyvault"
 	"github.com/pkg/errors"
 )
 
+// DefaultScriptLocale is the locale (LANG and LC_ALL) of the script when none is specified
+const DefaultScriptLocale = "C.UTF-8"
+
+// Bounds of the wait for the network to be ready, in seconds, when waitForNetwork doesn't set its timeout
+const (
+	defaultNetworkWaitInSeconds = 300
+	maxNetworkWaitInSeconds     = 3600
+)
+
+// Bounds of the size of the segments the output is compressed in, in MB, when outputCompression doesn't set it
+const (
+	defaultOutputSegmentSizeInMB = 64
+	maxOutputSegmentSizeInMB     = 1024
+)
+
+// Bounds of the number of reboots a script allowed to reboot can request, when maxReboots doesn't set it
+const (
+	defaultMaxReboots = 3
+	maxMaxReboots     = 10
+)
+
+// Bounds of the interval of the partial status updates of a running script, in seconds
+const (
+	minStatusUpdateIntervalInSeconds = 5
+	maxStatusUpdateIntervalInSeconds = 300
+)
+
+// Bounds of the output of each stream of the script reported in the status, in bytes, when maxStatusOutputBytes
+// doesn't set it. Both streams fit in the status accepted by the agent at the maximum.
+const (
+	DefaultMaxStatusOutputBytes = 4 * 1024
+	minMaxStatusOutputBytes     = 256
+	maxMaxStatusOutputBytes     = 32 * 1024
+)
+
+// maxKeepLastExecutions bounds the executions retentionPolicy can keep on the VM
+const maxKeepLastExecutions = 100
+
+// States the exit codes of the script can be mapped to with exitCodeMappings. Both are reported as succeeded
+// executions, along with a substatus telling them apart from the executions exiting with 0.
+const (
+	ExitCodeStateSucceededWithWarning = "SucceededWithWarning"
+	ExitCodeStateSkipped              = "Skipped"
+)
+
+// Encodings of the values of the parameters rendered in a script template: quoted for the shell, which reads the
+// protected parameters from its environment, or as they are for the other interpreters
+const (
+	TemplateEncodingShell = "shell"
+	TemplateEncodingNone  = "none"
+)
+
+// Modes of an artifact: downloaded again as a single file for every sequence number, or synced as the blobs under
+// a container prefix into a target directory kept across sequence numbers, which only downloads the changed blobs
+const (
+	ArtifactModeDownload = "download"
+	ArtifactModeSync     = "sync"
+)
+
+// commandInterpreters are the interpreters commandInterpreter can name, python3 and pwsh are looked up in the PATH
+var commandInterpreters = map[string]string{
+	"bash":    "/bin/bash",
+	"sh":      "/bin/sh",
+	"python3": "/usr/bin/env python3",
+	"pwsh":    "/usr/bin/env pwsh",
+}
+
+// interpreterPathPattern matches the absolute path of a custom interpreter, which is run by bash unquoted
+var interpreterPathPattern = regexp.MustCompile(`^/[A-Za-z0-9._+/-]+$`)
+
+// linuxCapabilities are the names of the capabilities the script can be granted, without their CAP_ prefix
+var linuxCapabilities = map[string]bool{
+	"chown": true, "dac_override": true, "dac_read_search": true, "fowner": true, "fsetid": true, "kill": true,
+	"setgid": true, "setuid": true, "setpcap": true, "linux_immutable": true, "net_bind_service": true,
+	"net_broadcast": true, "net_admin": true, "net_raw": true, "ipc_lock": true, "ipc_owner": true,
+	"sys_module": true, "sys_rawio": true, "sys_chroot": true, "sys_ptrace": true, "sys_pacct": true,
+	"sys_admin": true, "sys_boot": true, "sys_nice": true, "sys_resource": true, "sys_time": true,
+	"sys_tty_config": true, "mknod": true, "lease": true, "audit_write": true, "audit_control": true,
+	"setfcap": true, "mac_override": true, "mac_admin": true, "syslog": true, "wake_alarm": true,
+	"block_suspend": true, "audit_read": true, "perfmon": true, "bpf": true, "checkpoint_restore": true,
+}
+
+// requirementRegex matches the names of the commands a script requires, which are also the names of their packages
+var requirementRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]*$`)
+
+// localeRegex matches locale names such as C.UTF-8, en_US.UTF-8 or sr_RS@latin
+var localeRegex = regexp.MustCompile(`^[A-Za-z0-9_.@-]+$`)
+
+// environmentVariableRegex matches the names of the environment variables of a script
+var environmentVariableRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// checksumRegex matches a hex encoded SHA-256 checksum, as printed by sha256sum, optionally prefixed with sha256:
+var checksumRegex = regexp.MustCompile(`^(sha256:)?[0-9A-Fa-f]{64}$`)
+
 // handlerSettings holds the configuration of the extension handler.
 type HandlerSettings struct {
 	PublicSettings
@@ -25,6 +128,52 @@ func (s HandlerSettings) ScriptURI() string {
 	return s.PublicSettings.Source.ScriptURI
 }
 
+// ScriptChecksum returns the expected SHA-256 of the script downloaded from the script URI, if any
+func (s HandlerSettings) ScriptChecksum() string {
+	if s.PublicSettings.Source == nil {
+		return ""
+	}
+	return s.PublicSettings.Source.ScriptChecksum
+}
+
+// ProxyURL returns the proxy of the settings, nil to use the proxy of the environment
+func (s HandlerSettings) ProxyURL() *url.URL {
+	if s.PublicSettings.Proxy == "" {
+		return nil
+	}
+	u, err := url.Parse(s.PublicSettings.Proxy)
+	if err != nil {
+		return nil
+	}
+	return u
+}
+
+// ScriptLocalPath returns the path of a script already present on the machine, which is executed without downloading it
+func (s HandlerSettings) ScriptLocalPath() string {
+	return s.PublicSettings.Source.LocalPath
+}
+
+// LibraryScript returns the name of a script of the script library synced on the machine
+func (s HandlerSettings) LibraryScript() string {
+	return s.PublicSettings.Source.LibraryScript
+}
+
+// GitRepository returns the git repository of the script, if any
+func (s HandlerSettings) GitRepository() *GitRepositorySource {
+	if s.PublicSettings.Source == nil {
+		return nil
+	}
+	return s.PublicSettings.Source.GitRepository
+}
+
+// OCIArtifact returns the container registry artifact of the script, if any
+func (s HandlerSettings) OCIArtifact() *OCIArtifactSource {
+	if s.PublicSettings.Source == nil {
+		return nil
+	}
+	return s.PublicSettings.Source.OCIArtifact
+}
+
 func (s HandlerSettings) ScriptSAS() string {
 	return s.ProtectedSettings.SourceSASToken
 }
@@ -48,12 +197,19 @@ func (s HandlerSettings) ReadArtifacts() ([]UnifiedArtifact, error) {
 			protectedArtifact := s.ProtectedSettings.Artifacts[k]
 			if publicArtifact.ArtifactId == protectedArtifact.ArtifactId {
 				found = true
+				managedIdentity := protectedArtifact.ArtifactManagedIdentity
+				if managedIdentity == nil {
+					managedIdentity = publicArtifact.managedIdentity()
+				}
 				artifacts[i] = UnifiedArtifact{
 					ArtifactId:              publicArtifact.ArtifactId,
 					ArtifactUri:             publicArtifact.ArtifactUri,
 					ArtifactSasToken:        protectedArtifact.ArtifactSasToken,
 					FileName:                publicArtifact.FileName,
-					ArtifactManagedIdentity: protectedArtifact.ArtifactManagedIdentity,
+					Mode:                    publicArtifact.Mode,
+					TargetDirectory:         publicArtifact.TargetDirectory,
+					Checksum:                publicArtifact.Checksum,
+					ArtifactManagedIdentity: managedIdentity,
 				}
 			}
 		}
@@ -70,26 +226,480 @@ func (s HandlerSettings) ReadArtifacts() ([]UnifiedArtifact, error) {
 // the schema validation.
 func (s HandlerSettings) validate() error {
 
-	if s.PublicSettings.Source == nil || (s.PublicSettings.Source.Script == "") == (s.PublicSettings.Source.ScriptURI == "") {
+	if s.PublicSettings.Source == nil || s.PublicSettings.Source.specifiedCount() != 1 {
 		return errSourceNotSpecified
 	}
+	if s.PublicSettings.Source.LocalPath != "" && !filepath.IsAbs(s.PublicSettings.Source.LocalPath) {
+		return errLocalPathNotAbsolute
+	}
+	if s.PublicSettings.Source.ScriptChecksum != "" {
+		if s.PublicSettings.Source.ScriptURI == "" {
+			return errChecksumWithoutScriptURI
+		}
+		if !checksumRegex.MatchString(s.PublicSettings.Source.ScriptChecksum) {
+			return errInvalidScriptChecksum
+		}
+	}
+	if s.PublicSettings.Source.LibraryScript != "" {
+		if err := scriptlibrary.ValidateName(s.PublicSettings.Source.LibraryScript); err != nil {
+			return errors.Wrap(err, "'source.libraryScript' must be the name of a script of the script library")
+		}
+	}
+	if err := s.validateGitRepository(); err != nil {
+		return err
+	}
+	if a := s.OCIArtifact(); a != nil {
+		if _, err := download.ParseOCIReference(a.Reference); err != nil {
+			return errors.Wrap(err, "'source.ociArtifact.reference' must be the reference of an artifact")
+		}
+		if !isRelativeEntrypoint(a.Entrypoint) {
+			return errInvalidOCIEntrypoint
+		}
+		if s.PublicSettings.RunAsUser != "" {
+			return errOCIArtifactWithRunAs
+		}
+	}
+	if s.PublicSettings.RunAsUser == "" && (s.PublicSettings.RunAsGroup != "" || len(s.PublicSettings.RunAsSupplementaryGroups) > 0) {
+		return errRunAsGroupWithoutUser
+	}
+	if s.PublicSettings.RunAsUser == "" && (s.PublicSettings.RunAsLoginShell || s.PublicSettings.RunAsElevated) {
+		return errRunAsOptionsWithoutUser
+	}
+	if s.PublicSettings.RunAsElevated && (s.PublicSettings.RunAsGroup != "" || len(s.PublicSettings.RunAsSupplementaryGroups) > 0) {
+		return errRunAsElevatedWithGroups
+	}
+	if s.PublicSettings.Locale != "" && !localeRegex.MatchString(s.PublicSettings.Locale) {
+		return errInvalidLocale
+	}
+	for name := range s.PublicSettings.EnvironmentVariables {
+		if !environmentVariableRegex.MatchString(name) {
+			return errors.Errorf("'environmentVariables' has an invalid variable name '%s'", name)
+		}
+		if _, ok := s.ProtectedSettings.ProtectedEnvironmentVariables[name]; ok {
+			return errors.Errorf("'%s' can't be in both 'environmentVariables' and 'protectedEnvironmentVariables'", name)
+		}
+	}
+	for name := range s.ProtectedSettings.ProtectedEnvironmentVariables {
+		if !environmentVariableRegex.MatchString(name) {
+			return errors.Errorf("'protectedEnvironmentVariables' has an invalid variable name '%s'", name)
+		}
+	}
+	for name, reference := range s.ProtectedSettings.KeyVaultReferences {
+		if !environmentVariableRegex.MatchString(name) {
+			return errors.Errorf("'keyVaultReferences' has an invalid variable name '%s'", name)
+		}
+		_, public := s.PublicSettings.EnvironmentVariables[name]
+		_, protected := s.ProtectedSettings.ProtectedEnvironmentVariables[name]
+		if public || protected {
+			return errors.Errorf("'%s' can't be in both 'keyVaultReferences' and the environment variables", name)
+		}
+		if _, err := keyvault.ParseReference(reference); err != nil {
+			return errors.Wrapf(err, "'keyVaultReferences' has an invalid reference for '%s'", name)
+		}
+	}
+	for _, name := range s.PublicSettings.Requires {
+		if !requirementRegex.MatchString(name) {
+			return errors.Errorf("'requires' has an invalid command name '%s'", name)
+		}
+	}
+	if s.PublicSettings.UploadHandlerLogsOnFailure && s.PublicSettings.ErrorBlobURI == "" {
+		return errHandlerLogsWithoutErrorBlob
+	}
+	if capabilities, ok := s.ScriptCapabilities(); ok {
+		if s.PublicSettings.RunAsUser != "" {
+			return errCapabilitiesWithRunAs
+		}
+		for i, name := range capabilities {
+			if !linuxCapabilities[name] {
+				return errors.Errorf("'capabilities' has an unknown capability '%s'", s.PublicSettings.Capabilities[i])
+			}
+		}
+	}
+	if s.PublicSettings.OutputRetentionInDays < 0 {
+		return errInvalidRetention
+	}
+	for _, artifact := range s.PublicSettings.Artifacts {
+		if artifact.Checksum != "" && !checksumRegex.MatchString(artifact.Checksum) {
+			return errInvalidArtifactChecksum
+		}
+		if identity := artifact.managedIdentity(); identity != nil {
+			if identity.ClientId != "" && identity.ObjectId != "" {
+				return errors.Errorf("artifact %d: use either 'managedIdentityClientId' or 'managedIdentityObjectId', not both", artifact.ArtifactId)
+			}
+			for _, protected := range s.ProtectedSettings.Artifacts {
+				if protected.ArtifactId == artifact.ArtifactId && protected.ArtifactManagedIdentity != nil {
+					return errors.Errorf("artifact %d: the managed identity is set by both the public and the protected settings", artifact.ArtifactId)
+				}
+			}
+			if artifact.Mode == ArtifactModeSync {
+				return errors.Errorf("artifact %d: a synced artifact is accessed with its SAS token, not a managed identity", artifact.ArtifactId)
+			}
+		}
+		switch artifact.Mode {
+		case "", ArtifactModeDownload:
+		case ArtifactModeSync:
+			if !filepath.IsAbs(artifact.TargetDirectory) {
+				return errSyncTargetNotAbsolute
+			}
+			if artifact.Checksum != "" {
+				return errChecksumWithSync
+			}
+		default:
+			return errInvalidArtifactMode
+		}
+	}
+	if s.PublicSettings.Proxy != "" {
+		u, err := url.Parse(s.PublicSettings.Proxy)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+			return errInvalidProxy
+		}
+	}
+	if r := s.ProtectedSettings.BlobSASRenewal; r != nil {
+		u, err := url.Parse(r.URI)
+		if err != nil || u.Scheme != "https" || u.Host == "" || r.Resource == "" {
+			return errInvalidSASRenewal
+		}
+	}
+	if s.PublicSettings.MaxDownloadBandwidthKbps < 0 {
+		return errInvalidMaxDownloadBandwidth
+	}
+	if s.PublicSettings.MinFreeDiskSpaceMB < 0 {
+		return errInvalidMinFreeDiskSpace
+	}
+	if p := s.PublicSettings.RetentionPolicy; p != nil && (p.KeepLastExecutions < 0 || p.KeepLastExecutions > maxKeepLastExecutions || p.MaxAgeInDays < 0 || p.MaxDataDirSizeInMB < 0) {
+		return errInvalidRetentionPolicy
+	}
+	if c := s.PublicSettings.OutputCompression; c != nil && (c.SegmentSizeInMB < 0 || c.SegmentSizeInMB > maxOutputSegmentSizeInMB) {
+		return errInvalidOutputSegmentSize
+	}
+	if w := s.PublicSettings.WaitForNetwork; w != nil {
+		if w.TimeoutInSeconds < 0 || w.TimeoutInSeconds > maxNetworkWaitInSeconds {
+			return errInvalidNetworkWaitTimeout
+		}
+		for _, endpoint := range w.Endpoints {
+			if _, port, err := net.SplitHostPort(endpoint); err != nil || port == "" {
+				return errors.Errorf("'waitForNetwork.endpoints' has an invalid endpoint '%s', it must be host:port", endpoint)
+			}
+		}
+	}
+	if e := s.PublicSettings.TemplateEncoding; e != "" && e != TemplateEncodingShell && e != TemplateEncodingNone {
+		return errInvalidTemplateEncoding
+	}
+	if s.PublicSettings.WhatIf && s.PublicSettings.DryRenderTemplate {
+		return errWhatIfWithDryRender
+	}
+	if s.PublicSettings.MaxReboots < 0 || s.PublicSettings.MaxReboots > maxMaxReboots {
+		return errInvalidMaxReboots
+	}
+	if s.PublicSettings.MaxReboots > 0 && !s.PublicSettings.AllowReboot {
+		return errMaxRebootsWithoutReboot
+	}
+	if i := s.PublicSettings.StatusUpdateIntervalSeconds; i != 0 && (i < minStatusUpdateIntervalInSeconds || i > maxStatusUpdateIntervalInSeconds) {
+		return errInvalidStatusUpdateInterval
+	}
+	if m := s.PublicSettings.MaxStatusOutputBytes; m != 0 && (m < minMaxStatusOutputBytes || m > maxMaxStatusOutputBytes) {
+		return errInvalidMaxStatusOutput
+	}
+	if i := s.PublicSettings.CommandInterpreter; i != "" && commandInterpreters[i] == "" && !interpreterPathPattern.MatchString(i) {
+		return errInvalidCommandInterpreter
+	}
+	if l := s.PublicSettings.LogAnalytics; l != nil && (l.DataCollectionEndpoint == "" || l.DataCollectionRuleID == "" || l.StreamName == "") {
+		return errInvalidLogAnalytics
+	}
+	if _, err := s.OutputMetricExtractors(); err != nil {
+		return err
+	}
+	for _, mapping := range s.PublicSettings.ExitCodeMappings {
+		if mapping.State != ExitCodeStateSucceededWithWarning && mapping.State != ExitCodeStateSkipped {
+			return errInvalidExitCodeMap
+		}
+		for _, exitCode := range mapping.ExitCodes {
+			if exitCode < 1 || exitCode > 255 {
+				return errInvalidExitCodeMap
+			}
+		}
+	}
+	return nil
+}
+
+// validateGitRepository validates the git repository of the script, if any
+func (s HandlerSettings) validateGitRepository() error {
+	repo := s.GitRepository()
+	if repo == nil {
+		if s.ProtectedSettings.SourceGitToken != "" {
+			return errGitTokenWithoutRepository
+		}
+		return nil
+	}
+	u, err := url.Parse(repo.URL)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil {
+		return errInvalidGitRepositoryURL
+	}
+	if !isRelativeEntrypoint(repo.Entrypoint) {
+		return errInvalidGitEntrypoint
+	}
+	if strings.HasPrefix(repo.Ref, "-") {
+		return errInvalidGitRef
+	}
+	if repo.UseManagedIdentity && s.ProtectedSettings.SourceGitToken != "" {
+		return errGitTokenWithManagedIdentity
+	}
+	if s.PublicSettings.RunAsUser != "" {
+		return errGitRepositoryWithRunAs
+	}
 	return nil
 }
 
+// isRelativeEntrypoint returns whether entrypoint is the path of a file relative to the root of a bundle of scripts,
+// within it
+func isRelativeEntrypoint(entrypoint string) bool {
+	clean := filepath.Clean(entrypoint)
+	return entrypoint != "" && !filepath.IsAbs(clean) && clean != "." && clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// ScriptCapabilities returns the only capabilities the script runs with, in lower case without their CAP_ prefix
+// (e.g., net_admin). ok is false if the script runs with every capability of root.
+func (s HandlerSettings) ScriptCapabilities() (capabilities []string, ok bool) {
+	if s.PublicSettings.Capabilities == nil {
+		return nil, false
+	}
+	capabilities = []string{}
+	for _, name := range s.PublicSettings.Capabilities {
+		capabilities = append(capabilities, strings.TrimPrefix(strings.ToLower(name), "cap_"))
+	}
+	return capabilities, true
+}
+
+// ScriptLocale returns the locale (LANG and LC_ALL) the script runs with
+func (s HandlerSettings) ScriptLocale() string {
+	if s.PublicSettings.Locale != "" {
+		return s.PublicSettings.Locale
+	}
+	return DefaultScriptLocale
+}
+
+// MappedExitCodeState returns the state the given non-zero exit code of the script is mapped to, if any
+func (s HandlerSettings) MappedExitCodeState(exitCode int) (string, bool) {
+	for _, mapping := range s.PublicSettings.ExitCodeMappings {
+		for _, mappedExitCode := range mapping.ExitCodes {
+			if mappedExitCode == exitCode {
+				return mapping.State, true
+			}
+		}
+	}
+	return "", false
+}
+
+// OutputMetricExtractors returns the extractors of the metrics of metricExtractors
+func (s HandlerSettings) OutputMetricExtractors() ([]outputmetrics.Extractor, error) {
+	if len(s.PublicSettings.MetricExtractors) > outputmetrics.MaxExtractors {
+		return nil, errTooManyMetricExtractors
+	}
+	var extractors []outputmetrics.Extractor
+	names := map[string]bool{}
+	for _, m := range s.PublicSettings.MetricExtractors {
+		if names[m.Name] {
+			return nil, errors.Errorf("'metricExtractors' has the metric '%s' more than once", m.Name)
+		}
+		names[m.Name] = true
+		extractor, err := outputmetrics.New(m.Name, m.Regex, m.JSONPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "'metricExtractors' is invalid")
+		}
+		extractors = append(extractors, extractor)
+	}
+	return extractors, nil
+}
+
+// RebootLimit returns the number of reboots the script can request
+func (s HandlerSettings) RebootLimit() int {
+	if s.PublicSettings.MaxReboots == 0 {
+		return defaultMaxReboots
+	}
+	return s.PublicSettings.MaxReboots
+}
+
+// ExecutesScript returns whether the script is executed, rather than only rendered (dryRenderTemplate) or described
+// (whatIf)
+func (s HandlerSettings) ExecutesScript() bool {
+	return !s.PublicSettings.DryRenderTemplate && !s.PublicSettings.WhatIf
+}
+
+// StatusUpdateInterval returns how often the status of the running script is reported, 0 for the default
+func (s HandlerSettings) StatusUpdateInterval() time.Duration {
+	return time.Duration(s.PublicSettings.StatusUpdateIntervalSeconds) * time.Second
+}
+
+// MaxStatusOutputLength returns how much of each output stream of the script is reported in the status, in bytes
+func (s HandlerSettings) MaxStatusOutputLength() int64 {
+	if s.PublicSettings.MaxStatusOutputBytes == 0 {
+		return DefaultMaxStatusOutputBytes
+	}
+	return int64(s.PublicSettings.MaxStatusOutputBytes)
+}
+
+// CommandInterpreter returns the interpreter line launching the script, e.g. "/usr/bin/env python3", empty when the
+// script is launched with the interpreter of its shebang
+func (s HandlerSettings) CommandInterpreter() string {
+	if interpreter, ok := commandInterpreters[s.PublicSettings.CommandInterpreter]; ok {
+		return interpreter
+	}
+	return s.PublicSettings.CommandInterpreter
+}
+
+// ShouldKillPreviousRunningProcess returns whether the script of the previous sequence number is killed if still running
+func (s HandlerSettings) ShouldKillPreviousRunningProcess() bool {
+	return s.PublicSettings.KillPreviousRunningProcess == nil || *s.PublicSettings.KillPreviousRunningProcess
+}
+
 // PublicSettings is the type deserialized from public configuration section of
 // the extension handler. This should be in sync with publicSettingsSchema.
 type PublicSettings struct {
 	Source                          *ScriptSource         `json:"source"`
 	Parameters                      []ParameterDefinition `json:"parameters"`
 	RunAsUser                       string                `json:"runAsUser"`
+	RunAsGroup                      string                `json:"runAsGroup"`
+	RunAsSupplementaryGroups        []string              `json:"runAsSupplementaryGroups"`
+	RunAsLoginShell                 bool                  `json:"runAsLoginShell"`
+	RunAsElevated                   bool                  `json:"runAsElevated"`
+	EnvironmentVariables            map[string]string     `json:"environmentVariables"`
 	OutputBlobURI                   string                `json:"outputBlobUri"`
 	ErrorBlobURI                    string                `json:"errorBlobUri"`
 	TimeoutInSeconds                int                   `json:"timeoutInSeconds,int"`
 	AsyncExecution                  bool                  `json:"asyncExecution,bool"`
 	TreatFailureAsDeploymentFailure bool                  `json:"treatFailureAsDeploymentFailure,bool"`
 
+	// Capabilities are the only capabilities of root the script runs with (e.g., ["CAP_NET_ADMIN"]), the other ones
+	// are dropped. An empty list drops every capability. Not set, the script runs with every capability of root.
+	Capabilities []string `json:"capabilities"`
+
+	// ExecutionProfile names the execution profile defined on the machine the script executes with, the "default"
+	// profile if not set and defined
+	ExecutionProfile string `json:"executionProfile"`
+
+	// ResourceLimits bound the resources of the processes of the script, as set by the execution profile. They are
+	// only kept in memory.
+	ResourceLimits *ResourceLimits `json:"-"`
+
+	// NoNewPrivileges runs the script with the no_new_privs flag set, as the sandbox of the execution profile. It is
+	// only kept in memory.
+	NoNewPrivileges bool `json:"-"`
+
+	// Requires are the commands the script requires (e.g., ["jq", "curl"]). The script is not executed when one
+	// of them is missing from the PATH it executes with, that of the RunAs user with runAsUser.
+	Requires []string `json:"requires"`
+
+	// InstallRequirements installs the missing required commands with the package manager of the VM, as the
+	// packages of the same name, instead of failing
+	InstallRequirements bool `json:"installRequirements,bool"`
+
+	// KillPreviousRunningProcess kills the script of the previous sequence number if it is still running when a new
+	// one is enabled. Defaults to true. Set it to false to leave long-running asynchronous scripts alone.
+	KillPreviousRunningProcess *bool `json:"killPreviousRunningProcess"`
+
+	// Locale (LANG and LC_ALL) of the script. Defaults to C.UTF-8 so the output is consistent across images
+	Locale string `json:"locale"`
+
+	// DeleteOutputAfterUpload deletes the stdout and stderr files of the script from the VM once they are fully
+	// uploaded to outputBlobUri and errorBlobUri. A stream without a blob is kept.
+	DeleteOutputAfterUpload bool `json:"deleteOutputAfterUpload,bool"`
+
+	// OutputRetentionInDays deletes the stdout and stderr files of the script from the VM once the script has
+	// completed for that many days. Defaults to 0, which keeps them until the next execution replaces them.
+	OutputRetentionInDays int `json:"outputRetentionInDays,int"`
+
+	// UploadHandlerLogsOnFailure uploads the logs of the handler for the failed operation and a summary of the
+	// execution next to errorBlobUri (as <errorBlob>.handlerlogs) when the operation fails, for support engagements
+	UploadHandlerLogsOnFailure bool `json:"uploadHandlerLogsOnFailure,bool"`
+
+	// SkipDos2Unix leaves the DOS-line endings of a downloaded or local script as is, instead of converting them
+	SkipDos2Unix bool `json:"skipDos2Unix,bool"`
+
+	// SkipBOMRemoval leaves the byte order mark of a downloaded or local script as is, instead of removing it
+	SkipBOMRemoval bool `json:"skipBomRemoval,bool"`
+
+	// InsertShebang prepends #!/bin/bash to a downloaded or local script without a shebang
+	InsertShebang bool `json:"insertShebang,bool"`
+
+	// RenderTemplate renders the script as a template of the named parameters before executing it: ${name} is
+	// replaced by the value of the parameter name, encoded as templateEncoding tells, and $${name} by a literal ${name}
+	RenderTemplate bool `json:"renderTemplate,bool"`
+
+	// TemplateEncoding is how the values are rendered in the script template: shell (the default) quotes them for
+	// the quotes around the placeholder and references the protected ones as environment variables, none writes
+	// them as they are, e.g., for a python3 script, and leaves the protected ones out
+	TemplateEncoding string `json:"templateEncoding"`
+
+	// DryRenderTemplate renders the script without executing it and reports the rendered script as its output, which
+	// never contains the values of the protected parameters, and the issues found in the script (e.g., CRLF line
+	// endings or a missing interpreter) as its error output
+	DryRenderTemplate bool `json:"dryRenderTemplate,bool"`
+
+	// WhatIf downloads, validates and prepares the script without executing it, and reports what would run (the
+	// hash of the script, its interpreter, user and timeout) as its output, e.g., for change approvals
+	WhatIf bool `json:"whatIf,bool"`
+
+	// WaitForNetwork waits for the network to be ready before downloading and executing the script, e.g., for the
+	// run commands executed at boot while cloud-init configures the network
+	WaitForNetwork *NetworkReadiness `json:"waitForNetwork"`
+
+	// OutputCompression compresses the stdout and stderr files of the script in segments as they grow, so a long
+	// running script writing GBs of output consumes a fraction of the disk. The latest segment stays uncompressed.
+	OutputCompression *OutputCompression `json:"outputCompression"`
+
+	// Proxy is the HTTP proxy (e.g., http://proxy.contoso.com:3128) the script, artifacts and output blobs are
+	// accessed through, instead of the proxy of HTTP_PROXY and HTTPS_PROXY. The hosts of NO_PROXY are still accessed
+	// directly.
+	Proxy string `json:"proxy"`
+
+	// MaxDownloadBandwidthKbps bounds the bandwidth of the downloads of the script, the artifacts and the container
+	// registry artifact in kilobits per second, so pulling large artifacts doesn't saturate the network of the VM.
+	// Zero is no limit. The git repositories and the synced artifacts are not bounded.
+	MaxDownloadBandwidthKbps int `json:"maxDownloadBandwidthKbps"`
+
+	// MinFreeDiskSpaceMB is the free space, in MB, left on the file system of the downloads once the script and the
+	// artifacts are downloaded, which the output of the script needs. The execution fails before anything is
+	// downloaded unless the declared sizes of the downloads and this minimum fit. Zero skips the check.
+	MinFreeDiskSpaceMB int `json:"minFreeDiskSpaceMB"`
+
+	// RetentionPolicy bounds what the executions of the run command leave on the VM, applied after every execution
+	// and periodically by the immediate run command service
+	RetentionPolicy *RetentionPolicy `json:"retentionPolicy"`
+
+	// AllowReboot lets the script request a reboot of the VM by exiting with 194 or creating the file named by
+	// RUN_COMMAND_REBOOT_MARKER. The immediate run command service reboots the VM and executes the script again
+	// once it boots, with RUN_COMMAND_STEP telling it which step to resume at. Only the final step is reported
+	// as the outcome of the execution.
+	AllowReboot bool `json:"allowReboot,bool"`
+
+	// MaxReboots bounds the reboots the script can request, defaults to 3
+	MaxReboots int `json:"maxReboots,int"`
+
+	// LogAnalytics ships the lines of the output of the script to a Log Analytics workspace as they are written,
+	// in addition to the output blobs
+	LogAnalytics *LogAnalyticsDestination `json:"logAnalytics"`
+
+	// MetricExtractors extract named metrics from the output of the script, reported in the instance view and the
+	// telemetry of the execution (e.g., patched_packages=42)
+	MetricExtractors []MetricExtractor `json:"metricExtractors"`
+
+	// ExitCodeMappings reports the executions of the script exiting with some non-zero exit codes as succeeded
+	// instead of failed (e.g., exit code 2 meaning there was nothing to do)
+	ExitCodeMappings []ExitCodeMapping `json:"exitCodeMappings"`
+
 	// List of artifacts to download before running the script
 	Artifacts []PublicArtifactSource `json:"artifacts"`
+
+	// StatusUpdateIntervalSeconds is how often the status of the running script is reported, defaults to 30
+	StatusUpdateIntervalSeconds int `json:"statusUpdateIntervalSeconds,int"`
+
+	// MaxStatusOutputBytes is how much of the stdout and of the stderr of the script is reported in the status,
+	// defaults to 4096. A longer output is cut in the middle, keeping its beginning and its end.
+	MaxStatusOutputBytes int `json:"maxStatusOutputBytes"`
+
+	// CommandInterpreter launches the script instead of the interpreter of its shebang: bash, sh, python3, pwsh or
+	// the absolute path of an interpreter
+	CommandInterpreter string `json:"commandInterpreter"`
 }
 
 // ProtectedSettings is the type decoded and deserialized from protected
@@ -101,9 +711,26 @@ type ProtectedSettings struct {
 	ErrorBlobSASToken   string                `json:"errorBlobSASToken"`
 	ProtectedParameters []ParameterDefinition `json:"protectedParameters"`
 
+	// Environment variables of the script whose values are never written to the logs or the status
+	ProtectedEnvironmentVariables map[string]string `json:"protectedEnvironmentVariables"`
+
+	// Environment variables of the script whose values are secrets of a Key Vault, referenced as
+	// @Microsoft.KeyVault(SecretUri=<uri>) and read with the managed identity of the VM when the script is executed
+	KeyVaultReferences map[string]string `json:"keyVaultReferences"`
+
+	// Managed identity to use for reading the Key Vault secrets if the VM doesn't have a system managed identity
+	KeyVaultManagedIdentity *RunCommandManagedIdentity `json:"keyVaultManagedIdentity"`
+
+	// KeyVaultSecrets are the values of the keyVaultReferences by variable name, resolved before the script is
+	// executed. They are only kept in memory.
+	KeyVaultSecrets map[string]string `json:"-"`
+
 	// List of artifacts to download before running the script
 	Artifacts []ProtectedArtifactSource `json:"artifacts"`
 
+	// Personal access token to use for downloading the git repository of the script
+	SourceGitToken string `json:"sourceGitToken"`
+
 	// Managed identity to use for reading the script if its not a SAS and if the VM doesn't have a system managed identity
 	SourceManagedIdentity *RunCommandManagedIdentity `json:"sourceManagedIdentity"`
 
@@ -112,6 +739,35 @@ type ProtectedSettings struct {
 
 	// Managed identity to use for writing the error blob if the VM doesn't have a system managed identity
 	ErrorBlobManagedIdentity *RunCommandManagedIdentity `json:"errorBlobManagedIdentity"`
+
+	// BlobSASRenewal is the endpoint issuing the SAS tokens of the output and error blobs, renewed before they
+	// expire, so long executions need neither long-lived tokens nor storage role assignments
+	BlobSASRenewal *SASRenewal `json:"blobSasRenewal"`
+
+	// Managed identity to use for the Logs Ingestion API if the VM doesn't have a system managed identity
+	LogAnalyticsManagedIdentity *RunCommandManagedIdentity `json:"logAnalyticsManagedIdentity"`
+}
+
+// secrets returns the protected values that must never be written to the logs
+func (p ProtectedSettings) secrets() []string {
+	values := []string{p.RunAsPassword, p.SourceSASToken, p.SourceGitToken, p.OutputBlobSASToken, p.ErrorBlobSASToken}
+	for _, parameter := range p.ProtectedParameters {
+		values = append(values, parameter.Value)
+	}
+	for _, value := range p.ProtectedEnvironmentVariables {
+		values = append(values, value)
+	}
+	for _, value := range p.KeyVaultSecrets {
+		values = append(values, value)
+	}
+	for _, artifact := range p.Artifacts {
+		values = append(values, artifact.ArtifactSasToken)
+	}
+	if p.BlobSASRenewal != nil {
+		// The uri may carry a key of the endpoint
+		values = append(values, p.BlobSASRenewal.URI)
+	}
+	return values
 }
 
 // Contains the public and protected information for the artifact to download
@@ -120,6 +776,9 @@ type UnifiedArtifact struct {
 	ArtifactId              int
 	ArtifactUri             string
 	FileName                string
+	Mode                    string
+	TargetDirectory         string
+	Checksum                string
 	ArtifactSasToken        string
 	ArtifactManagedIdentity *RunCommandManagedIdentity
 }
@@ -130,6 +789,24 @@ type PublicArtifactSource struct {
 	ArtifactId  int    `json:"id"`
 	ArtifactUri string `json:"uri"`
 	FileName    string `json:"fileName"`
+	// Mode is either download (default) or sync. In sync mode, uri is a storage container, optionally followed by
+	// a prefix, and its blobs are synced into TargetDirectory, an absolute path.
+	Mode            string `json:"mode"`
+	TargetDirectory string `json:"targetDirectory"`
+	// Checksum is the SHA-256 of the downloaded file, which is not used if it differs. Synced artifacts have none.
+	Checksum string `json:"checksum"`
+	// ManagedIdentityClientId or ManagedIdentityObjectId select the user-assigned managed identity downloading the
+	// artifact, instead of the artifactManagedIdentity of its protected settings
+	ManagedIdentityClientId string `json:"managedIdentityClientId"`
+	ManagedIdentityObjectId string `json:"managedIdentityObjectId"`
+}
+
+// managedIdentity returns the managed identity selected by the public settings of the artifact, nil if none
+func (a PublicArtifactSource) managedIdentity() *RunCommandManagedIdentity {
+	if a.ManagedIdentityClientId == "" && a.ManagedIdentityObjectId == "" {
+		return nil
+	}
+	return &RunCommandManagedIdentity{ClientId: a.ManagedIdentityClientId, ObjectId: a.ManagedIdentityObjectId}
 }
 
 // Contains secret information about an artifact to download to the VM. This includes the sas token for the uri (located in public settings)
@@ -140,6 +817,17 @@ type ProtectedArtifactSource struct {
 	ArtifactManagedIdentity *RunCommandManagedIdentity `json:"artifactManagedIdentity"`
 }
 
+// SASRenewal is an endpoint of the customer issuing short-lived SAS tokens for the blobs the output is uploaded to.
+// The handler POSTs {"blobUri": "<uri>"} to it, authenticated by a token of the managed identity for Resource,
+// and expects {"sasToken": "<token>"} back. outputBlobSASToken and errorBlobSASToken, if any, are used first.
+type SASRenewal struct {
+	URI string `json:"uri"`
+	// Resource is the application ID URI the tokens of the managed identity are issued for
+	Resource string `json:"resource"`
+	// Managed identity authenticating the requests if the VM doesn't have a system managed identity
+	ManagedIdentity *RunCommandManagedIdentity `json:"managedIdentity"`
+}
+
 type RunCommandManagedIdentity struct {
 	ObjectId string `json:"objectId"`
 	ClientId string `json:"clientId"`
@@ -148,11 +836,146 @@ type RunCommandManagedIdentity struct {
 type ScriptSource struct {
 	Script    string `json:"script"`
 	ScriptURI string `json:"scriptUri"`
+	// LocalPath is a script pre-staged on the machine (e.g., baked into the image) for disconnected machines
+	LocalPath string `json:"localPath"`
+	// LibraryScript is the name of a script of the script library synced by the service (e.g., check-disk.sh)
+	LibraryScript string `json:"libraryScript"`
+	// GitRepository is a git repository whose entrypoint script is executed next to the other files of the repository
+	GitRepository *GitRepositorySource `json:"gitRepository"`
+	// OCIArtifact is an artifact of Azure Container Registry whose entrypoint script is executed next to the other
+	// files of the artifact
+	OCIArtifact *OCIArtifactSource `json:"ociArtifact"`
+	// ScriptChecksum is the SHA-256 of the script downloaded from ScriptURI, which is not executed if it differs
+	ScriptChecksum string `json:"scriptChecksum"`
 	// When the RunCommand extension sees the installAsService == true, it will apply the operations on the service as well.
 	// This service will continuously poll HGAP for any new goal state.
 	InstallAsService bool `json:"installAsService,bool"`
 }
 
+// specifiedCount returns how many of the alternative sources of the script are specified
+func (s ScriptSource) specifiedCount() int {
+	count := 0
+	for _, source := range []string{s.Script, s.ScriptURI, s.LocalPath, s.LibraryScript} {
+		if source != "" {
+			count++
+		}
+	}
+	if s.GitRepository != nil {
+		count++
+	}
+	if s.OCIArtifact != nil {
+		count++
+	}
+	return count
+}
+
+// GitRepositorySource is a git repository downloaded at a branch, tag or commit, anonymously or with either the
+// protected 'sourceGitToken' or the Azure DevOps token of a managed identity
+type GitRepositorySource struct {
+	// URL is the https URL of the repository, without credentials
+	URL string `json:"url"`
+	// Ref is the branch, tag or commit to download, the default branch of the repository if empty
+	Ref string `json:"ref"`
+	// Entrypoint is the path of the script to execute, relative to the root of the repository
+	Entrypoint string `json:"entrypoint"`
+	// UseManagedIdentity authenticates to Azure DevOps with the 'sourceManagedIdentity', or the system managed
+	// identity if not specified
+	UseManagedIdentity bool `json:"useManagedIdentity,bool"`
+}
+
+// OCIArtifactSource is a script bundle published as an artifact of Azure Container Registry, pulled with the
+// 'sourceManagedIdentity', or the system managed identity if not specified. The artifact has a single layer: a tar
+// archive extracted, or a single file.
+type OCIArtifactSource struct {
+	// Reference is the reference of the artifact, e.g., myregistry.azurecr.io/scripts/bundle:v1 or
+	// myregistry.azurecr.io/scripts/bundle@sha256:<digest>
+	Reference string `json:"reference"`
+	// Entrypoint is the path of the script to execute, relative to the root of the artifact
+	Entrypoint string `json:"entrypoint"`
+}
+
+// MetricExtractor extracts a named metric from the output of the script, with either a regular expression whose
+// first group (or whole match) of the last match is the value, or a JSON path (e.g., $.summary.patched) into the
+// output or its last line which is a JSON document
+type MetricExtractor struct {
+	Name     string `json:"name"`
+	Regex    string `json:"regex"`
+	JSONPath string `json:"jsonPath"`
+}
+
+// LogAnalyticsDestination is the Log Analytics workspace the output of the script is shipped to with the Logs
+// Ingestion API through a data collection rule, authenticated with a managed identity
+type LogAnalyticsDestination struct {
+	// DataCollectionEndpoint is the logs ingestion endpoint of the data collection endpoint, e.g.,
+	// https://contoso-abcd.eastus-1.ingest.monitor.azure.com
+	DataCollectionEndpoint string `json:"dataCollectionEndpoint"`
+
+	// DataCollectionRuleID is the immutable ID of the data collection rule, e.g., dcr-0123456789abcdef
+	DataCollectionRuleID string `json:"dataCollectionRuleId"`
+
+	// StreamName is the stream of the data collection rule, e.g., Custom-RunCommandOutput
+	StreamName string `json:"streamName"`
+}
+
+// NetworkReadiness is the network the script needs before executing. The VM must have a default route, and the
+// host names and endpoints listed must be reachable.
+type NetworkReadiness struct {
+	// HostNames must resolve, e.g., ["contoso.com"]
+	HostNames []string `json:"hostNames"`
+
+	// Endpoints must accept TCP connections, as host:port (e.g., "contoso.com:443")
+	Endpoints []string `json:"endpoints"`
+
+	// TimeoutInSeconds bounds the wait, defaults to 300
+	TimeoutInSeconds int `json:"timeoutInSeconds,int"`
+}
+
+// NetworkWaitTimeout returns how long to wait for the network to be ready
+func (n NetworkReadiness) NetworkWaitTimeout() time.Duration {
+	if n.TimeoutInSeconds == 0 {
+		return defaultNetworkWaitInSeconds * time.Second
+	}
+	return time.Duration(n.TimeoutInSeconds) * time.Second
+}
+
+// RetentionPolicy bounds the executions kept on the VM. A zero field doesn't bound them.
+type RetentionPolicy struct {
+	// KeepLastExecutions is how many of the most recent executions of the run command are kept. Defaults to the most
+	// recent one, none for the immediate run commands.
+	KeepLastExecutions int `json:"keepLastExecutions"`
+
+	// MaxAgeInDays deletes the executions completed that many days ago, except the most recent one
+	MaxAgeInDays int `json:"maxAgeInDays"`
+
+	// MaxDataDirSizeInMB caps the size of the data directory of the handler, shared by every run command of the VM.
+	// The oldest executions of any run command are deleted until it fits, except the most recent one of each.
+	MaxDataDirSizeInMB int `json:"maxDataDirSizeInMB"`
+}
+
+// OutputCompression compresses the output files of the script into gzip segments
+type OutputCompression struct {
+	// SegmentSizeInMB is the size of the output compressed at a time, defaults to 64
+	SegmentSizeInMB int `json:"segmentSizeInMB,int"`
+}
+
+// OutputSegmentSize returns the size of the output compressed at a time in bytes, 0 if the output is not compressed
+func (s HandlerSettings) OutputSegmentSize() int64 {
+	c := s.PublicSettings.OutputCompression
+	if c == nil {
+		return 0
+	}
+	if c.SegmentSizeInMB == 0 {
+		return defaultOutputSegmentSizeInMB * 1024 * 1024
+	}
+	return int64(c.SegmentSizeInMB) * 1024 * 1024
+}
+
+// ExitCodeMapping maps exit codes of the script to the state its executions are reported in
+type ExitCodeMapping struct {
+	ExitCodes []int  `json:"exitCodes"`
+	State     string `json:"state"`
+}
+
 type ParameterDefinition struct {
 	Name  string `json:"name"`
 	Value string `json:"value"`
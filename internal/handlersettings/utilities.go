@@ -35,10 +35,11 @@ func GetUriForLogging(uriString string) string {
 }
 
 // Get handler settings from config folder. Example path: /var/lib/waagent/Microsoft.CPlat.Core.RunCommandHandlerLinux-1.3.2/config
+// The settings are cached until the config file changes, so repeated invocations (e.g., status re-reports) don't
+// decrypt and validate them again.
 func GetHandlerSettings(configFolder string, extensionName string, sequenceNumber int, logContext *log.Context) (HandlerSettings, error) {
 	configPath := GetConfigFilePath(configFolder, sequenceNumber, extensionName)
-	cfg, err := ParseAndValidateSettings(logContext, configPath)
-	return cfg, err
+	return getCachedSettings(logContext, configPath, extensionName)
 }
 
 // Gets the config file path for the current extension name and sequence number.
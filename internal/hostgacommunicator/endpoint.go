@@ -0,0 +1,7 @@
+package hostgacommunicator
+
+// vmSettingsEndpoint returns the endpoint the VMSettings are requested from: the wire server, unless the service is
+// built for the test harness
+var vmSettingsEndpoint = func() string {
+	return WireServerFallbackAddress
+}
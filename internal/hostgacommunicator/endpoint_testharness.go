@@ -0,0 +1,20 @@
+//go:build testharness
+
+package hostgacommunicator
+
+import (
+	"os"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+)
+
+// The service built for the test harness requests the VMSettings from the fake HGAP of the harness, set by
+// VMSettingsEndpointEnvName. The production builds never read it.
+func init() {
+	vmSettingsEndpoint = func() string {
+		if value := os.Getenv(constants.VMSettingsEndpointEnvName); value != "" {
+			return value
+		}
+		return WireServerFallbackAddress
+	}
+}
@@ -3,9 +3,16 @@ package hostgacommunicator
 import (
 	"encoding/json"
 	"io"
+	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/Azure/run-command-handler-linux/internal/clock"
+	"github.com/Azure/run-command-handler-linux/internal/constants"
 	"github.com/Azure/run-command-handler-linux/internal/requesthelper"
+	"github.com/Azure/run-command-handler-linux/pkg/atomicfile"
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 )
@@ -15,6 +22,20 @@ const (
 	WireServerFallbackAddress = "http://168.63.129.16:32526"
 )
 
+// ErrNotModified is returned by GetImmediateVMSettings when the VMSettings have not changed since they were
+// acknowledged, their goal states were already processed
+var ErrNotModified = errors.New("the VMSettings were not modified")
+
+// IsNotModified returns true if err is, or wraps, ErrNotModified
+func IsNotModified(err error) bool {
+	return errors.Is(err, ErrNotModified)
+}
+
+// GetETagPath returns the path of the file tracking the ETag of the VMSettings under the given data directory
+func GetETagPath(dataDir string) string {
+	return filepath.Join(dataDir, constants.VMSettingsETagFileName)
+}
+
 // Interface for operations available when communicating with HostGAPlugin
 type IHostGACommunicator interface {
 	GetImmediateVMSettings(ctx *log.Context) (*VMSettings, error)
@@ -23,10 +44,29 @@ type IHostGACommunicator interface {
 // HostGaCommunicator provides methods for retrieving VMSettings from the HostGAPlugin
 type HostGACommunicator struct {
 	vmRequestManager IVMSettingsRequestManager
+
+	// etagPath is the file the acknowledged ETag is persisted to, the VMSettings are always requested if empty
+	etagPath string
+	// acknowledgedETag is the ETag of the VMSettings whose goal states were processed, sent as If-None-Match
+	acknowledgedETag string
+	// receivedETag is the ETag of the VMSettings last returned, acknowledged once their goal states are processed
+	receivedETag string
+	loaded       bool
+
+	// clock times the retries of the requests
+	clock clock.Clock
 }
 
 func NewHostGACommunicator(requestManager IVMSettingsRequestManager) HostGACommunicator {
-	return HostGACommunicator{vmRequestManager: requestManager}
+	return HostGACommunicator{vmRequestManager: requestManager, clock: clock.Real}
+}
+
+// NewHostGACommunicatorWithETag returns a communicator requesting the VMSettings only when they changed since they
+// were acknowledged, as told by their ETag (the incarnation of the goal state). The acknowledged ETag is persisted
+// at etagPath, so an unchanged goal state is not processed again after a restart either. The retries of the requests
+// are timed by clk.
+func NewHostGACommunicatorWithETag(requestManager IVMSettingsRequestManager, etagPath string, clk clock.Clock) *HostGACommunicator {
+	return &HostGACommunicator{vmRequestManager: requestManager, etagPath: etagPath, clock: clk}
 }
 
 type IVMSettingsRequestManager interface {
@@ -41,14 +81,22 @@ func (c *HostGACommunicator) GetImmediateVMSettings(ctx *log.Context) (*VMSettin
 		return nil, errors.Wrapf(err, "could not create the request manager")
 	}
 
+	if etag := c.lastETag(ctx); etag != "" {
+		requestManager.SetHeader("If-None-Match", etag)
+	}
+
 	ctx.Log("message", "attempting to make request with retries to retrieve VMSettings")
-	resp, err := requesthelper.WithRetries(ctx, requestManager, requesthelper.ActualSleep)
+	resp, err := requesthelper.WithRetries(ctx, requestManager, c.clock)
 	if err != nil {
 		return nil, errors.Wrapf(err, "metadata request failed with retries.")
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		ctx.Log("message", "VMSettings were not modified", "etag", c.acknowledgedETag)
+		return nil, ErrNotModified
+	}
 	ctx.Log("message", "request completed. Reading body content from response")
 
-	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		panic(err)
@@ -60,18 +108,55 @@ func (c *HostGACommunicator) GetImmediateVMSettings(ctx *log.Context) (*VMSettin
 		return nil, errors.Wrapf(err, "failed to parse json")
 	}
 
-	ctx.Log("message", "VMSettings successfully parsed")
+	c.receivedETag = resp.Header.Get("ETag")
+	ctx.Log("message", "VMSettings successfully parsed", "etag", c.receivedETag)
 	return &vmSettings, nil
 }
 
-// Gets the URI to use to call the given operation name
+// AcknowledgeVMSettings records the VMSettings last returned as processed: they are not returned again until they
+// change. The VMSettings whose goal states could not all be processed yet (e.g., no execution slot was free) must
+// not be acknowledged, so they are returned again on the next request.
+func (c *HostGACommunicator) AcknowledgeVMSettings(ctx *log.Context) error {
+	if c.etagPath == "" || c.receivedETag == "" || c.receivedETag == c.acknowledgedETag {
+		return nil
+	}
+	if err := atomicfile.WriteFile(c.etagPath, []byte(c.receivedETag), 0600); err != nil {
+		return errors.Wrap(err, "failed to persist the ETag of the VMSettings")
+	}
+	c.acknowledgedETag = c.receivedETag
+	ctx.Log("message", "VMSettings acknowledged", "etag", c.acknowledgedETag)
+	return nil
+}
+
+// lastETag returns the acknowledged ETag, read from its file on the first request. A missing or unreadable file
+// means the VMSettings are requested unconditionally.
+func (c *HostGACommunicator) lastETag(ctx *log.Context) string {
+	if c.etagPath == "" {
+		return ""
+	}
+	if !c.loaded {
+		c.loaded = true
+		b, err := os.ReadFile(c.etagPath)
+		if err != nil && !os.IsNotExist(err) {
+			ctx.Log("warning", "could not read the ETag of the VMSettings, requesting them unconditionally", "error", err)
+		}
+		c.acknowledgedETag = strings.TrimSpace(string(b))
+	}
+	return c.acknowledgedETag
+}
+
+// Gets the URI to use to call the given operation name, on the endpoint of the VMSettings
 func getOperationUri(ctx *log.Context, operationName string) (string, error) {
 	// TODO: investigate why other extensions use the env var AZURE_GUEST_AGENT_WIRE_PROTOCOL_ADDRESS
 	// and decide if we want to add that wire protocol address as a potential endpoint to use when provided
 	ctx.Log("message", "creating uri to perform operation")
-	uri, err := url.Parse(WireServerFallbackAddress)
+	address := vmSettingsEndpoint()
+	uri, err := url.Parse(address)
 	if err != nil {
-		return "", errors.Wrap(err, "could not parse address "+WireServerFallbackAddress)
+		return "", errors.Wrap(err, "could not parse address "+address)
+	}
+	if (uri.Scheme != "http" && uri.Scheme != "https") || uri.Host == "" {
+		return "", errors.Errorf("the VMSettings endpoint %s must be an http or https url", address)
 	}
 	uri.Path = operationName
 	return uri.String(), nil
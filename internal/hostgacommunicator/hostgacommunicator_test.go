@@ -4,6 +4,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/Azure/run-command-handler-linux/internal/constants"
 	"github.com/go-kit/kit/log"
 	"github.com/stretchr/testify/require"
 )
@@ -16,3 +17,23 @@ func Test_GetOperationUri(t *testing.T) {
 	require.NotNil(t, uri)
 	require.Contains(t, uri, operationName)
 }
+
+func Test_GetOperationUri_endpoint(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	defer func(endpoint func() string) { vmSettingsEndpoint = endpoint }(vmSettingsEndpoint)
+
+	// The production builds don't read the endpoint of the test harness
+	t.Setenv(constants.VMSettingsEndpointEnvName, "http://127.0.0.1:8080")
+	uri, err := getOperationUri(ctx, vmSettingsOperation)
+	require.Nil(t, err)
+	require.Equal(t, WireServerFallbackAddress+"/vmSettings", uri)
+
+	vmSettingsEndpoint = func() string { return "http://127.0.0.1:8080" }
+	uri, err = getOperationUri(ctx, vmSettingsOperation)
+	require.Nil(t, err)
+	require.Equal(t, "http://127.0.0.1:8080/vmSettings", uri)
+
+	vmSettingsEndpoint = func() string { return "ftp://127.0.0.1:8080" }
+	_, err = getOperationUri(ctx, vmSettingsOperation)
+	require.EqualError(t, err, "the VMSettings endpoint ftp://127.0.0.1:8080 must be an http or https url")
+}
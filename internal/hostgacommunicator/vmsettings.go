@@ -39,6 +39,8 @@ type ExtensionGoalStates struct {
 	ExtensionName       string                    `json:"extensionName"`
 	IsMultiConfig       bool                      `json:"isMultiConfig"`
 	Settings            []settings.SettingsCommon `json:"settings"`
+	// FeatureFlags overrides the default values of the feature flags of the handler for the fleet
+	FeatureFlags map[string]bool `json:"featureFlags,omitempty"`
 }
 
 type VMSettings struct {
@@ -83,7 +85,7 @@ func (u requestFactory) GetRequest(ctx *log.Context) (*http.Request, error) {
 }
 
 func (goalState *ExtensionGoalStates) ValidateSignature() (bool, error) {
-	he, err := handlersettings.GetHandlerEnv()
+	he, err := handlersettings.GetHandlerEnvWithFallback(goalState.Name, goalState.Version)
 	if err != nil {
 		return false, errors.Wrap(err, "failed to parse handlerenv")
 	}
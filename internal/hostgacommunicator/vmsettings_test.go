@@ -5,8 +5,11 @@ import (
 	"net/http/httptest"
 	"os"
 	"path"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/Azure/run-command-handler-linux/internal/clock"
 	"github.com/Azure/run-command-handler-linux/internal/requesthelper"
 	"github.com/ahmetb/go-httpbin"
 	"github.com/go-kit/kit/log"
@@ -82,3 +85,77 @@ func Test_FileExists(t *testing.T) {
 	require.False(t, fileExists(nonExistentFile))
 	require.True(t, fileExists(existentFile))
 }
+
+func Test_GetImmediateVMSettingsNotModified(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	etag := `"incarnation-1"`
+	var conditions []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conditions = append(conditions, r.Header.Get("If-None-Match"))
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(`{"extensionGoalStates":[{"name":"Microsoft.CPlat.Core.RunCommandHandlerLinux"}]}`))
+	}))
+	defer srv.Close()
+
+	testRequest := new(TestRequestManager)
+	testRequest.testUrlRequest = NewTestUrlRequest(srv.URL)
+	etagPath := path.Join(t.TempDir(), "vmSettings.etag")
+	communicator := NewHostGACommunicatorWithETag(testRequest, etagPath, clock.Real)
+
+	// Returned until they are acknowledged
+	for i := 0; i < 2; i++ {
+		vmSettings, err := communicator.GetImmediateVMSettings(ctx)
+		require.Nil(t, err)
+		require.Len(t, vmSettings.ExtensionGoalStates, 1)
+	}
+	require.Nil(t, communicator.AcknowledgeVMSettings(ctx))
+
+	_, err := communicator.GetImmediateVMSettings(ctx)
+	require.True(t, IsNotModified(err))
+	require.Equal(t, []string{"", "", etag}, conditions)
+
+	// The acknowledged ETag survives a restart
+	_, err = NewHostGACommunicatorWithETag(testRequest, etagPath, clock.Real).GetImmediateVMSettings(ctx)
+	require.True(t, IsNotModified(err))
+
+	// A new incarnation is returned
+	etag = `"incarnation-2"`
+	vmSettings, err := communicator.GetImmediateVMSettings(ctx)
+	require.Nil(t, err)
+	require.NotNil(t, vmSettings)
+}
+
+func Test_GetImmediateVMSettingsRetriesWithClock(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"extensionGoalStates":[]}`))
+	}))
+	defer srv.Close()
+
+	testRequest := new(TestRequestManager)
+	testRequest.testUrlRequest = NewTestUrlRequest(srv.URL)
+	fake := clock.NewFake(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	communicator := NewHostGACommunicatorWithETag(testRequest, "", fake)
+
+	result := make(chan error)
+	go func() {
+		_, err := communicator.GetImmediateVMSettings(ctx)
+		result <- err
+	}()
+
+	// The request is retried once the clock is advanced by the backoff
+	fake.WaitForWaiters(1)
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	fake.Advance(3 * time.Second)
+	require.Nil(t, <-result)
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
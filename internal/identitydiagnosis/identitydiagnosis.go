@@ -0,0 +1,222 @@
+// Package identitydiagnosis diagnoses the failures to access a storage blob with a managed identity. It probes the
+// managed identity endpoint of IMDS, so the error of a run command says which of the usual causes applies: no
+// identity on the VM, an identity not assigned to the VM, a token for another audience, or a missing role assignment.
+package identitydiagnosis
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/pkg/requestheaders"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// probeTimeout bounds every probe, IMDS is local to the host and answers quickly when available
+	probeTimeout = 2 * time.Second
+
+	// userAssignedSegment is found in the resource ID of a user-assigned identity
+	userAssignedSegment = "/userAssignedIdentities/"
+
+	// Descriptions of the errors of IMDS for the identities which can't be used
+	identityNotFound     = "Identity not found"
+	multipleUserAssigned = "Multiple user assigned identities exist"
+)
+
+// tokenURL is the endpoint of IMDS returning the tokens of the managed identities of the VM
+var tokenURL = "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01"
+
+var (
+	mu sync.Mutex
+	// diagnoses are the diagnoses already made by the process, by identity and resource
+	diagnoses = make(map[diagnosisKey]Diagnosis)
+)
+
+// diagnosisKey identifies the identity probed for a resource
+type diagnosisKey struct {
+	clientID string
+	objectID string
+	resource string
+}
+
+// Diagnosis is the outcome of probing the managed identities of the VM for a resource
+type Diagnosis struct {
+	// Findings describe the identities of the VM and the token of the selected identity, in the order probed
+	Findings []string
+	// TokenAcquired is set when the selected identity got a token for the resource, which leaves a missing role
+	// assignment as the likely cause of the failure
+	TokenAcquired bool
+}
+
+// String summarizes the diagnosis, recommending the role assignment on the container of the blob if the identity
+// got a token
+func (d Diagnosis) String(role string) string {
+	summary := "Managed identity diagnosis: " + strings.Join(d.Findings, "; ") + "."
+	if d.TokenAcquired {
+		summary += fmt.Sprintf(" The identity got a token for the storage account, make sure it has the '%s' role assignment on the container of the blob.", role)
+	}
+	return summary
+}
+
+// tokenClaims are the claims of an access token describing the identity it was issued to
+type tokenClaims struct {
+	Audience   string `json:"aud"`
+	ObjectID   string `json:"oid"`
+	ClientID   string `json:"appid"`
+	ResourceID string `json:"xms_mirid"`
+}
+
+// probeResult is the answer of IMDS to a token request
+type probeResult struct {
+	claims      *tokenClaims
+	description string
+	err         error
+}
+
+// Diagnose probes the system-assigned identity of the VM and the user-assigned identity mi, if any, for a token for
+// resource (e.g., https://storage.azure.com/). The identities are only probed, the tokens are never kept. An identity
+// is probed once per process for a resource, as every blob of the operation failing with it would probe it again.
+func Diagnose(ctx *log.Context, mi *handlersettings.RunCommandManagedIdentity, resource string) Diagnosis {
+	key := diagnosisKey{resource: resource}
+	if mi != nil {
+		key.clientID, key.objectID = mi.ClientId, mi.ObjectId
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if d, ok := diagnoses[key]; ok {
+		ctx.Log("event", "managed identity already diagnosed", "findings", strings.Join(d.Findings, "; "), "tokenAcquired", d.TokenAcquired)
+		return d
+	}
+	d := probeIdentities(ctx, mi, resource)
+	diagnoses[key] = d
+	return d
+}
+
+// probeIdentities probes the identities of the VM for a token for resource and diagnoses them
+func probeIdentities(ctx *log.Context, mi *handlersettings.RunCommandManagedIdentity, resource string) Diagnosis {
+	var d Diagnosis
+
+	system := probe(resource, "", "")
+	switch {
+	case system.err != nil:
+		d.Findings = append(d.Findings, fmt.Sprintf("the managed identity endpoint (IMDS) is not reachable: %v", system.err))
+		ctx.Log("event", "diagnosed managed identity", "findings", strings.Join(d.Findings, "; "))
+		return d
+	case system.claims != nil && strings.Contains(system.claims.ResourceID, userAssignedSegment):
+		// Without a system-assigned identity, IMDS returns the token of the only user-assigned identity of the VM
+		d.Findings = append(d.Findings, fmt.Sprintf("no system-assigned identity, the only user-assigned identity '%s' (client id %s) is used by default",
+			identityName(system.claims.ResourceID), system.claims.ClientID))
+	case system.claims != nil:
+		d.Findings = append(d.Findings, fmt.Sprintf("system-assigned identity available (object id %s)", system.claims.ObjectID))
+	case strings.Contains(system.description, multipleUserAssigned):
+		d.Findings = append(d.Findings, "no system-assigned identity, several user-assigned identities are assigned to the VM and one must be selected by its client id or object id")
+	case strings.Contains(system.description, identityNotFound):
+		d.Findings = append(d.Findings, "no system-assigned identity nor user-assigned identity is assigned to the VM")
+	default:
+		d.Findings = append(d.Findings, "the system-assigned identity can't get a token: "+system.description)
+	}
+
+	selected := system
+	if mi != nil && (mi.ClientId != "" || mi.ObjectId != "") {
+		name := "client id " + mi.ClientId
+		if mi.ClientId == "" {
+			name = "object id " + mi.ObjectId
+		}
+		selected = probe(resource, mi.ClientId, mi.ObjectId)
+		switch {
+		case selected.err != nil:
+			d.Findings = append(d.Findings, fmt.Sprintf("the user-assigned identity with %s could not be probed: %v", name, selected.err))
+		case selected.claims != nil:
+			d.Findings = append(d.Findings, fmt.Sprintf("user-assigned identity with %s available", name))
+		case strings.Contains(selected.description, identityNotFound):
+			d.Findings = append(d.Findings, fmt.Sprintf("the user-assigned identity with %s is not assigned to the VM", name))
+		default:
+			d.Findings = append(d.Findings, fmt.Sprintf("the user-assigned identity with %s can't get a token: %s", name, selected.description))
+		}
+	}
+
+	if selected.claims != nil {
+		if sameAudience(selected.claims.Audience, resource) {
+			d.TokenAcquired = true
+		} else {
+			d.Findings = append(d.Findings, fmt.Sprintf("the token is for audience '%s' instead of '%s'", selected.claims.Audience, resource))
+		}
+	}
+	ctx.Log("event", "diagnosed managed identity", "findings", strings.Join(d.Findings, "; "), "tokenAcquired", d.TokenAcquired)
+	return d
+}
+
+// probe requests a token for resource, for the identity with the given client or object id, or else the default
+// identity of the VM. Only the claims of the token are returned.
+func probe(resource string, clientID string, objectID string) probeResult {
+	query := url.Values{"resource": {resource}}
+	if clientID != "" {
+		query.Set("client_id", clientID)
+	} else if objectID != "" {
+		query.Set("object_id", objectID)
+	}
+	req, err := http.NewRequest(http.MethodGet, tokenURL+"&"+query.Encode(), nil)
+	if err != nil {
+		return probeResult{err: err}
+	}
+	req.Header.Set("Metadata", "true")
+	requestheaders.Apply(req)
+
+	// IMDS must be reached directly, never through a proxy
+	client := &http.Client{Timeout: probeTimeout, Transport: &http.Transport{Proxy: nil}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return probeResult{err: err}
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		AccessToken      string `json:"access_token"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return probeResult{description: fmt.Sprintf("unexpected response with status code %d", resp.StatusCode)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return probeResult{description: fmt.Sprintf("%s (status code %d)", body.ErrorDescription, resp.StatusCode)}
+	}
+	claims, err := parseClaims(body.AccessToken)
+	if err != nil {
+		return probeResult{err: err}
+	}
+	return probeResult{claims: &claims}
+}
+
+// parseClaims decodes the claims of a JWT access token, without verifying it
+func parseClaims(token string) (tokenClaims, error) {
+	var claims tokenClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("the access token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return claims, errors.Wrap(err, "invalid access token payload")
+	}
+	return claims, errors.Wrap(json.Unmarshal(payload, &claims), "invalid access token claims")
+}
+
+// sameAudience returns whether the audience of a token is the resource it was requested for, which the tokens
+// report with or without a trailing slash
+func sameAudience(audience string, resource string) bool {
+	return strings.TrimSuffix(audience, "/") == strings.TrimSuffix(resource, "/")
+}
+
+// identityName returns the name of an identity from its resource ID
+func identityName(resourceID string) string {
+	return resourceID[strings.LastIndex(resourceID, "/")+1:]
+}
@@ -0,0 +1,139 @@
+package identitydiagnosis
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+const storageResource = "https://storage.azure.com/"
+
+func token(t *testing.T, claims tokenClaims) string {
+	payload, err := json.Marshal(claims)
+	require.Nil(t, err)
+	return "header." + base64.RawURLEncoding.EncodeToString(payload) + ".signature"
+}
+
+// fakeIMDS answers the token requests of the identities, by client id ("" for the default identity)
+func fakeIMDS(t *testing.T, tokens map[string]tokenClaims, defaultError string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "true", r.Header.Get("Metadata"))
+		require.Equal(t, storageResource, r.URL.Query().Get("resource"))
+		clientID := r.URL.Query().Get("client_id")
+		claims, ok := tokens[clientID]
+		if !ok {
+			description := identityNotFound
+			if clientID == "" && defaultError != "" {
+				description = defaultError
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_request", "error_description": description})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": token(t, claims)})
+	}))
+}
+
+func diagnose(t *testing.T, server *httptest.Server, mi *handlersettings.RunCommandManagedIdentity) Diagnosis {
+	defer func(url string) { tokenURL, diagnoses = url, make(map[diagnosisKey]Diagnosis) }(tokenURL)
+	tokenURL = server.URL + "/metadata/identity/oauth2/token?api-version=2018-02-01"
+	return Diagnose(log.NewContext(log.NewNopLogger()), mi, storageResource)
+}
+
+func Test_Diagnose_systemAssigned(t *testing.T) {
+	server := fakeIMDS(t, map[string]tokenClaims{"": {Audience: "https://storage.azure.com", ObjectID: "oid-1"}}, "")
+	defer server.Close()
+
+	d := diagnose(t, server, nil)
+	require.Equal(t, []string{"system-assigned identity available (object id oid-1)"}, d.Findings)
+	require.True(t, d.TokenAcquired)
+	require.Equal(t, "Managed identity diagnosis: system-assigned identity available (object id oid-1). The identity got a token for the storage account, make sure it has the 'Storage Blob Data Reader' role assignment on the container of the blob.",
+		d.String("Storage Blob Data Reader"))
+}
+
+func Test_Diagnose_userAssignedNotOnVM(t *testing.T) {
+	server := fakeIMDS(t, map[string]tokenClaims{}, "")
+	defer server.Close()
+
+	d := diagnose(t, server, &handlersettings.RunCommandManagedIdentity{ClientId: "client-1"})
+	require.Equal(t, []string{
+		"no system-assigned identity nor user-assigned identity is assigned to the VM",
+		"the user-assigned identity with client id client-1 is not assigned to the VM",
+	}, d.Findings)
+	require.False(t, d.TokenAcquired)
+}
+
+func Test_Diagnose_onlyUserAssigned(t *testing.T) {
+	claims := tokenClaims{Audience: storageResource, ClientID: "client-1",
+		ResourceID: "/subscriptions/s/resourcegroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/builder"}
+	server := fakeIMDS(t, map[string]tokenClaims{"": claims, "client-1": claims}, "")
+	defer server.Close()
+
+	d := diagnose(t, server, nil)
+	require.Equal(t, []string{"no system-assigned identity, the only user-assigned identity 'builder' (client id client-1) is used by default"}, d.Findings)
+	require.True(t, d.TokenAcquired)
+}
+
+func Test_Diagnose_severalUserAssigned(t *testing.T) {
+	server := fakeIMDS(t, map[string]tokenClaims{"client-1": {Audience: "https://management.azure.com/"}},
+		"Multiple user assigned identities exist, please specify the clientId / resourceId of the identity in the token request")
+	defer server.Close()
+
+	d := diagnose(t, server, &handlersettings.RunCommandManagedIdentity{ClientId: "client-1"})
+	require.Equal(t, []string{
+		"no system-assigned identity, several user-assigned identities are assigned to the VM and one must be selected by its client id or object id",
+		"user-assigned identity with client id client-1 available",
+		"the token is for audience 'https://management.azure.com/' instead of 'https://storage.azure.com/'",
+	}, d.Findings)
+	require.False(t, d.TokenAcquired)
+}
+
+func Test_Diagnose_unreachable(t *testing.T) {
+	server := fakeIMDS(t, nil, "")
+	server.Close()
+
+	d := diagnose(t, server, &handlersettings.RunCommandManagedIdentity{ClientId: "client-1"})
+	require.Len(t, d.Findings, 1)
+	require.Contains(t, d.Findings[0], "the managed identity endpoint (IMDS) is not reachable")
+	require.False(t, d.TokenAcquired)
+}
+
+func Test_Diagnose_probesOnce(t *testing.T) {
+	defer func(url string) { tokenURL, diagnoses = url, make(map[diagnosisKey]Diagnosis) }(tokenURL)
+	probes := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes++
+		json.NewEncoder(w).Encode(map[string]string{"access_token": token(t, tokenClaims{Audience: storageResource, ObjectID: "oid-1"})})
+	}))
+	defer server.Close()
+	tokenURL = server.URL + "/metadata/identity/oauth2/token?api-version=2018-02-01"
+	ctx := log.NewContext(log.NewNopLogger())
+
+	d := Diagnose(ctx, nil, storageResource)
+	require.True(t, d.TokenAcquired)
+	require.Equal(t, 1, probes)
+
+	// The diagnosis of the identity is reused
+	require.Equal(t, d, Diagnose(ctx, &handlersettings.RunCommandManagedIdentity{}, storageResource))
+	require.Equal(t, 1, probes)
+
+	// Another identity is probed
+	Diagnose(ctx, &handlersettings.RunCommandManagedIdentity{ClientId: "client-1"}, storageResource)
+	require.Equal(t, 3, probes)
+	Diagnose(ctx, &handlersettings.RunCommandManagedIdentity{ClientId: "client-1"}, storageResource)
+	require.Equal(t, 3, probes)
+}
+
+func Test_parseClaims(t *testing.T) {
+	_, err := parseClaims("opaque")
+	require.EqualError(t, err, "the access token is not a JWT")
+	claims, err := parseClaims(token(t, tokenClaims{Audience: storageResource, ObjectID: "oid-1"}))
+	require.Nil(t, err)
+	require.Equal(t, tokenClaims{Audience: storageResource, ObjectID: "oid-1"}, claims)
+}
@@ -1,6 +1,10 @@
+//go:build !slim
+
 package immediatecmds
 
 import (
+	"time"
+
 	"github.com/Azure/run-command-handler-linux/internal/constants"
 	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
 	"github.com/Azure/run-command-handler-linux/internal/service"
@@ -9,6 +13,15 @@ import (
 	"github.com/pkg/errors"
 )
 
+const (
+	// serviceStartTimeout bounds the time the upgraded service has to become active
+	serviceStartTimeout = 30 * time.Second
+
+	// serviceStabilizationPeriod is how long the upgraded service must stay active. It exceeds the RestartSec of
+	// the unit, so a service exiting right after it starts is noticed.
+	serviceStabilizationPeriod = 10 * time.Second
+)
+
 func Update(ctx *log.Context, h types.HandlerEnvironment, extName string, seqNum int) (int, error) {
 	ctx.Log("message", "updating immediate run command")
 	// parse the extension handler settings
@@ -25,16 +38,36 @@ func Update(ctx *log.Context, h types.HandlerEnvironment, extName string, seqNum
 		}
 
 		if isInstalled {
-			err = service.Register(ctx)
-			if err != nil {
-				return constants.ExitCode_UpgradeInstalledServiceFailed, errors.Wrap(err, "failed to upgrade run command service")
-			}
+			return upgradeService(ctx)
 		}
 	}
 
 	return constants.ExitCode_Okay, nil
 }
 
+// upgradeService registers the service of this version and validates that it starts. If it does not, the service
+// of the version being updated from is restored, so a failed update leaves the service running.
+func upgradeService(ctx *log.Context) (int, error) {
+	previousUnitConfig, err := service.GetUnitConfiguration(ctx)
+	if err != nil {
+		return constants.ExitCode_UpgradeInstalledServiceFailed, errors.Wrap(err, "failed to read the unit configuration of the installed run command service")
+	}
+
+	err = service.Register(ctx)
+	if err == nil {
+		err = service.WaitUntilActive(ctx, serviceStartTimeout, serviceStabilizationPeriod)
+	}
+	if err == nil {
+		return constants.ExitCode_Okay, nil
+	}
+
+	ctx.Log("event", "run command service failed to start after upgrade, rolling back", "error", err)
+	if rollbackErr := service.RestoreUnitConfiguration(ctx, previousUnitConfig); rollbackErr != nil {
+		return constants.ExitCode_UpdateRollbackFailed, errors.Wrapf(rollbackErr, "failed to upgrade run command service (%v) and failed to restore the service of the previous version", err)
+	}
+	return constants.ExitCode_UpgradeInstalledServiceFailed, errors.Wrap(err, "failed to upgrade run command service, the service of the previous version was restored")
+}
+
 func Disable(ctx *log.Context, h types.HandlerEnvironment, extName string, seqNum int) (int, error) {
 	// parse the extension handler settings
 	cfg, err := handlersettings.GetHandlerSettings(h.HandlerEnvironment.ConfigFolder, extName, seqNum, ctx)
@@ -0,0 +1,36 @@
+//go:build slim
+
+package immediatecmds
+
+import (
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// The slim handler is built without the run command service, so it has no service to install, upgrade or remove
+
+func Update(ctx *log.Context, h types.HandlerEnvironment, extName string, seqNum int) (int, error) {
+	return constants.ExitCode_Okay, nil
+}
+
+func Disable(ctx *log.Context, h types.HandlerEnvironment, extName string, seqNum int) (int, error) {
+	return constants.ExitCode_Okay, nil
+}
+
+func Install() (int, error) {
+	return constants.ExitCode_Okay, nil
+}
+
+func Uninstall(ctx *log.Context, h types.HandlerEnvironment, extName string, seqNum int) (int, error) {
+	return constants.ExitCode_Okay, nil
+}
+
+func Enable(ctx *log.Context, h types.HandlerEnvironment, extName string, seqNum int, cfg handlersettings.HandlerSettings) (int, error) {
+	if cfg.InstallAsService() {
+		return constants.ExitCode_InstallServiceFailed, errors.New("installAsService is not supported by this build of the handler, which does not include the run command service")
+	}
+	return constants.ExitCode_Okay, nil
+}
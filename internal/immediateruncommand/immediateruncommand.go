@@ -1,25 +1,78 @@
+//go:build !slim
+
 package immediateruncommand
 
 import (
 	"fmt"
 	"math"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/Azure/run-command-handler-linux/internal/cleanup"
+	"github.com/Azure/run-command-handler-linux/internal/clock"
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/exec"
+	"github.com/Azure/run-command-handler-linux/internal/featureflags"
 	"github.com/Azure/run-command-handler-linux/internal/goalstate"
 	"github.com/Azure/run-command-handler-linux/internal/hostgacommunicator"
+	"github.com/Azure/run-command-handler-linux/internal/instancemetadata"
+	"github.com/Azure/run-command-handler-linux/internal/multistep"
+	"github.com/Azure/run-command-handler-linux/internal/outputstream"
+	"github.com/Azure/run-command-handler-linux/internal/readiness"
+	"github.com/Azure/run-command-handler-linux/internal/reaper"
 	"github.com/Azure/run-command-handler-linux/internal/requesthelper"
+	"github.com/Azure/run-command-handler-linux/internal/scriptlibrary"
+	"github.com/Azure/run-command-handler-linux/internal/serviceconfig"
 	"github.com/Azure/run-command-handler-linux/internal/settings"
+	"github.com/Azure/run-command-handler-linux/internal/status"
+	"github.com/Azure/run-command-handler-linux/internal/telemetry"
+	"github.com/Azure/run-command-handler-linux/internal/triggerapi"
+	"github.com/Azure/run-command-handler-linux/internal/versioncheck"
+	"github.com/Azure/run-command-handler-linux/internal/writablestate"
 	"github.com/Azure/run-command-handler-linux/pkg/counterutil"
+	"github.com/Azure/run-command-handler-linux/pkg/loglevel"
+	"github.com/Azure/run-command-handler-linux/pkg/requestheaders"
+	"github.com/Azure/run-command-handler-linux/pkg/versionutil"
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 )
 
 const (
-	maxConcurrentTasks             int32 = 5
-	statePollingFrequencyInSeconds int32 = 60 // This should be almost immediate when creating a 'PENDING GET' to se the server as the HGAP server returns a response within 60 seconds
+	defaultMaxConcurrentTasks        int32 = 5
+	maxParallelism                         = 64
+	defaultReservedHighPrioritySlots int32 = 1
+	statePollingFrequencyInSeconds   int32 = 60 // This should be almost immediate when creating a 'PENDING GET' to se the server as the HGAP server returns a response within 60 seconds
+	maxPollingIntervalInSeconds            = 3600
+	defaultMaxBackoffInSeconds             = 240
+	defaultPollingBurstLimit               = 10 // polls in a minute
+	maxPollingBurstLimit                   = 600
+	burstWindow                            = time.Minute
+
+	// retentionInterval is how often the service applies the retention policies, which walk the executions of
+	// every run command
+	retentionInterval = time.Hour
 )
 
-var executingTasks counterutil.AtomicCount
+var (
+	// maxConcurrentTasks is the number of goal states executing at the same time, read from the configuration of
+	// the service
+	maxConcurrentTasks = defaultMaxConcurrentTasks
+
+	executingTasks               counterutil.AtomicCount
+	executingNormalPriorityTasks counterutil.AtomicCount
+
+	// serviceClock times the polls of the service and the expiry of the goal states and the output
+	serviceClock clock.Clock = clock.Real
+
+	// randomJitter returns the jitter added to a wait between two polls, in [0, n)
+	randomJitter = rand.New(rand.NewSource(time.Now().UnixNano())).Int63n
+)
 
 type VMSettingsRequestManager struct{}
 
@@ -27,22 +80,278 @@ func (*VMSettingsRequestManager) GetVMSettingsRequestManager(ctx *log.Context) (
 	return hostgacommunicator.GetVMSettingsRequestManager(ctx)
 }
 
-func StartImmediateRunCommand(ctx *log.Context) error {
+// StartImmediateRunCommand runs the service until it is stopped. flushLogs writes the logs still buffered by ctx
+// before the service exits.
+func StartImmediateRunCommand(ctx *log.Context, flushLogs func()) error {
+	// The configuration file sets the environment the service reads its configuration from, so it is loaded first
+	config := serviceconfig.NewLoader(constants.ServiceConfigPath)
+	loadServiceConfig(ctx, config)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	go func() { stopService(ctx, <-stop, flushLogs) }()
+
+	ctx = ctx.With("operationId", requestheaders.InitializeFromEnvironment(ctx))
 	ctx.Log("message", "starting immediate run command service")
-	communicator := hostgacommunicator.NewHostGACommunicator(new(VMSettingsRequestManager))
+	versioncheck.Report(ctx, versionutil.Version, telemetry.SendTelemetry(constants.RunCommandHandlerName, versionutil.Version))
+
+	// Creates the data dir, or routes the state to a writable location when it can't be written
+	if err := writablestate.Resolve(ctx); err != nil {
+		return errors.Wrap(err, "precondition failed")
+	}
+
+	// The events of the service carry the metadata of the VM, like those of the goal states it executes
+	instancemetadata.Report(ctx)
 
+	// The VMSettings are only downloaded and processed again when their ETag changed
+	communicator := hostgacommunicator.NewHostGACommunicatorWithETag(new(VMSettingsRequestManager), hostgacommunicator.GetETagPath(constants.DataDir), serviceClock)
+
+	journal, err := goalstate.LoadJournal(goalstate.GetJournalPath(constants.DataDir))
+	if err != nil {
+		// A corrupted journal should not stop the service. Start over with an empty one.
+		ctx.Log("warning", "could not load goal state journal. Starting with an empty journal", "error", err)
+	}
+
+	// Background processes left by the scripts are re-parented to the service, which must reap them
+	if err := reaper.Start(ctx); err != nil {
+		ctx.Log("warning", "orphaned processes of the scripts will not be reaped by the service", "error", err)
+	}
+
+	// Scripts can reference the scripts of the library by name instead of downloading them
+	scriptlibrary.Start(ctx)
+
+	// Stream the output of the scripts to local clients (e.g., logs --follow)
+	broker := outputstream.NewBroker()
+	exec.EnableOutputStreaming(broker)
+	go func() {
+		if err := outputstream.ListenAndServe(ctx, constants.ServiceSocketPath, broker); err != nil {
+			ctx.Log("warning", "script output will not be streamed", "error", err)
+		}
+	}()
+
+	// Dependent extensions and agents probe the last successful run of the extensions
+	go func() {
+		if err := readiness.ListenAndServe(ctx, constants.ReadinessSocketPath, constants.ReadinessDir); err != nil {
+			ctx.Log("warning", "the readiness markers will not be served", "error", err)
+		}
+	}()
+
+	// Other extensions and the agent submit run commands locally, launched with the goal states
+	local := newLocalQueue()
+	submit := func(s settings.SettingsCommon) error { return local.submit(journal, s) }
+	go func() {
+		if err := triggerapi.ListenAndServe(ctx, constants.TriggerSocketPath, triggerapi.NewHandler(ctx, submit, status.ImmediateStatus)); err != nil {
+			ctx.Log("warning", "run commands will not be submitted locally", "error", err)
+		}
+	}()
+
+	// The steps completed by the executions whose script rebooted the VM are kept in the journal
+	multistep.UseStore(journal)
+
+	// The executions whose script rebooted the VM resume before any new goal state
+	resumeAfterReboot(ctx, journal)
+
+	maxConcurrentTasks = getMaxConcurrentTasks(ctx)
+	reservedHighPrioritySlots := getReservedHighPrioritySlots(ctx)
+	pollingInterval := getPollingInterval(ctx)
+	pollingJitter := getPollingJitter(ctx)
+	pollingMaxBackoff := getPollingMaxBackoff(ctx)
+	limiter := newPollLimiter(serviceClock, getPollingBurstLimit(ctx))
+
+	// The services of the VMs of a scale set start together, the jitter spreads their first polls too
+	if pollingJitter > 0 {
+		wait := time.Duration(randomJitter(int64(pollingJitter)))
+		ctx.Log("message", fmt.Sprintf("sleep for %v before the first attempt", wait))
+		serviceClock.Sleep(wait)
+	}
+
+	// The handler is not invoked until the next goal state, the service deletes the executions the retention policies
+	// no longer keep meanwhile
+	go applyRetentionPolicies(ctx)
+
+	failures := 0
 	for {
-		err := processImmediateRunCommandGoalStates(ctx, communicator)
+		limiter.wait(ctx)
+		// Only the failures to fetch the goal states from HGAP back off the polls
+		err := processImmediateRunCommandGoalStates(ctx, communicator, journal, local, reservedHighPrioritySlots)
+		if isGoalStatesFetchError(err) {
+			failures++
+		} else {
+			failures = 0
+		}
 		if err != nil {
-			ctx.Log("error", errors.Wrapf(err, "could not process new immediate run command states"))
+			ctx.Log("error", errors.Wrapf(err, "could not process new immediate run command states"), "consecutiveFailures", failures)
 		}
 
-		ctx.Log("message", fmt.Sprintf("sleep for %v seconds before the next attempt", statePollingFrequencyInSeconds))
-		time.Sleep(time.Second * time.Duration(statePollingFrequencyInSeconds))
+		// The handler is not invoked until the next goal state, the service deletes the expired output meanwhile
+		cleanup.DeleteExpiredOutput(ctx, constants.DataDir, serviceClock.Now())
+
+		wait := pollingWait(pollingInterval, pollingMaxBackoff, failures)
+		if pollingJitter > 0 {
+			wait += time.Duration(randomJitter(int64(pollingJitter)))
+		}
+		ctx.Log("message", fmt.Sprintf("sleep for %v before the next attempt", wait))
+		select {
+		case <-serviceClock.After(wait):
+		case <-local.submitted:
+			ctx.Log("message", "launching the run commands submitted locally")
+		case <-reload:
+			// The executing goal states are not interrupted, the new configuration applies from the next poll
+			ctx.Log("message", "reloading the service configuration")
+			loadServiceConfig(ctx, config)
+			maxConcurrentTasks = getMaxConcurrentTasks(ctx)
+			reservedHighPrioritySlots = getReservedHighPrioritySlots(ctx)
+			pollingInterval = getPollingInterval(ctx)
+			pollingJitter = getPollingJitter(ctx)
+			pollingMaxBackoff = getPollingMaxBackoff(ctx)
+			limiter.limit = getPollingBurstLimit(ctx)
+		}
 	}
 }
 
-func processImmediateRunCommandGoalStates(ctx *log.Context, communicator hostgacommunicator.HostGACommunicator) error {
+// applyRetentionPolicies applies the retention policies once the service starts, then every retentionInterval
+func applyRetentionPolicies(ctx *log.Context) {
+	ticker := serviceClock.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	for {
+		cleanup.ApplyRetentionPolicies(ctx, constants.DataDir, serviceClock.Now())
+		<-ticker.C()
+	}
+}
+
+// loadServiceConfig applies the configuration file to the environment of the service and the configuration read
+// once from the environment (e.g., the log level)
+func loadServiceConfig(ctx *log.Context, config *serviceconfig.Loader) {
+	if variables, err := config.Load(); err != nil {
+		ctx.Log("warning", "the service configuration is unchanged", "path", constants.ServiceConfigPath, "error", err)
+	} else {
+		ctx.Log("message", "loaded the service configuration", "path", constants.ServiceConfigPath, "variables", strings.Join(variables, ","))
+	}
+	if err := loglevel.Set(os.Getenv(constants.ServiceLogLevelEnvName)); err != nil {
+		ctx.Log("warning", "the log level is unchanged", "error", err)
+	}
+	requestheaders.ReloadFromEnvironment(ctx)
+}
+
+// getPollingInterval reads how long the service waits between two polls for new goal states
+func getPollingInterval(ctx *log.Context) time.Duration {
+	interval := statePollingFrequencyInSeconds
+	if value := os.Getenv(constants.ServicePollingIntervalEnvName); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxPollingIntervalInSeconds {
+			ctx.Log("warning", fmt.Sprintf("invalid value %q for %v. Using default of %v", value, constants.ServicePollingIntervalEnvName, statePollingFrequencyInSeconds))
+		} else {
+			interval = int32(parsed)
+		}
+	}
+	return time.Duration(interval) * time.Second
+}
+
+// getPollingJitter reads how much longer, at most, the service waits at random between two polls
+func getPollingJitter(ctx *log.Context) time.Duration {
+	jitter := 0
+	if value := os.Getenv(constants.ServicePollingJitterEnvName); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 || parsed > maxPollingIntervalInSeconds {
+			ctx.Log("warning", fmt.Sprintf("invalid value %q for %v. Using default of %v", value, constants.ServicePollingJitterEnvName, 0))
+		} else {
+			jitter = parsed
+		}
+	}
+	return time.Duration(jitter) * time.Second
+}
+
+// getPollingMaxBackoff reads how long, at most, the service waits between two polls once they keep failing
+func getPollingMaxBackoff(ctx *log.Context) time.Duration {
+	backoff := defaultMaxBackoffInSeconds
+	if value := os.Getenv(constants.ServicePollingMaxBackoffEnvName); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxPollingIntervalInSeconds {
+			ctx.Log("warning", fmt.Sprintf("invalid value %q for %v. Using default of %v", value, constants.ServicePollingMaxBackoffEnvName, defaultMaxBackoffInSeconds))
+		} else {
+			backoff = parsed
+		}
+	}
+	return time.Duration(backoff) * time.Second
+}
+
+// pollingWait returns the wait before the next poll after the given number of consecutive failed polls: the polling
+// interval, doubled with every failure up to the maximum backoff. A maximum backoff shorter than the interval doesn't
+// shorten it.
+func pollingWait(interval, maxBackoff time.Duration, failures int) time.Duration {
+	wait := interval
+	for i := 0; i < failures && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff && maxBackoff > interval {
+		return maxBackoff
+	}
+	return wait
+}
+
+// getPollingBurstLimit reads the most polls for new goal states the service makes in a minute
+func getPollingBurstLimit(ctx *log.Context) int {
+	limit := defaultPollingBurstLimit
+	if value := os.Getenv(constants.ServicePollingBurstLimitEnvName); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxPollingBurstLimit {
+			ctx.Log("warning", fmt.Sprintf("invalid value %q for %v. Using default of %v", value, constants.ServicePollingBurstLimitEnvName, defaultPollingBurstLimit))
+		} else {
+			limit = parsed
+		}
+	}
+	return limit
+}
+
+// pollLimiter bounds the polls in any window of a minute, which the waits between them don't when they are short or
+// interrupted (e.g., by reloading the configuration)
+type pollLimiter struct {
+	clock clock.Clock
+	limit int
+	// polls are the times of the polls of the last window, oldest first
+	polls []time.Time
+}
+
+func newPollLimiter(clk clock.Clock, limit int) *pollLimiter {
+	return &pollLimiter{clock: clk, limit: limit}
+}
+
+// wait blocks until a poll is within the limit, and records it
+func (l *pollLimiter) wait(ctx *log.Context) {
+	now := l.clock.Now()
+	l.expire(now)
+	if len(l.polls) >= l.limit {
+		delay := l.polls[len(l.polls)-l.limit].Add(burstWindow).Sub(now)
+		ctx.Log("warning", fmt.Sprintf("%v polls in the last minute, delaying the next one by %v", len(l.polls), delay))
+		l.clock.Sleep(delay)
+		now = l.clock.Now()
+		l.expire(now)
+	}
+	l.polls = append(l.polls, now)
+}
+
+// expire forgets the polls out of the window ending at now
+func (l *pollLimiter) expire(now time.Time) {
+	i := 0
+	for i < len(l.polls) && !now.Before(l.polls[i].Add(burstWindow)) {
+		i++
+	}
+	l.polls = l.polls[i:]
+}
+
+// goalStatesFetchError is the failure to fetch the goal states from HGAP
+type goalStatesFetchError struct {
+	error
+}
+
+// isGoalStatesFetchError returns whether err was caused by a failure to fetch the goal states from HGAP
+func isGoalStatesFetchError(err error) bool {
+	var fetchErr *goalStatesFetchError
+	return errors.As(err, &fetchErr)
+}
+
+func processImmediateRunCommandGoalStates(ctx *log.Context, communicator *hostgacommunicator.HostGACommunicator, journal *goalstate.Journal, local *localQueue, reservedHighPrioritySlots int32) error {
 	maxTasksToFetch := int(math.Max(float64(maxConcurrentTasks-executingTasks.Get()), 0))
 	ctx.Log("message", fmt.Sprintf("concurrent tasks: %v out of max %v", executingTasks.Get(), maxConcurrentTasks))
 	if maxTasksToFetch == 0 {
@@ -50,42 +359,85 @@ func processImmediateRunCommandGoalStates(ctx *log.Context, communicator hostgac
 		return nil
 	}
 
-	goalStates, err := goalstate.GetImmediateRunCommandGoalStates(ctx, &communicator)
-	if err != nil {
-		return errors.Wrapf(err, "could not retrieve goal states for immediate run command")
+	// The run commands submitted locally are launched even when HGAP can't be reached
+	goalStates, fetchErr := goalstate.GetImmediateRunCommandGoalStates(ctx, communicator)
+	notModified := hostgacommunicator.IsNotModified(fetchErr)
+	if notModified {
+		ctx.Log("message", "the goal states were not modified since they were processed")
+		fetchErr = nil
+	} else if fetchErr != nil {
+		fetchErr = &goalStatesFetchError{errors.Wrapf(fetchErr, "could not retrieve goal states for immediate run command")}
 	}
 
-	var newGoalStates []settings.SettingsCommon
+	var candidateGoalStates []settings.SettingsCommon
+	featureFlags := make(map[string]bool)
+	invalidSignatures := false
 	for _, el := range goalStates {
 		validSignature, err := el.ValidateSignature()
 		if err != nil {
 			return errors.Wrap(err, "failed to validate goal state signature")
 		}
 
-		if validSignature {
+		if !validSignature {
+			// The certificate may not be there yet, the goal state is validated again on the next poll
+			invalidSignatures = true
+		} else {
+			for name, enabled := range el.FeatureFlags {
+				featureFlags[name] = enabled
+			}
 			for _, s := range el.Settings {
-				if len(newGoalStates) < maxTasksToFetch {
-					newGoalStates = append(newGoalStates, s)
+				if s.ExtensionName == nil || s.SeqNo == nil {
+					ctx.Log("warning", "skipping goal state without extension name or sequence number")
+					continue
+				}
+
+				if s.IsLocal() {
+					ctx.Log("warning", fmt.Sprintf("skipping goal state %v, its name is reserved for the run commands submitted locally", *s.ExtensionName))
+					continue
+				}
+
+				if journal.Contains(s) {
+					ctx.Log("message", fmt.Sprintf("goal state %v with seqNo %v was already executed. Skipping duplicate", *s.ExtensionName, *s.SeqNo))
+					continue
 				}
+
+				if expired(ctx, s, journal, serviceClock.Now()) {
+					continue
+				}
+
+				candidateGoalStates = append(candidateGoalStates, s)
 			}
 		}
 	}
 
+	// The goal state of every poll is authoritative, the flags it no longer sets go back to their defaults. An
+	// unmodified goal state sets the same flags.
+	if fetchErr == nil && !notModified {
+		featureflags.SetGoalStateOverrides(ctx, featureFlags)
+		// The goal state may enable the metadata of the VM
+		instancemetadata.Report(ctx)
+	}
+
+	localRequests := takeLocalRequests(ctx, local, journal)
+	newGoalStates := selectGoalStatesToLaunch(append(candidateGoalStates, localRequests...), executingTasks.Get(), executingNormalPriorityTasks.Get(), reservedHighPrioritySlots)
+
+	var launched []settings.SettingsCommon
 	if len(newGoalStates) > 0 {
 		ctx.Log("message", fmt.Sprintf("trying to launch %v goal states concurrently", len(newGoalStates)))
 
 		for idx := range newGoalStates {
-			go func(state settings.SettingsCommon) {
-				ctx.Log("message", "launching new goal state. Incrementing executing tasks counter")
-				executingTasks.Increment()
-				err := goalstate.HandleImmediateGoalState(ctx, state)
-				ctx.Log("message", "goal state has exited. Decrementing executing tasks counter")
-				executingTasks.Decrement()
-
-				if err != nil {
-					ctx.Log("error", "failed to execute goal state", "message", err)
-				}
-			}(newGoalStates[idx])
+			if !executions.start() {
+				ctx.Log("message", "the service is stopping or rebooting the VM, the goal states not launched yet are launched once it starts again")
+				break
+			}
+
+			// Record the goal state before launching it so it is not executed again if HGAP re-delivers it
+			if err := journal.Add(newGoalStates[idx]); err != nil {
+				ctx.Log("warning", "failed to record goal state in the journal", "error", err)
+			}
+
+			launchGoalState(ctx, journal, newGoalStates[idx])
+			launched = append(launched, newGoalStates[idx])
 		}
 
 		ctx.Log("message", "finished launching goal states")
@@ -93,5 +445,196 @@ func processImmediateRunCommandGoalStates(ctx *log.Context, communicator hostgac
 		ctx.Log("message", "no new goal states were found in this iteration")
 	}
 
-	return nil
+	// The goal states are returned again until they are all launched, e.g., once an execution slot is free
+	local.requeue(notLaunched(localRequests, launched))
+	if fetchErr == nil && !notModified && !invalidSignatures && len(notLaunched(candidateGoalStates, launched)) == 0 {
+		if err := communicator.AcknowledgeVMSettings(ctx); err != nil {
+			ctx.Log("warning", "the goal states will be processed again on the next poll", "error", err)
+		}
+	}
+
+	return fetchErr
+}
+
+// takeLocalRequests returns the run commands submitted locally that are neither executed nor expired
+func takeLocalRequests(ctx *log.Context, local *localQueue, journal *goalstate.Journal) []settings.SettingsCommon {
+	var candidates []settings.SettingsCommon
+	for _, s := range local.take() {
+		if journal.Contains(s) {
+			ctx.Log("message", fmt.Sprintf("run command %v with seqNo %v submitted locally was already executed. Skipping duplicate", *s.ExtensionName, *s.SeqNo))
+			continue
+		}
+		if expired(ctx, s, journal, serviceClock.Now()) {
+			continue
+		}
+		candidates = append(candidates, s)
+	}
+	return candidates
+}
+
+// notLaunched returns the goal states of candidates missing from launched
+func notLaunched(candidates []settings.SettingsCommon, launched []settings.SettingsCommon) []settings.SettingsCommon {
+	var result []settings.SettingsCommon
+	for _, c := range candidates {
+		found := false
+		for _, l := range launched {
+			if *c.ExtensionName == *l.ExtensionName && *c.SeqNo == *l.SeqNo {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// expired reports the goal state as expired if it was not started before its expiration time, e.g., because the
+// service was down or all the execution slots were taken. An expired goal state is recorded in the journal so it is
+// reported once.
+func expired(ctx *log.Context, s settings.SettingsCommon, journal *goalstate.Journal, now time.Time) bool {
+	expiry, ok, err := s.Expiry()
+	if err != nil {
+		ctx.Log("warning", fmt.Sprintf("goal state %v with seqNo %v is executed without expiration", *s.ExtensionName, *s.SeqNo), "error", err)
+		return false
+	}
+	if !ok || now.Before(expiry) {
+		return false
+	}
+
+	ctx.Log("message", fmt.Sprintf("goal state %v with seqNo %v expired at %v. Skipping execution", *s.ExtensionName, *s.SeqNo, s.ExpirationTime))
+	if err := journal.Add(s); err != nil {
+		ctx.Log("warning", "failed to record goal state in the journal", "error", err)
+	}
+	if err := goalstate.ReportExpiredGoalState(ctx, s, expiry); err != nil {
+		ctx.Log("error", "failed to report the expired goal state", "message", err)
+	}
+	return true
+}
+
+// launchGoalState executes the goal state in the background, registered with executions.start. A goal state whose
+// script requests a reboot is recorded in the journal to resume once the VM boots.
+func launchGoalState(ctx *log.Context, journal *goalstate.Journal, state settings.SettingsCommon) {
+	// Counters are incremented before launching so the next iteration sees the slots as taken
+	ctx.Log("message", "launching new goal state. Incrementing executing tasks counter", "highPriority", state.IsHighPriority())
+	executingTasks.Increment()
+	if !state.IsHighPriority() {
+		executingNormalPriorityTasks.Increment()
+	}
+
+	go func() {
+		err := goalstate.HandleImmediateGoalState(ctx, state)
+		ctx.Log("message", "goal state has exited. Decrementing executing tasks counter")
+		executingTasks.Decrement()
+		if !state.IsHighPriority() {
+			executingNormalPriorityTasks.Decrement()
+		}
+
+		pending, rebootPending := multistep.IsRebootPending(err)
+		if rebootPending {
+			if err := journal.MarkRebootPending(state, pending.Step+1); err != nil {
+				ctx.Log("error", "the execution will not resume after the reboot", "message", err)
+				rebootPending = false
+			}
+		} else if err != nil {
+			ctx.Log("error", "failed to execute goal state", "message", err)
+		}
+
+		// The execution is done before the VM reboots, which waits for the other ones
+		executions.done()
+		if rebootPending {
+			rebootVM(ctx)
+		}
+	}()
+}
+
+// resumeAfterReboot launches the goal states whose script requested a reboot, at their next step
+func resumeAfterReboot(ctx *log.Context, journal *goalstate.Journal) {
+	pending, err := journal.TakeRebootPending()
+	if err != nil {
+		ctx.Log("warning", "the goal states resumed after the reboot may resume again after the next one", "error", err)
+	}
+	for _, e := range pending {
+		if !executions.start() {
+			if err := journal.MarkRebootPending(*e.Settings, e.ResumeStep); err != nil {
+				ctx.Log("error", "the execution will not resume after the reboot", "message", err)
+			}
+			continue
+		}
+		ctx.Log("message", fmt.Sprintf("resuming goal state %v with seqNo %v at step %v after the reboot", e.ExtensionName, e.SeqNo, e.ResumeStep))
+		launchGoalState(ctx, journal, *e.Settings)
+	}
+}
+
+// selectGoalStatesToLaunch picks the goal states that fit into the available execution slots. High priority
+// goal states go first and can use any free slot, while normal priority goal states cannot use the slots
+// reserved for high priority ones.
+func selectGoalStatesToLaunch(candidates []settings.SettingsCommon, executing int32, executingNormalPriority int32, reservedHighPrioritySlots int32) []settings.SettingsCommon {
+	available := maxConcurrentTasks - executing
+	availableNormalPriority := int32(math.Min(float64(maxConcurrentTasks-reservedHighPrioritySlots-executingNormalPriority), float64(available)))
+
+	sorted := make([]settings.SettingsCommon, len(candidates))
+	copy(sorted, candidates)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].IsHighPriority() && !sorted[j].IsHighPriority()
+	})
+
+	var result []settings.SettingsCommon
+	for _, s := range sorted {
+		if available <= 0 {
+			break
+		}
+
+		if s.IsHighPriority() {
+			result = append(result, s)
+			available--
+			availableNormalPriority = int32(math.Min(float64(availableNormalPriority), float64(available)))
+		} else if availableNormalPriority > 0 {
+			result = append(result, s)
+			available--
+			availableNormalPriority--
+		}
+	}
+
+	return result
+}
+
+// getMaxConcurrentTasks reads the number of goal states the service executes at the same time. A goal state running
+// long doesn't delay the others, up to this many.
+func getMaxConcurrentTasks(ctx *log.Context) int32 {
+	max := defaultMaxConcurrentTasks
+	if value := os.Getenv(constants.ServiceMaxParallelismEnvName); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxParallelism {
+			ctx.Log("warning", fmt.Sprintf("invalid value %q for %v. Using default of %v", value, constants.ServiceMaxParallelismEnvName, defaultMaxConcurrentTasks))
+		} else {
+			max = int32(parsed)
+		}
+	}
+
+	ctx.Log("message", fmt.Sprintf("goal states executing at the same time: %v", max))
+	return max
+}
+
+// getReservedHighPrioritySlots reads the number of execution slots reserved for high priority goal states. At least
+// one slot is left to the normal priority goal states.
+func getReservedHighPrioritySlots(ctx *log.Context) int32 {
+	defaultReserved := defaultReservedHighPrioritySlots
+	if defaultReserved >= maxConcurrentTasks {
+		defaultReserved = maxConcurrentTasks - 1
+	}
+
+	reserved := defaultReserved
+	if value := os.Getenv(constants.ReservedHighPrioritySlotsEnvName); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 || int32(parsed) >= maxConcurrentTasks {
+			ctx.Log("warning", fmt.Sprintf("invalid value %q for %v. Using default of %v", value, constants.ReservedHighPrioritySlotsEnvName, defaultReserved))
+		} else {
+			reserved = int32(parsed)
+		}
+	}
+
+	ctx.Log("message", fmt.Sprintf("execution slots reserved for high priority goal states: %v", reserved))
+	return reserved
 }
@@ -0,0 +1,216 @@
+//go:build !slim
+
+package immediateruncommand
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/clock"
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/goalstate"
+	"github.com/Azure/run-command-handler-linux/internal/settings"
+	"github.com/Azure/run-command-handler-linux/internal/triggerapi"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestGoalState(extensionName string, priority string) settings.SettingsCommon {
+	seqNo := 0
+	return settings.SettingsCommon{ExtensionName: &extensionName, SeqNo: &seqNo, Priority: priority}
+}
+
+func Test_SelectGoalStatesKeepsReservedSlotsForHighPriority(t *testing.T) {
+	candidates := []settings.SettingsCommon{
+		newTestGoalState("normal1", ""),
+		newTestGoalState("normal2", settings.NormalPriority),
+		newTestGoalState("normal3", ""),
+		newTestGoalState("normal4", ""),
+		newTestGoalState("normal5", ""),
+	}
+
+	selected := selectGoalStatesToLaunch(candidates, 0, 0, 1)
+	require.Equal(t, 4, len(selected))
+
+	// Only the reserved slot is free: normal priority goal states must wait
+	selected = selectGoalStatesToLaunch(candidates, 4, 4, 1)
+	require.Equal(t, 0, len(selected))
+}
+
+func Test_SelectGoalStatesLaunchesHighPriorityFirst(t *testing.T) {
+	candidates := []settings.SettingsCommon{
+		newTestGoalState("normal1", ""),
+		newTestGoalState("diagnostic1", "High"),
+		newTestGoalState("normal2", ""),
+		newTestGoalState("diagnostic2", settings.HighPriority),
+	}
+
+	selected := selectGoalStatesToLaunch(candidates, 3, 3, 1)
+	require.Equal(t, 2, len(selected))
+	require.Equal(t, "diagnostic1", *selected[0].ExtensionName)
+	require.Equal(t, "diagnostic2", *selected[1].ExtensionName)
+
+	selected = selectGoalStatesToLaunch(candidates, 5, 4, 1)
+	require.Equal(t, 0, len(selected))
+}
+
+func Test_getMaxConcurrentTasks(t *testing.T) {
+	defer func(max int32) { maxConcurrentTasks = max }(maxConcurrentTasks)
+	ctx := log.NewContext(log.NewNopLogger())
+	require.Equal(t, int32(5), getMaxConcurrentTasks(ctx))
+
+	t.Setenv(constants.ServiceMaxParallelismEnvName, "65")
+	require.Equal(t, int32(5), getMaxConcurrentTasks(ctx))
+
+	t.Setenv(constants.ServiceMaxParallelismEnvName, "10")
+	maxConcurrentTasks = getMaxConcurrentTasks(ctx)
+	require.Equal(t, int32(10), maxConcurrentTasks)
+	candidates := make([]settings.SettingsCommon, 12)
+	for i := range candidates {
+		candidates[i] = newTestGoalState(fmt.Sprintf("normal%d", i), "")
+	}
+	require.Len(t, selectGoalStatesToLaunch(candidates, 0, 0, getReservedHighPrioritySlots(ctx)), 9)
+
+	// A single goal state at a time leaves no slot to reserve for the high priority ones
+	t.Setenv(constants.ServiceMaxParallelismEnvName, "1")
+	maxConcurrentTasks = getMaxConcurrentTasks(ctx)
+	require.Equal(t, int32(0), getReservedHighPrioritySlots(ctx))
+	require.Len(t, selectGoalStatesToLaunch(candidates, 0, 0, getReservedHighPrioritySlots(ctx)), 1)
+}
+
+func Test_getPollingInterval(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	require.Equal(t, 60*time.Second, getPollingInterval(ctx))
+
+	t.Setenv(constants.ServicePollingIntervalEnvName, "5")
+	require.Equal(t, 5*time.Second, getPollingInterval(ctx))
+
+	t.Setenv(constants.ServicePollingIntervalEnvName, "0")
+	require.Equal(t, 60*time.Second, getPollingInterval(ctx))
+}
+
+func Test_getPollingJitterAndBurstLimit(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	require.Equal(t, time.Duration(0), getPollingJitter(ctx))
+	require.Equal(t, 10, getPollingBurstLimit(ctx))
+
+	t.Setenv(constants.ServicePollingJitterEnvName, "15")
+	t.Setenv(constants.ServicePollingBurstLimitEnvName, "120")
+	require.Equal(t, 15*time.Second, getPollingJitter(ctx))
+	require.Equal(t, 120, getPollingBurstLimit(ctx))
+
+	t.Setenv(constants.ServicePollingJitterEnvName, "-1")
+	t.Setenv(constants.ServicePollingBurstLimitEnvName, "0")
+	require.Equal(t, time.Duration(0), getPollingJitter(ctx))
+	require.Equal(t, 10, getPollingBurstLimit(ctx))
+}
+
+func Test_getPollingMaxBackoff(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	require.Equal(t, 4*time.Minute, getPollingMaxBackoff(ctx))
+
+	t.Setenv(constants.ServicePollingMaxBackoffEnvName, "300")
+	require.Equal(t, 5*time.Minute, getPollingMaxBackoff(ctx))
+
+	t.Setenv(constants.ServicePollingMaxBackoffEnvName, "3601")
+	require.Equal(t, 4*time.Minute, getPollingMaxBackoff(ctx))
+}
+
+func Test_isGoalStatesFetchError(t *testing.T) {
+	require.True(t, isGoalStatesFetchError(errors.Wrap(&goalStatesFetchError{errors.New("timeout")}, "wrapped")))
+	require.False(t, isGoalStatesFetchError(errors.New("failed to validate goal state signature")))
+	require.False(t, isGoalStatesFetchError(nil))
+}
+
+func Test_pollingWait(t *testing.T) {
+	interval, maxBackoff := time.Minute, 5*time.Minute
+	require.Equal(t, time.Minute, pollingWait(interval, maxBackoff, 0))
+	require.Equal(t, 2*time.Minute, pollingWait(interval, maxBackoff, 1))
+	require.Equal(t, 4*time.Minute, pollingWait(interval, maxBackoff, 2))
+	require.Equal(t, 5*time.Minute, pollingWait(interval, maxBackoff, 3))
+	require.Equal(t, 5*time.Minute, pollingWait(interval, maxBackoff, 1000))
+
+	// A maximum backoff shorter than the interval doesn't shorten it
+	require.Equal(t, time.Minute, pollingWait(interval, 30*time.Second, 3))
+}
+
+func Test_pollLimiter(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	clk := clock.NewFake(start)
+	limiter := newPollLimiter(clk, 2)
+
+	limiter.wait(ctx)
+	clk.Advance(10 * time.Second)
+	limiter.wait(ctx)
+
+	// The third poll waits for the first one to leave the window
+	done := make(chan struct{})
+	go func() {
+		limiter.wait(ctx)
+		close(done)
+	}()
+	clk.WaitForWaiters(1)
+	clk.Advance(49 * time.Second)
+	select {
+	case <-done:
+		t.Fatal("the poll was not delayed")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clk.Advance(time.Second)
+	<-done
+	require.Equal(t, []time.Time{start.Add(10 * time.Second), start.Add(time.Minute)}, limiter.polls)
+}
+
+func Test_expiredOnlyPastExpirationTime(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	journal, err := goalstate.LoadJournal(goalstate.GetJournalPath(t.TempDir()))
+	require.Nil(t, err)
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	s := newTestGoalState("rc1", "")
+	require.False(t, expired(ctx, s, journal, now), "without an expiration time")
+
+	s.ExpirationTime = "2026-01-02T03:05:00Z"
+	require.False(t, expired(ctx, s, journal, now), "before the expiration time")
+
+	s.ExpirationTime = "not a time"
+	require.False(t, expired(ctx, s, journal, now), "an invalid expiration time is ignored")
+	require.False(t, journal.Contains(s))
+}
+
+func Test_localQueue(t *testing.T) {
+	journal, err := goalstate.LoadJournal(goalstate.GetJournalPath(t.TempDir()))
+	require.Nil(t, err)
+	q := newLocalQueue()
+
+	rc1, rc2 := newTestGoalState("rc1", ""), newTestGoalState("rc2", "")
+	require.Nil(t, q.submit(journal, rc1))
+	require.Equal(t, triggerapi.ErrDuplicate, q.submit(journal, rc1), "already queued")
+	require.Nil(t, q.submit(journal, rc2))
+	select {
+	case <-q.submitted:
+	default:
+		require.Fail(t, "the submission must wake the service up")
+	}
+
+	// The run commands not launched are kept ahead of those submitted since
+	taken := q.take()
+	require.Equal(t, []settings.SettingsCommon{rc1, rc2}, taken)
+	rc3 := newTestGoalState("rc3", "")
+	require.Nil(t, q.submit(journal, rc3))
+	q.requeue(notLaunched(taken, []settings.SettingsCommon{rc1}))
+	require.Equal(t, []settings.SettingsCommon{rc2, rc3}, q.take())
+
+	require.Nil(t, journal.Add(rc1))
+	require.Equal(t, triggerapi.ErrDuplicate, q.submit(journal, rc1), "already executed")
+
+	for i := 0; i < maxQueuedLocalRequests; i++ {
+		s := newTestGoalState("rc", "")
+		*s.SeqNo = i
+		require.Nil(t, q.submit(journal, s))
+	}
+	require.Equal(t, triggerapi.ErrQueueFull, q.submit(journal, rc2))
+}
@@ -0,0 +1,71 @@
+//go:build !slim
+
+package immediateruncommand
+
+import (
+	"sync"
+
+	"github.com/Azure/run-command-handler-linux/internal/goalstate"
+	"github.com/Azure/run-command-handler-linux/internal/settings"
+	"github.com/Azure/run-command-handler-linux/internal/triggerapi"
+)
+
+// maxQueuedLocalRequests bounds the run commands submitted on the trigger socket waiting for an execution slot
+const maxQueuedLocalRequests = 100
+
+// localQueue holds the run commands submitted on the trigger socket until a poll launches them. Unlike the goal
+// states, they are not delivered again, so those not launched for lack of a slot stay queued for the next poll.
+type localQueue struct {
+	mutex   sync.Mutex
+	pending []settings.SettingsCommon
+
+	// submitted wakes the service up to launch the submitted run commands without waiting for the next poll
+	submitted chan struct{}
+}
+
+func newLocalQueue() *localQueue {
+	return &localQueue{submitted: make(chan struct{}, 1)}
+}
+
+// submit queues the run command unless it was already executed or queued
+func (q *localQueue) submit(journal *goalstate.Journal, s settings.SettingsCommon) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if journal.Contains(s) {
+		return triggerapi.ErrDuplicate
+	}
+	for _, p := range q.pending {
+		if *p.ExtensionName == *s.ExtensionName && *p.SeqNo == *s.SeqNo {
+			return triggerapi.ErrDuplicate
+		}
+	}
+	if len(q.pending) >= maxQueuedLocalRequests {
+		return triggerapi.ErrQueueFull
+	}
+
+	q.pending = append(q.pending, s)
+	select {
+	case q.submitted <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// take empties the queue, returning the run commands it held oldest first
+func (q *localQueue) take() []settings.SettingsCommon {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	pending := q.pending
+	q.pending = nil
+	return pending
+}
+
+// requeue puts the run commands taken but not launched back, ahead of those submitted since
+func (q *localQueue) requeue(notLaunched []settings.SettingsCommon) {
+	if len(notLaunched) == 0 {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.pending = append(append([]settings.SettingsCommon{}, notLaunched...), q.pending...)
+}
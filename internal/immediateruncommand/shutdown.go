@@ -0,0 +1,130 @@
+//go:build !slim
+
+package immediateruncommand
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/multistep"
+	"github.com/Azure/run-command-handler-linux/internal/pid"
+	"github.com/Azure/run-command-handler-linux/internal/telemetry"
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	// stopGracePeriod is how long the scripts have to exit once the service is stopping, before they are killed
+	stopGracePeriod = 10 * time.Second
+
+	// stopReportTimeout is how long the service waits for the executions of the scripts to report their status once
+	// they exited. With stopGracePeriod, it is well within the 90 seconds systemd waits for the service to stop.
+	stopReportTimeout = 30 * time.Second
+
+	// rebootWaitInterval is how often the service logs that it still waits for the executions in progress before
+	// rebooting the VM
+	rebootWaitInterval = time.Minute
+)
+
+// executions are the goal states executing in the background, which report their status before the service stops
+var executions executionTracker
+
+// executionTracker tracks the executions launched by the service until it stops launching them
+type executionTracker struct {
+	mutex     sync.Mutex
+	running   sync.WaitGroup
+	stopping  bool
+	rebooting bool
+}
+
+// start registers an execution about to be launched, which must call done once it reported its status. It returns
+// false once the service is stopping or rebooting the VM: the goal state is left to the next start of the service.
+func (t *executionTracker) start() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.stopping || t.rebooting {
+		return false
+	}
+	t.running.Add(1)
+	return true
+}
+
+func (t *executionTracker) done() {
+	t.running.Done()
+}
+
+// halt stops launching executions
+func (t *executionTracker) halt() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.stopping = true
+}
+
+// pauseForReboot stops launching executions until resume is called, as the VM is about to reboot. It returns false if
+// they are already paused for another reboot.
+func (t *executionTracker) pauseForReboot() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.rebooting {
+		return false
+	}
+	t.rebooting = true
+	return true
+}
+
+// resume launches executions again once the VM failed to reboot
+func (t *executionTracker) resume() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.rebooting = false
+}
+
+// wait waits up to timeout for the running executions. It returns false if some of them are still running.
+func (t *executionTracker) wait(timeout time.Duration) bool {
+	stopped := make(chan struct{})
+	go func() {
+		t.running.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// rebootVM reboots the VM as requested by a script once the other executions reported their status, so the reboot
+// doesn't kill their scripts. No execution is launched in the meantime. The executions requesting a reboot while the
+// VM is about to reboot resume along with the first one once it boots.
+func rebootVM(ctx *log.Context) {
+	if !executions.pauseForReboot() {
+		ctx.Log("message", "the VM is already about to reboot as requested by another script")
+		return
+	}
+	for !executions.wait(rebootWaitInterval) {
+		ctx.Log("message", "waiting for the executions in progress to complete before rebooting the VM")
+	}
+	if err := multistep.Reboot(ctx); err != nil {
+		ctx.Log("error", "failed to reboot the VM, the executions resume once the service restarts", "message", err)
+		executions.resume()
+	}
+}
+
+// stopService stops the service gracefully on SIGTERM: no goal state is launched anymore, the scripts executing are
+// terminated, and their executions report them as failed rather than leaving them transitioning. The telemetry
+// events are written in the background, the queued ones are written before the service exits, as are the summaries
+// of the duplicate logs flushed by flushLogs.
+func stopService(ctx *log.Context, sig os.Signal, flushLogs func()) {
+	ctx.Log("message", "stopping immediate run command service", "signal", sig)
+	executions.halt()
+	pid.TerminateScripts(ctx, os.Getpid(), stopGracePeriod)
+	if !executions.wait(stopReportTimeout) {
+		ctx.Log("warning", "some executions did not report their status before the service stopped")
+	}
+	if err := telemetry.Flush(telemetry.FlushTimeout); err != nil {
+		ctx.Log("warning", "some telemetry events may be lost", "error", err)
+	}
+	flushLogs()
+	os.Exit(0)
+}
@@ -0,0 +1,39 @@
+//go:build !slim
+
+package immediateruncommand
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_executionTracker(t *testing.T) {
+	var tracker executionTracker
+	require.True(t, tracker.start())
+	require.False(t, tracker.wait(10*time.Millisecond), "the execution is running")
+
+	tracker.halt()
+	require.False(t, tracker.start(), "no execution is launched once the service is stopping")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		tracker.done()
+	}()
+	require.True(t, tracker.wait(time.Minute))
+}
+
+func Test_executionTrackerPausedForReboot(t *testing.T) {
+	var tracker executionTracker
+	require.True(t, tracker.start())
+	require.True(t, tracker.pauseForReboot())
+	require.False(t, tracker.pauseForReboot(), "the VM is already about to reboot")
+	require.False(t, tracker.start(), "no execution is launched while the VM is about to reboot")
+	require.False(t, tracker.wait(10*time.Millisecond), "the reboot waits for the execution in progress")
+
+	tracker.done()
+	require.True(t, tracker.wait(time.Minute))
+	tracker.resume()
+	require.True(t, tracker.start(), "the executions are launched again once the VM failed to reboot")
+	tracker.done()
+}
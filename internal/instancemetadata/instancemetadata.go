@@ -0,0 +1,147 @@
+// Package instancemetadata queries the metadata of the VM from the Instance Metadata Service (IMDS), so the
+// outcomes of the run commands can be correlated across a fleet (e.g., by resource group or zone).
+package instancemetadata
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/featureflags"
+	"github.com/Azure/run-command-handler-linux/internal/telemetry"
+	"github.com/Azure/run-command-handler-linux/pkg/requestheaders"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// queryTimeout bounds the query, IMDS is local to the host and answers quickly when available
+	queryTimeout = 2 * time.Second
+
+	// scaleSetSegment and scaleSetVMSegment are found in the resource ID of a VM of a scale set in uniform
+	// orchestration mode, where scaleSetVMSegment precedes the instance ID
+	scaleSetSegment   = "/virtualMachineScaleSets/"
+	scaleSetVMSegment = "/virtualMachines/"
+)
+
+var (
+	// computeURL is the endpoint of IMDS returning the compute metadata of the VM
+	computeURL = "http://169.254.169.254/metadata/instance/compute?api-version=2021-02-01"
+
+	// setTelemetryFields adds the fields of the metadata to every telemetry event of the process
+	setTelemetryFields = telemetry.SetInstanceMetadata
+)
+
+// Metadata are the fields of the compute metadata of the VM reported with the run commands
+type Metadata struct {
+	VMID              string `json:"vmId"`
+	ResourceGroupName string `json:"resourceGroupName"`
+	Zone              string `json:"zone"`
+	VMScaleSetName    string `json:"vmScaleSetName"`
+	ResourceID        string `json:"resourceId"`
+}
+
+// VMScaleSetInstanceID returns the instance ID of the VM in its scale set, empty if the VM is not in a scale set in
+// uniform orchestration mode
+func (m Metadata) VMScaleSetInstanceID() string {
+	if m.VMScaleSetName == "" || !strings.Contains(m.ResourceID, scaleSetSegment) {
+		return ""
+	}
+	i := strings.LastIndex(m.ResourceID, scaleSetVMSegment)
+	if i < 0 {
+		return ""
+	}
+	return m.ResourceID[i+len(scaleSetVMSegment):]
+}
+
+// Fields returns the fields reported in the telemetry and the execution summaries, by name. The empty ones are left out.
+func (m Metadata) Fields() map[string]string {
+	fields := make(map[string]string)
+	for name, value := range map[string]string{
+		"vmId":                 m.VMID,
+		"resourceGroupName":    m.ResourceGroupName,
+		"zone":                 m.Zone,
+		"vmScaleSetInstanceId": m.VMScaleSetInstanceID(),
+	} {
+		if value != "" {
+			fields[name] = value
+		}
+	}
+	return fields
+}
+
+var (
+	mu     sync.Mutex
+	cached *Metadata
+)
+
+// Get returns the metadata of the VM. IMDS is only queried until it answers, the metadata of the VM does not change
+// while the handler runs.
+func Get(ctx *log.Context) (Metadata, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if cached != nil {
+		return *cached, nil
+	}
+
+	m, err := query()
+	if err != nil {
+		return m, errors.Wrap(err, "failed to query the instance metadata")
+	}
+	ctx.Log("message", "queried the instance metadata", "vmId", m.VMID)
+	cached = &m
+	return m, nil
+}
+
+// Report adds the metadata of the VM to the telemetry of the process and the execution summaries, when enabled by
+// the feature flag. It is reported by the handler for its operation, and by the immediate run command service for
+// its own events and the goal states it executes.
+func Report(ctx *log.Context) {
+	if !featureflags.Enabled(ctx, featureflags.InstanceMetadata) {
+		return
+	}
+	m, err := Get(ctx)
+	if err != nil {
+		ctx.Log("warning", "the instance metadata will not be reported", "error", err)
+		return
+	}
+	setTelemetryFields(m.Fields())
+}
+
+// Cached returns the metadata of the VM if it was already queried, without querying IMDS
+func Cached() (Metadata, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	if cached == nil {
+		return Metadata{}, false
+	}
+	return *cached, true
+}
+
+func query() (Metadata, error) {
+	var m Metadata
+	req, err := http.NewRequest(http.MethodGet, computeURL, nil)
+	if err != nil {
+		return m, err
+	}
+	req.Header.Set("Metadata", "true")
+	requestheaders.Apply(req)
+
+	// IMDS must be reached directly, never through a proxy
+	client := &http.Client{Timeout: queryTimeout, Transport: &http.Transport{Proxy: nil}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return m, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return m, errors.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return m, errors.Wrap(err, "invalid instance metadata")
+	}
+	return m, nil
+}
@@ -0,0 +1,89 @@
+package instancemetadata
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/featureflags"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Get(t *testing.T) {
+	defer func(url string) { computeURL, cached = url, nil }(computeURL)
+	ctx := log.NewContext(log.NewNopLogger())
+
+	queries := 0
+	available := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries++
+		require.Equal(t, "true", r.Header.Get("Metadata"))
+		if !available {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"vmId": "00000000-0000-0000-0000-000000000001", "resourceGroupName": "rg", "zone": "2", "vmScaleSetName": "vmss",
+			"resourceId": "/subscriptions/s/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/vmss/virtualMachines/3"}`))
+	}))
+	defer server.Close()
+	computeURL = server.URL
+
+	_, err := Get(ctx)
+	require.ErrorContains(t, err, "unexpected status code 503")
+	_, ok := Cached()
+	require.False(t, ok)
+
+	available = true
+	m, err := Get(ctx)
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{
+		"vmId":                 "00000000-0000-0000-0000-000000000001",
+		"resourceGroupName":    "rg",
+		"zone":                 "2",
+		"vmScaleSetInstanceId": "3",
+	}, m.Fields())
+
+	// IMDS is not queried again
+	_, err = Get(ctx)
+	require.Nil(t, err)
+	require.Equal(t, 2, queries)
+	cachedMetadata, ok := Cached()
+	require.True(t, ok)
+	require.Equal(t, m, cachedMetadata)
+}
+
+func Test_VMScaleSetInstanceID(t *testing.T) {
+	m := Metadata{ResourceID: "/subscriptions/s/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm"}
+	require.Equal(t, "", m.VMScaleSetInstanceID())
+	require.Equal(t, map[string]string{}, m.Fields())
+
+	m.VMScaleSetName = "vmss"
+	require.Equal(t, "", m.VMScaleSetInstanceID())
+}
+
+func Test_Report(t *testing.T) {
+	defer func(url string, set func(map[string]string)) { computeURL, setTelemetryFields, cached = url, set, nil }(computeURL, setTelemetryFields)
+	ctx := log.NewContext(log.NewNopLogger())
+
+	queries := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries++
+		w.Write([]byte(`{"vmId": "00000000-0000-0000-0000-000000000001", "zone": "2"}`))
+	}))
+	defer server.Close()
+	computeURL = server.URL
+	var reported map[string]string
+	setTelemetryFields = func(fields map[string]string) { reported = fields }
+
+	// IMDS is not queried unless enabled by the feature flag
+	Report(ctx)
+	require.Equal(t, 0, queries)
+	require.Nil(t, reported)
+
+	defer featureflags.SetGoalStateOverrides(ctx, nil)
+	featureflags.SetGoalStateOverrides(ctx, map[string]bool{string(featureflags.InstanceMetadata): true})
+	Report(ctx)
+	require.Equal(t, 1, queries)
+	require.Equal(t, map[string]string{"vmId": "00000000-0000-0000-0000-000000000001", "zone": "2"}, reported)
+}
@@ -18,8 +18,9 @@ func ReportInstanceView(ctx *log.Context, hEnv types.HandlerEnvironment, metadat
 		return nil
 	}
 
-	msg, err := serializeInstanceView(instanceview)
+	msg, err := serializeInstanceViewWithinLimit(ctx, t, c.Name, instanceview)
 	if err != nil {
+		ctx.Log("event", "failed to report status", "error", err)
 		return err
 	}
 
@@ -0,0 +1,138 @@
+package instanceview
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/Azure/run-command-handler-linux/pkg/encodingutil"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxStatusFileSize is the size of the largest status file accepted by CRP. A larger status is rejected
+	// without any error reported to the customer.
+	maxStatusFileSize = 128 * 1024
+
+	// minTrimmedFieldLen is the length the fields of the instance view are trimmed to before being dropped
+	minTrimmedFieldLen = 64
+
+	// statusTruncationMarker replaces the part of a field trimmed to fit the status in the size limit
+	statusTruncationMarker = "[...]"
+
+	// subStatusCodeSubStatusesOmitted replaces the substatuses dropped to fit the status in the size limit
+	subStatusCodeSubStatusesOmitted = "SubStatusesOmitted"
+)
+
+// serializeInstanceViewWithinLimit serializes the instance view so the status file reporting it does not exceed
+// maxStatusFileSize. The longest fields are trimmed first, halving their length until the status fits, and dropped
+// as a last resort. An error is returned rather than a status exceeding the limit.
+func serializeInstanceViewWithinLimit(ctx *log.Context, t types.StatusType, operation string, instanceview *types.RunCommandInstanceView) (string, error) {
+	msg, size, err := measureInstanceView(t, operation, instanceview)
+	if err != nil || size <= maxStatusFileSize {
+		return msg, err
+	}
+	originalSize := size
+
+	limit := longestTrimmableField(instanceview)
+	for limit > minTrimmedFieldLen {
+		limit /= 2
+		trimmed := trimInstanceView(*instanceview, limit)
+		if msg, size, err = measureInstanceView(t, operation, &trimmed); err != nil {
+			return "", err
+		}
+		if size <= maxStatusFileSize {
+			ctx.Log("warning", "status trimmed to fit the size limit", "size", originalSize, "trimmedSize", size, "fieldLength", limit)
+			return msg, nil
+		}
+	}
+
+	trimmed := trimInstanceView(*instanceview, 0)
+	if msg, size, err = measureInstanceView(t, operation, &trimmed); err != nil {
+		return "", err
+	}
+	if size <= maxStatusFileSize {
+		ctx.Log("warning", "status trimmed to fit the size limit, output dropped", "size", originalSize, "trimmedSize", size)
+		return msg, nil
+	}
+	return "", errors.Errorf("status of %d bytes exceeds the limit of %d bytes even when trimmed", originalSize, maxStatusFileSize)
+}
+
+// measureInstanceView returns the serialized instance view and the size of the status file reporting it. The size
+// is the one of the indented status file of the handler, the largest form the status is reported in.
+func measureInstanceView(t types.StatusType, operation string, instanceview *types.RunCommandInstanceView) (string, int, error) {
+	msg, err := serializeInstanceView(instanceview)
+	if err != nil {
+		return "", 0, err
+	}
+	b, err := json.MarshalIndent(types.NewStatusReport(t, operation, msg), "", "\t")
+	if err != nil {
+		return "", 0, fmt.Errorf("status: failed to marshal into json: %v", err)
+	}
+	return msg, len(b), nil
+}
+
+func longestTrimmableField(instanceview *types.RunCommandInstanceView) int {
+	longest := 0
+	for _, field := range []string{instanceview.ExecutionMessage, instanceview.Output, instanceview.Error, instanceview.ProcessTree} {
+		if len(field) > longest {
+			longest = len(field)
+		}
+	}
+	for _, subStatus := range instanceview.SubStatuses {
+		if len(subStatus.Message) > longest {
+			longest = len(subStatus.Message)
+		}
+	}
+	return longest
+}
+
+// trimInstanceView returns the instance view with its fields trimmed to limit bytes. The end of the output streams
+// and the beginning of the messages are kept. A zero limit drops the output streams and replaces the substatuses
+// with a single one counting them.
+func trimInstanceView(instanceview types.RunCommandInstanceView, limit int) types.RunCommandInstanceView {
+	instanceview.Output = keepTail(instanceview.Output, limit)
+	instanceview.Error = keepTail(instanceview.Error, limit)
+	instanceview.ProcessTree = keepTail(instanceview.ProcessTree, limit)
+
+	if limit == 0 {
+		instanceview.ExecutionMessage = keepHead(instanceview.ExecutionMessage, minTrimmedFieldLen)
+		if len(instanceview.SubStatuses) > 0 {
+			instanceview.SubStatuses = []types.InstanceViewSubStatus{{
+				Name:    "status",
+				Code:    subStatusCodeSubStatusesOmitted,
+				Level:   types.SubStatusLevelWarning,
+				Message: fmt.Sprintf("%d substatuses were omitted to fit the status in its size limit", len(instanceview.SubStatuses)),
+			}}
+		}
+		return instanceview
+	}
+
+	instanceview.ExecutionMessage = keepHead(instanceview.ExecutionMessage, limit)
+	subStatuses := make([]types.InstanceViewSubStatus, len(instanceview.SubStatuses))
+	for i, subStatus := range instanceview.SubStatuses {
+		subStatus.Message = keepHead(subStatus.Message, limit)
+		subStatuses[i] = subStatus
+	}
+	instanceview.SubStatuses = subStatuses
+	return instanceview
+}
+
+// keepTail returns the last limit bytes of s preceded by the truncation marker, if s is longer
+func keepTail(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	tail := encodingutil.TrimLeadingPartialRune([]byte(s[len(s)-limit:]))
+	return statusTruncationMarker + string(tail)
+}
+
+// keepHead returns the first limit bytes of s followed by the truncation marker, if s is longer
+func keepHead(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	head := []byte(s[:limit])
+	return string(head[:encodingutil.CompleteRunesLength(head)]) + statusTruncationMarker
+}
@@ -0,0 +1,70 @@
+package instanceview
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_serializeInstanceViewWithinLimit(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	instanceView := types.RunCommandInstanceView{
+		ExecutionState:   types.Succeeded,
+		ExecutionMessage: "Execution completed",
+		Output:           "output",
+		Error:            "error",
+	}
+
+	// A status within the limit is left as is
+	msg, err := serializeInstanceViewWithinLimit(ctx, types.StatusSuccess, "Enable", &instanceView)
+	require.Nil(t, err)
+	expected, err := serializeInstanceView(&instanceView)
+	require.Nil(t, err)
+	require.Equal(t, expected, msg)
+
+	// The output streams keep their end, the substatuses their beginning
+	instanceView.Output = strings.Repeat("o", maxStatusFileSize) + "last line"
+	instanceView.Error = "first error" + strings.Repeat("é", maxStatusFileSize/4)
+	instanceView.SubStatuses = []types.InstanceViewSubStatus{{Name: "errorBlobUri", Code: "BlobUploadFailed", Message: "upload failed" + strings.Repeat("m", maxStatusFileSize/2)}}
+	msg, err = serializeInstanceViewWithinLimit(ctx, types.StatusSuccess, "Enable", &instanceView)
+	require.Nil(t, err)
+	_, size, err := measureInstanceView(types.StatusSuccess, "Enable", &instanceView)
+	require.Nil(t, err)
+	require.Greater(t, size, maxStatusFileSize)
+
+	var trimmed types.RunCommandInstanceView
+	require.Nil(t, json.Unmarshal([]byte(msg), &trimmed))
+	require.True(t, strings.HasPrefix(trimmed.Output, statusTruncationMarker))
+	require.True(t, strings.HasSuffix(trimmed.Output, "last line"))
+	require.True(t, strings.HasPrefix(trimmed.Error, statusTruncationMarker+"é"))
+	require.True(t, strings.HasPrefix(trimmed.SubStatuses[0].Message, "upload failed"))
+	require.True(t, strings.HasSuffix(trimmed.SubStatuses[0].Message, statusTruncationMarker))
+	require.Equal(t, "Execution completed", trimmed.ExecutionMessage)
+	_, size, err = measureInstanceView(types.StatusSuccess, "Enable", &trimmed)
+	require.Nil(t, err)
+	require.LessOrEqual(t, size, maxStatusFileSize)
+
+	// The substatuses are dropped when there are too many to fit
+	instanceView.SubStatuses = make([]types.InstanceViewSubStatus, maxStatusFileSize/16)
+	msg, err = serializeInstanceViewWithinLimit(ctx, types.StatusSuccess, "Enable", &instanceView)
+	require.Nil(t, err)
+	require.Nil(t, json.Unmarshal([]byte(msg), &trimmed))
+	require.Equal(t, statusTruncationMarker, trimmed.Output)
+	require.Len(t, trimmed.SubStatuses, 1)
+	require.Equal(t, subStatusCodeSubStatusesOmitted, trimmed.SubStatuses[0].Code)
+}
+
+func Test_keepTailAndHead(t *testing.T) {
+	require.Equal(t, "short", keepTail("short", 5))
+	require.Equal(t, statusTruncationMarker+"end", keepTail("the end", 3))
+	require.Equal(t, statusTruncationMarker, keepTail("dropped", 0))
+	require.Equal(t, statusTruncationMarker+"b", keepTail("éb", 2))
+
+	require.Equal(t, "short", keepHead("short", 5))
+	require.Equal(t, "the"+statusTruncationMarker, keepHead("the end", 3))
+	require.Equal(t, "a"+statusTruncationMarker, keepHead("aé", 2))
+}
@@ -0,0 +1,129 @@
+// Package monitorevents emits a started and a completed event for every operation of the handler to the local
+// syslog, where the Azure Monitor Agent collects them, so alerts can be built on the failed run commands without
+// reading their status through ARM. The events are single-line JSON messages with the facility user and the tag
+// run-command-handler, the completed event having the severity err when the operation failed and info otherwise:
+//
+//	{"event":"RunCommandOperationStarted","correlationId":"6f0c...","operationId":"2f1c...","operation":"Enable","extensionName":"rc1","sequenceNumber":3,"timestamp":"2024-05-01T10:00:00Z"}
+//	{"event":"RunCommandOperationCompleted","correlationId":"6f0c...","operationId":"2f1c...","operation":"Enable","extensionName":"rc1","sequenceNumber":3,"timestamp":"2024-05-01T10:00:05Z","outcome":"Failed","exitCode":1,"durationInMilliseconds":5012,"message":"command terminated with exit status=1"}
+//
+// The correlation ID is unique per operation and pairs its events, the operation ID is the one of the handler
+// process found in its logs and in the User-Agent of its requests.
+package monitorevents
+
+import (
+	"encoding/json"
+	"log/syslog"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/Azure/run-command-handler-linux/pkg/encodingutil"
+	"github.com/Azure/run-command-handler-linux/pkg/logsanitizer"
+	"github.com/go-kit/kit/log"
+	"github.com/google/uuid"
+)
+
+const (
+	// Tag of the events in the syslog
+	Tag = "run-command-handler"
+
+	EventStarted   = "RunCommandOperationStarted"
+	EventCompleted = "RunCommandOperationCompleted"
+
+	// maxMessageLen bounds the message of the completed event, longer ones are truncated
+	maxMessageLen = 1024
+)
+
+// OutcomeRebootPending is the outcome of the operations resuming once the VM boots, the other outcomes are the
+// execution states of the instance view (e.g., Succeeded or Failed)
+const OutcomeRebootPending = "RebootPending"
+
+// writer writes the events to the syslog
+type writer interface {
+	Info(m string) error
+	Err(m string) error
+	Close() error
+}
+
+// dial connects to the local syslog, replaced by tests
+var dial = func() (writer, error) {
+	return syslog.New(syslog.LOG_USER|syslog.LOG_INFO, Tag)
+}
+
+// event is the message of an event
+type event struct {
+	Event          string `json:"event"`
+	CorrelationID  string `json:"correlationId"`
+	OperationID    string `json:"operationId,omitempty"`
+	Operation      string `json:"operation"`
+	ExtensionName  string `json:"extensionName"`
+	SequenceNumber int    `json:"sequenceNumber"`
+	Timestamp      string `json:"timestamp"`
+
+	// Fields of the completed event
+	Outcome                string `json:"outcome,omitempty"`
+	ExitCode               *int   `json:"exitCode,omitempty"`
+	DurationInMilliseconds *int64 `json:"durationInMilliseconds,omitempty"`
+	Message                string `json:"message,omitempty"`
+}
+
+// Operation is an operation whose start was emitted
+type Operation struct {
+	started time.Time
+	event   event
+}
+
+// Start emits the started event of the operation and returns it, to emit its completed event
+func Start(ctx *log.Context, operationID, operation, extensionName string, seqNum int) *Operation {
+	o := &Operation{
+		started: time.Now(),
+		event: event{
+			CorrelationID:  uuid.New().String(),
+			OperationID:    operationID,
+			Operation:      operation,
+			ExtensionName:  extensionName,
+			SequenceNumber: seqNum,
+		},
+	}
+	e := o.event
+	e.Event = EventStarted
+	e.Timestamp = o.started.UTC().Format(time.RFC3339)
+	emit(ctx, e)
+	return o
+}
+
+// Complete emits the completed event of the operation with its outcome, exit code and message (e.g., the error)
+func (o *Operation) Complete(ctx *log.Context, outcome string, exitCode int, message string) {
+	now := time.Now()
+	duration := now.Sub(o.started).Milliseconds()
+	e := o.event
+	e.Event = EventCompleted
+	e.Timestamp = now.UTC().Format(time.RFC3339)
+	e.Outcome = outcome
+	e.ExitCode = &exitCode
+	e.DurationInMilliseconds = &duration
+	e.Message = encodingutil.Truncate(logsanitizer.Sanitize(message), maxMessageLen)
+	emit(ctx, e)
+}
+
+// emit writes the event to the syslog. The operation goes on without its events if the syslog is unavailable.
+func emit(ctx *log.Context, e event) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		ctx.Log("warning", "failed to format the monitor event", "error", err)
+		return
+	}
+	w, err := dial()
+	if err != nil {
+		ctx.Log("warning", "failed to connect to the syslog, the monitor event is dropped", "event", e.Event, "error", err)
+		return
+	}
+	defer w.Close()
+	if e.Outcome != "" && e.Outcome != types.Succeeded && e.Outcome != OutcomeRebootPending {
+		err = w.Err(string(b))
+	} else {
+		err = w.Info(string(b))
+	}
+	if err != nil {
+		ctx.Log("warning", "failed to write the monitor event to the syslog", "event", e.Event, "error", err)
+	}
+}
@@ -0,0 +1,87 @@
+package monitorevents
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeWriter struct {
+	info []string
+	err  []string
+}
+
+func (w *fakeWriter) Info(m string) error { w.info = append(w.info, m); return nil }
+func (w *fakeWriter) Err(m string) error  { w.err = append(w.err, m); return nil }
+func (w *fakeWriter) Close() error        { return nil }
+
+func useFakeWriter(t *testing.T) *fakeWriter {
+	w := new(fakeWriter)
+	original := dial
+	dial = func() (writer, error) { return w, nil }
+	t.Cleanup(func() { dial = original })
+	return w
+}
+
+func TestOperation(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	w := useFakeWriter(t)
+
+	op := Start(ctx, "op-1", "Enable", "rc1", 3)
+	require.Len(t, w.info, 1)
+	var started map[string]interface{}
+	require.Nil(t, json.Unmarshal([]byte(w.info[0]), &started))
+	require.Equal(t, EventStarted, started["event"])
+	require.Equal(t, "op-1", started["operationId"])
+	require.Equal(t, "Enable", started["operation"])
+	require.Equal(t, "rc1", started["extensionName"])
+	require.Equal(t, float64(3), started["sequenceNumber"])
+	require.NotContains(t, started, "outcome")
+	require.NotContains(t, started, "exitCode")
+
+	op.Complete(ctx, "Failed", 1, "command terminated with exit status=1")
+	require.Len(t, w.err, 1)
+	var completed map[string]interface{}
+	require.Nil(t, json.Unmarshal([]byte(w.err[0]), &completed))
+	require.Equal(t, EventCompleted, completed["event"])
+	require.Equal(t, started["correlationId"], completed["correlationId"])
+	require.Equal(t, "Failed", completed["outcome"])
+	require.Equal(t, float64(1), completed["exitCode"])
+	require.Contains(t, completed, "durationInMilliseconds")
+	require.Equal(t, "command terminated with exit status=1", completed["message"])
+}
+
+func TestOperation_succeededIsInfo(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	w := useFakeWriter(t)
+
+	Start(ctx, "", "Enable", "rc1", 0).Complete(ctx, "Succeeded", 0, "")
+	Start(ctx, "", "Enable", "rc1", 1).Complete(ctx, OutcomeRebootPending, 0, "")
+	require.Len(t, w.info, 4)
+	require.Empty(t, w.err)
+	require.Contains(t, w.info[1], `"exitCode":0`)
+	require.NotContains(t, w.info[1], "operationId")
+}
+
+func TestOperation_truncatesMessage(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	w := useFakeWriter(t)
+
+	Start(ctx, "", "Enable", "rc1", 0).Complete(ctx, "Failed", 1, strings.Repeat("é", maxMessageLen))
+	var completed map[string]interface{}
+	require.Nil(t, json.Unmarshal([]byte(w.err[0]), &completed))
+	require.Equal(t, strings.Repeat("é", maxMessageLen/2)+"...", completed["message"])
+}
+
+func TestOperation_syslogUnavailable(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	original := dial
+	dial = func() (writer, error) { return nil, errors.New("no syslog") }
+	defer func() { dial = original }()
+
+	Start(ctx, "", "Enable", "rc1", 0).Complete(ctx, "Failed", 1, "")
+}
@@ -0,0 +1,167 @@
+// Package multistep tracks the executions of the scripts allowed to reboot the VM. Such an execution runs in steps:
+// a step requests a reboot when it exits, and the next step resumes the execution once the VM boots.
+package multistep
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
+	"github.com/Azure/run-command-handler-linux/pkg/atomicfile"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// maxStepOutputLen bounds the output of a step kept in the progress, reported with the final step
+const maxStepOutputLen = 1024
+
+// rebootCommand reboots the VM, in a minute so the status of the step is reported first
+var rebootCommand = []string{"shutdown", "-r", "+1", "Run Command: the script requested a reboot"}
+
+// StepResult is the outcome of a step that requested a reboot
+type StepResult struct {
+	Step        int       `json:"step"`
+	ExitCode    int       `json:"exitCode"`
+	Output      string    `json:"output"`
+	CompletedAt time.Time `json:"completedAt"`
+}
+
+// Progress records the steps of an execution completed so far
+type Progress struct {
+	StartedAt time.Time    `json:"startedAt"`
+	Steps     []StepResult `json:"steps"`
+}
+
+// Step returns the step the execution is at, from 1
+func (p Progress) Step() int {
+	return len(p.Steps) + 1
+}
+
+// Complete records the current step as completed with a reboot request
+func (p *Progress) Complete(exitCode int, output string, now time.Time) {
+	if len(output) > maxStepOutputLen {
+		output = output[len(output)-maxStepOutputLen:]
+	}
+	p.Steps = append(p.Steps, StepResult{Step: p.Step(), ExitCode: exitCode, Output: output, CompletedAt: now.UTC()})
+}
+
+// Store persists the progress of the executions, by extension name and sequence number. The immediate run command
+// service keeps it in its goal state journal.
+type Store interface {
+	// LoadProgress returns the progress recorded for the execution, nil if there is none
+	LoadProgress(extensionName string, seqNum int) (*Progress, error)
+
+	// SaveProgress records the progress of the execution, a nil progress clears it
+	SaveProgress(extensionName string, seqNum int, p *Progress) error
+}
+
+// store is the store passed to UseStore, nil if the executions of this process are not resumed after reboots
+var store Store
+
+// UseStore persists the progress of the executions of this process to s. A nil store disables it.
+func UseStore(s Store) {
+	store = s
+}
+
+// Load returns the progress of the execution of the given extension name and sequence number. An execution
+// without any progress recorded starts at its first step.
+func Load(extensionName string, seqNum int, now time.Time) (Progress, error) {
+	p := Progress{StartedAt: now.UTC()}
+	if store == nil {
+		return p, nil
+	}
+	recorded, err := store.LoadProgress(extensionName, seqNum)
+	if err != nil {
+		return p, errors.Wrap(err, "failed to load the progress of the execution")
+	}
+	if recorded == nil {
+		return p, nil
+	}
+	p = *recorded
+	p.Steps = append([]StepResult(nil), recorded.Steps...)
+	return p, nil
+}
+
+// Resuming returns whether the execution has completed steps, so it resumes after a reboot rather than starting over
+func Resuming(extensionName string, seqNum int) bool {
+	p, err := Load(extensionName, seqNum, time.Now())
+	return err == nil && len(p.Steps) > 0
+}
+
+// Save persists the progress of the execution
+func Save(extensionName string, seqNum int, p Progress) error {
+	if store == nil {
+		return errors.New("the progress of the execution is only saved by the immediate run command service")
+	}
+	return errors.Wrap(store.SaveProgress(extensionName, seqNum, &p), "failed to save the progress of the execution")
+}
+
+// Remove clears the progress once the execution completes
+func Remove(extensionName string, seqNum int) error {
+	if store == nil {
+		return nil
+	}
+	return errors.Wrap(store.SaveProgress(extensionName, seqNum, nil), "failed to remove the progress of the execution")
+}
+
+// PrepareStep records the step the script executes in its execution directory and clears a reboot request left by a
+// previous step
+func PrepareStep(seqNumDir string, step int) error {
+	if err := os.Remove(datapaths.RebootMarkerFilePath(seqNumDir)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to clear the reboot request of the previous step")
+	}
+	return errors.Wrap(atomicfile.WriteFile(datapaths.StepFilePath(seqNumDir), []byte(strconv.Itoa(step)), 0600), "failed to record the step of the script")
+}
+
+// Environment returns the variables telling the script the step it executes and where to request a reboot, none
+// if the execution directory has no step recorded
+func Environment(seqNumDir string) []string {
+	b, err := os.ReadFile(datapaths.StepFilePath(seqNumDir))
+	if err != nil {
+		return nil
+	}
+	return []string{
+		constants.ScriptStepEnvName + "=" + strings.TrimSpace(string(b)),
+		constants.ScriptRebootMarkerEnvName + "=" + datapaths.RebootMarkerFilePath(seqNumDir),
+	}
+}
+
+// RebootRequested returns whether the script requested a reboot, by its exit code or the marker file
+func RebootRequested(seqNumDir string, exitCode int) bool {
+	if exitCode == constants.ScriptRebootExitCode {
+		return true
+	}
+	_, err := os.Stat(datapaths.RebootMarkerFilePath(seqNumDir))
+	return err == nil
+}
+
+// RebootPendingError is returned for an execution whose step requested a reboot, it is neither succeeded nor failed
+// until its last step completes
+type RebootPendingError struct {
+	Step int
+}
+
+func (e RebootPendingError) Error() string {
+	return fmt.Sprintf("step %d of the script requested a reboot, the execution resumes once the VM boots", e.Step)
+}
+
+// IsRebootPending returns whether err, or the error it wraps, is a RebootPendingError
+func IsRebootPending(err error) (RebootPendingError, bool) {
+	pending, ok := errors.Cause(err).(RebootPendingError)
+	return pending, ok
+}
+
+// Reboot schedules the reboot of the VM
+func Reboot(ctx *log.Context) error {
+	ctx.Log("event", "rebooting the VM as requested by the script")
+	out, err := exec.Command(rebootCommand[0], rebootCommand[1:]...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "failed to reboot the VM: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package multistep
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryStore keeps the progress of the executions in memory, failing every call once err is set
+type memoryStore struct {
+	progress map[string]*Progress
+	err      error
+}
+
+func (s *memoryStore) LoadProgress(extensionName string, seqNum int) (*Progress, error) {
+	return s.progress[fmt.Sprintf("%s.%d", extensionName, seqNum)], s.err
+}
+
+func (s *memoryStore) SaveProgress(extensionName string, seqNum int, p *Progress) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.progress[fmt.Sprintf("%s.%d", extensionName, seqNum)] = p
+	return nil
+}
+
+func Test_progressSavedAndLoaded(t *testing.T) {
+	UseStore(&memoryStore{progress: map[string]*Progress{}})
+	defer UseStore(nil)
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	p, err := Load("RC0001", 3, start)
+	require.Nil(t, err)
+	require.Equal(t, 1, p.Step())
+	require.False(t, Resuming("RC0001", 3))
+
+	p.Complete(194, strings.Repeat("a", maxStepOutputLen)+"end", start.Add(time.Minute))
+	require.Nil(t, Save("RC0001", 3, p))
+	require.True(t, Resuming("RC0001", 3))
+	require.False(t, Resuming("RC0001", 4), "the progress of another sequence number is ignored")
+
+	loaded, err := Load("RC0001", 3, time.Now())
+	require.Nil(t, err)
+	require.Equal(t, 2, loaded.Step())
+	require.Equal(t, start, loaded.StartedAt)
+	require.Equal(t, 194, loaded.Steps[0].ExitCode)
+	require.Len(t, loaded.Steps[0].Output, maxStepOutputLen)
+	require.True(t, strings.HasSuffix(loaded.Steps[0].Output, "end"))
+
+	require.Nil(t, Remove("RC0001", 3))
+	require.False(t, Resuming("RC0001", 3))
+}
+
+func Test_progressWithoutStore(t *testing.T) {
+	p, err := Load("RC0001", 3, time.Now())
+	require.Nil(t, err)
+	require.Equal(t, 1, p.Step())
+	require.ErrorContains(t, Save("RC0001", 3, p), "only saved by the immediate run command service")
+	require.Nil(t, Remove("RC0001", 3))
+}
+
+func Test_loadProgressFails(t *testing.T) {
+	UseStore(&memoryStore{err: errors.New("journal: failed to parse")})
+	defer UseStore(nil)
+
+	p, err := Load("RC0001", 3, time.Now())
+	require.ErrorContains(t, err, "failed to load the progress of the execution")
+	require.Equal(t, 1, p.Step())
+	require.False(t, Resuming("RC0001", 3))
+}
+
+func Test_stepEnvironmentAndRebootRequest(t *testing.T) {
+	dir := t.TempDir()
+	require.Nil(t, Environment(dir), "no variables without a step")
+
+	require.Nil(t, PrepareStep(dir, 2))
+	require.Equal(t, []string{
+		constants.ScriptStepEnvName + "=2",
+		constants.ScriptRebootMarkerEnvName + "=" + datapaths.RebootMarkerFilePath(dir),
+	}, Environment(dir))
+
+	require.False(t, RebootRequested(dir, 0))
+	require.True(t, RebootRequested(dir, constants.ScriptRebootExitCode))
+
+	require.Nil(t, os.WriteFile(datapaths.RebootMarkerFilePath(dir), nil, 0600))
+	require.True(t, RebootRequested(dir, 0))
+
+	require.Nil(t, PrepareStep(dir, 3))
+	require.False(t, RebootRequested(dir, 0), "the request of the previous step is cleared")
+}
+
+func Test_IsRebootPending(t *testing.T) {
+	pending, ok := IsRebootPending(errors.Wrap(RebootPendingError{Step: 2}, "command execution failed"))
+	require.True(t, ok)
+	require.Equal(t, 2, pending.Step)
+
+	_, ok = IsRebootPending(errors.New("failed"))
+	require.False(t, ok)
+	_, ok = IsRebootPending(nil)
+	require.False(t, ok)
+}
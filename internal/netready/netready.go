@@ -0,0 +1,143 @@
+// Package netready waits for the network of the VM to be ready before a script executes, e.g., for the run commands
+// executed at boot racing cloud-init and the configuration of the network.
+package netready
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// checkTimeout bounds every resolution and connection attempt
+const checkTimeout = 5 * time.Second
+
+var (
+	// pollInterval is the time between two checks of the network
+	pollInterval = 2 * time.Second
+
+	// ipv4RouteFile and ipv6RouteFile list the routes of the VM
+	ipv4RouteFile = "/proc/net/route"
+	ipv6RouteFile = "/proc/net/ipv6_route"
+
+	resolve = func(ctx context.Context, host string) error {
+		_, err := net.DefaultResolver.LookupHost(ctx, host)
+		return err
+	}
+
+	dial = func(ctx context.Context, address string) error {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+)
+
+// Requirements are the conditions for the network to be ready. The VM always needs a default route.
+type Requirements struct {
+	// HostNames must resolve
+	HostNames []string
+	// Endpoints must accept TCP connections, as host:port
+	Endpoints []string
+}
+
+// Wait waits for the network to meet the requirements, at most timeout. The error lists the requirements still not
+// met once the timeout expires.
+func Wait(ctx *log.Context, requirements Requirements, timeout time.Duration) error {
+	start := time.Now()
+	deadline := start.Add(timeout)
+	for attempt := 1; ; attempt++ {
+		notReady := check(requirements, deadline)
+		if len(notReady) == 0 {
+			if attempt > 1 {
+				ctx.Log("message", "network is ready", "waited", time.Since(start).Round(time.Second))
+			}
+			return nil
+		}
+		if time.Now().Add(pollInterval).After(deadline) {
+			return fmt.Errorf("the network was not ready after waiting %v: %s", timeout, strings.Join(notReady, "; "))
+		}
+		if attempt == 1 {
+			ctx.Log("event", "waiting for the network to be ready", "timeout", timeout, "notReady", strings.Join(notReady, "; "))
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// check returns the requirements not met
+func check(requirements Requirements, deadline time.Time) []string {
+	var notReady []string
+	if !hasDefaultRoute() {
+		notReady = append(notReady, "no default route")
+	}
+	for _, host := range requirements.HostNames {
+		if err := withTimeout(deadline, func(ctx context.Context) error { return resolve(ctx, host) }); err != nil {
+			notReady = append(notReady, fmt.Sprintf("host name %s does not resolve: %v", host, err))
+		}
+	}
+	for _, endpoint := range requirements.Endpoints {
+		if err := withTimeout(deadline, func(ctx context.Context) error { return dial(ctx, endpoint) }); err != nil {
+			notReady = append(notReady, fmt.Sprintf("endpoint %s is not reachable: %v", endpoint, err))
+		}
+	}
+	return notReady
+}
+
+// withTimeout calls f with a context bounded by checkTimeout and the deadline
+func withTimeout(deadline time.Time, f func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	ctx, cancelDeadline := context.WithDeadline(ctx, deadline)
+	defer cancelDeadline()
+	return f(ctx)
+}
+
+// hasDefaultRoute returns whether the VM has an IPv4 or IPv6 default route through an interface other than loopback
+func hasDefaultRoute() bool {
+	return hasRoute(ipv4RouteFile, isIPv4DefaultRoute) || hasRoute(ipv6RouteFile, isIPv6DefaultRoute)
+}
+
+func hasRoute(path string, isDefault func(fields []string) bool) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if isDefault(strings.Fields(scanner.Text())) {
+			return true
+		}
+	}
+	return false
+}
+
+// isIPv4DefaultRoute matches a line of /proc/net/route: Iface Destination Gateway Flags ... Mask ...
+func isIPv4DefaultRoute(fields []string) bool {
+	if len(fields) < 8 || fields[0] == "lo" || fields[1] != "00000000" || fields[7] != "00000000" {
+		return false
+	}
+	flags, err := strconv.ParseUint(fields[3], 16, 32)
+	// RTF_UP
+	return err == nil && flags&0x1 != 0
+}
+
+// isIPv6DefaultRoute matches a line of /proc/net/ipv6_route: Destination PrefixLength Source SourcePrefixLength
+// NextHop Metric RefCount Use Flags Iface
+func isIPv6DefaultRoute(fields []string) bool {
+	if len(fields) < 10 || fields[9] == "lo" || fields[0] != strings.Repeat("0", 32) || fields[1] != "00" {
+		return false
+	}
+	flags, err := strconv.ParseUint(fields[8], 16, 32)
+	// RTF_UP, and not RTF_REJECT (an unreachable route)
+	return err == nil && flags&0x1 != 0 && flags&0x200 == 0
+}
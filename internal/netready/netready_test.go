@@ -0,0 +1,77 @@
+package netready
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	ipv4Routes = "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+		"eth0\t00000000\t010200C0\t0003\t0\t0\t0\t00000000\t0\t0\t0\n" +
+		"eth0\t000200C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n"
+	ipv4RoutesWithoutDefault = "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+		"eth0\t000200C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n"
+	ipv6Routes = "fe800000000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000002 00000000 00000001     eth0\n" +
+		"00000000000000000000000000000000 00 00000000000000000000000000000000 00 fd000000000000000000000000000001 00000400 00000001 00000000 00000003     eth0\n"
+	ipv6UnreachableRoute = "00000000000000000000000000000000 00 00000000000000000000000000000000 00 00000000000000000000000000000000 ffffffff 00000001 00000000 00200200       lo\n"
+)
+
+func writeRoutes(t *testing.T, ipv4 string, ipv6 string) {
+	dir := t.TempDir()
+	ipv4RouteFile, ipv6RouteFile = filepath.Join(dir, "route"), filepath.Join(dir, "ipv6_route")
+	require.Nil(t, os.WriteFile(ipv4RouteFile, []byte(ipv4), 0644))
+	require.Nil(t, os.WriteFile(ipv6RouteFile, []byte(ipv6), 0644))
+}
+
+func Test_hasDefaultRoute(t *testing.T) {
+	defer func(ipv4, ipv6 string) { ipv4RouteFile, ipv6RouteFile = ipv4, ipv6 }(ipv4RouteFile, ipv6RouteFile)
+
+	writeRoutes(t, ipv4Routes, "")
+	require.True(t, hasDefaultRoute())
+
+	writeRoutes(t, ipv4RoutesWithoutDefault, ipv6Routes)
+	require.True(t, hasDefaultRoute())
+
+	writeRoutes(t, ipv4RoutesWithoutDefault, ipv6UnreachableRoute)
+	require.False(t, hasDefaultRoute())
+
+	ipv4RouteFile, ipv6RouteFile = filepath.Join(t.TempDir(), "missing"), filepath.Join(t.TempDir(), "missing")
+	require.False(t, hasDefaultRoute())
+}
+
+func Test_Wait(t *testing.T) {
+	defer func(ipv4, ipv6 string, interval time.Duration) {
+		ipv4RouteFile, ipv6RouteFile, pollInterval = ipv4, ipv6, interval
+	}(ipv4RouteFile, ipv6RouteFile, pollInterval)
+	defer func(r, d func(context.Context, string) error) { resolve, dial = r, d }(resolve, dial)
+	ctx := log.NewContext(log.NewNopLogger())
+	pollInterval = time.Millisecond
+
+	attempts := 0
+	resolve = func(ctx context.Context, host string) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("no such host")
+		}
+		return nil
+	}
+	dial = func(ctx context.Context, address string) error { return nil }
+	writeRoutes(t, ipv4Routes, "")
+	requirements := Requirements{HostNames: []string{"contoso.com"}, Endpoints: []string{"contoso.com:443"}}
+
+	// The requirements are checked again until met
+	require.Nil(t, Wait(ctx, requirements, time.Minute))
+	require.Equal(t, 3, attempts)
+
+	writeRoutes(t, ipv4RoutesWithoutDefault, "")
+	dial = func(ctx context.Context, address string) error { return errors.New("connection refused") }
+	err := Wait(ctx, requirements, 20*time.Millisecond)
+	require.EqualError(t, err, "the network was not ready after waiting 20ms: no default route; endpoint contoso.com:443 is not reachable: connection refused")
+}
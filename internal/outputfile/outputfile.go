@@ -0,0 +1,432 @@
+// Package outputfile writes and reads the output files of the scripts, optionally compressed as they grow. The
+// rotating writer keeps the latest output in the file itself and, once it holds a full segment, moves the segment to
+// <file>.<n> and compresses it into <file>.<n>.gz in the background. The readers see the decompressed output as a
+// single stream, whether it was compressed or not.
+package outputfile
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	compressedSuffix = ".gz"
+	temporarySuffix  = ".tmp"
+
+	// maxOpenAttempts bounds the attempts to list the segments while the writer rotates them
+	maxOpenAttempts = 5
+)
+
+// segmentSuffixPattern matches the suffix of the segment files of an output file, in any state
+var segmentSuffixPattern = regexp.MustCompile(`^\.[0-9]+(\.gz(\.tmp)?)?$`)
+
+// segmentPath returns the path of the nth segment of the output file at path, numbered from 1
+func segmentPath(path string, n int, compressed bool) string {
+	p := fmt.Sprintf("%s.%d", path, n)
+	if compressed {
+		p += compressedSuffix
+	}
+	return p
+}
+
+// Create creates (or truncates) the output file at path, removing the segments of a previous output. Unless
+// segmentSize is 0, the output is compressed in segments of segmentSize bytes.
+func Create(ctx *log.Context, path string, segmentSize int64) (io.WriteCloser, error) {
+	if err := removeSegments(path); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if segmentSize <= 0 {
+		return f, nil
+	}
+	return &RotatingWriter{ctx: ctx, path: path, segmentSize: segmentSize, f: f}, nil
+}
+
+// RotatingWriter writes an output file, compressing every full segment of it
+type RotatingWriter struct {
+	ctx         *log.Context
+	path        string
+	segmentSize int64
+	f           *os.File
+	written     int64
+	segments    int
+	compressing sync.WaitGroup
+
+	// mu serializes Close with the writes, which may go on after the output is closed
+	mu     sync.Mutex
+	closed bool
+}
+
+// Write writes p to the current segment, rotating it whenever it is full
+func (w *RotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := int64(len(p))
+		if room := w.segmentSize - w.written; n > room {
+			n = room
+		}
+		m, err := w.f.Write(p[:n])
+		written += m
+		w.written += int64(m)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+		if w.written == w.segmentSize {
+			if err := w.rotate(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// rotate moves the full segment out of the output file and compresses it in the background. A segment is only
+// rotated once the previous one is compressed, so at most one segment is left uncompressed.
+func (w *RotatingWriter) rotate() error {
+	w.compressing.Wait()
+	if err := w.f.Close(); err != nil {
+		return errors.Wrap(err, "failed to close the output segment")
+	}
+	w.segments++
+	plain := segmentPath(w.path, w.segments, false)
+	if err := os.Rename(w.path, plain); err != nil {
+		return errors.Wrap(err, "failed to rotate the output segment")
+	}
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to create the output segment")
+	}
+	w.f = f
+	w.written = 0
+
+	w.compressing.Add(1)
+	go func() {
+		defer w.compressing.Done()
+		if err := compress(plain, segmentPath(w.path, w.segments, true)); err != nil {
+			// The segment is read uncompressed instead
+			w.ctx.Log("warning", "failed to compress the output segment", "path", plain, "error", err)
+		}
+	}()
+	return nil
+}
+
+// Close closes the output file once the last segment rotated is compressed
+func (w *RotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+	w.compressing.Wait()
+	return w.f.Close()
+}
+
+// compress compresses the file at plain into compressed and removes it. The compressed file is written to a
+// temporary file first, so a reader never sees a partial segment.
+func compress(plain string, compressed string) error {
+	src, err := os.Open(plain)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := compressed + temporarySuffix
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	zw, _ := gzip.NewWriterLevel(dst, gzip.BestSpeed)
+	_, err = io.Copy(zw, src)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, compressed)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(plain)
+}
+
+// Files returns the files of the output at path: its segments, in any state, and the file itself. Only the existing
+// segments are returned.
+func Files(path string) []string {
+	matches, _ := filepath.Glob(path + ".*")
+	var files []string
+	for _, m := range matches {
+		if segmentSuffixPattern.MatchString(m[len(path):]) {
+			files = append(files, m)
+		}
+	}
+	return append(files, path)
+}
+
+// Remove removes the output file at path and its segments, ignoring those which don't exist
+func Remove(path string) error {
+	if err := removeSegments(path); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func removeSegments(path string) error {
+	files := Files(path)
+	for _, f := range files[:len(files)-1] {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to remove the output segment")
+		}
+	}
+	return nil
+}
+
+// segment is a rotated segment of an output, at offset of the decompressed output
+type segment struct {
+	path       string
+	compressed bool
+	offset     int64
+	size       int64
+}
+
+// Reader reads the decompressed output of an output file as it was when opened, except for the output appended to
+// the file since then. It reads sequentially through a compressed segment without decompressing it again. It is not
+// safe for concurrent use.
+type Reader struct {
+	segments      []segment
+	current       *os.File
+	currentOffset int64
+
+	// stream is the decompressed content of segments[streamSegment], read up to streamPosition
+	stream         *gzip.Reader
+	streamFile     *os.File
+	streamSegment  int
+	streamPosition int64
+}
+
+// Open opens the output file at path and its segments. The error satisfies os.IsNotExist if there is no output.
+func Open(path string) (*Reader, error) {
+	for attempt := 1; ; attempt++ {
+		segments, err := listSegments(path)
+		if err != nil {
+			return nil, err
+		}
+		current, err := os.Open(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		// The writer rotated a segment meanwhile, the file opened may be listed as a segment or be missing one
+		if again, err := listSegments(path); err == nil && len(again) != len(segments) && attempt < maxOpenAttempts {
+			if current != nil {
+				current.Close()
+			}
+			continue
+		}
+		if current == nil && len(segments) == 0 {
+			return nil, err
+		}
+
+		r := &Reader{segments: segments, current: current}
+		if len(segments) > 0 {
+			last := segments[len(segments)-1]
+			r.currentOffset = last.offset + last.size
+		}
+		return r, nil
+	}
+}
+
+// listSegments returns the rotated segments of the output file at path, in order
+func listSegments(path string) ([]segment, error) {
+	var segments []segment
+	offset := int64(0)
+	for n := 1; ; n++ {
+		s := segment{path: segmentPath(path, n, false), offset: offset}
+		fi, err := os.Stat(s.path)
+		if err == nil {
+			s.size = fi.Size()
+		} else if os.IsNotExist(err) {
+			s.path, s.compressed = segmentPath(path, n, true), true
+			s.size, err = decompressedSize(s.path)
+			if os.IsNotExist(errors.Cause(err)) {
+				return segments, nil
+			}
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read the output segment")
+		}
+		segments = append(segments, s)
+		offset += s.size
+	}
+}
+
+// decompressedSize returns the size of the content of a gzip file, from its trailer. The segments are smaller than
+// the 4GB the trailer can hold.
+func decompressedSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	trailer := make([]byte, 4)
+	if _, err := f.Seek(-4, io.SeekEnd); err != nil {
+		return 0, errors.Wrap(err, "invalid compressed segment")
+	}
+	if _, err := io.ReadFull(f, trailer); err != nil {
+		return 0, errors.Wrap(err, "invalid compressed segment")
+	}
+	return int64(binary.LittleEndian.Uint32(trailer)), nil
+}
+
+// Size returns the size of the decompressed output, including the output written to the file since it was opened
+func (r *Reader) Size() (int64, error) {
+	if r.current == nil {
+		return r.currentOffset, nil
+	}
+	fi, err := r.current.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return r.currentOffset + fi.Size(), nil
+}
+
+// ReadAt reads len(p) bytes of the decompressed output from off. It returns io.EOF if the output ends first.
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	for read < len(p) {
+		n, err := r.readOnce(p[read:], off+int64(read))
+		read += n
+		if err != nil {
+			return read, err
+		}
+		if n == 0 {
+			return read, io.EOF
+		}
+	}
+	return read, nil
+}
+
+// readOnce reads from the segment holding off, at most up to its end
+func (r *Reader) readOnce(p []byte, off int64) (int, error) {
+	if off >= r.currentOffset {
+		if r.current == nil {
+			return 0, io.EOF
+		}
+		n, err := r.current.ReadAt(p, off-r.currentOffset)
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+		return n, err
+	}
+
+	i := len(r.segments) - 1
+	for r.segments[i].offset > off {
+		i--
+	}
+	s := r.segments[i]
+	if max := s.offset + s.size - off; int64(len(p)) > max {
+		p = p[:max]
+	}
+	if !s.compressed {
+		f, err := os.Open(s.path)
+		if os.IsNotExist(err) {
+			// The segment was compressed since it was listed
+			r.segments[i].path, r.segments[i].compressed = s.path+compressedSuffix, true
+			return r.readOnce(p, off)
+		}
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		n, err := f.ReadAt(p, off-s.offset)
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+		return n, err
+	}
+
+	if err := r.seekStream(i, off-s.offset); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(r.stream, p)
+	r.streamPosition += int64(n)
+	if err == io.ErrUnexpectedEOF || (err == io.EOF && n > 0) {
+		err = nil
+	}
+	return n, err
+}
+
+// seekStream positions the decompressed stream of the ith segment at position, decompressing the segment again
+// unless the stream is before position
+func (r *Reader) seekStream(i int, position int64) error {
+	if r.stream == nil || r.streamSegment != i || r.streamPosition > position {
+		r.closeStream()
+		f, err := os.Open(r.segments[i].path)
+		if err != nil {
+			return err
+		}
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return errors.Wrap(err, "invalid compressed segment")
+		}
+		r.stream, r.streamFile, r.streamSegment, r.streamPosition = zr, f, i, 0
+	}
+	skipped, err := io.CopyN(io.Discard, r.stream, position-r.streamPosition)
+	r.streamPosition += skipped
+	return errors.Wrap(err, "failed to read the compressed segment")
+}
+
+func (r *Reader) closeStream() {
+	if r.streamFile != nil {
+		r.streamFile.Close()
+	}
+	r.stream, r.streamFile = nil, nil
+}
+
+// Close closes the files of the output
+func (r *Reader) Close() error {
+	r.closeStream()
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+// Size returns the size of the decompressed output at path, 0 if there is none
+func Size(path string) (int64, error) {
+	r, err := Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer r.Close()
+	return r.Size()
+}
@@ -0,0 +1,122 @@
+package outputfile
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func newContext() *log.Context {
+	return log.NewContext(log.NewNopLogger())
+}
+
+func readAll(t *testing.T, path string) string {
+	r, err := Open(path)
+	require.Nil(t, err)
+	defer r.Close()
+	size, err := r.Size()
+	require.Nil(t, err)
+	b, err := io.ReadAll(io.NewSectionReader(r, 0, size))
+	require.Nil(t, err)
+	return string(b)
+}
+
+func Test_createWithoutCompression(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stdout")
+	w, err := Create(newContext(), path, 0)
+	require.Nil(t, err)
+	_, isFile := w.(*os.File)
+	require.True(t, isFile)
+
+	_, err = w.Write([]byte("output"))
+	require.Nil(t, err)
+	require.Nil(t, w.Close())
+	require.Equal(t, "output", readAll(t, path))
+	require.Equal(t, []string{path}, Files(path))
+}
+
+func Test_rotatingWriterCompressesSegments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stdout")
+	w, err := Create(newContext(), path, 10)
+	require.Nil(t, err)
+
+	output := strings.Repeat("0123456789", 3) + "tail"
+	_, err = w.Write([]byte(output[:15]))
+	require.Nil(t, err)
+	_, err = w.Write([]byte(output[15:]))
+	require.Nil(t, err)
+	require.Nil(t, w.Close())
+
+	require.Equal(t, []string{path + ".1.gz", path + ".2.gz", path + ".3.gz", path}, Files(path))
+	require.Equal(t, output, readAll(t, path))
+
+	size, err := Size(path)
+	require.Nil(t, err)
+	require.Equal(t, int64(len(output)), size)
+
+	_, err = w.Write([]byte("closed"))
+	require.Equal(t, os.ErrClosed, err)
+}
+
+func Test_readerReadsAcrossSegments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stdout")
+	w, err := Create(newContext(), path, 4)
+	require.Nil(t, err)
+	_, err = w.Write([]byte("abcdefghij"))
+	require.Nil(t, err)
+	require.Nil(t, w.Close())
+	// A segment left uncompressed is read as is
+	require.Nil(t, os.WriteFile(path+".3", []byte("ijkl"), 0600))
+	require.Nil(t, os.WriteFile(path, []byte("mn"), 0600))
+
+	r, err := Open(path)
+	require.Nil(t, err)
+	defer r.Close()
+
+	b := make([]byte, 4)
+	n, err := r.ReadAt(b, 2)
+	require.Nil(t, err)
+	require.Equal(t, "cdef", string(b[:n]))
+	n, err = r.ReadAt(b, 7)
+	require.Nil(t, err)
+	require.Equal(t, "hijk", string(b[:n]))
+	n, err = r.ReadAt(b, 0)
+	require.Nil(t, err)
+	require.Equal(t, "abcd", string(b[:n]))
+	n, err = r.ReadAt(b, 12)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, "mn", string(b[:n]))
+}
+
+func Test_openMissingOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stdout")
+	_, err := Open(path)
+	require.True(t, os.IsNotExist(err))
+
+	size, err := Size(path)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), size)
+}
+
+func Test_removeDeletesSegments(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "stdout")
+	for _, f := range []string{path, path + ".1.gz", path + ".2", path + ".3.gz.tmp", path + ".other", filepath.Join(dir, "stderr.1.gz")} {
+		require.Nil(t, os.WriteFile(f, nil, 0600))
+	}
+
+	require.Nil(t, Remove(path))
+	require.Nil(t, Remove(path))
+	entries, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	require.Equal(t, []string{"stderr.1.gz", "stdout.other"}, names)
+}
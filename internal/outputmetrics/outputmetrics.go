@@ -0,0 +1,209 @@
+// Package outputmetrics extracts named metrics from the output of a script (e.g., patched_packages=42), so a run
+// command can collect data reported in its instance view and telemetry without parsing its output.
+package outputmetrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MaxExtractors bounds the metrics a run command can extract
+	MaxExtractors = 20
+
+	// MaxValueLength truncates the values of the metrics, which are meant to be short (e.g., a number)
+	MaxValueLength = 256
+)
+
+var (
+	namePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]{0,63}$`)
+
+	// pathSegmentPattern matches a member (.name or name) or an index ([0]) of a JSON path
+	pathSegmentPattern = regexp.MustCompile(`^(?:\.?([^.\[\]]+)|\[(\d+)\])`)
+)
+
+// Metric is a value extracted from the output
+type Metric struct {
+	Name  string
+	Value string
+}
+
+// Extractor extracts a metric from the output, with either a regular expression or a JSON path
+type Extractor struct {
+	name  string
+	regex *regexp.Regexp
+	path  []pathSegment
+}
+
+// pathSegment is a member or an index of a JSON path
+type pathSegment struct {
+	member string
+	index  int
+}
+
+// New returns the extractor of the metric name. The value of the metric is either the first group captured by the
+// last match of regex (the whole match without a group), or the value at jsonPath (e.g., $.summary.patched or
+// results[0].name) of the output, or of its last line which is a JSON document.
+func New(name string, regex string, jsonPath string) (Extractor, error) {
+	if !namePattern.MatchString(name) {
+		return Extractor{}, errors.Errorf("invalid metric name '%s', it must start with a letter or _ and contain at most 64 letters, digits, _, . or -", name)
+	}
+	if (regex == "") == (jsonPath == "") {
+		return Extractor{}, errors.Errorf("metric '%s' must have exactly one of a regex or a JSON path", name)
+	}
+
+	e := Extractor{name: name}
+	if regex != "" {
+		r, err := regexp.Compile(regex)
+		if err != nil {
+			return Extractor{}, errors.Wrapf(err, "metric '%s' has an invalid regex", name)
+		}
+		e.regex = r
+		return e, nil
+	}
+
+	path, err := parsePath(jsonPath)
+	if err != nil {
+		return Extractor{}, errors.Wrapf(err, "metric '%s' has an invalid JSON path", name)
+	}
+	e.path = path
+	return e, nil
+}
+
+// Name returns the name of the metric
+func (e Extractor) Name() string {
+	return e.name
+}
+
+// Extract returns the value of the metric in the output, if found
+func (e Extractor) Extract(output []byte) (string, bool) {
+	var value string
+	var ok bool
+	if e.regex != nil {
+		value, ok = e.extractRegex(output)
+	} else {
+		value, ok = e.extractJSON(output)
+	}
+	if len(value) > MaxValueLength {
+		value = strings.ToValidUTF8(value[:MaxValueLength], "")
+	}
+	return value, ok
+}
+
+func (e Extractor) extractRegex(output []byte) (string, bool) {
+	matches := e.regex.FindAllSubmatch(output, -1)
+	if len(matches) == 0 {
+		return "", false
+	}
+	last := matches[len(matches)-1]
+	if len(last) > 1 {
+		return string(last[1]), true
+	}
+	return string(last[0]), true
+}
+
+func (e Extractor) extractJSON(output []byte) (string, bool) {
+	document, ok := lastJSONDocument(output)
+	if !ok {
+		return "", false
+	}
+	for _, segment := range e.path {
+		switch v := document.(type) {
+		case map[string]interface{}:
+			if segment.member == "" {
+				return "", false
+			}
+			if document, ok = v[segment.member]; !ok {
+				return "", false
+			}
+		case []interface{}:
+			if segment.member != "" || segment.index >= len(v) {
+				return "", false
+			}
+			document = v[segment.index]
+		default:
+			return "", false
+		}
+	}
+
+	switch v := document.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	// Neither null, objects nor arrays are metrics
+	return "", false
+}
+
+// lastJSONDocument returns the output decoded as a JSON document, or else its last line which is one
+func lastJSONDocument(output []byte) (interface{}, bool) {
+	if document, ok := decode(output); ok {
+		return document, true
+	}
+	lines := bytes.Split(output, []byte("\n"))
+	for i := len(lines) - 1; i >= 0; i-- {
+		if document, ok := decode(lines[i]); ok {
+			return document, true
+		}
+	}
+	return nil, false
+}
+
+func decode(b []byte) (interface{}, bool) {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 || (b[0] != '{' && b[0] != '[') {
+		return nil, false
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var document interface{}
+	if err := d.Decode(&document); err != nil || d.More() {
+		return nil, false
+	}
+	return document, true
+}
+
+func parsePath(jsonPath string) ([]pathSegment, error) {
+	rest := strings.TrimPrefix(jsonPath, "$")
+	if rest == "" {
+		return nil, errors.Errorf("'%s' does not select a value", jsonPath)
+	}
+	var path []pathSegment
+	for rest != "" {
+		match := pathSegmentPattern.FindStringSubmatch(rest)
+		if match == nil {
+			return nil, errors.Errorf("'%s' must be a path of members and indexes such as $.results[0].name", jsonPath)
+		}
+		if match[2] != "" {
+			index, err := strconv.Atoi(match[2])
+			if err != nil {
+				return nil, errors.Errorf("'%s' has an invalid index", jsonPath)
+			}
+			path = append(path, pathSegment{index: index})
+		} else {
+			path = append(path, pathSegment{member: match[1]})
+		}
+		rest = rest[len(match[0]):]
+	}
+	return path, nil
+}
+
+// Extract returns the metrics extracted from the output, in the order of the extractors. The metrics not found in
+// the output are left out.
+func Extract(extractors []Extractor, output []byte) []Metric {
+	var metrics []Metric
+	for _, e := range extractors {
+		if value, ok := e.Extract(output); ok {
+			metrics = append(metrics, Metric{Name: e.name, Value: value})
+		}
+	}
+	return metrics
+}
@@ -0,0 +1,88 @@
+package outputmetrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_regexExtractsLastMatch(t *testing.T) {
+	e, err := New("patched_packages", `patched=(\d+)`, "")
+	require.Nil(t, err)
+	require.Equal(t, "patched_packages", e.Name())
+
+	value, ok := e.Extract([]byte("patched=1\npatched=42\ndone\n"))
+	require.True(t, ok)
+	require.Equal(t, "42", value)
+
+	_, ok = e.Extract([]byte("nothing to patch\n"))
+	require.False(t, ok)
+
+	// Without a group, the value is the whole match
+	e, err = New("kernel", `\d+\.\d+\.\d+`, "")
+	require.Nil(t, err)
+	value, ok = e.Extract([]byte("kernel 5.15.0-1019-azure\n"))
+	require.True(t, ok)
+	require.Equal(t, "5.15.0", value)
+}
+
+func Test_jsonPathExtractsValue(t *testing.T) {
+	output := []byte("installing...\n{\"summary\": {\"patched\": 42, \"reboot\": true}, \"results\": [{\"name\": \"openssl\"}]}\n")
+	for path, expected := range map[string]string{
+		"$.summary.patched":  "42",
+		"summary.reboot":     "true",
+		"$.results[0].name":  "openssl",
+		"$['results']":       "",
+		"$.results[1].name":  "",
+		"$.summary":          "",
+		"$.summary.patched2": "",
+	} {
+		e, err := New("metric", "", path)
+		if expected == "" && err != nil {
+			continue
+		}
+		require.Nil(t, err, path)
+		value, ok := e.Extract(output)
+		require.Equal(t, expected != "", ok, path)
+		require.Equal(t, expected, value, path)
+	}
+
+	// The whole output may be a single document
+	e, err := New("count", "", "$[1]")
+	require.Nil(t, err)
+	value, ok := e.Extract([]byte("[\n  1,\n  2.5\n]\n"))
+	require.True(t, ok)
+	require.Equal(t, "2.5", value)
+}
+
+func Test_newValidatesExtractor(t *testing.T) {
+	_, err := New("1metric", "x", "")
+	require.Error(t, err)
+	_, err = New("metric", "x", "$.x")
+	require.EqualError(t, err, "metric 'metric' must have exactly one of a regex or a JSON path")
+	_, err = New("metric", "", "")
+	require.Error(t, err)
+	_, err = New("metric", "(", "")
+	require.Error(t, err)
+	_, err = New("metric", "", "$")
+	require.Error(t, err)
+	_, err = New("metric", "", "$.a..b")
+	require.Error(t, err)
+}
+
+func Test_extractTruncatesValues(t *testing.T) {
+	e, err := New("long", `value=(.*)`, "")
+	require.Nil(t, err)
+	metrics := Extract([]Extractor{e}, []byte("value="+strings.Repeat("x", 1000)))
+	require.Len(t, metrics, 1)
+	require.Len(t, metrics[0].Value, MaxValueLength)
+}
+
+func Test_extractLeavesOutMissingMetrics(t *testing.T) {
+	found, err := New("found", `found=(\w+)`, "")
+	require.Nil(t, err)
+	missing, err := New("missing", `missing=(\w+)`, "")
+	require.Nil(t, err)
+	require.Equal(t, []Metric{{Name: "found", Value: "yes"}}, Extract([]Extractor{missing, found}, []byte("found=yes\n")))
+}
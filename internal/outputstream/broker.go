@@ -0,0 +1,126 @@
+// Package outputstream publishes the output of the scripts line by line as they execute, so local
+// clients (e.g., the logs subcommand) can follow it in real time instead of polling the output files.
+package outputstream
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/Azure/run-command-handler-linux/pkg/encodingutil"
+)
+
+const (
+	Stdout = "stdout"
+	Stderr = "stderr"
+
+	// subscriberBufferSize is the number of lines a subscriber can lag behind before lines are dropped for it
+	subscriberBufferSize = 1024
+
+	// maxLineLength splits lines that are too long so a script that never writes a new line is still streamed
+	maxLineLength = 64 * 1024
+)
+
+// Line is a line of output written by a script
+type Line struct {
+	// Dir is the execution directory of the script, which identifies the extension and sequence number
+	Dir    string `json:"-"`
+	Stream string `json:"stream"`
+	Text   string `json:"text"`
+}
+
+// Broker fans out the published lines to the subscribers. Publishing never blocks: a subscriber
+// that does not keep up misses lines rather than slowing down the script.
+type Broker struct {
+	mu          sync.Mutex
+	subscribers map[*subscription]bool
+}
+
+type subscription struct {
+	match func(Line) bool
+	lines chan Line
+}
+
+// NewBroker returns a broker without subscribers
+func NewBroker() *Broker {
+	return &Broker{subscribers: make(map[*subscription]bool)}
+}
+
+// Publish sends l to every subscriber it matches
+func (b *Broker) Publish(l Line) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subscribers {
+		if !s.match(l) {
+			continue
+		}
+		select {
+		case s.lines <- l:
+		default:
+		}
+	}
+}
+
+// Subscribe returns the lines published from now on that match, and a function to stop receiving them
+func (b *Broker) Subscribe(match func(Line) bool) (<-chan Line, func()) {
+	s := &subscription{match: match, lines: make(chan Line, subscriberBufferSize)}
+	b.mu.Lock()
+	b.subscribers[s] = true
+	b.mu.Unlock()
+
+	return s.lines, func() {
+		b.mu.Lock()
+		delete(b.subscribers, s)
+		b.mu.Unlock()
+	}
+}
+
+// Publisher receives the lines written to a LineWriter, e.g., a Broker
+type Publisher interface {
+	Publish(l Line)
+}
+
+// LineWriter publishes the data written to it as lines of the given stream
+type LineWriter struct {
+	broker Publisher
+	dir    string
+	stream string
+	buf    []byte
+}
+
+// NewLineWriter returns a writer publishing to broker the lines written by the script executing in dir
+func NewLineWriter(broker Publisher, dir string, stream string) *LineWriter {
+	return &LineWriter{broker: broker, dir: dir, stream: stream}
+}
+
+// Write publishes every complete line in p and keeps the rest until the line is completed
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.publish(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+
+	if len(w.buf) >= maxLineLength {
+		w.publish(w.buf)
+		w.buf = nil
+	}
+	return len(p), nil
+}
+
+// Close publishes the last line, even if incomplete
+func (w *LineWriter) Close() error {
+	if len(w.buf) > 0 {
+		w.publish(w.buf)
+		w.buf = nil
+	}
+	return nil
+}
+
+func (w *LineWriter) publish(line []byte) {
+	line = bytes.TrimSuffix(line, []byte{'\r'})
+	w.broker.Publish(Line{Dir: w.dir, Stream: w.stream, Text: string(encodingutil.ToValidUTF8(line))})
+}
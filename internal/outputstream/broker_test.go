@@ -0,0 +1,60 @@
+package outputstream
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func matchAll(Line) bool { return true }
+
+func Test_lineWriterPublishesCompleteLines(t *testing.T) {
+	b := NewBroker()
+	lines, unsubscribe := b.Subscribe(matchAll)
+	defer unsubscribe()
+
+	w := NewLineWriter(b, "/dir/0", Stdout)
+	w.Write([]byte("first\r\nsec"))
+	w.Write([]byte("ond\nthi"))
+	require.Equal(t, Line{Dir: "/dir/0", Stream: Stdout, Text: "first"}, <-lines)
+	require.Equal(t, "second", (<-lines).Text)
+	require.Len(t, lines, 0)
+
+	w.Close()
+	require.Equal(t, "thi", (<-lines).Text)
+}
+
+func Test_lineWriterSplitsLongLines(t *testing.T) {
+	b := NewBroker()
+	lines, unsubscribe := b.Subscribe(matchAll)
+	defer unsubscribe()
+
+	w := NewLineWriter(b, "/dir/0", Stderr)
+	w.Write([]byte(strings.Repeat("a", maxLineLength)))
+	require.Len(t, (<-lines).Text, maxLineLength)
+}
+
+func Test_brokerFiltersAndUnsubscribes(t *testing.T) {
+	b := NewBroker()
+	lines, unsubscribe := b.Subscribe(func(l Line) bool { return l.Dir == "/a/0" })
+
+	b.Publish(Line{Dir: "/b/0", Text: "other"})
+	b.Publish(Line{Dir: "/a/0", Text: "mine"})
+	require.Equal(t, "mine", (<-lines).Text)
+	require.Len(t, lines, 0)
+
+	unsubscribe()
+	b.Publish(Line{Dir: "/a/0", Text: "late"})
+	require.Len(t, lines, 0)
+}
+
+func Test_brokerDoesNotBlockOnSlowSubscribers(t *testing.T) {
+	b := NewBroker()
+	_, unsubscribe := b.Subscribe(matchAll)
+	defer unsubscribe()
+
+	for i := 0; i < subscriberBufferSize+10; i++ {
+		b.Publish(Line{Text: "line"})
+	}
+}
@@ -0,0 +1,121 @@
+package outputstream
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// FollowRequest is sent by a client over the socket to follow the output of an extension
+type FollowRequest struct {
+	ExtensionName string `json:"extensionName"`
+}
+
+// matches reports whether l was written by a script of the requested extension
+func (r FollowRequest) matches(l Line) bool {
+	extensionDir := filepath.Dir(l.Dir)
+	return extensionDir == datapaths.DownloadPath(constants.DataDir, constants.ImmediateDownloadFolder, r.ExtensionName) ||
+		extensionDir == datapaths.DownloadPath(constants.DataDir, constants.DownloadFolder, r.ExtensionName)
+}
+
+// ListenAndServe serves the lines published to broker over a unix socket at socketPath, which only root
+// can connect to. Each client sends a FollowRequest and receives the matching lines as JSON until it disconnects.
+func ListenAndServe(ctx *log.Context, socketPath string, broker *Broker) error {
+	// A socket left by a previous instance of the service would make listening fail
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove existing output stream socket")
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen on output stream socket")
+	}
+	defer listener.Close()
+
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		return errors.Wrap(err, "failed to restrict access to output stream socket")
+	}
+
+	ctx.Log("message", "serving script output", "socket", socketPath)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return errors.Wrap(err, "failed to accept output stream connection")
+		}
+		go serve(ctx, conn, broker)
+	}
+}
+
+func serve(ctx *log.Context, conn net.Conn, broker *Broker) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	var request FollowRequest
+	if err := json.NewDecoder(reader).Decode(&request); err != nil {
+		ctx.Log("warning", "invalid output stream request", "error", err)
+		return
+	}
+
+	lines, unsubscribe := broker.Subscribe(request.matches)
+	defer unsubscribe()
+
+	// The client does not send anything else, so the read only returns when it disconnects
+	disconnected := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, reader)
+		close(disconnected)
+	}()
+
+	encoder := json.NewEncoder(conn)
+	for {
+		select {
+		case <-disconnected:
+			return
+		case l := <-lines:
+			if err := encoder.Encode(l); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Follow connects to the socket at socketPath and copies the output of the scripts of the extension to stdout
+// and stderr as it is written. It returns when the connection is closed.
+func Follow(socketPath string, extensionName string, stdout io.Writer, stderr io.Writer) error {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to the run command service. Make sure the service is running")
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(FollowRequest{ExtensionName: extensionName}); err != nil {
+		return errors.Wrap(err, "failed to send output stream request")
+	}
+
+	decoder := json.NewDecoder(conn)
+	for {
+		var l Line
+		if err := decoder.Decode(&l); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.Wrap(err, "failed to read output stream")
+		}
+
+		w := stdout
+		if l.Stream == Stderr {
+			w = stderr
+		}
+		if _, err := io.WriteString(w, l.Text+"\n"); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package outputstream
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_followRequestMatches(t *testing.T) {
+	r := FollowRequest{ExtensionName: "rc1"}
+	require.True(t, r.matches(Line{Dir: datapaths.SeqNumDir(datapaths.DownloadPath(constants.DataDir, constants.ImmediateDownloadFolder, "rc1"), 3)}))
+	require.True(t, r.matches(Line{Dir: datapaths.SeqNumDir(datapaths.DownloadPath(constants.DataDir, constants.DownloadFolder, "rc1"), 0)}))
+	require.False(t, r.matches(Line{Dir: datapaths.SeqNumDir(datapaths.DownloadPath(constants.DataDir, constants.DownloadFolder, "rc2"), 0)}))
+}
+
+func Test_listenAndServeStreamsLines(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "service.sock")
+	b := NewBroker()
+	go ListenAndServe(log.NewContext(log.NewNopLogger()), socketPath, b)
+
+	var conn net.Conn
+	require.Eventually(t, func() bool {
+		var err error
+		conn, err = net.Dial("unix", socketPath)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	defer conn.Close()
+	require.Nil(t, json.NewEncoder(conn).Encode(FollowRequest{ExtensionName: "rc1"}))
+
+	// Publish until the server has subscribed
+	dir := datapaths.SeqNumDir(datapaths.DownloadPath(constants.DataDir, constants.ImmediateDownloadFolder, "rc1"), 1)
+	received := make(chan Line)
+	go func() {
+		var l Line
+		if json.NewDecoder(conn).Decode(&l) == nil {
+			received <- l
+		}
+	}()
+
+	var l Line
+	require.Eventually(t, func() bool {
+		b.Publish(Line{Dir: dir, Stream: Stderr, Text: "hello"})
+		select {
+		case l = <-received:
+			return true
+		default:
+			return false
+		}
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, Stderr, l.Stream)
+	require.Equal(t, "hello", l.Text)
+}
+
+func Test_followWritesToStreams(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "service.sock")
+	listener, err := net.Listen("unix", socketPath)
+	require.Nil(t, err)
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var request FollowRequest
+		json.NewDecoder(conn).Decode(&request)
+		encoder := json.NewEncoder(conn)
+		encoder.Encode(Line{Stream: Stdout, Text: "out " + request.ExtensionName})
+		encoder.Encode(Line{Stream: Stderr, Text: "err"})
+	}()
+
+	var stdout, stderr bytes.Buffer
+	require.Nil(t, Follow(socketPath, "rc1", &stdout, &stderr))
+	require.Equal(t, "out rc1\n", stdout.String())
+	require.Equal(t, "err\n", stderr.String())
+}
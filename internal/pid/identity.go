@@ -0,0 +1,67 @@
+package pid
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// startTimeStatField is the index of the start time (in clock ticks after boot) in /proc/<pid>/stat,
+// counting from the state field which follows the executable name
+const startTimeStatField = 19
+
+// deletedExeSuffix is appended by the kernel to the executable path once the file is removed (e.g., after
+// the handler is upgraded), which does not make the process a different one
+const deletedExeSuffix = " (deleted)"
+
+// procDir is where the process information is read from
+var procDir = "/proc"
+
+// ProcessIdentity identifies a process beyond its pid, which the kernel recycles
+type ProcessIdentity struct {
+	Pid int
+
+	// StartTime is the start time of the process in clock ticks after boot
+	StartTime string
+
+	// Exe is the path of the executable of the process
+	Exe string
+
+	// Cmdline is the command line of the process with its arguments separated by spaces
+	Cmdline string
+}
+
+// GetProcessIdentity reads the identity of the active process with the given pid from /proc
+func GetProcessIdentity(pid int) (ProcessIdentity, error) {
+	identity := ProcessIdentity{Pid: pid}
+	dir := filepath.Join(procDir, strconv.Itoa(pid))
+
+	stat, err := os.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return identity, errors.Wrapf(err, "failed to read stat of process %d", pid)
+	}
+	// The executable name is in parentheses and may contain spaces and parentheses itself
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	if len(fields) <= startTimeStatField {
+		return identity, errors.Errorf("unexpected format of stat of process %d", pid)
+	}
+	identity.StartTime = fields[startTimeStatField]
+
+	exe, err := os.Readlink(filepath.Join(dir, "exe"))
+	if err != nil {
+		return identity, errors.Wrapf(err, "failed to read executable of process %d", pid)
+	}
+	identity.Exe = strings.TrimSuffix(exe, deletedExeSuffix)
+
+	cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline"))
+	if err != nil {
+		return identity, errors.Wrapf(err, "failed to read command line of process %d", pid)
+	}
+	identity.Cmdline = strings.TrimRight(strings.ReplaceAll(string(cmdline), "\x00", " "), " ")
+
+	return identity, nil
+}
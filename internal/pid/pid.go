@@ -8,7 +8,10 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/Azure/run-command-handler-linux/internal/proctree"
+	"github.com/Azure/run-command-handler-linux/pkg/atomicfile"
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 )
@@ -16,6 +19,9 @@ import (
 const (
 	// chmod is used to set the mode bits for new seqnum files.
 	chmod = os.FileMode(0600)
+
+	// terminatePollInterval is how often the scripts being terminated are checked for exit
+	terminatePollInterval = 200 * time.Millisecond
 )
 
 // GetProcessStartTime returns the start time of the active process if still active
@@ -28,18 +34,17 @@ func GetProcessStartTime(pid int) (string, error) {
 	return string(startTime), nil
 }
 
-// SaveCurrentPidAndStartTime stores current process id with start date in file extName.pid
-// Example: 325	Tue Dec  8 15:54:04 2020
+// SaveCurrentPidAndStartTime stores current process id with its start time, executable and command line
+// in file extName.pid, so the process is not confused with an unrelated one reusing its pid
+// Example: 325	4711	/var/lib/waagent/Microsoft.CPlat.Core.RunCommandHandlerLinux-1.3.2/bin/run-command-handler	bin/run-command-handler enable
 func SaveCurrentPidAndStartTime(path string) error {
-	pid := os.Getpid()
-	pidString := fmt.Sprintf("%d", pid)
-	startTime, err := GetProcessStartTime(pid)
+	identity, err := GetProcessIdentity(os.Getpid())
 	if err != nil {
-		return errors.Wrap(err, "failed to execute bash ps command")
+		return errors.Wrap(err, "failed to get current process identity")
 	}
 
-	b := []byte(fmt.Sprintf("%s\t%s", pidString, startTime))
-	return errors.Wrap(os.WriteFile(path, b, chmod), "extName.pid: failed to write")
+	b := []byte(fmt.Sprintf("%d\t%s\t%s\t%s", identity.Pid, identity.StartTime, identity.Exe, identity.Cmdline))
+	return errors.Wrap(atomicfile.WriteFile(path, b, chmod), "extName.pid: failed to write")
 }
 
 // DeleteCurrentPidAndStartTime delete the file created by SaveCurrentPidAndStartTime
@@ -47,43 +52,82 @@ func DeleteCurrentPidAndStartTime(path string) error {
 	return errors.Wrap(os.Remove(path), "failed to delete "+path)
 }
 
+// DeleteCurrentPidAndStartTimeIfOwned deletes the file created by SaveCurrentPidAndStartTime unless another
+// process has recorded itself since (e.g., a newer execution that left this one running)
+func DeleteCurrentPidAndStartTimeIfOwned(path string) error {
+	recordedPid, _, err := ReadPidAndStartTime(path)
+	if err != nil {
+		return err
+	}
+	if recordedPid != os.Getpid() {
+		return nil
+	}
+	return DeleteCurrentPidAndStartTime(path)
+}
+
 // ReadPidAndStartTime reads the stored pid and process start time from a file extName.pid
 // Returns 0 and "" if path not found
 func ReadPidAndStartTime(path string) (int, string, error) {
+	identity, _, err := ReadProcessIdentity(path)
+	return identity.Pid, identity.StartTime, err
+}
+
+// ReadProcessIdentity reads the process identity stored in a file extName.pid. Files written by previous
+// versions only have the pid and the start time reported by ps, in which case legacy is true.
+// Returns an empty identity if path not found
+func ReadProcessIdentity(path string) (identity ProcessIdentity, legacy bool, _ error) {
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return 0, "", nil
+			return identity, false, nil
 		}
-		return 0, "", errors.Wrap(err, "extName.pid: failed to read:"+path)
+		return identity, false, errors.Wrap(err, "extName.pid: failed to read:"+path)
 	}
-	data := strings.Split(string(b), "\t")
-	if len(data) != 2 {
-		return 0, "", errors.Wrap(err, "unexpected format in extName.pid:"+string(b))
+
+	// The command line is last as it may contain tabs
+	data := strings.SplitN(string(b), "\t", 4)
+	if len(data) != 2 && len(data) != 4 {
+		return identity, false, errors.New("unexpected format in extName.pid:" + string(b))
 	}
 
 	pid, err := strconv.Atoi(data[0])
 	if err != nil {
-		return 0, "", errors.Wrap(err, "failed to convert pid:"+data[0])
+		return identity, false, errors.Wrap(err, "failed to convert pid:"+data[0])
+	}
+
+	identity.Pid = pid
+	identity.StartTime = data[1]
+	if len(data) == 2 {
+		return identity, true, nil
 	}
-	return pid, data[1], nil
+	identity.Exe = data[2]
+	identity.Cmdline = data[3]
+	return identity, false, nil
 }
 
-// IsExtensionStillRunning checks if there is active process for the same extension name
+// IsExtensionStillRunning checks if there is active process for the same extension name. The active process
+// must match the recorded start time, executable and command line, not only the pid.
 func IsExtensionStillRunning(path string) bool {
 	// Check if we have a file record for previous process
-	previousPid, previousStartTime, err := ReadPidAndStartTime(path)
-	if err != nil || previousPid == 0 || previousStartTime == "" {
+	previous, legacy, err := ReadProcessIdentity(path)
+	if err != nil || previous.Pid == 0 || previous.StartTime == "" {
 		return false
 	}
 
-	// Try to get previous process start time
-	startTime, err := GetProcessStartTime(previousPid)
-	if err != nil || startTime == "" {
-		return false
+	if legacy {
+		// Try to get previous process start time
+		startTime, err := GetProcessStartTime(previous.Pid)
+		if err != nil || startTime == "" {
+			return false
+		}
+		return startTime == previous.StartTime
 	}
 
-	return startTime == previousStartTime
+	current, err := GetProcessIdentity(previous.Pid)
+	if err != nil {
+		return false
+	}
+	return current == previous
 }
 
 // KillPreviousExtension handles the case where a process for the same extension name is still active from previous execution.
@@ -94,7 +138,47 @@ func KillPreviousExtension(ctx *log.Context, pidFilePath string) {
 		if ctx != nil {
 			ctx.Log("event", "check process", "Active previous execution found. Killing pid ", previousPid)
 		}
+		// The scripts lead their own process groups, which are killed along with the one of the previous process
+		signalChildProcessGroups(previousPid, syscall.SIGKILL)
 		syscall.Kill(-previousPid, syscall.SIGKILL) // Negative pid means kill the whole process group
 		DeleteCurrentPidAndStartTime(pidFilePath)
 	}
 }
+
+// TerminateExtensionScripts stops the scripts of the active process recorded in the pid file, gracefully: their
+// process groups are sent SIGTERM, then SIGKILL once the grace period expires. The process itself keeps running to
+// report the outcome of its scripts. It returns false when there is no active process.
+func TerminateExtensionScripts(ctx *log.Context, pidFilePath string, grace time.Duration) bool {
+	if !IsExtensionStillRunning(pidFilePath) {
+		return false
+	}
+	extensionPid, _, _ := ReadPidAndStartTime(pidFilePath)
+	TerminateScripts(ctx, extensionPid, grace)
+	return true
+}
+
+// TerminateScripts stops the scripts started by the process with the given pid, e.g., the service, like
+// TerminateExtensionScripts
+func TerminateScripts(ctx *log.Context, parentPid int, grace time.Duration) {
+	ctx.Log("event", "terminating the scripts", "pid", parentPid, "gracePeriod", grace)
+	signalChildProcessGroups(parentPid, syscall.SIGTERM)
+
+	for deadline := time.Now().Add(grace); time.Now().Before(deadline); time.Sleep(terminatePollInterval) {
+		if children, err := proctree.Children(parentPid); err != nil || len(children) == 0 {
+			return
+		}
+	}
+	ctx.Log("event", "the scripts did not exit within the grace period, killing them", "pid", parentPid)
+	signalChildProcessGroups(parentPid, syscall.SIGKILL)
+}
+
+// signalChildProcessGroups signals the process groups led by the children of the given process, i.e., its scripts
+func signalChildProcessGroups(parentPid int, signal syscall.Signal) {
+	children, err := proctree.Children(parentPid)
+	if err != nil {
+		return
+	}
+	for _, child := range children {
+		syscall.Kill(-child.Pid, signal)
+	}
+}
@@ -6,8 +6,11 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/go-kit/kit/log"
 	"github.com/stretchr/testify/require"
 )
 
@@ -23,11 +26,60 @@ func Test_SaveAndReadPid(t *testing.T) {
 	pid, date, err := ReadPidAndStartTime(path)
 	require.Nil(t, err, "ReadPidAndStartTime failed")
 
-	expectedPid := os.Getpid()
-	pidString := fmt.Sprintf("%d", pid)
-	expectedStartTime, err := exec.Command("bash", "-c", "ps -o lstart= -p "+pidString).Output()
-	require.Equal(t, expectedPid, pid)
-	require.Equal(t, string(expectedStartTime), date)
+	expected, err := GetProcessIdentity(os.Getpid())
+	require.Nil(t, err)
+	require.Equal(t, os.Getpid(), pid)
+	require.Equal(t, expected.StartTime, date)
+
+	identity, legacy, err := ReadProcessIdentity(path)
+	require.Nil(t, err)
+	require.False(t, legacy)
+	require.Equal(t, expected, identity)
+}
+
+func Test_IsExtensionStillRunning_identityMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "extName.pid")
+	identity, err := GetProcessIdentity(os.Getpid())
+	require.Nil(t, err)
+
+	// Same pid but a different process (e.g., the pid was recycled)
+	for _, recorded := range []ProcessIdentity{
+		{Pid: identity.Pid, StartTime: "1", Exe: identity.Exe, Cmdline: identity.Cmdline},
+		{Pid: identity.Pid, StartTime: identity.StartTime, Exe: "/usr/bin/other", Cmdline: identity.Cmdline},
+		{Pid: identity.Pid, StartTime: identity.StartTime, Exe: identity.Exe, Cmdline: "other --arg"},
+	} {
+		require.Nil(t, os.WriteFile(path, []byte(fmt.Sprintf("%d\t%s\t%s\t%s", recorded.Pid, recorded.StartTime, recorded.Exe, recorded.Cmdline)), 0600))
+		require.False(t, IsExtensionStillRunning(path), "%+v", recorded)
+	}
+}
+
+func Test_IsExtensionStillRunning_legacyRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "extName.pid")
+	startTime, err := exec.Command("bash", "-c", fmt.Sprintf("ps -o lstart= -p %d", os.Getpid())).Output()
+	require.Nil(t, err)
+
+	require.Nil(t, os.WriteFile(path, []byte(fmt.Sprintf("%d\t%s", os.Getpid(), startTime)), 0600))
+	_, legacy, err := ReadProcessIdentity(path)
+	require.Nil(t, err)
+	require.True(t, legacy)
+	require.True(t, IsExtensionStillRunning(path))
+}
+
+func Test_GetProcessIdentity_parsesProc(t *testing.T) {
+	defer func(dir string) { procDir = dir }(procDir)
+	procDir = t.TempDir()
+	dir := filepath.Join(procDir, "42")
+	require.Nil(t, os.MkdirAll(dir, 0700))
+
+	// The executable name may contain spaces and parentheses
+	stat := "42 (bad) name) S 1 42 42 0 -1 4194560 100 0 0 0 1 2 0 0 20 0 1 0 987654 1000 100"
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0600))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "cmdline"), []byte("bin/run-command-handler\x00enable\x00"), 0600))
+	require.Nil(t, os.Symlink("/opt/handler/bin/run-command-handler (deleted)", filepath.Join(dir, "exe")))
+
+	identity, err := GetProcessIdentity(42)
+	require.Nil(t, err)
+	require.Equal(t, ProcessIdentity{Pid: 42, StartTime: "987654", Exe: "/opt/handler/bin/run-command-handler", Cmdline: "bin/run-command-handler enable"}, identity)
 }
 
 func Test_IsExtensionStillRunning(t *testing.T) {
@@ -55,3 +107,43 @@ func Test_GetProcessStartTime(t *testing.T) {
 	require.NotNil(t, err)
 	require.Contains(t, err.Error(), "failed to execute bash ps command")
 }
+
+func Test_DeleteCurrentPidAndStartTimeIfOwned(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "extName.pid")
+
+	// Another process recorded itself since
+	require.Nil(t, os.WriteFile(path, []byte("1\tThu Jan  1 00:00:00 1970"), 0600))
+	require.Nil(t, DeleteCurrentPidAndStartTimeIfOwned(path))
+	_, err := os.Stat(path)
+	require.Nil(t, err, "file of another process should be kept")
+
+	require.Nil(t, SaveCurrentPidAndStartTime(path))
+	require.Nil(t, DeleteCurrentPidAndStartTimeIfOwned(path))
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+
+	// Nothing to delete
+	require.Nil(t, DeleteCurrentPidAndStartTimeIfOwned(path))
+}
+
+func Test_TerminateExtensionScripts(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	path := filepath.Join(t.TempDir(), "extName.pid")
+	require.False(t, TerminateExtensionScripts(ctx, path, time.Second), "no active process")
+
+	require.Nil(t, SaveCurrentPidAndStartTime(path))
+	script := exec.Command("sleep", "30")
+	script.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	require.Nil(t, script.Start())
+	exited := make(chan error, 1)
+	go func() { exited <- script.Wait() }()
+
+	require.True(t, TerminateExtensionScripts(ctx, path, 5*time.Second))
+	select {
+	case err := <-exited:
+		require.EqualError(t, err, "signal: terminated")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the script was not terminated")
+	}
+	require.True(t, IsExtensionStillRunning(path), "the process itself keeps running")
+}
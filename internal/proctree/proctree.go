@@ -0,0 +1,152 @@
+// Package proctree takes snapshots of the process tree of a script from /proc to help diagnose
+// scripts that hang on child processes.
+package proctree
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// userHz is the unit of the times reported in /proc/<pid>/stat
+	userHz = 100
+
+	// Indexes of the fields of /proc/<pid>/stat counting from the state field, which follows the executable name
+	stateStatField = 0
+	ppidStatField  = 1
+	utimeStatField = 11
+	stimeStatField = 12
+	rssStatField   = 21
+
+	// maxSummaryProcesses bounds the length of the summary reported in the status
+	maxSummaryProcesses = 10
+)
+
+// procDir is where the process information is read from
+var procDir = "/proc"
+
+// Process is a process of the tree
+type Process struct {
+	Pid        int
+	PPid       int
+	Name       string
+	State      string // e.g., R (running), S (sleeping), Z (zombie)
+	CPUSeconds float64
+	RSSBytes   int64
+}
+
+// Snapshot returns the process with the given pid followed by all its descendants, parents before children
+func Snapshot(rootPid int) ([]Process, error) {
+	processes, children, err := listProcesses()
+	if err != nil {
+		return nil, err
+	}
+
+	root, ok := processes[rootPid]
+	if !ok {
+		return nil, errors.Errorf("process %d is not running", rootPid)
+	}
+
+	tree := []Process{root}
+	for i := 0; i < len(tree); i++ {
+		pids := children[tree[i].Pid]
+		sort.Ints(pids)
+		for _, pid := range pids {
+			tree = append(tree, processes[pid])
+		}
+	}
+	return tree, nil
+}
+
+// Children returns the direct children of the process with the given pid
+func Children(parentPid int) ([]Process, error) {
+	processes, children, err := listProcesses()
+	if err != nil {
+		return nil, err
+	}
+
+	pids := children[parentPid]
+	sort.Ints(pids)
+	result := make([]Process, 0, len(pids))
+	for _, pid := range pids {
+		result = append(result, processes[pid])
+	}
+	return result, nil
+}
+
+// listProcesses returns every process by pid and the pids of the children of every process
+func listProcesses() (map[int]Process, map[int][]int, error) {
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to list processes")
+	}
+
+	processes := make(map[int]Process)
+	children := make(map[int][]int)
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		// Processes may exit while listing them
+		p, err := readProcess(pid)
+		if err != nil {
+			continue
+		}
+		processes[pid] = p
+		children[p.PPid] = append(children[p.PPid], pid)
+	}
+	return processes, children, nil
+}
+
+// Summarize returns a compact description of the processes, e.g.,
+// "3 processes: bash(1234) cpu=0.12s rss=3.1MiB, sleep(1240) cpu=0.00s rss=0.9MiB, ..."
+func Summarize(processes []Process) string {
+	descriptions := make([]string, 0, maxSummaryProcesses)
+	for i, p := range processes {
+		if i == maxSummaryProcesses {
+			descriptions = append(descriptions, fmt.Sprintf("and %d more", len(processes)-maxSummaryProcesses))
+			break
+		}
+		descriptions = append(descriptions, fmt.Sprintf("%s(%d) cpu=%.2fs rss=%.1fMiB", p.Name, p.Pid, p.CPUSeconds, float64(p.RSSBytes)/(1024*1024)))
+	}
+	return fmt.Sprintf("%d processes: %s", len(processes), strings.Join(descriptions, ", "))
+}
+
+func readProcess(pid int) (Process, error) {
+	p := Process{Pid: pid}
+	stat, err := os.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return p, err
+	}
+
+	// The executable name is in parentheses and may contain spaces and parentheses itself
+	nameStart, nameEnd := bytes.IndexByte(stat, '('), bytes.LastIndexByte(stat, ')')
+	if nameStart < 0 || nameEnd < nameStart {
+		return p, errors.Errorf("unexpected format of stat of process %d", pid)
+	}
+	p.Name = string(stat[nameStart+1 : nameEnd])
+
+	fields := strings.Fields(string(stat[nameEnd+1:]))
+	if len(fields) <= rssStatField {
+		return p, errors.Errorf("unexpected format of stat of process %d", pid)
+	}
+
+	p.State = fields[stateStatField]
+	if p.PPid, err = strconv.Atoi(fields[ppidStatField]); err != nil {
+		return p, errors.Wrapf(err, "invalid parent of process %d", pid)
+	}
+	utime, _ := strconv.ParseInt(fields[utimeStatField], 10, 64)
+	stime, _ := strconv.ParseInt(fields[stimeStatField], 10, 64)
+	p.CPUSeconds = float64(utime+stime) / userHz
+	rss, _ := strconv.ParseInt(fields[rssStatField], 10, 64)
+	p.RSSBytes = rss * int64(os.Getpagesize())
+	return p, nil
+}
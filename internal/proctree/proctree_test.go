@@ -0,0 +1,73 @@
+package proctree
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeStat(t *testing.T, pid int, name string, ppid int, utime int, stime int, rssPages int) {
+	dir := filepath.Join(procDir, fmt.Sprint(pid))
+	require.Nil(t, os.MkdirAll(dir, 0700))
+	stat := fmt.Sprintf("%d (%s) S %d %d %d 0 -1 4194560 100 0 0 0 %d %d 0 0 20 0 1 0 1000 1000 %d 18446744073709551615", pid, name, ppid, pid, pid, utime, stime, rssPages)
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0600))
+}
+
+func Test_snapshotReturnsDescendants(t *testing.T) {
+	defer func(dir string) { procDir = dir }(procDir)
+	procDir = t.TempDir()
+
+	writeStat(t, 10, "bash", 1, 50, 25, 256)
+	writeStat(t, 12, "sleep", 10, 0, 0, 128)
+	writeStat(t, 11, "my (odd) name", 10, 1, 1, 128)
+	writeStat(t, 20, "python3", 11, 100, 0, 1024)
+	writeStat(t, 30, "unrelated", 1, 0, 0, 1)
+
+	processes, err := Snapshot(10)
+	require.Nil(t, err)
+	require.Len(t, processes, 4)
+	require.Equal(t, []int{10, 11, 12, 20}, []int{processes[0].Pid, processes[1].Pid, processes[2].Pid, processes[3].Pid})
+	require.Equal(t, "my (odd) name", processes[1].Name)
+	require.Equal(t, 0.75, processes[0].CPUSeconds)
+	require.Equal(t, int64(256*os.Getpagesize()), processes[0].RSSBytes)
+
+	_, err = Snapshot(99)
+	require.NotNil(t, err)
+
+	children, err := Children(10)
+	require.Nil(t, err)
+	require.Len(t, children, 2)
+	require.Equal(t, 11, children[0].Pid)
+	require.Equal(t, "S", children[0].State)
+}
+
+func Test_snapshotOfRunningProcess(t *testing.T) {
+	cmd := exec.Command("/bin/bash", "-c", "sleep 10 & wait")
+	require.Nil(t, cmd.Start())
+	defer cmd.Process.Kill()
+
+	require.Eventually(t, func() bool {
+		processes, err := Snapshot(cmd.Process.Pid)
+		return err == nil && len(processes) == 2 && processes[1].Name == "sleep"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func Test_summarize(t *testing.T) {
+	processes := []Process{
+		{Pid: 10, Name: "bash", CPUSeconds: 0.125, RSSBytes: 3 * 1024 * 1024},
+		{Pid: 11, Name: "sleep", RSSBytes: 512 * 1024},
+	}
+	require.Equal(t, "2 processes: bash(10) cpu=0.12s rss=3.0MiB, sleep(11) cpu=0.00s rss=0.5MiB", Summarize(processes))
+
+	for i := 0; i < maxSummaryProcesses; i++ {
+		processes = append(processes, Process{Pid: 100 + i, Name: "worker"})
+	}
+	summary := Summarize(processes)
+	require.Contains(t, summary, "12 processes: ")
+	require.Contains(t, summary, ", and 2 more")
+}
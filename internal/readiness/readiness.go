@@ -0,0 +1,155 @@
+// Package readiness publishes the last successful run of every run command extension, so other extensions and
+// agents can wait for a run command (e.g., a bootstrap script) to succeed before doing their part. The markers are
+// files readable by everyone, also served over HTTP on a unix socket by the immediate run command service.
+package readiness
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
+	"github.com/Azure/run-command-handler-linux/pkg/atomicfile"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// readyPath is the path of the endpoint serving the markers: /ready lists them, /ready/<extensionName> returns the
+// marker of an extension (/ready/ for the single-config extension)
+const readyPath = "/ready"
+
+// Marker records the last successful run of an extension
+type Marker struct {
+	ExtensionName  string `json:"extensionName"`
+	SeqNum         int    `json:"seqNum"`
+	CompletedAt    string `json:"completedAt"`
+	ExitCode       int    `json:"exitCode"`
+	ScriptHash     string `json:"scriptHash,omitempty"`
+	HandlerVersion string `json:"handlerVersion"`
+}
+
+// Record replaces the marker of the extension, writing a temporary file moved in place so a reader never sees a
+// partial marker
+func Record(dir string, m Marker) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal the readiness marker")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "failed to create the readiness directory")
+	}
+	path := datapaths.ReadinessMarkerFilePath(dir, m.ExtensionName)
+	return errors.Wrap(atomicfile.WriteFile(path, b, 0644), "failed to save the readiness marker")
+}
+
+// Read returns the marker of the extension. The error satisfies os.IsNotExist if the extension never succeeded.
+func Read(dir string, extensionName string) (Marker, error) {
+	var m Marker
+	b, err := os.ReadFile(datapaths.ReadinessMarkerFilePath(dir, extensionName))
+	if err != nil {
+		return m, err
+	}
+	return m, errors.Wrap(json.Unmarshal(b, &m), "invalid readiness marker")
+}
+
+// List returns the markers of every extension which succeeded, by extension name
+func List(dir string) ([]Marker, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Marker{}, nil
+		}
+		return nil, errors.Wrap(err, "failed to list the readiness markers")
+	}
+	markers := []Marker{}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		var m Marker
+		if json.Unmarshal(b, &m) == nil {
+			markers = append(markers, m)
+		}
+	}
+	sort.Slice(markers, func(i, j int) bool { return markers[i].ExtensionName < markers[j].ExtensionName })
+	return markers, nil
+}
+
+// NewHandler returns the HTTP handler serving the markers of dir. The extensions which never succeeded are not
+// found (404), so a dependent can probe /ready/<extensionName> until it succeeds.
+func NewHandler(dir string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(readyPath, func(w http.ResponseWriter, r *http.Request) {
+		if !allowed(w, r) {
+			return
+		}
+		markers, err := List(dir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, markers)
+	})
+	mux.HandleFunc(readyPath+"/", func(w http.ResponseWriter, r *http.Request) {
+		if !allowed(w, r) {
+			return
+		}
+		m, err := Read(dir, strings.TrimPrefix(r.URL.Path, readyPath+"/"))
+		if os.IsNotExist(errors.Cause(err)) {
+			http.Error(w, "the extension has not succeeded yet", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, m)
+	})
+	return mux
+}
+
+// allowed rejects the methods other than GET and HEAD, the endpoint is read-only
+func allowed(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// ListenAndServe serves the markers of dir over HTTP on a unix socket at socketPath. The markers hold no secret and
+// the endpoint is read-only, so every local user can connect, e.g.:
+//
+//	curl --unix-socket /var/lib/waagent/run-command-handler/readiness.sock http://localhost/ready/RC0001
+func ListenAndServe(ctx *log.Context, socketPath string, dir string) error {
+	// A socket left by a previous instance of the service would make listening fail
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove existing readiness socket")
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen on readiness socket")
+	}
+	defer listener.Close()
+
+	if err := os.Chmod(socketPath, 0666); err != nil {
+		return errors.Wrap(err, "failed to open access to readiness socket")
+	}
+
+	ctx.Log("message", "serving readiness markers", "socket", socketPath)
+	return errors.Wrap(http.Serve(listener, NewHandler(dir)), "failed to serve readiness markers")
+}
@@ -0,0 +1,124 @@
+package readiness
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_recordAndRead(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ready")
+	_, err := Read(dir, "rc1")
+	require.True(t, os.IsNotExist(err))
+
+	marker := Marker{ExtensionName: "rc1", SeqNum: 2, CompletedAt: "2024-01-02T03:04:05Z", HandlerVersion: "1.3.0"}
+	require.Nil(t, Record(dir, marker))
+	read, err := Read(dir, "rc1")
+	require.Nil(t, err)
+	require.Equal(t, marker, read)
+
+	fi, err := os.Stat(filepath.Join(dir, "rc1.json"))
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0644), fi.Mode().Perm(), "the markers are readable by every agent")
+
+	// A later success replaces the marker
+	marker.SeqNum = 3
+	require.Nil(t, Record(dir, marker))
+	read, err = Read(dir, "rc1")
+	require.Nil(t, err)
+	require.Equal(t, 3, read.SeqNum)
+	entries, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	require.Len(t, entries, 1, "no temporary file is left")
+}
+
+func Test_list(t *testing.T) {
+	dir := t.TempDir()
+	markers, err := List(filepath.Join(dir, "missing"))
+	require.Nil(t, err)
+	require.Empty(t, markers)
+
+	require.Nil(t, Record(dir, Marker{ExtensionName: "rc2"}))
+	require.Nil(t, Record(dir, Marker{ExtensionName: ""}))
+	require.Nil(t, Record(dir, Marker{ExtensionName: "rc1"}))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "invalid.json"), []byte("{"), 0644))
+
+	markers, err = List(dir)
+	require.Nil(t, err)
+	require.Equal(t, []Marker{{ExtensionName: ""}, {ExtensionName: "rc1"}, {ExtensionName: "rc2"}}, markers)
+}
+
+func Test_handler(t *testing.T) {
+	dir := t.TempDir()
+	require.Nil(t, Record(dir, Marker{ExtensionName: "rc1", SeqNum: 4}))
+	require.Nil(t, Record(dir, Marker{ExtensionName: "", SeqNum: 1}))
+	server := httptest.NewServer(NewHandler(dir))
+	defer server.Close()
+
+	get := func(path string) (int, []byte) {
+		resp, err := http.Get(server.URL + path)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		require.Nil(t, err)
+		return resp.StatusCode, b
+	}
+
+	status, body := get("/ready/rc1")
+	require.Equal(t, http.StatusOK, status)
+	var marker Marker
+	require.Nil(t, json.Unmarshal(body, &marker))
+	require.Equal(t, 4, marker.SeqNum)
+
+	status, body = get("/ready/")
+	require.Equal(t, http.StatusOK, status)
+	require.Nil(t, json.Unmarshal(body, &marker))
+	require.Equal(t, 1, marker.SeqNum, "the single-config extension is at /ready/")
+
+	status, _ = get("/ready/rc2")
+	require.Equal(t, http.StatusNotFound, status)
+
+	status, body = get("/ready")
+	require.Equal(t, http.StatusOK, status)
+	var markers []Marker
+	require.Nil(t, json.Unmarshal(body, &markers))
+	require.Len(t, markers, 2)
+
+	resp, err := http.Post(server.URL+"/ready/rc1", "application/json", nil)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func Test_listenAndServe(t *testing.T) {
+	dir := t.TempDir()
+	socketPath := filepath.Join(dir, "readiness.sock")
+	require.Nil(t, Record(dir, Marker{ExtensionName: "rc1"}))
+	go ListenAndServe(log.NewContext(log.NewNopLogger()), socketPath, dir)
+
+	client := http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return net.Dial("unix", socketPath)
+	}}}
+	require.Eventually(t, func() bool {
+		resp, err := client.Get("http://localhost/ready/rc1")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 50*time.Millisecond)
+
+	fi, err := os.Stat(socketPath)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0666), fi.Mode().Perm())
+}
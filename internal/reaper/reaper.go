@@ -0,0 +1,67 @@
+// Package reaper keeps a long-lived process from accumulating zombies left by the scripts it executes.
+//
+// Scripts often start background processes and exit. Once the service is their subreaper, those orphans
+// are re-parented to it instead of init, and must be waited for when they exit.
+package reaper
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/proctree"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// prSetChildSubreaper is the prctl option making the calling process the subreaper of its descendants
+	prSetChildSubreaper = 36
+
+	sweepInterval = 30 * time.Second
+)
+
+// Start makes the current process the subreaper of its descendants and reaps the orphans it adopts
+func Start(ctx *log.Context) error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+		return errors.Wrap(errno, "failed to become child subreaper")
+	}
+
+	go func() {
+		var zombies map[int]bool
+		for {
+			time.Sleep(sweepInterval)
+			zombies = sweep(ctx, zombies)
+		}
+	}()
+	return nil
+}
+
+// sweep reaps the zombie children that were already zombies in the previous sweep, and returns the ones found
+// in this sweep. Children started by this process (e.g., with os/exec) are waited for by their owner as soon as
+// they exit, so only zombies nobody waits for (the adopted orphans) remain from one sweep to the next. Waiting
+// for any child instead would steal the exit status of the children started by this process.
+func sweep(ctx *log.Context, previousZombies map[int]bool) map[int]bool {
+	children, err := proctree.Children(os.Getpid())
+	if err != nil {
+		ctx.Log("warning", "failed to list child processes to reap", "error", err)
+		return previousZombies
+	}
+
+	zombies := make(map[int]bool)
+	for _, c := range children {
+		if c.State != "Z" {
+			continue
+		}
+		if !previousZombies[c.Pid] {
+			zombies[c.Pid] = true
+			continue
+		}
+
+		var status syscall.WaitStatus
+		if pid, err := syscall.Wait4(c.Pid, &status, syscall.WNOHANG, nil); err == nil && pid == c.Pid {
+			ctx.Log("message", "reaped orphaned process", "pid", c.Pid, "name", c.Name, "exitStatus", status.ExitStatus())
+		}
+	}
+	return zombies
+}
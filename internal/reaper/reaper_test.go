@@ -0,0 +1,54 @@
+package reaper
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/proctree"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func zombieChildren(t *testing.T) []int {
+	children, err := proctree.Children(os.Getpid())
+	require.Nil(t, err)
+	var zombies []int
+	for _, c := range children {
+		if c.State == "Z" {
+			zombies = append(zombies, c.Pid)
+		}
+	}
+	return zombies
+}
+
+func Test_sweepReapsAdoptedOrphans(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	require.Nil(t, Start(ctx))
+
+	// The script exits right away and leaves an orphan that exits later
+	out, err := exec.Command("/bin/bash", "-c", "sleep 0.2 & echo $!").Output()
+	require.Nil(t, err)
+	orphan, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	require.Nil(t, err)
+
+	require.Eventually(t, func() bool {
+		for _, pid := range zombieChildren(t) {
+			if pid == orphan {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond, "orphan should be adopted by the subreaper")
+
+	// A zombie is only reaped once it was seen by the previous sweep
+	zombies := sweep(ctx, nil)
+	require.True(t, zombies[orphan])
+	require.Contains(t, zombieChildren(t), orphan)
+
+	sweep(ctx, zombies)
+	require.NotContains(t, zombieChildren(t), orphan)
+}
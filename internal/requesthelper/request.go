@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/Azure/run-command-handler-linux/pkg/requestheaders"
 	"github.com/go-kit/kit/log"
 )
 
@@ -19,6 +20,8 @@ type RequestFactory interface {
 type RequestManager struct {
 	httpClient     *http.Client
 	requestFactory RequestFactory
+	// header is added to every request, e.g., the conditional headers
+	header http.Header
 }
 
 // GetRequestManager returns a request manager for json requests
@@ -29,14 +32,30 @@ func GetRequestManager(rf RequestFactory, timeout time.Duration) *RequestManager
 	}
 }
 
+// SetHeader sets the header of the requests made from now on, or removes it if value is empty
+func (rm *RequestManager) SetHeader(name, value string) {
+	if rm.header == nil {
+		rm.header = make(http.Header)
+	}
+	if value == "" {
+		rm.header.Del(name)
+		return
+	}
+	rm.header.Set(name, value)
+}
+
 // MakeRequest retrieves a response body and checks the response status code to see
-// if it is 200 OK and then returns the response body. It issues a new request
+// if it is 200 OK and then returns the response body. A conditional request (If-None-Match)
+// may also return 304 Not Modified, without a body. It issues a new request
 // every time called. It is caller's responsibility to close the response body.
 func (rm *RequestManager) MakeRequest(ctx *log.Context) (*http.Response, error) {
 	req, err := rm.requestFactory.GetRequest(ctx)
 	if err != nil {
 		return nil, err
 	}
+	for name, values := range rm.header {
+		req.Header[name] = values
+	}
 
 	resp, err := rm.httpClient.Do(req)
 	if err != nil {
@@ -46,6 +65,9 @@ func (rm *RequestManager) MakeRequest(ctx *log.Context) (*http.Response, error)
 	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
 		return resp, nil
 	}
+	if resp.StatusCode == http.StatusNotModified && req.Header.Get("If-None-Match") != "" {
+		return resp, nil
+	}
 
 	err = fmt.Errorf("unexpected status code: actual=%d expected=%d", resp.StatusCode, http.StatusOK)
 
@@ -56,7 +78,7 @@ func (rm *RequestManager) MakeRequest(ctx *log.Context) (*http.Response, error)
 // However, an infinite timeout will cause the deployment to fail so here we are setting a specific timeout.
 func getHTTPClient(timeout time.Duration) *http.Client {
 	return &http.Client{
-		Transport: &http.Transport{
+		Transport: requestheaders.NewTransport(&http.Transport{
 			Dial: (&net.Dialer{
 				Timeout:   timeout,
 				KeepAlive: 30 * time.Second,
@@ -65,6 +87,6 @@ func getHTTPClient(timeout time.Duration) *http.Client {
 			TLSHandshakeTimeout:   10 * time.Second,
 			ResponseHeaderTimeout: 20 * time.Second,
 			ExpectContinueTimeout: 1 * time.Second,
-		},
+		}),
 		Timeout: timeout}
 }
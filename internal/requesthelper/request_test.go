@@ -199,3 +199,21 @@ func TestMakeRequest_BodyClosesWithoutError(t *testing.T) {
 	require.Nil(t, err)
 	require.Nil(t, resp.Body.Close())
 }
+
+func TestMakeRequest_NotModifiedOnlyWhenConditional(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer srv.Close()
+
+	rm := requesthelper.GetRequestManager(NewTestURLRequest(srv.URL), testRequestTimeout)
+	_, err := rm.MakeRequest(ctx)
+	require.ErrorContains(t, err, "unexpected status code: actual=304")
+
+	rm.SetHeader("If-None-Match", `"etag-1"`)
+	resp, err := rm.MakeRequest(ctx)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusNotModified, resp.StatusCode)
+}
@@ -6,17 +6,13 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/Azure/run-command-handler-linux/internal/clock"
 	"github.com/go-kit/kit/log"
 )
 
 // SleepFunc pauses the execution for at least duration d.
 type SleepFunc func(d time.Duration)
 
-var (
-	// ActualSleep uses actual time to pause the execution.
-	ActualSleep SleepFunc = time.Sleep
-)
-
 const (
 	// time to sleep between retries is an exponential backoff formula:
 	//   t(n) = k * m^n
@@ -29,8 +25,8 @@ const (
 // error returned from d will be retried (and retrieved response bodies will be
 // closed on failures). If the retries do not succeed, the last error is returned.
 //
-// It sleeps in exponentially increasing durations between retries.
-func WithRetries(ctx *log.Context, rm *RequestManager, sf SleepFunc) (*http.Response, error) {
+// It sleeps with clk in exponentially increasing durations between retries.
+func WithRetries(ctx *log.Context, rm *RequestManager, clk clock.Clock) (*http.Response, error) {
 	var lastErr error
 
 	for n := 0; n < expRetryN; n++ {
@@ -73,7 +69,7 @@ func WithRetries(ctx *log.Context, rm *RequestManager, sf SleepFunc) (*http.Resp
 				ctx.Log("message", "no response returned and unexpected error, skipping retries.")
 				break
 			}
-		} else if !isTransientHTTPStatusCode(status) {
+		} else if !IsTransientHTTPStatusCode(status) {
 			ctx.Log("message", fmt.Sprintf("RequestManager returned %v, skipping retries", status))
 			break
 		}
@@ -81,14 +77,15 @@ func WithRetries(ctx *log.Context, rm *RequestManager, sf SleepFunc) (*http.Resp
 		if n < expRetryN-1 {
 			// have more retries to go, sleep before retrying
 			slp := expRetryK * time.Duration(int(math.Pow(float64(expRetryM), float64(n))))
-			sf(slp)
+			clk.Sleep(slp)
 		}
 	}
 
 	return nil, lastErr
 }
 
-func isTransientHTTPStatusCode(statusCode int) bool {
+// IsTransientHTTPStatusCode returns true if a request failing with the given status code is worth retrying
+func IsTransientHTTPStatusCode(statusCode int) bool {
 	switch statusCode {
 	case
 		http.StatusRequestTimeout,      // 408
@@ -8,6 +8,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/Azure/run-command-handler-linux/internal/clock"
 	"github.com/Azure/run-command-handler-linux/internal/requesthelper"
 	"github.com/ahmetalpbalkan/go-httpbin"
 	"github.com/go-kit/kit/log"
@@ -26,13 +27,6 @@ var (
 	}
 )
 
-func TestActualSleep_actuallySleeps(t *testing.T) {
-	s := time.Now()
-	requesthelper.ActualSleep(time.Second)
-	e := time.Since(s)
-	require.InEpsilon(t, 1.0, e.Seconds(), 0.05, "took=%fs", e.Seconds())
-}
-
 func TestWithRetries_noRetries(t *testing.T) {
 	ctx := log.NewContext(log.NewSyncLogger(log.NewLogfmtLogger(os.Stdout))).With("time", log.DefaultTimestamp)
 	srv := httptest.NewServer(httpbin.GetMux())
@@ -41,12 +35,12 @@ func TestWithRetries_noRetries(t *testing.T) {
 	d := NewTestURLRequest(srv.URL + "/status/200")
 	rm := requesthelper.GetRequestManager(d, testRequestTimeout)
 
-	sr := new(sleepRecorder)
-	resp, err := requesthelper.WithRetries(ctx, rm, sr.Sleep)
+	sr := &sleepRecorder{Clock: clock.Real}
+	resp, err := requesthelper.WithRetries(ctx, rm, sr)
 	require.Nil(t, err, "should not fail")
 	defer resp.Body.Close()
 	require.NotNil(t, resp.Body, "response body exists")
-	require.Equal(t, []time.Duration(nil), []time.Duration(*sr), "sleep should not be called")
+	require.Equal(t, []time.Duration(nil), sr.slept, "sleep should not be called")
 }
 
 func TestWithRetries_noRecovery(t *testing.T) {
@@ -57,11 +51,11 @@ func TestWithRetries_noRecovery(t *testing.T) {
 	d := NewTestURLRequest(srv.URL + "/status/409")
 	rm := requesthelper.GetRequestManager(d, testRequestTimeout)
 
-	sr := new(sleepRecorder)
-	resp, err := requesthelper.WithRetries(ctx, rm, sr.Sleep)
+	sr := &sleepRecorder{Clock: clock.Real}
+	resp, err := requesthelper.WithRetries(ctx, rm, sr)
 	require.NotNil(t, err, "should have failed")
 	require.Nil(t, resp, "response exists")
-	require.Equal(t, []time.Duration(nil), []time.Duration(*sr), "sleep should not be called")
+	require.Equal(t, []time.Duration(nil), sr.slept, "sleep should not be called")
 }
 
 func TestWithRetries_noResponse(t *testing.T) {
@@ -76,11 +70,11 @@ func TestWithRetries_noResponse(t *testing.T) {
 	d := NewTestURLRequest(u.String())
 	rm := requesthelper.GetRequestManager(d, testRequestTimeout)
 
-	sr := new(sleepRecorder)
-	resp, err := requesthelper.WithRetries(ctx, rm, sr.Sleep)
+	sr := &sleepRecorder{Clock: clock.Real}
+	resp, err := requesthelper.WithRetries(ctx, rm, sr)
 	require.NotNil(t, err, "should have failed")
 	require.Nil(t, resp, "response exists")
-	require.Equal(t, []time.Duration(nil), []time.Duration(*sr), "sleep should not be called")
+	require.Equal(t, []time.Duration(nil), sr.slept, "sleep should not be called")
 }
 
 func TestWithRetries_failing_validateNumberOfCalls(t *testing.T) {
@@ -91,8 +85,8 @@ func TestWithRetries_failing_validateNumberOfCalls(t *testing.T) {
 	d := NewTestURLRequest(srv.URL + "/status/429")
 	rm := requesthelper.GetRequestManager(d, testRequestTimeout)
 
-	sr := new(sleepRecorder)
-	_, err := requesthelper.WithRetries(ctx, rm, sr.Sleep)
+	sr := &sleepRecorder{Clock: clock.Real}
+	_, err := requesthelper.WithRetries(ctx, rm, sr)
 	require.EqualError(t, err, "unexpected status code: actual=429 expected=200")
 	require.EqualValues(t, 7, d.calls, "calls exactly expRetryN times")
 }
@@ -102,8 +96,8 @@ func TestWithRetries_failedCreateRequest(t *testing.T) {
 	bd := &BadRequestor{}
 	rm := requesthelper.GetRequestManager(bd, testRequestTimeout)
 
-	sr := new(sleepRecorder)
-	_, err := requesthelper.WithRetries(ctx, rm, sr.Sleep)
+	sr := &sleepRecorder{Clock: clock.Real}
+	_, err := requesthelper.WithRetries(ctx, rm, sr)
 	require.EqualError(t, err, badRequestorErrorMsg)
 	require.EqualValues(t, 1, bd.calls, "called exactly one time")
 }
@@ -113,8 +107,8 @@ func TestWithRetries_requestFailedTimeout(t *testing.T) {
 	er := NewErrorRequest(false, true)
 	rm := requesthelper.GetRequestManager(er, testRequestTimeout)
 
-	sr := new(sleepRecorder)
-	_, err := requesthelper.WithRetries(ctx, rm, sr.Sleep)
+	sr := &sleepRecorder{Clock: clock.Real}
+	_, err := requesthelper.WithRetries(ctx, rm, sr)
 	require.EqualError(t, err, requestErrorMsg)
 	require.EqualValues(t, 7, er.calls, "calls exactly expRetryN times")
 }
@@ -124,8 +118,8 @@ func TestWithRetries_requestFailedTemporary(t *testing.T) {
 	er := NewErrorRequest(true, false)
 	rm := requesthelper.GetRequestManager(er, testRequestTimeout)
 
-	sr := new(sleepRecorder)
-	_, err := requesthelper.WithRetries(ctx, rm, sr.Sleep)
+	sr := &sleepRecorder{Clock: clock.Real}
+	_, err := requesthelper.WithRetries(ctx, rm, sr)
 	require.EqualError(t, err, requestErrorMsg)
 	require.EqualValues(t, 7, er.calls, "calls exactly expRetryN times")
 }
@@ -135,8 +129,8 @@ func TestWithRetries_requestFailedOther(t *testing.T) {
 	er := NewErrorRequest(false, false)
 	rm := requesthelper.GetRequestManager(er, testRequestTimeout)
 
-	sr := new(sleepRecorder)
-	_, err := requesthelper.WithRetries(ctx, rm, sr.Sleep)
+	sr := &sleepRecorder{Clock: clock.Real}
+	_, err := requesthelper.WithRetries(ctx, rm, sr)
 	require.EqualError(t, err, requestErrorMsg)
 	require.EqualValues(t, 1, er.calls, "called exactly one time")
 }
@@ -149,10 +143,10 @@ func TestWithRetries_failingBadStatusCode_validateSleeps(t *testing.T) {
 	d := NewTestURLRequest(srv.URL + "/status/429")
 	rm := requesthelper.GetRequestManager(d, testRequestTimeout)
 
-	sr := new(sleepRecorder)
-	_, err := requesthelper.WithRetries(ctx, rm, sr.Sleep)
+	sr := &sleepRecorder{Clock: clock.Real}
+	_, err := requesthelper.WithRetries(ctx, rm, sr)
 	require.EqualError(t, err, "unexpected status code: actual=429 expected=200")
-	require.Equal(t, sleepSchedule, []time.Duration(*sr))
+	require.Equal(t, sleepSchedule, sr.slept)
 }
 
 func TestWithRetries_healingServer(t *testing.T) {
@@ -162,23 +156,24 @@ func TestWithRetries_healingServer(t *testing.T) {
 
 	d := NewTestURLRequest(srv.URL)
 	rm := requesthelper.GetRequestManager(d, testRequestTimeout)
-	sr := new(sleepRecorder)
-	resp, err := requesthelper.WithRetries(ctx, rm, sr.Sleep)
+	sr := &sleepRecorder{Clock: clock.Real}
+	resp, err := requesthelper.WithRetries(ctx, rm, sr)
 	require.Nil(t, err, "should eventually succeed")
 	defer resp.Body.Close()
 	require.NotNil(t, resp.Body, "response body exists")
 
-	require.Equal(t, sleepSchedule[:3], []time.Duration(*sr))
+	require.Equal(t, sleepSchedule[:3], sr.slept)
 }
 
-func NoSleep(d time.Duration) {}
-
-// sleepRecorder keeps track of the durations of Sleep calls
-type sleepRecorder []time.Duration
+// sleepRecorder is a clock keeping track of the durations of Sleep calls
+type sleepRecorder struct {
+	clock.Clock
+	slept []time.Duration
+}
 
 // Sleep does not actually sleep. It records the duration and returns.
 func (s *sleepRecorder) Sleep(d time.Duration) {
-	*s = append(*s, d)
+	s.slept = append(s.slept, d)
 }
 
 // healingServer returns HTTP 500 until 4th call, then HTTP 200 afterwards
@@ -0,0 +1,39 @@
+package scriptlibrary
+
+import (
+	"github.com/Azure/run-command-handler-linux/internal/blobsync"
+	"github.com/Azure/run-command-handler-linux/pkg/download"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// containerSource syncs the library from a storage container accessed with a SAS token
+type containerSource struct {
+	uri       string
+	container blobsync.Container
+}
+
+func newContainerSource(uri string) (source, error) {
+	container, err := blobsync.NewSASContainer(uri)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid script library container")
+	}
+	return containerSource{uri: uri, container: container}, nil
+}
+
+func (s containerSource) String() string {
+	return download.GetUriForLogging(s.uri)
+}
+
+// sync downloads the new and changed blobs and removes the scripts no longer in the container. A script
+// failing to download keeps its previous version and is retried on the next sync.
+func (s containerSource) sync(ctx *log.Context, dir string) error {
+	result, err := blobsync.Sync(ctx, s.container, dir, ValidateName)
+	if err != nil {
+		return errors.Wrap(err, "failed to sync the script library container")
+	}
+	if result.Failed > 0 {
+		return errors.Errorf("failed to download %d scripts of the script library", result.Failed)
+	}
+	return nil
+}
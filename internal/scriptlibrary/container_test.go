@@ -0,0 +1,85 @@
+package scriptlibrary
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/blobsync"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeContainer serves blobs from memory and counts the downloads
+type fakeContainer struct {
+	blobs     map[string]string // name -> content, the ETag is the content
+	failing   map[string]bool
+	downloads int
+}
+
+func (c *fakeContainer) List() (map[string]blobsync.Blob, error) {
+	blobs := make(map[string]blobsync.Blob)
+	for name, content := range c.blobs {
+		blobs[name] = blobsync.Blob{ETag: content}
+	}
+	return blobs, nil
+}
+
+func (c *fakeContainer) Get(name string) (io.ReadCloser, error) {
+	if c.failing[name] {
+		return nil, errors.New("download failed")
+	}
+	c.downloads++
+	return io.NopCloser(strings.NewReader(c.blobs[name])), nil
+}
+
+func Test_containerSourceSync(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	dir := t.TempDir()
+	container := &fakeContainer{blobs: map[string]string{
+		"check-disk.sh":      "df -h",
+		"linux/uptime.sh":    "uptime",
+		"../escape.sh":       "rm -rf /",
+		"linux/.hidden.sh":   "hidden",
+		"to-be-removed.sh":   "echo removed",
+		"fails-next-time.sh": "echo v1",
+	}}
+	src := containerSource{container: container}
+
+	require.Nil(t, Sync(ctx, src, dir))
+	require.Equal(t, 4, container.downloads)
+	requireScript(t, dir, "check-disk.sh", "df -h")
+	requireScript(t, dir, "linux/uptime.sh", "uptime")
+	_, err := os.Stat(filepath.Join(dir, "linux", ".hidden.sh"))
+	require.True(t, os.IsNotExist(err))
+
+	// Unchanged blobs are not downloaded again, changed ones are and removed ones are deleted
+	container.downloads = 0
+	container.blobs["check-disk.sh"] = "df -hT"
+	container.blobs["fails-next-time.sh"] = "echo v2"
+	container.failing = map[string]bool{"fails-next-time.sh": true}
+	delete(container.blobs, "to-be-removed.sh")
+
+	require.EqualError(t, Sync(ctx, src, dir), "failed to download 1 scripts of the script library")
+	require.Equal(t, 1, container.downloads)
+	requireScript(t, dir, "check-disk.sh", "df -hT")
+	requireScript(t, dir, "fails-next-time.sh", "echo v1")
+	_, err = os.Stat(filepath.Join(dir, "to-be-removed.sh"))
+	require.True(t, os.IsNotExist(err))
+
+	// The failed script is retried
+	container.downloads = 0
+	container.failing = nil
+	require.Nil(t, Sync(ctx, src, dir))
+	require.Equal(t, 1, container.downloads)
+	requireScript(t, dir, "fails-next-time.sh", "echo v2")
+}
+
+func requireScript(t *testing.T, dir string, name string, content string) {
+	b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	require.Nil(t, err, name)
+	require.Equal(t, content, string(b), name)
+}
@@ -0,0 +1,72 @@
+package scriptlibrary
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/pkg/logsanitizer"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// gitTimeout bounds every git command so an unreachable remote does not block the next syncs
+const gitTimeout = 5 * time.Minute
+
+// gitSource syncs the library from the default branch of a git repository
+type gitSource struct {
+	repo string
+}
+
+func (s gitSource) String() string {
+	// The URL may contain credentials
+	if u, err := url.Parse(s.repo); err == nil && u.User != nil {
+		u.User = nil
+		return u.String()
+	}
+	return s.repo
+}
+
+// sync clones the repository the first time, then fetches the latest commit and discards any local change
+func (s gitSource) sync(ctx *log.Context, dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		// The library may have been synced from a container before
+		if err := os.RemoveAll(dir); err != nil {
+			return errors.Wrap(err, "failed to clear the script library directory")
+		}
+		return runGit("clone", "--quiet", "--depth", "1", s.repo, dir)
+	}
+
+	for _, args := range [][]string{
+		{"-C", dir, "remote", "set-url", "origin", s.repo},
+		{"-C", dir, "fetch", "--quiet", "--depth", "1", "origin"},
+		{"-C", dir, "reset", "--quiet", "--hard", "FETCH_HEAD"},
+		{"-C", dir, "clean", "--quiet", "-d", "--force"},
+	} {
+		if err := runGit(args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runGit(args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	// Never prompt for credentials
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		command := args[0]
+		if command == "-C" {
+			command = args[2]
+		}
+		return errors.Wrapf(err, "git %s failed: %s", command, logsanitizer.Sanitize(strings.TrimSpace(string(output))))
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package scriptlibrary
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_gitSourceSync(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	ctx := log.NewContext(log.NewNopLogger())
+
+	repo := t.TempDir()
+	commit := func(name string, content string) {
+		require.Nil(t, os.WriteFile(filepath.Join(repo, name), []byte(content), 0600))
+		out, err := exec.Command("git", "-C", repo, "add", "-A").CombinedOutput()
+		require.Nil(t, err, string(out))
+		out, err = exec.Command("git", "-C", repo, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "update").CombinedOutput()
+		require.Nil(t, err, string(out))
+	}
+	out, err := exec.Command("git", "init", "--quiet", repo).CombinedOutput()
+	require.Nil(t, err, string(out))
+	commit("check-disk.sh", "df -h")
+
+	dir := filepath.Join(t.TempDir(), "library")
+	src := gitSource{repo: "file://" + repo}
+	require.Nil(t, Sync(ctx, src, dir))
+	requireScript(t, dir, "check-disk.sh", "df -h")
+
+	// Local changes are discarded
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "check-disk.sh"), []byte("changed"), 0600))
+	commit("check-disk.sh", "df -hT")
+	require.Nil(t, Sync(ctx, src, dir))
+	requireScript(t, dir, "check-disk.sh", "df -hT")
+}
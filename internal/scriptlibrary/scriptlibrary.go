@@ -0,0 +1,125 @@
+// Package scriptlibrary keeps a local library of scripts in sync with a storage container or a git
+// repository, so run commands can reference a script by name and execute it without downloading it.
+package scriptlibrary
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/blobsync"
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/pkg/logsanitizer"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const defaultSyncInterval = 5 * time.Minute
+
+// source is where the library is synced from
+type source interface {
+	// sync makes dir contain the scripts of the source
+	sync(ctx *log.Context, dir string) error
+
+	// String returns a description of the source which is safe to log
+	String() string
+}
+
+// Start syncs the script library in the background if a source is configured in the environment
+func Start(ctx *log.Context) {
+	src, err := newSourceFromEnvironment()
+	if err != nil {
+		ctx.Log("warning", "the script library will not be synced", "error", err)
+		return
+	}
+	if src == nil {
+		ctx.Log("message", "no script library configured")
+		return
+	}
+
+	interval := getSyncInterval(ctx)
+	ctx = ctx.With("scriptLibrary", src.String())
+	ctx.Log("message", fmt.Sprintf("syncing the script library every %v", interval))
+	go func() {
+		for {
+			if err := Sync(ctx, src, constants.ScriptLibraryDir); err != nil {
+				ctx.Log("warning", "failed to sync the script library", "error", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Sync makes dir contain the scripts of src
+func Sync(ctx *log.Context, src source, dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "failed to create script library directory")
+	}
+
+	begin := time.Now()
+	if err := src.sync(ctx, dir); err != nil {
+		return err
+	}
+	ctx.Log("message", "synced the script library", "elapsed", time.Since(begin))
+	return nil
+}
+
+// Resolve returns the path of the script with the given name in the library
+func Resolve(name string) (string, error) {
+	return resolve(constants.ScriptLibraryDir, name)
+}
+
+func resolve(dir string, name string) (string, error) {
+	if err := ValidateName(name); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", errors.Errorf("script '%s' is not in the script library. Make sure the script library is configured and synced on the VM", name)
+	}
+	return path, nil
+}
+
+// ValidateName returns an error if name is not a relative path within the library, e.g., "check-disk.sh"
+// or "linux/check-disk.sh". Hidden files and directories are not part of the library.
+func ValidateName(name string) error {
+	if blobsync.ValidateName(name) != nil {
+		return errors.Errorf("invalid script library name '%s'", name)
+	}
+	return nil
+}
+
+// newSourceFromEnvironment returns the configured source, or nil if none is configured
+func newSourceFromEnvironment() (source, error) {
+	containerURI := os.Getenv(constants.ScriptLibraryContainerURIEnvName)
+	gitRepo := os.Getenv(constants.ScriptLibraryGitRepoEnvName)
+	// Both may contain credentials
+	logsanitizer.RegisterSecrets(containerURI, gitRepo)
+
+	switch {
+	case containerURI != "" && gitRepo != "":
+		return nil, errors.Errorf("only one of %v and %v can be set", constants.ScriptLibraryContainerURIEnvName, constants.ScriptLibraryGitRepoEnvName)
+	case containerURI != "":
+		return newContainerSource(containerURI)
+	case gitRepo != "":
+		return gitSource{repo: gitRepo}, nil
+	}
+	return nil, nil
+}
+
+func getSyncInterval(ctx *log.Context) time.Duration {
+	interval := defaultSyncInterval
+	if value := os.Getenv(constants.ScriptLibrarySyncIntervalEnvName); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			ctx.Log("warning", fmt.Sprintf("invalid value %q for %v. Using default of %v", value, constants.ScriptLibrarySyncIntervalEnvName, defaultSyncInterval))
+		} else {
+			interval = time.Duration(parsed) * time.Second
+		}
+	}
+	return interval
+}
@@ -0,0 +1,85 @@
+// Package scriptpolicy restricts the scripts executed by the handler to those allowed by the administrator of the
+// machine. The allow-list is a local file managed outside of the handler settings (e.g., by configuration
+// management), so a run command can never allow its own script.
+package scriptpolicy
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/Azure/run-command-handler-linux/internal/trustedfile"
+	"github.com/pkg/errors"
+)
+
+// Hash returns the hex encoded SHA-256 of the script file, as printed by sha256sum
+func Hash(scriptFilePath string) (string, error) {
+	f, err := os.Open(scriptFilePath)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to open script")
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", errors.Wrap(err, "failed to read script")
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Check returns an error unless the script with the given hash may execute. Every script may execute if there is
+// no allow-list at allowListPath. Otherwise, only the scripts whose hash is listed may, and none if the allow-list
+// can't be trusted.
+func Check(allowListPath string, hash string) error {
+	allowed, enabled, err := loadAllowList(allowListPath)
+	if err != nil {
+		return errors.Wrapf(err, "scripts are restricted by %s, which is invalid", allowListPath)
+	}
+	if !enabled {
+		return nil
+	}
+	if hash == "" || !allowed[strings.ToLower(hash)] {
+		return fmt.Errorf("the script (sha256 %s) is not in the allow-list %s of the VM", hash, allowListPath)
+	}
+	return nil
+}
+
+// loadAllowList returns the hashes listed in the allow-list, one per line optionally followed by the name of the
+// script as printed by sha256sum. Empty lines and lines starting with '#' are ignored. enabled is false if there is
+// no allow-list.
+func loadAllowList(path string) (allowed map[string]bool, enabled bool, _ error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, true, errors.Wrap(err, "failed to open allow-list")
+	}
+	defer f.Close()
+
+	if err := trustedfile.Check(f, "allow-list"); err != nil {
+		return nil, true, err
+	}
+
+	allowed = make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hash := strings.ToLower(strings.Fields(line)[0])
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+			return nil, true, errors.Errorf("line %d is not a SHA-256 hash", n)
+		}
+		allowed[hash] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, true, errors.Wrap(err, "failed to read allow-list")
+	}
+	return allowed, true, nil
+}
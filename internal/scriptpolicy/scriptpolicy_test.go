@@ -0,0 +1,48 @@
+package scriptpolicy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// helloHash is the SHA-256 of "echo hello\n"
+const helloHash = "5dbad7dd0b9b122dcd9956884390f4aac4738caba8ff53498a7ab6718b176c30"
+
+func Test_Hash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "script.sh")
+	require.Nil(t, os.WriteFile(path, []byte("echo hello\n"), 0500))
+
+	hash, err := Hash(path)
+	require.Nil(t, err)
+	require.Equal(t, helloHash, hash)
+
+	_, err = Hash(filepath.Join(t.TempDir(), "missing.sh"))
+	require.NotNil(t, err)
+}
+
+func Test_Check_noAllowList(t *testing.T) {
+	require.Nil(t, Check(filepath.Join(t.TempDir(), "allowed-scripts"), helloHash))
+}
+
+func Test_Check(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allowed-scripts")
+	require.Nil(t, os.WriteFile(path, []byte("# approved by the security team\n\n"+
+		"5DBAD7DD0B9B122DCD9956884390F4AAC4738CABA8FF53498A7AB6718B176C30  hello.sh\n"), 0644))
+
+	require.Nil(t, Check(path, helloHash))
+	require.ErrorContains(t, Check(path, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"), "not in the allow-list")
+	require.ErrorContains(t, Check(path, ""), "not in the allow-list")
+}
+
+func Test_Check_invalidAllowListDeniesEverything(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allowed-scripts")
+	require.Nil(t, os.WriteFile(path, []byte(helloHash+"\nnot-a-hash\n"), 0644))
+	require.ErrorContains(t, Check(path, helloHash), "line 2 is not a SHA-256 hash")
+
+	require.Nil(t, os.WriteFile(path, []byte(helloHash+"\n"), 0644))
+	require.Nil(t, os.Chmod(path, 0666))
+	require.ErrorContains(t, Check(path, helloHash), "only writable by its owner")
+}
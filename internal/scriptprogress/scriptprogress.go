@@ -0,0 +1,193 @@
+// Package scriptprogress reads the progress a script reports while it runs, as JSON lines it appends to the file
+// named by the RUN_COMMAND_PROGRESS_FILE environment variable. A line without a name updates the overall progress,
+// a line with a name reports a custom substatus, replacing the previous one with the same name. The names of the
+// substatuses of the output, StdOut and StdErr, are reserved whatever their case:
+//
+//	{"percentComplete": 40, "message": "Installing packages"}
+//	{"name": "database", "message": "Schema migrated", "level": "Warning"}
+package scriptprogress
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/Azure/run-command-handler-linux/pkg/encodingutil"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxReadPerUpdate bounds what is read from the file by an update, the rest is read by the next ones
+	maxReadPerUpdate = 1024 * 1024
+
+	// maxLineLen bounds a line, longer lines are ignored
+	maxLineLen = 4096
+
+	// maxMessageLen bounds the messages reported, longer ones are truncated
+	maxMessageLen = 256
+
+	// maxNameLen bounds the names of the custom substatuses
+	maxNameLen = 64
+
+	// MaxSubStatuses bounds the custom substatuses reported, the lines naming others are ignored
+	MaxSubStatuses = 10
+)
+
+// reservedNames are the names, in lower case, of the substatuses reporting the output of the script, which the
+// custom substatuses can't take
+var reservedNames = map[string]bool{"stdout": true, "stderr": true}
+
+// SubStatus is a custom substatus reported by the script
+type SubStatus struct {
+	Name    string
+	Level   types.SubStatusLevel
+	Message string
+}
+
+// Progress is the progress reported by the script so far
+type Progress struct {
+	// PercentComplete is nil until the script reports one
+	PercentComplete *int
+	Message         string
+	SubStatuses     []SubStatus
+}
+
+// line is a line of the file
+type line struct {
+	Name            string `json:"name"`
+	PercentComplete *int   `json:"percentComplete"`
+	Message         string `json:"message"`
+	Level           string `json:"level"`
+}
+
+// Reader reads the lines appended to the file since its last read
+type Reader struct {
+	path     string
+	offset   int64
+	partial  []byte
+	skipping bool
+	progress Progress
+}
+
+// NewReader returns a reader of the progress reported to the file at path
+func NewReader(path string) *Reader {
+	return &Reader{path: path}
+}
+
+// Read reads the complete lines appended to the file since the last read, ignoring the invalid ones, and returns
+// the progress reported so far. The file not existing yet is no progress.
+func (r *Reader) Read() (Progress, error) {
+	b, err := r.readAppended()
+	if err != nil {
+		return r.Progress(), err
+	}
+	r.partial = append(r.partial, b...)
+	for {
+		i := bytes.IndexByte(r.partial, '\n')
+		if i < 0 {
+			break
+		}
+		if !r.skipping && i <= maxLineLen {
+			r.apply(r.partial[:i])
+		}
+		r.skipping = false
+		r.partial = r.partial[i+1:]
+	}
+	// The rest of a line too long is dropped as it is read
+	if len(r.partial) > maxLineLen {
+		r.partial = nil
+		r.skipping = true
+	}
+	return r.Progress(), nil
+}
+
+// Progress returns a copy of the progress read so far
+func (r *Reader) Progress() Progress {
+	p := r.progress
+	p.SubStatuses = append([]SubStatus(nil), p.SubStatuses...)
+	return p
+}
+
+// readAppended reads what was appended to the file since the last read. The script may be another user (RunAs),
+// so the file is only read if it is a regular file, not a link to one.
+func (r *Reader) readAppended() ([]byte, error) {
+	f, err := os.OpenFile(r.path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "failed to open the progress file")
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to stat the progress file")
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, errors.New("the progress file is not a regular file")
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+		return nil, errors.New("the progress file has other links")
+	}
+	if fi.Size() < r.offset {
+		// The file was truncated, it is read again
+		r.offset, r.partial, r.skipping = 0, nil, false
+	}
+
+	b, err := io.ReadAll(io.NewSectionReader(f, r.offset, maxReadPerUpdate))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the progress file")
+	}
+	r.offset += int64(len(b))
+	return b, nil
+}
+
+// apply updates the progress with a line, unless invalid
+func (r *Reader) apply(b []byte) {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return
+	}
+	var l line
+	if err := json.Unmarshal(b, &l); err != nil {
+		return
+	}
+	if l.PercentComplete != nil && (*l.PercentComplete < 0 || *l.PercentComplete > 100) {
+		return
+	}
+	message := encodingutil.Truncate(l.Message, maxMessageLen)
+
+	if l.Name == "" {
+		if l.PercentComplete != nil {
+			percent := *l.PercentComplete
+			r.progress.PercentComplete = &percent
+		}
+		if message != "" {
+			r.progress.Message = message
+		}
+		return
+	}
+
+	if len(l.Name) > maxNameLen || reservedNames[strings.ToLower(l.Name)] {
+		return
+	}
+	level := types.SubStatusLevelInfo
+	if l.Level == string(types.SubStatusLevelWarning) {
+		level = types.SubStatusLevelWarning
+	}
+	s := SubStatus{Name: l.Name, Level: level, Message: message}
+	for i := range r.progress.SubStatuses {
+		if r.progress.SubStatuses[i].Name == l.Name {
+			r.progress.SubStatuses[i] = s
+			return
+		}
+	}
+	if len(r.progress.SubStatuses) < MaxSubStatuses {
+		r.progress.SubStatuses = append(r.progress.SubStatuses, s)
+	}
+}
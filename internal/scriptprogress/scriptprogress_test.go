@@ -0,0 +1,106 @@
+package scriptprogress
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/stretchr/testify/require"
+)
+
+func appendLines(t *testing.T, path string, s string) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	require.Nil(t, err)
+	defer f.Close()
+	_, err = f.WriteString(s)
+	require.Nil(t, err)
+}
+
+func TestRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "progress.jsonl")
+	r := NewReader(path)
+
+	// No progress until the script creates the file
+	p, err := r.Read()
+	require.Nil(t, err)
+	require.Equal(t, Progress{}, p)
+
+	appendLines(t, path, `{"percentComplete": 10, "message": "Downloading"}
+not json
+{"percentComplete": 150}
+{"name": "database", "message": "Migrating", "level": "Warning"}
+{"percentComplete": 40`)
+	p, err = r.Read()
+	require.Nil(t, err)
+	require.Equal(t, 10, *p.PercentComplete)
+	require.Equal(t, "Downloading", p.Message)
+	require.Equal(t, []SubStatus{{Name: "database", Level: types.SubStatusLevelWarning, Message: "Migrating"}}, p.SubStatuses)
+
+	// The line is complete once its newline is written
+	appendLines(t, path, `}
+{"name": "database", "message": "Migrated"}
+`)
+	p, err = r.Read()
+	require.Nil(t, err)
+	require.Equal(t, 40, *p.PercentComplete)
+	require.Equal(t, "Downloading", p.Message)
+	require.Equal(t, []SubStatus{{Name: "database", Level: types.SubStatusLevelInfo, Message: "Migrated"}}, p.SubStatuses)
+}
+
+func TestRead_limits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "progress.jsonl")
+	r := NewReader(path)
+
+	var lines strings.Builder
+	for i := 0; i <= MaxSubStatuses; i++ {
+		lines.WriteString(`{"name": "s` + strings.Repeat("x", i) + `"}` + "\n")
+	}
+	lines.WriteString(`{"message": "` + strings.Repeat("a", maxLineLen) + `"}` + "\n")
+	lines.WriteString(`{"message": "` + strings.Repeat("é", maxMessageLen) + `"}` + "\n")
+	appendLines(t, path, lines.String())
+
+	p, err := r.Read()
+	require.Nil(t, err)
+	require.Len(t, p.SubStatuses, MaxSubStatuses)
+	require.Equal(t, strings.Repeat("é", maxMessageLen/2)+"...", p.Message)
+}
+
+func TestRead_reservedNames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "progress.jsonl")
+	appendLines(t, path, `{"name": "StdOut", "message": "forged"}
+{"name": "stderr", "message": "forged"}
+{"name": "StdOutput", "message": "custom"}
+`)
+
+	p, err := NewReader(path).Read()
+	require.Nil(t, err)
+	require.Equal(t, []SubStatus{{Name: "StdOutput", Level: types.SubStatusLevelInfo, Message: "custom"}}, p.SubStatuses)
+}
+
+func TestRead_truncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "progress.jsonl")
+	r := NewReader(path)
+	appendLines(t, path, `{"percentComplete": 80}`+"\n")
+	_, err := r.Read()
+	require.Nil(t, err)
+
+	// The file is read again once truncated, e.g., by a script appending to it with >
+	require.Nil(t, os.WriteFile(path, []byte(`{"percentComplete": 5}`+"\n"), 0600))
+	p, err := r.Read()
+	require.Nil(t, err)
+	require.Equal(t, 5, *p.PercentComplete)
+}
+
+func TestRead_symlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	appendLines(t, target, `{"percentComplete": 80}`+"\n")
+	path := filepath.Join(dir, "progress.jsonl")
+	require.Nil(t, os.Symlink(target, path))
+
+	p, err := NewReader(path).Read()
+	require.Error(t, err)
+	require.Nil(t, p.PercentComplete)
+}
@@ -0,0 +1,165 @@
+// Package scripttemplate renders a script as a template of its named parameters, so one script can serve many
+// parameterized invocations without reading the parameters from the environment.
+package scripttemplate
+
+import (
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Azure/run-command-handler-linux/internal/exec"
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/pkg/errors"
+)
+
+// placeholderRegex matches ${name} and its escaped form $${name}
+var placeholderRegex = regexp.MustCompile(`\$(\$?)\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// doubleQuoteEscaper escapes the characters bash interprets within double quotes
+var doubleQuoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+
+// Parameters are the named parameters rendered in a script
+type Parameters struct {
+	// Values are the values of the public parameters, written in the script
+	Values map[string]string
+
+	// Protected are the names of the protected parameters. Their values are never written in the script: with the
+	// shell encoding, the script reads them from its environment, where the named parameters are passed.
+	Protected map[string]bool
+}
+
+// NewParameters returns the named parameters of cfg, protected parameters taking precedence
+func NewParameters(cfg *handlersettings.HandlerSettings) Parameters {
+	params := Parameters{Values: make(map[string]string), Protected: make(map[string]bool)}
+	for _, p := range cfg.PublicSettings.Parameters {
+		if p.Name != "" {
+			params.Values[p.Name] = p.Value
+		}
+	}
+	for _, p := range cfg.ProtectedSettings.ProtectedParameters {
+		if p.Name != "" {
+			params.Protected[p.Name] = true
+		}
+	}
+	return params
+}
+
+// quoting is how the shell reads the text at a position of the script
+type quoting int
+
+const (
+	unquoted quoting = iota
+	singleQuoted
+	doubleQuoted
+)
+
+// after returns how the shell reads the text following text
+func (q quoting) after(text string) quoting {
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case q == singleQuoted:
+			if c == '\'' {
+				q = unquoted
+			}
+		case c == '\\':
+			// the next character is escaped
+			i++
+		case c == '"':
+			if q == doubleQuoted {
+				q = unquoted
+			} else {
+				q = doubleQuoted
+			}
+		case c == '\'' && q == unquoted:
+			q = singleQuoted
+		}
+	}
+	return q
+}
+
+// quote returns value quoted for the shell at a position read with q, so it is read as is
+func (q quoting) quote(value string) string {
+	switch q {
+	case singleQuoted:
+		return strings.ReplaceAll(value, "'", `'\''`)
+	case doubleQuoted:
+		return doubleQuoteEscaper.Replace(value)
+	default:
+		return exec.ShellQuote(value)
+	}
+}
+
+// reference returns the reference to the environment variable name for the shell at a position read with q, so its
+// value is read as is
+func (q quoting) reference(name string) string {
+	switch q {
+	case singleQuoted:
+		return `'"${` + name + `}"'`
+	case doubleQuoted:
+		return "${" + name + "}"
+	default:
+		return `"${` + name + `}"`
+	}
+}
+
+// Render substitutes every ${name} of template with the value of the parameter name. With the shell encoding, values
+// are quoted for the quotes the placeholder is within, so each is read as is whatever quotes, expansions or newlines
+// it contains, and protected parameters are rendered as references to their environment variables. With the none
+// encoding, for the interpreters other than the shell, values are written as they are and the placeholders of the
+// protected parameters are left as is. $${name} renders as a literal ${name}, and a placeholder whose name is not a
+// parameter (e.g., a variable of the script such as ${HOME}) is left as is. Returns the sorted names of the rendered
+// parameters.
+func Render(template string, params Parameters, encoding string) (string, []string) {
+	shell := encoding != handlersettings.TemplateEncodingNone
+	rendered := make(map[string]bool)
+	var result strings.Builder
+	q, last := unquoted, 0
+	for _, match := range placeholderRegex.FindAllStringSubmatchIndex(template, -1) {
+		q = q.after(template[last:match[0]])
+		result.WriteString(template[last:match[0]])
+		last = match[1]
+
+		placeholder := template[match[0]:match[1]]
+		escaped, name := match[3] > match[2], template[match[4]:match[5]]
+		value, public := params.Values[name]
+		switch {
+		case escaped:
+			result.WriteString(placeholder[1:])
+		case params.Protected[name] && shell:
+			rendered[name] = true
+			result.WriteString(q.reference(name))
+		case params.Protected[name] || !public:
+			result.WriteString(placeholder)
+		case shell:
+			rendered[name] = true
+			result.WriteString(q.quote(value))
+		default:
+			rendered[name] = true
+			result.WriteString(value)
+		}
+	}
+	result.WriteString(template[last:])
+
+	names := make([]string, 0, len(rendered))
+	for name := range rendered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return result.String(), names
+}
+
+// RenderFile renders the script at path in place with the given parameters and returns the names of the rendered
+// parameters
+func RenderFile(path string, params Parameters, encoding string) ([]string, error) {
+	template, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the script template")
+	}
+	result, names := Render(string(template), params, encoding)
+	// The script is executable by its owner only, its mode is kept
+	if err := os.WriteFile(path, []byte(result), 0); err != nil {
+		return nil, errors.Wrap(err, "failed to write the rendered script")
+	}
+	return names, nil
+}
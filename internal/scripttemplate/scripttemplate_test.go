@@ -0,0 +1,106 @@
+package scripttemplate
+
+import (
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRender(t *testing.T) {
+	params := Parameters{Values: map[string]string{"name": "world", "count": "3", "empty": ""}}
+
+	rendered, names := Render("echo ${name} ${count}${empty} ${HOME} $${name} $name", params, "")
+	require.Equal(t, "echo 'world' '3''' ${HOME} ${name} $name", rendered)
+	require.Equal(t, []string{"count", "empty", "name"}, names)
+
+	// Values are not rendered again
+	rendered, names = Render("${name}", Parameters{Values: map[string]string{"name": "${count}", "count": "3"}}, "")
+	require.Equal(t, "'${count}'", rendered)
+	require.Equal(t, []string{"name"}, names)
+
+	rendered, names = Render("no placeholders", params, "")
+	require.Equal(t, "no placeholders", rendered)
+	require.Empty(t, names)
+}
+
+func TestRender_quotesValues(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "injected")
+	params := Parameters{Values: map[string]string{
+		"quote":     `it's "quoted"`,
+		"command":   "$(touch " + marker + ")",
+		"backticks": "`touch " + marker + "`",
+		"newline":   "a\ntouch " + marker + ` \`,
+	}}
+	values := []string{params.Values["quote"], params.Values["command"], params.Values["backticks"], params.Values["newline"]}
+
+	for template, expected := range map[string]string{
+		`printf '%s|' ${quote} ${command} ${backticks} ${newline}`:                values[0] + "|" + values[1] + "|" + values[2] + "|" + values[3] + "|",
+		`printf '%s|' "${quote}" "${command}" "${backticks}" "${newline}"`:        values[0] + "|" + values[1] + "|" + values[2] + "|" + values[3] + "|",
+		`printf '%s|' '${quote}' '${command}' '${backticks}' '${newline}'`:        values[0] + "|" + values[1] + "|" + values[2] + "|" + values[3] + "|",
+		`printf '%s|' "x ${quote}" 'x ${command}' x\'${backticks} "\"${newline}"`: "x " + values[0] + "|x " + values[1] + "|x'" + values[2] + `|"` + values[3] + "|",
+	} {
+		rendered, _ := Render(template, params, handlersettings.TemplateEncodingShell)
+
+		// Every value is read as is, whatever the quotes around its placeholder
+		out, err := osexec.Command("/bin/bash", "-c", rendered).Output()
+		require.Nil(t, err, rendered)
+		require.Equal(t, expected, string(out), rendered)
+	}
+	require.NoFileExists(t, marker)
+}
+
+func TestRender_protectedParameters(t *testing.T) {
+	params := Parameters{Values: map[string]string{"name": "public"}, Protected: map[string]bool{"name": true, "key": true}}
+
+	rendered, names := Render(`echo ${name} "${name}" '${key}'`, params, handlersettings.TemplateEncodingShell)
+	require.Equal(t, `echo "${name}" "${name}" ''"${key}"''`, rendered, "the protected parameters are read from the environment")
+	require.Equal(t, []string{"key", "name"}, names)
+
+	command := osexec.Command("/bin/bash", "-c", rendered)
+	command.Env = []string{"name=it's a secret", "key=$(id)"}
+	out, err := command.Output()
+	require.Nil(t, err)
+	require.Equal(t, "it's a secret it's a secret $(id)\n", string(out))
+}
+
+func TestRender_noEncoding(t *testing.T) {
+	params := Parameters{Values: map[string]string{"name": "it's"}, Protected: map[string]bool{"key": true}}
+
+	rendered, names := Render(`print("${name}", "${key}", "$${name}")`, params, handlersettings.TemplateEncodingNone)
+	require.Equal(t, `print("it's", "${key}", "${name}")`, rendered, "the protected parameters are never rendered")
+	require.Equal(t, []string{"name"}, names)
+}
+
+func TestNewParameters(t *testing.T) {
+	cfg := &handlersettings.HandlerSettings{
+		PublicSettings: handlersettings.PublicSettings{
+			Parameters: []handlersettings.ParameterDefinition{{Name: "a", Value: "public"}, {Name: "b", Value: "public"}, {Value: "positional"}},
+		},
+		ProtectedSettings: handlersettings.ProtectedSettings{
+			ProtectedParameters: []handlersettings.ParameterDefinition{{Name: "b", Value: "protected"}, {Value: "positional"}},
+		},
+	}
+	require.Equal(t, Parameters{Values: map[string]string{"a": "public", "b": "public"}, Protected: map[string]bool{"b": true}}, NewParameters(cfg))
+}
+
+func TestRenderFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "script.sh")
+	require.Nil(t, os.WriteFile(path, []byte("echo ${a} ${b}"), 0500))
+
+	names, err := RenderFile(path, Parameters{Values: map[string]string{"a": "1"}, Protected: map[string]bool{"b": true}}, "")
+	require.Nil(t, err)
+	require.Equal(t, []string{"a", "b"}, names)
+	b, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, `echo '1' "${b}"`, string(b), "the values of the protected parameters are not written to disk")
+	fi, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0500), fi.Mode().Perm())
+
+	_, err = RenderFile(filepath.Join(t.TempDir(), "missing.sh"), Parameters{}, "")
+	require.ErrorContains(t, err, "failed to read the script template")
+}
@@ -3,7 +3,9 @@ package service
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/Azure/run-command-handler-linux/internal/constants"
 	"github.com/Azure/run-command-handler-linux/pkg/servicehandler"
@@ -26,6 +28,7 @@ Restart=always
 RestartSec=5
 WorkingDirectory=%run_command_working_directory%
 ExecStart=%run_command_working_directory%/bin/immediate-run-command-handler
+ExecReload=/bin/kill -HUP $MAINPID
 StandardOutput=append:%run_command_output_directory%
 StandardError=append:%run_command_output_directory%
 
@@ -33,14 +36,35 @@ StandardError=append:%run_command_output_directory%
 WantedBy=multi-user.target`
 )
 
+// Options changes how the service gets installed or uninstalled
+type Options struct {
+	// DryRun only logs the actions that would be applied without changing the system
+	DryRun bool
+
+	// UnitPath is the directory where the unit configuration file is written. When empty,
+	// the systemd configuration path found in the system is used.
+	UnitPath string
+}
+
 func Register(ctx *log.Context) error {
+	return RegisterWithOptions(ctx, Options{})
+}
+
+// RegisterWithOptions installs, enables and starts the service using the given options
+func RegisterWithOptions(ctx *log.Context, opts Options) error {
 	if !isSystemdSupported(ctx) {
 		return errors.New("Systemd not supported. Failed to register service")
 	}
 
 	ctx.Log("message", "Generating service configuration files")
 	systemdUnitContent := generateServiceConfigurationContent(ctx)
-	serviceHandler := getSystemdHandler(ctx)
+	serviceHandler := getSystemdHandlerWithUnitPath(ctx, opts.UnitPath)
+
+	if opts.DryRun {
+		ctx.Log("message", "Dry run: the service would be registered and started with the following unit configuration", "unitPath", opts.UnitPath)
+		fmt.Println(systemdUnitContent)
+		return nil
+	}
 
 	ctx.Log("message", "Registering service")
 	err := serviceHandler.Register(ctx, systemdUnitContent)
@@ -48,7 +72,7 @@ func Register(ctx *log.Context) error {
 		return err
 	}
 
-	err = Start(ctx)
+	err = serviceHandler.Start()
 	if err != nil {
 		return err
 	}
@@ -58,8 +82,18 @@ func Register(ctx *log.Context) error {
 }
 
 func DeRegister(ctx *log.Context) error {
+	return DeRegisterWithOptions(ctx, Options{})
+}
+
+// DeRegisterWithOptions stops, disables and removes the service using the given options
+func DeRegisterWithOptions(ctx *log.Context, opts Options) error {
 	if isSystemdSupported(ctx) {
-		serviceHandler := getSystemdHandler(ctx)
+		serviceHandler := getSystemdHandlerWithUnitPath(ctx, opts.UnitPath)
+
+		if opts.DryRun {
+			ctx.Log("message", "Dry run: the service would be stopped, disabled and its unit configuration removed", "unitPath", opts.UnitPath)
+			return nil
+		}
 
 		ctx.Log("message", "Deregistering service")
 		err := serviceHandler.DeRegister(ctx)
@@ -182,14 +216,29 @@ func IsInstalled(ctx *log.Context) (bool, error) {
 }
 
 func getSystemdHandler(ctx *log.Context) *servicehandler.Handler {
+	return getSystemdHandlerWithUnitPath(ctx, "")
+}
+
+func getSystemdHandlerWithUnitPath(ctx *log.Context, unitPath string) *servicehandler.Handler {
 	ctx.Log("message", "Getting service handler for "+systemdUnitName)
 	config := servicehandler.NewConfiguration(systemdUnitName)
-	handler := servicehandler.NewHandler(systemd.NewUnitManager(), config, ctx)
+	manager := systemd.NewUnitManager()
+	if unitPath != "" {
+		ctx.Log("message", "Using unit configuration path: "+unitPath)
+		manager = systemd.NewUnitManagerWithConfigurationBasePath(unitPath)
+	}
+	handler := servicehandler.NewHandler(manager, config, ctx)
 	return &handler
 }
 
 func generateServiceConfigurationContent(ctx *log.Context) string {
 	workingDirectory := os.Getenv("AZURE_GUEST_AGENT_EXTENSION_PATH")
+	if workingDirectory == "" {
+		// Not invoked by the agent (e.g., install-service run by an operator). The executable lives in [EXT_NAME]/bin/.
+		if executable, err := os.Executable(); err == nil {
+			workingDirectory = filepath.Dir(filepath.Dir(executable))
+		}
+	}
 	systemdConfigContentWithOutputDir := strings.ReplaceAll(systemdUnitConfigurationTemplate, runcommand_output_directory_placeholder, constants.ImmediateRCOutputDirectory)
 	systemdConfigContent := strings.ReplaceAll(systemdConfigContentWithOutputDir, runcommand_working_directory_placeholder, workingDirectory)
 	ctx.Log("message", "Using working directory: "+workingDirectory)
@@ -208,3 +257,60 @@ func isSystemdSupported(ctx *log.Context) bool {
 
 	return result
 }
+
+// GetUnitConfiguration returns the content of the unit configuration file of the installed service
+func GetUnitConfiguration(ctx *log.Context) (string, error) {
+	unitConfigPath, err := systemd.NewUnitManager().GetUnitConfigurationFilePath(systemdUnitName, ctx)
+	if err != nil {
+		return "", err
+	}
+	b, err := os.ReadFile(unitConfigPath)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read unit configuration file")
+	}
+	return string(b), nil
+}
+
+// RestoreUnitConfiguration replaces the unit configuration of the service with the given one, e.g., the unit
+// configuration of the version being updated from, and restarts the service
+func RestoreUnitConfiguration(ctx *log.Context, unitConfigContent string) error {
+	serviceHandler := getSystemdHandler(ctx)
+
+	ctx.Log("message", "Restoring service unit configuration")
+	// The service may be restarting in a loop, so it is stopped before replacing its unit configuration
+	serviceHandler.Stop()
+	if err := serviceHandler.Register(ctx, unitConfigContent); err != nil {
+		return err
+	}
+	if err := serviceHandler.Start(); err != nil {
+		return err
+	}
+
+	ctx.Log("message", "Service unit configuration restored")
+	return nil
+}
+
+// WaitUntilActive returns an error unless the service becomes active within the given timeout and is still active
+// after the given stabilization period, so a service exiting right after it starts is not considered healthy
+func WaitUntilActive(ctx *log.Context, timeout time.Duration, stabilization time.Duration) error {
+	isActive := func() bool {
+		active, err := IsActive(ctx)
+		return err == nil && active
+	}
+	return waitUntilActive(isActive, time.Sleep, timeout, stabilization)
+}
+
+func waitUntilActive(isActive func() bool, sleep func(time.Duration), timeout time.Duration, stabilization time.Duration) error {
+	for waited := time.Duration(0); !isActive(); waited += time.Second {
+		if waited >= timeout {
+			return errors.Errorf("service did not become active within %v", timeout)
+		}
+		sleep(time.Second)
+	}
+
+	sleep(stabilization)
+	if !isActive() {
+		return errors.Errorf("service stopped within %v of becoming active", stabilization)
+	}
+	return nil
+}
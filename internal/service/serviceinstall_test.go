@@ -0,0 +1,30 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_waitUntilActive(t *testing.T) {
+	noSleep := func(time.Duration) {}
+	states := func(active ...bool) func() bool {
+		return func() bool {
+			result := active[0]
+			if len(active) > 1 {
+				active = active[1:]
+			}
+			return result
+		}
+	}
+
+	require.Nil(t, waitUntilActive(states(true), noSleep, 5*time.Second, time.Second))
+	require.Nil(t, waitUntilActive(states(false, false, true), noSleep, 5*time.Second, time.Second))
+
+	err := waitUntilActive(states(false), noSleep, 5*time.Second, time.Second)
+	require.ErrorContains(t, err, "did not become active")
+
+	err = waitUntilActive(states(true, false), noSleep, 5*time.Second, time.Second)
+	require.ErrorContains(t, err, "stopped within")
+}
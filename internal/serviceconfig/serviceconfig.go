@@ -0,0 +1,100 @@
+// Package serviceconfig loads the configuration of the immediate run command service from a local file, so it can be
+// changed and reloaded (on SIGHUP) without restarting the service and interrupting the scripts it executes.
+package serviceconfig
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/Azure/run-command-handler-linux/internal/trustedfile"
+	"github.com/pkg/errors"
+)
+
+// variablePrefix is the prefix of the variables the file can set, those configuring the service
+const variablePrefix = "RunCommand"
+
+// Loader applies the variables of the configuration file to the environment of the service, where the service reads
+// its configuration from. The file has a "Name=value" line per variable, e.g., RunCommandReservedHighPrioritySlots=2,
+// like the environment files of systemd. Empty lines and lines starting with '#' are ignored.
+type Loader struct {
+	path string
+	// initial keeps the value each variable set by the file had in the environment of the service, nil if unset
+	initial map[string]*string
+}
+
+// NewLoader returns a loader of the configuration file at path
+func NewLoader(path string) *Loader {
+	return &Loader{path: path, initial: make(map[string]*string)}
+}
+
+// Load applies the variables of the configuration file and returns their names. The variables removed from the
+// file since the last load go back to the value the service started with. Nothing is applied if the file is
+// invalid, and a missing file sets no variable.
+func (l *Loader) Load() ([]string, error) {
+	variables, err := readConfig(l.path)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, initial := range l.initial {
+		if _, ok := variables[name]; ok {
+			continue
+		}
+		if initial == nil {
+			os.Unsetenv(name)
+		} else {
+			os.Setenv(name, *initial)
+		}
+		delete(l.initial, name)
+	}
+
+	names := make([]string, 0, len(variables))
+	for name, value := range variables {
+		if _, ok := l.initial[name]; !ok {
+			var initial *string
+			if v, ok := os.LookupEnv(name); ok {
+				initial = &v
+			}
+			l.initial[name] = initial
+		}
+		os.Setenv(name, value)
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// readConfig returns the variables of the configuration file, none if there is no file
+func readConfig(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open service configuration")
+	}
+	defer f.Close()
+
+	if err := trustedfile.Check(f, "service configuration"); err != nil {
+		return nil, err
+	}
+
+	variables := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !strings.HasPrefix(name, variablePrefix) {
+			return nil, errors.Errorf("line %d must set a %s variable as Name=value", n, variablePrefix)
+		}
+		variables[name] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read service configuration")
+	}
+	return variables, nil
+}
@@ -0,0 +1,51 @@
+package serviceconfig
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Load(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "service.conf")
+	loader := NewLoader(path)
+	t.Setenv("RunCommandTestStarted", "initial")
+
+	// No file
+	variables, err := loader.Load()
+	require.Nil(t, err)
+	require.Empty(t, variables)
+
+	require.Nil(t, os.WriteFile(path, []byte("# service configuration\n\nRunCommandTestStarted = changed\nRunCommandTestAdded=added\n"), 0644))
+	variables, err = loader.Load()
+	require.Nil(t, err)
+	require.ElementsMatch(t, []string{"RunCommandTestStarted", "RunCommandTestAdded"}, variables)
+	require.Equal(t, "changed", os.Getenv("RunCommandTestStarted"))
+	require.Equal(t, "added", os.Getenv("RunCommandTestAdded"))
+
+	// An invalid file changes nothing
+	require.Nil(t, os.WriteFile(path, []byte("PATH=/tmp\n"), 0644))
+	_, err = loader.Load()
+	require.ErrorContains(t, err, "line 1 must set a RunCommand variable")
+	require.Equal(t, "added", os.Getenv("RunCommandTestAdded"))
+
+	// The variables removed from the file go back to their initial values
+	require.Nil(t, os.WriteFile(path, nil, 0644))
+	variables, err = loader.Load()
+	require.Nil(t, err)
+	require.Empty(t, variables)
+	require.Equal(t, "initial", os.Getenv("RunCommandTestStarted"))
+	_, ok := os.LookupEnv("RunCommandTestAdded")
+	require.False(t, ok)
+}
+
+func Test_Load_rejectsWritableByOthers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "service.conf")
+	require.Nil(t, os.WriteFile(path, []byte("RunCommandTestAdded=added\n"), 0644))
+	require.Nil(t, os.Chmod(path, 0666))
+
+	_, err := NewLoader(path).Load()
+	require.ErrorContains(t, err, "only writable by its owner")
+}
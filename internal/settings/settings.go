@@ -2,6 +2,8 @@ package settings
 
 import (
 	"encoding/json"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -14,6 +16,48 @@ type SettingsCommon struct {
 	SeqNo                   *int                   `json:"seqNo"`
 	ExtensionName           *string                `json:"extensionName"`
 	ExtensionState          *string                `json:"extensionState"`
+
+	// Priority of an immediate run command. High priority commands can use the execution slots reserved for them.
+	Priority string `json:"priority,omitempty"`
+
+	// ExpirationTime of an immediate run command, in RFC 3339 format. A command not started by then is reported as
+	// expired instead of executing.
+	ExpirationTime string `json:"expirationTime,omitempty"`
+}
+
+const (
+	// HighPriority is used for short diagnostic commands that should not wait behind long-running scripts
+	HighPriority = "high"
+
+	// NormalPriority is the default priority of immediate run commands
+	NormalPriority = "normal"
+
+	// LocalExtensionNamePrefix starts the extension names of the run commands submitted locally, on the trigger
+	// socket, and only theirs. ':' is not allowed in the names of the run commands delivered by HGAP, so those
+	// submitted locally never share a journal entry, a download folder or a status with them.
+	LocalExtensionNamePrefix = "local:"
+)
+
+// IsLocal returns true if the extension name is in the namespace of the run commands submitted locally
+func (li SettingsCommon) IsLocal() bool {
+	return li.ExtensionName != nil && strings.HasPrefix(*li.ExtensionName, LocalExtensionNamePrefix)
+}
+
+// IsHighPriority returns true if the settings were sent with the high priority
+func (li SettingsCommon) IsHighPriority() bool {
+	return strings.EqualFold(li.Priority, HighPriority)
+}
+
+// Expiry returns the time the settings expire at, if they have an expiration time
+func (li SettingsCommon) Expiry() (time.Time, bool, error) {
+	if li.ExpirationTime == "" {
+		return time.Time{}, false, nil
+	}
+	expiry, err := time.Parse(time.RFC3339, li.ExpirationTime)
+	if err != nil {
+		return time.Time{}, false, errors.Wrapf(err, "invalid expiration time %q", li.ExpirationTime)
+	}
+	return expiry, true, nil
 }
 
 func (li *SettingsCommon) UnmarshalJSON(data []byte) error {
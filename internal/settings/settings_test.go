@@ -3,6 +3,7 @@ package settings
 import (
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -78,3 +79,30 @@ func Test_MarshalVMSettingAPI(t *testing.T) {
 	require.Contains(t, json, "publicSettings", "missing public settings field. This gets exported via PublicSettingsRaw.")
 	require.Contains(t, json, "echo Hello World!")
 }
+
+func Test_Expiry(t *testing.T) {
+	var settings SettingsCommon
+	_, ok, err := settings.Expiry()
+	require.Nil(t, err)
+	require.False(t, ok, "settings without an expiration time never expire")
+
+	require.Nil(t, json.Unmarshal([]byte(`{"extensionName": "rc1", "seqNo": 1, "expirationTime": "2026-01-02T03:04:05Z"}`), &settings))
+	expiry, ok, err := settings.Expiry()
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC), expiry.UTC())
+
+	settings.ExpirationTime = "tomorrow"
+	_, _, err = settings.Expiry()
+	require.ErrorContains(t, err, "invalid expiration time \"tomorrow\"")
+}
+
+func Test_IsLocal(t *testing.T) {
+	var settings SettingsCommon
+	require.False(t, settings.IsLocal())
+	for name, local := range map[string]bool{"rc1": false, "local:rc1": true, "rc1local:": false} {
+		name := name
+		settings.ExtensionName = &name
+		require.Equal(t, local, settings.IsLocal(), name)
+	}
+}
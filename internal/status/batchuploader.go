@@ -0,0 +1,82 @@
+//go:build !slim
+
+package status
+
+import (
+	"sync"
+
+	"github.com/go-kit/kit/log"
+)
+
+// batchUploader coalesces the uploads requested while another upload is in flight into a single upload.
+// The aggregate status is read when an upload starts, so it includes the status of every caller in the
+// batch and dense VMs send one request per batch instead of one per status change.
+type batchUploader struct {
+	// uploadFunc uploads the aggregate status of every caller, logging with ctx
+	uploadFunc func(ctx *log.Context) error
+
+	mutex   sync.Mutex
+	running bool
+	pending *uploadBatch
+}
+
+// uploadBatch is a set of callers waiting for the same upload
+type uploadBatch struct {
+	done chan struct{}
+	err  error
+
+	// logs are the entries logged by the upload, logged again by every caller once it is done
+	logs logRecorder
+}
+
+// logRecorder is a logger keeping the entries logged
+type logRecorder [][]interface{}
+
+func (r *logRecorder) Log(keyvals ...interface{}) error {
+	*r = append(*r, append([]interface{}(nil), keyvals...))
+	return nil
+}
+
+func newBatchUploader(uploadFunc func(ctx *log.Context) error) *batchUploader {
+	return &batchUploader{uploadFunc: uploadFunc}
+}
+
+// upload joins the next batch and waits until it is uploaded. Callers must update the aggregate status
+// before calling upload so the batch includes it. The upload is logged with ctx, as the upload of the
+// batch is not tied to the caller starting it.
+func (u *batchUploader) upload(ctx *log.Context) error {
+	u.mutex.Lock()
+	if u.pending == nil {
+		u.pending = &uploadBatch{done: make(chan struct{})}
+	}
+	batch := u.pending
+	if !u.running {
+		u.running = true
+		go u.run()
+	}
+	u.mutex.Unlock()
+
+	<-batch.done
+	for _, keyvals := range batch.logs {
+		ctx.Log(keyvals...)
+	}
+	return batch.err
+}
+
+// run uploads the pending batches one at a time until no caller is waiting
+func (u *batchUploader) run() {
+	for {
+		u.mutex.Lock()
+		batch := u.pending
+		u.pending = nil
+		if batch == nil {
+			u.running = false
+			u.mutex.Unlock()
+			return
+		}
+		u.mutex.Unlock()
+
+		batch.err = u.uploadFunc(log.NewContext(&batch.logs))
+		close(batch.done)
+	}
+}
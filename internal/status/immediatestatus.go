@@ -0,0 +1,239 @@
+//go:build !slim
+
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/clock"
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/requesthelper"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/Azure/run-command-handler-linux/pkg/statusreporter"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxImmediateStatusSizeInBytes is the largest aggregate status accepted by HGAP
+	maxImmediateStatusSizeInBytes = 128 * 1024
+
+	// finishedStatusRetention is how long the status of a finished immediate run command stays in the aggregate
+	// status once it was uploaded, and is served to the local clients
+	finishedStatusRetention = time.Hour
+
+	// time to sleep between upload retries is an exponential backoff formula:
+	//   t(n) = k * m^n
+	immediateStatusRetryN = 3
+	immediateStatusRetryK = time.Second * 2
+	immediateStatusRetryM = 2
+)
+
+// ImmediateStatusAggregator keeps the latest status of every immediate run command so the
+// whole set can be uploaded to HGAP in a single request.
+type ImmediateStatusAggregator struct {
+	mutex    sync.Mutex
+	statuses map[string]types.ImmediateHandlerStatus
+}
+
+func NewImmediateStatusAggregator() *ImmediateStatusAggregator {
+	return &ImmediateStatusAggregator{statuses: make(map[string]types.ImmediateHandlerStatus)}
+}
+
+var (
+	// immediateStatus is shared by all the immediate run commands launched by the service
+	immediateStatus = NewImmediateStatusAggregator()
+
+	// immediateStatusUploader batches the uploads of the aggregate status requested at the same time
+	immediateStatusUploader = newBatchUploader(func(ctx *log.Context) error {
+		return uploadImmediateStatus(ctx, immediateStatus, newStatusReporter(ctx), clock.Real.Sleep)
+	})
+)
+
+// Set stores the given status replacing any previous status for the same extension name
+func (a *ImmediateStatusAggregator) Set(s types.ImmediateHandlerStatus) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.statuses[s.ExtensionName] = s
+}
+
+// Get returns the status of the given extension name, if any
+func (a *ImmediateStatusAggregator) Get(extensionName string) (types.ImmediateHandlerStatus, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	s, ok := a.statuses[extensionName]
+	return s, ok
+}
+
+// RemoveFinished deletes the statuses of the uploaded ones that are final and older than finishedBefore, unless
+// they were replaced since they were uploaded
+func (a *ImmediateStatusAggregator) RemoveFinished(uploaded []types.ImmediateHandlerStatus, finishedBefore time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, s := range uploaded {
+		if !s.IsTerminal() || a.statuses[s.ExtensionName] != s {
+			continue
+		}
+		if finished, err := time.Parse(time.RFC3339, s.TimestampUTC); err == nil && finished.Before(finishedBefore) {
+			delete(a.statuses, s.ExtensionName)
+		}
+	}
+}
+
+// Snapshot returns a copy of the stored statuses sorted by timestamp (oldest first)
+func (a *ImmediateStatusAggregator) Snapshot() []types.ImmediateHandlerStatus {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	result := make([]types.ImmediateHandlerStatus, 0, len(a.statuses))
+	for _, s := range a.statuses {
+		result = append(result, s)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].TimestampUTC == result[j].TimestampUTC {
+			return result[i].ExtensionName < result[j].ExtensionName
+		}
+		return result[i].TimestampUTC < result[j].TimestampUTC
+	})
+	return result
+}
+
+// ReportStatusToBlob stores the status of the immediate run command in the aggregate status and
+// uploads the aggregate status of all the immediate run commands to HGAP. Concurrent reports are
+// uploaded together in a single request.
+func ReportStatusToBlob(ctx *log.Context, hEnv types.HandlerEnvironment, metadata types.RCMetadata, statusType types.StatusType, c types.Cmd, msg string) error {
+	if !c.ShouldReportStatus {
+		ctx.Log("status", "not reported for operation (by design)")
+		return nil
+	}
+
+	immediateStatus.Set(types.NewImmediateHandlerStatus(constants.RunCommandHandlerName, metadata.ExtName, metadata.SeqNum, statusType, c.Name, msg))
+	return immediateStatusUploader.upload(ctx)
+}
+
+// ImmediateStatus returns the latest status reported by the immediate run command of the given extension name, if any
+func ImmediateStatus(extensionName string) (types.ImmediateHandlerStatus, bool) {
+	return immediateStatus.Get(extensionName)
+}
+
+// uploadImmediateStatus serializes the aggregate status, split into chunks fitting into the size limit, and uploads
+// every chunk with retries. Returns the last error if some chunks were not uploaded. Once they are all uploaded, the
+// statuses of the run commands finished for longer than finishedStatusRetention are removed from the aggregate status.
+func uploadImmediateStatus(ctx *log.Context, aggregator *ImmediateStatusAggregator, reporter statusreporter.IGuestInformationServiceClient, sf requesthelper.SleepFunc) error {
+	snapshot := aggregator.Snapshot()
+	chunks, err := getImmediateStatusChunks(ctx, snapshot, maxImmediateStatusSizeInBytes)
+	if err != nil {
+		return errors.Wrap(err, "failed to get json for immediate status report")
+	}
+
+	var lastErr error
+	for i, statusJson := range chunks {
+		if len(chunks) > 1 {
+			ctx.Log("message", fmt.Sprintf("uploading chunk %v of %v of the immediate status", i+1, len(chunks)))
+		}
+		if err := uploadImmediateStatusJson(ctx, statusJson, reporter, sf); err != nil {
+			lastErr = err
+		}
+	}
+	if lastErr == nil {
+		aggregator.RemoveFinished(snapshot, time.Now().Add(-finishedStatusRetention))
+	}
+	return lastErr
+}
+
+// uploadImmediateStatusJson uploads a serialized aggregate status with retries
+func uploadImmediateStatusJson(ctx *log.Context, statusJson []byte, reporter statusreporter.IGuestInformationServiceClient, sf requesthelper.SleepFunc) error {
+	var lastErr error
+	for n := 0; n < immediateStatusRetryN; n++ {
+		ctx.Log("message", fmt.Sprintf("uploading immediate status to %v (attempt %v)", reporter.GetEndpoint(), n+1))
+		response, err := reporter.ReportStatus(string(statusJson))
+		if err == nil && response.StatusCode == http.StatusOK {
+			ctx.Log("message", "Successfully uploaded immediate status")
+			return nil
+		}
+
+		if err != nil {
+			lastErr = errors.Wrap(err, "failed to report immediate status to HGAP")
+		} else {
+			lastErr = errors.New("failed to report immediate status with error code " + response.Status)
+			if !requesthelper.IsTransientHTTPStatusCode(response.StatusCode) {
+				break
+			}
+		}
+		ctx.Log("warning", fmt.Sprintf("error on attempt %v: %v", n+1, lastErr))
+
+		if n < immediateStatusRetryN-1 {
+			sf(immediateStatusRetryK * time.Duration(int(math.Pow(float64(immediateStatusRetryM), float64(n)))))
+		}
+	}
+
+	return lastErr
+}
+
+// getImmediateStatusChunks serializes the given statuses into aggregate statuses of at most maxSize bytes each, so
+// an aggregate status larger than HGAP accepts is uploaded in several requests rather than dropping statuses. The
+// statuses keep their order across the chunks. A status larger than maxSize on its own is not uploaded.
+func getImmediateStatusChunks(ctx *log.Context, statuses []types.ImmediateHandlerStatus, maxSize int) ([][]byte, error) {
+	empty, err := json.Marshal(types.ImmediateTopLevelStatus{AggregateHandlerImmediateStatus: []types.ImmediateHandlerStatus{}})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal immediate status report into json")
+	}
+
+	var chunks [][]byte
+	var chunk []types.ImmediateHandlerStatus
+	chunkSize := len(empty)
+	addChunk := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		b, err := json.Marshal(types.ImmediateTopLevelStatus{AggregateHandlerImmediateStatus: chunk})
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal immediate status report into json")
+		}
+		chunks = append(chunks, b)
+		chunk, chunkSize = nil, len(empty)
+		return nil
+	}
+	for _, s := range statuses {
+		b, err := json.Marshal(s)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal immediate status report into json")
+		}
+		if len(empty)+len(b) > maxSize {
+			ctx.Log("warning", fmt.Sprintf("the status of %v exceeds %v bytes. Dropping it", s.ExtensionName, maxSize))
+			continue
+		}
+
+		// The statuses are separated by commas
+		size := len(b)
+		if len(chunk) > 0 {
+			size++
+		}
+		if chunkSize+size > maxSize {
+			if err := addChunk(); err != nil {
+				return nil, err
+			}
+			size = len(b)
+		}
+		chunk = append(chunk, s)
+		chunkSize += size
+	}
+	if err := addChunk(); err != nil {
+		return nil, err
+	}
+
+	if len(chunks) == 0 {
+		if len(statuses) > 0 {
+			return nil, fmt.Errorf("every immediate status exceeds the limit of %v bytes", maxSize)
+		}
+		chunks = append(chunks, empty)
+	}
+	return chunks, nil
+}
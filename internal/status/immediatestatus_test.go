@@ -0,0 +1,226 @@
+//go:build !slim
+
+package status
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+type TestImmediateStatusClient struct {
+	statusCodes []int
+	uploads     []string
+}
+
+func (c *TestImmediateStatusClient) GetEndpoint() string {
+	return "localhost:3000/upload"
+}
+
+func (c *TestImmediateStatusClient) ReportStatus(statusToUpload string) (*http.Response, error) {
+	c.uploads = append(c.uploads, statusToUpload)
+	w := httptest.NewRecorder()
+	w.WriteHeader(c.statusCodes[len(c.uploads)-1])
+	return w.Result(), nil
+}
+
+func noSleep(d time.Duration) {}
+
+func Test_ImmediateStatusAggregatorKeepsLatestStatusPerExtension(t *testing.T) {
+	aggregator := NewImmediateStatusAggregator()
+	aggregator.Set(types.NewImmediateHandlerStatus("handler", "rc1", 1, types.StatusTransitioning, "Enable", "running"))
+	aggregator.Set(types.NewImmediateHandlerStatus("handler", "rc2", 1, types.StatusTransitioning, "Enable", "running"))
+	aggregator.Set(types.NewImmediateHandlerStatus("handler", "rc1", 1, types.StatusSuccess, "Enable", "done"))
+
+	snapshot := aggregator.Snapshot()
+	require.Equal(t, 2, len(snapshot))
+	for _, s := range snapshot {
+		if s.ExtensionName == "rc1" {
+			require.Equal(t, types.StatusSuccess, s.Status.Status)
+		}
+	}
+
+	rc1, ok := aggregator.Get("rc1")
+	require.True(t, ok)
+	require.Equal(t, "done", rc1.Status.FormattedMessage.Message)
+
+}
+
+func Test_ImmediateStatusAggregatorRemovesFinishedStatuses(t *testing.T) {
+	aggregator := NewImmediateStatusAggregator()
+	hourAgo := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	for _, s := range []types.ImmediateHandlerStatus{
+		types.NewImmediateHandlerStatus("handler", "finished", 1, types.StatusSuccess, "Enable", "done"),
+		types.NewImmediateHandlerStatus("handler", "running", 1, types.StatusTransitioning, "Enable", "running"),
+		types.NewImmediateHandlerStatus("handler", "replaced", 1, types.StatusError, "Enable", "failed"),
+		types.NewImmediateHandlerStatus("handler", "recent", 1, types.StatusSuccess, "Enable", "done"),
+	} {
+		if s.ExtensionName != "recent" {
+			s.TimestampUTC = hourAgo
+		}
+		aggregator.Set(s)
+	}
+	uploaded := aggregator.Snapshot()
+	aggregator.Set(types.NewImmediateHandlerStatus("handler", "replaced", 2, types.StatusTransitioning, "Enable", "running"))
+	aggregator.Set(types.NewImmediateHandlerStatus("handler", "new", 1, types.StatusSuccess, "Enable", "done"))
+
+	aggregator.RemoveFinished(uploaded, time.Now().Add(-time.Minute))
+	var remaining []string
+	for _, s := range aggregator.Snapshot() {
+		remaining = append(remaining, s.ExtensionName)
+	}
+	require.ElementsMatch(t, []string{"running", "replaced", "recent", "new"}, remaining)
+}
+
+func Test_UploadImmediateStatusRemovesFinishedStatuses(t *testing.T) {
+	aggregator := NewImmediateStatusAggregator()
+	finished := types.NewImmediateHandlerStatus("handler", "rc1", 1, types.StatusSuccess, "Enable", "done")
+	finished.TimestampUTC = time.Now().Add(-2 * finishedStatusRetention).UTC().Format(time.RFC3339)
+	aggregator.Set(finished)
+
+	// The status is kept until it is uploaded
+	client := &TestImmediateStatusClient{statusCodes: []int{http.StatusBadRequest, http.StatusOK, http.StatusOK}}
+	require.NotNil(t, uploadImmediateStatus(log.NewContext(log.NewNopLogger()), aggregator, client, noSleep))
+	_, ok := aggregator.Get("rc1")
+	require.True(t, ok)
+
+	require.Nil(t, uploadImmediateStatus(log.NewContext(log.NewNopLogger()), aggregator, client, noSleep))
+	require.Contains(t, client.uploads[1], `"rc1"`)
+	_, ok = aggregator.Get("rc1")
+	require.False(t, ok)
+	require.Nil(t, uploadImmediateStatus(log.NewContext(log.NewNopLogger()), aggregator, client, noSleep))
+	require.NotContains(t, client.uploads[2], `"rc1"`)
+}
+
+func Test_UploadImmediateStatusRetriesTransientErrors(t *testing.T) {
+	aggregator := NewImmediateStatusAggregator()
+	aggregator.Set(types.NewImmediateHandlerStatus("handler", "rc1", 1, types.StatusTransitioning, "Enable", "running"))
+
+	client := &TestImmediateStatusClient{statusCodes: []int{http.StatusServiceUnavailable, http.StatusOK}}
+	err := uploadImmediateStatus(log.NewContext(log.NewNopLogger()), aggregator, client, noSleep)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(client.uploads))
+
+	var topLevelStatus types.ImmediateTopLevelStatus
+	require.Nil(t, json.Unmarshal([]byte(client.uploads[1]), &topLevelStatus))
+	require.Equal(t, "rc1", topLevelStatus.AggregateHandlerImmediateStatus[0].ExtensionName)
+}
+
+func Test_UploadImmediateStatusDoesNotRetryNonTransientErrors(t *testing.T) {
+	aggregator := NewImmediateStatusAggregator()
+	aggregator.Set(types.NewImmediateHandlerStatus("handler", "rc1", 1, types.StatusTransitioning, "Enable", "running"))
+
+	client := &TestImmediateStatusClient{statusCodes: []int{http.StatusBadRequest, http.StatusOK}}
+	err := uploadImmediateStatus(log.NewContext(log.NewNopLogger()), aggregator, client, noSleep)
+	require.ErrorContains(t, err, "400")
+	require.Equal(t, 1, len(client.uploads))
+}
+
+func Test_GetImmediateStatusChunksSplitsLargeStatuses(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	large := strings.Repeat("a", 400)
+	statuses := []types.ImmediateHandlerStatus{
+		types.NewImmediateHandlerStatus("handler", "old", 1, types.StatusSuccess, "Enable", large),
+		types.NewImmediateHandlerStatus("handler", "running", 1, types.StatusTransitioning, "Enable", large),
+		types.NewImmediateHandlerStatus("handler", "new", 1, types.StatusError, "Enable", large),
+	}
+
+	// The first two statuses fit in the first chunk
+	firstTwo, err := json.Marshal(types.ImmediateTopLevelStatus{AggregateHandlerImmediateStatus: statuses[:2]})
+	require.Nil(t, err)
+	chunks, err := getImmediateStatusChunks(ctx, statuses, len(firstTwo))
+	require.Nil(t, err)
+	require.Len(t, chunks, 2)
+	require.Equal(t, firstTwo, chunks[0])
+	var last types.ImmediateTopLevelStatus
+	require.Nil(t, json.Unmarshal(chunks[1], &last))
+	require.Equal(t, statuses[2:], last.AggregateHandlerImmediateStatus)
+
+	running, err := json.Marshal(types.ImmediateTopLevelStatus{AggregateHandlerImmediateStatus: statuses[1:2]})
+	require.Nil(t, err)
+	chunks, err = getImmediateStatusChunks(ctx, statuses, len(running))
+	require.Nil(t, err)
+	require.Len(t, chunks, 3, "every status is uploaded on its own")
+
+	chunks, err = getImmediateStatusChunks(ctx, nil, 100)
+	require.Nil(t, err)
+	require.Equal(t, [][]byte{[]byte(`{"aggregateHandlerImmediateStatus":[]}`)}, chunks)
+
+	_, err = getImmediateStatusChunks(ctx, statuses[1:2], 100)
+	require.ErrorContains(t, err, "exceeds the limit")
+}
+
+func Test_UploadImmediateStatusUploadsEveryChunk(t *testing.T) {
+	aggregator := NewImmediateStatusAggregator()
+	large := strings.Repeat("a", maxImmediateStatusSizeInBytes/2)
+	aggregator.Set(types.NewImmediateHandlerStatus("handler", "rc1", 1, types.StatusSuccess, "Enable", large))
+	aggregator.Set(types.NewImmediateHandlerStatus("handler", "rc2", 1, types.StatusTransitioning, "Enable", large))
+
+	client := &TestImmediateStatusClient{statusCodes: []int{http.StatusOK, http.StatusOK}}
+	require.Nil(t, uploadImmediateStatus(log.NewContext(log.NewNopLogger()), aggregator, client, noSleep))
+	require.Len(t, client.uploads, 2)
+	for _, upload := range client.uploads {
+		require.LessOrEqual(t, len(upload), maxImmediateStatusSizeInBytes)
+	}
+}
+
+func Test_batchUploaderCoalescesConcurrentUploads(t *testing.T) {
+	started := make(chan bool)
+	release := make(chan bool)
+	uploads := 0
+	u := newBatchUploader(func(ctx *log.Context) error {
+		uploads++
+		ctx.Log("message", "uploaded")
+		if uploads == 1 {
+			started <- true
+			<-release
+		}
+		return nil
+	})
+	nop := log.NewContext(log.NewNopLogger())
+
+	// The first upload is in flight while the next callers join the same batch
+	firstDone := make(chan error)
+	go func() { firstDone <- u.upload(nop) }()
+	<-started
+
+	batchDone := make(chan error, 3)
+	var logs [3]logRecorder
+	for i := 0; i < 3; i++ {
+		ctx := log.NewContext(&logs[i])
+		go func() { batchDone <- u.upload(ctx) }()
+	}
+	require.Eventually(t, func() bool {
+		u.mutex.Lock()
+		defer u.mutex.Unlock()
+		return u.pending != nil
+	}, 5*time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	close(release)
+	require.Nil(t, <-firstDone)
+	for i := 0; i < 3; i++ {
+		require.Nil(t, <-batchDone)
+	}
+	require.Equal(t, 2, uploads)
+
+	// Every caller of the batch logs its upload
+	for i := range logs {
+		require.Equal(t, logRecorder{{"message", "uploaded"}}, logs[i])
+	}
+}
+
+func Test_batchUploaderReturnsUploadError(t *testing.T) {
+	err := newBatchUploader(func(*log.Context) error { return errors.New("upload failed") }).upload(log.NewContext(log.NewNopLogger()))
+	require.EqualError(t, err, "upload failed")
+
+	require.Nil(t, newBatchUploader(func(*log.Context) error { return nil }).upload(log.NewContext(log.NewNopLogger())))
+}
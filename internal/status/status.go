@@ -6,18 +6,12 @@ import (
 	"os"
 	"path/filepath"
 
-	"github.com/Azure/run-command-handler-linux/internal/hostgacommunicator"
 	"github.com/Azure/run-command-handler-linux/internal/types"
-	"github.com/Azure/run-command-handler-linux/pkg/statusreporter"
+	"github.com/Azure/run-command-handler-linux/pkg/atomicfile"
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 )
 
-func ReportStatusToBlob(ctx *log.Context, hEnv types.HandlerEnvironment, metadata types.RCMetadata, statusType types.StatusType, c types.Cmd, msg string) error {
-	reporter := statusreporter.NewGuestInformationServiceClient(hostgacommunicator.WireServerFallbackAddress)
-	return reportStatusToEndpoint(ctx, hEnv, metadata, statusType, c, msg, reporter)
-}
-
 // ReportStatusToLocalFile saves operation status to the status file for the extension
 // handler with the optional given message, if the given cmd requires reporting
 // status.
@@ -45,6 +39,32 @@ func ReportStatusToLocalFile(ctx *log.Context, hEnv types.HandlerEnvironment, me
 	return nil
 }
 
+// ReportStatusToFile returns a function saving operation status to the file at path instead of the status folder
+// of the handler, e.g., when the handler runs before the agent
+func ReportStatusToFile(path string) func(ctx *log.Context, hEnv types.HandlerEnvironment, metadata types.RCMetadata, statusType types.StatusType, c types.Cmd, msg string) error {
+	return func(ctx *log.Context, hEnv types.HandlerEnvironment, metadata types.RCMetadata, statusType types.StatusType, c types.Cmd, msg string) error {
+		if !c.ShouldReportStatus {
+			ctx.Log("status", "not reported for operation (by design)")
+			return nil
+		}
+
+		rootStatusJson, err := getRootStatusJson(ctx, statusType, c, msg, true)
+		if err != nil {
+			return errors.Wrap(err, "failed to get json for status report")
+		}
+
+		ctx.Log("message", "reporting status by writing status file", "path", path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return errors.Wrap(err, "failed to create status directory")
+		}
+		if err := writeStatusFile(path, rootStatusJson); err != nil {
+			ctx.Log("event", "failed to save handler status", "error", err)
+			return errors.Wrap(err, "failed to save handler status")
+		}
+		return nil
+	}
+}
+
 // SaveStatusReport persists the status message to the specified status folder using the
 // sequence number. The operation consists of writing to a temporary file in the
 // same folder and moving it to the final destination for atomicity.
@@ -55,21 +75,14 @@ func saveStatusReport(statusFolder string, extName string, seqNo int, rootStatus
 		fn = extName + "." + fn
 	}
 
-	path := filepath.Join(statusFolder, fn)
-	tmpFile, err := os.CreateTemp(statusFolder, fn)
-	if err != nil {
-		return fmt.Errorf("status: failed to create temporary file: %v", err)
-	}
-	tmpFile.Close()
-
-	if err := os.WriteFile(tmpFile.Name(), rootStatusJson, 0644); err != nil {
-		return fmt.Errorf("status: failed to path=%s error=%v", tmpFile.Name(), err)
-	}
+	return writeStatusFile(filepath.Join(statusFolder, fn), rootStatusJson)
+}
 
-	if err := os.Rename(tmpFile.Name(), path); err != nil {
-		return fmt.Errorf("status: failed to move to path=%s error=%v", path, err)
+// writeStatusFile atomically replaces the status file at path
+func writeStatusFile(path string, rootStatusJson []byte) error {
+	if err := atomicfile.WriteFile(path, rootStatusJson, 0644); err != nil {
+		return fmt.Errorf("status: failed to write path=%s error=%v", path, err)
 	}
-
 	return nil
 }
 
@@ -91,29 +104,3 @@ func getRootStatusJson(ctx *log.Context, statusType types.StatusType, c types.Cm
 
 	return b, nil
 }
-
-func reportStatusToEndpoint(ctx *log.Context, hEnv types.HandlerEnvironment, metadata types.RCMetadata, statusType types.StatusType, c types.Cmd, msg string, reporter statusreporter.IGuestInformationServiceClient) error {
-	if !c.ShouldReportStatus {
-		ctx.Log("status", "not reported for operation (by design)")
-		return nil
-	}
-
-	rootStatusJson, err := getRootStatusJson(ctx, statusType, c, msg, false)
-	if err != nil {
-		return errors.Wrap(err, "failed to get json for status report")
-	}
-
-	ctx.Log("message", "create request to upload status to: "+reporter.GetEndpoint())
-	response, err := reporter.ReportStatus(string(rootStatusJson))
-	if err != nil {
-		return errors.Wrap(err, "failed to report status to HGAP")
-	}
-
-	if response.StatusCode != 200 {
-		return errors.New("failed to report status with error code " + response.Status)
-	}
-
-	ctx.Log("message", fmt.Sprintf("Status received from request to %v: %v", response.Request.URL, response.Status))
-	ctx.Log("message", "Successfully uploaded status")
-	return nil
-}
@@ -1,17 +1,12 @@
 package status
 
 import (
-	"net/http"
-	"net/http/httptest"
 	"os"
 	"path/filepath"
-	"strconv"
 	"testing"
 
 	"github.com/Azure/run-command-handler-linux/internal/constants"
 	"github.com/Azure/run-command-handler-linux/internal/types"
-	"github.com/Azure/run-command-handler-linux/pkg/statusreporter"
-	"github.com/ahmetb/go-httpbin"
 	"github.com/go-kit/kit/log"
 	"github.com/stretchr/testify/require"
 )
@@ -44,6 +39,17 @@ func Test_reportStatus_fileExists(t *testing.T) {
 	require.NotEqual(t, 0, len(b), ".status file not empty")
 }
 
+func Test_reportStatusToFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "provisioning.status")
+	metadata := types.NewRCMetadata("provisioning", 0, constants.ProvisioningDownloadFolder, constants.DataDir)
+	report := ReportStatusToFile(path)
+	require.Nil(t, report(log.NewContext(log.NewNopLogger()), types.HandlerEnvironment{}, metadata, types.StatusSuccess, types.CmdEnableTemplate, "done"))
+
+	b, err := os.ReadFile(path)
+	require.Nil(t, err, "status file exists")
+	require.Contains(t, string(b), "done")
+}
+
 func Test_reportStatus_checksIfShouldBeReported(t *testing.T) {
 	for _, c := range types.CmdTemplates {
 		tmpDir, err := os.MkdirTemp("", "status-"+c.Name)
@@ -70,40 +76,3 @@ func Test_reportStatus_checksIfShouldBeReported(t *testing.T) {
 		}
 	}
 }
-
-type TestGuestInformationClient struct {
-	endpoint string
-}
-
-func (c TestGuestInformationClient) GetEndpoint() string {
-	return c.endpoint
-}
-
-func (c TestGuestInformationClient) ReportStatus(statusToUpload string) (*http.Response, error) {
-	w := httptest.NewRecorder()
-	resp := w.Result()
-	resp.Request = httptest.NewRequest(http.MethodPut, c.endpoint, nil)
-	return resp, nil
-}
-
-func Test_ReportStatusToEndpointOk(t *testing.T) {
-	ctx := log.NewContext(log.NewSyncLogger(log.NewLogfmtLogger(os.Stdout))).With("time", log.DefaultTimestamp)
-
-	fakeEnv := types.HandlerEnvironment{}
-	metadata := types.NewRCMetadata("testExtension", 2, constants.DownloadFolder, constants.DataDir)
-	reporter := TestGuestInformationClient{"localhost:3000/upload"}
-	err := reportStatusToEndpoint(ctx, fakeEnv, metadata, types.StatusSuccess, types.CmdEnableTemplate, "customMessage", reporter)
-	require.Nil(t, err)
-}
-
-func Test_ReportStatusToEndpointNotFound(t *testing.T) {
-	ctx := log.NewContext(log.NewSyncLogger(log.NewLogfmtLogger(os.Stdout))).With("time", log.DefaultTimestamp)
-	srv := httptest.NewServer(httpbin.GetMux())
-	defer srv.Close()
-	fakeEnv := types.HandlerEnvironment{}
-	metadata := types.NewRCMetadata("testExtension", 2, constants.DownloadFolder, constants.DataDir)
-	reporter := statusreporter.NewGuestInformationServiceClient(srv.URL + "/uploadnotexistent")
-	err := reportStatusToEndpoint(ctx, fakeEnv, metadata, types.StatusSuccess, types.CmdEnableTemplate, "customMessage", reporter)
-	require.ErrorContains(t, err, strconv.Itoa(http.StatusNotFound))
-	require.ErrorContains(t, err, "Not Found")
-}
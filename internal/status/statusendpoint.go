@@ -0,0 +1,83 @@
+//go:build !slim
+
+package status
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/hostgacommunicator"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/Azure/run-command-handler-linux/pkg/requestheaders"
+	"github.com/Azure/run-command-handler-linux/pkg/statusreporter"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// newStatusReporter returns the client uploading the status to HGAP, configured from the environment.
+// An invalid configuration is logged and the wire server fallback address is used instead.
+func newStatusReporter(ctx *log.Context) statusreporter.IGuestInformationServiceClient {
+	reporter, err := getConfiguredStatusReporter()
+	if err != nil {
+		ctx.Log("warning", fmt.Sprintf("invalid status endpoint configuration. Using %v", hostgacommunicator.WireServerFallbackAddress), "error", err)
+		return statusreporter.NewGuestInformationServiceClient(hostgacommunicator.WireServerFallbackAddress)
+	}
+	return reporter
+}
+
+func getConfiguredStatusReporter() (statusreporter.IGuestInformationServiceClient, error) {
+	endpoint := hostgacommunicator.WireServerFallbackAddress
+	if value := os.Getenv(constants.StatusEndpointEnvName); value != "" {
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.Errorf("%v must be an http or https url", constants.StatusEndpointEnvName)
+		}
+		endpoint = strings.TrimSuffix(value, "/")
+	}
+
+	headers, err := parseHeaders(os.Getenv(constants.StatusEndpointHeadersEnvName))
+	if err != nil {
+		return nil, err
+	}
+
+	opts := statusreporter.ClientOptions{
+		Headers:            headers,
+		CACertFile:         os.Getenv(constants.StatusEndpointCACertFileEnvName),
+		InsecureSkipVerify: strings.EqualFold(os.Getenv(constants.StatusEndpointInsecureSkipVerifyEnvName), "true"),
+	}
+	return statusreporter.NewGuestInformationServiceClientWithOptions(endpoint, opts)
+}
+
+// parseHeaders parses headers given as "Name1=value1;Name2=value2". The values are never logged.
+func parseHeaders(value string) (map[string]string, error) {
+	return requestheaders.Parse(value, constants.StatusEndpointHeadersEnvName)
+}
+
+func reportStatusToEndpoint(ctx *log.Context, hEnv types.HandlerEnvironment, metadata types.RCMetadata, statusType types.StatusType, c types.Cmd, msg string, reporter statusreporter.IGuestInformationServiceClient) error {
+	if !c.ShouldReportStatus {
+		ctx.Log("status", "not reported for operation (by design)")
+		return nil
+	}
+
+	rootStatusJson, err := getRootStatusJson(ctx, statusType, c, msg, false)
+	if err != nil {
+		return errors.Wrap(err, "failed to get json for status report")
+	}
+
+	ctx.Log("message", "create request to upload status to: "+reporter.GetEndpoint())
+	response, err := reporter.ReportStatus(string(rootStatusJson))
+	if err != nil {
+		return errors.Wrap(err, "failed to report status to HGAP")
+	}
+
+	if response.StatusCode != 200 {
+		return errors.New("failed to report status with error code " + response.Status)
+	}
+
+	ctx.Log("message", fmt.Sprintf("Status received from request to %v: %v", response.Request.URL, response.Status))
+	ctx.Log("message", "Successfully uploaded status")
+	return nil
+}
@@ -0,0 +1,84 @@
+//go:build !slim
+
+package status
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/hostgacommunicator"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/Azure/run-command-handler-linux/pkg/statusreporter"
+	"github.com/ahmetb/go-httpbin"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseHeaders(t *testing.T) {
+	headers, err := parseHeaders("")
+	require.Nil(t, err)
+	require.Nil(t, headers)
+
+	headers, err = parseHeaders("x-ms-version=2015-09-01; Authorization = Bearer abc=;")
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"x-ms-version": "2015-09-01", "Authorization": "Bearer abc="}, headers)
+
+	_, err = parseHeaders("novalue")
+	require.NotNil(t, err)
+}
+
+func Test_newStatusReporter(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	defer os.Unsetenv(constants.StatusEndpointEnvName)
+
+	os.Unsetenv(constants.StatusEndpointEnvName)
+	require.Equal(t, hostgacommunicator.WireServerFallbackAddress, newStatusReporter(ctx).GetEndpoint())
+
+	os.Setenv(constants.StatusEndpointEnvName, "https://168.63.129.16:32527/")
+	require.Equal(t, "https://168.63.129.16:32527", newStatusReporter(ctx).GetEndpoint())
+
+	// Invalid configuration falls back to the wire server
+	os.Setenv(constants.StatusEndpointEnvName, "ftp://host")
+	require.Equal(t, hostgacommunicator.WireServerFallbackAddress, newStatusReporter(ctx).GetEndpoint())
+}
+
+type TestGuestInformationClient struct {
+	endpoint string
+}
+
+func (c TestGuestInformationClient) GetEndpoint() string {
+	return c.endpoint
+}
+
+func (c TestGuestInformationClient) ReportStatus(statusToUpload string) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	resp := w.Result()
+	resp.Request = httptest.NewRequest(http.MethodPut, c.endpoint, nil)
+	return resp, nil
+}
+
+func Test_ReportStatusToEndpointOk(t *testing.T) {
+	ctx := log.NewContext(log.NewSyncLogger(log.NewLogfmtLogger(os.Stdout))).With("time", log.DefaultTimestamp)
+
+	fakeEnv := types.HandlerEnvironment{}
+	metadata := types.NewRCMetadata("testExtension", 2, constants.DownloadFolder, constants.DataDir)
+	reporter := TestGuestInformationClient{"localhost:3000/upload"}
+	err := reportStatusToEndpoint(ctx, fakeEnv, metadata, types.StatusSuccess, types.CmdEnableTemplate, "customMessage", reporter)
+	require.Nil(t, err)
+}
+
+func Test_ReportStatusToEndpointNotFound(t *testing.T) {
+	ctx := log.NewContext(log.NewSyncLogger(log.NewLogfmtLogger(os.Stdout))).With("time", log.DefaultTimestamp)
+	srv := httptest.NewServer(httpbin.GetMux())
+	defer srv.Close()
+	fakeEnv := types.HandlerEnvironment{}
+	metadata := types.NewRCMetadata("testExtension", 2, constants.DownloadFolder, constants.DataDir)
+	reporter := statusreporter.NewGuestInformationServiceClient(srv.URL + "/uploadnotexistent")
+	err := reportStatusToEndpoint(ctx, fakeEnv, metadata, types.StatusSuccess, types.CmdEnableTemplate, "customMessage", reporter)
+	require.ErrorContains(t, err, strconv.Itoa(http.StatusNotFound))
+	require.ErrorContains(t, err, "Not Found")
+}
@@ -0,0 +1,131 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// queueSize bounds the events waiting to be written, the events sent while it is full are dropped
+	queueSize = 1024
+
+	// maxBatchSize bounds the events written at once
+	maxBatchSize = 64
+
+	// batchInterval is how long the first event of a batch waits for the next ones before the batch is written
+	batchInterval = 200 * time.Millisecond
+
+	// FlushTimeout bounds the time the processes wait for their events to be written before they exit
+	FlushTimeout = 5 * time.Second
+)
+
+var errQueueFull = errors.New("telemetry queue is full, the event is dropped")
+
+// sender queues the events sent from any goroutine (e.g., the ticker of the status, the execution of the scripts or
+// the loop of the service) and writes them in batches from a single background worker, so sending never blocks on
+// the disk and the events are never written concurrently.
+type sender struct {
+	writer  eventWriter
+	queue   chan telemetryEvent
+	flushes chan chan error
+	start   sync.Once
+}
+
+func newSender(writer eventWriter) *sender {
+	return &sender{
+		writer:  writer,
+		queue:   make(chan telemetryEvent, queueSize),
+		flushes: make(chan chan error),
+	}
+}
+
+// send queues the event for the worker, started by the first event. The event is dropped if the queue is full.
+func (s *sender) send(e telemetryEvent) error {
+	s.start.Do(func() { go s.run() })
+	select {
+	case s.queue <- e:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+// flush waits for at most timeout for the worker to write the events queued before it is called. It returns the
+// first error writing the events since the previous flush.
+func (s *sender) flush(timeout time.Duration) error {
+	s.start.Do(func() { go s.run() })
+	deadline := time.After(timeout)
+	done := make(chan error, 1)
+	select {
+	case s.flushes <- done:
+	case <-deadline:
+		return errors.Errorf("timed out after %v flushing the telemetry events", timeout)
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-deadline:
+		return errors.Errorf("timed out after %v flushing the telemetry events", timeout)
+	}
+}
+
+// run is the worker writing the queued events. A batch is written once it is full, once its first event has waited
+// for batchInterval, or when the events are flushed. The first error writing a batch is kept for the next flush.
+func (s *sender) run() {
+	var batch []telemetryEvent
+	var batchDue <-chan time.Time
+	var writeErr error
+	for {
+		select {
+		case e := <-s.queue:
+			batch = append(batch, e)
+			if len(batch) == 1 {
+				batchDue = time.After(batchInterval)
+			}
+			if len(batch) < maxBatchSize {
+				continue
+			}
+		case <-batchDue:
+		case done := <-s.flushes:
+			if err := s.write(s.drain(batch)); writeErr == nil {
+				writeErr = err
+			}
+			batch, batchDue = nil, nil
+			done <- writeErr
+			writeErr = nil
+			continue
+		}
+		if err := s.write(batch); writeErr == nil {
+			writeErr = err
+		}
+		batch, batchDue = nil, nil
+	}
+}
+
+// drain appends the events in the queue to batch without waiting for more
+func (s *sender) drain(batch []telemetryEvent) []telemetryEvent {
+	for {
+		select {
+		case e := <-s.queue:
+			batch = append(batch, e)
+		default:
+			return batch
+		}
+	}
+}
+
+// write writes the events of the batch at once. The events failing to be written are lost, like the telemetry of
+// the agent they are best effort.
+func (s *sender) write(batch []telemetryEvent) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	bs, err := json.Marshal(batch)
+	if err != nil {
+		return errors.Wrapf(err, "failed to serialize %d telemetry events", len(batch))
+	}
+	return errors.Wrapf(s.writer.WriteEvents(bs), "failed to write %d telemetry events", len(batch))
+}
@@ -0,0 +1,104 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeEventWriter struct {
+	mu      sync.Mutex
+	events  []telemetryEvent
+	batches int
+	blocked chan struct{}
+	err     error
+}
+
+func (w *fakeEventWriter) WriteEvents(bs []byte) error {
+	if w.blocked != nil {
+		<-w.blocked
+	}
+	var events []telemetryEvent
+	if err := json.Unmarshal(bs, &events); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	w.events = append(w.events, events...)
+	w.batches++
+	return nil
+}
+
+func (w *fakeEventWriter) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.events)
+}
+
+func Test_sender_flushWritesConcurrentEvents(t *testing.T) {
+	writer := &fakeEventWriter{}
+	s := newSender(writer)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				require.Nil(t, s.send(newTelemetryEvent("name", "1.0", "operation", "message", true, 0)))
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Nil(t, s.flush(time.Second))
+	require.Equal(t, 100, writer.count())
+	require.LessOrEqual(t, writer.batches, 100/maxBatchSize+2, "the events are written in batches")
+}
+
+func Test_sender_flushReturnsWriteErrors(t *testing.T) {
+	writer := &fakeEventWriter{err: errors.New("disk full")}
+	s := newSender(writer)
+
+	require.Nil(t, s.send(newTelemetryEvent("name", "1.0", "operation", "message", true, 0)))
+	err := s.flush(time.Second)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to write 1 telemetry events: disk full")
+
+	// The error is reported once
+	writer.mu.Lock()
+	writer.err = nil
+	writer.mu.Unlock()
+	require.Nil(t, s.flush(time.Second))
+}
+
+func Test_sender_writesBatchAfterInterval(t *testing.T) {
+	writer := &fakeEventWriter{}
+	s := newSender(writer)
+
+	require.Nil(t, s.send(newTelemetryEvent("name", "1.0", "operation", "message", true, 0)))
+	require.Eventually(t, func() bool { return writer.count() == 1 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func Test_sender_dropsEventsWhenQueueIsFull(t *testing.T) {
+	writer := &fakeEventWriter{blocked: make(chan struct{})}
+	s := newSender(writer)
+
+	// The worker is blocked writing the first batch, so the queue fills up
+	var err error
+	for i := 0; i < queueSize+2*maxBatchSize && err == nil; i++ {
+		err = s.send(newTelemetryEvent("name", "1.0", "operation", "message", true, 0))
+	}
+	require.Equal(t, errQueueFull, err)
+
+	require.NotNil(t, s.flush(50*time.Millisecond), "the worker is blocked")
+	close(writer.blocked)
+	require.Nil(t, s.flush(5*time.Second))
+}
@@ -1,13 +1,14 @@
 package telemetry
 
 import (
-	"encoding/json"
 	"fmt"
-	"io"
 	"os"
 	"path"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/Azure/run-command-handler-linux/pkg/logsanitizer"
 	"github.com/pkg/errors"
 )
 
@@ -15,6 +16,22 @@ const (
 	telemetryEventsPath = "/var/lib/waagent/events"
 )
 
+var (
+	// defaultSender sends the events of the process to the agent
+	defaultSender = newSender(&fileEventWriter{dir: telemetryEventsPath})
+
+	instanceMetadataMu sync.RWMutex
+	// instanceMetadata are the fields of the metadata of the VM added to every event, by name
+	instanceMetadata map[string]string
+)
+
+// SetInstanceMetadata adds the given fields of the metadata of the VM (e.g., vmId) to every event sent
+func SetInstanceMetadata(fields map[string]string) {
+	instanceMetadataMu.Lock()
+	defer instanceMetadataMu.Unlock()
+	instanceMetadata = fields
+}
+
 type telemetryParameterString struct {
 	Name  string `json:"name"`
 	Value string `json:"value"`
@@ -36,76 +53,65 @@ type telemetryEvent struct {
 	Parameters []interface{} `json:"parameters"`
 }
 
-type telemetryEventWriter struct {
-	fh *os.File
+// eventWriter writes a serialized batch of events, a JSON array, where the agent collects it
+type eventWriter interface {
+	WriteEvents(bs []byte) error
+}
+
+// fileEventWriter writes every batch of events to its own file in the events directory of the agent. It is only
+// used by the worker of its sender, so it is not safe for concurrent use.
+type fileEventWriter struct {
+	dir string
+	// last is the timestamp of the last file written, the files of the batches written within the same nanosecond
+	// get the next timestamps so they don't overwrite each other
+	last int64
 }
 
-func (w *telemetryEventWriter) Write(bs []byte) (n int, err error) {
-	fn := getTelemetryFileName()
+func (w *fileEventWriter) WriteEvents(bs []byte) error {
+	ts := time.Now().UnixNano()
+	if ts <= w.last {
+		ts = w.last + 1
+	}
+	w.last = ts
+	fn := getTelemetryFileName(w.dir, ts)
 	temp := fn + ".tmp"
 
 	fh, err := os.OpenFile(temp, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0400)
 	if err != nil {
-		return 0, errors.Wrap(err, "failed to open telemetry file")
+		return errors.Wrap(err, "failed to open telemetry file")
 	}
-
-	w.fh = fh
-	n, err = w.fh.Write(bs)
-	err = os.Rename(temp, fn)
-
-	return
-}
-
-func (w *telemetryEventWriter) Close() (err error) {
-	if w.fh != nil {
-		err = w.fh.Close()
-		w.fh = nil
+	_, err = fh.Write(bs)
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
 	}
-	return
-}
-
-type telemetryEventSender struct {
-	writer io.WriteCloser
-}
-
-func NewTelemetryEventSender() *telemetryEventSender {
-	return newTelemetryEventSenderWithWriteCloser(&telemetryEventWriter{})
+	if err != nil {
+		os.Remove(temp)
+		return errors.Wrap(err, "failed to write telemetry file")
+	}
+	// The agent only collects the files with the .tld extension, so it never reads a partially written event
+	return errors.Wrap(os.Rename(temp, fn), "failed to rename telemetry file")
 }
 
-func SendTelemetry(sender *telemetryEventSender, name, version string) func(operation, message string, isSuccess bool, duration time.Duration) error {
+// SendTelemetry returns the function sending the telemetry events of the given extension. Sending queues the event
+// for the background worker and never blocks, it is safe from any goroutine.
+func SendTelemetry(name, version string) func(operation, message string, isSuccess bool, duration time.Duration) error {
 	return func(operation, message string, isSuccess bool, duration time.Duration) error {
-		e := newTelemetryEvent(name, version, operation, message, isSuccess, duration)
-		return sender.send(e)
+		return defaultSender.send(newTelemetryEvent(name, version, operation, message, isSuccess, duration))
 	}
 }
 
-func newTelemetryEventSenderWithWriteCloser(writer io.WriteCloser) *telemetryEventSender {
-	return &telemetryEventSender{writer: writer}
+// Flush writes the events sent before it is called, waiting for at most timeout. The processes call it before they
+// exit, as the events still queued are lost otherwise.
+func Flush(timeout time.Duration) error {
+	return defaultSender.flush(timeout)
 }
 
-func (w *telemetryEventSender) send(e telemetryEvent) error {
-	defer w.writer.Close()
-
-	bs, err := json.Marshal(e)
-	if err != nil {
-		return errors.Wrap(err, "failed to marhsal telemetry event")
-	}
-
-	_, err = w.writer.Write(bs)
-	if err != nil {
-		return errors.Wrap(err, "failed to write telemetry event")
-	}
-
-	return nil
-}
-
-func getTelemetryFileName() string {
-	fn := fmt.Sprintf("%d.tld", time.Now().UnixNano())
-	return path.Join(telemetryEventsPath, fn)
+func getTelemetryFileName(dir string, ts int64) string {
+	return path.Join(dir, fmt.Sprintf("%d.tld", ts))
 }
 
 func newTelemetryEvent(name, version, operation, message string, isSuccess bool, duration time.Duration) telemetryEvent {
-	return telemetryEvent{
+	e := telemetryEvent{
 		EventID:    1,
 		ProviderID: "69B669B9-4AF8-4C50-BDC4-6006FA76E975",
 		Parameters: []interface{}{
@@ -127,7 +133,7 @@ func newTelemetryEvent(name, version, operation, message string, isSuccess bool,
 			},
 			telemetryParameterString{
 				Name:  "Message",
-				Value: message,
+				Value: logsanitizer.Sanitize(message),
 			},
 			telemetryParameterLong{
 				Name:  "Duration",
@@ -135,4 +141,16 @@ func newTelemetryEvent(name, version, operation, message string, isSuccess bool,
 			},
 		},
 	}
+
+	instanceMetadataMu.RLock()
+	defer instanceMetadataMu.RUnlock()
+	names := make([]string, 0, len(instanceMetadata))
+	for name := range instanceMetadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		e.Parameters = append(e.Parameters, telemetryParameterString{Name: name, Value: instanceMetadata[name]})
+	}
+	return e
 }
@@ -1,9 +1,12 @@
 package telemetry
 
 import (
-	"bytes"
 	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -29,6 +32,16 @@ func Test_newTelemetryEvent(t *testing.T) {
 	require.Equal(t, int64(150)*1000, testSubject.Parameters[5].(telemetryParameterLong).Value)
 }
 
+func Test_newTelemetryEvent_instanceMetadata(t *testing.T) {
+	defer SetInstanceMetadata(nil)
+	SetInstanceMetadata(map[string]string{"zone": "1", "vmId": "--VmId--"})
+	testSubject := newTelemetryEvent("--Name--", "--Version--", "--Operation--", "--Message--", true, 0)
+
+	require.Len(t, testSubject.Parameters, 8)
+	require.Equal(t, telemetryParameterString{Name: "vmId", Value: "--VmId--"}, testSubject.Parameters[6])
+	require.Equal(t, telemetryParameterString{Name: "zone", Value: "1"}, testSubject.Parameters[7])
+}
+
 func Test_serializeTelemetryEvent(t *testing.T) {
 	duration, _ := time.ParseDuration("2m30s")
 	testSubject := newTelemetryEvent("--Name--", "--Version--", "--Operation--", "--Message--", true, duration)
@@ -69,68 +82,26 @@ func Test_serializeTelemetryEvent(t *testing.T) {
 	require.JSONEq(t, json, string(bs))
 }
 
-type mockWriteCloser struct {
-	isClosed bool
-	buf      *bytes.Buffer
-}
-
-func (s *mockWriteCloser) Write(bs []byte) (int, error) {
-	return s.buf.Write(bs)
-}
-
-func (s *mockWriteCloser) Close() error {
-	s.isClosed = true
-	return nil
-}
-
-func Test_telemetryEventSender(t *testing.T) {
-	writeCloser := &mockWriteCloser{
-		isClosed: false,
-		buf:      bytes.NewBufferString(""),
+func Test_fileEventWriter(t *testing.T) {
+	dir := t.TempDir()
+	writer := &fileEventWriter{dir: dir}
+	for i := 0; i < 3; i++ {
+		require.Nil(t, writer.WriteEvents([]byte(fmt.Sprintf(`[{"eventId": %d}]`, i))))
 	}
 
-	duration, _ := time.ParseDuration("2m30s")
-	event := newTelemetryEvent("--Name--", "--Version--", "--Operation--", "--Message--", true, duration)
-
-	testSubject := newTelemetryEventSenderWithWriteCloser(writeCloser)
-	testSubject.send(event)
-
-	require.Equal(t, true, writeCloser.isClosed, "expected writeCloser to be closed")
-
-	json := `{
-    "eventId": 1,
-    "providerId": "69B669B9-4AF8-4C50-BDC4-6006FA76E975",
-    "parameters": [
-        {
-            "name": "Name",
-            "value": "--Name--"
-        },
-        {
-            "name": "Version",
-            "value": "--Version--"
-        },
-        {
-            "name": "Operation",
-            "value": "--Operation--"
-        },
-        {
-            "name": "OperationSuccess",
-            "value": true
-        },
-        {
-            "name": "Message",
-            "value": "--Message--"
-        },
-        {
-            "name": "Duration",
-            "value": 150000
-        }
-    ]
-}`
-	require.JSONEq(t, writeCloser.buf.String(), json)
+	// The batches written within the same nanosecond don't overwrite each other
+	files, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	require.Len(t, files, 3)
+	for i, f := range files {
+		require.True(t, strings.HasSuffix(f.Name(), ".tld"), f.Name())
+		bs, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		require.Nil(t, err)
+		require.JSONEq(t, fmt.Sprintf(`[{"eventId": %d}]`, i), string(bs))
+	}
 }
 
 func Test_getTelemetryFileName(t *testing.T) {
-	testSubject := getTelemetryFileName()
+	testSubject := getTelemetryFileName(telemetryEventsPath, time.Now().UnixNano())
 	require.True(t, regexp.MustCompile("^/var/lib/waagent/events/\\d{19}\\.tld$").Match([]byte(testSubject)), testSubject)
 }
@@ -0,0 +1,166 @@
+package testharness
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/pkg/errors"
+)
+
+// environment is the directory the agent would prepare for the handler: the handler under Extension/bin, its
+// HandlerEnvironment.json, config and status folders, and the certificate encrypting the protected settings
+type environment struct {
+	dir           string
+	extensionName string
+	handlerPath   string
+	thumbprint    string
+}
+
+func (e *environment) configFolder() string {
+	return filepath.Join(e.dir, "Extension", "config")
+}
+
+func (e *environment) statusFolder() string {
+	return filepath.Join(e.dir, "Extension", "status")
+}
+
+// newEnvironment lays out the environment of the handler in dir, with a copy of the handler at handlerPath
+func newEnvironment(dir, extensionName, handlerPath string) (*environment, error) {
+	e := &environment{dir: dir, extensionName: extensionName, handlerPath: filepath.Join(dir, "Extension", "bin", filepath.Base(handlerPath))}
+	for _, d := range []string{filepath.Dir(e.handlerPath), e.configFolder(), e.statusFolder(), filepath.Join(dir, "log")} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return nil, errors.Wrap(err, "failed to create the environment of the handler")
+		}
+	}
+
+	handler, err := os.ReadFile(handlerPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the handler")
+	}
+	if err := os.WriteFile(e.handlerPath, handler, 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to copy the handler")
+	}
+
+	var env types.HandlerEnvironment
+	env.Version = 1
+	env.Name = extensionName
+	env.HandlerEnvironment.ConfigFolder = e.configFolder()
+	env.HandlerEnvironment.StatusFolder = e.statusFolder()
+	env.HandlerEnvironment.LogFolder = filepath.Join(dir, "log")
+	env.HandlerEnvironment.HeartbeatFile = filepath.Join(dir, "Extension", "heartbeat.log")
+	b, err := json.Marshal([]types.HandlerEnvironment{env})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "Extension", "HandlerEnvironment.json"), b, 0600); err != nil {
+		return nil, errors.Wrap(err, "failed to write HandlerEnvironment.json")
+	}
+
+	if e.thumbprint, err = writeCertificate(dir); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// writeCertificate writes a self-signed certificate and its private key to dir, named by the thumbprint of the
+// certificate as the agent does, and returns the thumbprint
+func writeCertificate(dir string) (string, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to generate the key of the certificate")
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "run-command-handler test harness"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create the certificate")
+	}
+	thumbprint := strings.ToUpper(fmt.Sprintf("%x", sha1.Sum(der)))
+
+	crt := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	prv := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(filepath.Join(dir, thumbprint+".crt"), crt, 0600); err != nil {
+		return "", errors.Wrap(err, "failed to write the certificate")
+	}
+	if err := os.WriteFile(filepath.Join(dir, thumbprint+".prv"), prv, 0600); err != nil {
+		return "", errors.Wrap(err, "failed to write the private key")
+	}
+	return thumbprint, nil
+}
+
+// writeSettings writes the settings of seqNum to the config folder, the protected ones encrypted with the
+// certificate of the environment as the agent does
+func (e *environment) writeSettings(seqNum int, public, protected map[string]interface{}) error {
+	handlerSettings := map[string]interface{}{"publicSettings": public}
+	if len(protected) > 0 {
+		encrypted, err := e.encrypt(protected)
+		if err != nil {
+			return err
+		}
+		handlerSettings["protectedSettingsCertThumbprint"] = e.thumbprint
+		handlerSettings["protectedSettings"] = encrypted
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"runtimeSettings": []interface{}{map[string]interface{}{"handlerSettings": handlerSettings}},
+	})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(e.configFolder(), fmt.Sprintf("%s.%d%s", e.extensionName, seqNum, constants.ConfigFileExtension))
+	return errors.Wrap(os.WriteFile(path, b, 0600), "failed to write the settings")
+}
+
+// encrypt returns the settings encrypted with the certificate of the environment, in base64
+func (e *environment) encrypt(settings map[string]interface{}) (string, error) {
+	b, err := json.Marshal(settings)
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.Command("openssl", "smime", "-encrypt", "-outform", "DER", "-aes256", filepath.Join(e.dir, e.thumbprint+".crt"))
+	cmd.Stdin = bytes.NewReader(b)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to encrypt the protected settings: %s", strings.TrimSpace(stderr.String()))
+	}
+	return base64.StdEncoding.EncodeToString(out), nil
+}
+
+// readStatus returns the instance view reported in the status file of seqNum
+func (e *environment) readStatus(seqNum int) (types.StatusType, types.RunCommandInstanceView, error) {
+	var instanceView types.RunCommandInstanceView
+	path := filepath.Join(e.statusFolder(), fmt.Sprintf("%s.%d.status", e.extensionName, seqNum))
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", instanceView, errors.Wrap(err, "failed to read the status file")
+	}
+	var report types.StatusReport
+	if err := json.Unmarshal(b, &report); err != nil || len(report) != 1 {
+		return "", instanceView, errors.Errorf("invalid status file %s", path)
+	}
+	if err := json.Unmarshal([]byte(report[0].Status.FormattedMessage.Message), &instanceView); err != nil {
+		return "", instanceView, errors.Wrapf(err, "invalid instance view in status file %s", path)
+	}
+	return report[0].Status.Status, instanceView, nil
+}
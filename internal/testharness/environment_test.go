@@ -0,0 +1,27 @@
+package testharness
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/handlersettings"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_environment_settingsReadByTheHandler(t *testing.T) {
+	dir := t.TempDir()
+	handler := filepath.Join(t.TempDir(), "run-command-handler")
+	require.Nil(t, os.WriteFile(handler, []byte("#!/bin/sh\n"), 0700))
+
+	env, err := newEnvironment(dir, extensionName, handler)
+	require.Nil(t, err)
+	require.FileExists(t, filepath.Join(dir, "Extension", "bin", "run-command-handler"))
+	require.FileExists(t, filepath.Join(dir, "Extension", "HandlerEnvironment.json"))
+
+	require.Nil(t, env.writeSettings(2, map[string]interface{}{"source": map[string]interface{}{"script": "date"}}, map[string]interface{}{"outputBlobSASToken": fakeSASToken}))
+	public, protected, err := handlersettings.ReadSettings(filepath.Join(env.configFolder(), extensionName+".2.settings"))
+	require.Nil(t, err)
+	require.Equal(t, map[string]interface{}{"script": "date"}, public["source"])
+	require.Equal(t, fakeSASToken, protected["outputBlobSASToken"])
+}
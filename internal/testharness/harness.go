@@ -0,0 +1,336 @@
+// Package testharness drives the handler binary through its lifecycle (install, enable, disable, uninstall) on the
+// machine, playing the part of the agent and of the storage it downloads the scripts from and uploads the output to,
+// and checks the status files and blobs it produces. It also runs the immediate run command service against a fake
+// HGAP serving its VMSettings. It is a regression test of the whole handler pipeline for the
+// machines without CI.
+package testharness
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/hostgacommunicator"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// extensionName is the name of the extension the harness runs the handler as
+	extensionName = "RunCommandTestHarness"
+
+	// commandTimeout bounds every invocation of the handler
+	commandTimeout = 5 * time.Minute
+
+	// pollTimeout bounds the wait for the service to poll the fake HGAP, which it does every second
+	pollTimeout = time.Minute
+
+	scriptPath      = "/scripts/hello.sh"
+	outputBlobURI   = "http://harness.blob.core.windows.net/output/stdout.txt"
+	errorBlobURI    = "http://harness.blob.core.windows.net/output/stderr.txt"
+	fakeSASToken    = "?sv=2020-08-04&sr=b&sp=racw&sig=harness"
+	expectedStdout  = "hello from the test harness\n"
+	expectedStderr  = "warning from the test harness\n"
+	failingExitCode = 3
+)
+
+var script = fmt.Sprintf("#!/bin/sh\necho '%s'\necho '%s' >&2\n", strings.TrimSpace(expectedStdout), strings.TrimSpace(expectedStderr))
+
+// Options configure a run of the harness
+type Options struct {
+	// HandlerPath is the handler binary under test
+	HandlerPath string
+	// ServicePath is the immediate run command service binary under test, not run if empty
+	ServicePath string
+	// WorkDir is where the environment of the handler is created, a temporary directory if empty
+	WorkDir string
+	// Keep keeps the environment of the handler once the run succeeds, it is always kept when it fails
+	Keep bool
+	// Force runs the harness even though the data directory of the handler exists, which uninstall removes
+	Force bool
+}
+
+// harness is a run of the handler against the fake storage, and of the service against the fake HGAP
+type harness struct {
+	ctx         *log.Context
+	env         *environment
+	storage     *FakeStorage
+	servicePath string
+}
+
+// step is a step of the lifecycle of the handler
+type step struct {
+	name string
+	run  func(h *harness) error
+}
+
+var steps = []step{
+	{"install", (*harness).install},
+	{"enable", (*harness).enable},
+	{"enable failing script", (*harness).enableFailingScript},
+	{"disable", (*harness).disable},
+	{"service", (*harness).service},
+	{"uninstall", (*harness).uninstall},
+}
+
+// Run drives the handler through its lifecycle. It must run as root, as the handler does. It returns the first
+// failing step.
+func Run(ctx *log.Context, opts Options) error {
+	if os.Geteuid() != 0 {
+		return errors.New("the test harness must run as root, like the handler")
+	}
+	if _, err := os.Stat(constants.DefaultDataDir); err == nil && !opts.Force {
+		return errors.Errorf("%s exists and uninstall removes it, run the harness on a machine without run command extensions or force it", constants.DefaultDataDir)
+	}
+
+	dir := opts.WorkDir
+	if dir == "" {
+		var err error
+		if dir, err = os.MkdirTemp("", "run-command-test-harness"); err != nil {
+			return errors.Wrap(err, "failed to create the work directory")
+		}
+	}
+	ctx = ctx.With("workDir", dir)
+	env, err := newEnvironment(dir, extensionName, opts.HandlerPath)
+	if err != nil {
+		return err
+	}
+	storage := NewFakeStorage()
+	defer storage.Close()
+	storage.Put(scriptPath, []byte(script))
+
+	h := &harness{ctx: ctx, env: env, storage: storage, servicePath: opts.ServicePath}
+	for _, s := range steps {
+		ctx.Log("event", "running step", "step", s.name)
+		if err := s.run(h); err != nil {
+			ctx.Log("event", "step failed, the environment of the handler is kept", "step", s.name, "error", err)
+			return errors.Wrapf(err, "step %s failed", s.name)
+		}
+		ctx.Log("event", "step passed", "step", s.name)
+	}
+
+	if !opts.Keep {
+		os.RemoveAll(dir)
+	}
+	return nil
+}
+
+func (h *harness) install() error {
+	if err := h.invoke("install", 0); err != nil {
+		return err
+	}
+	if _, err := os.Stat(constants.DefaultDataDir); err != nil {
+		return errors.Wrap(err, "the data directory was not created")
+	}
+	return nil
+}
+
+// enable downloads the script from the fake storage and uploads its output to it
+func (h *harness) enable() error {
+	const seqNum = 0
+	public := map[string]interface{}{
+		"source":        map[string]interface{}{"scriptUri": "http://harness-scripts.invalid" + scriptPath},
+		"outputBlobUri": outputBlobURI,
+		"errorBlobUri":  errorBlobURI,
+		"proxy":         h.storage.URL(),
+	}
+	protected := map[string]interface{}{
+		"outputBlobSASToken": fakeSASToken,
+		"errorBlobSASToken":  fakeSASToken,
+	}
+	if err := h.env.writeSettings(seqNum, public, protected); err != nil {
+		return err
+	}
+	if err := h.invoke("enable", seqNum); err != nil {
+		return err
+	}
+
+	status, instanceView, err := h.env.readStatus(seqNum)
+	if err != nil {
+		return err
+	}
+	if status != types.StatusSuccess || instanceView.ExecutionState != types.Succeeded || instanceView.ExitCode != 0 {
+		return errors.Errorf("expected a succeeded script, got status %s, execution state %s, exit code %d: %s", status, instanceView.ExecutionState, instanceView.ExitCode, instanceView.ExecutionMessage)
+	}
+	if !strings.Contains(instanceView.Output, strings.TrimSpace(expectedStdout)) {
+		return errors.Errorf("the status doesn't report the output of the script: %q", instanceView.Output)
+	}
+	if err := h.expectBlob(outputBlobURI, expectedStdout); err != nil {
+		return err
+	}
+	return h.expectBlob(errorBlobURI, expectedStderr)
+}
+
+// enableFailingScript runs an inline script failing with failingExitCode, which must be reported as failed
+func (h *harness) enableFailingScript() error {
+	const seqNum = 1
+	public := map[string]interface{}{
+		"source": map[string]interface{}{"script": fmt.Sprintf("exit %d", failingExitCode)},
+	}
+	if err := h.env.writeSettings(seqNum, public, nil); err != nil {
+		return err
+	}
+	// A failed script fails the command only when treatFailureAsDeploymentFailure is set
+	if err := h.invoke("enable", seqNum); err != nil {
+		return err
+	}
+
+	_, instanceView, err := h.env.readStatus(seqNum)
+	if err != nil {
+		return err
+	}
+	if instanceView.ExecutionState != types.Failed || instanceView.ExitCode != failingExitCode {
+		return errors.Errorf("expected a failed script with exit code %d, got execution state %s, exit code %d", failingExitCode, instanceView.ExecutionState, instanceView.ExitCode)
+	}
+	return nil
+}
+
+func (h *harness) disable() error {
+	const seqNum = 1
+	if err := h.invoke("disable", seqNum); err != nil {
+		return err
+	}
+	status, _, err := h.env.readStatus(seqNum)
+	if err != nil {
+		return err
+	}
+	if status != types.StatusSuccess {
+		return errors.Errorf("expected the disable to succeed, got status %s", status)
+	}
+	return nil
+}
+
+// service runs the immediate run command service against the fake HGAP, which must request the VMSettings again
+// only once their ETag changed
+func (h *harness) service() error {
+	if h.servicePath == "" {
+		h.ctx.Log("event", "the service binary was not given, the service is not run")
+		return nil
+	}
+	hgap := NewFakeHGAP()
+	defer hgap.Close()
+
+	logPath := filepath.Join(h.env.dir, "service.log")
+	output, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to create the log of the service")
+	}
+	defer output.Close()
+	cmd := exec.Command(h.servicePath)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%s", constants.VMSettingsEndpointEnvName, hgap.URL()),
+		fmt.Sprintf("%s=%d", constants.ServicePollingIntervalEnvName, 1))
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Start(); err != nil {
+		return errors.Wrap(err, "failed to start the service")
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	defer func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-exited:
+		case <-time.After(commandTimeout):
+			cmd.Process.Kill()
+			<-exited
+		}
+	}()
+
+	if err := h.expectPolls(hgap, exited, logPath); err != nil {
+		return err
+	}
+	// New VMSettings are requested again, once
+	if err := hgap.SetVMSettings(map[string]interface{}{"activityId": "harness", "extensionGoalStates": []interface{}{}}); err != nil {
+		return err
+	}
+	if err := h.expectPolls(hgap, exited, logPath); err != nil {
+		return err
+	}
+
+	etag, err := os.ReadFile(hostgacommunicator.GetETagPath(constants.DefaultDataDir))
+	if err != nil {
+		return errors.Wrap(err, "the service didn't save the ETag of the VMSettings")
+	}
+	if string(etag) != hgap.ETag() {
+		return errors.Errorf("expected the service to save the ETag %s, got %s", hgap.ETag(), etag)
+	}
+	return nil
+}
+
+// expectPolls waits for the service to get the VMSettings of the fake HGAP once, then to poll them with their ETag
+// and get 304 Not Modified
+func (h *harness) expectPolls(hgap *FakeHGAP, exited <-chan error, logPath string) error {
+	deadline := time.After(pollTimeout)
+	for {
+		served, notModified := hgap.Requests()
+		if served > 1 {
+			return errors.Errorf("the service requested the VMSettings %d times although they were not modified, see %s", served, logPath)
+		}
+		if served == 1 && notModified > 0 {
+			return nil
+		}
+		select {
+		case err := <-exited:
+			return errors.Errorf("the service exited (%v), see %s", err, logPath)
+		case <-deadline:
+			return errors.Errorf("the service didn't poll the VMSettings %s with their ETag, see %s", hgap.ETag(), logPath)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (h *harness) uninstall() error {
+	if err := h.invoke("uninstall", 1); err != nil {
+		return err
+	}
+	if _, err := os.Stat(constants.DefaultDataDir); !os.IsNotExist(err) {
+		return errors.New("the data directory was not removed")
+	}
+	return nil
+}
+
+// invoke runs the handler command as the agent does, its output saved next to the environment
+func (h *harness) invoke(command string, seqNum int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.env.handlerPath, command)
+	cmd.Dir = filepath.Dir(h.env.handlerPath)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%s", constants.ConfigExtensionNameEnvName, extensionName),
+		fmt.Sprintf("%s=%d", constants.ConfigSequenceNumberEnvName, seqNum))
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+
+	logPath := filepath.Join(h.env.dir, fmt.Sprintf("%s.%d.log", command, seqNum))
+	if writeErr := os.WriteFile(logPath, output.Bytes(), 0600); writeErr != nil {
+		h.ctx.Log("warning", "failed to save the output of the handler", "error", writeErr)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "the handler failed to %s, see %s", command, logPath)
+	}
+	return nil
+}
+
+// expectBlob checks the content of the blob the handler uploaded to
+func (h *harness) expectBlob(uri, expected string) error {
+	path := strings.TrimPrefix(uri, "http://harness.blob.core.windows.net")
+	content, ok := h.storage.Get(path)
+	if !ok {
+		return errors.Errorf("the handler didn't upload blob %s", uri)
+	}
+	if string(content) != expected {
+		return errors.Errorf("expected blob %s to be %q, got %q", uri, expected, content)
+	}
+	return nil
+}
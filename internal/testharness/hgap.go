@@ -0,0 +1,93 @@
+package testharness
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// FakeHGAP is the VMSettings endpoint of the host GA plugin the immediate run command service polls for goal
+// states, reached by the service as its VMSettings endpoint. Every VMSettings has a new ETag, and a request whose
+// If-None-Match is the current ETag gets 304 Not Modified, as the VMSettings were already processed.
+//
+// It doesn't receive the status of the immediate run commands, which is uploaded to the status endpoint.
+type FakeHGAP struct {
+	server *httptest.Server
+
+	mu          sync.Mutex
+	vmSettings  []byte
+	etag        string
+	incarnation int
+	served      int
+	notModified int
+}
+
+// NewFakeHGAP starts a fake HGAP listening on the loopback interface, serving VMSettings without goal states
+func NewFakeHGAP() *FakeHGAP {
+	h := &FakeHGAP{}
+	h.server = httptest.NewServer(h)
+	h.SetVMSettings(map[string]interface{}{"extensionGoalStates": []interface{}{}})
+	return h
+}
+
+// URL is the URL of the fake HGAP, to use as the VMSettings endpoint of the service
+func (h *FakeHGAP) URL() string {
+	return h.server.URL
+}
+
+// Close stops the fake HGAP
+func (h *FakeHGAP) Close() {
+	h.server.Close()
+}
+
+// SetVMSettings serves vmSettings, marshaled to JSON, with a new ETag
+func (h *FakeHGAP) SetVMSettings(vmSettings interface{}) error {
+	b, err := json.Marshal(vmSettings)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.vmSettings = b
+	h.incarnation++
+	h.etag = fmt.Sprintf(`"%d"`, h.incarnation)
+	h.served, h.notModified = 0, 0
+	return nil
+}
+
+// ETag returns the ETag of the VMSettings served
+func (h *FakeHGAP) ETag() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.etag
+}
+
+// Requests returns how many times the current VMSettings were served, and how many requests for them got 304 Not
+// Modified
+func (h *FakeHGAP) Requests() (served, notModified int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.served, h.notModified
+}
+
+func (h *FakeHGAP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || r.URL.Path != "/vmSettings" {
+		http.Error(w, "UnsupportedOperation", http.StatusNotImplemented)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	w.Header().Set("ETag", h.etag)
+	if r.Header.Get("If-None-Match") == h.etag {
+		h.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.served++
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(h.vmSettings)
+}
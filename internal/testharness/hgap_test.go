@@ -0,0 +1,49 @@
+package testharness
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/clock"
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/hostgacommunicator"
+	"github.com/Azure/run-command-handler-linux/internal/requesthelper"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// vmSettingsRequestManager requests the VMSettings from the fake HGAP at url
+type vmSettingsRequestManager struct {
+	url string
+}
+
+func (m vmSettingsRequestManager) GetVMSettingsRequestManager(ctx *log.Context) (*requesthelper.RequestManager, error) {
+	return requesthelper.GetRequestManager(m, 30*time.Second), nil
+}
+
+func (m vmSettingsRequestManager) GetRequest(ctx *log.Context) (*http.Request, error) {
+	return http.NewRequest(http.MethodGet, m.url+"/vmSettings", nil)
+}
+
+func TestFakeHGAP_etag(t *testing.T) {
+	h := NewFakeHGAP()
+	defer h.Close()
+	ctx := log.NewContext(log.NewNopLogger())
+	c := hostgacommunicator.NewHostGACommunicatorWithETag(vmSettingsRequestManager{h.URL()}, filepath.Join(t.TempDir(), constants.VMSettingsETagFileName), clock.Real)
+
+	_, err := c.GetImmediateVMSettings(ctx)
+	require.Nil(t, err)
+	require.Nil(t, c.AcknowledgeVMSettings(ctx))
+	_, err = c.GetImmediateVMSettings(ctx)
+	require.True(t, hostgacommunicator.IsNotModified(err))
+	served, notModified := h.Requests()
+	require.Equal(t, 1, served)
+	require.Equal(t, 1, notModified)
+
+	require.Nil(t, h.SetVMSettings(map[string]interface{}{"activityId": "next"}))
+	vmSettings, err := c.GetImmediateVMSettings(ctx)
+	require.Nil(t, err)
+	require.Equal(t, "next", vmSettings.ActivityId)
+}
@@ -0,0 +1,130 @@
+package testharness
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// FakeStorage is an in-memory blob storage serving the scripts and receiving the output of the handler. The handler
+// reaches it as its proxy, so the blob URLs keep the host names the storage clients expect (e.g.,
+// <account>.blob.core.windows.net) and the blobs are addressed by the path of the URL (/<container>/<blob>).
+//
+// It supports downloading blobs and the operations of the append blobs the output is uploaded to, not the block
+// blobs of the storage accounts without append blobs.
+type FakeStorage struct {
+	server *httptest.Server
+
+	mu    sync.Mutex
+	blobs map[string]*fakeBlob
+}
+
+type fakeBlob struct {
+	content      []byte
+	blobType     string
+	lastModified time.Time
+}
+
+// NewFakeStorage starts a fake storage listening on the loopback interface
+func NewFakeStorage() *FakeStorage {
+	s := &FakeStorage{blobs: make(map[string]*fakeBlob)}
+	s.server = httptest.NewServer(s)
+	return s
+}
+
+// URL is the URL of the fake storage, to use as the proxy of the handler
+func (s *FakeStorage) URL() string {
+	return s.server.URL
+}
+
+// Close stops the fake storage
+func (s *FakeStorage) Close() {
+	s.server.Close()
+}
+
+// Put saves content as the block blob at path
+func (s *FakeStorage) Put(path string, content []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[path] = &fakeBlob{content: content, blobType: "BlockBlob", lastModified: time.Now()}
+}
+
+// Get returns the content of the blob at path, false if there is none
+func (s *FakeStorage) Get(path string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	blob, ok := s.blobs[path]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte{}, blob.content...), true
+}
+
+func (s *FakeStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := r.URL.Path
+	blob, exists := s.blobs[path]
+	switch {
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		if !exists {
+			http.Error(w, "BlobNotFound", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(blob.content)))
+		w.Header().Set("Last-Modified", blob.lastModified.UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, blob.lastModified.UnixNano()))
+		w.Header().Set("x-ms-blob-type", blob.blobType)
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(blob.content)
+		}
+
+	case r.Method == http.MethodPut && r.URL.Query().Get("comp") == "appendblock":
+		if !exists || blob.blobType != "AppendBlob" {
+			http.Error(w, "BlobNotFound", http.StatusNotFound)
+			return
+		}
+		if position := r.Header.Get("x-ms-blob-condition-appendpos"); position != "" && position != fmt.Sprint(len(blob.content)) {
+			http.Error(w, "AppendPositionConditionNotMet", http.StatusPreconditionFailed)
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		blob.content = append(blob.content, data...)
+		blob.lastModified = time.Now()
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodPut && r.URL.Query().Get("comp") == "":
+		blobType := r.Header.Get("x-ms-blob-type")
+		if blobType != "AppendBlob" && blobType != "BlockBlob" {
+			http.Error(w, "UnsupportedBlobType", http.StatusBadRequest)
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.blobs[path] = &fakeBlob{content: data, blobType: blobType, lastModified: time.Now()}
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodDelete:
+		if !exists {
+			http.Error(w, "BlobNotFound", http.StatusNotFound)
+			return
+		}
+		delete(s.blobs, path)
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		http.Error(w, "UnsupportedOperation", http.StatusNotImplemented)
+	}
+}
@@ -0,0 +1,53 @@
+package testharness
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/run-command-handler-linux/pkg/download"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeStorage_appendBlob(t *testing.T) {
+	s := NewFakeStorage()
+	defer s.Close()
+	proxy, err := url.Parse(s.URL())
+	require.Nil(t, err)
+
+	blob, err := download.CreateOrReplaceAppendBlob(outputBlobURI, fakeSASToken, proxy, nil)
+	require.Nil(t, err)
+	require.Nil(t, blob.AppendBlock([]byte("hello "), nil))
+	position := uint(6)
+	require.Nil(t, blob.AppendBlock([]byte("world"), &storage.AppendBlockOptions{AppendPosition: &position}))
+	require.NotNil(t, blob.AppendBlock([]byte("!"), &storage.AppendBlockOptions{AppendPosition: &position}), "stale append position")
+	require.Nil(t, blob.GetProperties(nil))
+	require.EqualValues(t, 11, blob.Properties.ContentLength)
+
+	content, ok := s.Get("/output/stdout.txt")
+	require.True(t, ok)
+	require.Equal(t, "hello world", string(content))
+}
+
+func TestFakeStorage_download(t *testing.T) {
+	s := NewFakeStorage()
+	defer s.Close()
+	s.Put(scriptPath, []byte(script))
+	proxy, err := url.Parse(s.URL())
+	require.Nil(t, err)
+
+	d := download.ThroughProxy(download.NewURLDownload("http://harness-scripts.invalid"+scriptPath), proxy)
+	status, body, err := download.Download(log.NewContext(log.NewNopLogger()), d)
+	require.Nil(t, err)
+	defer body.Close()
+	require.Equal(t, http.StatusOK, status)
+	b, err := io.ReadAll(body)
+	require.Nil(t, err)
+	require.Equal(t, script, string(b))
+
+	_, _, err = download.Download(log.NewContext(log.NewNopLogger()), download.ThroughProxy(download.NewURLDownload("http://harness-scripts.invalid/missing.sh"), proxy))
+	require.NotNil(t, err)
+}
@@ -0,0 +1,101 @@
+package triggerapi
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+type peerContextKey struct{}
+
+// peer is the process at the other end of a connection, as reported by the kernel
+type peer struct {
+	pid int32
+	uid uint32
+}
+
+func (p *peer) String() string {
+	if p == nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("pid=%d uid=%d", p.pid, p.uid)
+}
+
+// peerCredentials returns the process connected to the unix socket, as reported by the kernel (SO_PEERCRED)
+func peerCredentials(conn net.Conn) (*peer, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("not a unix socket connection")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to access the connection")
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to access the connection")
+	}
+	if credErr != nil {
+		return nil, errors.Wrap(credErr, "failed to read the peer credentials")
+	}
+	return &peer{pid: cred.Pid, uid: cred.Uid}, nil
+}
+
+func peerFromContext(ctx context.Context) *peer {
+	p, _ := ctx.Value(peerContextKey{}).(*peer)
+	return p
+}
+
+// requireRoot rejects the requests whose connection doesn't come from a root process, or whose peer is unknown
+func requireRoot(ctx *log.Context, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := peerFromContext(r.Context()); p == nil || p.uid != 0 {
+			ctx.Log("warning", "rejected a request of a process not running as root", "peer", p)
+			http.Error(w, "only root can submit run commands", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ListenAndServe serves handler over HTTP on a unix socket at socketPath, which only root can connect to. The peer
+// credentials of every connection are available to handler, see requireRoot.
+func ListenAndServe(ctx *log.Context, socketPath string, handler http.Handler) error {
+	// A socket left by a previous instance of the service would make listening fail
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove existing trigger socket")
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen on trigger socket")
+	}
+	defer listener.Close()
+
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		return errors.Wrap(err, "failed to restrict access to trigger socket")
+	}
+
+	server := &http.Server{
+		Handler: handler,
+		ConnContext: func(connCtx context.Context, conn net.Conn) context.Context {
+			p, err := peerCredentials(conn)
+			if err != nil {
+				ctx.Log("warning", "the peer of the connection is unknown", "error", err)
+				return connCtx
+			}
+			return context.WithValue(connCtx, peerContextKey{}, p)
+		},
+	}
+	ctx.Log("message", "serving run command submissions", "socket", socketPath)
+	return errors.Wrap(server.Serve(listener), "failed to serve run command submissions")
+}
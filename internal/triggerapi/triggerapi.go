@@ -0,0 +1,121 @@
+// Package triggerapi serves the local API on which other extensions and the guest agent submit run commands to the
+// immediate run command service, for on-box orchestration without a round trip through ARM. The run commands are
+// executed like the immediate goal states: their settings are validated, they take an execution slot, and their
+// status is reported to HGAP and served by the API.
+//
+// The API is served over HTTP on a unix socket only root can connect to, and the peer credentials of every
+// connection are checked, e.g.:
+//
+//	curl --unix-socket /var/lib/waagent/run-command-handler/trigger.sock -d @runcommand.json http://localhost/runcommands
+//	curl --unix-socket /var/lib/waagent/run-command-handler/trigger.sock http://localhost/runcommands/local:RC0001
+//
+// The extension names of the run commands submitted locally start with settings.LocalExtensionNamePrefix, the other
+// names are those of the run commands delivered by HGAP.
+package triggerapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/run-command-handler-linux/internal/settings"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	runCommandsPath = "/runcommands"
+
+	// maxRequestSize bounds the body of a submitted run command, as large as the settings the agent accepts
+	maxRequestSize = 1024 * 1024
+)
+
+var (
+	// ErrDuplicate is returned by a SubmitFunc when the run command was already submitted or executed
+	ErrDuplicate = errors.New("the run command with this extension name and sequence number was already submitted")
+
+	// ErrQueueFull is returned by a SubmitFunc when too many run commands are waiting for an execution slot
+	ErrQueueFull = errors.New("too many run commands are waiting for an execution slot, submit it again later")
+)
+
+// SubmitFunc queues the run command for execution by the service
+type SubmitFunc func(s settings.SettingsCommon) error
+
+// StatusFunc returns the latest status of the run command of the extension, if any
+type StatusFunc func(extensionName string) (types.ImmediateHandlerStatus, bool)
+
+// NewHandler returns the handler of the API, submitting the run commands with submit and reading their status with
+// status. Only the callers whose peer credentials are root's are served.
+func NewHandler(ctx *log.Context, submit SubmitFunc, status StatusFunc) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(runCommandsPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var s settings.SettingsCommon
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&s); err != nil {
+			http.Error(w, "invalid run command: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validate(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := submit(s); err == ErrDuplicate {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err == ErrQueueFull {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ctx.Log("event", "run command submitted", "extensionName", *s.ExtensionName, "seqNo", *s.SeqNo, "peer", peerFromContext(r.Context()))
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc(runCommandsPath+"/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s, ok := status(strings.TrimPrefix(r.URL.Path, runCommandsPath+"/"))
+		if !ok {
+			http.Error(w, "the run command has not reported a status", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	})
+	return requireRoot(ctx, mux)
+}
+
+// validate checks the run command can be queued. Its settings are validated once it is executed, like those of the
+// goal states, and an invalid run command is reported as failed in its status.
+func validate(s settings.SettingsCommon) error {
+	if s.ExtensionName == nil || *s.ExtensionName == "" || strings.ContainsAny(*s.ExtensionName, "/\\") {
+		return errors.New("'extensionName' is required and can't contain path separators")
+	}
+	if !s.IsLocal() || *s.ExtensionName == settings.LocalExtensionNamePrefix {
+		return errors.Errorf("'extensionName' must start with '%s', the other names are those of the run commands delivered by HGAP", settings.LocalExtensionNamePrefix)
+	}
+	if s.SeqNo == nil || *s.SeqNo < 0 {
+		return errors.New("'seqNo' is required and must not be negative")
+	}
+	if s.PublicSettings == nil {
+		return errors.New("'publicSettings' is required")
+	}
+	if s.Priority != "" && !strings.EqualFold(s.Priority, settings.HighPriority) && !strings.EqualFold(s.Priority, settings.NormalPriority) {
+		return errors.Errorf("'priority' must be either %s or %s", settings.HighPriority, settings.NormalPriority)
+	}
+	if _, _, err := s.Expiry(); err != nil {
+		return err
+	}
+	return nil
+}
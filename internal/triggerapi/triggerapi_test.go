@@ -0,0 +1,148 @@
+package triggerapi
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/settings"
+	"github.com/Azure/run-command-handler-linux/internal/types"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+const runCommand = `{"extensionName": "local:rc1", "seqNo": 2, "priority": "high", "publicSettings": {"source": {"script": "date"}}}`
+
+// testAPI is the API over fake submission and status functions
+type testAPI struct {
+	submitted []settings.SettingsCommon
+	submitErr error
+	statuses  map[string]types.ImmediateHandlerStatus
+}
+
+func (a *testAPI) handler() http.Handler {
+	submit := func(s settings.SettingsCommon) error {
+		if a.submitErr != nil {
+			return a.submitErr
+		}
+		a.submitted = append(a.submitted, s)
+		return nil
+	}
+	status := func(extensionName string) (types.ImmediateHandlerStatus, bool) {
+		s, ok := a.statuses[extensionName]
+		return s, ok
+	}
+	return NewHandler(log.NewContext(log.NewNopLogger()), submit, status)
+}
+
+// serve returns the response of the API to the request of a process with the user id uid
+func serve(h http.Handler, uid uint32, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r = r.WithContext(context.WithValue(r.Context(), peerContextKey{}, &peer{pid: 42, uid: uid}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func Test_submit(t *testing.T) {
+	api := &testAPI{}
+	h := api.handler()
+
+	w := serve(h, 0, http.MethodPost, "/runcommands", runCommand)
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	require.Len(t, api.submitted, 1)
+	require.Equal(t, "local:rc1", *api.submitted[0].ExtensionName)
+	require.Equal(t, 2, *api.submitted[0].SeqNo)
+	require.True(t, api.submitted[0].IsHighPriority())
+	require.Equal(t, "date", api.submitted[0].PublicSettings["source"].(map[string]interface{})["script"])
+
+	api.submitErr = ErrDuplicate
+	require.Equal(t, http.StatusConflict, serve(h, 0, http.MethodPost, "/runcommands", runCommand).Code)
+	api.submitErr = ErrQueueFull
+	require.Equal(t, http.StatusServiceUnavailable, serve(h, 0, http.MethodPost, "/runcommands", runCommand).Code)
+	require.Equal(t, http.StatusMethodNotAllowed, serve(h, 0, http.MethodGet, "/runcommands", "").Code)
+}
+
+func Test_submitInvalid(t *testing.T) {
+	api := &testAPI{}
+	h := api.handler()
+	for _, body := range []string{
+		`{`,
+		`{"seqNo": 1, "publicSettings": {}}`,
+		`{"extensionName": "local:../rc1", "seqNo": 1, "publicSettings": {}}`,
+		`{"extensionName": "rc1", "seqNo": 1, "publicSettings": {}}`,
+		`{"extensionName": "local:", "seqNo": 1, "publicSettings": {}}`,
+		`{"extensionName": "local:rc1", "publicSettings": {}}`,
+		`{"extensionName": "local:rc1", "seqNo": -1, "publicSettings": {}}`,
+		`{"extensionName": "local:rc1", "seqNo": 1}`,
+		`{"extensionName": "local:rc1", "seqNo": 1, "publicSettings": {}, "priority": "urgent"}`,
+		`{"extensionName": "local:rc1", "seqNo": 1, "publicSettings": {}, "expirationTime": "tomorrow"}`,
+	} {
+		require.Equal(t, http.StatusBadRequest, serve(h, 0, http.MethodPost, "/runcommands", body).Code, body)
+	}
+	require.Empty(t, api.submitted)
+}
+
+func Test_status(t *testing.T) {
+	api := &testAPI{statuses: map[string]types.ImmediateHandlerStatus{
+		"local:rc1": types.NewImmediateHandlerStatus("handler", "local:rc1", 2, types.StatusSuccess, "Enable", "done"),
+	}}
+	h := api.handler()
+
+	w := serve(h, 0, http.MethodGet, "/runcommands/local:rc1", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var s types.ImmediateHandlerStatus
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &s))
+	require.Equal(t, 2, s.SeqNo)
+	require.Equal(t, types.StatusSuccess, s.Status.Status)
+
+	require.Equal(t, http.StatusNotFound, serve(h, 0, http.MethodGet, "/runcommands/local:rc2", "").Code)
+}
+
+func Test_onlyRootIsServed(t *testing.T) {
+	api := &testAPI{}
+	h := api.handler()
+	require.Equal(t, http.StatusForbidden, serve(h, 1000, http.MethodPost, "/runcommands", runCommand).Code)
+
+	// A request whose peer is unknown is rejected too
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/runcommands", strings.NewReader(runCommand)))
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.Empty(t, api.submitted)
+}
+
+func Test_listenAndServe(t *testing.T) {
+	api := &testAPI{}
+	socketPath := filepath.Join(t.TempDir(), "trigger.sock")
+	go ListenAndServe(log.NewContext(log.NewNopLogger()), socketPath, api.handler())
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(socketPath)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	fi, err := os.Stat(socketPath)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm(), "only root can connect")
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}}
+	response, err := client.Post("http://localhost/runcommands", "application/json", strings.NewReader(runCommand))
+	require.Nil(t, err)
+	defer response.Body.Close()
+
+	// The peer credentials are those of the test
+	expected := http.StatusAccepted
+	if os.Geteuid() != 0 {
+		expected = http.StatusForbidden
+	}
+	require.Equal(t, expected, response.StatusCode)
+}
@@ -0,0 +1,28 @@
+// Package trustedfile checks the local files configuring the handler and the service (e.g., the script allow-list,
+// the feature flags or the execution profiles): they can relax or override what the handler does as root, so they
+// must only be writable by the user running it, root.
+package trustedfile
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Check returns an error, naming the file name, unless the open file f is a regular file owned by the effective user
+// and not writable by its group or others. It checks the open file rather than its path, which could be replaced
+// between the check and the read.
+func Check(f *os.File, name string) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", name)
+	}
+	if !fi.Mode().IsRegular() || fi.Mode().Perm()&0022 != 0 {
+		return errors.Errorf("%s must be a regular file only writable by its owner", name)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Geteuid() {
+		return errors.Errorf("%s must be owned by uid %d", name, os.Geteuid())
+	}
+	return nil
+}
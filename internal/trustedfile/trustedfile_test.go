@@ -0,0 +1,34 @@
+package trustedfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	require.Nil(t, os.WriteFile(path, []byte("{}"), 0644))
+	f, err := os.Open(path)
+	require.Nil(t, err)
+	defer f.Close()
+	require.Nil(t, Check(f, "config"))
+
+	require.Nil(t, os.Chmod(path, 0664))
+	require.EqualError(t, Check(f, "config"), "config must be a regular file only writable by its owner")
+	require.Nil(t, os.Chmod(path, 0646))
+	require.EqualError(t, Check(f, "config"), "config must be a regular file only writable by its owner")
+
+	dir, err := os.Open(filepath.Dir(path))
+	require.Nil(t, err)
+	defer dir.Close()
+	require.NotNil(t, Check(dir, "config"))
+
+	if os.Geteuid() == 0 {
+		require.Nil(t, os.Chmod(path, 0644))
+		require.Nil(t, os.Chown(path, 65534, 65534))
+		require.EqualError(t, Check(f, "config"), "config must be owned by uid 0")
+	}
+}
@@ -1,6 +1,8 @@
 package types
 
 import (
+	"time"
+
 	"github.com/go-kit/kit/log"
 )
 
@@ -10,10 +12,11 @@ type preFunc func(ctx *log.Context, hEnv HandlerEnvironment, metadata RCMetadata
 type cleanupFunc func(ctx *log.Context, metadata RCMetadata, h HandlerEnvironment, runAsUser string)
 
 type Cmd struct {
-	Name               string       // human readable string
-	ShouldReportStatus bool         // determines if running this should report the status of the run command
-	FailExitCode       int          // exitCode to use when commands fail
-	Functions          CmdFunctions // functions used by the command
+	Name               string        // human readable string
+	ShouldReportStatus bool          // determines if running this should report the status of the run command
+	FailExitCode       int           // exitCode to use when commands fail
+	Deadline           time.Duration // time the command has to complete before it is reported as timed out, none if zero
+	Functions          CmdFunctions  // functions used by the command
 }
 
 type CmdFunctions struct {
@@ -29,11 +32,15 @@ func (command Cmd) InitializeFunctions(input CmdFunctions) Cmd {
 }
 
 var (
-	CmdInstallTemplate    = Cmd{Name: "Install", ShouldReportStatus: false, FailExitCode: 52}
+	// Scripts without a timeout may legitimately run for hours, so Enable only gets a deadline derived from the
+	// timeout of the script
+	CmdInstallTemplate    = Cmd{Name: "Install", ShouldReportStatus: false, FailExitCode: 52, Deadline: 5 * time.Minute}
 	CmdEnableTemplate     = Cmd{Name: "Enable", ShouldReportStatus: true, FailExitCode: 3}
-	CmdDisableTemplate    = Cmd{Name: "Disable", ShouldReportStatus: true, FailExitCode: 3}
-	CmdUpdateTemplate     = Cmd{Name: "Update", ShouldReportStatus: true, FailExitCode: 3}
-	CmdUninstallTemplate  = Cmd{Name: "Uninstall", ShouldReportStatus: false, FailExitCode: 3}
+	CmdDisableTemplate    = Cmd{Name: "Disable", ShouldReportStatus: true, FailExitCode: 3, Deadline: 5 * time.Minute}
+	CmdUpdateTemplate     = Cmd{Name: "Update", ShouldReportStatus: true, FailExitCode: 3, Deadline: 10 * time.Minute}
+	CmdUninstallTemplate  = Cmd{Name: "Uninstall", ShouldReportStatus: false, FailExitCode: 3, Deadline: 5 * time.Minute}
+	CmdCancelTemplate     = Cmd{Name: "Cancel", ShouldReportStatus: true, FailExitCode: 3, Deadline: 2 * time.Minute}
+	CmdValidateTemplate   = Cmd{Name: "Validate", ShouldReportStatus: true, FailExitCode: 3, Deadline: 5 * time.Minute}
 	CmdRunServiceTemplate = Cmd{Name: "RunService", ShouldReportStatus: true, FailExitCode: 3}
 
 	CmdTemplates = map[string]Cmd{
@@ -42,6 +49,8 @@ var (
 		"disable":    CmdDisableTemplate,
 		"update":     CmdUpdateTemplate,
 		"uninstall":  CmdUninstallTemplate,
+		"cancel":     CmdCancelTemplate,
+		"validate":   CmdValidateTemplate,
 		"runService": CmdRunServiceTemplate,
 	}
 )
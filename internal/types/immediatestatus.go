@@ -0,0 +1,39 @@
+package types
+
+import "time"
+
+// ImmediateTopLevelStatus is the aggregate status uploaded to HGAP. It contains the latest
+// status of every immediate run command known by the service.
+type ImmediateTopLevelStatus struct {
+	AggregateHandlerImmediateStatus []ImmediateHandlerStatus `json:"aggregateHandlerImmediateStatus"`
+}
+
+// ImmediateHandlerStatus describes the status of a single immediate run command
+type ImmediateHandlerStatus struct {
+	HandlerName   string `json:"handlerName"`
+	ExtensionName string `json:"extensionName"`
+	SeqNo         int    `json:"seqNo"`
+	TimestampUTC  string `json:"timestampUTC"`
+	Status        Status `json:"status"`
+}
+
+func NewImmediateHandlerStatus(handlerName string, extensionName string, seqNo int, statusType StatusType, operation string, message string) ImmediateHandlerStatus {
+	return ImmediateHandlerStatus{
+		HandlerName:   handlerName,
+		ExtensionName: extensionName,
+		SeqNo:         seqNo,
+		TimestampUTC:  time.Now().UTC().Format(time.RFC3339),
+		Status: Status{
+			Operation: operation,
+			Status:    statusType,
+			FormattedMessage: FormattedMessage{
+				Lang:    "en",
+				Message: message},
+		},
+	}
+}
+
+// IsTerminal returns true if the immediate run command has reached a final state
+func (s ImmediateHandlerStatus) IsTerminal() bool {
+	return s.Status.Status != StatusTransitioning
+}
@@ -26,17 +26,43 @@ const (
 
 	// Canceled state when customer canceled the script execution
 	Canceled = "Canceled"
+
+	// Expired state when the script did not start before the expiration time of its command
+	Expired = "Expired"
 )
 
+// SubStatusLevel indicates the severity of a substatus
+type SubStatusLevel string
+
+const (
+	SubStatusLevelInfo    SubStatusLevel = "Info"
+	SubStatusLevelWarning SubStatusLevel = "Warning"
+)
+
+// InstanceViewSubStatus reports a condition met during the execution that does not change its
+// state (e.g., the output could not be uploaded to the requested blob)
+type InstanceViewSubStatus struct {
+	Name    string         `json:"name"`
+	Code    string         `json:"code"`
+	Level   SubStatusLevel `json:"level"`
+	Message string         `json:"message"`
+}
+
 // RunCommandInstanceView reports script execution status
 type RunCommandInstanceView struct {
-	ExecutionState   ExecutionState `json:"executionState"`
-	ExecutionMessage string         `json:"executionMessage"`
-	Output           string         `json:"output"`
-	Error            string         `json:"error"`
-	ExitCode         int            `json:"exitCode"`
-	StartTime        string         `json:"startTime"`
-	EndTime          string         `json:"endTime"`
+	ExecutionState   ExecutionState          `json:"executionState"`
+	ExecutionMessage string                  `json:"executionMessage"`
+	Output           string                  `json:"output"`
+	Error            string                  `json:"error"`
+	ExitCode         int                     `json:"exitCode"`
+	StartTime        string                  `json:"startTime"`
+	EndTime          string                  `json:"endTime"`
+	SubStatuses      []InstanceViewSubStatus `json:"subStatuses,omitempty"`
+	QueuePosition    int                     `json:"queuePosition,omitempty"`
+	ProcessTree      string                  `json:"processTree,omitempty"`
+	ScriptHash       string                  `json:"scriptHash,omitempty"`
+	Metrics          map[string]string       `json:"metrics,omitempty"`
+	PercentComplete  *int                    `json:"percentComplete,omitempty"`
 }
 
 func (instanceView RunCommandInstanceView) Marshal() ([]byte, error) {
@@ -1,7 +1,9 @@
 package types
 
 import (
-	"path/filepath"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/internal/datapaths"
 )
 
 type RCMetadata struct {
@@ -12,9 +14,12 @@ type RCMetadata struct {
 	// Filename where active process keeps track of process id and process start time
 	PidFilePath string
 
+	// Filename locked while the state files of the extension are updated
+	LockFilePath string
+
 	// DownloadDir is where we store the downloaded files in the "{downloadDir}/{seqnum}/file"
 	// format and the logs as "{downloadDir}/{seqnum}/std(out|err)". Stored under dataDir
-	// multiconfig support - when extName is set we use {downloadDir}/{extName}/...
+	// multiconfig support - {downloadDir}/{extName}/... (see datapaths for the naming rules)
 	DownloadDir string
 
 	// Download path is the full path where the files are stored.
@@ -26,15 +31,19 @@ type RCMetadata struct {
 
 	// The sequence number. E.g., 1
 	SeqNum int
+
+	// How often the status of the running script is reported, the default if 0
+	StatusUpdateInterval time.Duration
 }
 
 func NewRCMetadata(extensionName string, seqNum int, downloadFolder string, dataDir string) RCMetadata {
 	result := RCMetadata{}
 	result.ExtName = extensionName
 	result.SeqNum = seqNum
-	result.DownloadDir = filepath.Join(downloadFolder, extensionName)
-	result.DownloadPath = filepath.Join(dataDir, result.DownloadDir)
-	result.MostRecentSequence = extensionName + ".mrseq"
-	result.PidFilePath = extensionName + ".pidstart"
+	result.DownloadDir = datapaths.DownloadDir(downloadFolder, extensionName)
+	result.DownloadPath = datapaths.DownloadPath(dataDir, downloadFolder, extensionName)
+	result.MostRecentSequence = datapaths.MostRecentSequencePath(dataDir, downloadFolder, extensionName)
+	result.PidFilePath = datapaths.PidFilePath(dataDir, downloadFolder, extensionName)
+	result.LockFilePath = datapaths.LockFilePath(dataDir, downloadFolder, extensionName)
 	return result
 }
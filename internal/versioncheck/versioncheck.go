@@ -0,0 +1,79 @@
+// Package versioncheck verifies that the version the handler was built with matches the handler installed on
+// disk, so a binary copied into the wrong versioned directory is reported up front instead of surfacing later
+// as confusing path errors.
+package versioncheck
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	// manifestFileName is the manifest of the extension image, bundled with the handler
+	manifestFileName = "manifest.xml"
+
+	// handlerManifestFileName is read by the agent to invoke the handler
+	handlerManifestFileName = "HandlerManifest.json"
+)
+
+// TelemetryFunc sends a telemetry event
+type TelemetryFunc func(operation, message string, isSuccess bool, duration time.Duration) error
+
+// extensionImage is the part of the manifest of the extension image holding the version
+type extensionImage struct {
+	Version string `xml:"Version"`
+}
+
+// Report logs a warning and sends a telemetry event for every inconsistency between version and the handler
+// installed in the directory of the running executable. The handler keeps running either way.
+func Report(ctx *log.Context, version string, sendTelemetry TelemetryFunc) {
+	executable, err := os.Executable()
+	if err != nil {
+		ctx.Log("warning", "cannot locate the handler directory to verify its version", "error", err)
+		return
+	}
+
+	// The executable lives in [EXT_NAME]/bin/
+	mismatches := Check(filepath.Dir(filepath.Dir(executable)), version)
+	for _, mismatch := range mismatches {
+		ctx.Log("warning", "handler version mismatch", "error", mismatch)
+		sendTelemetry("versionCheck", mismatch, false, 0)
+	}
+}
+
+// Check returns the inconsistencies between version and the handler installed in handlerDir: the name of the
+// directory, which the agent suffixes with the version, and the version of the bundled manifests. Builds without
+// a version (e.g., local builds) are not checked.
+func Check(handlerDir string, version string) []string {
+	if version == "" {
+		return nil
+	}
+
+	var mismatches []string
+	if dirName := filepath.Base(handlerDir); !strings.HasSuffix(dirName, "-"+version) {
+		mismatches = append(mismatches, fmt.Sprintf("handler version %s is installed in directory %s, which is named after another version", version, handlerDir))
+	}
+
+	if _, err := os.Stat(filepath.Join(handlerDir, handlerManifestFileName)); err != nil {
+		mismatches = append(mismatches, fmt.Sprintf("%s not found in handler directory %s", handlerManifestFileName, handlerDir))
+	}
+
+	b, err := os.ReadFile(filepath.Join(handlerDir, manifestFileName))
+	if err != nil {
+		// The manifest of the extension image is not required to run the handler
+		return mismatches
+	}
+	var manifest extensionImage
+	if err := xml.Unmarshal(b, &manifest); err != nil {
+		mismatches = append(mismatches, fmt.Sprintf("invalid %s in handler directory %s: %v", manifestFileName, handlerDir, err))
+	} else if strings.TrimSpace(manifest.Version) != version {
+		mismatches = append(mismatches, fmt.Sprintf("handler version %s does not match version %s of %s in handler directory %s", version, strings.TrimSpace(manifest.Version), manifestFileName, handlerDir))
+	}
+	return mismatches
+}
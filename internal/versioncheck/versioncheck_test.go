@@ -0,0 +1,49 @@
+package versioncheck
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newHandlerDir(t *testing.T, dirName string, manifestVersion string) string {
+	handlerDir := filepath.Join(t.TempDir(), dirName)
+	require.Nil(t, os.MkdirAll(handlerDir, 0700))
+	require.Nil(t, os.WriteFile(filepath.Join(handlerDir, handlerManifestFileName), []byte("[]"), 0600))
+	manifest := "<?xml version='1.0' encoding='utf-8' ?>\n<ExtensionImage xmlns=\"http://schemas.microsoft.com/windowsazure\">\n  <Version>" + manifestVersion + "</Version>\n</ExtensionImage>"
+	require.Nil(t, os.WriteFile(filepath.Join(handlerDir, manifestFileName), []byte(manifest), 0600))
+	return handlerDir
+}
+
+func Test_Check_consistent(t *testing.T) {
+	handlerDir := newHandlerDir(t, "Microsoft.CPlat.Core.RunCommandHandlerLinux-1.3.3", "1.3.3")
+	require.Empty(t, Check(handlerDir, "1.3.3"))
+}
+
+func Test_Check_noVersion(t *testing.T) {
+	require.Empty(t, Check(t.TempDir(), ""))
+}
+
+func Test_Check_wrongDirectory(t *testing.T) {
+	handlerDir := newHandlerDir(t, "Microsoft.CPlat.Core.RunCommandHandlerLinux-1.3.2", "1.3.3")
+	mismatches := Check(handlerDir, "1.3.3")
+	require.Len(t, mismatches, 1)
+	require.Contains(t, mismatches[0], "named after another version")
+}
+
+func Test_Check_wrongManifestVersion(t *testing.T) {
+	handlerDir := newHandlerDir(t, "Microsoft.CPlat.Core.RunCommandHandlerLinux-1.3.3", "1.3.2")
+	mismatches := Check(handlerDir, "1.3.3")
+	require.Len(t, mismatches, 1)
+	require.Contains(t, mismatches[0], "does not match version 1.3.2 of manifest.xml")
+}
+
+func Test_Check_missingManifests(t *testing.T) {
+	handlerDir := filepath.Join(t.TempDir(), "Microsoft.CPlat.Core.RunCommandHandlerLinux-1.3.3")
+	require.Nil(t, os.MkdirAll(handlerDir, 0700))
+	mismatches := Check(handlerDir, "1.3.3")
+	require.Len(t, mismatches, 1)
+	require.Contains(t, mismatches[0], "HandlerManifest.json not found")
+}
@@ -0,0 +1,135 @@
+// Package writablestate routes the state written by the handler (downloaded and temporary scripts, pid and queue
+// files, journals, sockets) to a writable location when the default data directory is not writable, e.g., on VMs
+// whose root filesystem is read-only or immutable.
+package writablestate
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/internal/trustedfile"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// stateDirName is the directory of the handler created in a writable location. The listed directories are shared
+// (e.g., /var/tmp), the handler only writes, cleans up and removes its own directory in them.
+const stateDirName = "run-command-handler"
+
+// Resolve sets the data directory of the handler to the default one if it is writable, or else to its own directory
+// in the first writable directory listed in constants.WritableStateDirsPath. The returned error lists the paths that
+// must be writable when none is.
+func Resolve(ctx *log.Context) error {
+	return resolve(ctx, constants.DefaultDataDir, constants.WritableStateDirsPath)
+}
+
+func resolve(ctx *log.Context, defaultDir, dirsPath string) error {
+	err := checkWritable(defaultDir, 0755)
+	if err == nil {
+		constants.SetDataDir(defaultDir)
+		return nil
+	}
+	reasons := []string{fmt.Sprintf("%s: %v", defaultDir, err)}
+	ctx.Log("warning", "data directory is not writable", "path", defaultDir, "readOnly", isReadOnly(err), "error", err)
+
+	dirs, err := loadDirs(dirsPath)
+	if err != nil {
+		return errors.Wrapf(err, "data directory %s is not writable and the writable locations in %s are invalid", defaultDir, dirsPath)
+	}
+	for _, dir := range dirs {
+		stateDir := filepath.Join(dir, stateDirName)
+		err := checkStateDir(dir, stateDir)
+		if err == nil {
+			ctx.Log("event", "routing the state of the handler to a writable location", "path", stateDir)
+			constants.SetDataDir(stateDir)
+			return nil
+		}
+		reasons = append(reasons, fmt.Sprintf("%s: %v", dir, err))
+	}
+
+	if len(dirs) == 0 {
+		reasons = append(reasons, fmt.Sprintf("no alternative location is listed in %s", dirsPath))
+	}
+	return fmt.Errorf("the handler requires a writable location for its state: %s must be writable, or one of the directories listed in %s (%s)",
+		defaultDir, dirsPath, strings.Join(reasons, "; "))
+}
+
+// checkWritable creates dir with perm if needed and checks that a file can be written in it
+func checkWritable(dir string, perm os.FileMode) error {
+	if err := os.MkdirAll(dir, perm); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".writable-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkStateDir creates the directory of the handler, stateDir, in the listed directory dir and checks it can be
+// written. The listed directories can be writable by everyone, so a stateDir created by another user, or a link,
+// is rejected rather than trusted with the state of the handler.
+func checkStateDir(dir, stateDir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := os.Mkdir(stateDir, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	fi, err := os.Lstat(stateDir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() || fi.Mode().Perm()&0022 != 0 {
+		return errors.Errorf("%s must be a directory only writable by its owner", stateDir)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Geteuid() {
+		return errors.Errorf("%s must be owned by uid %d", stateDir, os.Geteuid())
+	}
+	return checkWritable(stateDir, 0700)
+}
+
+// isReadOnly returns whether err comes from a read-only filesystem or an immutable file, rather than permissions
+func isReadOnly(err error) bool {
+	return errors.Is(err, syscall.EROFS) || errors.Is(err, syscall.EPERM)
+}
+
+// loadDirs returns the directories listed in the file at path, one absolute path per line. Empty lines and lines
+// starting with '#' are ignored, and a missing file lists no directory.
+func loadDirs(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open writable locations")
+	}
+	defer f.Close()
+
+	if err := trustedfile.Check(f, "writable locations"); err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			return nil, errors.Errorf("line %d must be an absolute path", n)
+		}
+		dirs = append(dirs, filepath.Clean(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read writable locations")
+	}
+	return dirs, nil
+}
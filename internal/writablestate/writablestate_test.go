@@ -0,0 +1,64 @@
+package writablestate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_resolve(t *testing.T) {
+	defer constants.SetDataDir(constants.DefaultDataDir)
+	ctx := log.NewContext(log.NewNopLogger())
+	tmp := t.TempDir()
+	dirsPath := filepath.Join(tmp, "writable-state-dirs")
+
+	// The default data directory is used when writable
+	defaultDir := filepath.Join(tmp, "data")
+	require.Nil(t, resolve(ctx, defaultDir, dirsPath))
+	require.Equal(t, defaultDir, constants.DataDir)
+	require.Equal(t, defaultDir+"/executionqueue", constants.ExecutionQueueDir)
+
+	// A directory can't be created below a file, like on a read-only filesystem
+	notWritable := filepath.Join(tmp, "file")
+	require.Nil(t, os.WriteFile(notWritable, nil, 0644))
+	defaultDir = filepath.Join(notWritable, "data")
+
+	err := resolve(ctx, defaultDir, dirsPath)
+	require.ErrorContains(t, err, "the handler requires a writable location for its state: "+defaultDir+" must be writable")
+	require.ErrorContains(t, err, "no alternative location is listed in "+dirsPath)
+
+	// The first writable directory listed is used instead
+	alternative := filepath.Join(tmp, "alternative")
+	require.Nil(t, os.WriteFile(dirsPath, []byte("# tmpfs\n"+filepath.Join(notWritable, "other")+"\n\n"+alternative+"\n"), 0644))
+	require.Nil(t, resolve(ctx, defaultDir, dirsPath))
+	stateDir := filepath.Join(alternative, stateDirName)
+	require.Equal(t, stateDir, constants.DataDir)
+	require.Equal(t, stateDir+"/service.sock", constants.ServiceSocketPath)
+	require.Equal(t, stateDir+"/ready", constants.ReadinessDir)
+	fi, err := os.Stat(stateDir)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+
+	// The directory of the handler in a shared location must not be controlled by someone else
+	require.Nil(t, os.Chmod(stateDir, 0777))
+	require.ErrorContains(t, resolve(ctx, defaultDir, dirsPath), "must be a directory only writable by its owner")
+	require.Nil(t, os.Remove(stateDir))
+	require.Nil(t, os.Symlink(tmp, stateDir))
+	require.ErrorContains(t, resolve(ctx, defaultDir, dirsPath), "must be a directory only writable by its owner")
+	require.Nil(t, os.Remove(stateDir))
+
+	require.Nil(t, os.WriteFile(dirsPath, []byte(filepath.Join(notWritable, "other")+"\n"), 0644))
+	err = resolve(ctx, defaultDir, dirsPath)
+	require.ErrorContains(t, err, "one of the directories listed in "+dirsPath)
+	require.ErrorContains(t, err, filepath.Join(notWritable, "other")+": ")
+
+	require.Nil(t, os.WriteFile(dirsPath, []byte("relative/dir\n"), 0644))
+	require.ErrorContains(t, resolve(ctx, defaultDir, dirsPath), "line 1 must be an absolute path")
+
+	require.Nil(t, os.Chmod(dirsPath, 0666))
+	require.ErrorContains(t, resolve(ctx, defaultDir, dirsPath), "only writable by its owner")
+}
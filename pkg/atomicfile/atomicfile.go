@@ -0,0 +1,55 @@
+// Package atomicfile writes the state files of the handler (sequence numbers, pids, statuses, journals, summaries)
+// so they are either left as they were or fully replaced, even on a power loss: a truncated state file can otherwise
+// wedge the processing of the sequence numbers.
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// WriteFile replaces the file at path with data, written with perm to a temporary file in the same directory,
+// synced, then renamed to path. The directory is synced too, so the rename survives a power loss.
+func WriteFile(path string, data []byte, perm os.FileMode) (err error) {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary file")
+	}
+	tmp := f.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to write %s", tmp)
+	}
+
+	if err = os.Rename(tmp, path); err != nil {
+		return errors.Wrapf(err, "failed to move to %s", path)
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes the entries of the directory, e.g., a file renamed into it
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open directory %s", dir)
+	}
+	defer d.Close()
+	return errors.Wrapf(d.Sync(), "failed to sync directory %s", dir)
+}
@@ -0,0 +1,48 @@
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "0.status")
+
+	require.Nil(t, WriteFile(path, []byte("first"), 0600))
+	require.Nil(t, WriteFile(path, []byte("second"), 0644))
+
+	b, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, "second", string(b))
+	fi, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0644), fi.Mode().Perm())
+
+	// No temporary file is left behind
+	entries, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestWriteFile_fails(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mrseq")
+	require.Nil(t, os.WriteFile(path, []byte("4"), 0600))
+
+	// A directory can't replace the file
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "sub"), 0700))
+	err := WriteFile(filepath.Join(dir, "sub"), []byte("5"), 0600)
+	require.Error(t, err)
+
+	// The temporary file is removed, and the existing files are left unchanged
+	entries, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	require.Len(t, entries, 2)
+	b, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, "4", string(b))
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/Azure/azure-sdk-for-go/storage"
 	"github.com/Azure/run-command-handler-linux/pkg/blobutil"
+	"github.com/Azure/run-command-handler-linux/pkg/requestheaders"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 )
@@ -71,8 +72,9 @@ func NewBlobDownload(accountName, accountKey string, blob blobutil.AzureBlobRef)
 }
 
 // GetSASBlob download a blob with specified uri and sas authorization and saves it to the target directory
-// Returns the filePath where the blob was downloaded
-func GetSASBlob(blobURI, blobSas, targetDir string) (string, error) {
+// Returns the filePath where the blob was downloaded. The requests go through proxy unless it is nil, and the
+// download reads at most maxKbps kilobits per second unless it is zero.
+func GetSASBlob(blobURI, blobSas, targetDir string, proxy *url.URL, maxKbps int) (string, error) {
 	bloburl, err := url.Parse(blobURI + blobSas)
 	loggableBlobUri := GetUriForLogging(blobURI)
 	if err != nil {
@@ -83,6 +85,7 @@ func GetSASBlob(blobURI, blobSas, targetDir string) (string, error) {
 	if err != nil {
 		return "", errors.Wrapf(err, "unable to open storage container: %q", loggableBlobUri)
 	}
+	configureStorageClient(containerRef.Client(), proxy)
 
 	// Extract the blob path after container name
 	fileName, blobPathError := getBlobPathAfterContainerName(blobURI, containerRef.Name)
@@ -95,6 +98,10 @@ func GetSASBlob(blobURI, blobSas, targetDir string) (string, error) {
 	if err != nil {
 		return "", errors.Wrapf(err, "unable to open storage blob: %q", loggableBlobUri)
 	}
+	defer reader.Close()
+	if maxKbps > 0 {
+		reader = newRateLimitedReader(reader, kbpsToBytesPerSecond(maxKbps))
+	}
 
 	scriptFilePath := filepath.Join(targetDir, fileName)
 	const mode = 0500 // scripts should have execute permissions
@@ -115,7 +122,55 @@ func GetSASBlob(blobURI, blobSas, targetDir string) (string, error) {
 }
 
 // CreateOrReplaceAppendBlob creates a reference to an append blob. If blob exists - it gets deleted first.
-func CreateOrReplaceAppendBlob(blobURI, blobSas string) (*storage.Blob, error) {
+// The requests go through proxy unless it is nil. With a renewal provider, the requests use the SAS tokens it
+// renews, starting with blobSas if given, and those of the blobs continuing this one.
+func CreateOrReplaceAppendBlob(blobURI, blobSas string, proxy *url.URL, renewal SASProvider) (*storage.Blob, error) {
+	blobref, err := getBlobReference(blobURI, blobSas, proxy, renewal)
+	if err != nil {
+		return nil, err
+	}
+
+	err = blobref.PutAppendBlob(nil) // Create the append blob
+	if err != nil {
+		return nil, err
+	}
+
+	return blobref, nil
+}
+
+// CreateOrReplaceBlockBlob creates a reference to an empty block blob, for the storage accounts without append
+// blobs. If blob exists - it gets replaced. The requests go through proxy unless it is nil, and use the SAS tokens
+// of the renewal provider unless it is nil, as for CreateOrReplaceAppendBlob.
+func CreateOrReplaceBlockBlob(blobURI, blobSas string, proxy *url.URL, renewal SASProvider) (*storage.Blob, error) {
+	blobref, err := getBlobReference(blobURI, blobSas, proxy, renewal)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := blobref.CreateBlockBlob(nil); err != nil {
+		return nil, err
+	}
+
+	return blobref, nil
+}
+
+func getBlobReference(blobURI, blobSas string, proxy *url.URL, renewal SASProvider) (*storage.Blob, error) {
+	var renewing *sasRenewingTransport
+	if renewal != nil {
+		// The tokens of the provider replace any in the query of the uri
+		blobURI = blobKey(blobURI)
+		renewing = newSASRenewingTransport(nil, renewal)
+		if blobSas != "" {
+			if err := renewing.seed(blobURI, blobSas); err != nil {
+				return nil, errors.Wrapf(err, "invalid SAS token of blob '%s'", GetUriForLogging(blobURI))
+			}
+		}
+		token, err := renewing.token(blobURI, false)
+		if err != nil {
+			return nil, err
+		}
+		blobSas = "?" + token.query.Encode()
+	}
 
 	bloburl, err := url.Parse(blobURI + blobSas)
 	if err != nil {
@@ -126,19 +181,31 @@ func CreateOrReplaceAppendBlob(blobURI, blobSas string) (*storage.Blob, error) {
 	if err != nil {
 		return nil, err
 	}
+	configureStorageClient(containerRef.Client(), proxy)
+	if renewing != nil {
+		client := containerRef.Client()
+		renewing.base = http.DefaultTransport
+		if client.HTTPClient != nil && client.HTTPClient.Transport != nil {
+			renewing.base = client.HTTPClient.Transport
+		}
+		client.HTTPClient = &http.Client{Transport: renewing}
+	}
 
 	fileName, blobPathError := getBlobPathAfterContainerName(blobURI, containerRef.Name)
 	if fileName == "" {
 		return nil, errors.Wrapf(blobPathError, "cannot extract blob path name from URL: %q", GetUriForLogging(blobURI))
 	}
 
-	blobref := containerRef.GetBlobReference(fileName)
-	err = blobref.PutAppendBlob(nil) // Create the append blob
-	if err != nil {
-		return nil, err
-	}
+	return containerRef.GetBlobReference(fileName), nil
+}
 
-	return blobref, nil
+// configureStorageClient adds the request headers to the requests of a legacy storage client and sends them
+// through proxy unless it is nil
+func configureStorageClient(client *storage.Client, proxy *url.URL) {
+	requestheaders.ApplyToStorageClient(client)
+	if proxy != nil {
+		client.HTTPClient = newStorageHTTPClient(proxy)
+	}
 }
 
 // Extract the suffix after the container name from blob uri
@@ -124,7 +124,7 @@ func Test_GetSASBlob_actualBlob(t *testing.T) {
 	require.Nil(t, err)
 	defer os.RemoveAll(tmpDir)
 
-	scriptFilePath, err := GetSASBlob(sasURL, sasToken, tmpDir)
+	scriptFilePath, err := GetSASBlob(sasURL, sasToken, tmpDir, nil, 0)
 	require.Nil(t, err)
 	result, err := ioutil.ReadFile(scriptFilePath)
 	require.Nil(t, err)
@@ -187,7 +187,7 @@ func Test_blobAppend_actualBlob(t *testing.T) {
 		t.Skipf("Skipping: AZURE_STORAGE_BLOB or SASTOKEN not specified to run this test")
 	}
 
-	blobref, err := CreateOrReplaceAppendBlob(blobURI, sasToken)
+	blobref, err := CreateOrReplaceAppendBlob(blobURI, sasToken, nil, nil)
 	require.Nil(t, err)
 
 	err = blobref.AppendBlock([]byte("First line\n"), nil)
@@ -3,10 +3,9 @@ package download
 import (
 	"fmt"
 	"io"
-	"net"
 	"net/http"
-	"time"
 
+	"github.com/Azure/run-command-handler-linux/pkg/requestheaders"
 	"github.com/Azure/run-command-handler-linux/pkg/urlutil"
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
@@ -31,26 +30,31 @@ var (
 	// Internet. http.Get() uses a client without timeouts (http.DefaultClient)
 	// so it is dangerous to use it for downloading files from the Internet.
 	httpClient = &http.Client{
-		Transport: &http.Transport{
-			Dial: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).Dial,
-			Proxy:                 http.ProxyFromEnvironment,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ResponseHeaderTimeout: 20 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-		}}
+		Transport: requestheaders.NewTransport(newTransport(Proxy))}
 )
 
 // Download retrieves a response body and checks the response status code to see
 // if it is 200 OK and then returns the response body. It issues a new request
 // every time called. It is caller's responsibility to close the response body.
 func Download(ctx *log.Context, downloader Downloader) (int, io.ReadCloser, error) {
+	status, response, err := get(ctx, downloader, nil)
+	if err != nil {
+		return status, nil, err
+	}
+	return status, response.Body, nil
+}
+
+// get issues a new request of the downloader with the given additional headers and returns the response if its
+// status is 200 OK, or 206 Partial Content for a range request. It is caller's responsibility to close the response
+// body.
+func get(ctx *log.Context, downloader Downloader, header http.Header) (int, *http.Response, error) {
 	request, err := downloader.GetRequest()
 	if err != nil {
 		return -1, nil, errors.Wrapf(err, "failed to create http request")
 	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
 	requestID := request.Header.Get(xMsClientRequestIdHeaderName)
 	if len(requestID) > 0 {
 		ctx.Log("info", fmt.Sprintf("starting download with client request ID %s", requestID))
@@ -62,9 +66,13 @@ func Download(ctx *log.Context, downloader Downloader) (int, io.ReadCloser, erro
 		return -1, nil, errors.Wrapf(err, "http request failed")
 	}
 
-	if response.StatusCode == http.StatusOK {
-		return response.StatusCode, response.Body, nil
+	if response.StatusCode == http.StatusOK || response.StatusCode == http.StatusPartialContent && request.Header.Get("Range") != "" {
+		if limit := bandwidthLimitFromContext(request.Context()); limit > 0 {
+			response.Body = newRateLimitedReader(response.Body, limit)
+		}
+		return response.StatusCode, response, nil
 	}
+	response.Body.Close()
 
 	errString := fmt.Sprintf("Status code %d while downloading blob '%s'. Use either a public script URI that points to .sh file, Azure storage blob SAS URI or storage blob accessible by a managed identity and retry. For more information, see https://aka.ms/RunCommandManagedLinux", response.StatusCode, request.URL.Opaque)
 	requestId := response.Header.Get(xMsServiceRequestIdHeaderName)
@@ -0,0 +1,178 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-extension-foundation/httputil"
+	"github.com/Azure/azure-extension-foundation/msi"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// azureDevOpsResourceName is the resource of the tokens of managed identities accepted by Azure DevOps
+	azureDevOpsResourceName = "499b84ac-1321-427f-aa17-267ca6975798"
+
+	// gitCloneTimeout bounds the download of a repository
+	gitCloneTimeout = 10 * time.Minute
+)
+
+// gitVersionRegex matches the major and minor versions printed by git --version, e.g., git version 2.39.5
+var gitVersionRegex = regexp.MustCompile(`^git version (\d+)\.(\d+)`)
+
+// GitRepository describes a git repository to download at a branch, tag or commit
+type GitRepository struct {
+	URL string
+	// Ref is the branch, tag or commit to download, the default branch of the repository if empty
+	Ref string
+	// PAT is a personal access token authenticating the download, if any
+	PAT string
+	// MsiProvider provides the Azure DevOps token of a managed identity authenticating the download, if any
+	MsiProvider MsiProvider
+	// Proxy is the proxy of the download, nil to use the proxy of the environment
+	Proxy *url.URL
+}
+
+// Clone downloads the files of the repository at its ref into dir, created if missing, without its history.
+// The credentials are passed to git in its environment, they are neither on its command line nor saved in the
+// repository.
+func (g GitRepository) Clone(ctx *log.Context, dir string) error {
+	config, err := g.config()
+	if err != nil {
+		return err
+	}
+	ref := g.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "failed to create the directory of the git repository")
+	}
+	opCtx, cancel := context.WithTimeout(context.Background(), gitCloneTimeout)
+	defer cancel()
+	if len(config) > 0 {
+		if err := checkGitVersion(opCtx); err != nil {
+			return err
+		}
+	}
+	for _, step := range [][]string{
+		{"init", "--quiet"},
+		{"fetch", "--quiet", "--depth", "1", "--no-tags", g.URL, ref},
+		{"checkout", "--quiet", "FETCH_HEAD"},
+	} {
+		ctx.Log("event", "running git "+step[0])
+		if err := runGit(opCtx, config, dir, step[0], step[1:]...); err != nil {
+			return errors.Wrapf(err, "failed to download the git repository '%s' at '%s'", GetUriForLogging(g.URL), ref)
+		}
+	}
+	return nil
+}
+
+// config returns the git configuration of the download: its credentials and proxy
+func (g GitRepository) config() (map[string]string, error) {
+	config := make(map[string]string)
+	switch {
+	case g.PAT != "":
+		basic := base64.StdEncoding.EncodeToString([]byte(":" + g.PAT))
+		config["http.extraHeader"] = "Authorization: Basic " + basic
+	case g.MsiProvider != nil:
+		token, err := g.MsiProvider()
+		if err != nil {
+			return nil, err
+		}
+		if token.AccessToken == "" {
+			return nil, errors.New("MSI token is empty")
+		}
+		config["http.extraHeader"] = "Authorization: Bearer " + token.AccessToken
+	}
+	if g.Proxy != nil {
+		config["http.proxy"] = g.Proxy.String()
+	}
+	return config, nil
+}
+
+// checkGitVersion fails unless git reads its configuration from GIT_CONFIG_COUNT, as of git 2.31. Older versions
+// ignore it: the credentials and the proxy would not be used.
+func checkGitVersion(ctx context.Context) error {
+	out, err := exec.CommandContext(ctx, "git", "--version").Output()
+	if err != nil {
+		return errors.Wrap(err, "failed to get the version of git")
+	}
+	version := strings.TrimSpace(string(out))
+	if !readsConfigFromEnvironment(version) {
+		return errors.Errorf("git 2.31 or later is required to download a git repository with a token, a managed identity or a proxy, the VM has '%s'", version)
+	}
+	return nil
+}
+
+// readsConfigFromEnvironment returns whether the git of the given version, as printed by git --version, reads its
+// configuration from GIT_CONFIG_COUNT
+func readsConfigFromEnvironment(version string) bool {
+	m := gitVersionRegex.FindStringSubmatch(version)
+	if m == nil {
+		return false
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return major > 2 || major == 2 && minor >= 31
+}
+
+// runGit runs the git command in dir with the configuration in its environment, never prompting for credentials
+func runGit(ctx context.Context, config map[string]string, dir string, command string, args ...string) error {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir, "-c", "advice.detachedHead=false", command}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", fmt.Sprintf("GIT_CONFIG_COUNT=%d", len(config)))
+	i := 0
+	for key, value := range config {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", i, key), fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", i, value))
+		i++
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return errors.Wrapf(ctx.Err(), "git %s timed out", command)
+		}
+		return errors.Errorf("git %s failed: %v: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// GetAzureDevOpsMsiProvider returns the provider of the Azure DevOps tokens of the system managed identity, or of
+// the user assigned one with the client or object id
+func GetAzureDevOpsMsiProvider(clientId, objectId string) MsiProvider {
+	return getMsiProviderForResource(azureDevOpsResourceName, "Azure DevOps", clientId, objectId)
+}
+
+// getMsiProviderForResource returns the provider of the tokens of the system managed identity for the resource, or
+// of the user assigned one with the client or object id
+func getMsiProviderForResource(resource, resourceDisplayName, clientId, objectId string) MsiProvider {
+	msiProvider := msi.NewMsiProvider(httputil.NewSecureHttpClient(httputil.DefaultRetryBehavior))
+	return func() (msi.Msi, error) {
+		var token msi.Msi
+		var err error
+		switch {
+		case clientId != "":
+			token, err = msiProvider.GetMsiUsingClientId(clientId, resource)
+		case objectId != "":
+			token, err = msiProvider.GetMsiUsingObjectId(objectId, resource)
+		default:
+			token, err = msiProvider.GetMsiForResource(resource)
+		}
+		if err != nil {
+			return token, errors.Wrapf(err, "Unable to get an %s token of the managed identity. "+
+				"Please make sure that the managed identity is enabled on the VM and has access to the %s.", resourceDisplayName, resourceDisplayName)
+		}
+		return token, nil
+	}
+}
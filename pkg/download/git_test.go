@@ -0,0 +1,96 @@
+package download
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-extension-foundation/msi"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestGitRepository creates a repository with a commit of each content of the file script.sh, tagged v<i>,
+// and returns its path and commits
+func newTestGitRepository(t *testing.T, contents ...string) (string, []string) {
+	dir := t.TempDir()
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		require.Nil(t, err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "--quiet", "--initial-branch", "main")
+	var commits []string
+	for i, content := range contents {
+		require.Nil(t, os.WriteFile(filepath.Join(dir, "script.sh"), []byte(content), 0644))
+		git("add", "script.sh")
+		git("commit", "--quiet", "-m", content)
+		git("tag", "v"+string(rune('0'+i)))
+		commits = append(commits, git("rev-parse", "HEAD"))
+	}
+	return dir, commits
+}
+
+func Test_gitRepository_Clone(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	repoDir, commits := newTestGitRepository(t, "echo first", "echo second")
+
+	for ref, expected := range map[string]string{
+		"":         "echo second",
+		"main":     "echo second",
+		"v0":       "echo first",
+		commits[0]: "echo first",
+	} {
+		dir := filepath.Join(t.TempDir(), "repository")
+		require.Nil(t, GitRepository{URL: "file://" + repoDir, Ref: ref}.Clone(ctx, dir), ref)
+		b, err := os.ReadFile(filepath.Join(dir, "script.sh"))
+		require.Nil(t, err)
+		require.Equal(t, expected, string(b), ref)
+	}
+}
+
+func Test_gitRepository_Clone_fails(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	repoDir, _ := newTestGitRepository(t, "echo first")
+
+	err := GitRepository{URL: "file://" + repoDir, Ref: "missing"}.Clone(ctx, t.TempDir())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "git fetch failed")
+
+	err = GitRepository{URL: "file://" + repoDir, MsiProvider: func() (msi.Msi, error) { return msi.Msi{}, nil }}.Clone(ctx, t.TempDir())
+	require.EqualError(t, err, "MSI token is empty")
+}
+
+func Test_gitRepository_config(t *testing.T) {
+	config, err := GitRepository{URL: "https://example.com/repo.git", PAT: "secret"}.config()
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"http.extraHeader": "Authorization: Basic OnNlY3JldA=="}, config)
+
+	config, err = GitRepository{
+		URL:         "https://dev.azure.com/org/project/_git/repo",
+		MsiProvider: func() (msi.Msi, error) { return msi.Msi{AccessToken: "token"}, nil },
+	}.config()
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"http.extraHeader": "Authorization: Bearer token"}, config)
+
+	config, err = GitRepository{URL: "https://example.com/repo.git"}.config()
+	require.Nil(t, err)
+	require.Empty(t, config)
+}
+
+func Test_readsConfigFromEnvironment(t *testing.T) {
+	for version, expected := range map[string]bool{
+		"git version 2.39.5":                 true,
+		"git version 2.31.0":                 true,
+		"git version 3.0.0":                  true,
+		"git version 2.39.3 (Apple Git-146)": true,
+		"git version 2.30.2":                 false,
+		"git version 1.8.3.1":                false,
+		"not git":                            false,
+	} {
+		require.Equal(t, expected, readsConfigFromEnvironment(version), version)
+	}
+}
@@ -0,0 +1,389 @@
+package download
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	// containerRegistryResourceName is the resource of the tokens of managed identities exchanged by Azure
+	// Container Registry for its own tokens
+	containerRegistryResourceName = "https://containerregistry.azure.net"
+
+	ociManifestMediaType        = "application/vnd.oci.image.manifest.v1+json"
+	dockerManifestMediaType     = "application/vnd.docker.distribution.manifest.v2+json"
+	ociLayerTarMediaType        = "application/vnd.oci.image.layer.v1.tar"
+	ociLayerTarGzipMediaType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+	dockerLayerTarGzipMediaType = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	ociTitleAnnotation          = "org.opencontainers.image.title"
+	orasUnpackAnnotation        = "io.deis.oras.content.unpack"
+	maxOCIManifestSize          = 4 * 1024 * 1024
+	maxOCIExtractedSizeInBytes  = 1024 * 1024 * 1024
+)
+
+// ociScheme is the scheme of the registries, replaced by tests
+var ociScheme = "https"
+
+// ociRegistryPattern matches the hosts of the registries of Azure Container Registry in the public and sovereign
+// clouds, the only ones the tokens of the managed identity are sent to. Replaced by tests.
+var ociRegistryPattern = regexp.MustCompile(`^[A-Za-z0-9]{5,50}\.azurecr\.(?:io|cn|us)$`)
+
+var (
+	ociRepositoryRegex = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	ociTagRegex        = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	ociDigestRegex     = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+// OCIReference is a reference to an artifact of an OCI registry, e.g., myregistry.azurecr.io/scripts/bundle:v1 or
+// myregistry.azurecr.io/scripts/bundle@sha256:<digest>
+type OCIReference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseOCIReference parses a reference to an artifact, which must name its registry of Azure Container Registry. The
+// tag defaults to latest.
+func ParseOCIReference(reference string) (OCIReference, error) {
+	var r OCIReference
+	rest := reference
+	if i := strings.Index(rest, "@"); i >= 0 {
+		rest, r.Digest = rest[:i], rest[i+1:]
+		if !ociDigestRegex.MatchString(r.Digest) {
+			return r, errors.Errorf("'%s' has an invalid digest, it must be sha256:<hex>", reference)
+		}
+	}
+	i := strings.Index(rest, "/")
+	if i <= 0 || (!strings.ContainsAny(rest[:i], ".:") && rest[:i] != "localhost") {
+		return r, errors.Errorf("'%s' must start with the host name of its registry", reference)
+	}
+	r.Registry, rest = rest[:i], rest[i+1:]
+	if !ociRegistryPattern.MatchString(r.Registry) {
+		return r, errors.Errorf("'%s' is not the host of an Azure Container Registry, such as myregistry.azurecr.io", r.Registry)
+	}
+	if j := strings.LastIndex(rest, ":"); j >= 0 {
+		rest, r.Tag = rest[:j], rest[j+1:]
+		if !ociTagRegex.MatchString(r.Tag) {
+			return r, errors.Errorf("'%s' has an invalid tag", reference)
+		}
+	}
+	if !ociRepositoryRegex.MatchString(rest) {
+		return r, errors.Errorf("'%s' has an invalid repository", reference)
+	}
+	r.Repository = rest
+	if r.Tag == "" && r.Digest == "" {
+		r.Tag = "latest"
+	}
+	return r, nil
+}
+
+// String returns the reference
+func (r OCIReference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// OCIDescriptor describes a manifest or layer of an artifact
+type OCIDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// ociManifest is the manifest of an artifact
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Layers    []OCIDescriptor `json:"layers"`
+}
+
+// OCIDownload downloads the single layer of an artifact of Azure Container Registry, authenticated with the token of
+// a managed identity. The manifest is resolved by every request, so a retry follows a tag moved meanwhile.
+type OCIDownload struct {
+	reference   OCIReference
+	msiProvider MsiProvider
+	proxy       *url.URL
+	layer       OCIDescriptor
+}
+
+// NewOCIDownload returns the download of the artifact through proxy, nil to use the proxy of the environment
+func NewOCIDownload(reference OCIReference, msiProvider MsiProvider, proxy *url.URL) *OCIDownload {
+	return &OCIDownload{reference: reference, msiProvider: msiProvider, proxy: proxy}
+}
+
+// Layer returns the layer of the last request
+func (o *OCIDownload) Layer() OCIDescriptor {
+	return o.layer
+}
+
+// GetRequest resolves the manifest of the artifact and returns a new request for its layer
+func (o *OCIDownload) GetRequest() (*http.Request, error) {
+	ctx := WithProxy(context.Background(), o.proxy)
+	token, err := o.registryToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := o.resolveManifest(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if len(manifest.Layers) != 1 {
+		return nil, errors.Errorf("the artifact '%s' must have a single layer, it has %d", o.reference, len(manifest.Layers))
+	}
+	layer := manifest.Layers[0]
+	if !ociDigestRegex.MatchString(layer.Digest) {
+		return nil, errors.Errorf("the layer of the artifact '%s' has an unsupported digest '%s'", o.reference, layer.Digest)
+	}
+	o.layer = layer
+
+	req, err := o.newRequest(ctx, http.MethodGet, "/v2/"+o.reference.Repository+"/blobs/"+layer.Digest, token)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(xMsClientRequestIdHeaderName, uuid.New().String())
+	return req, nil
+}
+
+// registryToken exchanges the token of the managed identity for a token of the registry pulling the repository
+func (o *OCIDownload) registryToken(ctx context.Context) (string, error) {
+	msi, err := o.msiProvider()
+	if err != nil {
+		return "", err
+	}
+	if msi.AccessToken == "" {
+		return "", errors.New("MSI token is empty")
+	}
+
+	var exchanged struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := o.postForm(ctx, "/oauth2/exchange", url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {o.reference.Registry},
+		"access_token": {msi.AccessToken},
+	}, &exchanged); err != nil {
+		return "", errors.Wrap(err, "failed to exchange the managed identity token for a registry token")
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := o.postForm(ctx, "/oauth2/token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"service":       {o.reference.Registry},
+		"scope":         {"repository:" + o.reference.Repository + ":pull"},
+		"refresh_token": {exchanged.RefreshToken},
+	}, &token); err != nil {
+		return "", errors.Wrap(err, "failed to get a registry token pulling the repository")
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("registry token is empty")
+	}
+	return token.AccessToken, nil
+}
+
+// resolveManifest returns the manifest of the artifact, verified against its digest if referenced by digest
+func (o *OCIDownload) resolveManifest(ctx context.Context, token string) (ociManifest, error) {
+	var manifest ociManifest
+	ref := o.reference.Digest
+	if ref == "" {
+		ref = o.reference.Tag
+	}
+	req, err := o.newRequest(ctx, http.MethodGet, "/v2/"+o.reference.Repository+"/manifests/"+ref, token)
+	if err != nil {
+		return manifest, err
+	}
+	req.Header.Set("Accept", ociManifestMediaType+", "+dockerManifestMediaType)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return manifest, errors.Wrap(err, "failed to get the manifest of the artifact")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return manifest, errors.Errorf("failed to get the manifest of the artifact '%s': %s", o.reference, resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxOCIManifestSize))
+	if err != nil {
+		return manifest, errors.Wrap(err, "failed to read the manifest of the artifact")
+	}
+	if o.reference.Digest != "" {
+		sum := sha256.Sum256(b)
+		if digest := "sha256:" + hex.EncodeToString(sum[:]); digest != o.reference.Digest {
+			return manifest, errors.Errorf("the manifest of the artifact '%s' has the digest %s", o.reference, digest)
+		}
+	}
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return manifest, errors.Wrap(err, "failed to parse the manifest of the artifact")
+	}
+	return manifest, nil
+}
+
+// postForm posts the form to the registry and decodes its JSON response into v
+func (o *OCIDownload) postForm(ctx context.Context, path string, form url.Values, v interface{}) error {
+	req, err := o.newRequest(ctx, http.MethodPost, path, "")
+	if err != nil {
+		return err
+	}
+	req.Body = io.NopCloser(strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("the registry returned %s", resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxOCIManifestSize)).Decode(v)
+}
+
+// newRequest returns a new request to the registry, authenticated with token unless empty
+func (o *OCIDownload) newRequest(ctx context.Context, method, path, token string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, ociScheme+"://"+o.reference.Registry+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+// PullOCIArtifact downloads the layer of the artifact with retries into dir, created if missing, once its digest
+// is verified. A layer packed by oras from a directory, or a tar layer without a title, is extracted. A layer with a
+// title is saved as the file of that name. The layer is read at most at maxKbps kilobits per second unless it is zero.
+func PullOCIArtifact(ctx *log.Context, o *OCIDownload, dir string, maxKbps int) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "failed to create the directory of the artifact")
+	}
+	body, err := WithRetries(ctx, []Downloader{Throttled(o, maxKbps)}, ActualSleep)
+	if err != nil {
+		return errors.Wrapf(err, "failed to download the artifact '%s'", o.reference)
+	}
+	defer body.Close()
+	layer := o.Layer()
+
+	f, err := os.CreateTemp(dir, ".layer")
+	if err != nil {
+		return errors.Wrap(err, "failed to create the file of the layer")
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hash), io.LimitReader(body, layer.Size+1))
+	if err != nil {
+		return errors.Wrap(err, "failed to download the layer of the artifact")
+	}
+	if digest := "sha256:" + hex.EncodeToString(hash.Sum(nil)); n != layer.Size || digest != layer.Digest {
+		return errors.Errorf("the layer of the artifact '%s' doesn't match its digest %s", o.reference, layer.Digest)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "failed to read the layer of the artifact")
+	}
+
+	title := layer.Annotations[ociTitleAnnotation]
+	if title != "" && layer.Annotations[orasUnpackAnnotation] != "true" {
+		if title != filepath.Base(title) || title == "." || title == ".." {
+			return errors.Errorf("the layer of the artifact has an invalid title '%s'", title)
+		}
+		if err := os.Rename(f.Name(), filepath.Join(dir, title)); err != nil {
+			return errors.Wrap(err, "failed to save the layer of the artifact")
+		}
+		return nil
+	}
+
+	var r io.Reader = f
+	switch layer.MediaType {
+	case ociLayerTarGzipMediaType, dockerLayerTarGzipMediaType:
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return errors.Wrap(err, "failed to decompress the layer of the artifact")
+		}
+		defer gz.Close()
+		r = gz
+	case ociLayerTarMediaType:
+	default:
+		return errors.Errorf("the layer of the artifact has the unsupported media type '%s'", layer.MediaType)
+	}
+	return extractTar(r, dir)
+}
+
+// extractTar extracts the directories and regular files of the archive into dir. The other entries (e.g., links)
+// are rejected, as are the paths out of dir.
+func extractTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	var extracted int64
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read the archive of the artifact")
+		}
+		name := filepath.Clean(header.Name)
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return errors.Errorf("the archive of the artifact has the path '%s' out of its directory", header.Name)
+		}
+		path := filepath.Join(dir, name)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return errors.Wrapf(err, "failed to extract '%s'", header.Name)
+			}
+		case tar.TypeReg:
+			extracted += header.Size
+			if extracted > maxOCIExtractedSizeInBytes {
+				return errors.Errorf("the archive of the artifact is larger than %d bytes", maxOCIExtractedSizeInBytes)
+			}
+			if err := extractFile(tr, path, os.FileMode(header.Mode).Perm()&0755); err != nil {
+				return errors.Wrapf(err, "failed to extract '%s'", header.Name)
+			}
+		default:
+			return errors.Errorf("the archive of the artifact has '%s', which is neither a file nor a directory", header.Name)
+		}
+	}
+}
+
+func extractFile(r io.Reader, path string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// GetContainerRegistryMsiProvider returns the provider of the Azure Container Registry tokens of the system managed
+// identity, or of the user assigned one with the client or object id
+func GetContainerRegistryMsiProvider(clientId, objectId string) MsiProvider {
+	return getMsiProviderForResource(containerRegistryResourceName, "Azure Container Registry", clientId, objectId)
+}
@@ -0,0 +1,172 @@
+package download
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-extension-foundation/msi"
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseOCIReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	for reference, expected := range map[string]OCIReference{
+		"myacr.azurecr.io/scripts/bundle:v1":             {Registry: "myacr.azurecr.io", Repository: "scripts/bundle", Tag: "v1"},
+		"myacr.azurecr.io/bundle":                        {Registry: "myacr.azurecr.io", Repository: "bundle", Tag: "latest"},
+		"myacr.azurecr.io/bundle@" + digest:              {Registry: "myacr.azurecr.io", Repository: "bundle", Digest: digest},
+		"myacr.azurecr.cn/scripts/bundle:v1.2@" + digest: {Registry: "myacr.azurecr.cn", Repository: "scripts/bundle", Tag: "v1.2", Digest: digest},
+	} {
+		r, err := ParseOCIReference(reference)
+		require.Nil(t, err, reference)
+		require.Equal(t, expected, r, reference)
+	}
+	r, err := ParseOCIReference("myacr.azurecr.io/bundle")
+	require.Nil(t, err)
+	require.Equal(t, "myacr.azurecr.io/bundle:latest", r.String())
+
+	for _, reference := range []string{"bundle:v1", "scripts/bundle:v1", "myacr.azurecr.io/Bundle", "myacr.azurecr.io/bundle:-v1", "myacr.azurecr.io/bundle@sha256:abc", "myacr.azurecr.io/",
+		"localhost:5000/bundle:v1", "registry.example.com/bundle:v1", "myacr.azurecr.io.example.com/bundle:v1", "myacr.azurecr.io:443/bundle:v1"} {
+		_, err := ParseOCIReference(reference)
+		require.Error(t, err, reference)
+	}
+}
+
+// fakeRegistry serves the artifact scripts/bundle:v1 with the layer, issuing the tokens of the OAuth2 exchange
+type fakeRegistry struct {
+	layer       []byte
+	descriptor  OCIDescriptor
+	manifest    []byte
+	accessToken string
+}
+
+func newFakeRegistry(t *testing.T, layer []byte, mediaType string, annotations map[string]string) (*fakeRegistry, *httptest.Server) {
+	sum := sha256.Sum256(layer)
+	r := &fakeRegistry{layer: layer, accessToken: "registry-token"}
+	r.descriptor = OCIDescriptor{MediaType: mediaType, Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(layer)), Annotations: annotations}
+	var err error
+	r.manifest, err = json.Marshal(ociManifest{MediaType: ociManifestMediaType, Layers: []OCIDescriptor{r.descriptor}})
+	require.Nil(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/oauth2/exchange":
+			require.Nil(t, req.ParseForm())
+			require.Equal(t, "msi-token", req.Form.Get("access_token"))
+			json.NewEncoder(w).Encode(map[string]string{"refresh_token": "refresh-token"})
+			return
+		case "/oauth2/token":
+			require.Nil(t, req.ParseForm())
+			require.Equal(t, "refresh-token", req.Form.Get("refresh_token"))
+			require.Equal(t, "repository:scripts/bundle:pull", req.Form.Get("scope"))
+			json.NewEncoder(w).Encode(map[string]string{"access_token": r.accessToken})
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer registry-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch req.URL.Path {
+		case "/v2/scripts/bundle/manifests/v1":
+			w.Write(r.manifest)
+		case "/v2/scripts/bundle/blobs/" + r.descriptor.Digest:
+			w.Write(r.layer)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	scheme, pattern, sleep := ociScheme, ociRegistryPattern, ActualSleep
+	ociScheme, ociRegistryPattern, ActualSleep = "http", regexp.MustCompile(`^127\.0\.0\.1:\d+$`), func(time.Duration) {}
+	t.Cleanup(func() { ociScheme, ociRegistryPattern, ActualSleep = scheme, pattern, sleep })
+	return r, srv
+}
+
+func newTestOCIDownload(t *testing.T, srv *httptest.Server) *OCIDownload {
+	reference, err := ParseOCIReference(strings.TrimPrefix(srv.URL, "http://") + "/scripts/bundle:v1")
+	require.Nil(t, err)
+	return NewOCIDownload(reference, func() (msi.Msi, error) { return msi.Msi{AccessToken: "msi-token"}, nil }, nil)
+}
+
+func tarGzip(t *testing.T, entries map[string]string) []byte {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gz)
+	for name, content := range entries {
+		if strings.HasSuffix(name, "/") {
+			require.Nil(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755}))
+			continue
+		}
+		require.Nil(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}))
+		_, err := tw.Write([]byte(content))
+		require.Nil(t, err)
+	}
+	require.Nil(t, tw.Close())
+	require.Nil(t, gz.Close())
+	return b.Bytes()
+}
+
+func Test_PullOCIArtifact_archive(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	layer := tarGzip(t, map[string]string{"deploy/": "", "deploy/run.sh": "echo run", "lib.sh": "echo lib"})
+	_, srv := newFakeRegistry(t, layer, ociLayerTarGzipMediaType, nil)
+
+	dir := filepath.Join(t.TempDir(), "bundle")
+	require.Nil(t, PullOCIArtifact(ctx, newTestOCIDownload(t, srv), dir, 0))
+	b, err := os.ReadFile(filepath.Join(dir, "deploy", "run.sh"))
+	require.Nil(t, err)
+	require.Equal(t, "echo run", string(b))
+	entries, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	require.Len(t, entries, 2)
+}
+
+func Test_PullOCIArtifact_file(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+	_, srv := newFakeRegistry(t, []byte("echo run"), ociLayerTarMediaType, map[string]string{ociTitleAnnotation: "run.sh"})
+
+	dir := t.TempDir()
+	require.Nil(t, PullOCIArtifact(ctx, newTestOCIDownload(t, srv), dir, 0))
+	b, err := os.ReadFile(filepath.Join(dir, "run.sh"))
+	require.Nil(t, err)
+	require.Equal(t, "echo run", string(b))
+}
+
+func Test_PullOCIArtifact_fails(t *testing.T) {
+	ctx := log.NewContext(log.NewNopLogger())
+
+	// The layer doesn't match its digest
+	r, srv := newFakeRegistry(t, []byte("echo run"), ociLayerTarMediaType, map[string]string{ociTitleAnnotation: "run.sh"})
+	r.layer = []byte("echo bad")
+	err := PullOCIArtifact(ctx, newTestOCIDownload(t, srv), t.TempDir(), 0)
+	require.ErrorContains(t, err, "doesn't match its digest")
+
+	// The archive leads out of the directory
+	_, srv = newFakeRegistry(t, tarGzip(t, map[string]string{"../evil.sh": "echo evil"}), ociLayerTarGzipMediaType, nil)
+	err = PullOCIArtifact(ctx, newTestOCIDownload(t, srv), t.TempDir(), 0)
+	require.ErrorContains(t, err, "out of its directory")
+
+	// The title leads out of the directory
+	_, srv = newFakeRegistry(t, []byte("echo run"), ociLayerTarMediaType, map[string]string{ociTitleAnnotation: "../run.sh"})
+	err = PullOCIArtifact(ctx, newTestOCIDownload(t, srv), t.TempDir(), 0)
+	require.ErrorContains(t, err, "invalid title")
+
+	// The registry denies the token
+	r, srv = newFakeRegistry(t, []byte("echo run"), ociLayerTarMediaType, nil)
+	r.accessToken = "other-token"
+	err = PullOCIArtifact(ctx, newTestOCIDownload(t, srv), t.TempDir(), 0)
+	require.ErrorContains(t, err, "401 Unauthorized")
+}
@@ -0,0 +1,112 @@
+package download
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// directHosts are always reached without a proxy: IMDS (which issues the managed identity tokens) and the wire
+// server are local to the host, and a proxy can't reach them
+var directHosts = map[string]bool{
+	"169.254.169.254": true,
+	"168.63.129.16":   true,
+}
+
+// proxyContextKey is the key of the proxy of the requests in their context
+type proxyContextKey struct{}
+
+// WithProxy returns a copy of ctx whose requests go through proxy instead of the proxy of HTTP_PROXY and HTTPS_PROXY.
+// The hosts of NO_PROXY are still reached directly. A nil proxy keeps the environment configuration.
+func WithProxy(ctx context.Context, proxy *url.URL) context.Context {
+	if proxy == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, proxyContextKey{}, proxy)
+}
+
+// ProxyFromContext returns the proxy set with WithProxy, nil if none
+func ProxyFromContext(ctx context.Context) *url.URL {
+	proxy, _ := ctx.Value(proxyContextKey{}).(*url.URL)
+	return proxy
+}
+
+// Proxy returns the proxy of a request: the proxy of its context if any, else the proxy of HTTP_PROXY and
+// HTTPS_PROXY. Either way, the hosts of NO_PROXY are reached directly, as are IMDS and the wire server.
+func Proxy(req *http.Request) (*url.URL, error) {
+	if directHosts[req.URL.Hostname()] {
+		return nil, nil
+	}
+	if proxy := ProxyFromContext(req.Context()); proxy != nil {
+		// The environment is read on every request like the proxy of the context, rather than once like
+		// http.ProxyFromEnvironment
+		config := httpproxy.FromEnvironment()
+		config.HTTPProxy, config.HTTPSProxy = proxy.String(), proxy.String()
+		return config.ProxyFunc()(req.URL)
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// proxiedDownloader sends the requests of a downloader through a proxy
+type proxiedDownloader struct {
+	downloader Downloader
+	proxy      *url.URL
+}
+
+// ThroughProxy returns a downloader sending the requests of downloader through proxy. A nil proxy keeps the
+// environment configuration.
+func ThroughProxy(downloader Downloader, proxy *url.URL) Downloader {
+	if proxy == nil {
+		return downloader
+	}
+	return proxiedDownloader{downloader: downloader, proxy: proxy}
+}
+
+func (d proxiedDownloader) GetRequest() (*http.Request, error) {
+	req, err := d.downloader.GetRequest()
+	if err != nil {
+		return nil, err
+	}
+	return req.WithContext(WithProxy(req.Context(), d.proxy)), nil
+}
+
+// newTransport returns a transport sending the requests through the proxy returned by proxy
+func newTransport(proxy func(*http.Request) (*url.URL, error)) *http.Transport {
+	return &http.Transport{
+		Dial: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		Proxy:                 proxy,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 20 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// NewTransport returns a transport sending the requests through the proxy of their context, set with WithProxy
+func NewTransport() http.RoundTripper {
+	return newTransport(Proxy)
+}
+
+// azureTransport is shared by the Azure SDK clients, so they share their connections
+var azureTransport = &http.Client{Transport: newTransport(Proxy)}
+
+// NewAzureTransport returns the transport of the Azure SDK clients (e.g., blob clients and managed identity
+// credentials). Their requests go through the proxy of the context of their calls, set with WithProxy.
+func NewAzureTransport() policy.Transporter {
+	return azureTransport
+}
+
+// newStorageHTTPClient returns the HTTP client of the legacy storage client, which doesn't pass contexts to its
+// requests, sending them through proxy
+func newStorageHTTPClient(proxy *url.URL) *http.Client {
+	return &http.Client{Transport: newTransport(func(req *http.Request) (*url.URL, error) {
+		return Proxy(req.WithContext(WithProxy(req.Context(), proxy)))
+	})}
+}
@@ -0,0 +1,93 @@
+package download
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Proxy(t *testing.T) {
+	proxy, err := url.Parse("http://proxy.contoso.com:3128")
+	require.Nil(t, err)
+	ctx := WithProxy(context.Background(), proxy)
+	require.Equal(t, proxy, ProxyFromContext(ctx))
+	require.Nil(t, ProxyFromContext(context.Background()))
+	require.Equal(t, context.Background(), WithProxy(context.Background(), nil))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://account.blob.core.windows.net/c/script.sh", nil)
+	require.Nil(t, err)
+	got, err := Proxy(req)
+	require.Nil(t, err)
+	require.Equal(t, proxy, got)
+
+	// IMDS is reached directly
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, "http://169.254.169.254/metadata/identity/oauth2/token", nil)
+	require.Nil(t, err)
+	got, err = Proxy(req)
+	require.Nil(t, err)
+	require.Nil(t, got)
+}
+
+func Test_Proxy_noProxy(t *testing.T) {
+	t.Setenv("NO_PROXY", ".internal.contoso.com,10.0.0.0/8")
+	proxy, err := url.Parse("http://proxy.contoso.com:3128")
+	require.Nil(t, err)
+	ctx := WithProxy(context.Background(), proxy)
+
+	// The hosts of NO_PROXY are reached directly, whether the proxy is that of the context or the environment
+	for _, direct := range []string{"https://repo.internal.contoso.com/script.sh", "http://10.1.2.3/script.sh"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, direct, nil)
+		require.Nil(t, err)
+		got, err := Proxy(req)
+		require.Nil(t, err)
+		require.Nil(t, got, direct)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://account.blob.core.windows.net/c/script.sh", nil)
+	require.Nil(t, err)
+	got, err := Proxy(req)
+	require.Nil(t, err)
+	require.Equal(t, proxy, got)
+}
+
+// proxyServer answers the requests it is sent as a proxy with the URL they were sent to
+func proxyServer(t *testing.T) (*httptest.Server, *url.URL) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("proxied " + r.URL.String()))
+	}))
+	u, err := url.Parse(server.URL)
+	require.Nil(t, err)
+	return server, u
+}
+
+func Test_ThroughProxy(t *testing.T) {
+	server, proxy := proxyServer(t)
+	defer server.Close()
+
+	require.Equal(t, NewURLDownload("http://contoso.invalid/script.sh"), ThroughProxy(NewURLDownload("http://contoso.invalid/script.sh"), nil))
+
+	status, body, err := Download(testctx, ThroughProxy(NewURLDownload("http://contoso.invalid/script.sh"), proxy))
+	require.Nil(t, err)
+	defer body.Close()
+	require.Equal(t, http.StatusOK, status)
+	b, err := io.ReadAll(body)
+	require.Nil(t, err)
+	require.Equal(t, "proxied http://contoso.invalid/script.sh", string(b))
+}
+
+func Test_newStorageHTTPClient(t *testing.T) {
+	server, proxy := proxyServer(t)
+	defer server.Close()
+
+	resp, err := newStorageHTTPClient(proxy).Get("http://account.blob.core.windows.net/c/output.txt")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "proxied http://account.blob.core.windows.net/c/output.txt", string(b))
+}
@@ -0,0 +1,179 @@
+package download
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// errChanged is the failure to resume a download as the resource changed since it started
+var errChanged = errors.New("the file changed on the server")
+
+// resumableBody is the body of a download, resumed with a range request where it stopped when reading it fails.
+// The range requests are conditional on the validator of the first response, so the download fails rather than
+// mixing two versions of a resource changed meanwhile.
+type resumableBody struct {
+	ctx        *log.Context
+	downloader Downloader
+	sleep      SleepFunc
+	body       io.ReadCloser
+	err        error
+
+	// read is the number of bytes of the resource read so far
+	read int64
+	// size is the size of the resource, -1 if unknown
+	size int64
+	// validator is the strong ETag or the last modification date of the resource, empty if the download can't be
+	// resumed
+	validator string
+	// etag is the strong ETag of the resource if the download can be resumed, empty otherwise
+	etag string
+	// md5 is the MD5 of the resource reported by the server, nil if unknown
+	md5 []byte
+	// attempts is the number of resumptions since the last byte read
+	attempts int
+}
+
+func newResumableBody(ctx *log.Context, downloader Downloader, response *http.Response, sleep SleepFunc) *resumableBody {
+	b := &resumableBody{
+		ctx:        ctx,
+		downloader: downloader,
+		sleep:      sleep,
+		body:       response.Body,
+		size:       response.ContentLength,
+		md5:        contentMD5(response),
+	}
+	// A partial response is the rest of a resource a previous attempt started downloading
+	if response.StatusCode == http.StatusPartialContent {
+		b.read, b.size = contentRangeStart(response), contentRangeSize(response)
+	}
+	if response.StatusCode == http.StatusPartialContent || response.Header.Get("Accept-Ranges") == "bytes" {
+		if etag := response.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			b.validator, b.etag = etag, etag
+		} else {
+			b.validator = response.Header.Get("Last-Modified")
+		}
+	}
+	return b
+}
+
+// interrupted returns whether reading the body failed before its end while the resource was unchanged, and its
+// download can be resumed from its ETag
+func (b *resumableBody) interrupted() bool {
+	return b.etag != "" && b.err != nil && errors.Cause(b.err) != errChanged
+}
+
+func (b *resumableBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.body.Read(p)
+	b.read += int64(n)
+	if n > 0 {
+		b.attempts = 0
+	}
+	if err == io.EOF && b.size >= 0 && b.read < b.size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+
+	if b.err = b.resume(err); b.err != nil {
+		return n, b.err
+	}
+	if n == 0 {
+		return b.Read(p)
+	}
+	return n, nil
+}
+
+func (b *resumableBody) Close() error {
+	return b.body.Close()
+}
+
+// resume replaces the failed body with the rest of the resource, retrying the transient failures
+func (b *resumableBody) resume(cause error) error {
+	b.body.Close()
+	if b.validator == "" {
+		return cause
+	}
+	for b.attempts < expRetryN {
+		slp := retryBackoff(b.attempts)
+		b.attempts++
+		b.ctx.Log("message", "resuming the download", "offset", b.read, "error", cause, "sleep", slp)
+		b.sleep(slp)
+
+		header := http.Header{
+			"Range":    {fmt.Sprintf("bytes=%d-", b.read)},
+			"If-Range": {b.validator},
+		}
+		status, response, err := get(b.ctx, b.downloader, header)
+		if err != nil {
+			if status != -1 && !isTransientHttpStatusCode(status) {
+				return errors.Wrapf(err, "failed to resume the download at byte %d", b.read)
+			}
+			cause = err
+			continue
+		}
+		// The server sends the whole resource instead of the range if it changed
+		if status != http.StatusPartialContent || contentRangeStart(response) != b.read {
+			response.Body.Close()
+			return errors.Wrapf(errChanged, "failed to resume the download at byte %d", b.read)
+		}
+		b.body = response.Body
+		return nil
+	}
+	return errors.Wrapf(cause, "failed to resume the download at byte %d", b.read)
+}
+
+// contentRangeStart returns the offset of the first byte of a partial response, -1 if it is invalid
+func contentRangeStart(response *http.Response) int64 {
+	contentRange := strings.TrimPrefix(response.Header.Get("Content-Range"), "bytes ")
+	i := strings.Index(contentRange, "-")
+	if i < 0 {
+		return -1
+	}
+	start, err := strconv.ParseInt(contentRange[:i], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return start
+}
+
+// contentRangeSize returns the size of the resource of a partial response, -1 if it is unknown
+func contentRangeSize(response *http.Response) int64 {
+	contentRange := response.Header.Get("Content-Range")
+	i := strings.LastIndex(contentRange, "/")
+	if i < 0 {
+		return -1
+	}
+	size, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// contentMD5 returns the MD5 of the resource reported by the response, the one of the blob for Azure storage
+func contentMD5(response *http.Response) []byte {
+	value := response.Header.Get(xMsBlobContentMd5HeaderName)
+	// The Content-MD5 of a partial response is the one of its range
+	if value == "" && response.StatusCode != http.StatusPartialContent {
+		value = response.Header.Get("Content-MD5")
+	}
+	if value == "" {
+		return nil
+	}
+	md5, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(md5) != 16 {
+		return nil
+	}
+	return md5
+}
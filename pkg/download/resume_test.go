@@ -0,0 +1,171 @@
+package download
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyServer serves the content, cutting the connection of the first request once it has sent half of it
+type flakyServer struct {
+	content []byte
+	etags   []string
+	md5     string
+	ranges  bool
+	ranged  []string
+	// unavailable fails the range requests
+	unavailable bool
+}
+
+func (s *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	etag := s.etags[0]
+	if len(s.etags) > 1 {
+		s.etags = s.etags[1:]
+	}
+	if r.Header.Get("Range") != "" {
+		s.ranged = append(s.ranged, r.Header.Get("Range"))
+		if s.unavailable {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Header().Set("ETag", etag)
+	if s.md5 != "" {
+		w.Header().Set("Content-MD5", s.md5)
+	}
+	if s.ranges && r.Header.Get("Range") != "" {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(s.content))
+		return
+	}
+	if s.ranges {
+		w.Header().Set("Accept-Ranges", "bytes")
+	}
+	w.Header().Set("Content-Length", "1048576")
+	w.WriteHeader(http.StatusOK)
+	w.Write(s.content[:len(s.content)/2])
+	w.(http.Flusher).Flush()
+	panic(http.ErrAbortHandler)
+}
+
+func newFlakyServer(t *testing.T) (*flakyServer, string) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1024*1024/16)
+	sum := md5.Sum(content)
+	s := &flakyServer{content: content, etags: []string{`"v1"`}, md5: base64.StdEncoding.EncodeToString(sum[:]), ranges: true}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	sleep := ActualSleep
+	ActualSleep = func(time.Duration) {}
+	t.Cleanup(func() { ActualSleep = sleep })
+	return s, srv.URL
+}
+
+func TestSaveTo_resumesInterruptedDownload(t *testing.T) {
+	s, url := newFlakyServer(t)
+	dst := filepath.Join(t.TempDir(), "artifact")
+
+	n, err := SaveTo(log.NewContext(log.NewNopLogger()), []Downloader{NewURLDownload(url)}, dst, 0600)
+	require.Nil(t, err)
+	require.EqualValues(t, len(s.content), n)
+	require.Equal(t, []string{"bytes=524288-"}, s.ranged)
+
+	b, err := os.ReadFile(dst)
+	require.Nil(t, err)
+	require.Equal(t, s.content, b)
+	require.NoFileExists(t, dst+partFileSuffix)
+}
+
+func TestSaveTo_failsWhenTheFileChanges(t *testing.T) {
+	s, url := newFlakyServer(t)
+	s.etags = []string{`"v1"`, `"v2"`}
+	dst := filepath.Join(t.TempDir(), "artifact")
+
+	_, err := SaveTo(log.NewContext(log.NewNopLogger()), []Downloader{NewURLDownload(url)}, dst, 0600)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "the file changed on the server")
+	require.NoFileExists(t, dst)
+	require.NoFileExists(t, dst+partFileSuffix)
+}
+
+func TestSaveTo_failsWithoutRanges(t *testing.T) {
+	s, url := newFlakyServer(t)
+	s.ranges = false
+	dst := filepath.Join(t.TempDir(), "artifact")
+
+	_, err := SaveTo(log.NewContext(log.NewNopLogger()), []Downloader{NewURLDownload(url)}, dst, 0600)
+	require.NotNil(t, err)
+	require.Empty(t, s.ranged)
+	require.NoFileExists(t, dst)
+	require.NoFileExists(t, dst+partFileSuffix)
+}
+
+func TestSaveTo_warnsOnMD5Mismatch(t *testing.T) {
+	s, url := newFlakyServer(t)
+	s.md5 = base64.StdEncoding.EncodeToString(make([]byte, 16))
+	dst := filepath.Join(t.TempDir(), "artifact")
+
+	var logs bytes.Buffer
+	_, err := SaveTo(log.NewContext(log.NewLogfmtLogger(&logs)), []Downloader{NewURLDownload(url)}, dst, 0600)
+	require.Nil(t, err)
+	require.FileExists(t, dst)
+	require.Contains(t, logs.String(), "doesn't match the one reported by the server")
+}
+
+func TestSaveTo_resumesPreviousAttempt(t *testing.T) {
+	s, url := newFlakyServer(t)
+	s.unavailable = true
+	dst := filepath.Join(t.TempDir(), "artifact")
+
+	_, err := SaveTo(log.NewContext(log.NewNopLogger()), []Downloader{NewURLDownload(url)}, dst, 0600)
+	require.NotNil(t, err)
+	require.NoFileExists(t, dst)
+	part, err := os.ReadFile(dst + partFileSuffix)
+	require.Nil(t, err)
+	require.Equal(t, s.content[:len(s.content)/2], part, "the partial download is kept")
+
+	// The next attempt downloads the rest of the file only
+	s.unavailable, s.ranged = false, nil
+	var logs bytes.Buffer
+	n, err := SaveTo(log.NewContext(log.NewLogfmtLogger(&logs)), []Downloader{NewURLDownload(url)}, dst, 0600)
+	require.Nil(t, err)
+	require.EqualValues(t, len(s.content), n)
+	require.Equal(t, []string{"bytes=524288-"}, s.ranged)
+	require.NotContains(t, logs.String(), "doesn't match", "the MD5 is of the whole file")
+
+	b, err := os.ReadFile(dst)
+	require.Nil(t, err)
+	require.Equal(t, s.content, b)
+	require.NoFileExists(t, dst+partFileSuffix)
+	require.NoFileExists(t, dst+partETagFileSuffix)
+}
+
+func TestSaveTo_restartsWhenTheFileChangedSincePreviousAttempt(t *testing.T) {
+	s, url := newFlakyServer(t)
+	s.unavailable = true
+	dst := filepath.Join(t.TempDir(), "artifact")
+
+	_, err := SaveTo(log.NewContext(log.NewNopLogger()), []Downloader{NewURLDownload(url)}, dst, 0600)
+	require.NotNil(t, err)
+	require.FileExists(t, dst+partFileSuffix)
+
+	// The ETag doesn't match anymore, the file is downloaded again
+	s.unavailable, s.ranged, s.etags = false, nil, []string{`"v2"`}
+	n, err := SaveTo(log.NewContext(log.NewNopLogger()), []Downloader{NewURLDownload(url)}, dst, 0600)
+	require.Nil(t, err)
+	require.EqualValues(t, len(s.content), n)
+	require.Equal(t, []string{"bytes=524288-", "bytes=524288-"}, s.ranged)
+
+	b, err := os.ReadFile(dst)
+	require.Nil(t, err)
+	require.Equal(t, s.content, b)
+	require.NoFileExists(t, dst+partFileSuffix)
+}
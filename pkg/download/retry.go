@@ -31,15 +31,22 @@ const (
 // error returned from d will be retried (and retrieved response bodies will be
 // closed on failures). If the retries do not succeed, the last error is returned.
 //
-// It sleeps in exponentially increasing durations between retries.
+// It sleeps in exponentially increasing durations between retries. If reading the
+// returned body fails, the download is resumed where it stopped with a range request,
+// as long as the server supports them, so a transient failure late in the download of
+// a large file doesn't restart it.
 func WithRetries(ctx *log.Context, downloaders []Downloader, sf SleepFunc) (io.ReadCloser, error) {
+	return withRetries(ctx, downloaders, sf)
+}
+
+func withRetries(ctx *log.Context, downloaders []Downloader, sf SleepFunc) (*resumableBody, error) {
 	var downloadErrors error
 	for _, d := range downloaders {
 		for n := 0; n < expRetryN; n++ {
 			ctx := ctx.With("retry", n)
-			status, out, err := Download(ctx, d)
+			status, response, err := get(ctx, d, nil)
 			if err == nil {
-				return out, nil
+				return newResumableBody(ctx, d, response, sf), nil
 			}
 
 			if downloadErrors != nil {
@@ -50,10 +57,6 @@ func WithRetries(ctx *log.Context, downloaders []Downloader, sf SleepFunc) (io.R
 
 			ctx.Log("error", err)
 
-			if out != nil { // we are not going to read this response body
-				out.Close()
-			}
-
 			// If there is an access issue while downloading using this downloader, use next downloader
 			// For ex. User may have set up access to blob using managed identity, but not using public blob access or vice-versa.
 			if isAccessIssueHttpStatusCode(status) {
@@ -68,7 +71,7 @@ func WithRetries(ctx *log.Context, downloaders []Downloader, sf SleepFunc) (io.R
 
 			if n != expRetryN-1 {
 				// have more retries to go, sleep before retrying
-				slp := expRetryK * time.Duration(int(math.Pow(float64(expRetryM), float64(n))))
+				slp := retryBackoff(n)
 				ctx.Log("sleep", slp)
 				sf(slp)
 			}
@@ -77,6 +80,11 @@ func WithRetries(ctx *log.Context, downloaders []Downloader, sf SleepFunc) (io.R
 	return nil, downloadErrors
 }
 
+// retryBackoff returns the time to sleep before the retry following the nth attempt
+func retryBackoff(n int) time.Duration {
+	return expRetryK * time.Duration(int(math.Pow(float64(expRetryM), float64(n))))
+}
+
 func isTransientHttpStatusCode(statusCode int) bool {
 	switch statusCode {
 	case
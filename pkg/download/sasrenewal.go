@@ -0,0 +1,220 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/run-command-handler-linux/pkg/urlutil"
+	"github.com/pkg/errors"
+)
+
+// sasRenewalMargin is how long before its expiry a SAS token is renewed, so a call never starts with a token about
+// to expire
+const sasRenewalMargin = 5 * time.Minute
+
+// sasParameters are the query parameters of the SAS tokens, replaced in the requests by the renewed token
+var sasParameters = []string{
+	"sv", "ss", "srt", "sr", "sp", "st", "se", "sip", "spr", "si", "sig", "ses", "sdd",
+	"skoid", "sktid", "skt", "ske", "sks", "skv", "saoid", "suoid", "scid",
+	"rscc", "rscd", "rsce", "rscl", "rsct",
+}
+
+// SASProvider returns a SAS token (e.g., ?sv=...&sig=...) for the blob at blobURI
+type SASProvider func(blobURI string) (string, error)
+
+// sasRenewalRequest is the body of the requests to a SAS renewal endpoint
+type sasRenewalRequest struct {
+	BlobURI string `json:"blobUri"`
+}
+
+// sasRenewalResponse is the body of the responses of a SAS renewal endpoint
+type sasRenewalResponse struct {
+	SASToken string `json:"sasToken"`
+}
+
+// NewSASRenewalEndpoint returns the provider of the SAS tokens issued by the endpoint at uri. The provider POSTs
+// {"blobUri": "<uri>"} to the endpoint, authenticated by a bearer token of msiProvider, and expects
+// {"sasToken": "<token>"} back. The requests are bound by ctx and go through its proxy.
+func NewSASRenewalEndpoint(ctx context.Context, uri string, msiProvider MsiProvider) SASProvider {
+	return func(blobURI string) (string, error) {
+		msiToken, err := msiProvider()
+		if err != nil {
+			return "", err
+		}
+		if msiToken.AccessToken == "" {
+			return "", errors.New("MSI token is empty")
+		}
+		body, err := json.Marshal(sasRenewalRequest{BlobURI: blobURI})
+		if err != nil {
+			return "", err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, bytes.NewReader(body))
+		if err != nil {
+			return "", errors.Wrap(err, "failed to create the request to the SAS renewal endpoint")
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+msiToken.AccessToken)
+
+		response, err := httpClient.Do(req)
+		if err != nil {
+			return "", errors.Wrap(urlutil.RemoveUrlFromErr(err), "the SAS renewal endpoint can't be reached")
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("the SAS renewal endpoint returned a response code and message of %q", response.Status)
+		}
+		var renewal sasRenewalResponse
+		if err := json.NewDecoder(response.Body).Decode(&renewal); err != nil || renewal.SASToken == "" {
+			return "", errors.New("the SAS renewal endpoint didn't return a sasToken")
+		}
+		return renewal.SASToken, nil
+	}
+}
+
+// GetSASRenewalMsiProvider returns the provider of the tokens of the system managed identity, or of the user
+// assigned one with the client or object id, for the SAS renewal endpoint whose application ID URI is resource
+func GetSASRenewalMsiProvider(resource, clientId, objectId string) MsiProvider {
+	return getMsiProviderForResource(resource, "SAS renewal endpoint", clientId, objectId)
+}
+
+// sasToken is a SAS token and its expiry, zero if it doesn't expire
+type sasToken struct {
+	query  url.Values
+	expiry time.Time
+}
+
+// sasRenewingTransport sends the requests of a legacy storage client with the SAS token of their blob from a
+// provider instead of the token the client was created with. The tokens are renewed before they expire, and once
+// the storage rejects them, so they can be short-lived even though the client outlives them.
+type sasRenewingTransport struct {
+	base     http.RoundTripper
+	provider SASProvider
+	now      func() time.Time
+
+	mu     sync.Mutex
+	tokens map[string]sasToken // by blob uri
+}
+
+func newSASRenewingTransport(base http.RoundTripper, provider SASProvider) *sasRenewingTransport {
+	return &sasRenewingTransport{base: base, provider: provider, now: time.Now, tokens: make(map[string]sasToken)}
+}
+
+// seed makes sas the token of the blob at blobURI until it is renewed
+func (t *sasRenewingTransport) seed(blobURI, sas string) error {
+	token, err := parseSASToken(sas)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokens[blobKey(blobURI)] = token
+	return nil
+}
+
+// token returns the token of the blob at blobURI, from the provider unless a token is known and doesn't expire
+// within sasRenewalMargin. renew always gets a new token from the provider.
+func (t *sasRenewingTransport) token(blobURI string, renew bool) (sasToken, error) {
+	key := blobKey(blobURI)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if token, ok := t.tokens[key]; ok && !renew && (token.expiry.IsZero() || t.now().Add(sasRenewalMargin).Before(token.expiry)) {
+		return token, nil
+	}
+
+	sas, err := t.provider(key)
+	if err != nil {
+		return sasToken{}, errors.Wrapf(err, "failed to renew the SAS token of blob '%s'", GetUriForLogging(key))
+	}
+	token, err := parseSASToken(sas)
+	if err != nil {
+		return sasToken{}, errors.Wrapf(err, "the renewed SAS token of blob '%s' is invalid", GetUriForLogging(key))
+	}
+	t.tokens[key] = token
+	return token, nil
+}
+
+func (t *sasRenewingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.token(req.URL.String(), false)
+	if err != nil {
+		return nil, err
+	}
+	response, err := t.send(req, token)
+	if err != nil || response.StatusCode != http.StatusForbidden || (req.Body != nil && req.GetBody == nil) {
+		return response, err
+	}
+
+	// The token was revoked or expired early (e.g., clock skew): renew it and try again once
+	token, err = t.token(req.URL.String(), true)
+	if err != nil {
+		return response, nil
+	}
+	response.Body.Close()
+	return t.send(req, token)
+}
+
+// send sends a copy of req with the SAS token replaced by token
+func (t *sasRenewingTransport) send(req *http.Request, token sasToken) (*http.Response, error) {
+	clone := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		clone.Body = body
+	}
+	query := clone.URL.Query()
+	for _, name := range sasParameters {
+		query.Del(name)
+	}
+	for name, values := range token.query {
+		query[name] = values
+	}
+	clone.URL.RawQuery = query.Encode()
+	return t.base.RoundTrip(clone)
+}
+
+// blobKey returns the uri of a blob without its query
+func blobKey(blobURI string) string {
+	u, err := url.Parse(blobURI)
+	if err != nil {
+		return blobURI
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String()
+}
+
+// SASExpiry returns the expiry (se) of a SAS token, if it declares one
+func SASExpiry(sas string) (time.Time, bool) {
+	token, err := parseSASToken(sas)
+	if err != nil || token.expiry.IsZero() {
+		return time.Time{}, false
+	}
+	return token.expiry, true
+}
+
+// parseSASToken parses a SAS token, with or without its leading ?, and its expiry (se)
+func parseSASToken(sas string) (sasToken, error) {
+	query, err := url.ParseQuery(strings.TrimPrefix(sas, "?"))
+	if err != nil {
+		return sasToken{}, err
+	}
+	if query.Get("sig") == "" {
+		return sasToken{}, errors.New("the SAS token has no signature")
+	}
+	token := sasToken{query: query}
+	if se := query.Get("se"); se != "" {
+		for _, layout := range []string{time.RFC3339, "2006-01-02T15:04Z", "2006-01-02"} {
+			if expiry, err := time.Parse(layout, se); err == nil {
+				token.expiry = expiry
+				break
+			}
+		}
+	}
+	return token, nil
+}
@@ -0,0 +1,200 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-extension-foundation/msi"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingTransport answers 201 to the requests, or 403 to those signed with a revoked signature, and records them
+type recordingTransport struct {
+	revoked  string
+	requests []*url.URL
+	bodies   []string
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := ""
+	if req.Body != nil {
+		b, _ := io.ReadAll(req.Body)
+		body = string(b)
+	}
+	t.requests = append(t.requests, req.URL)
+	t.bodies = append(t.bodies, body)
+	status := http.StatusCreated
+	if req.URL.Query().Get("sig") == t.revoked {
+		status = http.StatusForbidden
+	}
+	return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+// countingProvider issues the tokens sig=1, sig=2... expiring after validity
+type countingProvider struct {
+	now      time.Time
+	validity time.Duration
+	uris     []string
+}
+
+func (p *countingProvider) provide(blobURI string) (string, error) {
+	p.uris = append(p.uris, blobURI)
+	return "?sv=2020-08-04&sr=b&sp=aw&se=" + p.now.Add(p.validity).UTC().Format(time.RFC3339) + "&sig=" + string(rune('0'+len(p.uris))), nil
+}
+
+const testBlobURI = "https://account.blob.core.windows.net/container/output.txt"
+
+func Test_sasRenewingTransport_renewsBeforeExpiry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	provider := &countingProvider{now: now, validity: time.Hour}
+	base := &recordingTransport{}
+	transport := newSASRenewingTransport(base, provider.provide)
+	transport.now = func() time.Time { return now }
+	require.Nil(t, transport.seed(testBlobURI, "?sv=2020-08-04&se=2024-01-01T12:30:00Z&sig=initial"))
+	client := &http.Client{Transport: transport}
+
+	send := func() *url.URL {
+		req, err := http.NewRequest(http.MethodPut, testBlobURI+"?comp=appendblock&timeout=60&sv=2020-08-04&se=2024-01-01T12:30:00Z&sig=initial", strings.NewReader("data"))
+		require.Nil(t, err)
+		response, err := client.Do(req)
+		require.Nil(t, err)
+		require.Equal(t, http.StatusCreated, response.StatusCode)
+		return base.requests[len(base.requests)-1]
+	}
+
+	// the seeded token is used while it is valid
+	u := send()
+	require.Equal(t, "initial", u.Query().Get("sig"))
+	require.Equal(t, "appendblock", u.Query().Get("comp"))
+	require.Empty(t, provider.uris)
+
+	// and renewed within the margin of its expiry
+	now = now.Add(26 * time.Minute)
+	provider.now = now
+	u = send()
+	require.Equal(t, "1", u.Query().Get("sig"))
+	require.Equal(t, "appendblock", u.Query().Get("comp"))
+	require.Equal(t, "60", u.Query().Get("timeout"))
+	require.Equal(t, []string{testBlobURI}, provider.uris)
+
+	u = send()
+	require.Equal(t, "1", u.Query().Get("sig"))
+	require.Len(t, provider.uris, 1)
+}
+
+func Test_sasRenewingTransport_renewsRejectedToken(t *testing.T) {
+	provider := &countingProvider{now: time.Now(), validity: time.Hour}
+	base := &recordingTransport{revoked: "revoked"}
+	transport := newSASRenewingTransport(base, provider.provide)
+	require.Nil(t, transport.seed(testBlobURI, "sv=2020-08-04&sig=revoked"))
+
+	req, err := http.NewRequest(http.MethodPut, testBlobURI+"?comp=appendblock&sig=revoked", strings.NewReader("data"))
+	require.Nil(t, err)
+	response, err := (&http.Client{Transport: transport}).Do(req)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+	require.Len(t, base.requests, 2)
+	require.Equal(t, "1", base.requests[1].Query().Get("sig"))
+	require.Equal(t, []string{"data", "data"}, base.bodies, "the body is sent again")
+}
+
+func Test_sasRenewingTransport_tokenPerBlob(t *testing.T) {
+	provider := &countingProvider{now: time.Now(), validity: time.Hour}
+	base := &recordingTransport{}
+	transport := newSASRenewingTransport(base, provider.provide)
+	client := &http.Client{Transport: transport}
+
+	for _, uri := range []string{testBlobURI, testBlobURI + ".1", testBlobURI} {
+		req, err := http.NewRequest(http.MethodHead, uri+"?sig=initial", nil)
+		require.Nil(t, err)
+		_, err = client.Do(req)
+		require.Nil(t, err)
+	}
+	require.Equal(t, []string{testBlobURI, testBlobURI + ".1"}, provider.uris)
+}
+
+func Test_sasRenewingTransport_providerFails(t *testing.T) {
+	transport := newSASRenewingTransport(&recordingTransport{}, func(string) (string, error) {
+		return "", errors.New("endpoint unavailable")
+	})
+	req, err := http.NewRequest(http.MethodHead, testBlobURI, nil)
+	require.Nil(t, err)
+	_, err = (&http.Client{Transport: transport}).Do(req)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "endpoint unavailable")
+
+	transport = newSASRenewingTransport(&recordingTransport{}, func(string) (string, error) { return "?sv=2020-08-04", nil })
+	_, err = transport.token(testBlobURI, false)
+	require.NotNil(t, err, "a token without signature is invalid")
+}
+
+func TestCreateOrReplaceAppendBlob_withRenewal(t *testing.T) {
+	var mu sync.Mutex
+	var signatures []string
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		signatures = append(signatures, r.URL.Query().Get("sig"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer storage.Close()
+	proxy, err := url.Parse(storage.URL)
+	require.Nil(t, err)
+
+	provider := &countingProvider{now: time.Now(), validity: time.Hour}
+	blob, err := CreateOrReplaceAppendBlob("http://account.blob.core.windows.net/container/output.txt", "", proxy, provider.provide)
+	require.Nil(t, err)
+	require.Nil(t, blob.AppendBlock([]byte("output"), nil))
+	require.Equal(t, []string{"http://account.blob.core.windows.net/container/output.txt"}, provider.uris)
+	require.Equal(t, []string{"1", "1"}, signatures)
+}
+
+func TestNewSASRenewalEndpoint(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer dummyToken" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req sasRenewalRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.BlobURI != testBlobURI {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"sasToken": "?sv=2020-08-04&sig=renewed"}`))
+	}))
+	defer server.Close()
+
+	provider := NewSASRenewalEndpoint(context.Background(), server.URL, func() (msi.Msi, error) { return msi.Msi{AccessToken: "dummyToken"}, nil })
+	sas, err := provider(testBlobURI)
+	require.Nil(t, err)
+	require.Equal(t, "?sv=2020-08-04&sig=renewed", sas)
+
+	provider = NewSASRenewalEndpoint(context.Background(), server.URL, func() (msi.Msi, error) { return msi.Msi{AccessToken: "otherToken"}, nil })
+	_, err = provider(testBlobURI)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "401")
+
+	provider = NewSASRenewalEndpoint(context.Background(), server.URL, func() (msi.Msi, error) { return msi.Msi{}, errors.New("no identity") })
+	_, err = provider(testBlobURI)
+	require.EqualError(t, err, "no identity")
+}
+
+func TestSASExpiry(t *testing.T) {
+	expiry, ok := SASExpiry("?sv=2020-08-04&se=2026-03-01T10:00:00Z&sig=abc")
+	require.True(t, ok)
+	require.Equal(t, time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC), expiry)
+
+	_, ok = SASExpiry("sv=2020-08-04&sig=abc")
+	require.False(t, ok)
+	_, ok = SASExpiry("se=2026-03-01")
+	require.False(t, ok, "a SAS token without a signature is invalid")
+}
@@ -1,7 +1,12 @@
 package download
 
 import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"hash"
 	"io"
+	"net/http"
 	"os"
 
 	"github.com/go-kit/kit/log"
@@ -10,25 +15,128 @@ import (
 
 const (
 	writeBufSize = 1024 * 8
+
+	// partFileSuffix is the suffix of the files being downloaded
+	partFileSuffix = ".part"
+
+	// partETagFileSuffix is the suffix of the file holding the ETag of the resource being downloaded, so a later
+	// attempt resumes the download only if the resource didn't change
+	partETagFileSuffix = ".part.etag"
 )
 
 // SaveTo uses given downloader to fetch the resource with retries and saves the
 // given file. Directory of dst is not created by this function. If a file at
-// dst exists, it will be truncated. If a new file is created, mode is used to
-// set the permission bits. Written number of bytes are returned on success.
+// dst exists, it will be replaced and its permission bits are kept. If a new file
+// is created, mode is used to set the permission bits. Written number of bytes are
+// returned on success.
+//
+// The resource is saved with the .part suffix until its size is verified, so dst
+// never holds a partial file. When the download is interrupted, the .part file is
+// kept along with the ETag of the resource, and the next attempt to save it resumes
+// the download if the resource still has this ETag. A mismatch with the MD5 reported
+// by the server is logged as a warning.
 func SaveTo(ctx *log.Context, downloaders []Downloader, dst string, mode os.FileMode) (int64, error) {
-	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, mode)
+	if fi, err := os.Stat(dst); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	part := dst + partFileSuffix
+	hash := md5.New()
+	f, body := resumePart(ctx, downloaders, part, hash)
+	if body == nil {
+		removePart(part)
+		var err error
+		f, err = os.OpenFile(part, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, mode)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to open file for writing: %s", dst)
+		}
+		if body, err = withRetries(ctx, downloaders, ActualSleep); err != nil {
+			f.Close()
+			removePart(part)
+			return 0, errors.Wrapf(err, "failed to download file '%s'", dst)
+		}
+		if body.etag != "" {
+			if err := os.WriteFile(part+partETagFileSuffix, []byte(body.etag), 0600); err != nil {
+				ctx.Log("warning", "an interrupted download will not be resumed", "error", err)
+			}
+		}
+	}
+
+	n, err := save(ctx, body, f, hash, dst)
+	body.Close()
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = errors.Wrapf(closeErr, "failed to write to file: %s", dst)
+	}
+	if err == nil {
+		err = errors.Wrapf(os.Rename(part, dst), "failed to replace file: %s", dst)
+	}
 	if err != nil {
-		return 0, errors.Wrapf(err, "failed to open file for writing: %s", dst)
+		if body.interrupted() {
+			ctx.Log("message", "keeping the partial download for the next attempt", "offset", body.read)
+		} else {
+			removePart(part)
+		}
+		return n, err
 	}
-	defer f.Close()
+	os.Remove(part + partETagFileSuffix)
+	return n, nil
+}
 
-	body, err := WithRetries(ctx, downloaders, ActualSleep)
+// resumePart returns the file a previous attempt partially downloaded the resource to, positioned at its end, and
+// the body of the rest of the resource. hash is updated with the content of the file. The body is nil if there is
+// no such file, or the resource changed since.
+func resumePart(ctx *log.Context, downloaders []Downloader, part string, hash hash.Hash) (*os.File, *resumableBody) {
+	etag, err := os.ReadFile(part + partETagFileSuffix)
+	if err != nil {
+		return nil, nil
+	}
+	f, err := os.OpenFile(part, os.O_RDWR, 0)
 	if err != nil {
-		return 0, errors.Wrapf(err, "failed to download file '%s'", dst)
+		return nil, nil
 	}
-	defer body.Close()
+	offset, err := io.Copy(hash, f)
+	if err != nil || offset == 0 {
+		f.Close()
+		return nil, nil
+	}
+
+	header := http.Header{
+		"Range":    {fmt.Sprintf("bytes=%d-", offset)},
+		"If-Match": {string(etag)},
+	}
+	for _, d := range downloaders {
+		status, response, err := get(ctx, d, header)
+		if err != nil {
+			continue
+		}
+		if status != http.StatusPartialContent || contentRangeStart(response) != offset {
+			response.Body.Close()
+			continue
+		}
+		ctx.Log("message", "resuming the download of a previous attempt", "offset", offset)
+		return f, newResumableBody(ctx, d, response, ActualSleep)
+	}
+	ctx.Log("message", "the download of a previous attempt can't be resumed, downloading the file again", "offset", offset)
+	f.Close()
+	hash.Reset()
+	return nil, nil
+}
 
-	n, err := io.CopyBuffer(f, body, make([]byte, writeBufSize))
-	return n, errors.Wrapf(err, "failed to write to file: %s", dst)
+// removePart removes the partial download and its ETag
+func removePart(part string) {
+	os.Remove(part)
+	os.Remove(part + partETagFileSuffix)
+}
+
+// save writes the body to f and compares the MD5 of the resource, the one of the part saved before and the body, to
+// the one reported by the server. It returns the size of the resource saved.
+func save(ctx *log.Context, body *resumableBody, f io.Writer, hash hash.Hash, dst string) (int64, error) {
+	offset := body.read
+	n, err := io.CopyBuffer(io.MultiWriter(f, hash), body, make([]byte, writeBufSize))
+	if err != nil {
+		return offset + n, errors.Wrapf(err, "failed to write to file: %s", dst)
+	}
+	if body.md5 != nil && !bytes.Equal(hash.Sum(nil), body.md5) {
+		ctx.Log("warning", fmt.Sprintf("the MD5 of file '%s' doesn't match the one reported by the server", dst))
+	}
+	return offset + n, nil
 }
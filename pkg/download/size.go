@@ -0,0 +1,44 @@
+package download
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Azure/run-command-handler-linux/pkg/urlutil"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// ContentLength returns the size the server declares for the resource of the downloaders, with a HEAD request of
+// each downloader in turn until one succeeds, as SaveTo downloads it. The size is -1 when the server doesn't declare
+// it.
+func ContentLength(ctx *log.Context, downloaders []Downloader) (int64, error) {
+	err := errors.New("no downloader")
+	for _, downloader := range downloaders {
+		var size int64
+		if size, err = head(downloader); err == nil {
+			return size, nil
+		}
+		ctx.Log("event", "failed to get the size of the download", "error", err)
+	}
+	return -1, err
+}
+
+// head returns the Content-Length of the response to a HEAD request of the downloader
+func head(downloader Downloader) (int64, error) {
+	request, err := downloader.GetRequest()
+	if err != nil {
+		return -1, errors.Wrapf(err, "failed to create http request")
+	}
+	request.Method = http.MethodHead
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return -1, errors.Wrapf(urlutil.RemoveUrlFromErr(err), "http request failed")
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return -1, fmt.Errorf("the server returned a response code and message of %q", response.Status)
+	}
+	return response.ContentLength, nil
+}
@@ -0,0 +1,46 @@
+package download
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentLength(t *testing.T) {
+	var methods []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		switch r.URL.Path {
+		case "/script.sh":
+			w.Header().Set("Content-Length", "1048576")
+		case "/chunked":
+			w.Header().Set("Transfer-Encoding", "chunked")
+			w.(http.Flusher).Flush()
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	ctx := log.NewContext(log.NewNopLogger())
+
+	size, err := ContentLength(ctx, []Downloader{NewURLDownload(server.URL + "/script.sh")})
+	require.Nil(t, err)
+	require.EqualValues(t, 1048576, size)
+	require.Equal(t, []string{http.MethodHead}, methods)
+
+	// the downloaders are tried in turn
+	size, err = ContentLength(ctx, []Downloader{NewURLDownload(server.URL + "/missing"), NewURLDownload(server.URL + "/script.sh")})
+	require.Nil(t, err)
+	require.EqualValues(t, 1048576, size)
+
+	size, err = ContentLength(ctx, []Downloader{NewURLDownload(server.URL + "/chunked")})
+	require.Nil(t, err)
+	require.EqualValues(t, -1, size)
+
+	_, err = ContentLength(ctx, []Downloader{NewURLDownload(server.URL + "/missing")})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "404")
+}
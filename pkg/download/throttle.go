@@ -0,0 +1,96 @@
+package download
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Clock returns the current time and pauses the execution
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time        { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// throttleClock times the reads of the throttled downloads
+var throttleClock Clock = realClock{}
+
+// bandwidthContextKey is the key of the bandwidth limit of the requests in their context
+type bandwidthContextKey struct{}
+
+// WithBandwidthLimit returns a copy of ctx whose downloads read at most maxKbps kilobits per second. Zero is no
+// limit.
+func WithBandwidthLimit(ctx context.Context, maxKbps int) context.Context {
+	if maxKbps <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, bandwidthContextKey{}, kbpsToBytesPerSecond(maxKbps))
+}
+
+func kbpsToBytesPerSecond(kbps int) int64 {
+	return int64(kbps) * 1000 / 8
+}
+
+// bandwidthLimitFromContext returns the bytes per second set with WithBandwidthLimit, 0 if none
+func bandwidthLimitFromContext(ctx context.Context) int64 {
+	limit, _ := ctx.Value(bandwidthContextKey{}).(int64)
+	return limit
+}
+
+// throttledDownloader limits the bandwidth of the downloads of a downloader
+type throttledDownloader struct {
+	downloader Downloader
+	maxKbps    int
+}
+
+// Throttled returns a downloader whose downloads read at most maxKbps kilobits per second. Zero is no limit.
+func Throttled(downloader Downloader, maxKbps int) Downloader {
+	if maxKbps <= 0 {
+		return downloader
+	}
+	return throttledDownloader{downloader: downloader, maxKbps: maxKbps}
+}
+
+func (d throttledDownloader) GetRequest() (*http.Request, error) {
+	req, err := d.downloader.GetRequest()
+	if err != nil {
+		return nil, err
+	}
+	return req.WithContext(WithBandwidthLimit(req.Context(), d.maxKbps)), nil
+}
+
+// rateLimitedReader reads at most bytesPerSecond on average, sleeping once it is ahead of the rate. The reads are
+// split into tenths of a second of transfer at most, so the data flows evenly rather than in bursts.
+type rateLimitedReader struct {
+	r              io.ReadCloser
+	bytesPerSecond int64
+	start          time.Time
+	read           int64
+}
+
+func newRateLimitedReader(r io.ReadCloser, bytesPerSecond int64) *rateLimitedReader {
+	return &rateLimitedReader{r: r, bytesPerSecond: bytesPerSecond, start: throttleClock.Now()}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if chunk := r.bytesPerSecond/10 + 1; int64(len(p)) > chunk {
+		p = p[:chunk]
+	}
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	due := time.Duration(float64(r.read) / float64(r.bytesPerSecond) * float64(time.Second))
+	if ahead := due - throttleClock.Now().Sub(r.start); ahead > 0 {
+		throttleClock.Sleep(ahead)
+	}
+	return n, err
+}
+
+func (r *rateLimitedReader) Close() error {
+	return r.r.Close()
+}
@@ -0,0 +1,72 @@
+package download
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+// sleepingClock is a clock whose time only moves when it sleeps
+type sleepingClock struct {
+	now   time.Time
+	slept time.Duration
+}
+
+func (c *sleepingClock) Now() time.Time { return c.now }
+func (c *sleepingClock) Sleep(d time.Duration) {
+	c.now = c.now.Add(d)
+	c.slept += d
+}
+
+func useSleepingClock(t *testing.T) *sleepingClock {
+	c := &sleepingClock{now: time.Unix(0, 0)}
+	previous := throttleClock
+	throttleClock = c
+	t.Cleanup(func() { throttleClock = previous })
+	return c
+}
+
+func Test_rateLimitedReader(t *testing.T) {
+	c := useSleepingClock(t)
+	content := bytes.Repeat([]byte("a"), 1000*1000)
+
+	// 800 kbps is 100 KB per second
+	r := newRateLimitedReader(io.NopCloser(bytes.NewReader(content)), kbpsToBytesPerSecond(800))
+	b, err := io.ReadAll(r)
+	require.Nil(t, err)
+	require.Equal(t, content, b)
+	require.Equal(t, 10*time.Second, c.slept)
+}
+
+func Test_rateLimitedReader_splitsReads(t *testing.T) {
+	useSleepingClock(t)
+	r := newRateLimitedReader(io.NopCloser(bytes.NewReader(make([]byte, 1024*1024))), 10000)
+	n, err := r.Read(make([]byte, 64*1024))
+	require.Nil(t, err)
+	require.Equal(t, 1001, n, "a tenth of a second of transfer at most")
+}
+
+func TestThrottled(t *testing.T) {
+	c := useSleepingClock(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 50000))
+	}))
+	defer srv.Close()
+
+	d := NewURLDownload(srv.URL)
+	require.Equal(t, d, Throttled(d, 0), "no limit")
+
+	_, body, err := Download(log.NewContext(log.NewNopLogger()), Throttled(d, 400))
+	require.Nil(t, err)
+	defer body.Close()
+	n, err := io.Copy(io.Discard, body)
+	require.Nil(t, err)
+	require.EqualValues(t, 50000, n)
+	require.Equal(t, time.Second, c.slept)
+}
@@ -10,6 +10,7 @@ import (
 const (
 	xMsClientRequestIdHeaderName  = "x-ms-client-request-id"
 	xMsServiceRequestIdHeaderName = "x-ms-request-id"
+	xMsBlobContentMd5HeaderName   = "x-ms-blob-content-md5"
 )
 
 // urlDownload describes a URL to download.
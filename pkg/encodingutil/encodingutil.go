@@ -0,0 +1,68 @@
+// Package encodingutil normalizes the output of scripts so it can be embedded in the status
+// file (JSON) and in the output blobs regardless of the locale the script ran with.
+package encodingutil
+
+import (
+	"unicode/utf8"
+)
+
+// ToValidUTF8 returns b as valid UTF-8. Valid UTF-8 sequences are kept as they are. Any other byte
+// is assumed to come from a single-byte locale encoding (ISO-8859-1) and is transcoded to the
+// equivalent character, so no output is lost or replaced by U+FFFD when serialized.
+func ToValidUTF8(b []byte) []byte {
+	if utf8.Valid(b) {
+		return b
+	}
+
+	result := make([]byte, 0, len(b)+len(b)/2)
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		if r == utf8.RuneError && size <= 1 {
+			r, size = rune(b[0]), 1
+		}
+		result = utf8.AppendRune(result, r)
+		b = b[size:]
+	}
+	return result
+}
+
+// TrimLeadingPartialRune drops the continuation bytes at the start of b left by reading from the
+// middle of a multi-byte UTF-8 sequence (e.g., when reading the tail of a file).
+func TrimLeadingPartialRune(b []byte) []byte {
+	i := 0
+	for i < len(b) && i < utf8.UTFMax-1 && !utf8.RuneStart(b[i]) {
+		i++
+	}
+
+	if i < len(b) && utf8.RuneStart(b[i]) {
+		return b[i:]
+	}
+	// Too many continuation bytes to be a split sequence, keep them to be transcoded
+	return b
+}
+
+// Truncate returns s cut to at most n bytes followed by "...", without splitting a UTF-8 sequence, or s as it is if
+// it is not longer than n bytes
+func Truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + "..."
+}
+
+// CompleteRunesLength returns the length of b excluding an incomplete UTF-8 sequence at its end,
+// so the sequence can be completed by the data written next.
+func CompleteRunesLength(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if utf8.FullRune(b[i:]) {
+				return len(b)
+			}
+			return i
+		}
+	}
+	return len(b)
+}
@@ -0,0 +1,48 @@
+package encodingutil
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_toValidUTF8_keepsValidUTF8(t *testing.T) {
+	b := []byte("héllo wörld ✓")
+	require.Equal(t, b, ToValidUTF8(b))
+}
+
+func Test_toValidUTF8_transcodesSingleByteLocale(t *testing.T) {
+	// "café 25°C" encoded as ISO-8859-1
+	b := []byte{'c', 'a', 'f', 0xe9, ' ', '2', '5', 0xb0, 'C'}
+	require.Equal(t, "café 25°C", string(ToValidUTF8(b)))
+}
+
+func Test_toValidUTF8_producesValidJson(t *testing.T) {
+	b := []byte{'o', 'k', 0xff, 0xfe, '"', '\n'}
+	j, err := json.Marshal(string(ToValidUTF8(b)))
+	require.Nil(t, err)
+	require.Equal(t, `"okÿþ\"\n"`, string(j))
+}
+
+func Test_trimLeadingPartialRune(t *testing.T) {
+	// "✓" is e2 9c 93. A tail starting after its first byte
+	require.Equal(t, "ok", string(TrimLeadingPartialRune([]byte{0x9c, 0x93, 'o', 'k'})))
+	require.Equal(t, "ok", string(TrimLeadingPartialRune([]byte("ok"))))
+	require.Equal(t, []byte{0x80, 0x80, 0x80, 0x80}, TrimLeadingPartialRune([]byte{0x80, 0x80, 0x80, 0x80}))
+	require.Empty(t, TrimLeadingPartialRune(nil))
+}
+
+func Test_truncate(t *testing.T) {
+	require.Equal(t, "hello", Truncate("hello", 5))
+	require.Equal(t, "hel...", Truncate("hello", 3))
+	require.Equal(t, "h...", Truncate("hé", 2), "é is not split")
+	require.Equal(t, "...", Truncate("✓", 2))
+}
+
+func Test_completeRunesLength(t *testing.T) {
+	require.Equal(t, 2, CompleteRunesLength([]byte("ok")))
+	require.Equal(t, 6, CompleteRunesLength([]byte("ok ✓")))
+	require.Equal(t, 3, CompleteRunesLength([]byte{'o', 'k', ' ', 0xe2, 0x9c}))
+	require.Equal(t, 0, CompleteRunesLength(nil))
+}
@@ -0,0 +1,261 @@
+// Package keyvault resolves Key Vault references, such as
+// @Microsoft.KeyVault(SecretUri=https://myvault.vault.azure.net/secrets/mysecret/), to the values of their secrets,
+// read with the token of a managed identity.
+package keyvault
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// apiVersion is the version of the Key Vault REST API reading the secrets
+	apiVersion = "7.4"
+
+	// DefaultCacheTTL is how long a secret read is reused, so the run commands of a goal state read it once
+	DefaultCacheTTL = 5 * time.Minute
+
+	requestTimeout    = 30 * time.Second
+	maxRetries        = 3
+	initialRetryDelay = 2 * time.Second
+
+	// maxErrorBodyLen bounds the response body reported in the error of a rejected request
+	maxErrorBodyLen = 512
+)
+
+var (
+	referencePattern = regexp.MustCompile(`^@Microsoft\.KeyVault\((.*)\)$`)
+
+	// vaultHostPattern matches the hosts of the vaults of the public and sovereign clouds, capturing the suffix
+	// the tokens are requested for (e.g., vault.azure.net)
+	vaultHostPattern = regexp.MustCompile(`^[A-Za-z0-9-]{3,24}\.(vault\.(?:azure\.net|azure\.cn|usgovcloudapi\.net|microsoftazure\.de))$`)
+
+	secretPathPattern = regexp.MustCompile(`^/secrets/([A-Za-z0-9-]{1,127})(?:/([A-Za-z0-9]*))?/?$`)
+)
+
+// TokenFunc returns a bearer token for the given scope (e.g., of a managed identity)
+type TokenFunc func(ctx context.Context, scope string) (string, error)
+
+// Secret identifies the version of a secret in a vault, the latest version if Version is empty
+type Secret struct {
+	VaultHost string
+	Name      string
+	Version   string
+}
+
+// URI returns the URI of the secret
+func (s Secret) URI() string {
+	uri := fmt.Sprintf("https://%s/secrets/%s", s.VaultHost, s.Name)
+	if s.Version != "" {
+		uri += "/" + s.Version
+	}
+	return uri
+}
+
+// scope returns the scope of the tokens reading the secret
+func (s Secret) scope() string {
+	return "https://" + vaultHostPattern.FindStringSubmatch(s.VaultHost)[1] + "/.default"
+}
+
+// ParseReference parses a Key Vault reference, either with the URI of the secret
+// (@Microsoft.KeyVault(SecretUri=<uri>)) or with its parts
+// (@Microsoft.KeyVault(VaultName=<vault>;SecretName=<name>[;SecretVersion=<version>])), in the public cloud.
+func ParseReference(reference string) (Secret, error) {
+	match := referencePattern.FindStringSubmatch(strings.TrimSpace(reference))
+	if match == nil {
+		return Secret{}, errors.New("a Key Vault reference must be @Microsoft.KeyVault(SecretUri=<uri>) or @Microsoft.KeyVault(VaultName=<vault>;SecretName=<name>)")
+	}
+	parts := make(map[string]string)
+	for _, part := range strings.Split(match[1], ";") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		i := strings.Index(part, "=")
+		if i < 0 {
+			return Secret{}, errors.Errorf("invalid part '%s' of the Key Vault reference", part)
+		}
+		parts[strings.ToLower(part[:i])] = strings.TrimSpace(part[i+1:])
+	}
+
+	if uri, ok := parts["secreturi"]; ok {
+		if len(parts) > 1 {
+			return Secret{}, errors.New("a Key Vault reference with a SecretUri has no other part")
+		}
+		return parseSecretURI(uri)
+	}
+	if parts["vaultname"] == "" || parts["secretname"] == "" {
+		return Secret{}, errors.New("a Key Vault reference needs either a SecretUri or a VaultName and a SecretName")
+	}
+	path := "/secrets/" + parts["secretname"]
+	if version := parts["secretversion"]; version != "" {
+		path += "/" + version
+	}
+	return parseSecretURI("https://" + parts["vaultname"] + ".vault.azure.net" + path)
+}
+
+func parseSecretURI(uri string) (Secret, error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "https" || u.RawQuery != "" || u.User != nil {
+		return Secret{}, errors.Errorf("invalid secret URI '%s', it must be such as https://<vault>.vault.azure.net/secrets/<name>/<version>", uri)
+	}
+	if !vaultHostPattern.MatchString(u.Host) {
+		return Secret{}, errors.Errorf("'%s' is not the host of a Key Vault", u.Host)
+	}
+	path := secretPathPattern.FindStringSubmatch(u.Path)
+	if path == nil {
+		return Secret{}, errors.Errorf("invalid secret URI '%s', its path must be /secrets/<name>[/<version>]", uri)
+	}
+	return Secret{VaultHost: strings.ToLower(u.Host), Name: path[1], Version: path[2]}, nil
+}
+
+// Clock times the expiry of the cached secrets and the retries
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Client reads secrets, retrying the throttled and failed requests and caching the secrets read
+type Client struct {
+	token  TokenFunc
+	client *http.Client
+	clock  Clock
+	ttl    time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedSecret
+}
+
+type cachedSecret struct {
+	value   string
+	expires time.Time
+}
+
+// NewClient returns a client reading the secrets with the tokens returned by token, through transport (the default
+// transport if nil). The secrets are cached by the client, which must only be shared by the users of the same token.
+func NewClient(token TokenFunc, transport http.RoundTripper) *Client {
+	return &Client{
+		token:  token,
+		client: &http.Client{Transport: transport, Timeout: requestTimeout},
+		clock:  realClock{},
+		ttl:    DefaultCacheTTL,
+		cache:  make(map[string]cachedSecret),
+	}
+}
+
+// Resolve returns the value of the secret of the Key Vault reference
+func (c *Client) Resolve(ctx context.Context, reference string) (string, error) {
+	secret, err := ParseReference(reference)
+	if err != nil {
+		return "", err
+	}
+	return c.GetSecret(ctx, secret)
+}
+
+// GetSecret returns the value of the secret, from the cache if it was read recently. The failed requests are retried
+// as long as the next attempt starts before the deadline of ctx, if any.
+func (c *Client) GetSecret(ctx context.Context, secret Secret) (string, error) {
+	uri := secret.URI()
+	c.mu.Lock()
+	cached, ok := c.cache[uri]
+	c.mu.Unlock()
+	if ok && c.clock.Now().Before(cached.expires) {
+		return cached.value, nil
+	}
+
+	delay := initialRetryDelay
+	for attempt := 0; ; attempt++ {
+		value, err := c.getSecret(ctx, secret)
+		if err == nil {
+			c.mu.Lock()
+			c.cache[uri] = cachedSecret{value: value, expires: c.clock.Now().Add(c.ttl)}
+			c.mu.Unlock()
+			return value, nil
+		}
+		if attempt == maxRetries || !retryable(err) {
+			return "", errors.Wrapf(err, "failed to read the secret '%s'", uri)
+		}
+		if deadline, ok := ctx.Deadline(); ok && !c.clock.Now().Add(delay).Before(deadline) {
+			return "", errors.Wrapf(err, "failed to read the secret '%s' before the timeout", uri)
+		}
+		select {
+		case <-ctx.Done():
+			return "", errors.Wrapf(err, "failed to read the secret '%s' before the timeout", uri)
+		case <-c.clock.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (c *Client) getSecret(ctx context.Context, secret Secret) (string, error) {
+	token, err := c.token(ctx, secret.scope())
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get a token for the Key Vault")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, secret.URI()+"?api-version="+apiVersion, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyLen))
+		return "", StatusError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+	}
+
+	var bundle struct {
+		Value *string `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&bundle); err != nil {
+		return "", errors.Wrap(err, "invalid response of the Key Vault")
+	}
+	if bundle.Value == nil {
+		return "", errors.New("the response of the Key Vault has no value")
+	}
+	return *bundle.Value, nil
+}
+
+// StatusError is a request rejected by the Key Vault
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e StatusError) Error() string {
+	switch e.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Sprintf("access denied (%d), the managed identity needs the permission to get the secret: %s", e.StatusCode, e.Body)
+	case http.StatusNotFound:
+		return fmt.Sprintf("secret not found (%d): %s", e.StatusCode, e.Body)
+	}
+	return fmt.Sprintf("the Key Vault responded with status %d: %s", e.StatusCode, e.Body)
+}
+
+// retryable returns whether err is transient: throttling, a failure of the service or of the network
+func retryable(err error) bool {
+	var statusErr StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,149 @@
+package keyvault
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseReference(t *testing.T) {
+	s, err := ParseReference("@Microsoft.KeyVault(SecretUri=https://myvault.vault.azure.net/secrets/mysecret/ec96f02080254f109c51a1f14cdb1931)")
+	require.Nil(t, err)
+	require.Equal(t, Secret{VaultHost: "myvault.vault.azure.net", Name: "mysecret", Version: "ec96f02080254f109c51a1f14cdb1931"}, s)
+	require.Equal(t, "https://vault.azure.net/.default", s.scope())
+
+	s, err = ParseReference("@Microsoft.KeyVault(SecretUri=https://myvault.vault.azure.cn/secrets/mysecret/)")
+	require.Nil(t, err)
+	require.Equal(t, "https://myvault.vault.azure.cn/secrets/mysecret", s.URI())
+	require.Equal(t, "https://vault.azure.cn/.default", s.scope())
+
+	s, err = ParseReference("@Microsoft.KeyVault(VaultName=myvault;SecretName=mysecret;SecretVersion=v1)")
+	require.Nil(t, err)
+	require.Equal(t, "https://myvault.vault.azure.net/secrets/mysecret/v1", s.URI())
+
+	for _, reference := range []string{
+		"plain value",
+		"@Microsoft.KeyVault(SecretUri=http://myvault.vault.azure.net/secrets/mysecret)",
+		"@Microsoft.KeyVault(SecretUri=https://attacker.example.com/secrets/mysecret)",
+		"@Microsoft.KeyVault(SecretUri=https://myvault.vault.azure.net/keys/mykey)",
+		"@Microsoft.KeyVault(SecretUri=https://myvault.vault.azure.net/secrets/mysecret;VaultName=other)",
+		"@Microsoft.KeyVault(VaultName=myvault)",
+	} {
+		_, err := ParseReference(reference)
+		require.NotNil(t, err, reference)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func response(status int, body string) *http.Response {
+	return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body)), Header: http.Header{}}
+}
+
+// fakeClock is a clock whose time only moves when advanced or waited on, and whose waits end at once unless it is
+// stopped
+type fakeClock struct {
+	now     time.Time
+	stopped bool
+	waited  []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time          { return c.now }
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.waited = append(c.waited, d)
+	if c.stopped {
+		return nil
+	}
+	c.Advance(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func newTestClient(responses ...*http.Response) (*Client, *[]*http.Request, *fakeClock) {
+	var requests []*http.Request
+	token := func(ctx context.Context, scope string) (string, error) { return "token-for-" + scope, nil }
+	c := NewClient(token, roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		requests = append(requests, req)
+		resp := responses[0]
+		responses = responses[1:]
+		return resp, nil
+	}))
+	fake := &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	c.clock = fake
+	return c, &requests, fake
+}
+
+func TestResolve(t *testing.T) {
+	c, requests, fake := newTestClient(
+		response(http.StatusTooManyRequests, ""),
+		response(http.StatusOK, `{"value": "s3cret", "id": "https://myvault.vault.azure.net/secrets/mysecret/v1"}`),
+		response(http.StatusOK, `{"value": "rotated"}`))
+	reference := "@Microsoft.KeyVault(SecretUri=https://myvault.vault.azure.net/secrets/mysecret/v1)"
+
+	value, err := c.Resolve(context.Background(), reference)
+	require.Nil(t, err)
+	require.Equal(t, "s3cret", value)
+	require.Len(t, *requests, 2)
+	require.Equal(t, "https://myvault.vault.azure.net/secrets/mysecret/v1?api-version=7.4", (*requests)[1].URL.String())
+	require.Equal(t, "Bearer token-for-https://vault.azure.net/.default", (*requests)[1].Header.Get("Authorization"))
+
+	// The secret is cached until it expires
+	value, err = c.Resolve(context.Background(), reference)
+	require.Nil(t, err)
+	require.Equal(t, "s3cret", value)
+	require.Len(t, *requests, 2)
+
+	fake.Advance(DefaultCacheTTL)
+	value, err = c.Resolve(context.Background(), reference)
+	require.Nil(t, err)
+	require.Equal(t, "rotated", value)
+}
+
+func TestResolveDenied(t *testing.T) {
+	c, requests, _ := newTestClient(response(http.StatusForbidden, `{"error": {"code": "Forbidden"}}`))
+
+	_, err := c.Resolve(context.Background(), "@Microsoft.KeyVault(VaultName=myvault;SecretName=mysecret)")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to read the secret 'https://myvault.vault.azure.net/secrets/mysecret'")
+	require.Contains(t, err.Error(), "the managed identity needs the permission to get the secret")
+	require.Len(t, *requests, 1)
+}
+
+func TestGetSecret_retriesWithinTheDeadline(t *testing.T) {
+	c, requests, fake := newTestClient(
+		response(http.StatusServiceUnavailable, ""),
+		response(http.StatusServiceUnavailable, ""),
+		response(http.StatusOK, `{"value": "s3cret"}`))
+	fake.now = time.Now()
+	ctx, cancel := context.WithDeadline(context.Background(), fake.now.Add(5*time.Second))
+	defer cancel()
+
+	// The second retry would start after the deadline
+	_, err := c.GetSecret(ctx, Secret{VaultHost: "myvault.vault.azure.net", Name: "mysecret"})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "before the timeout")
+	require.Contains(t, err.Error(), "503")
+	require.Len(t, *requests, 2)
+	require.Equal(t, []time.Duration{initialRetryDelay}, fake.waited)
+}
+
+func TestGetSecret_stopsWaitingWhenCanceled(t *testing.T) {
+	c, requests, fake := newTestClient(response(http.StatusTooManyRequests, ""))
+	fake.stopped = true
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := c.GetSecret(ctx, Secret{VaultHost: "myvault.vault.azure.net", Name: "mysecret"})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "before the timeout")
+	require.Len(t, *requests, 1)
+}
@@ -0,0 +1,171 @@
+// Package logdedup collapses the warnings and errors repeated in the logs (e.g., an upload failing on every status
+// update during a storage outage) into periodic summaries counting them, so the logs stay readable.
+package logdedup
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	// DefaultWindow is how long the duplicates of a record are suppressed after it is written
+	DefaultWindow = 5 * time.Minute
+
+	// maxTracked bounds the distinct records tracked, the summaries are written when more are logged
+	maxTracked = 1000
+)
+
+// timeKey is the key of the time of the records, set to the time a summary is written
+const timeKey = "time"
+
+// volatileKeys are left out when comparing records
+var volatileKeys = map[interface{}]bool{timeKey: true}
+
+// Clock returns the current time
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// Logger passes the records to the next logger, except the warnings and errors identical to one written less than
+// a window ago. Once the window of a record ends, the last of its duplicates is written with their count under the
+// "duplicates" key, and the next duplicate starts a new window. The summaries are written in the order their records
+// were first written, with the time they are written at.
+type Logger struct {
+	next   log.Logger
+	window time.Duration
+	clock  Clock
+
+	mu      sync.Mutex
+	tracked map[string]*tracked
+	written uint64
+}
+
+// tracked is a record written, and its duplicates suppressed since
+type tracked struct {
+	order      uint64
+	since      time.Time
+	duplicates int
+	last       []interface{}
+}
+
+// NewLogger returns a logger suppressing the duplicate warnings and errors passed to next for window
+func NewLogger(next log.Logger, window time.Duration) *Logger {
+	return NewLoggerWithClock(next, window, realClock{})
+}
+
+// NewLoggerWithClock returns a logger suppressing the duplicate warnings and errors passed to next for window, as
+// timed by clk
+func NewLoggerWithClock(next log.Logger, window time.Duration, clk Clock) *Logger {
+	return &Logger{next: next, window: window, clock: clk, tracked: make(map[string]*tracked)}
+}
+
+// Log writes the record unless it duplicates a warning or an error written less than a window ago
+func (l *Logger) Log(keyvals ...interface{}) error {
+	l.mu.Lock()
+	now := l.clock.Now()
+	summaries := l.expire(now, len(l.tracked) >= maxTracked)
+	suppressed := false
+	if isWarningOrError(keyvals) {
+		key := recordKey(keyvals)
+		if t, ok := l.tracked[key]; ok {
+			t.duplicates++
+			t.last = append([]interface{}(nil), keyvals...)
+			suppressed = true
+		} else {
+			l.written++
+			l.tracked[key] = &tracked{order: l.written, since: now}
+		}
+	}
+	l.mu.Unlock()
+
+	for _, summary := range summaries {
+		l.next.Log(summary...)
+	}
+	if suppressed {
+		return nil
+	}
+	return l.next.Log(keyvals...)
+}
+
+// Flush writes the summaries of the duplicates suppressed so far, e.g., before the process exits
+func (l *Logger) Flush() {
+	l.mu.Lock()
+	summaries := l.expire(l.clock.Now(), true)
+	l.mu.Unlock()
+
+	for _, summary := range summaries {
+		l.next.Log(summary...)
+	}
+}
+
+// expire stops tracking the records whose window ended at now, or every record if all is set, and returns the
+// summaries of their duplicates, written at now
+func (l *Logger) expire(now time.Time, all bool) [][]interface{} {
+	var expired []*tracked
+	for key, t := range l.tracked {
+		if !all && now.Sub(t.since) < l.window {
+			continue
+		}
+		delete(l.tracked, key)
+		if t.duplicates > 0 {
+			expired = append(expired, t)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].order < expired[j].order })
+
+	summaries := make([][]interface{}, 0, len(expired))
+	for _, t := range expired {
+		summaries = append(summaries, append(stamp(t.last, now), "duplicates", t.duplicates))
+	}
+	return summaries
+}
+
+// stamp sets the time of the record to now, in the format of its current time
+func stamp(keyvals []interface{}, now time.Time) []interface{} {
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i] != timeKey {
+			continue
+		}
+		if _, ok := keyvals[i+1].(time.Time); ok {
+			keyvals[i+1] = now
+		} else {
+			keyvals[i+1] = now.Format(time.RFC3339)
+		}
+	}
+	return keyvals
+}
+
+// isWarningOrError returns whether the record has an "error" or a "warning" key
+func isWarningOrError(keyvals []interface{}) bool {
+	for i := 0; i < len(keyvals); i += 2 {
+		if keyvals[i] == "error" || keyvals[i] == "warning" {
+			return true
+		}
+	}
+	return false
+}
+
+// recordKey returns the keys and values of the record, except the volatile ones
+func recordKey(keyvals []interface{}) string {
+	var b strings.Builder
+	for i := 0; i < len(keyvals); i += 2 {
+		if volatileKeys[keyvals[i]] {
+			continue
+		}
+		fmt.Fprint(&b, keyvals[i], "=")
+		if i+1 < len(keyvals) {
+			fmt.Fprint(&b, keyvals[i+1])
+		}
+		b.WriteByte(0)
+	}
+	return b.String()
+}
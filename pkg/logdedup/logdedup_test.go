@@ -0,0 +1,101 @@
+package logdedup
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func lines(out *bytes.Buffer) []string {
+	s := strings.TrimSpace(out.String())
+	out.Reset()
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// fakeClock is a clock whose time only moves when advanced
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time          { return c.now }
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func TestNewLogger(t *testing.T) {
+	var out bytes.Buffer
+	clk := &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	logger := NewLoggerWithClock(log.NewLogfmtLogger(&out), time.Minute, clk)
+	ctx := log.NewContext(logger).With("time", log.Valuer(func() interface{} { return clk.Now().Format(time.RFC3339) }))
+
+	ctx.Log("message", "failed to append", "error", "timeout")
+	ctx.Log("message", "failed to append", "error", "timeout")
+	ctx.Log("message", "failed to append", "error", "connection reset")
+	ctx.Log("message", "progress")
+	ctx.Log("message", "progress")
+	require.Equal(t, []string{
+		`time=2024-01-02T03:04:05Z message="failed to append" error=timeout`,
+		`time=2024-01-02T03:04:05Z message="failed to append" error="connection reset"`,
+		`time=2024-01-02T03:04:05Z message=progress`,
+		`time=2024-01-02T03:04:05Z message=progress`,
+	}, lines(&out))
+
+	clk.Advance(30 * time.Second)
+	ctx.Log("message", "failed to append", "error", "timeout")
+	require.Empty(t, lines(&out))
+
+	// The window ended, the duplicates are summarized with the next record
+	clk.Advance(30 * time.Second)
+	ctx.Log("warning", "retrying")
+	require.Equal(t, []string{
+		`time=2024-01-02T03:05:05Z message="failed to append" error=timeout duplicates=2`,
+		`time=2024-01-02T03:05:05Z warning=retrying`,
+	}, lines(&out))
+
+	ctx.Log("message", "failed to append", "error", "timeout")
+	require.Equal(t, []string{`time=2024-01-02T03:05:05Z message="failed to append" error=timeout`}, lines(&out))
+}
+
+func TestFlush(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewLogger(log.NewLogfmtLogger(&out), DefaultWindow)
+
+	logger.Log("warning", "slow")
+	logger.Log("warning", "slow")
+	logger.Log("warning", "slow")
+	require.Equal(t, []string{`warning=slow`}, lines(&out))
+
+	logger.Flush()
+	require.Equal(t, []string{`warning=slow duplicates=2`}, lines(&out))
+	logger.Flush()
+	require.Empty(t, lines(&out))
+}
+
+func TestFlush_ordersSummaries(t *testing.T) {
+	var out bytes.Buffer
+	clk := &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	logger := NewLoggerWithClock(log.NewLogfmtLogger(&out), DefaultWindow, clk)
+
+	for _, warning := range []string{"a", "b", "c", "d", "e"} {
+		logger.Log("time", clk.Now().Format(time.RFC3339), "warning", warning)
+		logger.Log("time", clk.Now().Format(time.RFC3339), "warning", warning)
+		clk.Advance(time.Second)
+	}
+	lines(&out)
+
+	// The summaries are written when flushed, in the order their records were first written
+	clk.Advance(time.Minute)
+	logger.Flush()
+	require.Equal(t, []string{
+		`time=2024-01-02T03:05:10Z warning=a duplicates=1`,
+		`time=2024-01-02T03:05:10Z warning=b duplicates=1`,
+		`time=2024-01-02T03:05:10Z warning=c duplicates=1`,
+		`time=2024-01-02T03:05:10Z warning=d duplicates=1`,
+		`time=2024-01-02T03:05:10Z warning=e duplicates=1`,
+	}, lines(&out))
+}
@@ -0,0 +1,61 @@
+// Package loglevel filters the records written to the logs by their severity, which can be changed while the
+// process runs.
+package loglevel
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// Levels by increasing severity. A record is an error if it has an "error" key, a warning if it has a "warning"
+// key, and informational otherwise.
+const (
+	Info    = "info"
+	Warning = "warning"
+	Error   = "error"
+)
+
+var severities = map[string]int32{Info: 0, Warning: 1, Error: 2}
+
+// minSeverity is the severity of the records written, every record by default
+var minSeverity int32
+
+// Set changes the level of the records written, e.g., "warning" only writes the warnings and errors. An empty
+// level writes every record.
+func Set(level string) error {
+	if level == "" {
+		level = Info
+	}
+	severity, ok := severities[strings.ToLower(level)]
+	if !ok {
+		return errors.Errorf("invalid log level %q, must be one of info, warning or error", level)
+	}
+	atomic.StoreInt32(&minSeverity, severity)
+	return nil
+}
+
+// NewLogger returns a logger passing to next the records at least as severe as the level set
+func NewLogger(next log.Logger) log.Logger {
+	return log.LoggerFunc(func(keyvals ...interface{}) error {
+		if severity(keyvals) < atomic.LoadInt32(&minSeverity) {
+			return nil
+		}
+		return next.Log(keyvals...)
+	})
+}
+
+func severity(keyvals []interface{}) int32 {
+	result := severities[Info]
+	for i := 0; i < len(keyvals); i += 2 {
+		switch keyvals[i] {
+		case Error:
+			return severities[Error]
+		case Warning:
+			result = severities[Warning]
+		}
+	}
+	return result
+}
@@ -0,0 +1,37 @@
+package loglevel
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewLogger(t *testing.T) {
+	defer Set(Info)
+	var out bytes.Buffer
+	ctx := log.NewContext(NewLogger(log.NewLogfmtLogger(&out))).With("operation", "test")
+
+	ctx.Log("message", "info")
+	require.Contains(t, out.String(), "message=info")
+
+	require.Nil(t, Set("WARNING"))
+	out.Reset()
+	ctx.Log("message", "info")
+	ctx.Log("warning", "warning")
+	ctx.Log("message", "failed", "error", "error")
+	require.NotContains(t, out.String(), "message=info")
+	require.Contains(t, out.String(), "warning=warning")
+	require.Contains(t, out.String(), "error=error")
+
+	require.Nil(t, Set(Error))
+	out.Reset()
+	ctx.Log("warning", "warning")
+	require.Empty(t, out.String())
+
+	require.ErrorContains(t, Set("debug"), "invalid log level")
+	require.Nil(t, Set(""))
+	ctx.Log("message", "info")
+	require.Contains(t, out.String(), "message=info")
+}
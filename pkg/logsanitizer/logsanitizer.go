@@ -0,0 +1,81 @@
+// Package logsanitizer removes secrets from the data written to the logs and telemetry.
+package logsanitizer
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	// maxValueLength is the maximum length of a single value written to the logs
+	maxValueLength = 4096
+
+	// minSecretLength avoids masking short values (e.g., "1") that would garble every log line
+	minSecretLength = 4
+
+	mask = "***"
+)
+
+var (
+	// urlQueryRegex matches the query of any http(s) url, which may carry a SAS token
+	urlQueryRegex = regexp.MustCompile(`(?i)(https?://[^\s?"'#]+)\?[^\s"'#]*`)
+
+	// sasSignatureRegex matches the signature of a SAS token outside of a url (e.g., a token logged by itself)
+	sasSignatureRegex = regexp.MustCompile(`(?i)(sig=)[^&\s"']+`)
+
+	secrets = struct {
+		sync.RWMutex
+		values map[string]bool
+	}{values: make(map[string]bool)}
+)
+
+// RegisterSecrets adds values (e.g., protected settings) to be masked in every sanitized string
+func RegisterSecrets(values ...string) {
+	secrets.Lock()
+	defer secrets.Unlock()
+	for _, v := range values {
+		if len(v) >= minSecretLength {
+			secrets.values[v] = true
+		}
+	}
+}
+
+// Sanitize masks registered secrets and SAS signatures, strips the query of urls and caps the length of s
+func Sanitize(s string) string {
+	secrets.RLock()
+	for v := range secrets.values {
+		s = strings.ReplaceAll(s, v, mask)
+	}
+	secrets.RUnlock()
+
+	s = urlQueryRegex.ReplaceAllString(s, "$1")
+	s = sasSignatureRegex.ReplaceAllString(s, "${1}"+mask)
+
+	if len(s) > maxValueLength {
+		s = s[:maxValueLength] + fmt.Sprintf("...(%d bytes truncated)", len(s)-maxValueLength)
+	}
+	return s
+}
+
+// NewLogger returns a logger sanitizing every textual value before passing it to next
+func NewLogger(next log.Logger) log.Logger {
+	return log.LoggerFunc(func(keyvals ...interface{}) error {
+		sanitized := make([]interface{}, len(keyvals))
+		copy(sanitized, keyvals)
+		for i := 1; i < len(sanitized); i += 2 {
+			switch v := sanitized[i].(type) {
+			case string:
+				sanitized[i] = Sanitize(v)
+			case error:
+				sanitized[i] = Sanitize(v.Error())
+			case fmt.Stringer:
+				sanitized[i] = Sanitize(v.String())
+			}
+		}
+		return next.Log(sanitized...)
+	})
+}
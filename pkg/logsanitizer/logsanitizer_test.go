@@ -0,0 +1,41 @@
+package logsanitizer
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_sanitizeStripsUrlQuery(t *testing.T) {
+	s := Sanitize("failed to download https://account.blob.core.windows.net/container/script.sh?sv=2020-08-04&sig=abc%2Fdef returned 403")
+	require.Equal(t, "failed to download https://account.blob.core.windows.net/container/script.sh returned 403", s)
+}
+
+func Test_sanitizeMasksSasSignature(t *testing.T) {
+	s := Sanitize("token sv=2020-08-04&ss=b&sig=abc%2Fdef&se=2030")
+	require.Equal(t, "token sv=2020-08-04&ss=b&sig=***&se=2030", s)
+}
+
+func Test_sanitizeMasksRegisteredSecrets(t *testing.T) {
+	RegisterSecrets("", "1", "P@ssw0rd!")
+	require.Equal(t, "password is *** and count is 1", Sanitize("password is P@ssw0rd! and count is 1"))
+}
+
+func Test_sanitizeCapsLength(t *testing.T) {
+	s := Sanitize(strings.Repeat("a", maxValueLength+10))
+	require.True(t, strings.HasPrefix(s, strings.Repeat("a", maxValueLength)))
+	require.True(t, strings.HasSuffix(s, "...(10 bytes truncated)"))
+}
+
+func Test_loggerSanitizesValues(t *testing.T) {
+	RegisterSecrets("supersecret")
+	var buf bytes.Buffer
+	ctx := log.NewContext(NewLogger(log.NewLogfmtLogger(&buf)))
+
+	ctx.Log("message", "using supersecret", "error", errors.New("GET https://host/blob?sig=xyz failed"), "count", 3)
+	require.Equal(t, "message=\"using ***\" error=\"GET https://host/blob failed\" count=3\n", buf.String())
+}
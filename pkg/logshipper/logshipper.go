@@ -0,0 +1,131 @@
+// Package logshipper ships the output of the scripts to a Log Analytics workspace, in batches retried on transient
+// failures, so operators can query the output of the run commands centrally.
+package logshipper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultMaxBatchBytes bounds the size of a batch, well below the 1MB limit of a request of the Logs Ingestion API
+	DefaultMaxBatchBytes = 512 * 1024
+
+	// DefaultMaxRetries is the number of times a batch is retried on a transient failure
+	DefaultMaxRetries = 4
+
+	// initialRetryDelay is the delay before the first retry, doubled for every subsequent one
+	initialRetryDelay = 2 * time.Second
+
+	// requestTimeout bounds every request sent to the workspace
+	requestTimeout = 30 * time.Second
+)
+
+// Record is a line of output of a script
+type Record struct {
+	TimeGenerated string `json:"TimeGenerated"`
+	Computer      string `json:"Computer"`
+	ExtensionName string `json:"ExtensionName"`
+	SeqNum        int    `json:"SeqNum"`
+	Stream        string `json:"Stream"`
+	Line          string `json:"Line"`
+}
+
+// Sender sends a batch of records to a workspace
+type Sender interface {
+	Send(ctx context.Context, body []byte) error
+}
+
+// statusError is returned for a request rejected by the workspace
+type statusError struct {
+	statusCode int
+	body       string
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d: %s", e.statusCode, e.body)
+}
+
+// retryable returns whether a failed request may succeed if sent again: throttling, server errors, and errors
+// without a response (e.g., a timeout)
+func retryable(err error) bool {
+	if se, ok := errors.Cause(err).(statusError); ok {
+		return se.statusCode == http.StatusTooManyRequests || se.statusCode == http.StatusRequestTimeout || se.statusCode >= 500
+	}
+	return true
+}
+
+// Shipper batches the records added to it and sends them with its sender. The batches are sent as they fill up and
+// when flushed. A batch failing after the retries is dropped, the failures are counted to be reported.
+type Shipper struct {
+	sender        Sender
+	maxBatchBytes int
+	maxRetries    int
+	sleep         func(d time.Duration)
+
+	batch     []Record
+	batchSize int
+
+	// Records sent and dropped, and the last error dropping records
+	Sent      int
+	Dropped   int
+	LastError error
+}
+
+// NewShipper returns a shipper sending its batches with sender
+func NewShipper(sender Sender) *Shipper {
+	return &Shipper{sender: sender, maxBatchBytes: DefaultMaxBatchBytes, maxRetries: DefaultMaxRetries, sleep: time.Sleep}
+}
+
+// Add adds a record to the batch, sending the batch first if the record doesn't fit in it
+func (s *Shipper) Add(ctx context.Context, r Record) {
+	size := recordSize(r)
+	if len(s.batch) > 0 && s.batchSize+size > s.maxBatchBytes {
+		s.Flush(ctx)
+	}
+	s.batch = append(s.batch, r)
+	s.batchSize += size
+}
+
+// Flush sends the batch
+func (s *Shipper) Flush(ctx context.Context) {
+	if len(s.batch) == 0 {
+		return
+	}
+	batch := s.batch
+	s.batch, s.batchSize = nil, 0
+
+	body, err := json.Marshal(batch)
+	if err == nil {
+		err = s.send(ctx, body)
+	}
+	if err != nil {
+		s.Dropped += len(batch)
+		s.LastError = err
+		return
+	}
+	s.Sent += len(batch)
+}
+
+func (s *Shipper) send(ctx context.Context, body []byte) error {
+	delay := initialRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := s.sender.Send(ctx, body)
+		if err == nil || attempt == s.maxRetries || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		s.sleep(delay)
+		delay *= 2
+	}
+}
+
+// recordSize returns the size of the record serialized in a batch
+func recordSize(r Record) int {
+	b, _ := json.Marshal(r)
+	return len(b) + 1
+}
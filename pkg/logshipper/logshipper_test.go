@@ -0,0 +1,104 @@
+package logshipper
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSender struct {
+	batches [][]Record
+	errs    []error
+}
+
+func (f *fakeSender) Send(ctx context.Context, body []byte) error {
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		if err != nil {
+			return err
+		}
+	}
+	var batch []Record
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return err
+	}
+	f.batches = append(f.batches, batch)
+	return nil
+}
+
+func newTestShipper(sender Sender, sleeps *[]time.Duration) *Shipper {
+	s := NewShipper(sender)
+	s.sleep = func(d time.Duration) { *sleeps = append(*sleeps, d) }
+	return s
+}
+
+func Test_shipperBatchesBySize(t *testing.T) {
+	sender := &fakeSender{}
+	var sleeps []time.Duration
+	s := newTestShipper(sender, &sleeps)
+	record := Record{Stream: "stdout", Line: "hello"}
+	s.maxBatchBytes = 2 * recordSize(record)
+
+	for i := 0; i < 5; i++ {
+		s.Add(context.Background(), record)
+	}
+	require.Len(t, sender.batches, 2, "full batches are sent as records are added")
+	s.Flush(context.Background())
+	require.Len(t, sender.batches, 3)
+	require.Len(t, sender.batches[2], 1)
+	require.Equal(t, 5, s.Sent)
+	require.Equal(t, 0, s.Dropped)
+
+	s.Flush(context.Background())
+	require.Len(t, sender.batches, 3, "an empty batch is not sent")
+}
+
+func Test_shipperRetriesTransientFailures(t *testing.T) {
+	sender := &fakeSender{errs: []error{statusError{statusCode: http.StatusTooManyRequests}, statusError{statusCode: http.StatusServiceUnavailable}}}
+	var sleeps []time.Duration
+	s := newTestShipper(sender, &sleeps)
+
+	s.Add(context.Background(), Record{Line: "hello"})
+	s.Flush(context.Background())
+	require.Len(t, sender.batches, 1)
+	require.Equal(t, 1, s.Sent)
+	require.Equal(t, []time.Duration{2 * time.Second, 4 * time.Second}, sleeps)
+}
+
+func Test_shipperDropsBatchOnPermanentFailure(t *testing.T) {
+	sender := &fakeSender{errs: []error{statusError{statusCode: http.StatusForbidden, body: "forbidden"}}}
+	var sleeps []time.Duration
+	s := newTestShipper(sender, &sleeps)
+
+	s.Add(context.Background(), Record{Line: "hello"})
+	s.Add(context.Background(), Record{Line: "world"})
+	s.Flush(context.Background())
+	require.Empty(t, sender.batches)
+	require.Empty(t, sleeps, "a rejected batch is not retried")
+	require.Equal(t, 2, s.Dropped)
+	require.EqualError(t, s.LastError, "unexpected status code 403: forbidden")
+
+	// The next batch is sent
+	s.Add(context.Background(), Record{Line: "again"})
+	s.Flush(context.Background())
+	require.Len(t, sender.batches, 1)
+	require.Equal(t, 1, s.Sent)
+}
+
+func Test_shipperGivesUpAfterRetries(t *testing.T) {
+	failure := statusError{statusCode: http.StatusInternalServerError}
+	sender := &fakeSender{errs: []error{failure, failure, failure, failure, failure}}
+	var sleeps []time.Duration
+	s := newTestShipper(sender, &sleeps)
+
+	s.Add(context.Background(), Record{Line: "hello"})
+	s.Flush(context.Background())
+	require.Empty(t, sender.batches)
+	require.Len(t, sleeps, DefaultMaxRetries)
+	require.Equal(t, 1, s.Dropped)
+}
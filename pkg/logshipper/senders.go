@@ -0,0 +1,70 @@
+package logshipper
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// logsIngestionAPIVersion is the version of the Logs Ingestion API, authenticated with a token through a data
+	// collection rule
+	logsIngestionAPIVersion = "2023-01-01"
+
+	// maxErrorBodyLen bounds the response body reported in the error of a rejected request
+	maxErrorBodyLen = 512
+)
+
+// TokenFunc returns a bearer token for the Logs Ingestion API (e.g., of a managed identity)
+type TokenFunc func(ctx context.Context) (string, error)
+
+// ingestionSender sends the records with the Logs Ingestion API
+type ingestionSender struct {
+	endpoint string
+	token    TokenFunc
+	client   *http.Client
+}
+
+// NewIngestionSender returns a sender authenticated with a token, sending the records to the stream of the data
+// collection rule through the data collection endpoint
+func NewIngestionSender(dataCollectionEndpoint string, ruleID string, streamName string, token TokenFunc) Sender {
+	return &ingestionSender{
+		endpoint: fmt.Sprintf("%s/dataCollectionRules/%s/streams/%s?api-version=%s",
+			strings.TrimSuffix(dataCollectionEndpoint, "/"), url.PathEscape(ruleID), url.PathEscape(streamName), logsIngestionAPIVersion),
+		token:  token,
+		client: &http.Client{Timeout: requestTimeout},
+	}
+}
+
+func (s *ingestionSender) Send(ctx context.Context, body []byte) error {
+	token, err := s.token(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get a token for the workspace")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	return do(s.client, req)
+}
+
+func do(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyLen))
+	return statusError{statusCode: resp.StatusCode, body: strings.TrimSpace(string(b))}
+}
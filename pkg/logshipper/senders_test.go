@@ -0,0 +1,26 @@
+package logshipper
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ingestionSenderAuthenticatesWithToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/dataCollectionRules/dcr-1/streams/Custom-Output", r.URL.Path)
+		require.Equal(t, "2023-01-01", r.URL.Query().Get("api-version"))
+		require.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("throttled"))
+	}))
+	defer server.Close()
+
+	sender := NewIngestionSender(server.URL+"/", "dcr-1", "Custom-Output", func(ctx context.Context) (string, error) { return "token", nil })
+	err := sender.Send(context.Background(), []byte(`[]`))
+	require.EqualError(t, err, "unexpected status code 429: throttled")
+	require.True(t, retryable(err))
+}
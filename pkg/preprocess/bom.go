@@ -2,6 +2,7 @@ package preprocess
 
 import (
 	"bytes"
+	"unicode/utf8"
 
 	"golang.org/x/text/encoding/unicode"
 )
@@ -42,3 +43,27 @@ func encodeToUTF8(b []byte) []byte {
 	}
 	return utf8Bytes // decoded from utf16
 }
+
+// Encodings reported by DetectEncoding
+const (
+	EncodingUTF8    = "UTF-8"
+	EncodingUTF8BOM = "UTF-8 with BOM"
+	EncodingUTF16LE = "UTF-16LE with BOM"
+	EncodingUTF16BE = "UTF-16BE with BOM"
+	EncodingNotUTF8 = "not UTF-8"
+)
+
+// DetectEncoding returns the encoding of the provided text, detected from its
+// BOM or, without a BOM, from whether it is valid UTF-8.
+func DetectEncoding(b []byte) string {
+	encodings := []string{EncodingUTF8BOM, EncodingUTF16LE, EncodingUTF16BE} // in the order of bomSequences
+	for i, bs := range bomSequences {
+		if bytes.HasPrefix(b, bs) {
+			return encodings[i]
+		}
+	}
+	if utf8.Valid(b) {
+		return EncodingUTF8
+	}
+	return EncodingNotUTF8
+}
@@ -70,3 +70,17 @@ func Test_encodeToUTF8_returnsSameSliceOnFailure(t *testing.T) {
 	b := encodeToUTF8(s)
 	require.Equal(t, s, b)
 }
+
+func TestDetectEncoding(t *testing.T) {
+	for f, encoding := range map[string]string{
+		"utf8_without_bom.sh":             EncodingUTF8,
+		"utf8_with_bom.sh":                EncodingUTF8BOM,
+		"utf16_little_endian_with_bom.sh": EncodingUTF16LE,
+		"utf16_big_endian_with_bom.sh":    EncodingUTF16BE,
+		"mslogo.png":                      EncodingNotUTF8,
+	} {
+		b, err := os.ReadFile(filepath.Join(testDataDir, f))
+		require.Nil(t, err)
+		require.Equal(t, encoding, DetectEncoding(b), f)
+	}
+}
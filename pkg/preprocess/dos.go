@@ -13,3 +13,8 @@ var (
 func Dos2Unix(b []byte) []byte {
 	return bytes.Replace(b, dosLineEndings, unixLineEndings, -1)
 }
+
+// CountDOSLineEndings returns the number of DOS-line endings in given contents
+func CountDOSLineEndings(b []byte) int {
+	return bytes.Count(b, dosLineEndings)
+}
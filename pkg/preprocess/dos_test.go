@@ -33,3 +33,8 @@ func TestDos2UnixFiles(t *testing.T) {
 		require.False(t, bytes.Contains(n, dosLineEndings), "output of %s still contains DOS line endings: %v ", fn, n)
 	}
 }
+
+func TestCountDOSLineEndings(t *testing.T) {
+	require.Equal(t, 4, CountDOSLineEndings([]byte("\r\nLine1\nLine2\r\nLine3\r\n\r\n.")))
+	require.Equal(t, 0, CountDOSLineEndings([]byte("Line1\nLine2\r")))
+}
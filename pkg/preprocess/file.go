@@ -59,3 +59,25 @@ func hasTextExtension(path string) bool {
 	}
 	return false
 }
+
+// AddShebang prepends a shebang running the given interpreter to provided
+// file contents, unless they already start with one.
+func AddShebang(b []byte, interpreter string) []byte {
+	if hasShebang(b) {
+		return b
+	}
+	return append([]byte("#!"+interpreter+"\n"), b...)
+}
+
+// Shebang returns the interpreter line of provided file contents, e.g.,
+// "/usr/bin/env python3", if they start with a shebang.
+func Shebang(b []byte) (string, bool) {
+	if !hasShebang(b) {
+		return "", false
+	}
+	line := RemoveBOM(b)[2:]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	return strings.TrimSpace(string(line)), true
+}
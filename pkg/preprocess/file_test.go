@@ -48,3 +48,22 @@ func TestIsTextFile(t *testing.T) {
 		require.Equal(t, exp, out, "IsTextFile(%s)", f)
 	}
 }
+
+func TestAddShebang(t *testing.T) {
+	require.Equal(t, "#!/bin/bash\necho hi\n", string(AddShebang([]byte("echo hi\n"), "/bin/bash")))
+	require.Equal(t, "#!/bin/sh\necho hi\n", string(AddShebang([]byte("#!/bin/sh\necho hi\n"), "/bin/bash")))
+	require.Equal(t, "#!/bin/bash\n", string(AddShebang(nil, "/bin/bash")))
+}
+
+func TestShebang(t *testing.T) {
+	interpreter, ok := Shebang([]byte("#! /usr/bin/env python3\r\nprint(1)\n"))
+	require.True(t, ok)
+	require.Equal(t, "/usr/bin/env python3", interpreter)
+
+	interpreter, ok = Shebang([]byte("\xef\xbb\xbf#!/bin/sh"))
+	require.True(t, ok)
+	require.Equal(t, "/bin/sh", interpreter)
+
+	_, ok = Shebang([]byte("echo hi\n"))
+	require.False(t, ok)
+}
@@ -0,0 +1,170 @@
+// Package requestheaders stamps every outbound HTTP request of the handler with a consistent User-Agent,
+// including the handler version and the operation ID, and with the extra headers configured on the machine.
+// This lets the server side attribute throttling and trace requests to a handler operation.
+package requestheaders
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/run-command-handler-linux/internal/constants"
+	"github.com/Azure/run-command-handler-linux/pkg/logsanitizer"
+	"github.com/Azure/run-command-handler-linux/pkg/versionutil"
+	"github.com/go-kit/kit/log"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const userAgentHeaderName = "User-Agent"
+
+var (
+	mutex        sync.RWMutex
+	operationID  string
+	extraHeaders map[string]string
+)
+
+// InitializeFromEnvironment generates the operation ID of this process and reads the extra headers from the
+// environment. Invalid headers are logged and ignored. It returns the operation ID so it can be logged.
+func InitializeFromEnvironment(ctx *log.Context) string {
+	headers, err := Parse(os.Getenv(constants.RequestHeadersEnvName), constants.RequestHeadersEnvName)
+	if err != nil {
+		ctx.Log("warning", "extra request headers will not be added", "error", err)
+		headers = nil
+	}
+
+	id := uuid.New().String()
+	Initialize(id, headers)
+	return id
+}
+
+// ReloadFromEnvironment reads the extra headers from the environment again, keeping the operation ID. Invalid
+// headers are logged and the current ones are kept.
+func ReloadFromEnvironment(ctx *log.Context) {
+	headers, err := Parse(os.Getenv(constants.RequestHeadersEnvName), constants.RequestHeadersEnvName)
+	if err != nil {
+		ctx.Log("warning", "keeping the current extra request headers", "error", err)
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	extraHeaders = headers
+}
+
+// Initialize sets the operation ID and the extra headers added to the requests
+func Initialize(id string, headers map[string]string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	operationID = id
+	extraHeaders = headers
+}
+
+// OperationID returns the operation ID of this process, empty if not initialized
+func OperationID() string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return operationID
+}
+
+// UserAgent returns the User-Agent of the handler, e.g.,
+// "Microsoft.CPlat.Core.RunCommandHandlerLinux/1.3.2 (operationId 2f1c...)"
+func UserAgent() string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return userAgent()
+}
+
+func userAgent() string {
+	if operationID == "" {
+		return fmt.Sprintf("%s/%s", constants.RunCommandHandlerName, versionutil.Version)
+	}
+	return fmt.Sprintf("%s/%s (operationId %s)", constants.RunCommandHandlerName, versionutil.Version, operationID)
+}
+
+// Apply adds the User-Agent of the handler in front of the User-Agent of req, if any, and the extra
+// headers that req does not set already
+func Apply(req *http.Request) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	ua := userAgent()
+	if existing := req.Header.Get(userAgentHeaderName); existing != "" {
+		ua += " " + existing
+	}
+	req.Header.Set(userAgentHeaderName, ua)
+
+	for name, value := range extraHeaders {
+		if req.Header.Get(name) == "" {
+			req.Header.Set(name, value)
+		}
+	}
+}
+
+// transport applies the headers to the requests before sending them with the base transport
+type transport struct {
+	base http.RoundTripper
+}
+
+// NewTransport returns a transport adding the headers to the requests sent with base
+func NewTransport(base http.RoundTripper) http.RoundTripper {
+	return transport{base: base}
+}
+
+func (t transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A transport must not modify the request it is given
+	req = req.Clone(req.Context())
+	Apply(req)
+	return t.base.RoundTrip(req)
+}
+
+// azurePolicy applies the headers to the requests of the Azure SDK clients
+type azurePolicy struct{}
+
+// NewPolicy returns a per call policy for Azure SDK clients adding the headers to the requests. It must
+// run after the telemetry policy of the SDK so the User-Agent of the SDK is kept.
+func NewPolicy() policy.Policy {
+	return azurePolicy{}
+}
+
+func (azurePolicy) Do(req *policy.Request) (*http.Response, error) {
+	Apply(req.Raw())
+	return req.Next()
+}
+
+// ApplyToStorageClient adds the headers to the requests of the legacy storage client
+func ApplyToStorageClient(client *storage.Client) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	client.AddToUserAgent(userAgent())
+	if len(extraHeaders) > 0 {
+		client.AddAdditionalHeaders(extraHeaders)
+	}
+}
+
+// Parse parses headers given as "Name1=value1;Name2=value2" in the given setting. The values are never logged.
+func Parse(value string, setting string) (map[string]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	headers := make(map[string]string)
+	for _, header := range strings.Split(value, ";") {
+		if strings.TrimSpace(header) == "" {
+			continue
+		}
+		name, headerValue, found := strings.Cut(header, "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, errors.Errorf("invalid header in %v, expected Name=value", setting)
+		}
+		headers[name] = strings.TrimSpace(headerValue)
+		logsanitizer.RegisterSecrets(headers[name])
+	}
+	return headers, nil
+}
@@ -0,0 +1,72 @@
+package requestheaders
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Azure/run-command-handler-linux/pkg/versionutil"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_userAgentIncludesVersionAndOperationID(t *testing.T) {
+	defer Initialize("", nil)
+	versionutil.Initialize("1.3.2", "", "", "")
+	defer versionutil.Initialize("", "", "", "")
+
+	require.Equal(t, "Microsoft.CPlat.Core.RunCommandHandlerLinux/1.3.2", UserAgent())
+
+	Initialize("op1", nil)
+	require.Equal(t, "Microsoft.CPlat.Core.RunCommandHandlerLinux/1.3.2 (operationId op1)", UserAgent())
+	require.Equal(t, "op1", OperationID())
+}
+
+func Test_applyKeepsExistingHeaders(t *testing.T) {
+	defer Initialize("", nil)
+	Initialize("op1", map[string]string{"x-ms-correlation-id": "abc", "Authorization": "extra"})
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost", nil)
+	require.Nil(t, err)
+	req.Header.Set("User-Agent", "azsdk-go/1.0")
+	req.Header.Set("Authorization", "Bearer token")
+	Apply(req)
+
+	require.Equal(t, UserAgent()+" azsdk-go/1.0", req.Header.Get("User-Agent"))
+	require.Equal(t, "abc", req.Header.Get("x-ms-correlation-id"))
+	require.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+}
+
+func Test_transportAddsHeaders(t *testing.T) {
+	defer Initialize("", nil)
+	Initialize("op1", map[string]string{"x-ms-correlation-id": "abc"})
+
+	var received http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: NewTransport(http.DefaultTransport)}
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	require.Nil(t, err)
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+
+	require.Equal(t, UserAgent(), received.Get("User-Agent"))
+	require.Equal(t, "abc", received.Get("x-ms-correlation-id"))
+	require.Empty(t, req.Header.Get("x-ms-correlation-id"), "the original request must not be modified")
+}
+
+func Test_parse(t *testing.T) {
+	headers, err := Parse("", "setting")
+	require.Nil(t, err)
+	require.Nil(t, headers)
+
+	headers, err = Parse("traceparent=00-abc-01; x-ms-correlation-id = 123;", "setting")
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"traceparent": "00-abc-01", "x-ms-correlation-id": "123"}, headers)
+
+	_, err = Parse("novalue", "setting")
+	require.EqualError(t, err, "invalid header in setting, expected Name=value")
+}
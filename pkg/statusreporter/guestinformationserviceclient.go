@@ -4,26 +4,81 @@
 package statusreporter
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/Azure/run-command-handler-linux/internal/constants"
 	"github.com/pkg/errors"
 )
 
+const defaultTimeout = 30 * time.Second
+
 type IGuestInformationServiceClient interface {
 	ReportStatus(statusToUpload string) (*http.Response, error)
 	GetEndpoint() string
 }
 
+// ClientOptions changes how the status is sent to the endpoint
+type ClientOptions struct {
+	// Headers are added to every request (e.g., the authentication headers required by the endpoint)
+	Headers map[string]string
+
+	// CACertFile is a PEM file with certificates to trust for HTTPS endpoints, in addition to the system ones
+	CACertFile string
+
+	// InsecureSkipVerify disables the validation of the certificate of HTTPS endpoints. Only meant for testing.
+	InsecureSkipVerify bool
+
+	// Timeout bounds each request. Defaults to 30 seconds.
+	Timeout time.Duration
+}
+
 type GuestInformationServiceClient struct {
-	Endpoint string
+	Endpoint   string
+	headers    map[string]string
+	httpClient *http.Client
 }
 
 func NewGuestInformationServiceClient(e string) GuestInformationServiceClient {
 	return GuestInformationServiceClient{Endpoint: e}
 }
 
+// NewGuestInformationServiceClientWithOptions returns a client for the given endpoint, which can use HTTP or HTTPS
+func NewGuestInformationServiceClientWithOptions(e string, opts ClientOptions) (GuestInformationServiceClient, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify}
+	if opts.CACertFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(opts.CACertFile)
+		if err != nil {
+			return GuestInformationServiceClient{}, errors.Wrap(err, "failed to read CA certificates")
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return GuestInformationServiceClient{}, errors.Errorf("no valid CA certificates found in %s", opts.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return GuestInformationServiceClient{
+		Endpoint:   e,
+		headers:    opts.Headers,
+		httpClient: &http.Client{Transport: transport, Timeout: timeout},
+	}, nil
+}
+
 func (c GuestInformationServiceClient) GetEndpoint() string {
 	return c.Endpoint
 }
@@ -34,5 +89,5 @@ func (c GuestInformationServiceClient) ReportStatus(statusToUpload string) (*htt
 	}
 
 	putStatusUri := fmt.Sprintf(constants.PutStatusFormatString, c.GetEndpoint())
-	return ReportStatus(putStatusUri, statusToUpload)
+	return reportStatus(c.httpClient, c.headers, putStatusUri, statusToUpload)
 }
@@ -0,0 +1,67 @@
+package statusreporter
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTLSStatusServer(t *testing.T, receivedHeaders *http.Header) *httptest.Server {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*receivedHeaders = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func Test_reportStatusOverHttpsWithCACertFile(t *testing.T) {
+	var headers http.Header
+	srv := newTLSStatusServer(t, &headers)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.Nil(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600))
+
+	client, err := NewGuestInformationServiceClientWithOptions(srv.URL, ClientOptions{
+		CACertFile: caFile,
+		Headers:    map[string]string{"Authorization": "Bearer token"},
+	})
+	require.Nil(t, err)
+
+	resp, err := client.ReportStatus("status")
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "Bearer token", headers.Get("Authorization"))
+	require.Equal(t, "application/json; charset=utf-8", headers.Get("Content-Type"))
+}
+
+func Test_reportStatusOverHttpsValidatesCertificate(t *testing.T) {
+	var headers http.Header
+	srv := newTLSStatusServer(t, &headers)
+
+	client, err := NewGuestInformationServiceClientWithOptions(srv.URL, ClientOptions{})
+	require.Nil(t, err)
+	_, err = client.ReportStatus("status")
+	require.NotNil(t, err, "self-signed certificate should not be trusted")
+
+	client, err = NewGuestInformationServiceClientWithOptions(srv.URL, ClientOptions{InsecureSkipVerify: true})
+	require.Nil(t, err)
+	resp, err := client.ReportStatus("status")
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func Test_newClientWithInvalidCACertFile(t *testing.T) {
+	_, err := NewGuestInformationServiceClientWithOptions("https://localhost", ClientOptions{CACertFile: "/non/existing/ca.pem"})
+	require.NotNil(t, err)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.Nil(t, os.WriteFile(caFile, []byte("not a certificate"), 0600))
+	_, err = NewGuestInformationServiceClientWithOptions("https://localhost", ClientOptions{CACertFile: caFile})
+	require.ErrorContains(t, err, "no valid CA certificates")
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"net/http"
 
+	"github.com/Azure/run-command-handler-linux/pkg/requestheaders"
 	"github.com/pkg/errors"
 )
 
@@ -14,6 +15,11 @@ type PutStatusRequest struct {
 }
 
 func ReportStatus(putStatusEndpoint string, statusToUpload string) (*http.Response, error) {
+	return reportStatus(nil, nil, putStatusEndpoint, statusToUpload)
+}
+
+// reportStatus uploads the status with the given client (a default one if nil) adding the given headers
+func reportStatus(client *http.Client, headers map[string]string, putStatusEndpoint string, statusToUpload string) (*http.Response, error) {
 	// If the statusToUpload is empty, the above call to create the blob will clear out the
 	// contents of the blob and set it to empty. We can return now.
 	if statusToUpload == "" {
@@ -26,17 +32,23 @@ func ReportStatus(putStatusEndpoint string, statusToUpload string) (*http.Respon
 		return nil, errors.Wrap(err, "failed to marshal PutStatusRequest")
 	}
 
-	return uploadData(putStatusEndpoint, serializedRequestContent)
+	return uploadData(client, headers, putStatusEndpoint, serializedRequestContent)
 }
 
-func uploadData(putStatusEndpoint string, serializedRequestContent []byte) (*http.Response, error) {
+func uploadData(client *http.Client, headers map[string]string, putStatusEndpoint string, serializedRequestContent []byte) (*http.Response, error) {
 	req, err := http.NewRequest(http.MethodPut, putStatusEndpoint, bytes.NewBuffer(serializedRequestContent))
 	if err != nil {
 		return nil, errors.Wrap(err, "could not create new http request to send provided content")
 	}
 	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	requestheaders.Apply(req)
 
-	client := &http.Client{}
+	if client == nil {
+		client = &http.Client{}
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to send http request")
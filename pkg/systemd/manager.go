@@ -28,12 +28,19 @@ const (
 )
 
 type Manager struct {
+	// Directory where unit configuration files are stored. When empty, the systemd path found in the system is used
+	configurationBasePath string
 }
 
 func NewUnitManager() *Manager {
 	return &Manager{}
 }
 
+// NewUnitManagerWithConfigurationBasePath returns a manager storing the unit configuration files in the given directory
+func NewUnitManagerWithConfigurationBasePath(configurationBasePath string) *Manager {
+	return &Manager{configurationBasePath: configurationBasePath}
+}
+
 func (mgr *Manager) StartUnit(unitName string, ctx *log.Context) error {
 	ctx.Log("message", "running command to start unit")
 	err := exec.Command(systemctl, systemctl_start, unitName).Run()
@@ -85,7 +92,7 @@ func (mgr *Manager) IsUnitEnabled(unitName string, ctx *log.Context) (bool, erro
 }
 
 func (mgr *Manager) IsUnitInstalled(unitName string, ctx *log.Context) (bool, error) {
-	filePath, err := GetUnitConfigurationFilePath(unitName, ctx)
+	filePath, err := mgr.GetUnitConfigurationFilePath(unitName, ctx)
 	if err != nil {
 		return false, err
 	}
@@ -102,8 +109,8 @@ func (mgr *Manager) IsUnitInstalled(unitName string, ctx *log.Context) (bool, er
 	return true, nil
 }
 
-func (*Manager) CreateUnitConfigurationFile(unitName string, content []byte, ctx *log.Context) error {
-	unitConfigPath, err := GetUnitConfigurationFilePath(unitName, ctx)
+func (mgr *Manager) CreateUnitConfigurationFile(unitName string, content []byte, ctx *log.Context) error {
+	unitConfigPath, err := mgr.GetUnitConfigurationFilePath(unitName, ctx)
 	if err != nil {
 		return err
 	}
@@ -112,8 +119,8 @@ func (*Manager) CreateUnitConfigurationFile(unitName string, content []byte, ctx
 	return os.WriteFile(unitConfigPath, content, unitConfigurationFilePermission)
 }
 
-func (*Manager) RemoveUnitConfigurationFile(unitName string, ctx *log.Context) error {
-	unitConfigPath, err := GetUnitConfigurationFilePath(unitName, ctx)
+func (mgr *Manager) RemoveUnitConfigurationFile(unitName string, ctx *log.Context) error {
+	unitConfigPath, err := mgr.GetUnitConfigurationFilePath(unitName, ctx)
 	if err != nil {
 		return err
 	}
@@ -122,6 +129,14 @@ func (*Manager) RemoveUnitConfigurationFile(unitName string, ctx *log.Context) e
 	return os.Remove(unitConfigPath)
 }
 
+// GetUnitConfigurationFilePath returns the path of the unit configuration file, honoring the configured base path if any
+func (mgr *Manager) GetUnitConfigurationFilePath(unitName string, ctx *log.Context) (string, error) {
+	if mgr.configurationBasePath != "" {
+		return path.Join(mgr.configurationBasePath, unitName), nil
+	}
+	return GetUnitConfigurationFilePath(unitName, ctx)
+}
+
 var GetUnitConfigurationFilePath = func(unitName string, ctx *log.Context) (string, error) {
 	base_path, err := GetSystemDConfigurationBasePath(ctx)
 	if err != nil {